@@ -0,0 +1,226 @@
+// Package access decides which peers the node exchanges packets with.
+// It supports a blocklist mode (everyone except blocked peers) and an allowlist mode (only allowed peers).
+// The lists are persisted to disk so they survive restarts.
+package access
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/strictjson"
+)
+
+type Mode string
+
+const (
+	ModeBlocklist Mode = "blocklist" // All peers except blocked ones are allowed
+	ModeAllowlist Mode = "allowlist" // Only allowed peers are allowed, blocked peers are still denied
+)
+
+// AccessList is thread-safe.
+type AccessList struct {
+	mu       sync.Mutex
+	mode     Mode
+	blocked  map[netip.Addr]bool
+	allowed  map[netip.Addr]bool
+	filePath string // Where the lists are persisted, empty to disable persistence
+}
+
+// accessListFile is the on-disk representation of an AccessList.
+type accessListFile struct {
+	Mode    Mode         `json:"mode"`
+	Blocked []netip.Addr `json:"blocked"`
+	Allowed []netip.Addr `json:"allowed"`
+}
+
+// NewAccessList creates an access list in blocklist mode and loads the persisted lists from filePath if the file exists.
+// filePath may be empty to disable persistence.
+func NewAccessList(filePath string) *AccessList {
+	a := &AccessList{
+		mode:     ModeBlocklist,
+		blocked:  make(map[netip.Addr]bool),
+		allowed:  make(map[netip.Addr]bool),
+		filePath: filePath,
+	}
+
+	if filePath == "" {
+		return a
+	}
+
+	err := a.load()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Warnf("Failed to load access list from %s: %v", filePath, err)
+	}
+
+	return a
+}
+
+// IsAllowed returns whether packets from the address should be processed.
+func (a *AccessList) IsAllowed(addr netip.Addr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.blocked[addr] {
+		return false
+	}
+
+	if a.mode == ModeAllowlist {
+		return a.allowed[addr]
+	}
+
+	return true
+}
+
+// Block adds the address to the blocklist and persists the change.
+func (a *AccessList) Block(addr netip.Addr) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.blocked[addr] = true
+	return a.save()
+}
+
+// Unblock removes the address from the blocklist and persists the change.
+func (a *AccessList) Unblock(addr netip.Addr) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.blocked, addr)
+	return a.save()
+}
+
+// AllowOnly switches to allowlist mode with exactly the given addresses allowed and persists the change.
+func (a *AccessList) AllowOnly(addrs []netip.Addr) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.mode = ModeAllowlist
+	a.allowed = make(map[netip.Addr]bool, len(addrs))
+	for _, addr := range addrs {
+		a.allowed[addr] = true
+	}
+	return a.save()
+}
+
+// AllowAll switches back to blocklist mode and persists the change.
+// The allowlist is cleared.
+func (a *AccessList) AllowAll() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.mode = ModeBlocklist
+	a.allowed = make(map[netip.Addr]bool)
+	return a.save()
+}
+
+// Replace replaces the mode and both lists, e.g. when a configuration is imported, and persists the change.
+func (a *AccessList) Replace(mode Mode, blocked []netip.Addr, allowed []netip.Addr) error {
+	if mode != ModeBlocklist && mode != ModeAllowlist {
+		return errors.New("unknown access list mode: " + string(mode))
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.mode = mode
+	a.blocked = make(map[netip.Addr]bool, len(blocked))
+	for _, addr := range blocked {
+		a.blocked[addr] = true
+	}
+	a.allowed = make(map[netip.Addr]bool, len(allowed))
+	for _, addr := range allowed {
+		a.allowed[addr] = true
+	}
+	return a.save()
+}
+
+// GetMode returns the current mode.
+func (a *AccessList) GetMode() Mode {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.mode
+}
+
+// GetBlocked returns the sorted blocked addresses.
+func (a *AccessList) GetBlocked() []netip.Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return sortedKeys(a.blocked)
+}
+
+// GetAllowed returns the sorted allowed addresses of the allowlist mode.
+func (a *AccessList) GetAllowed() []netip.Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return sortedKeys(a.allowed)
+}
+
+func sortedKeys(set map[netip.Addr]bool) []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(set))
+	for addr := range set {
+		addrs = append(addrs, addr)
+	}
+	slices.SortFunc(addrs, func(a, b netip.Addr) int { return a.Compare(b) })
+	return addrs
+}
+
+// load reads the lists from the file.
+func (a *AccessList) load() error {
+	data, err := os.ReadFile(a.filePath)
+	if err != nil {
+		return err
+	}
+
+	var file accessListFile
+	err = strictjson.Unmarshal(data, &file)
+	if err != nil {
+		return err
+	}
+
+	if file.Mode != ModeBlocklist && file.Mode != ModeAllowlist {
+		return errors.New("unknown access list mode: " + string(file.Mode))
+	}
+
+	a.mode = file.Mode
+	for _, addr := range file.Blocked {
+		a.blocked[addr] = true
+	}
+	for _, addr := range file.Allowed {
+		a.allowed[addr] = true
+	}
+
+	return nil
+}
+
+// save writes the lists to the file.
+// Must be called with a.mu held.
+func (a *AccessList) save() error {
+	if a.filePath == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(accessListFile{
+		Mode:    a.mode,
+		Blocked: sortedKeys(a.blocked),
+		Allowed: sortedKeys(a.allowed),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(a.filePath), 0700)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(a.filePath, data, 0600)
+}
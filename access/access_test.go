@@ -0,0 +1,102 @@
+package access
+
+import (
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestBlocklistMode(t *testing.T) {
+	a := NewAccessList("")
+	peer := netip.MustParseAddr("10.0.0.2")
+	other := netip.MustParseAddr("10.0.0.3")
+
+	if !a.IsAllowed(peer) {
+		t.Errorf("Expected %s to be allowed by default", peer)
+	}
+
+	a.Block(peer)
+	if a.IsAllowed(peer) {
+		t.Errorf("Expected blocked %s to be denied", peer)
+	}
+	if !a.IsAllowed(other) {
+		t.Errorf("Expected %s to be allowed", other)
+	}
+
+	a.Unblock(peer)
+	if !a.IsAllowed(peer) {
+		t.Errorf("Expected unblocked %s to be allowed", peer)
+	}
+}
+
+func TestAllowlistMode(t *testing.T) {
+	a := NewAccessList("")
+	peer := netip.MustParseAddr("10.0.0.2")
+	other := netip.MustParseAddr("10.0.0.3")
+
+	a.AllowOnly([]netip.Addr{peer})
+	if !a.IsAllowed(peer) {
+		t.Errorf("Expected allowed %s to be allowed", peer)
+	}
+	if a.IsAllowed(other) {
+		t.Errorf("Expected %s to be denied in allowlist mode", other)
+	}
+
+	a.Block(peer)
+	if a.IsAllowed(peer) {
+		t.Errorf("Expected blocked %s to be denied even if allowed", peer)
+	}
+
+	a.Unblock(peer)
+	a.AllowAll()
+	if !a.IsAllowed(other) {
+		t.Errorf("Expected %s to be allowed after leaving allowlist mode", other)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "access.json")
+	peer := netip.MustParseAddr("10.0.0.2")
+	allowed := netip.MustParseAddr("10.0.0.4")
+
+	a := NewAccessList(filePath)
+	if err := a.Block(peer); err != nil {
+		t.Fatalf("Block failed: %v", err)
+	}
+	if err := a.AllowOnly([]netip.Addr{allowed}); err != nil {
+		t.Fatalf("AllowOnly failed: %v", err)
+	}
+
+	loaded := NewAccessList(filePath)
+	if loaded.GetMode() != ModeAllowlist {
+		t.Errorf("Expected mode %s after loading, got %s", ModeAllowlist, loaded.GetMode())
+	}
+	if !slices.Equal(loaded.GetBlocked(), []netip.Addr{peer}) {
+		t.Errorf("Expected blocked %v after loading, got %v", []netip.Addr{peer}, loaded.GetBlocked())
+	}
+	if !slices.Equal(loaded.GetAllowed(), []netip.Addr{allowed}) {
+		t.Errorf("Expected allowed %v after loading, got %v", []netip.Addr{allowed}, loaded.GetAllowed())
+	}
+}
+
+func TestReplace(t *testing.T) {
+	a := NewAccessList("")
+	peer := netip.MustParseAddr("10.0.0.2")
+	other := netip.MustParseAddr("10.0.0.3")
+
+	a.Block(peer)
+	if err := a.Replace(ModeAllowlist, []netip.Addr{other}, []netip.Addr{peer}); err != nil {
+		t.Fatalf("Replace failed: %v", err)
+	}
+	if !a.IsAllowed(peer) || a.IsAllowed(other) {
+		t.Errorf("Expected only %s to be allowed after replacing the lists", peer)
+	}
+
+	if err := a.Replace("unknown", nil, nil); err == nil {
+		t.Errorf("Expected error for unknown mode")
+	}
+	if a.GetMode() != ModeAllowlist {
+		t.Errorf("Failed Replace changed the mode to %s", a.GetMode())
+	}
+}
@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/access"
+)
+
+// HandleBlock blocks all packets from a peer or lists the blocked peers if no address is given.
+// Usage: block [<IPv4 address>]
+func HandleBlock(args []string) {
+	if len(args) > 1 {
+		fmt.Println("Usage: block [<IPv4 address>]")
+		return
+	}
+
+	if len(args) == 0 {
+		printAccessList()
+		return
+	}
+
+	addr, err := netip.ParseAddr(args[0])
+	if err != nil || !addr.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	err = accessList.Block(addr)
+	if err != nil {
+		fmt.Printf("Blocked %s, but failed to persist the access list: %v\n", addr, err)
+	} else {
+		fmt.Printf("Blocked %s\n", addr)
+	}
+
+	disconnectDenied(addr)
+}
+
+// HandleUnblock removes a peer from the blocklist.
+// Usage: unblock <IPv4 address>
+func HandleUnblock(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: unblock <IPv4 address>")
+		return
+	}
+
+	addr, err := netip.ParseAddr(args[0])
+	if err != nil || !addr.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	err = accessList.Unblock(addr)
+	if err != nil {
+		fmt.Printf("Unblocked %s, but failed to persist the access list: %v\n", addr, err)
+		return
+	}
+	fmt.Printf("Unblocked %s\n", addr)
+}
+
+// HandleAllowOnly switches to allowlist mode where only the given peers are allowed.
+// "allowonly off" switches back to blocklist mode.
+// Usage: allowonly (<IPv4 address>... | off)
+func HandleAllowOnly(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: allowonly (<IPv4 address>... | off)")
+		return
+	}
+
+	if len(args) == 1 && args[0] == "off" {
+		err := accessList.AllowAll()
+		if err != nil {
+			fmt.Printf("Failed to persist the access list: %v\n", err)
+		}
+		fmt.Println("Allowlist disabled, all peers except blocked ones are allowed.")
+		return
+	}
+
+	addrs := make([]netip.Addr, 0, len(args))
+	for _, arg := range args {
+		addr, err := netip.ParseAddr(arg)
+		if err != nil || !addr.Is4() {
+			fmt.Printf("Invalid IPv4 address: %s\n", arg)
+			return
+		}
+		addrs = append(addrs, addr)
+	}
+
+	err := accessList.AllowOnly(addrs)
+	if err != nil {
+		fmt.Printf("Failed to persist the access list: %v\n", err)
+	}
+	fmt.Printf("Allowlist enabled, only %v are allowed.\n", addrs)
+
+	for neighbor := range router.GetNeighbors() {
+		disconnectDenied(neighbor)
+	}
+}
+
+// disconnectDenied disconnects from the address if it is a neighbor that is no longer allowed.
+func disconnectDenied(addr netip.Addr) {
+	if accessList.IsAllowed(addr) {
+		return
+	}
+
+	if isNeighbor, _ := router.IsNeighbor(addr); !isNeighbor {
+		return
+	}
+
+	doneChan, err := connections.DisconnectNeighbor(addr)
+	if err != nil {
+		fmt.Printf("Error disconnecting from %s: %v\n", addr, err)
+		return
+	}
+
+	go func() {
+		<-doneChan
+		fmt.Printf("Disconnected from denied neighbor %s\n", addr)
+	}()
+}
+
+func printAccessList() {
+	mode := accessList.GetMode()
+	fmt.Printf("Access list mode: %s\n", mode)
+
+	fmt.Printf("Blocked: %v\n", accessList.GetBlocked())
+	if mode == access.ModeAllowlist {
+		fmt.Printf("Allowed: %v\n", accessList.GetAllowed())
+	}
+}
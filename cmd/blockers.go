@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+const blockersUsage = "Usage: blockers [release <IPv4 address> <msg|file>]"
+
+// HandleBlockers lists the message and file sequences currently being sent, or force-unblocks one of them.
+// A sequence whose sending goroutine crashed would otherwise block further messages or files to the peer.
+// Usage: blockers [release <IPv4 address> <msg|file>]
+func HandleBlockers(args []string) {
+	switch {
+	case len(args) == 0:
+		listBlockers()
+	case args[0] == "release" && len(args) == 3:
+		addr, err := netip.ParseAddr(args[1])
+		if err != nil || !addr.Is4() {
+			fmt.Printf("Invalid IPv4 address: %s\n", args[1])
+			return
+		}
+
+		var msgType byte
+		switch args[2] {
+		case "msg":
+			msgType = pkt.MsgTypeChatMessage
+		case "file":
+			msgType = pkt.MsgTypeFileTransfer
+		default:
+			fmt.Println(blockersUsage)
+			return
+		}
+
+		if !outSequencing.ReleaseBlocker(addr, msgType) {
+			fmt.Printf("No %s sequence is being sent to %s\n", args[2], addr)
+			return
+		}
+		fmt.Printf("Released the %s sequence to %s\n", args[2], addr)
+	default:
+		fmt.Println(blockersUsage)
+	}
+}
+
+func listBlockers() {
+	blockers := outSequencing.Blockers()
+	if len(blockers) == 0 {
+		fmt.Println("No sequences are being sent.")
+		return
+	}
+
+	for _, blocker := range blockers {
+		kind := "msg"
+		if blocker.MsgType == pkt.MsgTypeFileTransfer {
+			kind = "file"
+		}
+
+		flags := ""
+		if blocker.Cancelled {
+			flags += " [cancelled]"
+		}
+		if blocker.Aborted {
+			flags += " [aborted]"
+		}
+
+		fmt.Printf("  %s %s by %q for %s%s\n", blocker.Dest, kind, blocker.Owner, time.Since(blocker.Since).Round(time.Second), flags)
+	}
+}
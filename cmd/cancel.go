@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sequencing"
+)
+
+// HandleCancel cancels the message and file transfers currently being sent to a peer.
+// Open acknowledgments of the transfers are dropped and no FIN is sent.
+// Files queued for the peer aren't cancelled, the next one is started (see HandleQueue).
+// Usage: cancel <IPv4 address>
+func HandleCancel(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: cancel <IPv4 address>")
+		return
+	}
+
+	addr, err := netip.ParseAddr(args[0])
+	if err != nil || !addr.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	cancelledMsg := outSequencing.GetSequenceBlocker(addr, pkt.MsgTypeChatMessage).Cancel()
+	cancelledFile := outSequencing.GetSequenceBlocker(addr, pkt.MsgTypeFileTransfer).Cancel()
+
+	if !cancelledMsg && !cancelledFile {
+		fmt.Printf("Nothing is being sent to %s\n", addr)
+	}
+}
+
+// pktNumRange is a contiguous range of packet numbers of a sequence, from and to are inclusive.
+type pktNumRange struct {
+	from uint32
+	to   uint32
+}
+
+// sentPktNums records the packet numbers of a sequence as contiguous ranges.
+// Packet numbers are shared by all sequences to a peer, so the packets of a sequence may be interleaved with packets of other sequences.
+type sentPktNums []pktNumRange
+
+// add records a packet number, packet numbers must be added in increasing order.
+func (s *sentPktNums) add(pktNum [4]byte) {
+	num := binary.BigEndian.Uint32(pktNum[:])
+
+	if n := len(*s); n > 0 && (*s)[n-1].to+1 == num {
+		(*s)[n-1].to = num
+		return
+	}
+	*s = append(*s, pktNumRange{from: num, to: num})
+}
+
+// abort removes the open acknowledgments of all recorded packets, so a cancelled sequence doesn't wait for its ACKs anymore.
+func (s sentPktNums) abort(out *sequencing.OutgoingPktNumHandler, peer netip.Addr) {
+	for _, r := range s {
+		out.AbortSequence(peer, r.from, r.to)
+	}
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// HandleCongestionStats displays the current congestion state and the recent congestion timeline of a peer.
+func HandleCongestionStats(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: ccstats <IPv4 address>")
+		return
+	}
+
+	peerIP, err := netip.ParseAddr(args[0])
+	if err != nil || !peerIP.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	if outSequencing == nil {
+		logger.Warnf("Outgoing sequencing is not initialized.")
+		return
+	}
+
+	stats, exists := outSequencing.GetCongestionStats(peerIP)
+	if !exists {
+		fmt.Printf("No congestion state for %s.\n", peerIP)
+		return
+	}
+
+	phase := "congestion avoidance"
+	if stats.SlowStart {
+		phase = "slow start"
+	}
+
+	fmt.Printf("Congestion state for %s:\n", peerIP)
+	fmt.Printf("  Cwnd: %d, ssthresh: %s, avoidance acc: %d, phase: %s\n", stats.Cwnd, formatSsthresh(stats.Ssthresh), stats.CAvoidanceAcc, phase)
+	fmt.Printf("  Highest contiguous ACK: %d, open ACKs: %d (%d bytes in flight)\n", stats.HighestAckedContiguousPktNum, stats.OpenAcks, stats.InFlightBytes)
+	if stats.RTTSamples > 0 {
+		fmt.Printf("  SRTT: %v, RTT variation: %v (%d samples)\n", stats.SRTT.Round(time.Microsecond), stats.RTTVar.Round(time.Microsecond), stats.RTTSamples)
+	}
+	if histogram, measured := outSequencing.GetRTTHistogram(peerIP); measured {
+		fmt.Printf("  RTT p50: <%v, p99: <%v, max: %v (rtt %s --hist for the distribution)\n", histogram.Percentile(50), histogram.Percentile(99), histogram.Max.Round(time.Microsecond), peerIP)
+	}
+	fmt.Printf("  Unexpected ACKs: %d duplicate, %d late, %d spurious\n", stats.DuplicateAcks, stats.LateAcks, stats.SpuriousAcks)
+	if share, shared := connections.GetFairShare(peerIP); shared {
+		fmt.Printf("  Fair share: %d of %d packets in flight via %s (%d destinations), %d in flight\n", share.Share, share.Budget, share.NextHop, share.Destinations, share.InFlight)
+	}
+
+	if len(stats.Timeline) == 0 {
+		fmt.Println("  No congestion events recorded.")
+		return
+	}
+
+	fmt.Printf("Recent congestion events (oldest first):\n")
+	start := stats.Timeline[0].Time
+	for _, event := range stats.Timeline {
+		fmt.Printf("  +%8.3fs %-9s pkt %-6d cwnd %-5d ssthresh %s\n",
+			event.Time.Sub(start).Seconds(), event.Kind, event.PktNum, event.Cwnd, formatSsthresh(event.Ssthresh))
+	}
+}
+
+// formatSsthresh formats a slow start threshold, showing "inf" for a threshold that has not been set yet.
+func formatSsthresh(ssthresh int64) string {
+	if ssthresh == math.MaxInt64 {
+		return "inf"
+	}
+	return fmt.Sprint(ssthresh)
+}
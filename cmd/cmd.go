@@ -1,18 +1,43 @@
 package cmd
 
 import (
+	"context"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/access"
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/node"
 	"bjoernblessin.de/chatprotogol/routing"
 	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
 	"bjoernblessin.de/chatprotogol/sock"
 )
 
+// The components of the selected node, commands are executed on it.
+// They are only changed by the input loop, goroutines started by commands must not read them.
 var socket sock.Socket
 var router *routing.Router
 var outSequencing *sequencing.OutgoingPktNumHandler
+var accessList *access.AccessList
+var connections *connection.Manager
+var reconstructors *reconstruction.Manager
+
+// setGlobalVars selects the node commands are executed on.
+func setGlobalVars(n *node.Node) {
+	socket = n.Socket
+	router = n.Router
+	outSequencing = n.OutSequencing
+	accessList = n.AccessList
+	connections = n.Connections
+	reconstructors = n.Reconstructors
+}
 
-// SetGlobalVars sets the global socket variable to the provided socket.
-func SetGlobalVars(s sock.Socket, r *routing.Router, out *sequencing.OutgoingPktNumHandler) {
-	socket = s
-	router = r
-	outSequencing = out
+// sleepContext waits for the duration or until ctx is done, in which case it returns the error of ctx.
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	select {
+	case <-time.After(duration):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -7,15 +7,29 @@ import (
 	"strings"
 
 	"bjoernblessin.de/chatprotogol/connection"
-	"bjoernblessin.de/chatprotogol/pkt"
-	"bjoernblessin.de/chatprotogol/sock"
-	"bjoernblessin.de/chatprotogol/util/assert"
-	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
 // HandleConnect processes the "connect" command to establish a connection to a specified IP address and port.
+// If the peer identifies by a node ID instead of its IP address, the node ID follows the address (con <IP address:port> <node ID>).
+// With --via, a relayed connection through a common neighbor is established instead.
 func HandleConnect(args []string) {
-	if len(args) == 1 {
+	if len(args) == 3 && args[0] == "--via" {
+		connectVia(args[1], args[2])
+	} else if len(args) == 2 && strings.Contains(args[0], ":") {
+		addrPort, err := netip.ParseAddrPort(args[0])
+		if err != nil {
+			printUsage()
+			return
+		}
+
+		nodeID, err := netip.ParseAddr(args[1])
+		if err != nil || !nodeID.Is4() {
+			fmt.Printf("Invalid node ID: %s\n", args[1])
+			return
+		}
+
+		connectTo(nodeID, addrPort)
+	} else if len(args) == 1 {
 		if !strings.Contains(args[0], ":") {
 			printUsage()
 			return
@@ -49,53 +63,71 @@ func connect(ipv4String string, portString string) {
 		return
 	}
 
-	if !addr.Is4() {
-		fmt.Printf("The provided IP address is not a valid IPv4 address: %s\n", ipv4String)
+	connectTo(addr, netip.AddrPortFrom(addr, uint16(port)))
+}
+
+// connectTo connects to the peer with the node ID, reached at addrPort.
+// The node ID is the IP address of addrPort unless the peer identifies by a node ID.
+func connectTo(nodeID netip.Addr, addrPort netip.AddrPort) {
+	if !addrPort.Addr().Is4() {
+		fmt.Printf("The provided IP address is not a valid IPv4 address: %s\n", addrPort.Addr())
 		return
 	}
 
-	if isNeighbor, _ := router.IsNeighbor(addr); isNeighbor {
-		fmt.Printf("Already connected to %s\n", addr)
+	if isNeighbor, _ := router.IsNeighbor(nodeID); isNeighbor {
+		fmt.Printf("Already connected to %s\n", nodeID)
 		return
 	}
 
-	addrPort := netip.AddrPortFrom(addr, uint16(port))
-
-	packet := connection.BuildSequencedPacket(pkt.MsgTypeConnect, nil, addr)
+	if !accessList.IsAllowed(nodeID) || !accessList.IsAllowed(addrPort.Addr()) {
+		fmt.Printf("Can't connect to %s: The address is blocked or not allowed.\n", nodeID)
+		return
+	}
 
-	ackChan, err := connection.SendReliablePacketTo(addrPort, packet)
+	_, err := connections.ConnectTo(nodeID, addrPort, connections.BuildConnectPayload())
 	if err != nil {
-		fmt.Printf("Failed to send connect message: %v\n", err)
+		fmt.Printf("Failed to connect to %s: %v\n", addrPort, err)
+	}
+}
+
+// connectVia connects to the target through the relay, which must be a direct neighbor of us and the target.
+// The target becomes a (relayed) neighbor, packets to it are encapsulated and passed on by the relay.
+func connectVia(relayString string, targetString string) {
+	relay, err := netip.ParseAddr(relayString)
+	if err != nil || !relay.Is4() {
+		fmt.Printf("Invalid relay IPv4 address: %s\n", relayString)
 		return
 	}
 
-	go func() {
-		success := <-ackChan
-		if success {
-			handleConnectAck(addrPort, socket)
-		} else {
-			logger.Warnf("Acknowledgment for connection request to %s:%d was not received", addr, port)
-		}
-	}()
-}
+	target, err := netip.ParseAddr(targetString)
+	if err != nil || !target.Is4() {
+		fmt.Printf("Invalid target IPv4 address: %s\n", targetString)
+		return
+	}
 
-func printUsage() {
-	fmt.Println("Usage: con (<IP address> <port> | <IP address:port>) Example: con 10.0.0.2 8080; con 10.0.0.2:8080")
-}
+	if isNeighbor, relayAddrPort := router.IsNeighbor(relay); !isNeighbor || connection.IsRelayedAddrPort(relayAddrPort) {
+		fmt.Printf("The relay %s must be a direct neighbor\n", relay)
+		return
+	}
 
-func handleConnectAck(addrPort netip.AddrPort, socket sock.Socket) {
-	router.AddNeighbor(addrPort)
+	if isNeighbor, _ := router.IsNeighbor(target); isNeighbor {
+		fmt.Printf("Already connected to %s\n", target)
+		return
+	}
 
-	localAddr := socket.MustGetLocalAddress().Addr()
+	if !accessList.IsAllowed(target) {
+		fmt.Printf("Can't connect to %s: The address is blocked or not allowed.\n", target)
+		return
+	}
 
-	localLSA, exists := router.GetLSA(localAddr)
-	assert.Assert(exists, "Local LSA should exist for the local address")
-	connection.FloodLSA(localAddr, localLSA)
+	connections.AddRelay(target, relay)
 
-	err := connection.SendDD(addrPort)
+	_, err = connections.ConnectTo(target, connection.RelayedAddrPort(target), connections.BuildConnectPayload())
 	if err != nil {
-		logger.Warnf("Failed to send database description to %s: %v", addrPort, err)
+		fmt.Printf("Failed to connect to %s via %s: %v\n", target, relay, err)
 	}
+}
 
-	fmt.Printf("Connected to %s\n", addrPort)
+func printUsage() {
+	fmt.Println("Usage: con (<IP address> <port> | <IP address:port> [<node ID>] | --via <relay IP address> <IP address>) Example: con 10.0.0.2 8080; con 10.0.0.2:8080; con 10.0.0.2:8080 172.16.0.7; con --via 10.0.0.3 10.0.0.2")
 }
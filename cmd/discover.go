@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/connection"
+)
+
+const discoverUsage = "Usage: discover [on | auto | off | connect <node ID>]"
+
+// HandleDiscover controls the discovery of nodes on the local network and lists the discovered nodes.
+// "discover on" announces us and discovers other nodes, "discover auto" also connects to discovered nodes the access list allows.
+// "discover connect" connects to a discovered node without typing its address.
+// Usage: discover [on | auto | off | connect <node ID>]
+func HandleDiscover(args []string) {
+	if len(args) == 0 {
+		listDiscoveredPeers()
+		return
+	}
+
+	switch {
+	case len(args) == 1 && (args[0] == "on" || args[0] == "auto"):
+		localAddr, err := socket.GetBoundAddress()
+		if err != nil {
+			fmt.Println("Not initialized, use 'init' first.")
+			return
+		}
+		StartDiscovery(localAddr, args[0] == "auto")
+	case len(args) == 1 && args[0] == "off":
+		connections.StopDiscovery()
+		fmt.Println("Discovery stopped.")
+	case len(args) == 2 && args[0] == "connect":
+		connectDiscovered(args[1])
+	default:
+		fmt.Println(discoverUsage)
+	}
+}
+
+// StartDiscovery announces the selected node, whose socket listens on localAddr, on the local network and discovers other nodes.
+// If autoConnect is set, discovered nodes the access list allows are connected to.
+func StartDiscovery(localAddr netip.AddrPort, autoConnect bool) {
+	var policy func(nodeID netip.Addr) bool
+	if autoConnect {
+		allowed := accessList // Called by the discovery, not the input loop
+		policy = allowed.IsAllowed
+	}
+
+	if err := connections.StartDiscovery(localAddr, policy); err != nil {
+		fmt.Printf("Failed to start discovery: %v\n", err)
+		return
+	}
+
+	if autoConnect {
+		fmt.Println("Discovering nodes on the local network, discovered nodes are connected to automatically.")
+	} else {
+		fmt.Println("Discovering nodes on the local network, list them with 'discover'.")
+	}
+}
+
+func listDiscoveredPeers() {
+	if !connections.IsDiscoveryRunning() {
+		fmt.Println("Discovery is off, start it with 'discover on' or 'discover auto'.")
+		return
+	}
+
+	peers := connections.DiscoveredPeers()
+	if len(peers) == 0 {
+		fmt.Println("No nodes discovered yet.")
+		return
+	}
+
+	fmt.Println("Discovered nodes:")
+	for _, peer := range peers {
+		state := ""
+		if peerState := connections.GetPeerState(peer.NodeID); peerState != connection.PeerDown {
+			state = fmt.Sprintf(" (%s)", peerState)
+		}
+		fmt.Printf("  %s at %s, seen %s ago%s\n", peer.NodeID, peer.AddrPort, time.Since(peer.LastSeen).Round(time.Second), state)
+	}
+}
+
+// connectDiscovered connects to the discovered node with the node ID at the address of its beacon.
+func connectDiscovered(nodeIDString string) {
+	nodeID, err := netip.ParseAddr(nodeIDString)
+	if err != nil || !nodeID.Is4() {
+		fmt.Printf("Invalid node ID: %s\n", nodeIDString)
+		return
+	}
+
+	for _, peer := range connections.DiscoveredPeers() {
+		if peer.NodeID == nodeID {
+			connectTo(peer.NodeID, peer.AddrPort)
+			return
+		}
+	}
+
+	fmt.Printf("%s wasn't discovered, list the discovered nodes with 'discover'.\n", nodeID)
+}
@@ -0,0 +1,243 @@
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// finding is the result of a check of the doctor command.
+type finding struct {
+	problem bool
+	text    string
+	action  string // What the user can do about the problem, empty if there's nothing to do
+}
+
+// HandleDoctor checks the local invariants of the node and prints a finding per check, with what to do about each problem:
+// the socket is open, the routing table is consistent with the LSDB, there are no open acknowledgments of unknown peers,
+// no reconstructors of unreachable peers, no stuck sequence blockers, enough disk space for received files and no leaked timers.
+// Usage: doctor
+func HandleDoctor(args []string) {
+	if len(args) != 0 {
+		fmt.Println("Usage: doctor")
+		return
+	}
+
+	findings := checkSocket()
+	if findings[0].problem {
+		printFindings(findings) // The other checks need the local address
+		return
+	}
+
+	findings = append(findings, checkRoutingTable()...)
+	findings = append(findings, checkOpenAcks()...)
+	findings = append(findings, checkReconstructors()...)
+	findings = append(findings, checkBlockers()...)
+	findings = append(findings, checkDiskSpace())
+	findings = append(findings, checkTimers())
+	printFindings(findings)
+}
+
+func printFindings(findings []finding) {
+	problems := 0
+	for _, f := range findings {
+		if !f.problem {
+			fmt.Printf("[ OK ] %s\n", f.text)
+			continue
+		}
+
+		problems++
+		fmt.Printf("[FAIL] %s\n", f.text)
+		if f.action != "" {
+			fmt.Printf("       -> %s\n", f.action)
+		}
+	}
+
+	if problems == 0 {
+		fmt.Println("No problems found.")
+	} else {
+		fmt.Printf("%d problem(s) found.\n", problems)
+	}
+}
+
+func checkSocket() []finding {
+	boundAddr, err := socket.GetBoundAddress()
+	if err != nil {
+		return []finding{{problem: true, text: "Socket is not open", action: "open it with 'init'"}}
+	}
+
+	findings := []finding{{text: fmt.Sprintf("Socket is open on %s", boundAddr)}}
+	if set, ok := socket.(*sock.SocketSet); ok {
+		for i, member := range set.Members() {
+			if !member.BoundAddr.IsValid() {
+				findings = append(findings, finding{
+					problem: true,
+					text:    fmt.Sprintf("Socket %d of the socket set is closed, its neighbors aren't reachable", i+1),
+					action:  "see 'sockets' and reconnect its neighbors",
+				})
+			}
+		}
+	}
+	return findings
+}
+
+func checkRoutingTable() []finding {
+	problems := router.VerifyRoutingTable()
+	if len(problems) == 0 {
+		return []finding{{text: fmt.Sprintf("Routing table is consistent with the LSDB (%d routes)", len(router.GetRoutingTable()))}}
+	}
+
+	findings := make([]finding, 0, len(problems))
+	for _, problem := range problems {
+		findings = append(findings, finding{
+			problem: true,
+			text:    "Routing table is inconsistent with the LSDB: " + problem,
+			action:  "compare 'lsdb' with 'route'; the table is rebuilt with the next LSA or neighbor change",
+		})
+	}
+	return findings
+}
+
+// isUnknownPeer returns whether the peer is neither routable nor being connected to, so no state should be kept for it.
+func isUnknownPeer(addr netip.Addr) bool {
+	if _, found := router.GetNextHop(addr); found {
+		return false
+	}
+	return connections.GetPeerState(addr) == connection.PeerDown
+}
+
+func checkOpenAcks() []finding {
+	openAcks := outSequencing.GetOpenAcks()
+
+	var findings []finding
+	total := 0
+	for _, addr := range slices.SortedFunc(maps.Keys(openAcks), netip.Addr.Compare) {
+		acks := openAcks[addr]
+		total += len(acks)
+		if isUnknownPeer(addr) {
+			findings = append(findings, finding{
+				problem: true,
+				text:    fmt.Sprintf("%d open ACKs reference the unknown peer %s", len(acks), addr),
+				action:  fmt.Sprintf("they should be removed by the garbage collection within %v, check 'acks' again", common.OPEN_ACK_GC_INTERVAL),
+			})
+		}
+	}
+
+	if len(findings) == 0 {
+		return []finding{{text: fmt.Sprintf("No orphan open ACKs (%d open)", total)}}
+	}
+	return findings
+}
+
+func checkReconstructors() []finding {
+	streams := reconstructors.OpenStreams()
+
+	var findings []finding
+	for _, stream := range streams {
+		if isUnknownPeer(stream.Peer) {
+			findings = append(findings, finding{
+				problem: true,
+				text:    fmt.Sprintf("Receiving a %s from %s, which is unreachable, the transfer can't finish", streamKind(stream.MsgType), stream.Peer),
+				action:  fmt.Sprintf("its state should have been cleared when %s was lost, report it with the output of 'timeline %s'", stream.Peer, stream.Peer),
+			})
+		}
+	}
+
+	if len(findings) == 0 {
+		return []finding{{text: fmt.Sprintf("No orphan reconstructors (%d receiving)", len(streams))}}
+	}
+	return findings
+}
+
+// checkBlockers reports the sequences of unknown peers and the ones that are blocked for a while without any open acknowledgments,
+// their sending goroutine probably stopped without unblocking them.
+func checkBlockers() []finding {
+	blockers := outSequencing.Blockers()
+	openAcks := outSequencing.GetOpenAcks()
+
+	var findings []finding
+	for _, blocker := range blockers {
+		kind := streamKind(blocker.MsgType)
+		release := fmt.Sprintf("release it with 'blockers release %s %s'", blocker.Dest, kind)
+		age := time.Since(blocker.Since)
+
+		switch {
+		case isUnknownPeer(blocker.Dest):
+			findings = append(findings, finding{
+				problem: true,
+				text:    fmt.Sprintf("The %s sequence to %s is blocked, but %s is unknown", kind, blocker.Dest, blocker.Dest),
+				action:  release,
+			})
+		case len(openAcks[blocker.Dest]) == 0 && age > common.DOCTOR_STALE_BLOCKER_AGE:
+			findings = append(findings, finding{
+				problem: true,
+				text:    fmt.Sprintf("The %s sequence to %s by %q is blocked for %v without open ACKs", kind, blocker.Dest, blocker.Owner, age.Round(time.Second)),
+				action:  release + " if no further packets are sent",
+			})
+		}
+	}
+
+	if len(findings) == 0 {
+		return []finding{{text: fmt.Sprintf("No stuck sequence blockers (%d sending)", len(blockers))}}
+	}
+	return findings
+}
+
+func checkDiskSpace() finding {
+	available, err := reconstruction.AvailableDiskSpace()
+	if err != nil {
+		return finding{text: fmt.Sprintf("Disk space for received files not checked: %v", err)}
+	}
+
+	if available <= common.MIN_FREE_DISK_SPACE_BYTES {
+		return finding{
+			problem: true,
+			text:    fmt.Sprintf("Only %d MiB are available for %s, received files are refused", available>>20, common.RECEIVED_FILES_DIR),
+			action:  fmt.Sprintf("free disk space, %d MiB are kept free", common.MIN_FREE_DISK_SPACE_BYTES>>20),
+		}
+	}
+	return finding{text: fmt.Sprintf("%d MiB available for received files in %s", (available-common.MIN_FREE_DISK_SPACE_BYTES)>>20, common.RECEIVED_FILES_DIR)}
+}
+
+// checkTimers compares the timers on the timer wheel with the timers that should be scheduled:
+// one per open acknowledgment with an active timer and one of the garbage collection.
+// The timers and open acknowledgments aren't read at the same instant, a single finding may be a coincidence.
+func checkTimers() finding {
+	timers, ok := outSequencing.PendingTimers()
+	if !ok {
+		return finding{text: "Timers not checked, the sequencing doesn't use the timer wheel"}
+	}
+
+	expected := 1 // Garbage collection
+	for _, acks := range outSequencing.GetOpenAcks() {
+		for _, ack := range acks {
+			if ack.TimerStatus == "active" {
+				expected++
+			}
+		}
+	}
+
+	if timers > expected {
+		return finding{
+			problem: true,
+			text:    fmt.Sprintf("%d timers are scheduled, but only %d are expected, %d may be leaked", timers, expected, timers-expected),
+			action:  "run 'doctor' again, if the number persists or grows report it with the output of 'acks'",
+		}
+	}
+	return finding{text: fmt.Sprintf("No leaked timers (%d scheduled)", timers)}
+}
+
+func streamKind(msgType byte) string {
+	if msgType == pkt.MsgTypeFileTransfer {
+		return "file"
+	}
+	return "msg"
+}
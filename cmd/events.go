@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/events"
+)
+
+// SubscribeToEvents prints received messages and files, changes of peers and room traffic to the console.
+// Should be called once at startup.
+func SubscribeToEvents() {
+	messages := events.MessageReceived.Subscribe()
+	chunks := events.MessageChunk.Subscribe()
+	files := events.FileReceived.Subscribe()
+	connected := events.PeerConnected.Subscribe()
+	lost := events.PeerLost.Subscribe()
+	discovered := events.PeerDiscovered.Subscribe()
+	aborted := events.TransferAborted.Subscribe()
+	presence := events.PresenceChanged.Subscribe()
+	roomMessages := events.RoomMessage.Subscribe()
+	roomMembership := events.RoomMembership.Subscribe()
+
+	go func() {
+		for {
+			select {
+			case msg := <-messages:
+				printMessage(msg)
+			case chunk := <-chunks:
+				fmt.Printf("MSG %v (receiving): %s\n", chunk.From, chunk.Text)
+			case file := <-files:
+				if filepath.Base(file.Path) != file.OriginalName {
+					fmt.Printf("FILE %v: %s (sent as %q)\n", file.From, file.Path, file.OriginalName)
+				} else {
+					fmt.Printf("FILE %v: %s\n", file.From, file.Path)
+				}
+				fmt.Printf("Transfer summary for %s from %v: %s\n", filepath.Base(file.Path), file.From, file.Summary)
+			case peer := <-connected:
+				if peer.Relay.IsValid() {
+					fmt.Printf("Connected to %s via relay %s\n", peer.Addr, peer.Relay)
+				} else {
+					fmt.Printf("Connected to %s\n", peer.AddrPort)
+				}
+			case peer := <-lost:
+				fmt.Printf("Lost connection to %s\n", peer.Addr)
+			case peer := <-discovered:
+				fmt.Printf("Discovered %s at %s\n", peer.NodeID, peer.AddrPort)
+			case abort := <-aborted:
+				kind := "message"
+				if abort.File {
+					kind = "file"
+				}
+				if abort.Direction == events.Sending {
+					fmt.Printf("%s aborted the %s transfer: %s\n", abort.Peer, kind, abort.Reason)
+				} else {
+					fmt.Printf("Aborted the %s transfer from %s: %s\n", kind, abort.Peer, abort.Reason)
+				}
+			case update := <-presence:
+				if update.Status == "typing" {
+					fmt.Printf("%s is typing...\n", update.From)
+				} else {
+					fmt.Printf("%s is %s\n", update.From, update.Status)
+				}
+			case msg := <-roomMessages:
+				fmt.Printf("ROOM %s %v: %s\n", msg.Room, msg.From, msg.Text)
+			case change := <-roomMembership:
+				printRoomMembership(change)
+			}
+		}
+	}()
+}
+
+// printMessage prints a received message with the time it was sent, its one-way delay and whether it was delayed significantly, reordered or its times aren't corrected for the clock offset to the peer.
+// Only the part of the message that wasn't streamed yet is printed.
+func printMessage(msg events.MessageReceivedEvent) {
+	text := msg.Text[msg.Streamed:]
+
+	if msg.SentAt.IsZero() {
+		fmt.Printf("MSG %v: %s\n", msg.From, text)
+		return
+	}
+
+	var flags string
+	if msg.Delay > common.MESSAGE_DELAY_WARNING_THRESHOLD {
+		flags += " DELAYED"
+	}
+	if msg.Reordered {
+		flags += " OUT OF ORDER"
+	}
+	if !msg.ClockCorrected {
+		flags += " UNSYNCED CLOCK"
+	}
+	if msg.Unreliable {
+		flags += " UNRELIABLE"
+	}
+	fmt.Printf("MSG %v [sent %s, delay %v%s]: %s\n", msg.From, msg.SentAt.Format("15:04:05.000"), msg.Delay.Round(time.Millisecond), flags, text)
+}
@@ -7,12 +7,16 @@ import (
 func HandleExit(args []string) {
 	println("Exiting...")
 
-	disconnectAll()
+	forEachNode(func() {
+		disconnectAll()
+		connections.StopNATTraversal()
+		connections.StopDiscovery()
+	})
 }
 
 func disconnectAll() {
 	for addr := range router.GetNeighbors() {
-		doneChan, err := disconnectFrom(addr)
+		doneChan, err := connections.DisconnectNeighbor(addr)
 		if err != nil {
 			fmt.Printf("Error disconnecting from %s: %v\n", addr, err)
 			continue
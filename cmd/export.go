@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+
+	"bjoernblessin.de/chatprotogol/access"
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/util/strictjson"
+)
+
+// nodeConfigFile is the exported configuration of a node, see HandleExport.
+// The pre-shared key and the node ID aren't exported, the key is a secret and the ID identifies the original node.
+type nodeConfigFile struct {
+	TeamID        byte               `json:"teamId"`
+	Promiscuous   bool               `json:"promiscuous"`
+	HopByHopARQ   bool               `json:"hopByHopArq"`
+	PathRecording bool               `json:"pathRecording"`
+	AccessMode    access.Mode        `json:"accessMode"`
+	Blocked       []netip.Addr       `json:"blocked"`
+	Allowed       []netip.Addr       `json:"allowed"`
+	Neighbors     []neighborEndpoint `json:"neighbors"`
+}
+
+// neighborEndpoint is a neighbor and the address it is reached at.
+type neighborEndpoint struct {
+	Addr     netip.Addr     `json:"addr"` // Node ID of the neighbor, usually the address of AddrPort
+	AddrPort netip.AddrPort `json:"addrPort"`
+}
+
+// HandleExport writes the configuration, the access list and the endpoints of the current neighbors to a JSON file.
+// Usage: export <file>
+func HandleExport(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: export <file>")
+		return
+	}
+
+	config := nodeConfigFile{
+		TeamID:        connections.TeamID(),
+		Promiscuous:   connections.IsPromiscuous(),
+		HopByHopARQ:   connections.IsHopByHopARQEnabled(),
+		PathRecording: connections.IsPathRecordingEnabled(),
+		AccessMode:    accessList.GetMode(),
+		Blocked:       accessList.GetBlocked(),
+		Allowed:       accessList.GetAllowed(),
+		Neighbors:     []neighborEndpoint{},
+	}
+
+	for _, peer := range connections.ConnectedPeers() {
+		if peer.State != connection.PeerEstablishedWaitingDD && peer.State != connection.PeerFull {
+			continue
+		}
+		if connection.IsRelayedAddrPort(peer.AddrPort) {
+			continue // The relay may not be a neighbor of the importing node
+		}
+		config.Neighbors = append(config.Neighbors, neighborEndpoint{Addr: peer.Addr, AddrPort: peer.AddrPort})
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		fmt.Printf("Failed to serialize the configuration: %v\n", err)
+		return
+	}
+
+	err = os.WriteFile(args[0], data, 0600)
+	if err != nil {
+		fmt.Printf("Failed to write %s: %v\n", args[0], err)
+		return
+	}
+
+	fmt.Printf("Exported the configuration and %d neighbors to %s\n", len(config.Neighbors), args[0])
+}
+
+// HandleImport applies a configuration written by HandleExport and connects to its neighbors.
+// The access list is replaced, current neighbors stay connected.
+// Hop-by-hop ARQ applies to the links connected afterwards.
+// Usage: import <file>
+func HandleImport(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: import <file>")
+		return
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Printf("Failed to read %s: %v\n", args[0], err)
+		return
+	}
+
+	var config nodeConfigFile
+	err = strictjson.Unmarshal(data, &config)
+	if err != nil {
+		fmt.Printf("Invalid configuration file %s: %v\n", args[0], err)
+		return
+	}
+
+	err = accessList.Replace(config.AccessMode, config.Blocked, config.Allowed)
+	if err != nil {
+		fmt.Printf("Failed to import the access list: %v\n", err)
+		return
+	}
+
+	if config.TeamID != connections.TeamID() {
+		fmt.Printf("Keeping team %d, the team %d of the file can only be set at startup (%s)\n", connections.TeamID(), config.TeamID, common.TEAM_ID_ENV)
+	}
+	connections.SetPromiscuous(config.Promiscuous)
+	connections.SetHopByHopARQ(config.HopByHopARQ)
+	connections.SetPathRecording(config.PathRecording)
+
+	fmt.Printf("Imported the configuration from %s\n", args[0])
+
+	for _, neighbor := range config.Neighbors {
+		if isNeighbor, _ := router.IsNeighbor(neighbor.Addr); isNeighbor {
+			continue
+		}
+		fmt.Printf("Connecting to %s at %s\n", neighbor.Addr, neighbor.AddrPort)
+		connectTo(neighbor.Addr, neighbor.AddrPort)
+	}
+}
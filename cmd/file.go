@@ -1,73 +1,215 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/netip"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"bjoernblessin.de/chatprotogol/common"
 	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/events"
 	"bjoernblessin.de/chatprotogol/pkt"
 	"bjoernblessin.de/chatprotogol/sequencing"
 	"bjoernblessin.de/chatprotogol/util/logger"
 	"github.com/schollz/progressbar/v3"
 )
 
-func HandleSendFile(args []string) {
-	if len(args) < 2 {
-		println("Usage: file <IPv4 address> <file path>")
-		return
-	}
+// fileTransfer holds the per-peer state of a file transfer.
+// Each peer has its own sequencing, congestion window and progress bar, only the disk reads are shared.
+type fileTransfer struct {
+	connections   *connection.Manager // Of the node sending the file, which stays the same if another node is selected meanwhile
+	outSequencing *sequencing.OutgoingPktNumHandler
+	peerIP        netip.Addr
+	blocker       *sequencing.SequenceBlocker
+	ctx           context.Context // Context of the blocked sequence, cancelled by the cancel command or if the peer becomes unreachable
+	stats         *sequencing.TransferStats
+	chunks        chan []byte // Chunks read from disk, closed after the last chunk
+}
 
-	peerIP, err := netip.ParseAddr(args[0])
-	if err != nil || !peerIP.Is4() {
-		println("Invalid IPv4 address:", args[0])
-		return
+// NewSendFileHandler returns the handler of the file command, which sends a file to one or more peers.
+// If another file is currently being sent to a peer, the file is queued for the peer, see HandleQueue.
+// With "-" as file path, input is read until EOF and sent as a file with a generated name.
+// With --quiet, the console only shows warnings and errors while the file is sent, also if it is queued.
+// input is the rest of the command input, see inputreader.InputReader.Read.
+func NewSendFileHandler(input io.Reader) func(args []string) {
+	return func(args []string) {
+		quiet := len(args) > 0 && args[0] == "--quiet"
+		if quiet {
+			args = args[1:]
+		}
+
+		if len(args) < 2 {
+			println("Usage: file [--quiet] <IPv4 address>[,<IPv4 address>...] <file path | ->")
+			return
+		}
+
+		if args[1] == "-" {
+			defer io.Copy(io.Discard, input) // The input is never executed as commands, also if the file isn't sent
+		}
+
+		peerIPs, err := parsePeerList(args[0])
+		if err != nil {
+			println(err.Error())
+			return
+		}
+
+		filePath := args[1]
+		if filePath == "-" {
+			if quiet {
+				defer logger.Quiet()()
+			}
+			sendInput(peerIPs, input)
+			return
+		}
+
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			fmt.Printf("Failed to get file info for %s: %v\n", args[1], err)
+			return
+		}
+
+		if fileInfo.IsDir() {
+			fmt.Printf("The specified path %s is a directory, not a file.\n", args[1])
+			return
+		}
+
+		transfers := make([]*fileTransfer, 0, len(peerIPs))
+		for _, peerIP := range peerIPs {
+			transfer, err := startFileTransfer(connections, outSequencing, peerIP, fileInfo.Name(), fileInfo.Size())
+			if errors.Is(err, errFileTransferBusy) {
+				position := enqueueFile(connections, outSequencing, peerIP, filePath, quiet)
+				fmt.Printf("Another file is currently being sent to %s, queued %s at position %d\n", peerIP, fileInfo.Name(), position)
+				continue
+			}
+			if err != nil {
+				logger.Warnf("Failed to send metadata packet to %s: %v, cancelling file transfer\n", peerIP, err)
+				continue
+			}
+
+			transfers = append(transfers, transfer)
+		}
+
+		if len(transfers) == 0 {
+			return
+		}
+
+		go sendFile(transfers, filePath, quiet)
 	}
+}
+
+// sendInput streams the input until EOF to the peers as a file with a generated name.
+// The size of the file is unknown to the peers.
+// Blocks until the file is sent, the input is exhausted afterwards anyway.
+func sendInput(peerIPs []netip.Addr, input io.Reader) {
+	name := fmt.Sprintf("stdin-%s.bin", time.Now().Format("20060102-150405"))
 
-	blocker := sequencing.GetSequenceBlocker(peerIP, pkt.MsgTypeFileTransfer)
-	success := blocker.Block()
-	if !success {
-		fmt.Printf("Can't send file to %s: Another file is currently being sent.\n", peerIP)
+	transfers := startFileTransfers(peerIPs, name, -1)
+	if len(transfers) == 0 {
 		return
 	}
 
-	filePath := args[1]
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		fmt.Printf("Failed to get file info for %s: %v\n", args[1], err)
-		blocker.Unblock()
-		return
+	sendFileChunks(transfers, input, name, -1)
+}
+
+// startFileTransfers starts a transfer of the file to each peer and returns the transfers that could be started.
+func startFileTransfers(peerIPs []netip.Addr, name string, size int64) []*fileTransfer {
+	transfers := make([]*fileTransfer, 0, len(peerIPs))
+
+	for _, peerIP := range peerIPs {
+		transfer, err := startFileTransfer(connections, outSequencing, peerIP, name, size)
+		if errors.Is(err, errFileTransferBusy) {
+			fmt.Printf("Can't send file to %s: Another file is currently being sent.\n", peerIP)
+			continue
+		}
+		if err != nil {
+			logger.Warnf("Failed to send metadata packet to %s: %v, cancelling file transfer\n", peerIP, err)
+			continue
+		}
+
+		transfers = append(transfers, transfer)
 	}
 
-	if fileInfo.IsDir() {
-		fmt.Printf("The specified path %s is a directory, not a file.\n", args[1])
-		blocker.Unblock()
-		return
+	return transfers
+}
+
+// errFileTransferBusy is returned by startFileTransfer if another file is currently being sent to the peer.
+var errFileTransferBusy = errors.New("another file is currently being sent")
+
+// startFileTransfer blocks the file sequence to the peer and sends the file name packet.
+// The chunks are sent by sendFileChunks, which unblocks the sequence when the transfer is done.
+// A negative size is sent as unknown.
+func startFileTransfer(connections *connection.Manager, outSequencing *sequencing.OutgoingPktNumHandler, peerIP netip.Addr, name string, size int64) (*fileTransfer, error) {
+	blocker := outSequencing.GetSequenceBlocker(peerIP, pkt.MsgTypeFileTransfer)
+	if !blocker.Block("file " + name) {
+		return nil, errFileTransferBusy
 	}
 
-	packet := connection.BuildSequencedPacket(pkt.MsgTypeFileTransfer, []byte(fileInfo.Name()), peerIP)
-	_, err = connection.SendReliableRoutedPacket(packet)
+	return startBlockedFileTransfer(connections, outSequencing, peerIP, blocker, name, size)
+}
+
+// startBlockedFileTransfer is like startFileTransfer for a file sequence the caller already blocked.
+// The sequence is unblocked if the file name packet can't be sent.
+func startBlockedFileTransfer(connections *connection.Manager, outSequencing *sequencing.OutgoingPktNumHandler, peerIP netip.Addr, blocker *sequencing.SequenceBlocker, name string, size int64) (*fileTransfer, error) {
+	packet := connections.BuildFileNamePacket(name, size, peerIP)
+	_, err := connections.SendReliableRoutedPacket(blocker.Context(), packet)
 	if err != nil {
-		logger.Warnf("Failed to send metadata packet to %s: %v, cancelling file transfer\n", peerIP, err)
 		blocker.Unblock()
-		return
+		return nil, err
 	}
 
-	go sendFileChunks(peerIP, filePath, blocker)
+	return &fileTransfer{
+		connections:   connections,
+		outSequencing: outSequencing,
+		peerIP:        peerIP,
+		blocker:       blocker,
+		ctx:           blocker.Context(),
+		stats:         sequencing.NewTransferStats(),
+		chunks:        make(chan []byte, common.FILE_FANOUT_BUFFER_CHUNKS),
+	}, nil
 }
 
-func sendFileChunks(peerIP netip.Addr, filePath string, blocker *sequencing.SequenceBlocker) {
-	defer blocker.Unblock()
-	logger.SetEnable(false) // Disable logging for faster file transfer
-	defer logger.SetEnable(true)
+// parsePeerList parses a comma separated list of IPv4 addresses.
+// Duplicate addresses are removed.
+func parsePeerList(list string) ([]netip.Addr, error) {
+	peerIPs := make([]netip.Addr, 0)
+
+	for ipString := range strings.SplitSeq(list, ",") {
+		peerIP, err := netip.ParseAddr(ipString)
+		if err != nil || !peerIP.Is4() {
+			return nil, fmt.Errorf("Invalid IPv4 address: %s", ipString)
+		}
+
+		if !slices.Contains(peerIPs, peerIP) {
+			peerIPs = append(peerIPs, peerIP)
+		}
+	}
+
+	return peerIPs, nil
+}
+
+// sendFile sends the file at filePath to all transfers.
+// If quiet is set, the console only shows warnings and errors meanwhile, see logger.Quiet.
+func sendFile(transfers []*fileTransfer, filePath string, quiet bool) {
+	if quiet {
+		defer logger.Quiet()()
+	}
 
 	file, err := os.Open(filePath)
 	if err != nil {
 		fmt.Printf("Failed to open file %s: %v\n", filePath, err)
+		for _, transfer := range transfers {
+			transfer.unblock()
+			transfer.notifySent(filepath.Base(filePath), err)
+		}
 		return
 	}
 	defer file.Close()
@@ -75,11 +217,93 @@ func sendFileChunks(peerIP netip.Addr, filePath string, blocker *sequencing.Sequ
 	fileInfo, err := file.Stat()
 	if err != nil {
 		fmt.Printf("Failed to get file info for %s: %v\n", filePath, err)
+		for _, transfer := range transfers {
+			transfer.unblock()
+			transfer.notifySent(filepath.Base(filePath), err)
+		}
 		return
 	}
 
-	bar := progressbar.NewOptions(int(fileInfo.Size()),
-		progressbar.OptionSetDescription(fmt.Sprintf("Sending %s", fileInfo.Name())),
+	sendFileChunks(transfers, file, fileInfo.Name(), fileInfo.Size())
+}
+
+// sendFileChunks reads the file once and fans the chunks out to all transfers.
+// Every transfer sends its chunks in its own goroutine, so a slow peer only delays the others once its chunk buffer is full.
+// The file is read until EOF, size is only used for the progress and is negative if unknown.
+func sendFileChunks(transfers []*fileTransfer, file io.Reader, name string, size int64) {
+	wg := &sync.WaitGroup{} // Used to wait for all per-peer transfers
+	defer wg.Wait()
+
+	for _, transfer := range transfers {
+		defer close(transfer.chunks)
+	}
+
+	chunkSize := discoverChunkSize(transfers)
+
+	for _, transfer := range transfers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			transfer.sendChunks(name, size)
+		}()
+	}
+
+	for !allCancelled(transfers) {
+		buffer := make([]byte, chunkSize)   // New buffer per chunk because it is shared by all transfers
+		n, err := io.ReadFull(file, buffer) // Fills the chunk also if the file is a pipe that returns less
+		if n == 0 {
+			if err != io.EOF {
+				fmt.Printf("Failed to read file %s: %v\n", name, err)
+			}
+			break
+		}
+
+		for _, transfer := range transfers {
+			transfer.chunks <- buffer[:n]
+		}
+	}
+}
+
+// allCancelled returns whether all transfers were cancelled, so the rest of the file doesn't need to be read.
+func allCancelled(transfers []*fileTransfer) bool {
+	for _, transfer := range transfers {
+		if transfer.ctx.Err() == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// discoverChunkSize returns the largest chunk size that fits the paths to all peers of the transfers.
+// Paths that haven't been probed yet are probed concurrently first.
+func discoverChunkSize(transfers []*fileTransfer) int {
+	limits := make([]int, len(transfers))
+
+	wg := &sync.WaitGroup{}
+	for i, transfer := range transfers {
+		if transfer.connections.HasDiscoveredPathMTU(transfer.peerIP) {
+			limits[i] = transfer.connections.GetMaxPayloadSize(transfer.peerIP)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limits[i] = transfer.connections.DiscoverPathMTU(transfer.peerIP)
+		}()
+	}
+	wg.Wait()
+
+	return slices.Min(limits)
+}
+
+// sendChunks sends all chunks of the transfer channel to the peer followed by the FIN message.
+// The progress bar shows a spinner if the size is unknown (negative).
+func (t *fileTransfer) sendChunks(name string, size int64) {
+	defer t.unblock()
+
+	bar := progressbar.NewOptions64(max(size, -1),
+		progressbar.OptionSetDescription(fmt.Sprintf("Sending %s to %s", name, t.peerIP)),
 		progressbar.OptionShowBytes(true),
 		progressbar.OptionThrottle(65*time.Millisecond),
 		progressbar.OptionOnCompletion(func() {
@@ -87,53 +311,98 @@ func sendFileChunks(peerIP netip.Addr, filePath string, blocker *sequencing.Sequ
 		}),
 	)
 
-	wg := &sync.WaitGroup{} // Used to wait for file chuck ACKs
+	delivery := sequencing.NewDeliveryTracker() // Used to wait for file chunk ACKs
 	var lastChunkPktNum [4]byte
+	var sent sentPktNums
+	var sentBytes atomic.Int64
 
-	buffer := make([]byte, common.MAX_PAYLOAD_SIZE_BYTES)
-	for {
-		n, err := file.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-
-			fmt.Printf("Failed to read file %s: %v\n", file.Name(), err)
+	for chunk := range t.chunks {
+		if t.blocker.IsAborted() || t.ctx.Err() != nil {
+			continue // The receiver rejected or the transfer was cancelled, drain the chunks so the other transfers aren't blocked
 		}
 
-		packet := connection.BuildSequencedPacket(pkt.MsgTypeFileTransfer, buffer[:n], peerIP)
+		packet := t.connections.BuildSequencedPacketShared(pkt.MsgTypeFileTransfer, chunk, t.peerIP) // Chunks are never modified after reading
+		sent.add(packet.Header.PktNum)
 
-		ackChan, err := connection.SendReliableRoutedPacket(packet)
-		for err != nil {
-			logger.Debugf("Failed to send file chunk %v to %s, skipping: %v", packet.Header.PktNum, peerIP, err)
+		ackChan, err := t.connections.SendTrackedRoutedPacket(t.ctx, packet, t.stats)
+		if err != nil {
+			logger.Debugf("Failed to send file chunk %v to %s, skipping: %v", packet.Header.PktNum, t.peerIP, err)
+			delivery.RecordChunk(false)
 			continue
 		}
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			<-ackChan
-			// We ignore the success of the ACK to avoid blocking the send process. The receiver might get a faulty file.
-			bar.Add(n)
-		}()
+		// A chunk that isn't acknowledged doesn't block the send process, the delivery status reports it
+		delivery.TrackChunk(ackChan, func(acked bool) {
+			if acked {
+				t.stats.AddPacket(len(chunk))
+			}
+			bar.Add(len(chunk))
+
+			events.TransferProgress.NotifyObservers(events.TransferProgressEvent{
+				Peer:      t.peerIP,
+				Direction: events.Sending,
+				Name:      name,
+				Bytes:     sentBytes.Add(int64(len(chunk))),
+				Total:     max(size, 0),
+			})
+		})
 
 		lastChunkPktNum = packet.Header.PktNum
 	}
 
+	if t.ctx.Err() != nil {
+		sent.abort(t.outSequencing, t.peerIP) // Don't wait for the ACKs of the sent chunks
+	}
+
 	// Send the FIN message after all chunks have been sent and acknowledged
-	wg.Wait()
+	delivery.Wait()
+
+	if t.ctx.Err() != nil {
+		fmt.Printf("\nFile transfer to %s cancelled\n", t.peerIP)
+		t.notifySent(name, t.ctx.Err())
+		return
+	}
 
 	payload := []byte(lastChunkPktNum[:])
-	packet := connection.BuildSequencedPacket(pkt.MsgTypeFinish, payload, peerIP)
+	packet := t.connections.BuildSequencedPacket(pkt.MsgTypeFinish, payload, t.peerIP)
 
-	ackChan, err := connection.SendReliableRoutedPacket(packet)
-	for err != nil {
-		logger.Debugf("Failed to send finish message to %s: %v\n", peerIP, err)
+	ackChan, err := t.connections.SendReliableRoutedPacket(t.ctx, packet)
+	if err != nil {
+		logger.Debugf("Failed to send finish message to %s: %v\n", t.peerIP, err)
+		t.notifySent(name, err)
 		return
 	}
 
-	<-ackChan
-	// We ignore the success of the ACK to avoid blocking the send process. The receiver might not be ready for a new message but we don't care.
+	delivery.RecordFinish(<-ackChan)
+
+	if t.blocker.IsAborted() {
+		t.notifySent(name, errors.New("aborted by the receiver"))
+		return
+	}
+
+	status := delivery.Status()
+	fmt.Printf("File to %s %s\n", t.peerIP, status)
+	fmt.Printf("Transfer summary for %s to %s: %s\n", name, t.peerIP, t.stats.Snapshot())
+	if !status.Delivered() {
+		t.notifySent(name, fmt.Errorf("file %s", status))
+		return
+	}
+	t.connections.RecordTransfer(pkt.MsgTypeFileTransfer, true)
+	t.notifySent(name, nil)
+}
+
+// unblock ends the file sequence to the peer and starts the next queued file, if any.
+func (t *fileTransfer) unblock() {
+	t.blocker.Unblock()
+	startQueuedFile(t.connections, t.outSequencing, t.peerIP)
+}
 
-	fmt.Printf("File sent\n")
+// notifySent publishes the result of the transfer, err is nil if the file was sent.
+func (t *fileTransfer) notifySent(name string, err error) {
+	events.FileSent.NotifyObservers(events.FileSentEvent{
+		To:      t.peerIP,
+		Name:    name,
+		Summary: t.stats.Snapshot(),
+		Err:     err,
+	})
 }
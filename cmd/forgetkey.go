@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"fmt"
+)
+
+// HandleForgetKey forgets the pinned signing key of a host, e.g. after its operator replaced the key file.
+// Until then CONNECTs and LSAs of the host with the new key are rejected.
+func HandleForgetKey(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: forgetkey <IPv4 address> Example: forgetkey 10.10.10.2")
+		return
+	}
+
+	addr, ok := parseIPv4(args[0])
+	if !ok {
+		return
+	}
+
+	if !connections.ForgetPeerKey(addr) {
+		fmt.Printf("No key pinned for %s\n", addr)
+		return
+	}
+	fmt.Printf("Forgot the key of %s, the next key it announces is pinned\n", addr)
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/connection"
+)
+
+// HandleIngress displays the senders that exceeded their ingress budgets with the dropped packets, resets the drops or toggles auto-blocking.
+// Usage: ingress [reset | autoblock on|off]
+func HandleIngress(args []string) {
+	if len(args) == 2 && args[0] == "autoblock" && (args[1] == "on" || args[1] == "off") {
+		connections.SetIngressAutoBlock(args[1] == "on")
+		fmt.Printf("Auto-blocking %s\n", args[1])
+		return
+	}
+
+	if len(args) == 1 && args[0] == "reset" {
+		connections.ResetIngressStats()
+		fmt.Println("Ingress drops reset")
+		return
+	}
+
+	if len(args) != 0 {
+		fmt.Println("Usage: ingress [reset | autoblock on|off]")
+		return
+	}
+
+	fmt.Printf("Budget per sender: control %d packets/s, %d KiB/s; data %d packets/s, %d KiB/s\n",
+		common.INGRESS_CONTROL_PACKETS_PER_SECOND, common.INGRESS_CONTROL_BYTES_PER_SECOND>>10,
+		common.INGRESS_DATA_PACKETS_PER_SECOND, common.INGRESS_DATA_BYTES_PER_SECOND>>10)
+	if connections.IsIngressAutoBlockEnabled() {
+		fmt.Printf("Auto-blocking on, after %v over budget\n", common.INGRESS_AUTO_BLOCK_AFTER)
+	} else {
+		fmt.Println("Auto-blocking off")
+	}
+
+	stats := connections.IngressStats()
+	if len(stats) == 0 {
+		fmt.Println("No sender exceeded its budget.")
+		return
+	}
+
+	for _, source := range stats {
+		control := source.Drops[connection.IngressControl]
+		data := source.Drops[connection.IngressData]
+		fmt.Printf("%v: dropped %d control (%d bytes), %d data (%d bytes), last %s ago",
+			source.Addr, control.Packets, control.Bytes, data.Packets, data.Bytes, time.Since(source.LastDrop).Round(time.Millisecond))
+		if !source.LimitedSince.IsZero() {
+			fmt.Printf(", limited for %s", time.Since(source.LimitedSince).Round(time.Second))
+		}
+		fmt.Println()
+	}
+}
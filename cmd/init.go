@@ -1,30 +1,29 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/sock"
 )
 
+// HandleInit (re)opens the socket on a local address.
+// The address is given directly, by interface name, or detected automatically.
+// "init auto" picks the first non-loopback address, "init auto <target IP>" picks the address of the interface used to reach the target.
+// Without arguments, the available addresses are listed.
 func HandleInit(args []string) {
-	if len(args) < 1 {
-		fmt.Println("Usage: init <IP address> Example: init 10.8.0.6")
-		return
-	}
-
-	hostIP := net.ParseIP(args[0])
-	if hostIP == nil {
-		fmt.Printf("Invalid IP address: %s\n", args[0])
-		return
-	}
-
-	if hostIP.IsUnspecified() {
-		fmt.Println("The provided IP address is unspecified. Please provide a valid IP address.")
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("Usage: init (<IP address> | <interface name> | auto [<target IP address>]) Example: init 10.8.0.6; init eth0; init auto 10.8.0.1")
+		PrintInterfaceAddresses()
 		return
 	}
 
-	ipv4 := hostIP.To4()
-	if ipv4 == nil {
-		fmt.Printf("The provided IP address is not a valid IPv4 address: %s\n", args[0])
+	hostAddr, err := resolveInitAddress(args)
+	if err != nil {
+		fmt.Println(err.Error())
 		return
 	}
 
@@ -34,13 +33,83 @@ func HandleInit(args []string) {
 		router.RemoveLSA(oldLocalAddr.Addr())
 	}
 
+	connections.StopNATTraversal()
 	socket.Close()
 
-	localAddr, err := socket.Open(ipv4)
+	localAddr, err := socket.Open(net.IP(hostAddr.AsSlice()))
 	if err != nil {
 		fmt.Printf("Failed to open UDP socket: %v\n", err.Error())
 		return
 	}
 
 	fmt.Printf("Listening on %s:%d\n", localAddr.IP, localAddr.Port)
+
+	if common.NAT_TRAVERSAL {
+		connections.StartNATTraversal(localAddr.AddrPort())
+	}
+	if err := connections.RestartDiscovery(localAddr.AddrPort()); err != nil {
+		fmt.Printf("Failed to restart discovery: %v\n", err)
+	}
+}
+
+// resolveInitAddress returns the local IPv4 address selected by the init arguments.
+func resolveInitAddress(args []string) (netip.Addr, error) {
+	if args[0] == "auto" {
+		if len(args) == 1 {
+			addr := sock.SelectDefaultAddress()
+			fmt.Printf("Selected %s\n", addr)
+			return addr, nil
+		}
+
+		target, err := netip.ParseAddr(args[1])
+		if err != nil || !target.Is4() {
+			return netip.Addr{}, fmt.Errorf("Invalid target IPv4 address: %s", args[1])
+		}
+
+		addr, err := sock.DetectOutgoingAddress(target)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("Failed to detect the local address for %s: %v", target, err)
+		}
+		fmt.Printf("Selected %s to reach %s\n", addr, target)
+		return addr, nil
+	}
+
+	if len(args) != 1 {
+		return netip.Addr{}, fmt.Errorf("Unexpected argument: %s", args[1])
+	}
+
+	hostIP := net.ParseIP(args[0])
+	if hostIP == nil {
+		addr, err := sock.GetInterfaceAddress(args[0])
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("Invalid IP address or interface name: %s", args[0])
+		}
+		return addr, nil
+	}
+
+	if hostIP.IsUnspecified() {
+		return netip.Addr{}, errors.New("The provided IP address is unspecified. Please provide a valid IP address.")
+	}
+
+	addr, ok := netip.AddrFromSlice(hostIP.To4())
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("The provided IP address is not a valid IPv4 address: %s", args[0])
+	}
+
+	return addr, nil
+}
+
+// PrintInterfaceAddresses prints the IPv4 addresses of all up network interfaces.
+func PrintInterfaceAddresses() {
+	addrs, err := sock.GetInterfaceAddresses()
+	if err != nil {
+		fmt.Printf("Failed to get network interfaces: %v\n", err)
+		return
+	}
+
+	fmt.Println("Available network interfaces:")
+
+	for _, addr := range addrs {
+		fmt.Printf("  Interface: %s, Address: %s\n", addr.Interface, addr.Addr)
+	}
 }
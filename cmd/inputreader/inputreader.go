@@ -3,10 +3,9 @@ package inputreader
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strings"
-
-	"bjoernblessin.de/chatprotogol/sock"
 )
 
 type Command string
@@ -14,16 +13,17 @@ type Command string
 type CommandHandler func(args []string)
 
 type InputReader struct {
-	scanner  *bufio.Scanner
+	input    *bufio.Reader
 	handlers map[Command][]CommandHandler
-	socket   sock.Socket
+	prompt   func() string
 }
 
-func NewInputReader(socket sock.Socket) *InputReader {
+// NewInputReader creates an input reader that shows the string returned by prompt before each command.
+func NewInputReader(prompt func() string) *InputReader {
 	return &InputReader{
-		scanner:  bufio.NewScanner(os.Stdin),
+		input:    bufio.NewReader(os.Stdin),
 		handlers: make(map[Command][]CommandHandler),
-		socket:   socket,
+		prompt:   prompt,
 	}
 }
 
@@ -37,23 +37,17 @@ func (ir *InputReader) InputLoop() {
 	fmt.Println("Ready for commands. Type 'exit' to stop, 'help' for a list of commands.")
 
 	for {
-		addrPort, err := ir.socket.GetLocalAddress()
-		var promptPrefix string
-		if err != nil {
-			promptPrefix = "Socket closed"
-		} else {
-			promptPrefix = addrPort.String()
-		}
-		fmt.Printf("%s > ", promptPrefix)
+		fmt.Printf("%s > ", ir.prompt())
 
-		if !ir.scanner.Scan() {
-			if err := ir.scanner.Err(); err != nil {
+		line, err := ir.input.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err != io.EOF {
 				fmt.Fprintln(os.Stderr, "Error reading from stdin:", err)
 			}
 			break
 		}
 
-		parts := strings.Fields(ir.scanner.Text())
+		parts := strings.Fields(line)
 		if len(parts) == 0 {
 			continue
 		}
@@ -61,25 +55,37 @@ func (ir *InputReader) InputLoop() {
 		command := strings.ToLower(parts[0])
 		args := parts[1:]
 
+		ir.Dispatch(command, args)
+
 		if command == "exit" {
-			for _, handler := range ir.handlers[Command(command)] {
-				handler(args)
-			}
 			return
-		} else if command == "help" {
-			fmt.Println("Available commands:")
+		}
+	}
+}
 
-			for cmd := range ir.handlers {
-				fmt.Printf("- %s\n", cmd)
-			}
-		} else {
-			if _, exists := ir.handlers[Command(command)]; !exists {
-				fmt.Printf("No handlers registered for command: '%s'\n", command)
-			} else {
-				for _, handler := range ir.handlers[Command(command)] {
-					handler(args)
-				}
-			}
+// Read reads the input that follows the current command, e.g. content piped to stdin after a command line.
+// Handlers read it until EOF, the input loop ends afterwards.
+func (ir *InputReader) Read(p []byte) (int, error) {
+	return ir.input.Read(p)
+}
+
+// Dispatch notifies the handlers registered for the command.
+func (ir *InputReader) Dispatch(command string, args []string) {
+	if command == "help" {
+		fmt.Println("Available commands:")
+
+		for cmd := range ir.handlers {
+			fmt.Printf("- %s\n", cmd)
 		}
+		return
+	}
+
+	if _, exists := ir.handlers[Command(command)]; !exists {
+		fmt.Printf("No handlers registered for command: '%s'\n", command)
+		return
+	}
+
+	for _, handler := range ir.handlers[Command(command)] {
+		handler(args)
 	}
 }
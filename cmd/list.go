@@ -2,9 +2,14 @@ package cmd
 
 import (
 	"fmt"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/connection"
 )
 
 func HandleList(args []string) {
+	printNeighborStates()
+
 	routingTable := router.GetRoutingTable()
 	if len(routingTable) == 0 {
 		fmt.Printf("No entries in the routing table.\n")
@@ -12,7 +17,24 @@ func HandleList(args []string) {
 	}
 
 	fmt.Printf("Routing Table:\n")
-	for addrPort, nextHop := range routingTable {
-		fmt.Printf("  %s -> Next Hop: %s\n", addrPort, nextHop)
+	for addr, nextHop := range routingTable {
+		if path, found := router.GetPath(addr); found {
+			fmt.Printf("  %s -> Next Hop: %s, Path: %s (cost %d)\n", addr, nextHop, connection.FormatPath(path.Hops), path.Cost)
+		} else {
+			fmt.Printf("  %s -> Next Hop: %s\n", addr, nextHop)
+		}
+	}
+}
+
+// printNeighborStates prints the state of the connection to every peer we are, were or are becoming connected to.
+func printNeighborStates() {
+	peers := connections.ConnectedPeers()
+	if len(peers) == 0 {
+		return
+	}
+
+	fmt.Printf("Neighbors:\n")
+	for _, peer := range peers {
+		fmt.Printf("  %s (%s) %s for %s\n", peer.Addr, peer.AddrPort, peer.State, time.Since(peer.Since).Round(time.Second))
 	}
 }
@@ -2,13 +2,23 @@ package cmd
 
 import (
 	"fmt"
+	"net/netip"
+	"slices"
+	"time"
 
 	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
+// HandleListDatabase prints the LSDB or compares it with the LSDB of a neighbor.
+// Usage: lsdb [diff <IPv4 address>]
 func HandleListDatabase(args []string) {
+	if len(args) == 2 && args[0] == "diff" {
+		diffDatabase(args[1])
+		return
+	}
+
 	if len(args) != 0 {
-		logger.Warnf("Usage: lsdb")
+		logger.Warnf("Usage: lsdb [diff <IPv4 address>]")
 		return
 	}
 
@@ -17,13 +27,85 @@ func HandleListDatabase(args []string) {
 		return
 	}
 
-	fmt.Println("Local Link State Database:")
-	for _, lsaAddr := range router.GetAvailableLSAs() {
+	localAddr := socket.MustGetLocalAddress().Addr()
+	lsaAddrs := router.GetAvailableLSAs()
+	slices.SortFunc(lsaAddrs, netip.Addr.Compare)
+
+	stats := router.GetLSDBStats()
+	overloaded := ""
+	if stats.Overloaded {
+		overloaded = ", OVERLOADED: new neighbors are refused"
+	}
+	fmt.Printf("Local Link State Database (%d/%d LSAs, %d evicted, %d rejected%s):\n", stats.Size, stats.Max, stats.Evicted, stats.Rejected, overloaded)
+	for _, lsaAddr := range lsaAddrs {
 		lsa, exists := router.GetLSA(lsaAddr)
 		if !exists {
 			fmt.Printf("  %s -> (not found)\n", lsaAddr)
 			continue
 		}
-		fmt.Printf("  %s -> %+v\n", lsaAddr, lsa)
+
+		origin := "local"
+		if lsa.ReceivedFrom.IsValid() {
+			origin = "from " + lsa.ReceivedFrom.String()
+		}
+
+		flags := ""
+		if lsa.Stub {
+			flags += " [stub]"
+		}
+		if _, reachable := router.GetNextHop(lsaAddr); !reachable && lsaAddr != localAddr {
+			flags += " [UNREACHABLE]"
+		}
+
+		fmt.Printf("  %s -> seq %d, updated %s ago %s, neighbors %v%s\n", lsaAddr, lsa.SeqNum, time.Since(lsa.Updated).Round(time.Second), origin, lsa.Neighbors, flags)
+	}
+}
+
+// diffDatabase requests the DD of a neighbor and prints the LSAs whose sequence numbers differ from ours.
+func diffDatabase(addrString string) {
+	peerIP, err := netip.ParseAddr(addrString)
+	if err != nil || !peerIP.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", addrString)
+		return
+	}
+
+	entries, err := connections.RequestDD(peerIP)
+	if err != nil {
+		fmt.Printf("Failed to get the database description of %s: %v\n", peerIP, err)
+		return
+	}
+
+	peerSeqNums := make(map[netip.Addr]uint32, len(entries))
+	for _, entry := range entries {
+		peerSeqNums[entry.Addr] = entry.SeqNum
+	}
+
+	lsaAddrs := router.GetAvailableLSAs()
+	for addr := range peerSeqNums {
+		if !slices.Contains(lsaAddrs, addr) {
+			lsaAddrs = append(lsaAddrs, addr)
+		}
+	}
+	slices.SortFunc(lsaAddrs, netip.Addr.Compare)
+
+	fmt.Printf("Link State Database compared with %s:\n", peerIP)
+	identical := 0
+	for _, addr := range lsaAddrs {
+		lsa, local := router.GetLSA(addr)
+		peerSeqNum, remote := peerSeqNums[addr]
+
+		switch {
+		case local && remote && lsa.SeqNum == peerSeqNum:
+			identical++
+		case local && remote && lsa.SeqNum > peerSeqNum:
+			fmt.Printf("  %s -> local seq %d, peer seq %d (local newer)\n", addr, lsa.SeqNum, peerSeqNum)
+		case local && remote:
+			fmt.Printf("  %s -> local seq %d, peer seq %d (peer newer)\n", addr, lsa.SeqNum, peerSeqNum)
+		case local:
+			fmt.Printf("  %s -> local seq %d, missing at peer\n", addr, lsa.SeqNum)
+		default:
+			fmt.Printf("  %s -> peer seq %d, missing locally\n", addr, peerSeqNum)
+		}
 	}
+	fmt.Printf("  %d identical LSAs\n", identical)
 }
@@ -0,0 +1,326 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+const loadgenUsage = "Usage: loadgen [<IPv4 address> [--size <bytes>] [--rate <packets/s>] [--pattern seq|random] | stop [<IPv4 address>]]"
+
+// loadGenerator sends a stream of messages to a peer until it is stopped, see HandleLoadGen.
+type loadGenerator struct {
+	peerIP  netip.Addr
+	size    int    // Payload bytes per packet
+	rate    int    // Packets per second, 0 sends as fast as the congestion window allows
+	pattern string // "seq" or "random"
+	stats   *sequencing.TransferStats
+	sent    atomic.Int64 // Packets sent, including unacknowledged ones
+	stop    context.CancelFunc
+	done    chan struct{} // Closed once the generator stopped
+}
+
+// loadGenKey identifies a generator by the node sending and the peer, a node runs one generator per peer.
+type loadGenKey struct {
+	connections *connection.Manager
+	peerIP      netip.Addr
+}
+
+// loadGenerators holds the started generators, only accessed by the input loop.
+var loadGenerators = make(map[loadGenKey]*loadGenerator)
+
+// HandleLoadGen starts a load generator, which sends messages to a peer until it is stopped, e.g. to measure throughput and test behavior under load.
+// Each packet carries size bytes following the pattern: "seq" repeats the packet index, so gaps and duplicates are visible at the receiver, "random" is random text.
+// The achieved throughput and retransmissions are printed every common.LOADGEN_DISPLAY_INTERVAL.
+// Generators to different peers run concurrently, without arguments the running generators are listed.
+// Usage: loadgen [<IPv4 address> [--size <bytes>] [--rate <packets/s>] [--pattern seq|random] | stop [<IPv4 address>]]
+func HandleLoadGen(args []string) {
+	pruneLoadGenerators()
+
+	if len(args) == 0 {
+		listLoadGenerators()
+		return
+	}
+
+	if args[0] == "stop" {
+		stopLoadGenerators(args[1:])
+		return
+	}
+
+	peerIP, err := netip.ParseAddr(args[0])
+	if err != nil || !peerIP.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	generator := &loadGenerator{
+		peerIP:  peerIP,
+		size:    connections.GetMaxPayloadSize(peerIP),
+		pattern: "seq",
+		stats:   sequencing.NewTransferStats(),
+		done:    make(chan struct{}),
+	}
+	if err := generator.parseOptions(args[1:]); err != nil {
+		fmt.Printf("%v\n%s\n", err, loadgenUsage)
+		return
+	}
+	if maxSize := connections.GetMaxPayloadSize(peerIP); generator.size > maxSize {
+		fmt.Printf("The size exceeds the maximum payload size of %d bytes to %s\n", maxSize, peerIP)
+		return
+	}
+
+	blocker := outSequencing.GetSequenceBlocker(peerIP, pkt.MsgTypeChatMessage)
+	if !blocker.Block("loadgen") {
+		fmt.Printf("Can't start a load generator to %s: Another message is currently being sent.\n", peerIP)
+		return
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	generator.stop = stop
+	loadGenerators[loadGenKey{connections, peerIP}] = generator
+
+	fmt.Printf("Load generator to %s started (%s). Stop with 'loadgen stop %s'.\n", peerIP, generator.describe(), peerIP)
+
+	go generator.run(ctx, connections, outSequencing, blocker)
+}
+
+// parseOptions applies the command options to the generator.
+func (g *loadGenerator) parseOptions(options []string) error {
+	for i := 0; i < len(options); i += 2 {
+		if i+1 >= len(options) {
+			return fmt.Errorf("missing value of %s", options[i])
+		}
+		value := options[i+1]
+
+		switch options[i] {
+		case "--size":
+			size, err := strconv.Atoi(value)
+			if err != nil || size <= 0 {
+				return fmt.Errorf("invalid size: %s", value)
+			}
+			g.size = size
+		case "--rate":
+			rate, err := strconv.Atoi(value)
+			if err != nil || rate < 0 {
+				return fmt.Errorf("invalid rate: %s", value)
+			}
+			g.rate = rate
+		case "--pattern":
+			if value != "seq" && value != "random" {
+				return fmt.Errorf("invalid pattern: %s", value)
+			}
+			g.pattern = value
+		default:
+			return fmt.Errorf("unknown option: %s", options[i])
+		}
+	}
+	return nil
+}
+
+// describe returns the settings of the generator, e.g. "1200 bytes per packet, 100 packets/s, seq pattern".
+func (g *loadGenerator) describe() string {
+	rate := "unlimited rate"
+	if g.rate > 0 {
+		rate = fmt.Sprintf("%d packets/s", g.rate)
+	}
+	return fmt.Sprintf("%d bytes per packet, %s, %s pattern", g.size, rate, g.pattern)
+}
+
+// isRunning returns whether the generator hasn't stopped yet.
+func (g *loadGenerator) isRunning() bool {
+	select {
+	case <-g.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// pruneLoadGenerators forgets the generators that stopped on their own, e.g. because the peer became unreachable.
+func pruneLoadGenerators() {
+	for key, generator := range loadGenerators {
+		if !generator.isRunning() {
+			delete(loadGenerators, key)
+		}
+	}
+}
+
+func listLoadGenerators() {
+	if len(loadGenerators) == 0 {
+		fmt.Println("No load generators running.")
+		return
+	}
+
+	generators := make([]*loadGenerator, 0, len(loadGenerators))
+	for _, generator := range loadGenerators {
+		generators = append(generators, generator)
+	}
+	slices.SortFunc(generators, func(a, b *loadGenerator) int { return a.peerIP.Compare(b.peerIP) })
+
+	for _, generator := range generators {
+		fmt.Printf("%s: %s\n", generator.peerIP, generator.describe())
+		fmt.Printf("  %d packets sent, %s\n", generator.sent.Load(), generator.stats.Snapshot())
+	}
+}
+
+// stopLoadGenerators stops the generator to the peer of args, or all generators of the selected node without args.
+func stopLoadGenerators(args []string) {
+	if len(args) > 1 {
+		fmt.Println(loadgenUsage)
+		return
+	}
+
+	stopped := 0
+	for key, generator := range loadGenerators {
+		if key.connections != connections || (len(args) == 1 && key.peerIP.String() != args[0]) {
+			continue
+		}
+
+		generator.stop()
+		delete(loadGenerators, key)
+		stopped++
+	}
+
+	if stopped == 0 {
+		fmt.Println("No matching load generator running.")
+	}
+}
+
+// run sends messages of common.LOADGEN_MESSAGE_PACKETS packets to the peer until ctx is done or the sequence is cancelled.
+// Every message is finished with a FIN once its packets are acknowledged, so the receiver delivers it and doesn't hit its message size limit.
+// The sequence is unblocked afterwards.
+func (g *loadGenerator) run(ctx context.Context, connections *connection.Manager, outSequencing *sequencing.OutgoingPktNumHandler, blocker *sequencing.SequenceBlocker) {
+	defer panics.Recover("generating load to %s", g.peerIP)
+	defer close(g.done)
+	defer blocker.Unblock()
+
+	go g.display(ctx)
+
+	start := time.Now()
+	var index int64 // Index of the next packet
+
+	sendCtx := blocker.Context() // Cancelled by the cancel command or if the peer becomes unreachable, packets in flight are still acknowledged after stopping
+
+	for ctx.Err() == nil && sendCtx.Err() == nil && !blocker.IsAborted() {
+		delivery := sequencing.NewDeliveryTracker()
+		var firstChunkPktNum, lastChunkPktNum [4]byte
+		var sent sentPktNums
+
+		for range common.LOADGEN_MESSAGE_PACKETS {
+			if g.rate > 0 {
+				due := start.Add(time.Duration(index) * time.Second / time.Duration(g.rate))
+				if sleepContext(ctx, time.Until(due)) != nil {
+					break
+				}
+			}
+			if ctx.Err() != nil || blocker.IsAborted() {
+				break
+			}
+
+			payload := g.payload(index)
+			packet := connections.BuildSequencedPacket(pkt.MsgTypeChatMessage, payload, g.peerIP)
+
+			ackChan, err := connections.SendTrackedRoutedPacket(sendCtx, packet, g.stats)
+			if err != nil {
+				if sendCtx.Err() == nil {
+					fmt.Printf("Load generator to %s failed to send: %v\n", g.peerIP, err)
+				}
+				break
+			}
+
+			if len(sent) == 0 {
+				firstChunkPktNum = packet.Header.PktNum
+			}
+			sent.add(packet.Header.PktNum)
+			lastChunkPktNum = packet.Header.PktNum
+			index++
+			g.sent.Add(1)
+
+			delivery.TrackChunk(ackChan, func(acked bool) {
+				if acked {
+					g.stats.AddPacket(len(payload))
+				}
+			})
+		}
+
+		if sendCtx.Err() != nil {
+			sent.abort(outSequencing, g.peerIP) // Don't wait for the ACKs of the sent packets
+		}
+		delivery.Wait()
+
+		if len(sent) == 0 || sendCtx.Err() != nil {
+			break
+		}
+
+		packet := connections.BuildSequencedPacket(pkt.MsgTypeFinish, messageFinishPayload(connections, firstChunkPktNum, lastChunkPktNum, time.Now()), g.peerIP)
+		ackChan, err := connections.SendReliableRoutedPacket(sendCtx, packet)
+		if err != nil {
+			fmt.Printf("Load generator to %s failed to send the finish message: %v\n", g.peerIP, err)
+			break
+		}
+		<-ackChan
+	}
+
+	g.stop() // Stops the display if the generator stopped on its own
+	fmt.Printf("Load generator to %s stopped: %d packets sent, %s\n", g.peerIP, g.sent.Load(), g.stats.Snapshot())
+}
+
+// display prints the throughput of the last interval and the retransmissions every common.LOADGEN_DISPLAY_INTERVAL until ctx is done.
+func (g *loadGenerator) display(ctx context.Context) {
+	defer panics.Recover("displaying the load generator to %s", g.peerIP)
+
+	ticker := time.NewTicker(common.LOADGEN_DISPLAY_INTERVAL)
+	defer ticker.Stop()
+
+	previous := g.stats.Snapshot()
+	previousTime := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			current := g.stats.Snapshot()
+			throughput := float64(current.Bytes-previous.Bytes) / now.Sub(previousTime).Seconds()
+
+			fmt.Printf("loadgen %s: %s (avg %s), %d packets acknowledged, %d retransmissions, %d lost\n",
+				g.peerIP, sequencing.FormatThroughput(throughput), sequencing.FormatThroughput(current.AvgBytesPerSec),
+				current.Packets, current.Retransmissions, current.Lost)
+
+			previous, previousTime = current, now
+		}
+	}
+}
+
+// payloadAlphabet is the text of random payloads, single-byte characters so packets can be cut anywhere.
+const payloadAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// payload returns the payload of the packet with the index.
+func (g *loadGenerator) payload(index int64) pkt.Payload {
+	payload := make(pkt.Payload, g.size)
+
+	switch g.pattern {
+	case "random":
+		for i := range payload {
+			payload[i] = payloadAlphabet[rand.IntN(len(payloadAlphabet))]
+		}
+	default:
+		marker := fmt.Sprintf("#%d ", index)
+		for i := range payload {
+			payload[i] = marker[i%len(marker)]
+		}
+	}
+
+	return payload
+}
@@ -42,4 +42,7 @@ func HandleLogLevel(args []string) {
 	// If no arguments, just display the current level
 	currentLevel := logger.GetLogLevel()
 	fmt.Printf("Current log level: %s\n", currentLevel.String())
+	if dropped := logger.DroppedLines(); dropped > 0 {
+		fmt.Printf("Dropped log lines: %d\n", dropped)
+	}
 }
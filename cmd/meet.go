@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// HandleMeet asks an introducer to introduce us to a peer, after which both sides connect to each other.
+// This connects two peers behind NATs that are both connected to a publicly reachable introducer.
+// Usage: meet <introducer IPv4 address> <peer IPv4 address>
+func HandleMeet(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: meet <introducer IPv4 address> <peer IPv4 address>")
+		return
+	}
+
+	introducer, err := netip.ParseAddr(args[0])
+	if err != nil || !introducer.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	peer, err := netip.ParseAddr(args[1])
+	if err != nil || !peer.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[1])
+		return
+	}
+
+	if isNeighbor, _ := router.IsNeighbor(peer); isNeighbor {
+		fmt.Printf("Already connected to %s\n", peer)
+		return
+	}
+
+	if !accessList.IsAllowed(peer) {
+		fmt.Printf("Can't meet %s: The address is blocked or not allowed.\n", peer)
+		return
+	}
+
+	ackChan, err := connections.SendIntroductionRequest(introducer, peer)
+	if err != nil {
+		fmt.Printf("Failed to send introduction request to %s: %v\n", introducer, err)
+		return
+	}
+
+	go func() {
+		if !<-ackChan {
+			fmt.Printf("Introducer %s did not acknowledge the introduction request\n", introducer)
+		}
+	}()
+}
@@ -1,87 +1,263 @@
 package cmd
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net/netip"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"bjoernblessin.de/chatprotogol/common"
 	"bjoernblessin.de/chatprotogol/connection"
 	"bjoernblessin.de/chatprotogol/pkt"
 	"bjoernblessin.de/chatprotogol/sequencing"
 	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/utf8chunk"
 )
 
-func HandleSend(args []string) {
-	if len(args) < 2 {
-		println("Usage: msg <IPv4 address> <message>")
-		return
+// unreliableMessages is whether messages are sent unreliably unless --reliable is given, see SetUnreliableMessages.
+var unreliableMessages atomic.Bool
+
+// SetUnreliableMessages sets whether the msg command sends messages unreliably by default.
+func SetUnreliableMessages(enabled bool) {
+	unreliableMessages.Store(enabled)
+}
+
+// NewSendHandler returns the handler of the msg command, which sends a chat message to a peer.
+// With "-" as message, input is read until EOF and sent as the message.
+// With --unreliable, the message is sent as a single packet without ACKs (see connection.Manager.SendUnreliableMessage),
+// --reliable overrides SetUnreliableMessages.
+// input is the rest of the command input, see inputreader.InputReader.Read.
+func NewSendHandler(input io.Reader) func(args []string) {
+	return func(args []string) {
+		unreliable := unreliableMessages.Load()
+		if len(args) > 0 && (args[0] == "--unreliable" || args[0] == "--reliable") {
+			unreliable = args[0] == "--unreliable"
+			args = args[1:]
+		}
+
+		if len(args) < 2 {
+			println("Usage: msg [--unreliable | --reliable] <IPv4 address> <message | ->")
+			return
+		}
+
+		fromInput := len(args) == 2 && args[1] == "-"
+		if fromInput {
+			defer io.Copy(io.Discard, input) // The input is never executed as commands, also if the message isn't sent
+		}
+
+		peerIP, err := netip.ParseAddr(args[0])
+		if err != nil || !peerIP.Is4() {
+			println("Invalid IPv4 address:", args[0])
+			return
+		}
+
+		message := strings.Join(args[1:], " ")
+		if fromInput {
+			message, err = readMessage(input)
+			if err != nil {
+				fmt.Printf("Can't send message to %s: %v\n", peerIP, err)
+				return
+			}
+		}
+
+		if unreliable {
+			sendUnreliableMsg(connections, peerIP, message)
+			return
+		}
+
+		blocker := outSequencing.GetSequenceBlocker(peerIP, pkt.MsgTypeChatMessage)
+		success := blocker.Block("msg")
+		if !success {
+			fmt.Printf("Can't send message to %s: Another message is currently being sent.\n", peerIP)
+			return
+		}
+
+		if fromInput {
+			sendMsgChunks(connections, outSequencing, peerIP, message, time.Now(), blocker) // The input is exhausted, so wait until the message is sent
+			return
+		}
+
+		go sendMsgChunks(connections, outSequencing, peerIP, message, time.Now(), blocker)
 	}
+}
 
-	peerIP, err := netip.ParseAddr(args[0])
-	if err != nil || !peerIP.Is4() {
-		println("Invalid IPv4 address:", args[0])
-		return
+// readMessage reads a message from the input until EOF, a trailing line break is removed.
+// Errors if the message exceeds common.MAX_MESSAGE_SIZE_BYTES, which the receiver would abort.
+func readMessage(input io.Reader) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(input, common.MAX_MESSAGE_SIZE_BYTES+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the message: %w", err)
+	}
+	if len(data) > common.MAX_MESSAGE_SIZE_BYTES {
+		return "", fmt.Errorf("the message exceeds %d bytes", common.MAX_MESSAGE_SIZE_BYTES)
 	}
 
-	blocker := sequencing.GetSequenceBlocker(peerIP, pkt.MsgTypeChatMessage)
-	success := blocker.Block()
-	if !success {
-		fmt.Printf("Can't send message to %s: Another message is currently being sent.\n", peerIP)
+	message := strings.TrimSuffix(string(data), "\n")
+	message = strings.TrimSuffix(message, "\r")
+	if message == "" {
+		return "", errors.New("the message is empty")
+	}
+	return message, nil
+}
+
+// sendUnreliableMsg sends the message as a single unreliable packet, it isn't known whether it arrives.
+// Unreliable messages don't use the sequence of reliable messages, so they can be sent while a reliable message is being sent.
+func sendUnreliableMsg(connections *connection.Manager, peerIP netip.Addr, message string) {
+	size, err := connections.SendUnreliableMessage(peerIP, message, time.Now())
+	if errors.Is(err, connection.ErrUnreliableMessageTooLarge) {
+		fmt.Printf("Can't send message to %s unreliably: %v, send it reliably instead\n", peerIP, err)
+		return
+	} else if err != nil {
+		fmt.Printf("Can't send message to %s: %v\n", peerIP, err)
 		return
 	}
 
-	go sendMsgChunks(peerIP, strings.Join(args[1:], " "), blocker)
+	connections.RecordTransfer(pkt.MsgTypeChatMessage, true)
+	fmt.Printf("Message sent unreliably (1 packet, %d bytes)\n", size)
 }
 
-func sendMsgChunks(peerIP netip.Addr, fullMsg string, blocker *sequencing.SequenceBlocker) {
+// sendMsgChunks sends the message in chunks followed by a FIN carrying sentAt, so the receiver can display when the message was sent.
+// It is sent by the node of connections and outSequencing, which stays the same if another node is selected meanwhile.
+// Prints and returns whether the message was delivered, i.e. whether all chunks and the FIN were acknowledged.
+func sendMsgChunks(connections *connection.Manager, outSequencing *sequencing.OutgoingPktNumHandler, peerIP netip.Addr, fullMsg string, sentAt time.Time, blocker *sequencing.SequenceBlocker) sequencing.DeliveryStatus {
 	defer blocker.Unblock()
 
-	wg := &sync.WaitGroup{}
+	var firstChunkPktNum, lastChunkPktNum [4]byte
+	var sent sentPktNums
 
-	msgBytes := []byte(fullMsg)
-	bytesLen := len(msgBytes)
+	stats := sequencing.NewTransferStats()
+	delivery := sequencing.NewDeliveryTracker()
 
-	var lastChunkPktNum [4]byte
+	maxPayloadSize := connections.GetMaxPayloadSize(peerIP)
 
-	start := 0
-	for start < bytesLen {
-		end := min(start+common.MAX_PAYLOAD_SIZE_BYTES, bytesLen)
+	ctx := blocker.Context() // Cancelled by the cancel command or if the peer becomes unreachable
 
-		packet := connection.BuildSequencedPacket(pkt.MsgTypeChatMessage, msgBytes[start:end], peerIP)
+	// Chunks end at rune boundaries, so no chunk contains a partial multi-byte character (e.g. an emoji)
+	chunks := utf8chunk.Split([]byte(fullMsg), maxPayloadSize)
+	if len(chunks) == 1 && common.SINGLE_PACKET_MESSAGES && connections.PeerSupports(peerIP, connection.CapabilitySinglePacket) {
+		return sendSinglePacketMsg(outSequencing, connections, peerIP, chunks[0], sentAt, blocker, stats)
+	}
 
-		ackChan, err := connection.SendReliableRoutedPacket(packet)
-		for err != nil {
+	for _, chunk := range chunks {
+		if blocker.IsAborted() {
+			break // The receiver rejected the message, the FIN still ends the sequence
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		packet := connections.BuildSequencedPacket(pkt.MsgTypeChatMessage, chunk, peerIP)
+		if len(sent) == 0 {
+			firstChunkPktNum = packet.Header.PktNum
+		}
+		sent.add(packet.Header.PktNum)
+
+		ackChan, err := connections.SendTrackedRoutedPacket(ctx, packet, stats)
+		if err != nil {
 			logger.Debugf("Failed to send message chunk %v to %s, skipping: %v", packet.Header.PktNum, peerIP, err)
+			delivery.RecordChunk(false)
 			continue
 		}
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			<-ackChan
-			// We ignore the success of the ACK to avoid blocking the send process. The receiver might get a faulty message.
-		}()
+		// A chunk that isn't acknowledged doesn't block the send process, the delivery status reports it
+		delivery.TrackChunk(ackChan, nil)
 
 		lastChunkPktNum = packet.Header.PktNum
-		start = end
+	}
+
+	if ctx.Err() != nil {
+		sent.abort(outSequencing, peerIP) // Don't wait for the ACKs of the sent chunks
 	}
 
 	// Send the FIN message after all chunks have been sent and acknowledged
-	wg.Wait()
+	delivery.Wait()
+
+	if ctx.Err() != nil {
+		fmt.Printf("Message to %s cancelled\n", peerIP)
+		return delivery.Status()
+	}
 
-	payload := []byte(lastChunkPktNum[:])
-	packet := connection.BuildSequencedPacket(pkt.MsgTypeFinish, payload, peerIP)
+	packet := connections.BuildSequencedPacket(pkt.MsgTypeFinish, messageFinishPayload(connections, firstChunkPktNum, lastChunkPktNum, sentAt), peerIP)
 
-	ackChan, err := connection.SendReliableRoutedPacket(packet)
-	for err != nil {
+	ackChan, err := connections.SendTrackedRoutedPacket(ctx, packet, stats)
+	if err != nil {
 		logger.Debugf("Failed to send finish message to %s: %v\n", peerIP, err)
-		return
+	} else {
+		delivery.RecordFinish(<-ackChan)
 	}
 
-	<-ackChan
-	// We ignore the success of the ACK to avoid blocking the send process. The receiver might not be ready for a new message but we don't care.
+	if blocker.IsAborted() {
+		return delivery.Status()
+	}
+
+	reportMessageDelivery(connections, delivery.Status(), stats)
+	return delivery.Status()
+}
+
+// messageFinishPayload returns the payload of the FIN of a message with the chunks from firstChunkPktNum to lastChunkPktNum.
+// The message ID (our address, boot epoch and packet number range) lets the receiver drop the message if it already delivered it.
+func messageFinishPayload(connections *connection.Manager, firstChunkPktNum, lastChunkPktNum [4]byte, sentAt time.Time) pkt.Payload {
+	payload := binary.BigEndian.AppendUint64(lastChunkPktNum[:], uint64(sentAt.UnixNano()))
+	payload = binary.BigEndian.AppendUint64(payload, connections.BootEpoch())
+	return append(payload, firstChunkPktNum[:]...)
+}
+
+// sendSinglePacketMsg sends a message of one packet that finishes itself, so no FIN follows (see connection.Manager.BuildSinglePacketMessage).
+func sendSinglePacketMsg(outSequencing *sequencing.OutgoingPktNumHandler, connections *connection.Manager, peerIP netip.Addr, msg []byte, sentAt time.Time, blocker *sequencing.SequenceBlocker, stats *sequencing.TransferStats) sequencing.DeliveryStatus {
+	ctx := blocker.Context()
+
+	packet := connections.BuildSinglePacketMessage(msg, peerIP, sentAt)
+	var sent sentPktNums
+	sent.add(packet.Header.PktNum)
 
-	fmt.Printf("Message sent\n")
+	acked := false
+	ackChan, err := connections.SendTrackedRoutedPacket(ctx, packet, stats)
+	if err != nil {
+		logger.Debugf("Failed to send message to %s: %v", peerIP, err)
+	} else {
+		acked = <-ackChan
+	}
+
+	delivery := sequencing.NewDeliveryTracker()
+	delivery.RecordChunk(acked)
+	delivery.RecordFinish(acked) // The ACK of the message is the ACK of its FIN
+
+	if ctx.Err() != nil {
+		sent.abort(outSequencing, peerIP)
+		fmt.Printf("Message to %s cancelled\n", peerIP)
+		return delivery.Status()
+	}
+	if blocker.IsAborted() {
+		return delivery.Status()
+	}
+
+	reportMessageDelivery(connections, delivery.Status(), stats)
+	return delivery.Status()
+}
+
+// reportMessageDelivery prints the delivery status of a message with the number of retransmissions of stats,
+// e.g. "Message delivered" or "Message partially delivered (2/3 chunks, 4 retransmissions)".
+// Delivered messages are counted for the session summary.
+func reportMessageDelivery(connections *connection.Manager, status sequencing.DeliveryStatus, stats *sequencing.TransferStats) {
+	if status.Delivered() {
+		connections.RecordTransfer(pkt.MsgTypeChatMessage, true)
+	}
+
+	details := make([]string, 0, 2)
+	if detail := status.Detail(); detail != "" {
+		details = append(details, detail)
+	}
+	if retransmissions := stats.Snapshot().Retransmissions; retransmissions > 0 {
+		details = append(details, fmt.Sprintf("%d retransmissions", retransmissions))
+	}
+
+	if len(details) > 0 {
+		fmt.Printf("Message %s (%s)\n", status.Outcome(), strings.Join(details, ", "))
+	} else {
+		fmt.Printf("Message %s\n", status.Outcome())
+	}
 }
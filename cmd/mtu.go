@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// HandleMTU probes the path to a peer and displays the discovered maximum payload size.
+func HandleMTU(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: mtu <IPv4 address>")
+		return
+	}
+
+	peerIP, err := netip.ParseAddr(args[0])
+	if err != nil || !peerIP.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	if _, found := router.GetNextHop(peerIP); !found {
+		fmt.Printf("%s is not reachable.\n", peerIP)
+		return
+	}
+
+	fmt.Printf("Probing path to %s...\n", peerIP)
+	limit := connections.DiscoverPathMTU(peerIP)
+	fmt.Printf("Maximum payload size to %s: %d bytes\n", peerIP, limit)
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"bjoernblessin.de/chatprotogol/connection"
+)
+
+// HandleNetem impairs the datagrams the selected node sends, like Linux netem, e.g. for a soak test on loopback.
+// Without arguments, the current impairment is displayed, "netem off" disables it.
+// Usage: netem [loss=<0-1>] [reorder=<0-1>] | netem off
+func HandleNetem(args []string) {
+	if len(args) == 0 {
+		printNetem(connections.Netem(), connections.NetemStats())
+		return
+	}
+
+	if len(args) == 1 && args[0] == "off" {
+		connections.SetNetem(connection.NetemConfig{})
+		fmt.Println("Outgoing datagrams are no longer impaired.")
+		return
+	}
+
+	config := connections.Netem()
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, "=")
+
+		probability, err := strconv.ParseFloat(value, 64)
+		if err != nil || probability < 0 || probability > 1 {
+			fmt.Printf("Invalid probability %q, must be between 0 and 1\n", value)
+			return
+		}
+
+		switch name {
+		case "loss":
+			config.Loss = probability
+		case "reorder":
+			config.Reorder = probability
+		default:
+			fmt.Println("Usage: netem [loss=<0-1>] [reorder=<0-1>] | netem off")
+			return
+		}
+	}
+
+	connections.SetNetem(config)
+	printNetem(config, connections.NetemStats())
+}
+
+func printNetem(config connection.NetemConfig, stats connection.NetemStats) {
+	if !config.Enabled() {
+		fmt.Println("Outgoing datagrams aren't impaired.")
+	} else {
+		fmt.Printf("Outgoing datagrams: %s\n", formatNetem(config))
+	}
+	fmt.Printf("Impaired so far: %d dropped, %d reordered\n", stats.Dropped, stats.Reordered)
+}
+
+// formatNetem returns the impairment in percent, e.g. "10.0% loss, 5.0% reordered".
+func formatNetem(config connection.NetemConfig) string {
+	return fmt.Sprintf("%.1f%% loss, %.1f%% reordered", config.Loss*100, config.Reorder*100)
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/node"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// nodes holds the local nodes of the process, node 1 is the node the process was started with.
+// Only accessed by the input loop.
+var nodes = struct {
+	list     []*node.Node
+	selected int // Index of the selected node in list
+}{}
+
+// AddNode adds a local node and returns its number.
+// The first node is selected.
+func AddNode(n *node.Node) int {
+	nodes.list = append(nodes.list, n)
+	if len(nodes.list) == 1 {
+		selectNode(0)
+	}
+	return len(nodes.list)
+}
+
+// selectNode selects the node at index i of the node list.
+func selectNode(i int) {
+	nodes.selected = i
+	setGlobalVars(nodes.list[i])
+}
+
+// Prompt returns the prompt of the input loop, the local address of the selected node.
+// The number of the node is shown once other nodes were spawned.
+func Prompt() string {
+	addrPort, err := socket.GetLocalAddress()
+	prompt := addrPort.String()
+	if err != nil {
+		prompt = "Socket closed"
+	}
+
+	if len(nodes.list) > 1 {
+		prompt = fmt.Sprintf("[%d] %s", nodes.selected+1, prompt)
+	}
+	return prompt
+}
+
+// HandleSpawn starts an additional local node in this process, e.g. to test routing on a single machine.
+// The node has its own socket, router, sequencing and connections and uses the team, authentication and hop-by-hop ARQ settings of the selected node.
+// Its access list isn't persisted.
+// The address is selected like for init, it must not be the address of another local node (e.g. use 127.0.0.2, 127.0.0.3, ... on Linux).
+func HandleSpawn(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("Usage: spawn (<IP address> | <interface name> | auto [<target IP address>]) Example: spawn 127.0.0.2")
+		return
+	}
+
+	hostAddr, err := resolveInitAddress(args)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	for i, n := range nodes.list {
+		if localAddr, err := n.Socket.GetLocalAddress(); err == nil && localAddr.Addr() == hostAddr {
+			fmt.Printf("Node %d already uses %s, each node needs its own address\n", i+1, hostAddr)
+			return
+		}
+	}
+
+	spawned := node.New(sock.NewUDPSocket(), "")
+
+	spawned.Connections.SetTeamID(connections.TeamID())
+	spawned.Connections.SetPromiscuous(connections.IsPromiscuous())
+	spawned.Connections.SetStrict(connections.IsStrict())
+	spawned.Connections.SetHopByHopARQ(connections.IsHopByHopARQEnabled())
+	spawned.Connections.SetPathRecording(connections.IsPathRecordingEnabled())
+	if connections.IsAuthenticationEnabled() {
+		spawned.Connections.SetPreSharedKey(connections.PreSharedKey())
+	}
+
+	localAddr, err := spawned.Socket.Open(net.IP(hostAddr.AsSlice()))
+	if err != nil {
+		fmt.Printf("Failed to open UDP socket: %v\n", err.Error())
+		return
+	}
+
+	if common.NAT_TRAVERSAL {
+		spawned.Connections.StartNATTraversal(localAddr.AddrPort())
+	}
+
+	number := AddNode(spawned)
+	fmt.Printf("Node %d listening on %s:%d, use 'node %d' to select it\n", number, localAddr.IP, localAddr.Port, number)
+}
+
+// NewNodeHandler returns the handler of the node command, which selects the node further commands are executed on.
+// "node <number>" selects the node, "node <number>> <command>" executes a single command on the node.
+// Without arguments, the local nodes are listed.
+// dispatch executes a command, see inputreader.InputReader.Dispatch.
+func NewNodeHandler(dispatch func(command string, args []string)) func(args []string) {
+	return func(args []string) {
+		if len(args) == 0 {
+			listNodes()
+			return
+		}
+
+		numberString, once := strings.CutSuffix(args[0], ">")
+		if once != (len(args) > 1) {
+			fmt.Println("Usage: node [<number> | <number>> <command>] Example: node 2; node 2> msg 10.0.0.1 Hello")
+			return
+		}
+
+		number, err := strconv.Atoi(numberString)
+		if err != nil || number < 1 || number > len(nodes.list) {
+			fmt.Printf("No node %s, use 'node' to list the nodes\n", numberString)
+			return
+		}
+
+		if !once {
+			selectNode(number - 1)
+			return
+		}
+
+		command := strings.ToLower(args[1])
+		if command == "exit" || command == "node" {
+			fmt.Printf("Can't execute %s on a single node\n", command)
+			return
+		}
+
+		previous := nodes.selected
+		selectNode(number - 1)
+		defer selectNode(previous)
+
+		dispatch(command, args[2:])
+	}
+}
+
+// listNodes prints the local nodes and their addresses.
+func listNodes() {
+	for i, n := range nodes.list {
+		marker := " "
+		if i == nodes.selected {
+			marker = "*"
+		}
+
+		localAddr, err := n.Socket.GetLocalAddress()
+		if err != nil {
+			fmt.Printf("%s %d: socket closed\n", marker, i+1)
+			continue
+		}
+		fmt.Printf("%s %d: %s\n", marker, i+1, localAddr)
+	}
+}
+
+// forEachNode selects every local node in turn and calls f, the previously selected node is selected afterwards.
+func forEachNode(f func()) {
+	previous := nodes.selected
+	defer selectNode(previous)
+
+	for i := range nodes.list {
+		selectNode(i)
+		f()
+	}
+}
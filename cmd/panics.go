@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+
+	"bjoernblessin.de/chatprotogol/util/assert"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// HandlePanics displays the number of recovered panics and the most recent ones as well as the number of failed assertions.
+// Usage: panics [-v], -v also prints the stack traces.
+func HandlePanics(args []string) {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "-v") {
+		fmt.Println("Usage: panics [-v]")
+		return
+	}
+	verbose := len(args) == 1
+
+	if failures := assert.Failures(); failures > 0 {
+		fmt.Printf("%d assertions failed, see the log for details.\n", failures)
+	}
+
+	count := panics.Count()
+	if count == 0 {
+		fmt.Println("No panics recovered.")
+		return
+	}
+
+	fmt.Printf("Recovered %d panics, most recent (oldest first):\n", count)
+	for _, report := range panics.Recent() {
+		fmt.Printf("  %s while %s: %v\n", report.Time.Format("15:04:05.000"), report.Context, report.Value)
+		if verbose {
+			fmt.Println(report.Stack)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// HandlePeer displays everything the selected node knows about a peer: its route, connection state, capabilities, congestion state, clock offset, traffic, transfers and LSA.
+// Usage: peer <IPv4 address>
+func HandlePeer(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: peer <IPv4 address>")
+		return
+	}
+
+	peerIP, err := netip.ParseAddr(args[0])
+	if err != nil || !peerIP.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	fmt.Printf("Peer %s:\n", peerIP)
+	printPeerRoute(peerIP)
+	printPeerCapabilities(peerIP)
+	printPeerCongestion(peerIP)
+	printPeerClock(peerIP)
+	printPeerTraffic(peerIP)
+	printPeerTransfers(peerIP)
+	printPeerLSA(peerIP)
+}
+
+func printPeerRoute(peerIP netip.Addr) {
+	if state := connections.GetPeerState(peerIP); state != connection.PeerDown {
+		fmt.Printf("  Neighbor: %s\n", state)
+	}
+
+	nextHop, found := router.GetNextHop(peerIP)
+	if !found {
+		fmt.Println("  Route: unreachable")
+		return
+	}
+	if path, found := router.GetPath(peerIP); found {
+		fmt.Printf("  Route: next hop %s, %d hops via %s\n", nextHop, path.Cost, connection.FormatPath(path.Hops))
+	} else {
+		fmt.Printf("  Route: next hop %s\n", nextHop)
+	}
+}
+
+func printPeerCapabilities(peerIP netip.Addr) {
+	if connections.GetPeerState(peerIP) == connection.PeerDown {
+		return
+	}
+
+	capabilities, announced := connections.GetPeerCapabilities(peerIP)
+	if !announced {
+		fmt.Println("  Capabilities: none announced (legacy node)")
+		return
+	}
+	fmt.Printf("  Capabilities: version %d, %s, max payload %d bytes\n", capabilities.Version, capabilities.Flags, capabilities.MaxPayloadSize)
+}
+
+func printPeerCongestion(peerIP netip.Addr) {
+	stats, exists := outSequencing.GetCongestionStats(peerIP)
+	if !exists {
+		return
+	}
+
+	if stats.RTTSamples > 0 {
+		fmt.Printf("  SRTT: %v, RTT variation: %v (%d samples)\n", stats.SRTT.Round(time.Microsecond), stats.RTTVar.Round(time.Microsecond), stats.RTTSamples)
+	} else {
+		fmt.Println("  SRTT: no samples")
+	}
+	fmt.Printf("  Cwnd: %d, ssthresh: %s, open ACKs: %d\n", stats.Cwnd, formatSsthresh(stats.Ssthresh), stats.OpenAcks)
+}
+
+func printPeerClock(peerIP netip.Addr) {
+	offset, exists := connections.GetClockOffset(peerIP)
+	if !exists {
+		fmt.Println("  Clock offset: unknown")
+		return
+	}
+
+	fmt.Printf("  Clock offset: %v (round trip %v, best of %d samples, %s ago)\n", offset.Offset.Round(time.Microsecond), offset.Delay.Round(time.Microsecond), offset.Samples, time.Since(offset.Time).Round(time.Second))
+}
+
+func printPeerTraffic(peerIP netip.Addr) {
+	traffic, exists := connections.GetPeerTraffic(peerIP)
+	if !exists {
+		fmt.Println("  Traffic: none")
+		return
+	}
+
+	fmt.Printf("  Sent: %s, received: %s\n", formatTraffic(traffic.Sent), formatTraffic(traffic.Received))
+	if traffic.LastSeen.IsZero() {
+		fmt.Println("  Last seen: never")
+	} else {
+		fmt.Printf("  Last seen: %s ago\n", time.Since(traffic.LastSeen).Round(time.Millisecond))
+	}
+}
+
+func printPeerTransfers(peerIP netip.Addr) {
+	transfers := make([]string, 0)
+	if outSequencing.GetSequenceBlocker(peerIP, pkt.MsgTypeChatMessage).IsBlocked() {
+		transfers = append(transfers, "sending message")
+	}
+	if outSequencing.GetSequenceBlocker(peerIP, pkt.MsgTypeFileTransfer).IsBlocked() {
+		transfers = append(transfers, "sending file")
+	}
+
+	receivingMsg, receivingFile, fileBytes := connections.IncomingTransfers(peerIP)
+	if receivingMsg {
+		transfers = append(transfers, "receiving message")
+	}
+	if receivingFile {
+		transfers = append(transfers, fmt.Sprintf("receiving file (%d bytes so far)", fileBytes))
+	}
+
+	fileQueues.mu.Lock()
+	if queue, exists := fileQueues.queues[fileQueueKey{connections: connections, peerIP: peerIP}]; exists {
+		transfers = append(transfers, fmt.Sprintf("%d files queued", len(queue.files)))
+	}
+	fileQueues.mu.Unlock()
+
+	if len(transfers) == 0 {
+		fmt.Println("  Transfers: none")
+		return
+	}
+	fmt.Println("  Transfers:")
+	for _, transfer := range transfers {
+		fmt.Printf("    %s\n", transfer)
+	}
+}
+
+func printPeerLSA(peerIP netip.Addr) {
+	lsa, exists := router.GetLSA(peerIP)
+	if !exists {
+		fmt.Println("  LSA: none")
+		return
+	}
+
+	fmt.Printf("  LSA: seq %d, %d neighbors, updated %s ago\n", lsa.SeqNum, len(lsa.Neighbors), time.Since(lsa.Updated).Round(time.Second))
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/connection"
+)
+
+var presenceStatuses = map[string]byte{
+	"online":  connection.PresenceOnline,
+	"away":    connection.PresenceAway,
+	"offline": connection.PresenceOffline,
+}
+
+// HandlePresence sends our presence status to all reachable hosts.
+// Usage: presence online|away|offline
+func HandlePresence(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: presence online|away|offline")
+		return
+	}
+
+	status, exists := presenceStatuses[args[0]]
+	if !exists {
+		fmt.Println("Usage: presence online|away|offline")
+		return
+	}
+
+	sendPresence(status, netip.Addr{})
+}
+
+// HandleTyping tells a peer that we are typing a message to it.
+// Usage: typing <IPv4 address>
+func HandleTyping(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: typing <IPv4 address>")
+		return
+	}
+
+	peerIP, err := netip.ParseAddr(args[0])
+	if err != nil || !peerIP.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	sendPresence(connection.PresenceTyping, peerIP)
+}
+
+func sendPresence(status byte, target netip.Addr) {
+	sent, err := connections.SendPresence(status, target)
+	switch {
+	case errors.Is(err, connection.ErrPresenceRateLimited):
+		fmt.Println("Presence update dropped, please wait a moment before sending the next one.")
+	case err != nil:
+		fmt.Printf("Failed to send presence update: %v\n", err)
+	case sent == 0:
+		fmt.Println("No reachable hosts to send the presence update to.")
+	default:
+		fmt.Printf("Presence update sent to %d hosts\n", sent)
+	}
+}
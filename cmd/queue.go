@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sequencing"
+)
+
+// fileQueueKey identifies the file queue of a peer, each local node has its own queues.
+type fileQueueKey struct {
+	connections *connection.Manager
+	peerIP      netip.Addr
+}
+
+// fileQueue holds the files waiting until the file currently being sent to the peer is done, in the order they are sent.
+type fileQueue struct {
+	outSequencing *sequencing.OutgoingPktNumHandler
+	files         []queuedFile
+}
+
+type queuedFile struct {
+	path     string
+	queuedAt time.Time
+	quiet    bool // Sent with the console limited to warnings, see sendFile
+}
+
+var fileQueues = struct {
+	mu     sync.Mutex
+	queues map[fileQueueKey]*fileQueue // Empty queues are removed
+}{queues: make(map[fileQueueKey]*fileQueue)}
+
+// enqueueFile appends the file to the queue of the peer and returns its position, starting at 1.
+// The file is started right away if the transfer to the peer finished meanwhile.
+func enqueueFile(connections *connection.Manager, outSequencing *sequencing.OutgoingPktNumHandler, peerIP netip.Addr, path string, quiet bool) int {
+	key := fileQueueKey{connections: connections, peerIP: peerIP}
+
+	fileQueues.mu.Lock()
+	queue, exists := fileQueues.queues[key]
+	if !exists {
+		queue = &fileQueue{outSequencing: outSequencing}
+		fileQueues.queues[key] = queue
+	}
+	queue.files = append(queue.files, queuedFile{path: path, queuedAt: time.Now(), quiet: quiet})
+	position := len(queue.files)
+	fileQueues.mu.Unlock()
+
+	startQueuedFile(connections, outSequencing, peerIP)
+	return position
+}
+
+// startQueuedFile starts the next queued file of the peer unless another file is currently being sent to it.
+// Called whenever a file transfer to the peer ends. Files that can't be started are dropped from the queue.
+func startQueuedFile(connections *connection.Manager, outSequencing *sequencing.OutgoingPktNumHandler, peerIP netip.Addr) {
+	key := fileQueueKey{connections: connections, peerIP: peerIP}
+
+	for {
+		fileQueues.mu.Lock()
+		queue, exists := fileQueues.queues[key]
+		if !exists {
+			fileQueues.mu.Unlock()
+			return
+		}
+
+		blocker := outSequencing.GetSequenceBlocker(peerIP, pkt.MsgTypeFileTransfer)
+		if !blocker.Block("queue " + filepath.Base(queue.files[0].path)) {
+			fileQueues.mu.Unlock()
+			return // Started again when the current transfer ends
+		}
+
+		file := queue.files[0]
+		queue.files = queue.files[1:]
+		if len(queue.files) == 0 {
+			delete(fileQueues.queues, key)
+		}
+		fileQueues.mu.Unlock()
+
+		transfer, err := startQueuedTransfer(connections, outSequencing, peerIP, blocker, file.path)
+		if err != nil {
+			fmt.Printf("Failed to send queued file %s to %s: %v\n", file.path, peerIP, err)
+			events.FileSent.NotifyObservers(events.FileSentEvent{
+				To:   peerIP,
+				Name: filepath.Base(file.path),
+				Err:  err,
+			})
+			continue
+		}
+
+		fmt.Printf("Sending queued file %s to %s\n", file.path, peerIP)
+		go sendFile([]*fileTransfer{transfer}, file.path, file.quiet)
+		return
+	}
+}
+
+// startQueuedTransfer starts the transfer of a queued file with the blocked file sequence, the file may have changed since it was queued.
+// The sequence is unblocked if the transfer can't be started.
+func startQueuedTransfer(connections *connection.Manager, outSequencing *sequencing.OutgoingPktNumHandler, peerIP netip.Addr, blocker *sequencing.SequenceBlocker, path string) (*fileTransfer, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		blocker.Unblock()
+		return nil, err
+	}
+	if fileInfo.IsDir() {
+		blocker.Unblock()
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+
+	return startBlockedFileTransfer(connections, outSequencing, peerIP, blocker, fileInfo.Name(), fileInfo.Size())
+}
+
+// HandleQueue lists, reorders or cancels the files queued for peers of the selected node.
+// Positions start at 1, "move" moves a file to the given position and "cancel" removes a file or all files from the queue.
+// Usage: queue [<IPv4 address> [move <position> <new position> | cancel (<position> | all)]]
+func HandleQueue(args []string) {
+	if len(args) == 0 {
+		listQueues()
+		return
+	}
+
+	peerIP, err := netip.ParseAddr(args[0])
+	if err != nil || !peerIP.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	switch {
+	case len(args) == 1:
+		listQueue(peerIP)
+	case len(args) == 4 && args[1] == "move":
+		moveQueuedFile(peerIP, args[2], args[3])
+	case len(args) == 3 && args[1] == "cancel":
+		cancelQueuedFile(peerIP, args[2])
+	default:
+		fmt.Println("Usage: queue [<IPv4 address> [move <position> <new position> | cancel (<position> | all)]]")
+	}
+}
+
+// listQueues prints the queues of all peers of the selected node.
+func listQueues() {
+	fileQueues.mu.Lock()
+	peerIPs := make([]netip.Addr, 0)
+	for key := range fileQueues.queues {
+		if key.connections == connections {
+			peerIPs = append(peerIPs, key.peerIP)
+		}
+	}
+	fileQueues.mu.Unlock()
+
+	if len(peerIPs) == 0 {
+		fmt.Println("No queued files")
+		return
+	}
+
+	slices.SortFunc(peerIPs, netip.Addr.Compare)
+	for _, peerIP := range peerIPs {
+		listQueue(peerIP)
+	}
+}
+
+func listQueue(peerIP netip.Addr) {
+	fileQueues.mu.Lock()
+	defer fileQueues.mu.Unlock()
+
+	queue, exists := fileQueues.queues[fileQueueKey{connections: connections, peerIP: peerIP}]
+	if !exists {
+		fmt.Printf("No files queued for %s\n", peerIP)
+		return
+	}
+
+	fmt.Printf("Files queued for %s:\n", peerIP)
+	for i, file := range queue.files {
+		fmt.Printf("  %d. %s (queued %s ago)\n", i+1, file.path, time.Since(file.queuedAt).Round(time.Second))
+	}
+}
+
+func moveQueuedFile(peerIP netip.Addr, fromString string, toString string) {
+	fileQueues.mu.Lock()
+	defer fileQueues.mu.Unlock()
+
+	queue, exists := fileQueues.queues[fileQueueKey{connections: connections, peerIP: peerIP}]
+	if !exists {
+		fmt.Printf("No files queued for %s\n", peerIP)
+		return
+	}
+
+	from, err := parseQueuePosition(fromString, len(queue.files))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	to, err := parseQueuePosition(toString, len(queue.files))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	file := queue.files[from]
+	queue.files = slices.Delete(queue.files, from, from+1)
+	queue.files = slices.Insert(queue.files, to, file)
+
+	fmt.Printf("Moved %s to position %d\n", file.path, to+1)
+}
+
+func cancelQueuedFile(peerIP netip.Addr, positionString string) {
+	fileQueues.mu.Lock()
+	defer fileQueues.mu.Unlock()
+
+	key := fileQueueKey{connections: connections, peerIP: peerIP}
+	queue, exists := fileQueues.queues[key]
+	if !exists {
+		fmt.Printf("No files queued for %s\n", peerIP)
+		return
+	}
+
+	if positionString == "all" {
+		delete(fileQueues.queues, key)
+		fmt.Printf("Removed %d queued files for %s\n", len(queue.files), peerIP)
+		return
+	}
+
+	i, err := parseQueuePosition(positionString, len(queue.files))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	file := queue.files[i]
+	queue.files = slices.Delete(queue.files, i, i+1)
+	if len(queue.files) == 0 {
+		delete(fileQueues.queues, key)
+	}
+
+	fmt.Printf("Removed %s from the queue\n", file.path)
+}
+
+// parseQueuePosition parses a position of a queue with length files and returns its index.
+func parseQueuePosition(positionString string, length int) (int, error) {
+	position, err := strconv.Atoi(positionString)
+	if err != nil || position < 1 || position > length {
+		return 0, fmt.Errorf("Invalid position %s, the queue has %d files", positionString, length)
+	}
+	return position - 1, nil
+}
@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+const sendRawUsage = "Usage: send-raw [--yes] <IPv4 address:port> <hex>"
+const craftUsage = "Usage: craft [type=<name | 0-15>] [src=<IPv4 address>] [dst=<IPv4 address>] [team=<0-15>] [ttl=<0-255>] [pktnum=<number>] [checksum=<hex | auto>] [ext=<type>:<hex>]... [payloadhex=<hex> | payload=<text>]"
+
+// NewSendRawHandler returns the handler of the send-raw command, which sends arbitrary bytes to an address, e.g. to test how peers handle malformed packets.
+// The bytes are sent from our socket as they are, without MAC or any check. Unless --yes is given, the user must confirm on input.
+// input is the rest of the command input, see inputreader.InputReader.Read.
+// Usage: send-raw [--yes] <IPv4 address:port> <hex>
+func NewSendRawHandler(input io.Reader) func(args []string) {
+	return func(args []string) {
+		confirmed := len(args) > 0 && args[0] == "--yes"
+		if confirmed {
+			args = args[1:]
+		}
+		if len(args) < 2 {
+			fmt.Println(sendRawUsage)
+			return
+		}
+
+		addrPort, err := netip.ParseAddrPort(args[0])
+		if err != nil || !addrPort.Addr().Is4() {
+			fmt.Printf("Invalid IPv4 address and port: %s\n", args[0])
+			return
+		}
+
+		data, err := hex.DecodeString(strings.Join(args[1:], "")) // The hex may be split into groups
+		if err != nil {
+			fmt.Printf("Invalid hex: %v\n", err)
+			return
+		}
+
+		if packet, err := pkt.ParsePacket(data); err != nil {
+			fmt.Printf("The %d bytes don't parse as packet: %v\n", len(data), err)
+		} else {
+			fmt.Printf("The %d bytes parse as %v (checksum valid: %v)\n", len(data), packet, pkt.VerifyChecksum(packet))
+		}
+
+		if !confirmed && !confirm(input, fmt.Sprintf("Send them to %s?", addrPort)) {
+			fmt.Println("Not sent.")
+			return
+		}
+
+		if err := socket.SendTo(net.UDPAddrFromAddrPort(addrPort), data); err != nil {
+			fmt.Printf("Failed to send to %s: %v\n", addrPort, err)
+			return
+		}
+		fmt.Printf("Sent %d bytes to %s\n", len(data), addrPort)
+	}
+}
+
+// confirm asks the question and reads the answer from the next input line, only "y" and "yes" confirm.
+// The input is read byte by byte, so the following commands stay unread.
+func confirm(input io.Reader, question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+
+	var answer strings.Builder
+	buf := make([]byte, 1)
+	for {
+		n, err := input.Read(buf)
+		if n == 1 && buf[0] != '\n' {
+			answer.WriteByte(buf[0])
+		}
+		if n == 1 && buf[0] == '\n' || err != nil {
+			break
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer.String())) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// HandleCraft builds a packet from named fields and prints it as hex for send-raw.
+// Fields that aren't given are taken from a valid packet of the selected node to itself: MSG, our address, our team, initial TTL, packet number 0.
+// The checksum is computed unless it is given, payload= takes the rest of the line as text.
+// Usage: craft [type=<name | 0-15>] [src=<IPv4 address>] [dst=<IPv4 address>] [team=<0-15>] [ttl=<0-255>] [pktnum=<number>] [checksum=<hex | auto>] [ext=<type>:<hex>]... [payloadhex=<hex> | payload=<text>]
+func HandleCraft(args []string) {
+	packet, err := craftPacket(args)
+	if err != nil {
+		fmt.Printf("%v\n%s\n", err, craftUsage)
+		return
+	}
+
+	fmt.Printf("%v\n", packet)
+	fmt.Println(hex.EncodeToString(packet.ToByteArray()))
+}
+
+// craftPacket builds the packet of the craft command from its arguments.
+func craftPacket(args []string) (*pkt.Packet, error) {
+	msgType := byte(pkt.MsgTypeChatMessage)
+	teamID := connections.TeamID()
+	packet := &pkt.Packet{
+		Header: pkt.Header{
+			TTL: common.INITIAL_TTL,
+		},
+	}
+	if localAddr, err := socket.GetLocalAddress(); err == nil {
+		packet.Header.SourceAddr = localAddr.Addr().As4()
+		packet.Header.DestAddr = localAddr.Addr().As4()
+	}
+
+	var checksum []byte // nil computes the checksum
+
+	for i, arg := range args {
+		name, value, found := strings.Cut(arg, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid field %q, want <name>=<value>", arg)
+		}
+
+		var err error
+		switch name {
+		case "type":
+			msgType, err = parseCraftMsgType(value)
+		case "src":
+			packet.Header.SourceAddr, err = parseCraftAddr(value)
+		case "dst":
+			packet.Header.DestAddr, err = parseCraftAddr(value)
+		case "team":
+			var id uint64
+			id, err = strconv.ParseUint(value, 0, 4)
+			teamID = byte(id)
+		case "ttl":
+			var ttl uint64
+			ttl, err = strconv.ParseUint(value, 0, 8)
+			packet.Header.TTL = byte(ttl)
+		case "pktnum":
+			var pktNum uint64
+			pktNum, err = strconv.ParseUint(value, 0, 32)
+			binary.BigEndian.PutUint32(packet.Header.PktNum[:], uint32(pktNum))
+		case "checksum":
+			if value != "auto" {
+				checksum, err = hex.DecodeString(value)
+				if err == nil && len(checksum) != 2 {
+					err = errors.New("checksum must be 2 bytes")
+				}
+			}
+		case "ext":
+			err = addCraftExtension(packet, value)
+		case "payloadhex":
+			packet.Payload, err = hex.DecodeString(value)
+		case "payload":
+			packet.Payload = pkt.Payload(strings.Join(append([]string{value}, args[i+1:]...), " "))
+		default:
+			err = errors.New("unknown field")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+
+		if name == "payload" {
+			break // The text is the rest of the line
+		}
+	}
+
+	packet.Header.Control = pkt.MakeControlByte(msgType, teamID)
+	if checksum != nil {
+		packet.Header.Checksum = [2]byte(checksum)
+	} else {
+		pkt.SetChecksum(packet)
+	}
+	return packet, nil
+}
+
+// parseCraftMsgType parses a message type given by its name in the wire format (e.g. "MSG") or as number.
+func parseCraftMsgType(value string) (byte, error) {
+	for _, msg := range pkt.DescribeWireFormat().MessageTypes {
+		if strings.EqualFold(msg.Name, value) {
+			return msg.Type, nil
+		}
+	}
+
+	msgType, err := strconv.ParseUint(value, 0, 4)
+	if err != nil {
+		return 0, errors.New("unknown message type")
+	}
+	return byte(msgType), nil
+}
+
+func parseCraftAddr(value string) ([4]byte, error) {
+	addr, err := netip.ParseAddr(value)
+	if err != nil || !addr.Is4() {
+		return [4]byte{}, errors.New("not an IPv4 address")
+	}
+	return addr.As4(), nil
+}
+
+// addCraftExtension adds an extension given as <type>:<hex value>, e.g. "0x1:00000005".
+func addCraftExtension(packet *pkt.Packet, value string) error {
+	typeString, valueHex, _ := strings.Cut(value, ":")
+
+	extType, err := strconv.ParseUint(typeString, 0, 8)
+	if err != nil {
+		return errors.New("extension type must be a number (0-255)")
+	}
+	extValue, err := hex.DecodeString(valueHex)
+	if err != nil {
+		return err
+	}
+
+	packet.AddExtension(byte(extType), extValue)
+	return nil
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+
+	"bjoernblessin.de/chatprotogol/common"
+)
+
+// HandleRebind moves the socket to a new local address without losing connections, e.g. after a network change.
+// Unlike init, our address in the protocol stays the same and neighbors are told to reach us at the new address.
+// The address is selected like for init.
+func HandleRebind(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("Usage: rebind (<IP address> | <interface name> | auto [<target IP address>]) Example: rebind 192.168.1.20; rebind wlan0")
+		PrintInterfaceAddresses()
+		return
+	}
+
+	if _, err := socket.GetLocalAddress(); err != nil {
+		fmt.Println("Not initialized, use 'init' first.")
+		return
+	}
+
+	hostAddr, err := resolveInitAddress(args)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	boundAddr, err := connections.Rebind(net.IP(hostAddr.AsSlice()))
+	if err != nil {
+		fmt.Printf("Failed to rebind: %v\n", err)
+		return
+	}
+
+	// The port mapping of the old address is useless now
+	connections.StopNATTraversal()
+	if common.NAT_TRAVERSAL {
+		connections.StartNATTraversal(boundAddr)
+	}
+	if err := connections.RestartDiscovery(boundAddr); err != nil {
+		fmt.Printf("Failed to restart discovery: %v\n", err)
+	}
+
+	fmt.Printf("Listening on %s as %s\n", boundAddr, socket.MustGetLocalAddress().Addr())
+}
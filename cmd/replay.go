@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+
+	"bjoernblessin.de/chatprotogol/sequencing"
+)
+
+const maxReplayDivergences = 10 // Divergences printed by the replay command, the first one is usually the interesting one
+
+// HandleReplay replays a sequencing journal (see sequencing.ReplayJournal) and reports where the replayed congestion state diverges from the recorded one.
+// Usage: replay <journal>
+func HandleReplay(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: replay <journal>")
+		return
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		fmt.Printf("Failed to open %s: %v\n", args[0], err)
+		return
+	}
+	defer file.Close()
+
+	replay, err := sequencing.ReplayJournal(file)
+	if err != nil {
+		fmt.Printf("Replay stopped: %v\n", err)
+	}
+
+	fmt.Printf("Replayed %d events:", replay.Entries)
+	for _, kind := range slices.Sorted(maps.Keys(replay.Kinds)) {
+		fmt.Printf(" %s %d", kind, replay.Kinds[kind])
+	}
+	fmt.Println()
+
+	if len(replay.Divergences) == 0 {
+		fmt.Println("No divergences, the replay reproduces the recorded state.")
+	} else {
+		fmt.Printf("%d divergences:\n", len(replay.Divergences))
+		for _, divergence := range replay.Divergences[:min(len(replay.Divergences), maxReplayDivergences)] {
+			fmt.Printf("  Line %d, %s %d of %s:\n", divergence.Line, divergence.Entry.Kind, divergence.Entry.PktNum, divergence.Entry.Peer)
+			fmt.Printf("    recorded %s\n", formatJournalState(*divergence.Entry.State))
+			fmt.Printf("    replayed %s\n", formatJournalState(divergence.Replayed))
+		}
+	}
+
+	if len(replay.Peers) > 0 {
+		fmt.Println("Final state:")
+		for _, addr := range slices.SortedFunc(maps.Keys(replay.Peers), netip.Addr.Compare) {
+			fmt.Printf("  %s: %s\n", addr, formatJournalState(replay.Peers[addr]))
+		}
+	}
+}
+
+func formatJournalState(state sequencing.JournalState) string {
+	ssthresh := "inf"
+	if state.Ssthresh != 0 {
+		ssthresh = formatSsthresh(state.Ssthresh)
+	}
+	return fmt.Sprintf("cwnd %d, ssthresh %s, acc %d, highest ACK %d, open ACKs %d, SRTT %v", state.Cwnd, ssthresh, state.CAvoidanceAcc, state.HighestAcked, state.OpenAcks, state.SRTT)
+}
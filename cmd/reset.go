@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"fmt"
+)
+
+// HandleReset restarts our packet numbers to a peer with a RESET, e.g. if the peer keeps dropping our packets as duplicates after its state diverged from ours.
+// Unfinished transfers to the peer are cancelled.
+func HandleReset(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: reset <IPv4 address> Example: reset 10.10.10.2")
+		return
+	}
+
+	addr, ok := parseIPv4(args[0])
+	if !ok {
+		return
+	}
+
+	ackChan, err := connections.ResetPeer(addr)
+	if err != nil {
+		fmt.Printf("Failed to reset %s: %v\n", addr, err)
+		return
+	}
+
+	if <-ackChan {
+		fmt.Printf("Reset the packet numbers to %s\n", addr)
+	} else {
+		fmt.Printf("No ACK received from %s, it might still drop our packets as duplicates.\n", addr)
+	}
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"bjoernblessin.de/chatprotogol/events"
+)
+
+const roomUsage = "Usage: room [create <name> | close <name> | join <host IPv4 address> <name> | leave <name> | msg <name> <text>]"
+
+// HandleRoom lists the rooms we host or joined, or creates, closes, joins, leaves or posts to a room.
+// Usage: room [create <name> | close <name> | join <host IPv4 address> <name> | leave <name> | msg <name> <text>]
+func HandleRoom(args []string) {
+	if len(args) == 0 {
+		listRooms()
+		return
+	}
+
+	var err error
+	switch {
+	case args[0] == "create" && len(args) == 2:
+		err = connections.CreateRoom(args[1])
+		if err == nil {
+			fmt.Printf("Hosting room %s\n", args[1])
+		}
+	case args[0] == "close" && len(args) == 2:
+		err = connections.CloseRoom(args[1])
+		if err == nil {
+			fmt.Printf("Closed room %s\n", args[1])
+		}
+	case args[0] == "join" && len(args) == 3:
+		host, parseErr := netip.ParseAddr(args[1])
+		if parseErr != nil || !host.Is4() {
+			fmt.Printf("Invalid IPv4 address: %s\n", args[1])
+			return
+		}
+		err = connections.JoinRoom(host, args[2])
+		if err == nil {
+			fmt.Printf("Joining room %s on %s...\n", args[2], host)
+		}
+	case args[0] == "leave" && len(args) == 2:
+		err = connections.LeaveRoom(args[1])
+		if err == nil {
+			fmt.Printf("Left room %s\n", args[1])
+		}
+	case args[0] == "msg" && len(args) >= 3:
+		err = connections.SendRoomMessage(args[1], strings.Join(args[2:], " "))
+	default:
+		fmt.Println(roomUsage)
+		return
+	}
+
+	if err != nil {
+		fmt.Printf("Room command failed: %v\n", err)
+	}
+}
+
+func listRooms() {
+	rooms := connections.Rooms()
+	if len(rooms) == 0 {
+		fmt.Println("No rooms.")
+		return
+	}
+
+	for _, room := range rooms {
+		switch {
+		case room.Hosted:
+			fmt.Printf("%s (hosted), %d members\n", room.Name, len(room.Members))
+		case room.Joined:
+			fmt.Printf("%s on %s, %d members\n", room.Name, room.Host, len(room.Members))
+		default:
+			fmt.Printf("%s on %s, joining...\n", room.Name, room.Host)
+		}
+		for _, member := range room.Members {
+			fmt.Printf("  %s\n", member)
+		}
+	}
+}
+
+// printRoomMembership prints that a member joined or left a room.
+func printRoomMembership(change events.RoomMembershipEvent) {
+	action := "left"
+	if change.Joined {
+		action = "joined"
+	}
+
+	if change.Reason != "" {
+		fmt.Printf("ROOM %s: %s %s (%s)\n", change.Room, change.Member, action, change.Reason)
+	} else {
+		fmt.Printf("ROOM %s: %s %s\n", change.Room, change.Member, action)
+	}
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+const routeUsage = "Usage: route [add <destination IPv4 address> via <neighbor IPv4 address> | del <destination IPv4 address>]"
+
+// HandleRoute lists the static routes, or adds or deletes a static route.
+// Static routes take precedence over the shortest paths and survive routing table rebuilds,
+// e.g. to debug asymmetric paths or to force traffic through a specific relay.
+// Usage: route [add <destination IPv4 address> via <neighbor IPv4 address> | del <destination IPv4 address>]
+func HandleRoute(args []string) {
+	switch {
+	case len(args) == 0:
+		listStaticRoutes()
+	case args[0] == "add" && len(args) == 4 && args[2] == "via":
+		dest, ok := parseIPv4(args[1])
+		if !ok {
+			return
+		}
+		via, ok := parseIPv4(args[3])
+		if !ok {
+			return
+		}
+
+		if !router.AddStaticRoute(dest, via) {
+			fmt.Printf("Can't route %s via %s, %s isn't a neighbor or %s is the local address.\n", dest, via, via, dest)
+			return
+		}
+		fmt.Printf("Routing %s via %s\n", dest, via)
+	case args[0] == "del" && len(args) == 2:
+		dest, ok := parseIPv4(args[1])
+		if !ok {
+			return
+		}
+
+		if !router.RemoveStaticRoute(dest) {
+			fmt.Printf("No static route to %s\n", dest)
+			return
+		}
+		fmt.Printf("Removed the static route to %s, the shortest path applies again.\n", dest)
+	default:
+		fmt.Println(routeUsage)
+	}
+}
+
+// parseIPv4 parses an IPv4 address argument and prints an error if it is invalid.
+func parseIPv4(arg string) (addr netip.Addr, ok bool) {
+	addr, err := netip.ParseAddr(arg)
+	if err != nil || !addr.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", arg)
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
+
+func listStaticRoutes() {
+	routes := router.GetStaticRoutes()
+	if len(routes) == 0 {
+		fmt.Println("No static routes.")
+		return
+	}
+
+	fmt.Println("Static Routes:")
+	for _, route := range routes {
+		if route.Active {
+			fmt.Printf("  %s via %s\n", route.Dest, route.Via)
+		} else {
+			fmt.Printf("  %s via %s (inactive, %s isn't a neighbor)\n", route.Dest, route.Via, route.Via)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/sequencing"
+)
+
+const rttHistogramWidth = 40 // Characters of the longest bar of the histogram
+
+// HandleRTT displays the smoothed round-trip time of a peer and the distribution of its ACK round trips, optionally as a histogram.
+// Usage: rtt <IPv4 address> [--hist]
+func HandleRTT(args []string) {
+	if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "--hist") {
+		fmt.Println("Usage: rtt <IPv4 address> [--hist]")
+		return
+	}
+
+	peerIP, err := netip.ParseAddr(args[0])
+	if err != nil || !peerIP.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	stats, exists := outSequencing.GetCongestionStats(peerIP)
+	histogram, measured := outSequencing.GetRTTHistogram(peerIP)
+	if !exists || !measured {
+		fmt.Printf("No round trips to %s measured.\n", peerIP)
+		return
+	}
+
+	fmt.Printf("Round trips to %s (%d samples):\n", peerIP, histogram.Samples)
+	fmt.Printf("  SRTT: %v, RTT variation: %v\n", stats.SRTT.Round(time.Microsecond), stats.RTTVar.Round(time.Microsecond))
+	fmt.Printf("  Min: %v, max: %v\n", histogram.Min.Round(time.Microsecond), histogram.Max.Round(time.Microsecond))
+	fmt.Printf("  p50: <%v, p90: <%v, p99: <%v\n", histogram.Percentile(50), histogram.Percentile(90), histogram.Percentile(99))
+
+	if len(args) == 2 {
+		printRTTHistogram(histogram)
+	}
+}
+
+// printRTTHistogram prints the buckets from the first to the last non-empty one with bars scaled to the largest bucket.
+func printRTTHistogram(histogram sequencing.RTTHistogram) {
+	first, last := -1, 0
+	var largest uint64
+	for i, bucket := range histogram.Buckets {
+		if bucket.Count == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		largest = max(largest, bucket.Count)
+	}
+
+	fmt.Println("  Histogram:")
+	lowerBound := time.Duration(0)
+	for i, bucket := range histogram.Buckets {
+		if i >= first && i <= last {
+			upperBound := "inf"
+			if bucket.UpperBound != math.MaxInt64 {
+				upperBound = bucket.UpperBound.String()
+			}
+			bar := strings.Repeat("#", int(bucket.Count*rttHistogramWidth/largest))
+			if bar == "" && bucket.Count > 0 {
+				bar = "."
+			}
+			fmt.Printf("  %9v - %-9s %6d %s\n", lowerBound, upperBound, bucket.Count, bar)
+		}
+		lowerBound = bucket.UpperBound
+	}
+}
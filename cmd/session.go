@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/connection"
+)
+
+// sessionReportFile is the session summary of all nodes written on exit, see ReportSession.
+type sessionReportFile struct {
+	End   time.Time                   `json:"end"`
+	Nodes []connection.SessionSummary `json:"nodes"`
+}
+
+// ReportSession prints the session summary of every node and writes it to path as JSON, unless path is empty.
+// Called on shutdown.
+func ReportSession(path string) {
+	report := sessionReportFile{End: time.Now()}
+	forEachNode(func() {
+		summary := connections.SessionSummary()
+		printSessionSummary(summary)
+		report.Nodes = append(report.Nodes, summary)
+	})
+
+	if path == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Printf("Failed to serialize the session summary: %v\n", err)
+		return
+	}
+
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		fmt.Printf("Failed to write %s: %v\n", path, err)
+		return
+	}
+
+	fmt.Printf("Session summary written to %s\n", path)
+}
+
+func printSessionSummary(summary connection.SessionSummary) {
+	if summary.Addr.IsValid() {
+		fmt.Printf("Session summary of %s (%v):\n", summary.Addr, summary.Duration.Round(time.Second))
+	} else {
+		fmt.Printf("Session summary (%v):\n", summary.Duration.Round(time.Second))
+	}
+
+	fmt.Printf("  Neighbors connected: %d\n", summary.NeighborsConnected)
+	fmt.Printf("  Messages: %d sent, %d received\n", summary.Messages.Sent, summary.Messages.Received)
+	fmt.Printf("  Files: %d sent, %d received\n", summary.Files.Sent, summary.Files.Received)
+	fmt.Printf("  Sent: %s\n", formatTraffic(summary.Sent))
+	fmt.Printf("  Received: %s\n", formatTraffic(summary.Received))
+	fmt.Printf("  Retransmissions: %d of %d reliable packets (%.1f%%)\n", summary.Retransmissions, summary.ReliablePackets, summary.RetransmissionRate()*100)
+	fmt.Printf("  Route changes: %d\n", summary.RouteChanges)
+
+	for _, peer := range summary.Peers {
+		fmt.Printf("  %s: sent %s, received %s, max cwnd %d\n", peer.Addr, formatTraffic(peer.Sent), formatTraffic(peer.Received), peer.MaxCwnd)
+	}
+}
@@ -0,0 +1,416 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/handler"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// The soak command sends messages and files named "soak-<run>-<n>" and asks the peer for the SHA-256 of what it received,
+// using the message type that is free for embedders (see handler.RegisterType).
+// A request carries the item name, the reply whether the item was received, its hash and the name.
+const (
+	soakEchoType    = 0xE
+	soakEchoRequest = 0x1
+	soakEchoReply   = 0x2
+	soakItemPrefix  = "soak-"
+	soakFileSuffix  = ".bin"
+)
+
+// soakRetryInterval is the interval the echo is requested again while the peer hasn't received the item yet.
+const soakRetryInterval = time.Millisecond * 200
+
+// soakRunes are the characters of the random soak messages, including multi-byte characters that must not be split between chunks.
+var soakRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 äöüß€😀")
+
+// runningSoak is the soak test started last, only accessed by the input loop.
+var runningSoak struct {
+	stop context.CancelFunc
+	done chan struct{} // Closed once the results are printed, nil if no soak test was started
+}
+
+// soakKey identifies an item of a soak test by the peer that sent or received it.
+type soakKey struct {
+	peer netip.Addr
+	name string
+}
+
+type soakEcho struct {
+	received bool
+	hash     [sha256.Size]byte
+}
+
+// soakReceived holds the hashes of the last common.SOAK_ECHO_HISTORY received soak items for echo requests.
+var soakReceived = struct {
+	mu     sync.Mutex
+	hashes map[soakKey][sha256.Size]byte
+	order  []soakKey // Oldest first
+}{
+	hashes: make(map[soakKey][sha256.Size]byte),
+}
+
+// soakWaiters holds the echo requests of running soak tests waiting for their reply.
+var soakWaiters = struct {
+	mu      sync.Mutex
+	waiters map[soakKey]chan soakEcho
+}{
+	waiters: make(map[soakKey]chan soakEcho),
+}
+
+// soakOutcome is the result of a single item of a soak test.
+type soakOutcome int
+
+const (
+	soakVerified    soakOutcome = iota // The peer received the item with the same hash
+	soakCorrupted                      // The peer received the item with another hash
+	soakUnverified                     // The item was delivered but the peer didn't echo its hash
+	soakUndelivered                    // The item wasn't acknowledged completely
+	soakCancelled                      // The item wasn't sent because the soak test was stopped
+)
+
+// soakCounts counts the outcomes of the messages or files of a soak test.
+type soakCounts [soakCancelled]int
+
+func (c soakCounts) sent() int {
+	return c[soakVerified] + c[soakCorrupted] + c[soakUnverified] + c[soakUndelivered]
+}
+
+func (c soakCounts) String() string {
+	return fmt.Sprintf("%d sent, %d verified, %d corrupted, %d unverified, %d undelivered",
+		c.sent(), c[soakVerified], c[soakCorrupted], c[soakUnverified], c[soakUndelivered])
+}
+
+// RegisterSoakEcho lets peers running a soak test to this process verify the items they sent.
+// Should be called once at startup.
+func RegisterSoakEcho() {
+	handler.RegisterType(soakEchoType, handleSoakEcho)
+
+	messages := events.MessageReceived.Subscribe()
+	files := events.FileReceived.Subscribe()
+
+	go func() {
+		for {
+			select {
+			case msg := <-messages:
+				name, _, _ := strings.Cut(msg.Text, " ")
+				if strings.HasPrefix(name, soakItemPrefix) {
+					recordSoakItem(soakKey{msg.From, name}, sha256.Sum256([]byte(msg.Text)))
+				}
+			case file := <-files:
+				name, isSoakFile := strings.CutSuffix(file.OriginalName, soakFileSuffix)
+				if !isSoakFile || !strings.HasPrefix(name, soakItemPrefix) {
+					continue
+				}
+
+				data, err := os.ReadFile(file.Path)
+				if err != nil {
+					fmt.Printf("Failed to read soak file %s: %v\n", file.Path, err)
+					continue
+				}
+				recordSoakItem(soakKey{file.From, name}, sha256.Sum256(data))
+			}
+		}
+	}()
+}
+
+func recordSoakItem(key soakKey, hash [sha256.Size]byte) {
+	soakReceived.mu.Lock()
+	defer soakReceived.mu.Unlock()
+
+	if _, exists := soakReceived.hashes[key]; !exists {
+		soakReceived.order = append(soakReceived.order, key)
+	}
+	soakReceived.hashes[key] = hash
+
+	if len(soakReceived.order) > common.SOAK_ECHO_HISTORY {
+		delete(soakReceived.hashes, soakReceived.order[0])
+		soakReceived.order = soakReceived.order[1:]
+	}
+}
+
+// handleSoakEcho answers echo requests of peers and hands replies to the waiting soak test.
+func handleSoakEcho(packet *pkt.Packet, ctx handler.Context) {
+	payload := packet.Payload
+	if len(payload) < 1 {
+		return
+	}
+
+	switch payload[0] {
+	case soakEchoRequest:
+		name := string(payload[1:])
+
+		soakReceived.mu.Lock()
+		hash, received := soakReceived.hashes[soakKey{ctx.Source, name}]
+		soakReceived.mu.Unlock()
+
+		reply := []byte{soakEchoReply, 0}
+		if received {
+			reply[1] = 1
+		}
+		reply = append(reply, hash[:]...)
+		reply = append(reply, name...)
+
+		go func() {
+			defer panics.Recover("replying to the soak echo request of %v", ctx.Source)
+
+			ctx.Reply(context.Background(), soakEchoType, reply) // A lost reply is requested again
+		}()
+	case soakEchoReply:
+		if len(payload) < 2+sha256.Size {
+			return
+		}
+		echo := soakEcho{received: payload[1] == 1, hash: [sha256.Size]byte(payload[2 : 2+sha256.Size])}
+		key := soakKey{ctx.Source, string(payload[2+sha256.Size:])}
+
+		soakWaiters.mu.Lock()
+		waiter, waiting := soakWaiters.waiters[key]
+		soakWaiters.mu.Unlock()
+
+		if waiting {
+			select {
+			case waiter <- echo:
+			default: // A reply to an earlier request was already handed over
+			}
+		}
+	}
+}
+
+// HandleSoak sends random messages and small files to a peer for the given number of seconds and verifies that the peer received them intact.
+// Every item is sent after the previous one was delivered, the peer echoes the SHA-256 of each delivered item.
+// The impairment of the netem command applies, so the protocol can be tested under loss and reordering on any network.
+// "soak stop" stops the test after the current item.
+// Usage: soak <IPv4 address> <seconds> | soak stop
+func HandleSoak(args []string) {
+	if len(args) == 1 && args[0] == "stop" {
+		if !isSoakRunning() {
+			fmt.Println("No soak test is running.")
+			return
+		}
+		runningSoak.stop()
+		return
+	}
+
+	if len(args) != 2 {
+		fmt.Println("Usage: soak <IPv4 address> <seconds> | soak stop")
+		return
+	}
+
+	if isSoakRunning() {
+		fmt.Println("A soak test is already running, stop it with 'soak stop'.")
+		return
+	}
+
+	peerIP, err := netip.ParseAddr(args[0])
+	if err != nil || !peerIP.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	seconds, err := strconv.Atoi(args[1])
+	if err != nil || seconds <= 0 {
+		fmt.Printf("Invalid number of seconds: %s\n", args[1])
+		return
+	}
+	duration := time.Duration(seconds) * time.Second
+
+	netem := connections.Netem()
+	if netem.Enabled() {
+		fmt.Printf("Soak testing %s for %v with %s. Stop with 'soak stop'.\n", peerIP, duration, formatNetem(netem))
+	} else {
+		fmt.Printf("Soak testing %s for %v without impairment, see netem. Stop with 'soak stop'.\n", peerIP, duration)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	done := make(chan struct{})
+	runningSoak.stop = cancel
+	runningSoak.done = done
+
+	go func() {
+		defer close(done)
+		defer cancel()
+
+		runSoak(ctx, connections, outSequencing, peerIP)
+	}()
+}
+
+func isSoakRunning() bool {
+	if runningSoak.done == nil {
+		return false
+	}
+
+	select {
+	case <-runningSoak.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// runSoak sends soak items to the peer until ctx is done and prints the results.
+func runSoak(ctx context.Context, connections *connection.Manager, outSequencing *sequencing.OutgoingPktNumHandler, peerIP netip.Addr) {
+	defer panics.Recover("soak testing %s", peerIP)
+
+	start := time.Now()
+	run := mathrand.Uint32()
+	totalsBefore := outSequencing.GetPeerTotals()[peerIP]
+	netemBefore := connections.NetemStats()
+
+	var messages, files soakCounts
+	for i := 1; ctx.Err() == nil; i++ {
+		name := fmt.Sprintf("%s%08x-%d", soakItemPrefix, run, i)
+
+		if i%common.SOAK_FILE_INTERVAL == 0 {
+			files[soakFile(ctx, connections, outSequencing, peerIP, name)]++
+		} else {
+			messages[soakMessage(ctx, connections, outSequencing, peerIP, name)]++
+		}
+	}
+
+	totals := outSequencing.GetPeerTotals()[peerIP]
+	netem := connections.NetemStats()
+
+	fmt.Printf("Soak test to %s finished after %v:\n", peerIP, time.Since(start).Round(time.Second))
+	fmt.Printf("  Messages: %s\n", messages)
+	fmt.Printf("  Files: %s\n", files)
+	fmt.Printf("  Retransmissions: %d of %d reliable packets\n", totals.Retransmissions-totalsBefore.Retransmissions, totals.Packets-totalsBefore.Packets)
+	fmt.Printf("  Impaired datagrams: %d dropped, %d reordered\n", netem.Dropped-netemBefore.Dropped, netem.Reordered-netemBefore.Reordered)
+
+	failed := 0
+	for _, outcome := range []soakOutcome{soakCorrupted, soakUnverified, soakUndelivered} {
+		failed += messages[outcome] + files[outcome]
+	}
+	if failed > 0 {
+		fmt.Printf("Soak test to %s FAILED: %d of %d items weren't received intact\n", peerIP, failed, messages.sent()+files.sent())
+	} else {
+		fmt.Printf("Soak test to %s passed: all %d items were received intact\n", peerIP, messages.sent()+files.sent())
+	}
+}
+
+// soakMessage sends a message of random size starting with the item name and verifies it.
+func soakMessage(ctx context.Context, connections *connection.Manager, outSequencing *sequencing.OutgoingPktNumHandler, peerIP netip.Addr, name string) soakOutcome {
+	text := name + " " + randomSoakText(mathrand.IntN(common.SOAK_MAX_MESSAGE_SIZE_BYTES)+1)
+
+	blocker := outSequencing.GetSequenceBlocker(peerIP, pkt.MsgTypeChatMessage)
+	for !blocker.Block("soak " + name) {
+		if sleepContext(ctx, soakRetryInterval) != nil {
+			return soakCancelled
+		}
+	}
+
+	status := sendMsgChunks(connections, outSequencing, peerIP, text, time.Now(), blocker)
+	if !status.Delivered() {
+		return soakUndelivered
+	}
+	return verifySoakItem(ctx, connections, peerIP, name, sha256.Sum256([]byte(text)))
+}
+
+// soakFile sends a file of random size and content named after the item and verifies it.
+func soakFile(ctx context.Context, connections *connection.Manager, outSequencing *sequencing.OutgoingPktNumHandler, peerIP netip.Addr, name string) soakOutcome {
+	data := make([]byte, mathrand.IntN(common.SOAK_MAX_FILE_SIZE_BYTES)+1)
+	rand.Read(data)
+	fileName := name + soakFileSuffix
+
+	sent := events.FileSent.Subscribe()
+	defer events.FileSent.Unsubscribe(sent)
+
+	transfer, err := startFileTransfer(connections, outSequencing, peerIP, fileName, int64(len(data)))
+	for err == errFileTransferBusy {
+		if sleepContext(ctx, soakRetryInterval) != nil {
+			return soakCancelled
+		}
+		transfer, err = startFileTransfer(connections, outSequencing, peerIP, fileName, int64(len(data)))
+	}
+	if err != nil {
+		return soakUndelivered
+	}
+
+	sendFileChunks([]*fileTransfer{transfer}, bytes.NewReader(data), fileName, int64(len(data)))
+
+	// The result is published before sendFileChunks returns
+	for {
+		select {
+		case result := <-sent:
+			if result.To != peerIP || result.Name != fileName {
+				continue
+			}
+			if result.Err != nil {
+				return soakUndelivered
+			}
+			return verifySoakItem(ctx, connections, peerIP, name, sha256.Sum256(data))
+		default:
+			return soakUndelivered
+		}
+	}
+}
+
+// verifySoakItem requests the hash of a delivered item from the peer until it arrives or common.SOAK_ECHO_TIMEOUT passes.
+// The peer may not have processed the item yet when its delivery is acknowledged, so the request is repeated while the peer doesn't know the item.
+func verifySoakItem(ctx context.Context, connections *connection.Manager, peerIP netip.Addr, name string, hash [sha256.Size]byte) soakOutcome {
+	key := soakKey{peerIP, name}
+	waiter := make(chan soakEcho, 1)
+
+	soakWaiters.mu.Lock()
+	soakWaiters.waiters[key] = waiter
+	soakWaiters.mu.Unlock()
+
+	defer func() {
+		soakWaiters.mu.Lock()
+		delete(soakWaiters.waiters, key)
+		soakWaiters.mu.Unlock()
+	}()
+
+	// The echo is requested independent of ctx, so the last item of a soak test is verified too
+	echoCtx, cancel := context.WithTimeout(context.Background(), common.SOAK_ECHO_TIMEOUT)
+	defer cancel()
+
+	request := append([]byte{soakEchoRequest}, name...)
+	for {
+		packet := connections.BuildSequencedPacket(soakEchoType, request, peerIP)
+		if _, err := connections.SendReliableRoutedPacket(echoCtx, packet); err != nil {
+			return soakUnverified
+		}
+
+		select {
+		case echo := <-waiter:
+			if !echo.received {
+				break // Not processed yet, request again
+			}
+			if echo.hash != hash {
+				return soakCorrupted
+			}
+			return soakVerified
+		case <-echoCtx.Done():
+			return soakUnverified
+		}
+
+		if sleepContext(echoCtx, soakRetryInterval) != nil {
+			return soakUnverified
+		}
+	}
+}
+
+// randomSoakText returns random text of at least size bytes.
+func randomSoakText(size int) string {
+	var text strings.Builder
+	for text.Len() < size {
+		text.WriteRune(soakRunes[mathrand.IntN(len(soakRunes))])
+	}
+	return text.String()
+}
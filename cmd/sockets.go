@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// HandleSockets lists the local sockets with the neighbors they reach and the neighbor of the connected-UDP fast path.
+func HandleSockets(args []string) {
+	if len(args) != 0 {
+		fmt.Println("Usage: sockets")
+		return
+	}
+
+	set, ok := socket.(*sock.SocketSet)
+	if !ok {
+		boundAddr, err := socket.GetBoundAddress()
+		if err != nil {
+			fmt.Println("Not initialized, use 'init' first.")
+			return
+		}
+		fmt.Printf("Listening on %s\n", boundAddr)
+		printConnectedPeer(socket)
+		return
+	}
+
+	for i, member := range set.Members() {
+		role := ""
+		if member.Primary {
+			role = " (primary)"
+		}
+
+		if !member.BoundAddr.IsValid() {
+			fmt.Printf("%d: closed%s\n", i+1, role)
+			continue
+		}
+		fmt.Printf("%d: %s%s, %d neighbors\n", i+1, member.BoundAddr, role, len(member.Neighbors))
+		for _, neighbor := range member.Neighbors {
+			fmt.Printf("  %s\n", neighbor)
+		}
+	}
+	printConnectedPeer(socket)
+}
+
+func printConnectedPeer(s sock.Socket) {
+	if peer, connected := s.ConnectedPeer(); connected {
+		fmt.Printf("Connected-UDP fast path to %s\n", peer)
+	}
+}
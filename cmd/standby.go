@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+
+	"bjoernblessin.de/chatprotogol/util/assert"
+)
+
+// HandleStandby advertises us as non-forwarding for planned maintenance.
+// Neighbors stay connected and we stay reachable, but other hosts route around us.
+// Usage: standby
+func HandleStandby(args []string) {
+	if len(args) != 0 {
+		fmt.Println("Usage: standby")
+		return
+	}
+
+	setStub(true)
+}
+
+// HandleResume ends the standby, other hosts route through us again.
+// Usage: resume
+func HandleResume(args []string) {
+	if len(args) != 0 {
+		fmt.Println("Usage: resume")
+		return
+	}
+
+	setStub(false)
+}
+
+// setStub floods the local LSA if the stub flag changed.
+func setStub(stub bool) {
+	localAddrPort, err := socket.GetLocalAddress()
+	if err != nil {
+		fmt.Println("Not initialized, use 'init' first.")
+		return
+	}
+
+	if !router.SetStub(stub) {
+		if stub {
+			fmt.Println("Already in standby.")
+		} else {
+			fmt.Println("Not in standby.")
+		}
+		return
+	}
+
+	localAddr := localAddrPort.Addr()
+	localLSA, exists := router.GetLSA(localAddr)
+	assert.Assert(exists, "LSA should exist for the local address")
+	connections.FloodLSA(localAddr, localLSA)
+
+	if stub {
+		fmt.Println("Standby: other hosts route around us, neighbors stay connected. Use 'resume' to forward again.")
+	} else {
+		fmt.Println("Resumed forwarding.")
+	}
+}
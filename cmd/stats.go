@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"bjoernblessin.de/chatprotogol/connection"
+)
+
+// HandleStats displays the packets this node forwarded for other hosts.
+// Transit traffic is listed per neighbor (received from / forwarded to) and per ingress neighbor and destination.
+// "stats reset" clears the counters.
+func HandleStats(args []string) {
+	if len(args) == 1 && args[0] == "reset" {
+		connections.ResetForwardingStats()
+		fmt.Println("Forwarding statistics cleared.")
+		return
+	}
+	if len(args) != 0 {
+		fmt.Println("Usage: stats [reset]")
+		return
+	}
+
+	stats := connections.ForwardingStats()
+	if len(stats.Flows) == 0 {
+		fmt.Println("No packets forwarded.")
+		return
+	}
+
+	neighborNames := make(map[netip.AddrPort]string)
+	for addr, addrPort := range router.GetNeighbors() {
+		neighborNames[netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())] = fmt.Sprintf("%s (%s)", addr, addrPort)
+	}
+	name := func(addrPort netip.AddrPort) string {
+		if name, isNeighbor := neighborNames[addrPort]; isNeighbor {
+			return name
+		}
+		return fmt.Sprintf("%s (no neighbor)", addrPort)
+	}
+
+	neighbors := make([]netip.AddrPort, 0, len(stats.Ingress)+len(stats.NextHops))
+	for addrPort := range stats.Ingress {
+		neighbors = append(neighbors, addrPort)
+	}
+	for addrPort := range stats.NextHops {
+		if _, exists := stats.Ingress[addrPort]; !exists {
+			neighbors = append(neighbors, addrPort)
+		}
+	}
+	slices.SortFunc(neighbors, netip.AddrPort.Compare)
+
+	fmt.Println("Forwarded per neighbor (received from / forwarded to):")
+	for _, addrPort := range neighbors {
+		fmt.Printf("  %s: %s / %s\n", name(addrPort), formatTraffic(stats.Ingress[addrPort]), formatTraffic(stats.NextHops[addrPort]))
+	}
+
+	flows := make([]connection.ForwardingFlow, 0, len(stats.Flows))
+	for flow := range stats.Flows {
+		flows = append(flows, flow)
+	}
+	slices.SortFunc(flows, func(a, b connection.ForwardingFlow) int {
+		if c := a.Ingress.Compare(b.Ingress); c != 0 {
+			return c
+		}
+		return a.Dest.Compare(b.Dest)
+	})
+
+	fmt.Println("Forwarded per ingress neighbor and destination:")
+	for _, flow := range flows {
+		fmt.Printf("  %s -> %s: %s\n", name(flow.Ingress), flow.Dest, formatTraffic(stats.Flows[flow]))
+	}
+
+	if stats.CongestionMarked > 0 {
+		fmt.Printf("Marked %d forwarded data packets as congestion experienced\n", stats.CongestionMarked)
+	}
+}
+
+// formatTraffic formats a traffic counter, e.g. "12 packets, 14400 bytes".
+func formatTraffic(counter connection.TrafficCounter) string {
+	return fmt.Sprintf("%d packets, %d bytes", counter.Packets, counter.Bytes)
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// HandleTeam displays the team ID and the number of dropped packets per foreign team, or toggles promiscuous mode.
+// Usage: team [promisc on|off]
+func HandleTeam(args []string) {
+	if len(args) == 2 && args[0] == "promisc" && (args[1] == "on" || args[1] == "off") {
+		connections.SetPromiscuous(args[1] == "on")
+		fmt.Printf("Promiscuous mode %s\n", args[1])
+		return
+	}
+
+	if len(args) != 0 {
+		fmt.Println("Usage: team [promisc on|off]")
+		return
+	}
+
+	mode := "off"
+	if connections.IsPromiscuous() {
+		mode = "on"
+	}
+	fmt.Printf("Team %d, promiscuous mode %s\n", connections.TeamID(), mode)
+
+	drops := connections.TeamDrops()
+	if len(drops) == 0 {
+		fmt.Println("No packets of other teams dropped.")
+		return
+	}
+
+	fmt.Println("Dropped packets of other teams:")
+	for _, id := range slices.Sorted(maps.Keys(drops)) {
+		fmt.Printf("  Team %-2d %d\n", id, drops[id])
+	}
+}
@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/ringbuffer"
+)
+
+// TimelineEntry is something that happened with a peer, see HandleTimeline.
+type TimelineEntry struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"` // "peer", "routing", "transfer", "congestion" or "log"
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail"`
+}
+
+// transferKey identifies a file transfer that is in progress, see timelineRecorder.milestones.
+type transferKey struct {
+	peer      netip.Addr
+	direction events.TransferDirection
+}
+
+// timelineRecorder keeps the recent peer, routing and transfer events of each peer from the event bus.
+// Congestion events and log lines are kept elsewhere, they are merged in when the timeline is shown.
+type timelineRecorder struct {
+	mu         sync.Mutex
+	peers      map[netip.Addr]*ringbuffer.RingBuffer[TimelineEntry]
+	milestones map[transferKey]int64 // Last recorded quarter of a transfer in progress
+}
+
+var timeline = &timelineRecorder{
+	peers:      make(map[netip.Addr]*ringbuffer.RingBuffer[TimelineEntry]),
+	milestones: make(map[transferKey]int64),
+}
+
+// StartTimeline records the events of the peers for the timeline command.
+// Should be called once at startup.
+func StartTimeline() {
+	connected := events.PeerConnected.Subscribe()
+	lost := events.PeerLost.Subscribe()
+	routes := events.RouteChanged.Subscribe()
+	progress := events.TransferProgress.Subscribe()
+	sent := events.FileSent.Subscribe()
+	received := events.FileReceived.Subscribe()
+	aborted := events.TransferAborted.Subscribe()
+
+	go func() {
+		for {
+			select {
+			case peer := <-connected:
+				if peer.Relay.IsValid() {
+					timeline.record(peer.Addr, "peer", "CONNECTED", fmt.Sprintf("via relay %s", peer.Relay))
+				} else {
+					timeline.record(peer.Addr, "peer", "CONNECTED", fmt.Sprintf("at %s", peer.AddrPort))
+				}
+			case peer := <-lost:
+				timeline.record(peer.Addr, "peer", "LOST", "state cleared")
+			case change := <-routes:
+				timeline.recordRoute(change)
+			case update := <-progress:
+				timeline.recordProgress(update)
+			case file := <-sent:
+				timeline.finishTransfer(file.To, events.Sending)
+				if file.Err != nil {
+					timeline.record(file.To, "transfer", "FAILED", fmt.Sprintf("sending %s: %v", file.Name, file.Err))
+				} else {
+					timeline.record(file.To, "transfer", "SENT", fmt.Sprintf("%s: %s", file.Name, file.Summary))
+				}
+			case file := <-received:
+				timeline.finishTransfer(file.From, events.Receiving)
+				timeline.record(file.From, "transfer", "RECEIVED", fmt.Sprintf("%s: %s", file.OriginalName, file.Summary))
+			case abort := <-aborted:
+				kind := "message"
+				if abort.File {
+					kind = "file"
+					timeline.finishTransfer(abort.Peer, abort.Direction)
+				}
+				timeline.record(abort.Peer, "transfer", "ABORTED", fmt.Sprintf("%s %s: %s", abort.Direction, kind, abort.Reason))
+			}
+		}
+	}()
+}
+
+func (r *timelineRecorder) record(addr netip.Addr, source string, kind string, detail string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries, exists := r.peers[addr]
+	if !exists {
+		entries = ringbuffer.New[TimelineEntry](common.TIMELINE_SIZE)
+		r.peers[addr] = entries
+	}
+	entries.Push(TimelineEntry{Time: time.Now(), Source: source, Kind: kind, Detail: detail})
+}
+
+// recordRoute records the change of the route to the destination, and for the next hops that the destination is now or no longer reached through them.
+func (r *timelineRecorder) recordRoute(change events.RouteChangedEvent) {
+	switch {
+	case !change.PrevNextHop.IsValid():
+		r.record(change.Dest, "routing", "ROUTE+", fmt.Sprintf("via %s", change.NextHop))
+	case !change.NextHop.IsValid():
+		r.record(change.Dest, "routing", "ROUTE-", fmt.Sprintf("was via %s", change.PrevNextHop))
+	default:
+		r.record(change.Dest, "routing", "REROUTE", fmt.Sprintf("via %s, was via %s", change.NextHop, change.PrevNextHop))
+	}
+
+	if change.NextHop.IsValid() && change.NextHop.Addr() != change.Dest {
+		r.record(change.NextHop.Addr(), "routing", "NEXTHOP+", fmt.Sprintf("for %s", change.Dest))
+	}
+	if change.PrevNextHop.IsValid() && change.PrevNextHop.Addr() != change.Dest {
+		r.record(change.PrevNextHop.Addr(), "routing", "NEXTHOP-", fmt.Sprintf("for %s", change.Dest))
+	}
+}
+
+// recordProgress records the start of a transfer and each quarter of it that was completed.
+func (r *timelineRecorder) recordProgress(update events.TransferProgressEvent) {
+	key := transferKey{peer: update.Peer, direction: update.Direction}
+	quarter := int64(0)
+	if update.Total > 0 {
+		quarter = update.Bytes * 4 / update.Total
+	}
+
+	r.mu.Lock()
+	last, started := r.milestones[key]
+	r.milestones[key] = quarter
+	r.mu.Unlock()
+
+	switch {
+	case !started:
+		r.record(update.Peer, "transfer", "STARTED", fmt.Sprintf("%s %s (%d bytes)", update.Direction, transferName(update.Name), update.Total))
+	case quarter > last && quarter < 4:
+		r.record(update.Peer, "transfer", "PROGRESS", fmt.Sprintf("%s %s: %d%% (%d of %d bytes)", update.Direction, transferName(update.Name), quarter*25, update.Bytes, update.Total))
+	}
+}
+
+// finishTransfer forgets the milestones of a transfer, the next progress of the peer in the direction starts a new one.
+func (r *timelineRecorder) finishTransfer(addr netip.Addr, direction events.TransferDirection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.milestones, transferKey{peer: addr, direction: direction})
+}
+
+// entries returns the recorded entries of the peer, oldest first.
+func (r *timelineRecorder) entries(addr netip.Addr) []TimelineEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries, exists := r.peers[addr]
+	if !exists {
+		return []TimelineEntry{} // Serialized as an empty list instead of null
+	}
+	return entries.Items()
+}
+
+func transferName(name string) string {
+	if name == "" {
+		return "file"
+	}
+	return name
+}
+
+// HandleTimeline shows a merged chronological view of a peer: connection and routing changes, transfer milestones,
+// congestion events (TIMEOUT events are retransmissions) and the recent warning and informational log lines mentioning the peer.
+// The view is printed or written as JSON.
+// Usage: timeline <IPv4 address> [json [<file>]]
+func HandleTimeline(args []string) {
+	if len(args) < 1 || len(args) > 3 || len(args) > 1 && args[1] != "json" {
+		fmt.Println("Usage: timeline <IPv4 address> [json [<file>]]")
+		return
+	}
+
+	peerIP, ok := parseIPv4(args[0])
+	if !ok {
+		return
+	}
+
+	entries := peerTimeline(peerIP)
+
+	if len(args) == 1 {
+		printTimeline(peerIP, entries)
+		return
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		fmt.Printf("Failed to serialize the timeline: %v\n", err)
+		return
+	}
+	data = append(data, '\n')
+
+	if len(args) < 3 {
+		fmt.Print(string(data))
+		return
+	}
+
+	if err := os.WriteFile(args[2], data, 0644); err != nil {
+		fmt.Printf("Failed to write %s: %v\n", args[2], err)
+		return
+	}
+	fmt.Printf("Wrote %d timeline entries of %s to %s\n", len(entries), peerIP, args[2])
+}
+
+// peerTimeline merges the recorded entries of the peer with its congestion events and the log lines mentioning it, ordered by time.
+func peerTimeline(addr netip.Addr) []TimelineEntry {
+	entries := timeline.entries(addr)
+
+	if outSequencing != nil {
+		if stats, exists := outSequencing.GetCongestionStats(addr); exists {
+			for _, event := range stats.Timeline {
+				entries = append(entries, TimelineEntry{
+					Time:   event.Time,
+					Source: "congestion",
+					Kind:   event.Kind.String(),
+					Detail: fmt.Sprintf("pkt %d, cwnd %d, ssthresh %s", event.PktNum, event.Cwnd, formatSsthresh(event.Ssthresh)),
+				})
+			}
+		}
+	}
+
+	for _, line := range logger.RecentLines() {
+		if mentionsAddr(line.Text, addr.String()) {
+			entries = append(entries, TimelineEntry{Time: line.Time, Source: "log", Kind: line.Level.String(), Detail: line.Text})
+		}
+	}
+
+	slices.SortStableFunc(entries, func(a, b TimelineEntry) int {
+		return a.Time.Compare(b.Time)
+	})
+	return entries
+}
+
+// mentionsAddr returns whether text contains the address, not just as a prefix of another address (e.g. 10.0.0.1 in 10.0.0.10).
+func mentionsAddr(text string, addr string) bool {
+	for offset := 0; ; {
+		i := strings.Index(text[offset:], addr)
+		if i < 0 {
+			return false
+		}
+		start := offset + i
+		end := start + len(addr)
+		if !partOfAddr(text, start-1) && !partOfAddr(text, end) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+// partOfAddr returns whether the byte at i is a digit or a dot followed by a digit, false if i is out of range.
+func partOfAddr(text string, i int) bool {
+	if i < 0 || i >= len(text) {
+		return false
+	}
+	c := text[i]
+	return c >= '0' && c <= '9' || c == '.' && i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '9'
+}
+
+func printTimeline(addr netip.Addr, entries []TimelineEntry) {
+	if len(entries) == 0 {
+		fmt.Printf("No timeline entries for %s.\n", addr)
+		return
+	}
+
+	fmt.Printf("Timeline of %s (oldest first):\n", addr)
+	for _, entry := range entries {
+		fmt.Printf("  %s %-10s %-10s %s\n", entry.Time.Format("15:04:05.000"), entry.Source, entry.Kind, entry.Detail)
+	}
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/connection"
+)
+
+// HandleTrace sends a path trace to a peer and displays the paths the trace and its reply took.
+func HandleTrace(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: trace <IPv4 address>")
+		return
+	}
+
+	peerIP, err := netip.ParseAddr(args[0])
+	if err != nil || !peerIP.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", args[0])
+		return
+	}
+
+	traced, err := connections.TracePath(peerIP)
+	if errors.Is(err, connection.ErrNoRoute) {
+		fmt.Printf("%s is not reachable.\n", peerIP)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to trace path to %s: %v\n", peerIP, err)
+		return
+	}
+
+	fmt.Printf("Path to %s:   %s\n", peerIP, formatTracedPath(traced.Forward, peerIP))
+	fmt.Printf("Path back:    %s\n", formatTracedPath(traced.Return, socket.MustGetLocalAddress().Addr()))
+
+	verifyTracedPath(traced.Forward, peerIP)
+}
+
+// verifyTracedPath compares the path the trace took with the path computed from our LSDB.
+// A different path of the same cost is expected if another host breaks a tie differently, a longer path hints at an outdated LSDB.
+func verifyTracedPath(forward []netip.Addr, dest netip.Addr) {
+	computed, found := router.GetPath(dest)
+	if !found || len(forward) == 0 || len(forward) >= common.PATH_RECORD_MAX_HOPS {
+		return // Truncated paths can't be compared
+	}
+
+	taken := append(forward[1:len(forward):len(forward)], dest) // Without us, like the computed path
+	switch {
+	case slices.Equal(taken, computed.Hops):
+		fmt.Println("The trace took the computed path.")
+	case len(taken) == len(computed.Hops):
+		fmt.Printf("The trace took another path of the same cost as the computed path %s.\n", connection.FormatPath(computed.Hops))
+	default:
+		fmt.Printf("The trace took %d hops, the computed path %s has %d. The LSDBs may be inconsistent.\n", len(taken), connection.FormatPath(computed.Hops), computed.Cost)
+	}
+}
+
+// formatTracedPath formats a recorded path ending at dest, marking paths that may be truncated.
+func formatTracedPath(path []netip.Addr, dest netip.Addr) string {
+	if len(path) >= common.PATH_RECORD_MAX_HOPS {
+		return connection.FormatPath(path) + " -> ... -> " + dest.String()
+	}
+	return connection.FormatPath(append(path, dest))
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+)
+
+// HandleViolations displays the wire format violations of inbound packets per kind with recent samples, resets them or toggles strict mode.
+// Usage: violations [reset | strict on|off]
+func HandleViolations(args []string) {
+	if len(args) == 2 && args[0] == "strict" && (args[1] == "on" || args[1] == "off") {
+		connections.SetStrict(args[1] == "on")
+		fmt.Printf("Strict mode %s\n", args[1])
+		return
+	}
+
+	if len(args) == 1 && args[0] == "reset" {
+		connections.ResetViolations()
+		fmt.Println("Violations reset")
+		return
+	}
+
+	if len(args) != 0 {
+		fmt.Println("Usage: violations [reset | strict on|off]")
+		return
+	}
+
+	mode := "off"
+	if connections.IsStrict() {
+		mode = "on"
+	}
+	fmt.Printf("Strict mode %s\n", mode)
+
+	reports := connections.Violations()
+	if len(reports) == 0 {
+		fmt.Println("No violations.")
+		return
+	}
+
+	for _, report := range reports {
+		fmt.Printf("%s: %d\n", report.Kind, report.Count)
+		for _, sample := range report.Samples {
+			fmt.Printf("  %s ago from %v: %s", time.Since(sample.Time).Round(time.Second), sample.Sender, sample.Detail)
+			if sample.Packet != "" {
+				fmt.Printf(" %s", sample.Packet)
+			}
+			fmt.Println()
+		}
+	}
+}
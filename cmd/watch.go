@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// directoryWatch sends the new and modified files of a directory to a peer.
+// The directory is polled every common.WATCH_POLL_INTERVAL, a file is sent once its size and modification time didn't change for a whole interval, so files that are still being written aren't sent.
+// The files are sent one after another, a file waits while another file is being sent to the peer (see sequencing.SequenceBlocker).
+type directoryWatch struct {
+	dir           string
+	peerIP        netip.Addr
+	connections   *connection.Manager // Of the node that started the watch, which stays the same if another node is selected meanwhile
+	outSequencing *sequencing.OutgoingPktNumHandler
+	stop          chan struct{}
+	sent          map[string]fileVersion // Files already sent or present when the watch started
+	changed       map[string]fileVersion // Files that changed in the last poll
+}
+
+// fileVersion identifies the content of a watched file.
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+var (
+	watchesMu sync.Mutex
+	watches   = make(map[string]*directoryWatch) // Keyed by the absolute path of the directory
+)
+
+// HandleWatch sends new or modified files of a directory to a peer, lists the watched directories or stops watching a directory.
+// Files that exist when the watch starts are only sent once they are modified.
+// Usage: watch [<directory> <IPv4 address> | stop <directory>]
+func HandleWatch(args []string) {
+	switch {
+	case len(args) == 0:
+		listWatches()
+	case len(args) == 2 && args[0] == "stop":
+		stopWatch(args[1])
+	case len(args) == 2:
+		startWatch(args[0], args[1])
+	default:
+		fmt.Println("Usage: watch [<directory> <IPv4 address> | stop <directory>]")
+	}
+}
+
+func startWatch(dirString string, addrString string) {
+	peerIP, err := netip.ParseAddr(addrString)
+	if err != nil || !peerIP.Is4() {
+		fmt.Printf("Invalid IPv4 address: %s\n", addrString)
+		return
+	}
+
+	dir, err := filepath.Abs(dirString)
+	if err != nil {
+		fmt.Printf("Invalid directory %s: %v\n", dirString, err)
+		return
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		fmt.Printf("Failed to get directory info for %s: %v\n", dir, err)
+		return
+	}
+	if !info.IsDir() {
+		fmt.Printf("The specified path %s is not a directory.\n", dir)
+		return
+	}
+
+	watch := &directoryWatch{
+		dir:           dir,
+		peerIP:        peerIP,
+		connections:   connections,
+		outSequencing: outSequencing,
+		stop:          make(chan struct{}),
+		changed:       make(map[string]fileVersion),
+	}
+
+	watch.sent, err = watch.scan()
+	if err != nil {
+		fmt.Printf("Failed to read directory %s: %v\n", dir, err)
+		return
+	}
+
+	watchesMu.Lock()
+	if _, exists := watches[dir]; exists {
+		watchesMu.Unlock()
+		fmt.Printf("%s is already watched\n", dir)
+		return
+	}
+	watches[dir] = watch
+	watchesMu.Unlock()
+
+	go watch.run()
+
+	fmt.Printf("Watching %s, new or modified files are sent to %s\n", dir, peerIP)
+}
+
+func stopWatch(dirString string) {
+	dir, err := filepath.Abs(dirString)
+	if err != nil {
+		fmt.Printf("Invalid directory %s: %v\n", dirString, err)
+		return
+	}
+
+	watchesMu.Lock()
+	watch, exists := watches[dir]
+	delete(watches, dir)
+	watchesMu.Unlock()
+
+	if !exists {
+		fmt.Printf("%s is not watched\n", dir)
+		return
+	}
+
+	close(watch.stop) // A file that is currently being sent is sent completely
+	fmt.Printf("Stopped watching %s\n", dir)
+}
+
+func listWatches() {
+	watchesMu.Lock()
+	defer watchesMu.Unlock()
+
+	if len(watches) == 0 {
+		fmt.Println("No watched directories")
+		return
+	}
+
+	dirs := make([]string, 0, len(watches))
+	for dir := range watches {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+
+	fmt.Println("Watched directories:")
+	for _, dir := range dirs {
+		fmt.Printf("  %s -> %s\n", dir, watches[dir].peerIP)
+	}
+}
+
+// run polls the directory until the watch is stopped.
+func (w *directoryWatch) run() {
+	defer panics.Recover("watching %s", w.dir)
+
+	ticker := time.NewTicker(common.WATCH_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, name := range w.poll() {
+			if !w.send(name) {
+				return
+			}
+		}
+	}
+}
+
+// scan returns the regular files of the directory, hidden files are ignored.
+func (w *directoryWatch) scan() (map[string]fileVersion, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]fileVersion, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || entry.Name()[0] == '.' {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue // Removed since ReadDir
+		}
+		files[entry.Name()] = fileVersion{size: info.Size(), modTime: info.ModTime()}
+	}
+	return files, nil
+}
+
+// poll scans the directory and returns the names of the changed files that didn't change since the last poll, sorted by name.
+func (w *directoryWatch) poll() []string {
+	files, err := w.scan()
+	if err != nil {
+		fmt.Printf("Failed to read watched directory %s: %v\n", w.dir, err)
+		return nil
+	}
+
+	for name := range w.sent {
+		if _, exists := files[name]; !exists {
+			delete(w.sent, name) // Send the file again if it is recreated
+		}
+	}
+
+	stable := make([]string, 0)
+	changed := make(map[string]fileVersion)
+	for name, version := range files {
+		if sentVersion, exists := w.sent[name]; exists && sentVersion == version {
+			continue
+		}
+
+		if lastVersion, exists := w.changed[name]; exists && lastVersion == version {
+			stable = append(stable, name)
+		} else {
+			changed[name] = version
+		}
+	}
+	w.changed = changed
+
+	slices.Sort(stable)
+	return stable
+}
+
+// send sends the file to the peer and waits until the transfer is done.
+// Returns false if the watch was stopped while waiting for another file transfer to the peer.
+func (w *directoryWatch) send(name string) bool {
+	path := filepath.Join(w.dir, name)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return true // Removed since the poll
+	}
+	w.sent[name] = fileVersion{size: info.Size(), modTime: info.ModTime()} // A failed transfer is retried once the file is modified again
+
+	var transfer *fileTransfer
+	for {
+		transfer, err = startFileTransfer(w.connections, w.outSequencing, w.peerIP, name, info.Size())
+		if !errors.Is(err, errFileTransferBusy) {
+			break
+		}
+
+		select {
+		case <-w.stop:
+			return false
+		case <-time.After(common.WATCH_POLL_INTERVAL):
+		}
+	}
+
+	if err != nil {
+		fmt.Printf("Failed to send watched file %s to %s: %v\n", path, w.peerIP, err)
+		events.FileSent.NotifyObservers(events.FileSentEvent{
+			To:   w.peerIP,
+			Name: name,
+			Err:  err,
+		})
+		return true
+	}
+
+	sendFile([]*fileTransfer{transfer}, path, false)
+	return true
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// HandleWireFormat prints the wire format of the protocol (see pkt.DescribeWireFormat) as markdown or JSON, or writes it to a file.
+// Usage: wireformat [markdown | json] [<file>]
+func HandleWireFormat(args []string) {
+	if len(args) > 2 {
+		fmt.Println("Usage: wireformat [markdown | json] [<file>]")
+		return
+	}
+
+	format := "markdown"
+	if len(args) > 0 {
+		format = args[0]
+	}
+
+	var data []byte
+	switch format {
+	case "markdown":
+		data = []byte(wireFormatMarkdown(pkt.DescribeWireFormat()))
+	case "json":
+		var err error
+		data, err = json.MarshalIndent(pkt.DescribeWireFormat(), "", "  ")
+		if err != nil {
+			fmt.Printf("Failed to serialize the wire format: %v\n", err)
+			return
+		}
+		data = append(data, '\n')
+	default:
+		fmt.Println("Usage: wireformat [markdown | json] [<file>]")
+		return
+	}
+
+	if len(args) < 2 {
+		fmt.Print(string(data))
+		return
+	}
+
+	if err := os.WriteFile(args[1], data, 0644); err != nil {
+		fmt.Printf("Failed to write %s: %v\n", args[1], err)
+		return
+	}
+	fmt.Printf("Wrote the wire format to %s\n", args[1])
+}
+
+// wireFormatMarkdown renders the wire format as a markdown document with a table per layout.
+func wireFormatMarkdown(format pkt.WireFormat) string {
+	var b strings.Builder
+
+	b.WriteString("# ChatProtoGol Wire Format\n\n")
+	b.WriteString("All multi-byte fields are big endian.\n\n")
+
+	fmt.Fprintf(&b, "## Header (%d bytes)\n\n", format.HeaderSize)
+	writeFieldTable(&b, format.Header)
+	fmt.Fprintf(&b, "Checksum: %s.\n\n", format.Checksum)
+
+	b.WriteString("## Extended Packets\n\n")
+	fmt.Fprintf(&b, "Packets with message type 0x%X carry extensions between the header and the payload, the extensions start with:\n\n", format.ExtendedType)
+	writeFieldTable(&b, format.ExtensionPrefix)
+	b.WriteString("Each extension is encoded as:\n\n")
+	writeFieldTable(&b, format.Extension)
+
+	b.WriteString("## Message Types\n\n")
+	for _, msg := range format.MessageTypes {
+		fmt.Fprintf(&b, "### 0x%X %s\n\n", msg.Type, msg.Name)
+		fmt.Fprintf(&b, "%s.\n\n", msg.Description)
+		if msg.Sequenced {
+			b.WriteString("Packet number: next packet number to the destination, the packet is acknowledged.\n\n")
+		} else {
+			fmt.Fprintf(&b, "Packet number: %s.\n\n", msg.PktNum)
+		}
+		for _, payload := range msg.Payloads {
+			if payload.Name != "" {
+				fmt.Fprintf(&b, "%s payload:\n\n", payload.Name)
+			}
+			if len(payload.Fields) == 0 {
+				b.WriteString("Empty payload.\n\n")
+				continue
+			}
+			writeFieldTable(&b, payload.Fields)
+		}
+	}
+
+	b.WriteString("## Extension Types\n\n")
+	for _, ext := range format.Extensions {
+		fmt.Fprintf(&b, "### 0x%X %s\n\n", ext.Type, ext.Name)
+		fmt.Fprintf(&b, "%s.\n\n", ext.Description)
+		if len(ext.Value) == 0 {
+			b.WriteString("No value.\n\n")
+			continue
+		}
+		writeFieldTable(&b, ext.Value)
+	}
+
+	return b.String()
+}
+
+func writeFieldTable(b *strings.Builder, fields []pkt.Field) {
+	b.WriteString("| Field | Bits | Description |\n")
+	b.WriteString("|-------|------|-------------|\n")
+	for _, field := range fields {
+		bits := fmt.Sprint(field.Bits)
+		if field.Bits == 0 {
+			bits = "variable"
+		}
+
+		notes := make([]string, 0, 3)
+		if field.Optional {
+			notes = append(notes, "Optional, with all following fields.")
+		}
+		if field.Repeated {
+			notes = append(notes, "Repeats with all following fields until the end of the payload.")
+		}
+		if field.Description != "" {
+			notes = append(notes, field.Description+".")
+		}
+
+		fmt.Fprintf(b, "| %s | %s | %s |\n", field.Name, bits, strings.Join(notes, " "))
+	}
+	b.WriteString("\n")
+}
@@ -10,24 +10,133 @@ import (
 const INITIAL_TTL = 30              // TTL for a new packet
 const MAX_PAYLOAD_SIZE_BYTES = 1200 // MTU in bytes after subtracting ChatProtocol header: 1484
 const ACK_TIMEOUT_DURATION = time.Second * 2
-const RETRIES_PER_PACKET = 10 // Number of times to retry sending a packet before giving up; -1 means infinite retries
-const TEAM_ID = 0x2
-const UDP_BUFFER_SIZE_BYTES = 1500                  // Number of bytes to read from socket per packet (1500 is common MTU size for Ethernet); incoming packets larger than this will be dropped
-const RECEIVER_WINDOW = math.MaxInt64               // Size of sequencing buffer per peer
-const SOCKET_RECEIVE_BUFFER_SIZE = 500              // Number of packets to buffer in the receiving socket channel before dropping them
-const PACKET_HANDLER_GOROUTINES = 100               // Number of goroutines to handle incoming packets concurrently
-const CWND_FULL_RETRY_DELAY = time.Millisecond * 50 // Duration before retrying to send a file / msg chunk after sender congestion overflow
-const INITIAL_CWND = 10                             // Size of the initial congestion window for new connections; this is the number of packets that can be sent before waiting for an acknowledgment, modified dynamically per peer based on ACKs received
-const IGNORE_CWND = false                           // If true, the congestion window will not limit the number of packets sent
+const RETRIES_PER_PACKET = 10                                      // Number of times to retry sending a packet before giving up; -1 means infinite retries
+const TEAM_ID = 0x2                                                // Default team ID of outgoing packets, incoming packets of other teams are dropped
+const UDP_BUFFER_SIZE_BYTES = 9000                                 // Number of bytes to read from socket per packet (9000 allows jumbo frames discovered by MTU probing); incoming packets larger than this will be dropped
+const RECEIVER_WINDOW = math.MaxInt64                              // Size of sequencing buffer per peer
+const SOCKET_RECEIVE_BUFFER_SIZE = 4096                            // Number of packets to buffer in the receiving socket channel, the oldest buffered packets are dropped when it overflows
+const PACKET_HANDLER_GOROUTINES = 100                              // Number of goroutines to handle incoming packets concurrently
+const ACK_QUEUE_SIZE_PACKETS = 1024                                // Number of received ACKs queued for the goroutine that handles them apart from the PACKET_HANDLER_GOROUTINES, further ACKs are dropped
+const CWND_FULL_RETRY_DELAY = time.Millisecond * 50                // Duration before retrying to send a file / msg chunk after sender congestion overflow
+const INITIAL_CWND = 10                                            // Size of the initial congestion window for new connections; this is the number of packets that can be sent before waiting for an acknowledgment, modified dynamically per peer based on ACKs received
+const IGNORE_CWND = false                                          // If true, the congestion window will not limit the number of packets sent
+const CWND_IDLE_INTERVAL = ACK_TIMEOUT_DURATION                    // The congestion window of a peer is halved for every such interval nothing was sent to it, down to the initial window; at least the retransmission timeout of the peer, 0 disables the decay
+const AUTO_RESET = true                                            // If true, a peer that acknowledges packets we never sent is sent a RESET, its view of our packet numbers diverged
+const AUTO_RESET_MIN_INTERVAL = time.Second * 10                   // Minimum interval between two automatic RESETs to the same peer
+const SEND_QUEUE_SIZE_PACKETS = 1024                               // Number of MSG/FILE packets queued per next hop, further packets are dropped (and retransmitted); control packets bypass the queue
+const CE_QUEUE_THRESHOLD_PACKETS = 256                             // Forwarded MSG/FILE packets are marked as congestion experienced while the send queue of their next hop holds at least this many packets
+const FILE_FANOUT_BUFFER_CHUNKS = 64                               // Number of read file chunks buffered per destination when sending a file to multiple peers
+const MTU_PROBE_TIMEOUT = time.Millisecond * 500                   // Duration to wait for the reply to a single path MTU probe
+const MTU_PROBE_ATTEMPTS = 2                                       // Number of probes sent per candidate size before the size is considered too large
+const ACK_PIGGYBACKING = true                                      // If true, ACKs to peers we are sending data to are piggybacked on outgoing MSG/FILE packets
+const ACK_PIGGYBACK_DELAY = time.Millisecond * 5                   // Maximum time an ACK is held back waiting for a data packet to ride on
+const ACK_PIGGYBACK_ACTIVITY_WINDOW = time.Millisecond * 200       // ACKs are only held back if data was sent to the peer within this window
+const MAX_PIGGYBACKED_ACKS = 10                                    // Maximum number of ACKs carried by a single data packet, fewer if they don't fit into pkt.EXTENSION_RESERVE_BYTES
+const CONGESTION_TIMELINE_SIZE = 64                                // Number of congestion events kept per peer for the ccstats command
+const NAT_TRAVERSAL = false                                        // If true, a UDP port mapping is requested from the gateway via NAT-PMP or UPnP when the socket is opened
+const NAT_MAPPING_LIFETIME = time.Hour                             // Requested lifetime of the port mapping, it is renewed after half the lifetime
+const NAT_MAPPING_RETRY_DELAY = time.Minute                        // Delay before retrying a failed port mapping request
+const ALLOW_RELAYING = true                                        // If true, we relay packets between two of our neighbors that connected through us with "con --via"
+const LOG_RATE_LIMIT_PER_SECOND = 20                               // Console lines per second of a frequent kind of log line (e.g. "SENT FILE"), further lines only go to the log file; 0 disables the limit
+const LOG_QUEUE_SIZE_LINES = 4096                                  // Number of log lines queued for the goroutine writing them, further debug and trace lines are dropped
+const LOG_HISTORY_SIZE_LINES = 1024                                // Number of recent warning and informational log lines kept in memory for the timeline command
+const TIMELINE_SIZE = 256                                          // Number of peer, routing and transfer events kept per peer for the timeline command
+const EVENT_BUFFER_SIZE = 256                                      // Number of events buffered per event subscriber, further events are dropped for that subscriber
+const MAX_MESSAGE_SIZE_BYTES = 1 << 20                             // Maximum size of a received chat message, longer messages are aborted
+const MAX_FILE_SIZE_BYTES = 1 << 32                                // Maximum size of a received file (including the file name), larger files are aborted
+const MSG_SPILL_THRESHOLD_BYTES = 256 << 10                        // Messages larger than this are buffered on disk instead of in memory while they are received
+const MAX_RECONSTRUCTORS = 64                                      // Maximum number of messages and files all peers can send us at the same time (a peer sends one of each at most), further transfers are aborted
+const INGRESS_CONTROL_PACKETS_PER_SECOND = 2000                    // Control packets per second a single sender address may send us, further packets are dropped
+const INGRESS_CONTROL_BYTES_PER_SECOND = 1 << 20                   // Bytes of control packets per second a single sender address may send us
+const INGRESS_DATA_PACKETS_PER_SECOND = 50000                      // Data packets (MSG, FILE, FIN, ACK and others) per second a single sender address may send us, it also forwards the traffic of other hosts
+const INGRESS_DATA_BYTES_PER_SECOND = 64 << 20                     // Bytes of data packets per second a single sender address may send us
+const INGRESS_BURST = time.Second                                  // Budget a sender may use at once after being idle, as duration of its ingress rates
+const INGRESS_AUTO_BLOCK_AFTER = time.Second * 10                  // A sender that exceeds its ingress budget without a break of a second for this long is blocked if auto-blocking is enabled
+const INGRESS_AUTO_BLOCK_ENV = "CHATPROTOGOL_INGRESS_AUTO_BLOCK"   // Environment variable that enables blocking senders that exceed their ingress budget for INGRESS_AUTO_BLOCK_AFTER if set to "1" or "true"
+const INGRESS_MAX_SOURCES = 4096                                   // Number of senders whose ingress budgets are tracked before idle senders are forgotten
+const MIN_FREE_DISK_SPACE_BYTES = 64 << 20                         // Disk space that is kept free when accepting a received file, files that don't fit are aborted
+const PRE_SHARED_KEY_ENV = "CHATPROTOGOL_PSK"                      // Environment variable with the network-wide key for packet authentication, unset disables it
+const BIND_ADDRESS_ENV = "CHATPROTOGOL_BIND"                       // Environment variable with the IPv4 address or interface name to listen on at startup, unset selects a non-loopback address
+const BIND_ALSO_ENV = "CHATPROTOGOL_BIND_ALSO"                     // Environment variable with comma-separated IPv4 addresses or interface names to listen on in addition, e.g. to bridge network segments, unset listens on one address
+const NODE_ID_ENV = "CHATPROTOGOL_NODE_ID"                         // Environment variable with the node ID in IPv4 notation or "random" for one derived from the signing key, unset identifies the node by its socket address
+const PRESENCE_MIN_INTERVAL = time.Second                          // Minimum interval between presence updates sent to or accepted from a single host, further updates are dropped
+const ROOM_KEEPALIVE_INTERVAL = 10 * time.Second                   // Interval in which room members send keepalives to the host and the host checks for timed out members
+const ROOM_MEMBER_TIMEOUT = 30 * time.Second                       // Room members that weren't heard for this long are removed by the host, a join that isn't answered within it is given up
+const ROOM_NAME_MAX_LENGTH = 64                                    // Maximum length of a room name in bytes
+const MESSAGE_DELAY_WARNING_THRESHOLD = time.Second * 5            // Received messages whose one-way delay exceeds this are flagged as delayed
+const DELIVERED_MESSAGE_HISTORY_SIZE = 64                          // Number of delivered message IDs kept per peer to drop messages that are retransmitted completely after a reconnect
+const STREAM_MESSAGES = false                                      // If true, received message chunks are displayed as soon as they are contiguous instead of when the message is complete
+const SINGLE_PACKET_MESSAGES = true                                // If true, messages that fit into one packet carry their FIN instead of being followed by one, if the receiver announced support
+const LSA_FLOOD_SUPPRESSION_WINDOW = time.Second * 5               // An LSA (owner and sequence number) is flooded to a neighbor at most once within this window
+const LSA_FLOOD_JITTER = time.Millisecond * 10                     // Maximum random delay before the LSA of another host is re-flooded, so neighbors don't flood in lockstep
+const LSA_ORIGINATION_RATE = 5.0                                   // Number of own LSAs that may be flooded per second on average
+const LSA_ORIGINATION_BURST = 10.0                                 // Number of own LSAs that may be flooded at once before LSA_ORIGINATION_RATE applies
+const MAX_LSDB_ENTRIES = 4096                                      // Maximum number of LSAs in the LSDB, the oldest unreachable LSAs are evicted for new ones; if none is unreachable, new LSAs are rejected and new neighbors refused
+const REQUIRE_SIGNED_LSAS = false                                  // If true, unsigned LSAs are rejected; otherwise LSAs of hosts that never announced or used a signing key are accepted unsigned
+const SIGNING_KEY_ENV = "CHATPROTOGOL_SIGNING_KEY"                 // Environment variable with a file holding the seed of the key LSAs are signed with, created if missing; unset signs with a new key on every start
+const TEAM_ID_ENV = "CHATPROTOGOL_TEAM"                            // Environment variable with the team ID (0-15) to use instead of TEAM_ID
+const PROMISCUOUS_ENV = "CHATPROTOGOL_PROMISCUOUS"                 // Environment variable that enables processing packets of all teams if set to "1" or "true"
+const RETRANSMIT_TIMER_TICK = time.Millisecond * 10                // Resolution of the retransmission timers, ACK timeouts are rounded up to a multiple of it
+const RETRANSMIT_TIMER_SLOTS = 512                                 // Number of slots of the retransmission timer wheel, timeouts up to RETRANSMIT_TIMER_TICK * RETRANSMIT_TIMER_SLOTS need a single rotation
+const MAX_IN_FLIGHT_BYTES = 1 << 20                                // Maximum number of bytes sent to a peer but not acknowledged yet, caps the congestion window for full-sized chunks; 0 disables the cap, ignored if the congestion window is ignored
+const MAX_OPEN_ACKS_PER_PEER = 1 << 16                             // Maximum number of packets waiting for an ACK per peer, also if the congestion window is ignored
+const OPEN_ACK_GC_INTERVAL = time.Second * 30                      // Interval of the garbage collection of abandoned open acknowledgments and sequencing state
+const EXPIRED_PACKET_HISTORY_SIZE = 256                            // Number of packets per peer that are remembered after their retries were exhausted, to recognize late ACKs
+const HOP_ARQ_ENV = "CHATPROTOGOL_HOP_ARQ"                         // Environment variable that enables hop-by-hop retransmission of forwarded packets if set to "1" or "true", all nodes of a network should agree
+const HOP_ARQ_TIMEOUT = time.Millisecond * 100                     // Duration a forwarded packet waits for the hop ACK of the next hop before it is retransmitted
+const HOP_ARQ_RETRIES = 3                                          // Number of hop-by-hop retransmissions per forwarded packet, afterwards only the source retransmits it
+const HOP_ARQ_WINDOW = 256                                         // Maximum number of forwarded packets per next hop waiting for a hop ACK, further packets are forwarded without hop-by-hop retransmission
+const FORWARD_CACHE_SIZE = 1024                                    // Number of recently forwarded MSG/FILE/FIN packets remembered per destination to drop redundant copies
+const FORWARD_CACHE_TTL = time.Second * 30                         // Duration a forwarded packet is remembered, covers the retransmissions of the source
+const FORWARD_DUPLICATE_WINDOW = time.Second                       // Copies of an unacknowledged forwarded packet arriving within this window are dropped, must be shorter than ACK_TIMEOUT_DURATION so retransmissions of the source pass
+const PATH_RECORDING_ENV = "CHATPROTOGOL_PATH_RECORDING"           // Environment variable that enables the path recording debug mode if set to "1" or "true"
+const PATH_RECORD_MAX_HOPS = 16                                    // Maximum number of addresses recorded in the path of a packet, further hops aren't recorded
+const DD_REQUEST_TIMEOUT = time.Second * 5                         // Duration a DD request waits for the DD of the neighbor
+const FAIR_SHARE_IDLE_TIMEOUT = time.Millisecond * 500             // A destination stops sharing the data budget of its next hop once it didn't send data packets for this duration
+const WATCH_POLL_INTERVAL = time.Second                            // Interval a watched directory is scanned for new or modified files, a file is sent once it didn't change for a whole interval
+const TIME_SYNC_INTERVAL = time.Second * 30                        // Interval a new clock offset sample is requested from a peer we send packets to
+const TIME_SYNC_SAMPLES = 8                                        // Number of recent clock offset samples per peer, the sample with the smallest round-trip delay is used
+const STRICT_ENV = "CHATPROTOGOL_STRICT"                           // Environment variable that enables dropping inbound packets that violate the wire format if set to "1" or "true"
+const VIOLATION_SAMPLES = 5                                        // Number of recent packets kept per kind of wire format violation for the violations command
+const SEQUENCE_BLOCKER_RELEASE_DELAY = time.Second * 5             // A cancelled message or file sequence is released after this delay if its sender didn't unblock it, e.g. because the sending goroutine crashed
+const DOCTOR_STALE_BLOCKER_AGE = time.Second * 30                  // A sequence without open acknowledgments that is blocked for longer is reported as stuck by the doctor command
+const RTT_HISTOGRAM_MIN = time.Microsecond * 250                   // Upper bound of the first bucket of the ACK round-trip histograms, the bounds double with every bucket
+const RTT_HISTOGRAM_BUCKETS = 16                                   // Number of buckets of the ACK round-trip histograms, the last bucket counts round trips of 4.096s and longer
+const JOURNAL_ENV = "CHATPROTOGOL_JOURNAL"                         // Environment variable with a file that every outgoing reliable packet and ACK event is journaled to for the replay command, unset disables the journal
+const CONNECTED_UDP_ENV = "CHATPROTOGOL_CONNECTED_UDP"             // Environment variable that enables the connected-UDP fast path to the neighbor receiving most packets if set to "1" or "true" (Linux and macOS)
+const UNRELIABLE_MESSAGES_ENV = "CHATPROTOGOL_UNRELIABLE_MESSAGES" // Environment variable that makes the msg command send messages unreliably by default (single packet, no ACKs) if set to "1" or "true"
+const SESSION_REPORT_ENV = "CHATPROTOGOL_SESSION_REPORT"           // Environment variable with a file the session summary is written to as JSON on exit, unset only prints the summary
+const CONNECTED_UDP_WINDOW = 256                                   // Number of sent packets after which the connected-UDP fast path is moved to the destination with the largest share
+const CONNECTED_UDP_MIN_SHARE = 0.5                                // Share of the packets of a window a destination needs to get the connected-UDP fast path
+const NETEM_REORDER_DELAY = time.Millisecond * 20                  // Delay of the datagrams the netem fault injector holds back to reorder them
+const SOAK_MAX_MESSAGE_SIZE_BYTES = 4096                           // Maximum size of the random messages of the soak command
+const SOAK_MAX_FILE_SIZE_BYTES = 64 << 10                          // Maximum size of the random files of the soak command
+const SOAK_FILE_INTERVAL = 5                                       // Every n-th item of the soak command is a file, the others are messages
+const SOAK_ECHO_TIMEOUT = time.Second * 5                          // Time the soak command waits for the peer to echo the hash of a delivered item
+const SOAK_ECHO_HISTORY = 1024                                     // Number of received soak items whose hashes are kept for echo requests
+const LOADGEN_MESSAGE_PACKETS = 16                                 // Number of packets of each message sent by the loadgen command, the receiver gets a complete message every few packets
+const LOADGEN_DISPLAY_INTERVAL = time.Second * 2                   // Interval the loadgen command prints the achieved throughput and retransmissions of its generators
+const DISCOVERY_ENV = "CHATPROTOGOL_DISCOVERY"                     // Environment variable that announces and discovers nodes on the local network if set to "1" or "true", "auto" also connects to discovered nodes
+const DISCOVERY_GROUP = "239.255.67.71:20100"                      // Multicast group and port of the LAN discovery beacons
+const DISCOVERY_BEACON_INTERVAL = time.Second * 5                  // Interval the LAN discovery beacon is sent in
+const DISCOVERY_PEER_TIMEOUT = time.Second * 20                    // Discovered nodes whose beacon wasn't received for this long are forgotten
+const LOG_UNEXPECTED_ACKS = false                                  // If true, duplicate, late and spurious ACKs are logged at info level instead of debug level
 
 var RECEIVED_FILES_DIR string
+var CONFIG_DIR string       // Directory for persisted node state, e.g. the access list
+var ACCESS_LIST_FILE string // File the blocklist and allowlist are persisted to
 
 func init() {
 	const subdirectory = "chatprotogol_received_files"
+	const configSubdirectory = ".chatprotogol"
 	dir, err := os.UserHomeDir()
 	if err != nil {
 		RECEIVED_FILES_DIR = string(os.PathSeparator) + subdirectory
+		CONFIG_DIR = string(os.PathSeparator) + configSubdirectory
 	} else {
 		RECEIVED_FILES_DIR = filepath.Join(dir, subdirectory)
+		CONFIG_DIR = filepath.Join(dir, configSubdirectory)
 	}
+
+	ACCESS_LIST_FILE = filepath.Join(CONFIG_DIR, "access.json")
 }
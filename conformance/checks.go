@@ -0,0 +1,301 @@
+package conformance
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+const (
+	behaviorConnect     = "connect"
+	behaviorDuplicate   = "duplicate"
+	behaviorOutOfOrder  = "out-of-order"
+	behaviorBadChecksum = "bad-checksum"
+	behaviorTTL         = "ttl"
+	behaviorStaleLSA    = "stale-lsa"
+	behaviorDisconnect  = "disconnect"
+)
+
+const minRetransmitInterval = time.Millisecond * 10 // Minimum interval the CONNECT and forwarding probes are repeated at
+
+// phantomAddr is a host behind the suite that only exists in the LSAs the suite floods (TEST-NET-1, never a real peer).
+// Packets to it are routed back to the suite, which observes how the implementation forwards them.
+var phantomAddr = netip.MustParseAddr("192.0.2.1")
+
+// check is a scripted interaction checking one behavior.
+// run returns whether the implementation behaved as required and a short description of what was observed.
+type check struct {
+	behavior string
+	run      func(p *scriptedPeer) (passed bool, detail string)
+}
+
+// checks are run in order, every check relies on the connection of the first one.
+var checks = []check{
+	{behaviorConnect, checkConnect},
+	{behaviorDuplicate, checkDuplicate},
+	{behaviorOutOfOrder, checkOutOfOrder},
+	{behaviorBadChecksum, checkBadChecksum},
+	{behaviorTTL, checkTTL},
+	{behaviorStaleLSA, checkStaleLSA},
+	{behaviorDisconnect, checkDisconnect},
+}
+
+// silence returns how long the suite waits to conclude that the implementation doesn't reply to a packet.
+func (p *scriptedPeer) silence() time.Duration {
+	return p.timeout / 4
+}
+
+// checkConnect connects to the implementation and announces the link in the LSA of the suite.
+// The CONNECT is retransmitted until it is acknowledged, like a regular peer would.
+func checkConnect(p *scriptedPeer) (bool, string) {
+	connect := p.buildToTarget(pkt.MsgTypeConnect, binary.BigEndian.AppendUint64(nil, p.bootEpoch))
+	interval := max(p.timeout/10, minRetransmitInterval)
+
+	start := time.Now()
+	acked := false
+	for !acked && time.Since(start) < p.timeout {
+		if err := p.send(connect); err != nil {
+			return false, fmt.Sprintf("CONNECT not sent: %v", err)
+		}
+		_, acked = p.expectAck(connect, interval)
+	}
+	if !acked {
+		return false, fmt.Sprintf("CONNECT not acknowledged within %v", p.timeout)
+	}
+	rtt := time.Since(start)
+
+	if ok, detail := p.floodOwnLSA(p.targetAddr); !ok {
+		return false, detail
+	}
+	return true, fmt.Sprintf("CONNECT acknowledged after %v, LSA acknowledged", rtt.Round(time.Millisecond))
+}
+
+// checkDuplicate sends a chunk twice, both copies must be acknowledged and the message must complete.
+func checkDuplicate(p *scriptedPeer) (bool, string) {
+	chunk := p.buildToTarget(pkt.MsgTypeChatMessage, pkt.Payload("duplicate"))
+	if _, acked := p.sendAndExpectAck(chunk); !acked {
+		return false, "chunk not acknowledged"
+	}
+	if _, acked := p.sendAndExpectAck(chunk); !acked {
+		return false, "duplicate of an acknowledged chunk not acknowledged again, the sender would retransmit it forever"
+	}
+
+	fin := p.buildToTarget(pkt.MsgTypeFinish, finPayload(chunk))
+	if _, acked := p.sendAndExpectAck(fin); !acked {
+		return false, "FIN after the duplicate not acknowledged"
+	}
+	return true, "both copies acknowledged"
+}
+
+// checkOutOfOrder sends the chunks of a message in the order 3, 1, 2, all must be acknowledged without an ABORT.
+func checkOutOfOrder(p *scriptedPeer) (bool, string) {
+	chunks := []*pkt.Packet{
+		p.buildToTarget(pkt.MsgTypeChatMessage, pkt.Payload("out-")),
+		p.buildToTarget(pkt.MsgTypeChatMessage, pkt.Payload("of-")),
+		p.buildToTarget(pkt.MsgTypeChatMessage, pkt.Payload("order")),
+	}
+	for _, i := range []int{2, 0, 1} {
+		if err := p.send(chunks[i]); err != nil {
+			return false, fmt.Sprintf("chunk not sent: %v", err)
+		}
+	}
+
+	pending := len(chunks)
+	acked := make([]bool, len(chunks))
+	aborted := false
+	p.expectWithin(p.timeout, func(reply *pkt.Packet) bool {
+		if reply.GetMessageType() == pkt.MsgTypeAbort && netip.AddrFrom4(reply.Header.DestAddr) == p.addr {
+			aborted = true
+			return true
+		}
+		for i, chunk := range chunks {
+			if !acked[i] && isAckOf(reply, chunk) {
+				acked[i] = true
+				pending--
+			}
+		}
+		return pending == 0
+	})
+	if aborted {
+		return false, "message aborted"
+	}
+	if pending > 0 {
+		return false, fmt.Sprintf("%d of %d chunks not acknowledged", pending, len(chunks))
+	}
+
+	fin := p.buildToTarget(pkt.MsgTypeFinish, finPayload(chunks[len(chunks)-1]))
+	if _, acked := p.sendAndExpectAck(fin); !acked {
+		return false, "FIN not acknowledged"
+	}
+	return true, "chunks 3, 1, 2 acknowledged"
+}
+
+// checkBadChecksum sends a chunk with a corrupted checksum, it must be dropped without an ACK.
+// The intact chunk is acknowledged afterwards.
+func checkBadChecksum(p *scriptedPeer) (bool, string) {
+	chunk := p.buildToTarget(pkt.MsgTypeChatMessage, pkt.Payload("checksum"))
+	corrupted := *chunk
+	corrupted.Header.Checksum[0] ^= 0xFF
+
+	if err := p.send(&corrupted); err != nil {
+		return false, fmt.Sprintf("chunk not sent: %v", err)
+	}
+	if _, acked := p.expectAck(chunk, p.silence()); acked {
+		return false, "chunk with a corrupted checksum acknowledged"
+	}
+
+	if _, acked := p.sendAndExpectAck(chunk); !acked {
+		return false, "intact chunk not acknowledged after the corrupted copy"
+	}
+	fin := p.buildToTarget(pkt.MsgTypeFinish, finPayload(chunk))
+	if _, acked := p.sendAndExpectAck(fin); !acked {
+		return false, "FIN not acknowledged"
+	}
+	return true, "corrupted chunk dropped, intact chunk acknowledged"
+}
+
+// checkTTL routes packets to phantomAddr through the suite and sends them with an expiring TTL.
+// A packet with TTL 2 must be forwarded with TTL 1. A packet with TTL 1 must be dropped or forwarded with TTL 0,
+// implementations differ in whether the TTL is checked before or after it is decremented; a larger TTL means it wasn't decremented.
+func checkTTL(p *scriptedPeer) (bool, string) {
+	if ok, detail := p.routePhantomThroughPeer(); !ok {
+		return false, detail
+	}
+
+	probe := p.buildProbe(2)
+	if err := p.send(probe); err != nil {
+		return false, fmt.Sprintf("probe not sent: %v", err)
+	}
+	forwarded := p.expectForwarded(probe, p.timeout)
+	if forwarded == nil {
+		return false, "packet with TTL 2 not forwarded"
+	}
+	if forwarded.Header.TTL != 1 {
+		return false, fmt.Sprintf("packet with TTL 2 forwarded with TTL %d, want 1", forwarded.Header.TTL)
+	}
+
+	probe = p.buildProbe(1)
+	if err := p.send(probe); err != nil {
+		return false, fmt.Sprintf("probe not sent: %v", err)
+	}
+	forwarded = p.expectForwarded(probe, p.silence())
+	if forwarded == nil {
+		return true, "TTL 2 forwarded with TTL 1, TTL 1 dropped"
+	}
+	if forwarded.Header.TTL != 0 {
+		return false, fmt.Sprintf("packet with TTL 1 forwarded with TTL %d, want it dropped or forwarded with TTL 0", forwarded.Header.TTL)
+	}
+	return true, "TTL 2 forwarded with TTL 1, TTL 1 forwarded with TTL 0"
+}
+
+// checkStaleLSA floods an LSA of the suite with an older sequence number than the last one, it must be acknowledged and ignored.
+// A newer LSA without the link to phantomAddr must replace the last one, packets to phantomAddr aren't routed anymore.
+func checkStaleLSA(p *scriptedPeer) (bool, string) {
+	if ok, detail := p.routePhantomThroughPeer(); !ok {
+		return false, detail
+	}
+
+	stale := p.buildToTarget(pkt.MsgTypeLSA, p.lsaPayload(p.addr, p.lsaSeqNum-1, p.targetAddr))
+	if _, acked := p.sendAndExpectAck(stale); !acked {
+		return false, "stale LSA not acknowledged, the sender would retransmit it forever"
+	}
+	time.Sleep(p.silence()) // The routing may be updated after the ACK
+	if !p.awaitForwarding(true) {
+		return false, "stale LSA replaced the newer LSA"
+	}
+
+	if ok, detail := p.floodOwnLSA(p.targetAddr); !ok {
+		return false, detail
+	}
+	if !p.awaitForwarding(false) {
+		return false, "newer LSA without the link to the forwarding target ignored"
+	}
+	return true, "stale LSA ignored, newer LSA applied"
+}
+
+// checkDisconnect disconnects from the implementation, the DISCONNECT must be acknowledged.
+func checkDisconnect(p *scriptedPeer) (bool, string) {
+	disconnect := p.buildToTarget(pkt.MsgTypeDisconnect, nil)
+	rtt, acked := p.sendAndExpectAck(disconnect)
+	if !acked {
+		return false, "DISCONNECT not acknowledged"
+	}
+	return true, fmt.Sprintf("DISCONNECT acknowledged after %v", rtt.Round(time.Millisecond))
+}
+
+// floodOwnLSA sends the next LSA of the suite with the neighbors and waits for its ACK.
+func (p *scriptedPeer) floodOwnLSA(neighbors ...netip.Addr) (bool, string) {
+	p.lsaSeqNum++
+	lsa := p.buildToTarget(pkt.MsgTypeLSA, p.lsaPayload(p.addr, p.lsaSeqNum, neighbors...))
+	if _, acked := p.sendAndExpectAck(lsa); !acked {
+		return false, fmt.Sprintf("LSA with seqnum %d not acknowledged", p.lsaSeqNum)
+	}
+	return true, ""
+}
+
+// routePhantomThroughPeer floods the LSAs of a link between the suite and phantomAddr and waits until packets to phantomAddr are routed to the suite.
+func (p *scriptedPeer) routePhantomThroughPeer() (bool, string) {
+	if ok, detail := p.floodOwnLSA(p.targetAddr, phantomAddr); !ok {
+		return false, detail
+	}
+
+	p.phantomSeq++
+	lsa := p.buildToTarget(pkt.MsgTypeLSA, p.lsaPayload(phantomAddr, p.phantomSeq, p.addr))
+	if _, acked := p.sendAndExpectAck(lsa); !acked {
+		return false, fmt.Sprintf("LSA of %v not acknowledged", phantomAddr)
+	}
+
+	if !p.awaitForwarding(true) {
+		return false, fmt.Sprintf("packets to %v not routed to the suite after flooding the link", phantomAddr)
+	}
+	return true, ""
+}
+
+// buildProbe returns a packet from the suite to phantomAddr with the TTL, its forwarded copy is routed back to the suite.
+// Every probe has its own packet number, so the implementation doesn't drop it as a redundant copy of an earlier probe.
+func (p *scriptedPeer) buildProbe(ttl byte) *pkt.Packet {
+	probe := p.build(pkt.MsgTypeChatMessage, pkt.Payload("probe"), p.addr, phantomAddr)
+	probe.Header.TTL = ttl
+	pkt.SetChecksum(probe)
+	return probe
+}
+
+// expectForwarded waits for the forwarded copy of the probe, nil if it doesn't arrive within the timeout.
+func (p *scriptedPeer) expectForwarded(probe *pkt.Packet, timeout time.Duration) *pkt.Packet {
+	var forwarded *pkt.Packet
+	p.expectWithin(timeout, func(reply *pkt.Packet) bool {
+		if reply.GetMessageType() == probe.GetMessageType() && reply.Header.PktNum == probe.Header.PktNum &&
+			reply.Header.SourceAddr == probe.Header.SourceAddr && reply.Header.DestAddr == probe.Header.DestAddr {
+			forwarded = reply
+		}
+		return forwarded != nil
+	})
+	return forwarded
+}
+
+// awaitForwarding sends probes with a full TTL until they are forwarded (want) or not forwarded (!want) anymore.
+// Routing updates may be applied after the LSA is acknowledged, so a single probe isn't conclusive.
+// A probe counts as not forwarded if its copy doesn't arrive within the silence period.
+// Returns false if the forwarding didn't change to want within the timeout of the suite.
+func (p *scriptedPeer) awaitForwarding(want bool) bool {
+	interval := max(p.timeout/10, minRetransmitInterval)
+	if !want {
+		interval = p.silence()
+	}
+
+	start := time.Now()
+	for time.Since(start) < p.timeout {
+		probe := p.buildProbe(common.INITIAL_TTL)
+		if err := p.send(probe); err != nil {
+			return false
+		}
+		if forwarded := p.expectForwarded(probe, interval); (forwarded != nil) == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+// Package conformance checks another implementation of the protocol against the behavior the wire format requires.
+// The suite plays a neighbor of the implementation under test: it connects, sends scripted packets (duplicates,
+// chunks out of order, corrupted checksums, packets with an expiring TTL, outdated LSAs) and reports per behavior
+// whether the replies match. Teams (see common.TEAM_ID) can run it against each other's nodes before interoperating.
+package conformance
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// Status is the outcome of a check.
+type Status int
+
+const (
+	StatusPass Status = iota
+	StatusFail
+	StatusSkip // The check couldn't run because an earlier check failed
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusPass:
+		return "PASS"
+	case StatusFail:
+		return "FAIL"
+	default:
+		return "SKIP"
+	}
+}
+
+// Result is the outcome of the check of one behavior.
+type Result struct {
+	Behavior string
+	Status   Status
+	Detail   string // What was observed, explains a failure
+}
+
+// Options configure a run of the suite.
+type Options struct {
+	TeamID  byte          // Team ID of the packets the suite sends
+	Timeout time.Duration // Maximum time to wait for an expected reply
+}
+
+// Run runs the conformance subcommand with its command line arguments.
+// Usage: conformance [-timeout duration] [-team id] [-bind ip] <ip:port>
+func Run(args []string) error {
+	flags := flag.NewFlagSet("conformance", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", time.Second*2, "maximum time to wait for an expected reply of the peer")
+	teamID := flags.Uint("team", common.TEAM_ID, "team ID of the packets sent to the peer")
+	bindAddr := flags.String("bind", "", "local IPv4 address to send from, by default the address the peer is reached from")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: conformance [-timeout duration] [-team id] [-bind ip] <ip:port>")
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected exactly one peer address")
+	}
+	if *teamID > 0xF {
+		return fmt.Errorf("team ID %d doesn't fit into 4 bits", *teamID)
+	}
+
+	target, err := netip.ParseAddrPort(flags.Arg(0))
+	if err != nil || !target.Addr().Is4() {
+		return fmt.Errorf("invalid peer address %q, expected an IPv4 address and port", flags.Arg(0))
+	}
+
+	var localAddr netip.Addr
+	if *bindAddr == "" {
+		localAddr, err = sock.DetectOutgoingAddress(target.Addr())
+	} else {
+		localAddr, err = netip.ParseAddr(*bindAddr)
+	}
+	if err != nil {
+		return fmt.Errorf("no local address to reach %v from: %w", target, err)
+	}
+
+	socket := sock.NewUDPSocket()
+	_, err = socket.Open(net.IP(localAddr.AsSlice()))
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+
+	fmt.Printf("Checking %v from %v\n", target, socket.MustGetLocalAddress())
+
+	results := RunSuite(socket, target, Options{TeamID: byte(*teamID), Timeout: *timeout})
+	failed := PrintReport(os.Stdout, results)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d behaviors failed", failed, len(results))
+	}
+	return nil
+}
+
+// RunSuite runs all checks in order against the implementation listening at target and returns a result per behavior.
+// The socket must be open, its local address is the address of the suite in the protocol.
+// The checks after the connect are skipped if the implementation doesn't accept the connection.
+func RunSuite(socket sock.Socket, target netip.AddrPort, options Options) []Result {
+	peer := newScriptedPeer(socket, target, options)
+
+	results := make([]Result, 0, len(checks))
+	connected := true
+	for _, check := range checks {
+		if !connected {
+			results = append(results, Result{Behavior: check.behavior, Status: StatusSkip, Detail: "not connected"})
+			continue
+		}
+
+		passed, detail := check.run(peer)
+		status := StatusPass
+		if !passed {
+			status = StatusFail
+		}
+		results = append(results, Result{Behavior: check.behavior, Status: status, Detail: detail})
+
+		if check.behavior == behaviorConnect && !passed {
+			connected = false
+		}
+	}
+	return results
+}
+
+// PrintReport writes a line per result and a summary to w.
+// Returns the number of failed behaviors.
+func PrintReport(w io.Writer, results []Result) (failed int) {
+	counts := map[Status]int{}
+	for _, result := range results {
+		counts[result.Status]++
+		fmt.Fprintf(w, "%s  %-14s %s\n", result.Status, result.Behavior, result.Detail)
+	}
+	fmt.Fprintf(w, "%d passed, %d failed, %d skipped\n", counts[StatusPass], counts[StatusFail], counts[StatusSkip])
+	return counts[StatusFail]
+}
@@ -0,0 +1,48 @@
+package conformance
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/node"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// TestSuiteAgainstNode verifies that a node of this implementation passes every check of the suite
+// and that the chunks sent out of order are reassembled in order.
+func TestSuiteAgainstNode(t *testing.T) {
+	network := sock.NewMemoryNetwork()
+
+	target := node.New(network.NewSocket(), "")
+	targetAddr, err := target.Socket.Open(net.IPv4(10, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("Failed to open socket of the node: %v", err)
+	}
+	t.Cleanup(func() { _ = target.Socket.Close() })
+
+	suiteSocket := network.NewSocket()
+	if _, err := suiteSocket.Open(net.IPv4(10, 0, 0, 2)); err != nil {
+		t.Fatalf("Failed to open socket of the suite: %v", err)
+	}
+
+	messages := events.MessageReceived.Subscribe()
+	defer events.MessageReceived.Unsubscribe(messages)
+
+	results := RunSuite(suiteSocket, targetAddr.AddrPort(), Options{TeamID: target.Connections.TeamID(), Timeout: time.Second})
+
+	var report strings.Builder
+	if failed := PrintReport(&report, results); failed > 0 {
+		t.Fatalf("Node doesn't pass the suite:\n%s", report.String())
+	}
+
+	received := map[string]bool{}
+	for len(messages) > 0 {
+		received[(<-messages).Text] = true
+	}
+	if !received["out-of-order"] {
+		t.Errorf("Chunks sent out of order weren't reassembled in order, received %v", received)
+	}
+}
@@ -0,0 +1,160 @@
+package conformance
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// scriptedPeer is the suite's side of the interactions, it builds raw packets and reads the replies of the target packet by packet.
+// Reliable packets of the target addressed to the peer are acknowledged automatically while waiting, like a regular neighbor would.
+type scriptedPeer struct {
+	socket     sock.Socket
+	addr       netip.Addr // Address of the peer in the protocol
+	target     netip.AddrPort
+	targetAddr netip.Addr
+	packets    chan *sock.Packet
+	teamID     byte
+	nextPktNum uint32
+	bootEpoch  uint64
+	timeout    time.Duration
+	lsaSeqNum  uint32 // Sequence number of the last LSA of the peer
+	phantomSeq uint32 // Sequence number of the last LSA of phantomAddr
+}
+
+func newScriptedPeer(socket sock.Socket, target netip.AddrPort, options Options) *scriptedPeer {
+	return &scriptedPeer{
+		socket:     socket,
+		addr:       socket.MustGetLocalAddress().Addr(),
+		target:     target,
+		targetAddr: target.Addr(),
+		packets:    socket.Subscribe(),
+		teamID:     options.TeamID,
+		bootEpoch:  uint64(time.Now().UnixNano()),
+		timeout:    options.Timeout,
+	}
+}
+
+// build returns a packet from src to dest with the next packet number.
+func (p *scriptedPeer) build(msgType byte, payload pkt.Payload, src netip.Addr, dest netip.Addr) *pkt.Packet {
+	var pktNum [4]byte
+	binary.BigEndian.PutUint32(pktNum[:], p.nextPktNum)
+	p.nextPktNum++
+
+	packet := &pkt.Packet{
+		Header: pkt.Header{
+			SourceAddr: src.As4(),
+			DestAddr:   dest.As4(),
+			Control:    pkt.MakeControlByte(msgType, p.teamID),
+			TTL:        common.INITIAL_TTL,
+			PktNum:     pktNum,
+		},
+		Payload: payload,
+	}
+	pkt.SetChecksum(packet)
+	return packet
+}
+
+// buildToTarget returns a packet from the peer to the target with the next packet number.
+func (p *scriptedPeer) buildToTarget(msgType byte, payload pkt.Payload) *pkt.Packet {
+	return p.build(msgType, payload, p.addr, p.targetAddr)
+}
+
+// send sends the packet to the target as is, also if its checksum doesn't match.
+func (p *scriptedPeer) send(packet *pkt.Packet) error {
+	return p.socket.SendTo(net.UDPAddrFromAddrPort(p.target), packet.ToByteArray())
+}
+
+// expectWithin passes every packet of the target to done until done returns true or the timeout elapses.
+// Returns false if the timeout elapsed.
+func (p *scriptedPeer) expectWithin(timeout time.Duration, done func(packet *pkt.Packet) bool) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case udpPacket := <-p.packets:
+			from := udpPacket.Addr.AddrPort()
+			if netip.AddrPortFrom(from.Addr().Unmap(), from.Port()) != p.target {
+				continue // Not the implementation under test
+			}
+			packet, err := pkt.ParsePacket(udpPacket.Data)
+			if err != nil {
+				continue
+			}
+
+			p.acknowledge(packet)
+
+			if done(packet) {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// expectAck waits for the ACK of the packet from the target, other packets are skipped.
+// Returns the time until the ACK arrived and false if it didn't arrive within the timeout.
+func (p *scriptedPeer) expectAck(packet *pkt.Packet, timeout time.Duration) (time.Duration, bool) {
+	start := time.Now()
+	acked := p.expectWithin(timeout, func(reply *pkt.Packet) bool {
+		return isAckOf(reply, packet)
+	})
+	return time.Since(start), acked
+}
+
+// sendAndExpectAck sends the packet and waits for its ACK within the timeout of the suite.
+func (p *scriptedPeer) sendAndExpectAck(packet *pkt.Packet) (time.Duration, bool) {
+	if err := p.send(packet); err != nil {
+		return 0, false
+	}
+	return p.expectAck(packet, p.timeout)
+}
+
+// acknowledge acknowledges a reliable packet of the target that is addressed to the peer.
+func (p *scriptedPeer) acknowledge(packet *pkt.Packet) {
+	switch packet.GetMessageType() {
+	case pkt.MsgTypeAcknowledgment, pkt.MsgTypeMTUProbe, pkt.MsgTypePresence, pkt.MsgTypeRelay:
+		return
+	}
+	if netip.AddrFrom4(packet.Header.DestAddr) != p.addr {
+		return
+	}
+
+	ack := &pkt.Packet{
+		Header: pkt.Header{
+			SourceAddr: p.addr.As4(),
+			DestAddr:   packet.Header.SourceAddr,
+			Control:    pkt.MakeControlByte(pkt.MsgTypeAcknowledgment, p.teamID),
+			TTL:        common.INITIAL_TTL,
+			PktNum:     packet.Header.PktNum,
+		},
+	}
+	pkt.SetChecksum(ack)
+	_ = p.send(ack)
+}
+
+// lsaPayload returns the payload of an LSA of owner with the given neighbors, the peer's boot epoch comes first.
+func (p *scriptedPeer) lsaPayload(owner netip.Addr, seqNum uint32, neighbors ...netip.Addr) pkt.Payload {
+	payload := binary.BigEndian.AppendUint64(nil, p.bootEpoch)
+	payload = append(payload, owner.AsSlice()...)
+	payload = binary.BigEndian.AppendUint32(payload, seqNum)
+	for _, neighbor := range neighbors {
+		payload = append(payload, neighbor.AsSlice()...)
+	}
+	return payload
+}
+
+// finPayload returns the payload of the FIN of a message whose last chunk has the packet number.
+func finPayload(lastChunk *pkt.Packet) pkt.Payload {
+	return pkt.Payload(lastChunk.Header.PktNum[:])
+}
+
+// isAckOf returns whether the reply is the ACK of the packet.
+func isAckOf(reply *pkt.Packet, packet *pkt.Packet) bool {
+	return reply.GetMessageType() == pkt.MsgTypeAcknowledgment && reply.Header.PktNum == packet.Header.PktNum && reply.Header.DestAddr == packet.Header.SourceAddr
+}
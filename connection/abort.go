@@ -0,0 +1,61 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// ABORT packets tell a sender that we rejected its message or file transfer and cleared our state of it.
+// The sender should stop sending the remaining packets and finish the sequence with a FIN.
+//
+// Payload:
+//
+//	+------------------------+------------------+
+//	| Message Type (8 bits)  | Reason (8 bits)  |
+//	+------------------------+------------------+
+//
+// The message type is pkt.MsgTypeChatMessage or pkt.MsgTypeFileTransfer.
+// An ABORT of pkt.MsgTypeConnect refuses a CONNECT instead, it has packet number zero and isn't acknowledged (see RefuseConnect).
+const (
+	AbortReasonMessageTooLarge    = 0x00 // The message exceeds common.MAX_MESSAGE_SIZE_BYTES of the receiver
+	AbortReasonFileTooLarge       = 0x01 // The file exceeds common.MAX_FILE_SIZE_BYTES of the receiver
+	AbortReasonTooManyTransfers   = 0x02 // The receiver has common.MAX_RECONSTRUCTORS open transfers already
+	AbortReasonReconstructorError = 0x03 // The receiver failed to store the transfer
+	AbortReasonInsufficientSpace  = 0x04 // The advertised file size doesn't fit on the receiver's disk
+	AbortReasonOverloaded         = 0x05 // The receiver's LSDB is full, it doesn't accept new neighbors
+)
+
+var abortReasonNames = map[byte]string{
+	AbortReasonMessageTooLarge:    "message too large",
+	AbortReasonFileTooLarge:       "file too large",
+	AbortReasonTooManyTransfers:   "too many concurrent transfers",
+	AbortReasonReconstructorError: "receiver failed to store the transfer",
+	AbortReasonInsufficientSpace:  "not enough disk space",
+	AbortReasonOverloaded:         "LSDB overloaded",
+}
+
+// AbortReasonString returns a readable description of the abort reason.
+func AbortReasonString(reason byte) string {
+	name, exists := abortReasonNames[reason]
+	if !exists {
+		return "unknown reason"
+	}
+	return name
+}
+
+// SendAbort tells the peer that we rejected its transfer of the message type.
+// The ABORT is sent reliably, the returned channel reports whether it was acknowledged.
+func (m *Manager) SendAbort(peer netip.Addr, msgType byte, reason byte) (chan bool, error) {
+	return m.SendReliableRoutedPacket(context.Background(), m.BuildSequencedPacket(pkt.MsgTypeAbort, pkt.Payload{msgType, reason}, peer))
+}
+
+// ParseAbortPayload returns the message type of the aborted transfer and the reason.
+func ParseAbortPayload(payload pkt.Payload) (msgType byte, reason byte, err error) {
+	if len(payload) < 2 {
+		return 0, 0, errors.New("ABORT payload too short")
+	}
+	return payload[0], payload[1], nil
+}
@@ -0,0 +1,67 @@
+package connection
+
+import (
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// SetPreSharedKey enables packet authentication with the given key.
+// All outgoing packets carry a MAC and incoming packets without a valid MAC are rejected.
+// Must be called before the socket is opened.
+func (m *Manager) SetPreSharedKey(key []byte) {
+	m.preSharedKey = key
+}
+
+// PreSharedKey returns the key packets are authenticated with, nil if authentication is disabled.
+func (m *Manager) PreSharedKey() []byte {
+	return m.preSharedKey
+}
+
+// IsAuthenticationEnabled returns whether a pre-shared key is configured.
+func (m *Manager) IsAuthenticationEnabled() bool {
+	return m.preSharedKey != nil
+}
+
+// VerifyAuthentication returns whether an incoming packet may be processed.
+// If authentication is enabled, the packet must carry a valid MAC for the pre-shared key.
+func (m *Manager) VerifyAuthentication(packet *pkt.Packet) bool {
+	if !m.IsAuthenticationEnabled() {
+		return true
+	}
+	return pkt.VerifyMAC(packet, m.preSharedKey)
+}
+
+// IsPlausibleAckSender returns whether an ACK with the source address srcAddr may have been received from sender.
+// Without this check, any host could clear open acknowledgments of other flows by forging the source address of ACKs.
+// With authentication enabled, the verified MAC already proves that the ACK was sent by a member of the network.
+// Otherwise the ACK must be received from srcAddr itself or from a neighbor that is the last hop of some path from srcAddr to us.
+// srcAddr may not be a neighbor yet, e.g. for the ACK of a CONNECT.
+func (m *Manager) IsPlausibleAckSender(srcAddr netip.Addr, sender netip.AddrPort) bool {
+	if m.IsAuthenticationEnabled() {
+		return true
+	}
+
+	if m.IsValidSender(srcAddr, sender) {
+		return true
+	}
+	if isNeighbor, addrPort := m.router.IsNeighbor(srcAddr); isNeighbor && addrPort == sender {
+		return true
+	}
+
+	for neighbor, addrPort := range m.router.GetNeighbors() {
+		if addrPort == sender {
+			return m.router.IsOnPath(srcAddr, neighbor)
+		}
+	}
+
+	return false // Not received from a neighbor
+}
+
+// authenticationOverhead returns the number of bytes authentication may add to an outgoing packet.
+func (m *Manager) authenticationOverhead() int {
+	if !m.IsAuthenticationEnabled() {
+		return 0
+	}
+	return pkt.AUTHENTICATION_OVERHEAD
+}
@@ -0,0 +1,184 @@
+package connection
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// Neighbors announce their protocol version and capabilities with an ExtTypeCapabilities extension on the CONNECT and its ACK,
+// so a feature can be rolled out node by node and is only used on links to neighbors that announced it.
+// The announcement is an extension instead of additional CONNECT payload because older nodes read any payload after the boot epoch
+// as external address, while they ignore unknown extensions. Neighbors without announcement are legacy nodes without capabilities.
+//
+// Value:
+//
+//	+----------+---------------------------+---------------------------+
+//	| Version  | Capability flags (16 bits)| Max payload size (16 bits)|
+//	+----------+---------------------------+---------------------------+
+
+// PROTOCOL_VERSION is the protocol version announced to neighbors.
+const PROTOCOL_VERSION = 1
+
+const capabilitiesSize = 5
+
+// Capability is a feature a node announces to its neighbors, the flags are combined with |.
+type Capability uint16
+
+const (
+	CapabilityCompression  Capability = 1 << iota // Compressed payloads
+	CapabilitySACK                                // Selective acknowledgments
+	CapabilityCRC32C                              // CRC32C instead of the Internet checksum
+	CapabilityEncryption                          // Encrypted payloads
+	CapabilitySinglePacket                        // Messages of one packet that carry their FIN in an ExtTypeFinish extension
+)
+
+var capabilityNames = []struct {
+	capability Capability
+	name       string
+}{
+	{CapabilityCompression, "compression"},
+	{CapabilitySACK, "SACK"},
+	{CapabilityCRC32C, "CRC32C"},
+	{CapabilityEncryption, "encryption"},
+	{CapabilitySinglePacket, "single-packet messages"},
+}
+
+func (c Capability) String() string {
+	names := make([]string, 0)
+	for _, known := range capabilityNames {
+		if c&known.capability != 0 {
+			names = append(names, known.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// Capabilities is the protocol version and capabilities announced by a node.
+type Capabilities struct {
+	Version        byte
+	Flags          Capability // Unknown flags of newer versions are kept
+	MaxPayloadSize int        // Largest payload in bytes the node can receive
+}
+
+// Has returns whether all of the capabilities are announced.
+func (c Capabilities) Has(capability Capability) bool {
+	return c.Flags&capability == capability
+}
+
+// capabilityState holds the capabilities we announce and those our neighbors announced.
+type capabilityState struct {
+	mu    sync.Mutex
+	local Capability
+	peers map[netip.Addr]Capabilities
+}
+
+// SetCapabilities sets the capabilities announced to neighbors, a feature adds its flag once it is implemented and enabled.
+// Must be called before connecting to neighbors, capabilities are announced when connecting.
+func (m *Manager) SetCapabilities(flags Capability) {
+	m.capabilities.mu.Lock()
+	defer m.capabilities.mu.Unlock()
+
+	m.capabilities.local = flags
+}
+
+// LocalCapabilities returns the version and capabilities announced to neighbors.
+func (m *Manager) LocalCapabilities() Capabilities {
+	m.capabilities.mu.Lock()
+	defer m.capabilities.mu.Unlock()
+
+	return Capabilities{
+		Version:        PROTOCOL_VERSION,
+		Flags:          m.capabilities.local,
+		MaxPayloadSize: common.UDP_BUFFER_SIZE_BYTES - 28 - pkt.HEADER_SIZE, // Without IPv4 and UDP header
+	}
+}
+
+// announceCapabilities adds the ExtTypeCapabilities extension to a CONNECT or its ACK.
+func (m *Manager) announceCapabilities(packet *pkt.Packet) {
+	local := m.LocalCapabilities()
+
+	value := make([]byte, capabilitiesSize)
+	value[0] = local.Version
+	binary.BigEndian.PutUint16(value[1:3], uint16(local.Flags))
+	binary.BigEndian.PutUint16(value[3:5], uint16(min(local.MaxPayloadSize, 0xFFFF)))
+
+	packet.AddExtension(pkt.ExtTypeCapabilities, value)
+	pkt.SetChecksum(packet)
+}
+
+// ParseCapabilities returns the capabilities of an ExtTypeCapabilities extension of the packet.
+// Returns false if the packet doesn't announce capabilities.
+func ParseCapabilities(packet *pkt.Packet) (Capabilities, bool) {
+	for _, ext := range packet.GetExtensions(pkt.ExtTypeCapabilities) {
+		if len(ext.Value) >= capabilitiesSize { // Newer versions may append fields
+			return Capabilities{
+				Version:        ext.Value[0],
+				Flags:          Capability(binary.BigEndian.Uint16(ext.Value[1:3])),
+				MaxPayloadSize: int(binary.BigEndian.Uint16(ext.Value[3:5])),
+			}, true
+		}
+	}
+	return Capabilities{}, false
+}
+
+// RecordCapabilities records the capabilities the neighbor addr announced.
+// Must be called with CONNECTs and ACKs from neighbors. A CONNECT without announcement makes the neighbor a legacy node,
+// an ACK without announcement doesn't revoke an announcement.
+func (m *Manager) RecordCapabilities(packet *pkt.Packet, addr netip.Addr) {
+	capabilities, announced := ParseCapabilities(packet)
+	if !announced && packet.GetMessageType() != pkt.MsgTypeConnect {
+		return
+	}
+
+	m.capabilities.mu.Lock()
+	defer m.capabilities.mu.Unlock()
+
+	if announced {
+		m.capabilities.peers[addr] = capabilities
+	} else {
+		delete(m.capabilities.peers, addr)
+	}
+}
+
+// GetPeerCapabilities returns the capabilities the neighbor announced.
+// Returns false for legacy neighbors and peers that aren't neighbors.
+func (m *Manager) GetPeerCapabilities(addr netip.Addr) (Capabilities, bool) {
+	m.capabilities.mu.Lock()
+	defer m.capabilities.mu.Unlock()
+
+	capabilities, exists := m.capabilities.peers[addr]
+	return capabilities, exists
+}
+
+// PeerSupports returns whether we and the neighbor both announced the capability, so it may be used for packets to the neighbor.
+func (m *Manager) PeerSupports(addr netip.Addr, capability Capability) bool {
+	m.capabilities.mu.Lock()
+	defer m.capabilities.mu.Unlock()
+
+	peer, exists := m.capabilities.peers[addr]
+	return exists && peer.Has(capability) && m.capabilities.local&capability == capability
+}
+
+// announcedPayloadLimit returns the maximum payload size the neighbor announced or 0 if it didn't.
+func (m *Manager) announcedPayloadLimit(addr netip.Addr) int {
+	m.capabilities.mu.Lock()
+	defer m.capabilities.mu.Unlock()
+
+	return m.capabilities.peers[addr].MaxPayloadSize
+}
+
+// clearCapabilities forgets the capabilities of a removed neighbor.
+func (m *Manager) clearCapabilities(addr netip.Addr) {
+	m.capabilities.mu.Lock()
+	defer m.capabilities.mu.Unlock()
+
+	delete(m.capabilities.peers, addr)
+}
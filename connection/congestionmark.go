@@ -0,0 +1,86 @@
+package connection
+
+import (
+	"net/netip"
+	"sync"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// Forwarding nodes mark data packets as congestion experienced (ExtTypeCE) while their send queue to the next hop holds at least common.CE_QUEUE_THRESHOLD_PACKETS packets.
+// The destination echoes the mark to the source with the next ACK or data packet (ExtTypeCEEcho).
+// The source reduces its congestion window like after a loss, but before the queue overflows and packets are actually lost.
+// congestionMarkState holds the marks waiting to be echoed.
+type congestionMarkState struct {
+	mu      sync.Mutex
+	pending map[netip.Addr][4]byte // Packet number of the latest marked packet per source
+}
+
+// dataQueueLength returns the number of data packets queued for the next hop.
+func (m *Manager) dataQueueLength(nextHop netip.AddrPort) int {
+	m.scheduler.mu.Lock()
+	defer m.scheduler.mu.Unlock()
+
+	queue, exists := m.scheduler.queues[nextHop]
+	if !exists {
+		return 0
+	}
+	return len(queue.packets)
+}
+
+// markIfCongested marks a forwarded data packet as congestion experienced if the send queue to its next hop is congested.
+// The checksum must be updated afterwards.
+func (m *Manager) markIfCongested(nextHop netip.AddrPort, packet *pkt.Packet) {
+	if !isDataMsgType(packet.GetMessageType()) || packet.IsCongestionMarked() {
+		return
+	}
+	if m.dataQueueLength(nextHop) < common.CE_QUEUE_THRESHOLD_PACKETS {
+		return
+	}
+
+	packet.AddExtension(pkt.ExtTypeCE, nil)
+
+	m.forwarding.mu.Lock()
+	m.forwarding.congestionMarked++
+	m.forwarding.mu.Unlock()
+
+	logger.Debugf("Send queue to %v is congested, marking %s %d from %v", nextHop, msgTypeNames[packet.GetMessageType()], packet.Header.PktNum, netip.AddrFrom4(packet.Header.SourceAddr))
+}
+
+// RecordCongestionMark remembers a marked data packet we received, so the mark is echoed to its source.
+// Packets that aren't marked are ignored.
+func (m *Manager) RecordCongestionMark(packet *pkt.Packet) {
+	if !isDataMsgType(packet.GetMessageType()) || !packet.IsCongestionMarked() {
+		return
+	}
+
+	m.congestionMarks.mu.Lock()
+	defer m.congestionMarks.mu.Unlock()
+
+	m.congestionMarks.pending[netip.AddrFrom4(packet.Header.SourceAddr)] = packet.Header.PktNum
+}
+
+// attachCongestionEcho adds the pending mark of the destination to an outgoing ACK or data packet and updates its checksum.
+func (m *Manager) attachCongestionEcho(packet *pkt.Packet) {
+	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
+
+	m.congestionMarks.mu.Lock()
+	pktNum, exists := m.congestionMarks.pending[destAddr]
+	delete(m.congestionMarks.pending, destAddr)
+	m.congestionMarks.mu.Unlock()
+
+	if exists {
+		packet.AddExtension(pkt.ExtTypeCEEcho, pktNum[:])
+		pkt.SetChecksum(packet)
+	}
+}
+
+// clearCongestionMark drops the pending mark of the peer.
+func (m *Manager) clearCongestionMark(addr netip.Addr) {
+	m.congestionMarks.mu.Lock()
+	defer m.congestionMarks.mu.Unlock()
+
+	delete(m.congestionMarks.pending, addr)
+}
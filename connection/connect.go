@@ -0,0 +1,137 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// ErrOverloaded is returned if a new neighbor is refused because our LSDB is full, see routing.Router.IsOverloaded.
+var ErrOverloaded = errors.New("LSDB is overloaded")
+
+// ConnectTo sends a CONNECT with the given payload (see BuildConnectPayload) to the peer with the address addr, reached at addrPort.
+// addr is the node ID of the peer, it differs from the address of addrPort if the peer identifies by a node ID.
+// Once the CONNECT is acknowledged, the peer is established as neighbor (see EstablishNeighbor).
+// The returned channel receives whether the connection was established.
+// Errors if the connection to the peer isn't Down, e.g. because another CONNECT is still waiting for its ACK, or with ErrOverloaded.
+// The CONNECT is given up if the peer refuses the connection, see HandleConnectRefused.
+func (m *Manager) ConnectTo(addr netip.Addr, addrPort netip.AddrPort, payload pkt.Payload) (<-chan bool, error) {
+	if m.router.IsOverloaded() {
+		return nil, fmt.Errorf("can't connect to %s: %w", addr, ErrOverloaded)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m.peerStates.mu.Lock()
+	if !m.transitionPeerLocked(addr, addrPort, PeerConnecting) {
+		m.peerStates.mu.Unlock()
+		cancel()
+		return nil, fmt.Errorf("connection to %s is %v", addr, m.GetPeerState(addr))
+	}
+	m.peerStates.peers[addr].cancelConnect = cancel
+	m.peerStates.mu.Unlock()
+
+	packet := m.BuildSequencedPacket(pkt.MsgTypeConnect, payload, addr)
+	if localAddr := m.socket.MustGetLocalAddress(); m.isIdentifiedByNodeID(localAddr) {
+		nodeID := localAddr.Addr().As4()
+		packet.AddExtension(pkt.ExtTypeNodeID, nodeID[:])
+		pkt.SetChecksum(packet)
+	}
+	m.announceHopARQ(packet)
+	m.announceCapabilities(packet)
+	m.announcePublicKey(packet)
+	m.signConnect(packet)
+
+	if addr != addrPort.Addr() && !IsRelayedAddrPort(addrPort) {
+		m.RecordAdvertisedAddress(addr, addrPort) // Packets of the peer, starting with the ACK, are sent from addrPort
+	}
+
+	ackChan, err := m.SendReliablePacketTo(ctx, addrPort, packet)
+	if err != nil {
+		cancel()
+		m.transitionPeer(addr, netip.AddrPort{}, PeerDown)
+		return nil, fmt.Errorf("failed to send connect message: %w", err)
+	}
+
+	connected := make(chan bool, 1)
+
+	go func() {
+		defer panics.Recover("handling connection acknowledgment of %s", addr)
+		defer cancel()
+
+		success := <-ackChan
+		if success {
+			// Fails if both peers sent a CONNECT at the same time (e.g. when punching a NAT) and the peer's CONNECT was handled first
+			m.EstablishNeighbor(addr, addrPort)
+		} else {
+			if ctx.Err() == nil {
+				logger.Warnf("Acknowledgment for connection request to %s was not received", addrPort)
+			}
+			if m.transitionPeer(addr, netip.AddrPort{}, PeerDown) {
+				m.clearAdvertisedAddress(addr)
+			}
+		}
+		connected <- success
+	}()
+
+	return connected, nil
+}
+
+// RefuseConnect tells the peer at addrPort that we don't accept it as neighbor, its CONNECT isn't acknowledged.
+// The refusal is an ABORT of the CONNECT with the reason, e.g. AbortReasonOverloaded.
+// It is sent directly to the peer and isn't sequenced, the peer isn't a neighbor and may not be routable.
+func (m *Manager) RefuseConnect(addr netip.Addr, addrPort netip.AddrPort, reason byte) error {
+	logger.Warnf("Refusing connection of %v: %s", addr, AbortReasonString(reason))
+	return m.sendPacketTo(addrPort, m.buildPacket(pkt.MsgTypeAbort, pkt.Payload{pkt.MsgTypeConnect, reason}, addr, [4]byte{}))
+}
+
+// HandleConnectRefused gives up our CONNECT to the peer at addrPort because the peer refused the connection, see RefuseConnect.
+// Refusals of peers we aren't connecting to, or from another address than the CONNECT was sent to, are ignored.
+func (m *Manager) HandleConnectRefused(addr netip.Addr, addrPort netip.AddrPort, reason byte) {
+	m.peerStates.mu.Lock()
+	defer m.peerStates.mu.Unlock()
+
+	peer, exists := m.peerStates.peers[addr]
+	if !exists || peer.State != PeerConnecting || peer.AddrPort != addrPort || peer.cancelConnect == nil {
+		logger.Debugf("Ignoring refused connection from %v (%v), we aren't connecting to it", addr, addrPort)
+		return
+	}
+
+	logger.Warnf("Connection to %v refused: %s", addr, AbortReasonString(reason))
+	peer.cancelConnect() // The CONNECT isn't resent, its goroutine moves the connection to Down
+}
+
+// NotifyConnected publishes that a new neighbor is connected.
+func (m *Manager) NotifyConnected(addr netip.Addr, addrPort netip.AddrPort) {
+	m.recordSessionNeighbor(addr)
+
+	event := events.PeerConnectedEvent{Addr: addr, AddrPort: addrPort}
+	if relay, isRelayed := m.GetRelay(addr); isRelayed && IsRelayedAddrPort(addrPort) {
+		event.Relay = relay
+	}
+	events.PeerConnected.NotifyObservers(event)
+}
+
+// isIdentifiedByNodeID returns whether our address in the protocol isn't the address of our socket.
+// This is the case if a node ID is configured or the socket was moved with Rebind.
+func (m *Manager) isIdentifiedByNodeID(localAddr netip.AddrPort) bool {
+	boundAddr, err := m.socket.GetBoundAddress()
+	return err == nil && boundAddr.Addr() != localAddr.Addr()
+}
+
+// ParseNodeID returns the node ID of the ExtTypeNodeID extension of a CONNECT.
+// Returns false if the sender identifies by its IP address.
+func ParseNodeID(packet *pkt.Packet) (netip.Addr, bool) {
+	for _, ext := range packet.GetExtensions(pkt.ExtTypeNodeID) {
+		if len(ext.Value) == 4 {
+			return netip.AddrFrom4([4]byte(ext.Value)), true
+		}
+	}
+	return netip.Addr{}, false
+}
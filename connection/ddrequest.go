@@ -0,0 +1,114 @@
+package connection
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// A DD lists the addresses of the LSAs in the LSDB of its sender, which is enough to send a neighbor the LSAs it misses.
+// To compare the LSDBs of two neighbors, a node sends its DD with an ExtTypeDDRequest extension.
+// The neighbor handles it like any DD and replies with its own DD marked by an ExtTypeDDSeqNums extension.
+// The entries of such a DD carry the sequence number of each LSA after its address.
+// ddRequestState holds the DD requests waiting for the DD of the neighbor.
+type ddRequestState struct {
+	mu      sync.Mutex
+	pending map[netip.Addr]chan<- []DDEntry
+}
+
+// DDEntry is an LSA listed in the DD of a neighbor.
+type DDEntry struct {
+	Addr   netip.Addr
+	SeqNum uint32
+}
+
+// buildDDPayload returns the DD payload of our LSDB, optionally with the sequence numbers of the LSAs.
+func (m *Manager) buildDDPayload(withSeqNums bool) pkt.Payload {
+	existingLSAs := m.router.GetAvailableLSAs()
+	payload := make(pkt.Payload, 0, len(existingLSAs)*8)
+	for _, addr := range existingLSAs {
+		lsa, exists := m.router.GetLSA(addr)
+		if !exists {
+			continue // LSDB changed between GetAvailableLSAs() and here (very unlikely)
+		}
+
+		addrBytes := addr.As4()
+		payload = append(payload, addrBytes[:]...)
+		if withSeqNums {
+			payload = binary.BigEndian.AppendUint32(payload, lsa.SeqNum)
+		}
+	}
+	return payload
+}
+
+// RequestDD sends our DD to the neighbor and asks it for its DD with sequence numbers.
+// Blocks until the DD of the neighbor arrives or common.DD_REQUEST_TIMEOUT passes.
+func (m *Manager) RequestDD(addr netip.Addr) ([]DDEntry, error) {
+	isNeighbor, addrPort := m.router.IsNeighbor(addr)
+	if !isNeighbor {
+		return nil, fmt.Errorf("%w: %s", ErrPeerUnknown, addr)
+	}
+
+	replyChan := make(chan []DDEntry, 1)
+
+	m.ddRequests.mu.Lock()
+	if _, exists := m.ddRequests.pending[addr]; exists {
+		m.ddRequests.mu.Unlock()
+		return nil, errors.New("the DD of the neighbor was already requested")
+	}
+	m.ddRequests.pending[addr] = replyChan
+	m.ddRequests.mu.Unlock()
+
+	defer func() {
+		m.ddRequests.mu.Lock()
+		delete(m.ddRequests.pending, addr)
+		m.ddRequests.mu.Unlock()
+	}()
+
+	packet := m.BuildSequencedPacket(pkt.MsgTypeDD, m.buildDDPayload(false), addr)
+	packet.AddExtension(pkt.ExtTypeDDRequest, nil)
+	pkt.SetChecksum(packet)
+
+	_, err := m.SendReliablePacketTo(context.Background(), addrPort, packet)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case entries := <-replyChan:
+		return entries, nil
+	case <-time.After(common.DD_REQUEST_TIMEOUT):
+		return nil, errors.New("no DD received")
+	}
+}
+
+// SendDDReply answers a DD request of the neighbor destAddr at destAddrPort with our DD including sequence numbers.
+func (m *Manager) SendDDReply(destAddr netip.Addr, destAddrPort netip.AddrPort) error {
+	packet := m.BuildSequencedPacket(pkt.MsgTypeDD, m.buildDDPayload(true), destAddr)
+	packet.AddExtension(pkt.ExtTypeDDSeqNums, nil)
+	pkt.SetChecksum(packet)
+
+	_, err := m.SendReliablePacketTo(context.Background(), destAddrPort, packet)
+	return err
+}
+
+// HandleDDReply passes the entries of a DD with sequence numbers to the request waiting for it, if any.
+func (m *Manager) HandleDDReply(addr netip.Addr, entries []DDEntry) {
+	m.ddRequests.mu.Lock()
+	replyChan, exists := m.ddRequests.pending[addr]
+	m.ddRequests.mu.Unlock()
+
+	if exists {
+		select {
+		case replyChan <- entries:
+		default: // A DD for this request was already delivered
+		}
+	}
+}
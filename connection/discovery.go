@@ -0,0 +1,208 @@
+package connection
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/discovery"
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// discoveryState holds the LAN discovery and the nodes it found, see package discovery.
+type discoveryState struct {
+	mu          sync.Mutex
+	conn        *discovery.Conn // nil while the discovery isn't running
+	stop        chan struct{}
+	autoConnect func(nodeID netip.Addr) bool // Decides whether a discovered node is connected to, nil connects to none
+	peers       map[netip.Addr]DiscoveredPeer
+}
+
+// DiscoveredPeer is a node on the local network whose beacon was received.
+type DiscoveredPeer struct {
+	NodeID   netip.Addr
+	AddrPort netip.AddrPort // UDP address the node listens on
+	LastSeen time.Time
+}
+
+// StartDiscovery announces us on the local network and discovers other nodes, see package discovery.
+// The beacon advertises localAddr, the address our socket listens on, and is sent every common.DISCOVERY_BEACON_INTERVAL.
+// Beacons of other teams are ignored unless we are promiscuous. With a pre-shared key, beacons are authenticated.
+// Newly discovered nodes are published as events.PeerDiscoveredEvent and connected to if autoConnect returns true for them, autoConnect may be nil.
+// Nodes are forgotten once their beacon wasn't received for common.DISCOVERY_PEER_TIMEOUT.
+func (m *Manager) StartDiscovery(localAddr netip.AddrPort, autoConnect func(nodeID netip.Addr) bool) error {
+	m.StopDiscovery()
+
+	conn, err := discovery.Listen(netip.MustParseAddrPort(common.DISCOVERY_GROUP), localAddr.Addr())
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+
+	m.discovery.mu.Lock()
+	m.discovery.conn = conn
+	m.discovery.stop = stop
+	m.discovery.autoConnect = autoConnect
+	m.discovery.peers = make(map[netip.Addr]DiscoveredPeer)
+	m.discovery.mu.Unlock()
+
+	nodeID := m.socket.MustGetLocalAddress().Addr()
+	beacon := discovery.AppendBeacon(nil, discovery.Beacon{NodeID: nodeID, AddrPort: localAddr, Team: m.TeamID()}, m.preSharedKey)
+
+	go m.receiveBeacons(conn, nodeID)
+	go m.sendBeacons(conn, beacon, stop)
+
+	return nil
+}
+
+// StopDiscovery stops announcing us and forgets the discovered nodes.
+func (m *Manager) StopDiscovery() {
+	m.discovery.mu.Lock()
+	defer m.discovery.mu.Unlock()
+
+	if m.discovery.conn == nil {
+		return
+	}
+
+	close(m.discovery.stop)
+	_ = m.discovery.conn.Close()
+	m.discovery.conn = nil
+	m.discovery.peers = nil
+}
+
+// IsDiscoveryRunning returns whether we announce us and discover nodes on the local network.
+func (m *Manager) IsDiscoveryRunning() bool {
+	m.discovery.mu.Lock()
+	defer m.discovery.mu.Unlock()
+
+	return m.discovery.conn != nil
+}
+
+// DiscoveredPeers returns the nodes discovered on the local network, ordered by node ID.
+func (m *Manager) DiscoveredPeers() []DiscoveredPeer {
+	m.discovery.mu.Lock()
+	defer m.discovery.mu.Unlock()
+
+	peers := make([]DiscoveredPeer, 0, len(m.discovery.peers))
+	for _, peer := range m.discovery.peers {
+		peers = append(peers, peer)
+	}
+	slices.SortFunc(peers, func(a, b DiscoveredPeer) int { return a.NodeID.Compare(b.NodeID) })
+	return peers
+}
+
+// sendBeacons sends the beacon every common.DISCOVERY_BEACON_INTERVAL and forgets timed out nodes until stop is closed.
+func (m *Manager) sendBeacons(conn *discovery.Conn, beacon []byte, stop <-chan struct{}) {
+	defer panics.Recover("sending discovery beacons")
+
+	ticker := time.NewTicker(common.DISCOVERY_BEACON_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := conn.Send(beacon); err != nil {
+			logger.Debugf("Failed to send discovery beacon: %v", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.forgetTimedOutPeers()
+		}
+	}
+}
+
+func (m *Manager) forgetTimedOutPeers() {
+	m.discovery.mu.Lock()
+	defer m.discovery.mu.Unlock()
+
+	for nodeID, peer := range m.discovery.peers {
+		if time.Since(peer.LastSeen) > common.DISCOVERY_PEER_TIMEOUT {
+			delete(m.discovery.peers, nodeID)
+		}
+	}
+}
+
+// receiveBeacons records the nodes whose beacons arrive until conn is closed.
+// localNodeID is our node ID, our own beacons are received as well.
+func (m *Manager) receiveBeacons(conn *discovery.Conn, localNodeID netip.Addr) {
+	defer panics.Recover("receiving discovery beacons")
+
+	buf := make([]byte, common.UDP_BUFFER_SIZE_BYTES)
+	for {
+		n, from, err := conn.Receive(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Debugf("Failed to receive discovery beacon: %v", err)
+			continue
+		}
+
+		beacon, err := discovery.ParseBeacon(buf[:n], m.preSharedKey)
+		if err != nil {
+			if !errors.Is(err, discovery.ErrNotABeacon) {
+				logger.Debugf("Dropping discovery beacon from %v: %v", from, err)
+			}
+			continue
+		}
+
+		if beacon.NodeID == localNodeID || (beacon.Team != m.TeamID() && !m.IsPromiscuous()) {
+			continue
+		}
+
+		m.recordBeacon(conn, beacon)
+	}
+}
+
+// recordBeacon records the node of the beacon, a new node is published and connected to if the auto-connect policy allows it.
+// Beacons that arrive after the discovery was stopped or restarted (conn isn't the current one) are ignored.
+func (m *Manager) recordBeacon(conn *discovery.Conn, beacon discovery.Beacon) {
+	m.discovery.mu.Lock()
+	if m.discovery.conn != conn {
+		m.discovery.mu.Unlock()
+		return
+	}
+	previous, known := m.discovery.peers[beacon.NodeID]
+	m.discovery.peers[beacon.NodeID] = DiscoveredPeer{NodeID: beacon.NodeID, AddrPort: beacon.AddrPort, LastSeen: time.Now()}
+	autoConnect := m.discovery.autoConnect
+	m.discovery.mu.Unlock()
+
+	if known && previous.AddrPort == beacon.AddrPort {
+		return
+	}
+
+	logger.Infof("Discovered %v at %v", beacon.NodeID, beacon.AddrPort)
+	events.PeerDiscovered.NotifyObservers(events.PeerDiscoveredEvent{NodeID: beacon.NodeID, AddrPort: beacon.AddrPort})
+
+	if autoConnect == nil || !autoConnect(beacon.NodeID) || m.GetPeerState(beacon.NodeID) != PeerDown {
+		return
+	}
+	if isNeighbor, _ := m.router.IsNeighbor(beacon.NodeID); isNeighbor {
+		return
+	}
+
+	if _, err := m.ConnectTo(beacon.NodeID, beacon.AddrPort, m.BuildConnectPayload()); err != nil {
+		logger.Debugf("Failed to connect to discovered %v: %v", beacon.NodeID, err)
+	}
+}
+
+// RestartDiscovery restarts a running discovery with the same auto-connect policy, e.g. after our socket moved to another address.
+// Does nothing if the discovery isn't running.
+func (m *Manager) RestartDiscovery(localAddr netip.AddrPort) error {
+	m.discovery.mu.Lock()
+	running, autoConnect := m.discovery.conn != nil, m.discovery.autoConnect
+	m.discovery.mu.Unlock()
+
+	if !running {
+		return nil
+	}
+	return m.StartDiscovery(localAddr, autoConnect)
+}
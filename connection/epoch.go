@@ -0,0 +1,64 @@
+package connection
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// CONNECT and LSA payloads start with the boot epoch of the sending peer.
+// Packet numbers start at 0 after a restart, the epoch lets receivers tell a restart (newer epoch) from a replay (older epoch).
+//
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|                         Boot Epoch (64 bits)                          |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|                     Rest of the payload ...                           |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+const BOOT_EPOCH_SIZE = 8
+
+// BootEpoch returns the boot epoch of this node.
+func (m *Manager) BootEpoch() uint64 {
+	return m.bootEpoch
+}
+
+// appendBootEpoch appends the local boot epoch to the payload.
+func (m *Manager) appendBootEpoch(payload pkt.Payload) pkt.Payload {
+	return binary.BigEndian.AppendUint64(payload, m.bootEpoch)
+}
+
+// BuildConnectPayload returns the payload of a CONNECT packet.
+// It contains the boot epoch and the external address if NAT traversal mapped one.
+func (m *Manager) BuildConnectPayload() pkt.Payload {
+	payload := m.appendBootEpoch(make(pkt.Payload, 0, BOOT_EPOCH_SIZE+externalAddrSize))
+	return m.appendExternalAddress(payload)
+}
+
+// BuildConnectPayloadWithExternal acts like BuildConnectPayload but advertises the given external address,
+// e.g. the address an introducer observed for us.
+func (m *Manager) BuildConnectPayloadWithExternal(external netip.AddrPort) pkt.Payload {
+	payload := m.appendBootEpoch(make(pkt.Payload, 0, BOOT_EPOCH_SIZE+externalAddrSize))
+	return appendAddrPort(payload, external)
+}
+
+// SplitBootEpoch returns the boot epoch at the start of a CONNECT or LSA payload and the rest of the payload.
+func SplitBootEpoch(payload pkt.Payload) (epoch uint64, rest pkt.Payload, err error) {
+	if len(payload) < BOOT_EPOCH_SIZE {
+		return 0, nil, errors.New("payload is too short to contain a boot epoch")
+	}
+	return binary.BigEndian.Uint64(payload[:BOOT_EPOCH_SIZE]), payload[BOOT_EPOCH_SIZE:], nil
+}
+
+// ResetRestartedPeer clears the state of a neighbor that restarted (see sequencing.EpochRestart).
+// The peer lost its sequencing state, so our packet numbers to it restart at 0 as well and open ACKs and unfinished transfers are dropped.
+// The incoming packet numbers are already cleared by IncomingPktNumHandler.CheckBootEpoch.
+func (m *Manager) ResetRestartedPeer(addr netip.Addr) {
+	logger.Infof("Peer %s restarted, resetting its sequencing state", addr)
+	m.outgoingSequencing.ClearPacketNumbers(addr)
+	m.outgoingSequencing.ClearBlockers(addr)
+	m.reconstructors.ClearPeer(addr)
+	m.clearPiggybackState(addr)
+	m.clearCongestionMark(addr)
+}
@@ -0,0 +1,33 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"bjoernblessin.de/chatprotogol/sequencing"
+)
+
+// Errors of the send path. They are wrapped with details, callers branch on them with errors.Is instead of matching the message.
+var (
+	// ErrNoRoute is returned if the routing table has no next hop to the destination, e.g. because the peer disconnected.
+	ErrNoRoute = errors.New("no route to the destination")
+
+	// ErrWindowFull is returned if ctx was cancelled while the packet waited for the congestion window, it also matches the error of ctx.
+	// It is the same error as sequencing.ErrWindowFull.
+	ErrWindowFull = sequencing.ErrWindowFull
+
+	// ErrPeerUnknown is returned if an operation requires a neighbor and the peer isn't one.
+	ErrPeerUnknown = errors.New("peer is not a neighbor")
+
+	// ErrSocketClosed is returned if a datagram couldn't be written because the socket is closed.
+	ErrSocketClosed = errors.New("socket is closed")
+)
+
+// wrapSocketError classifies an error of writing to the socket, see ErrSocketClosed.
+func wrapSocketError(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("%w: %w", ErrSocketClosed, err)
+	}
+	return fmt.Errorf("failed to send packet to peer: %w", err)
+}
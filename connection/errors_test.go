@@ -0,0 +1,58 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// TestSendPathErrorKinds verifies that the send path errors can be told apart with errors.Is.
+func TestSendPathErrorKinds(t *testing.T) {
+	socket := sock.NewMemoryNetwork().NewSocket()
+	if _, err := socket.Open(net.IPv4(10, 0, 0, 1)); err != nil {
+		t.Fatalf("Failed to open socket: %v", err)
+	}
+
+	m := NewManager(socket, routing.NewRouter(socket), sequencing.NewIncomingPktNumHandler(socket), sequencing.NewOutgoingPktNumHandler(1, false), reconstruction.NewManager())
+	peer := netip.MustParseAddr("10.0.0.2")
+	peerAddrPort := netip.AddrPortFrom(peer, sock.PREFERRED_PORT)
+
+	_, err := m.SendReliableRoutedPacket(context.Background(), m.buildPacket(pkt.MsgTypeChatMessage, nil, peer, [4]byte{}))
+	if !errors.Is(err, ErrNoRoute) {
+		t.Errorf("Sending to an unreachable peer returned %v, want ErrNoRoute", err)
+	}
+
+	_, err = m.DisconnectNeighbor(peer)
+	if !errors.Is(err, ErrPeerUnknown) {
+		t.Errorf("Disconnecting from a non-neighbor returned %v, want ErrPeerUnknown", err)
+	}
+
+	if _, err := m.SendReliablePacketTo(context.Background(), peerAddrPort, m.BuildSequencedPacket(pkt.MsgTypeConnect, nil, peer)); err != nil {
+		t.Fatalf("Failed to send the first packet: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = m.SendReliablePacketTo(ctx, peerAddrPort, m.BuildSequencedPacket(pkt.MsgTypeConnect, nil, peer))
+	if !errors.Is(err, ErrWindowFull) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Sending beyond the congestion window returned %v, want ErrWindowFull and context.DeadlineExceeded", err)
+	}
+
+	packet := m.buildPacket(pkt.MsgTypeAcknowledgment, nil, peer, [4]byte{})
+	msg := m.buildPacket(pkt.MsgTypeChatMessage, nil, peer, [4]byte{})
+	socket.Close()
+	if err := m.sendPacketTo(peerAddrPort, packet); !errors.Is(err, ErrSocketClosed) {
+		t.Errorf("Sending on a closed socket returned %v, want ErrSocketClosed", err)
+	}
+	if err := m.sendPacketTo(peerAddrPort, msg); !errors.Is(err, ErrSocketClosed) {
+		t.Errorf("Sending a MSG on a closed socket returned %v, want ErrSocketClosed", err)
+	}
+}
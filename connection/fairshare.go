@@ -0,0 +1,131 @@
+package connection
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+)
+
+// Each destination has its own congestion window, but destinations behind the same next hop share the first link.
+// Without coordination, their windows add up and overload that link, and a destination that started earlier keeps a larger window.
+// So the data packets in flight to the active destinations of a next hop share an aggregate budget: the largest congestion window among them, the best estimate of what the link carries.
+// The budget is split proportionally to the congestion windows of the destinations, a destination whose share is used up waits like for a full congestion window.
+// fairShareState holds the destinations that recently sent data packets per next hop.
+type fairShareState struct {
+	mu    sync.Mutex
+	flows map[netip.AddrPort]map[netip.Addr]time.Time // Next hop -> destination -> time of its last data packet
+}
+
+// FairShare is the part of the budget of a next hop a destination may have in flight.
+type FairShare struct {
+	NextHop      netip.AddrPort
+	Destinations int   // Active destinations sharing the next hop, including this one
+	Budget       int64 // Packets in flight allowed for all destinations of the next hop
+	Share        int64 // Packets in flight allowed for this destination
+	InFlight     int   // Packets in flight to this destination
+}
+
+// fairShare returns the share of a destination with congestion window cwnd of the budget of a next hop, whose active destinations have the congestion windows windows.
+// windows includes cwnd. Every destination may have at least one packet in flight.
+func fairShare(cwnd int64, windows []int64) (share int64, budget int64) {
+	var sum int64
+	for _, window := range windows {
+		budget = max(budget, window)
+		sum += window
+	}
+	if sum == 0 {
+		return 1, budget
+	}
+	return max(budget*cwnd/sum, 1), budget
+}
+
+// activeDestinations marks the destination as active on the next hop and returns the active destinations of the next hop.
+// Destinations that didn't send a data packet within common.FAIR_SHARE_IDLE_TIMEOUT are removed.
+func (m *Manager) activeDestinations(nextHop netip.AddrPort, dest netip.Addr) []netip.Addr {
+	now := time.Now()
+
+	m.fairShare.mu.Lock()
+	defer m.fairShare.mu.Unlock()
+
+	flows, exists := m.fairShare.flows[nextHop]
+	if !exists {
+		flows = make(map[netip.Addr]time.Time)
+		m.fairShare.flows[nextHop] = flows
+	}
+	flows[dest] = now
+
+	active := make([]netip.Addr, 0, len(flows))
+	for addr, lastSent := range flows {
+		if now.Sub(lastSent) > common.FAIR_SHARE_IDLE_TIMEOUT {
+			delete(flows, addr)
+			continue
+		}
+		active = append(active, addr)
+	}
+	return active
+}
+
+// computeFairShare returns the fair share of the destination of the budget of the next hop.
+// Returns false if the destination doesn't share the next hop or the congestion window is ignored.
+func (m *Manager) computeFairShare(nextHop netip.AddrPort, dest netip.Addr, active []netip.Addr) (FairShare, bool) {
+	if len(active) < 2 {
+		return FairShare{}, false
+	}
+
+	windows := make([]int64, 0, len(active))
+	var cwnd int64
+	var inFlight int
+	for _, addr := range active {
+		window, openAcks := m.outgoingSequencing.GetWindowUsage(addr)
+		if window < 0 {
+			return FairShare{}, false
+		}
+		windows = append(windows, window)
+		if addr == dest {
+			cwnd, inFlight = window, openAcks
+		}
+	}
+
+	share, budget := fairShare(cwnd, windows)
+	return FairShare{
+		NextHop:      nextHop,
+		Destinations: len(active),
+		Budget:       budget,
+		Share:        share,
+		InFlight:     inFlight,
+	}, true
+}
+
+// exceedsFairShare marks the destination as active on the next hop and returns whether its packets in flight used up its fair share.
+func (m *Manager) exceedsFairShare(nextHop netip.AddrPort, dest netip.Addr) bool {
+	share, shared := m.computeFairShare(nextHop, dest, m.activeDestinations(nextHop, dest))
+	return shared && int64(share.InFlight) >= share.Share
+}
+
+// GetFairShare returns the fair share of the destination of the budget of its next hop.
+// Returns false if the destination is unreachable or no other destination recently sent data packets through its next hop.
+func (m *Manager) GetFairShare(dest netip.Addr) (FairShare, bool) {
+	nextHop, found := m.router.GetNextHop(dest)
+	if !found {
+		return FairShare{}, false
+	}
+
+	now := time.Now()
+	m.fairShare.mu.Lock()
+	active := make([]netip.Addr, 0)
+	isActive := false
+	for addr, lastSent := range m.fairShare.flows[nextHop] {
+		if now.Sub(lastSent) <= common.FAIR_SHARE_IDLE_TIMEOUT {
+			active = append(active, addr)
+			isActive = isActive || addr == dest
+		}
+	}
+	m.fairShare.mu.Unlock()
+
+	if !isActive {
+		return FairShare{}, false
+	}
+	return m.computeFairShare(nextHop, dest, active)
+}
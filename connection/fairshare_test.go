@@ -0,0 +1,73 @@
+package connection
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+func TestFairShareIsProportionalToCwnd(t *testing.T) {
+	tests := []struct {
+		cwnd      int64
+		windows   []int64
+		wantShare int64
+	}{
+		{cwnd: 8, windows: []int64{8}, wantShare: 8},
+		{cwnd: 8, windows: []int64{8, 8}, wantShare: 4},
+		{cwnd: 12, windows: []int64{12, 4}, wantShare: 9},
+		{cwnd: 4, windows: []int64{12, 4}, wantShare: 3},
+		{cwnd: 1, windows: []int64{100, 1}, wantShare: 1},
+	}
+
+	for _, test := range tests {
+		share, _ := fairShare(test.cwnd, test.windows)
+		if share != test.wantShare {
+			t.Errorf("fairShare(%d, %v) = %d, want %d", test.cwnd, test.windows, share, test.wantShare)
+		}
+	}
+}
+
+// TestDestinationsShareNextHopBudget verifies that a destination waits once its packets in flight use up its share of the next hop, while another destination can still send.
+func TestDestinationsShareNextHopBudget(t *testing.T) {
+	socket := sock.NewMemoryNetwork().NewSocket()
+	if _, err := socket.Open(net.IPv4(10, 0, 0, 1)); err != nil {
+		t.Fatalf("Failed to open socket: %v", err)
+	}
+
+	out := sequencing.NewOutgoingPktNumHandler(4, false)
+	m := NewManager(socket, routing.NewRouter(socket), sequencing.NewIncomingPktNumHandler(socket), out, reconstruction.NewManager())
+
+	nextHop := netip.MustParseAddrPort("10.0.0.2:20000")
+	busy := netip.MustParseAddr("10.0.0.3")
+	idle := netip.MustParseAddr("10.0.0.4")
+
+	if m.exceedsFairShare(nextHop, busy) {
+		t.Fatalf("A single destination shouldn't be limited by the fair share")
+	}
+
+	for range 2 {
+		packet := m.buildPacket(pkt.MsgTypeFileTransfer, nil, busy, out.GetNextpacketNumber(busy))
+		if _, err := out.AddOpenAck(context.Background(), packet, func() {}); err != nil {
+			t.Fatalf("Failed to add open acknowledgment: %v", err)
+		}
+	}
+
+	if m.exceedsFairShare(nextHop, idle) {
+		t.Errorf("Destination without packets in flight exceeds its fair share")
+	}
+	if !m.exceedsFairShare(nextHop, busy) {
+		t.Errorf("Destination with 2 packets in flight doesn't exceed its share of 2")
+	}
+
+	otherHop := netip.MustParseAddrPort("10.0.0.5:20000")
+	if m.exceedsFairShare(otherHop, busy) {
+		t.Errorf("Destinations of another next hop limit the fair share")
+	}
+}
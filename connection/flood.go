@@ -0,0 +1,198 @@
+package connection
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// lsaFloodKey identifies an LSA instance sent to a neighbor.
+type lsaFloodKey struct {
+	owner    netip.Addr
+	seqNum   uint32
+	neighbor netip.Addr
+}
+
+// lsaFloodingState holds the state that prevents flood storms in dense topologies.
+type lsaFloodingState struct {
+	mu               sync.Mutex
+	sent             map[lsaFloodKey]time.Time // LSA instances sent per neighbor within common.LSA_FLOOD_SUPPRESSION_WINDOW
+	originTokens     float64                   // Token bucket limiting the origination of our own LSAs
+	originRefilledAt time.Time
+	originPending    bool // A flood of our own LSA is scheduled because the token bucket was empty
+}
+
+// FloodLSA sends a Link State Advertisement (LSA) to all neighbors.
+// Optionally, it can exclude certain addresses (neighbors) from receiving the LSA.
+// Our own LSAs are sent immediately unless more than common.LSA_ORIGINATION_BURST were sent recently,
+// then the latest local LSA is sent once the origination rate allows it.
+// LSAs of other hosts are re-flooded after a random delay of up to common.LSA_FLOOD_JITTER, so neighbors don't flood in lockstep.
+// They aren't sent if a newer LSA of the owner arrived in the meantime.
+// An LSA instance is sent to a neighbor at most once within common.LSA_FLOOD_SUPPRESSION_WINDOW.
+// LSAs the routing policy refuses to flood aren't sent, see routing.Router.SetPolicy.
+func (m *Manager) FloodLSA(lsaOwner netip.Addr, lsa routing.LSAEntry, exceptAddrs ...netip.Addr) {
+	if !m.router.ShouldFloodLSA(lsaOwner, lsa) {
+		logger.Tracef("Not flooding LSA of %v with seqnum %d, refused by the routing policy", lsaOwner, lsa.SeqNum)
+		return
+	}
+
+	if lsaOwner == m.socket.MustGetLocalAddress().Addr() {
+		m.originateLSA(lsaOwner, exceptAddrs)
+		return
+	}
+
+	payload := m.buildLSAPayload(lsaOwner, lsa) // The router may reuse the neighbors slice of the LSA until the flood
+	seqNum := lsa.SeqNum
+
+	jitter := rand.N(common.LSA_FLOOD_JITTER + 1)
+	time.AfterFunc(jitter, func() {
+		if current, exists := m.router.GetLSA(lsaOwner); exists && current.SeqNum > seqNum {
+			logger.Tracef("Not flooding LSA of %v with seqnum %d, it was superseded by seqnum %d", lsaOwner, seqNum, current.SeqNum)
+			return
+		}
+		m.floodLSAPayload(lsaOwner, seqNum, payload, exceptAddrs)
+	})
+}
+
+// originateLSA floods the latest local LSA if the origination rate allows it, otherwise it schedules the flood.
+func (m *Manager) originateLSA(localAddr netip.Addr, exceptAddrs []netip.Addr) {
+	m.lsaFlooding.mu.Lock()
+
+	if m.lsaFlooding.originPending {
+		m.lsaFlooding.mu.Unlock()
+		return // The scheduled flood sends the latest local LSA
+	}
+
+	wait := m.takeOriginToken()
+	if wait > 0 {
+		m.lsaFlooding.originPending = true
+		m.lsaFlooding.mu.Unlock()
+
+		logger.Debugf("LSA origination rate exceeded, flooding the local LSA in %v", wait)
+		time.AfterFunc(wait, func() {
+			m.lsaFlooding.mu.Lock()
+			m.lsaFlooding.originPending = false
+			m.lsaFlooding.mu.Unlock()
+
+			m.originateLSA(localAddr, nil) // All neighbors may have missed a change by now
+		})
+		return
+	}
+
+	m.lsaFlooding.mu.Unlock()
+
+	lsa, exists := m.router.GetLSA(localAddr)
+	if !exists {
+		return
+	}
+	m.floodLSAPayload(localAddr, lsa.SeqNum, m.buildLSAPayload(localAddr, lsa), exceptAddrs)
+}
+
+// takeOriginToken takes a token of the origination token bucket.
+// Returns the time until a token is available if the bucket is empty, no token is taken then.
+// Must be called with lsaFlooding.mu held.
+func (m *Manager) takeOriginToken() time.Duration {
+	now := time.Now()
+	if !m.lsaFlooding.originRefilledAt.IsZero() {
+		elapsed := now.Sub(m.lsaFlooding.originRefilledAt).Seconds()
+		m.lsaFlooding.originTokens = min(m.lsaFlooding.originTokens+elapsed*common.LSA_ORIGINATION_RATE, common.LSA_ORIGINATION_BURST)
+	}
+	m.lsaFlooding.originRefilledAt = now
+
+	if m.lsaFlooding.originTokens < 1 {
+		return time.Duration((1 - m.lsaFlooding.originTokens) / common.LSA_ORIGINATION_RATE * float64(time.Second))
+	}
+
+	m.lsaFlooding.originTokens--
+	return 0
+}
+
+// floodLSAPayload sends the LSA payload to all neighbors except exceptAddrs that didn't receive the LSA recently.
+func (m *Manager) floodLSAPayload(lsaOwner netip.Addr, seqNum uint32, payload pkt.Payload, exceptAddrs []netip.Addr) {
+	for destAddr, destAddrPort := range m.router.GetNeighbors() {
+		if slices.Contains(exceptAddrs, destAddr) {
+			continue
+		}
+
+		if !m.reserveLSAFlood(lsaFloodKey{owner: lsaOwner, seqNum: seqNum, neighbor: destAddr}) {
+			logger.Tracef("Not flooding LSA of %v with seqnum %d to %v, it was sent recently", lsaOwner, seqNum, destAddr)
+			continue
+		}
+
+		err := m.sendLSAPayload(destAddr, destAddrPort, payload)
+		if err != nil {
+			logger.Warnf("Failed to send LSA for %s: %v", destAddr, err)
+		}
+	}
+}
+
+// SendLSA sends the LSA to a single neighbor, e.g. an LSA the neighbor is missing according to its database description.
+// The LSA is sent even if the neighbor received it recently.
+func (m *Manager) SendLSA(destAddr netip.Addr, destAddrPort netip.AddrPort, lsaOwner netip.Addr, lsa routing.LSAEntry) error {
+	m.reserveLSAFlood(lsaFloodKey{owner: lsaOwner, seqNum: lsa.SeqNum, neighbor: destAddr})
+	return m.sendLSAPayload(destAddr, destAddrPort, m.buildLSAPayload(lsaOwner, lsa))
+}
+
+func (m *Manager) sendLSAPayload(destAddr netip.Addr, destAddrPort netip.AddrPort, payload pkt.Payload) error {
+	packet := m.BuildSequencedPacket(pkt.MsgTypeLSA, payload, destAddr)
+	_, err := m.SendReliablePacketTo(context.Background(), destAddrPort, packet)
+	return err
+}
+
+// reserveLSAFlood records that the LSA instance is sent to the neighbor.
+// Returns false if it was already sent within common.LSA_FLOOD_SUPPRESSION_WINDOW.
+func (m *Manager) reserveLSAFlood(key lsaFloodKey) bool {
+	m.lsaFlooding.mu.Lock()
+	defer m.lsaFlooding.mu.Unlock()
+
+	now := time.Now()
+	for sentKey, sentAt := range m.lsaFlooding.sent {
+		if now.Sub(sentAt) >= common.LSA_FLOOD_SUPPRESSION_WINDOW {
+			delete(m.lsaFlooding.sent, sentKey)
+		}
+	}
+
+	if _, sent := m.lsaFlooding.sent[key]; sent {
+		return false
+	}
+	m.lsaFlooding.sent[key] = now
+	return true
+}
+
+// buildLSAPayload returns the payload of an LSA packet.
+// Our own LSAs are signed, LSAs of other hosts carry the signature they were received with, if any.
+func (m *Manager) buildLSAPayload(lsaOwner netip.Addr, lsa routing.LSAEntry) pkt.Payload {
+	body := make([]byte, 0, 8+(len(lsa.Neighbors)+1)*4)
+
+	lsaOwnerBytes := lsaOwner.As4()
+	body = append(body, lsaOwnerBytes[:]...)
+	body = binary.BigEndian.AppendUint32(body, lsa.SeqNum)
+
+	for _, neighborAddr := range lsa.Neighbors {
+		addrBytes := neighborAddr.As4()
+		body = append(body, addrBytes[:]...)
+	}
+
+	if lsa.Stub {
+		markerBytes := routing.StubMarker.As4()
+		body = append(body, markerBytes[:]...)
+	}
+
+	signature := lsa.Signature
+	if lsaOwner == m.socket.MustGetLocalAddress().Addr() {
+		signature = m.signLSA(body)
+	}
+
+	payload := make(pkt.Payload, 0, BOOT_EPOCH_SIZE+len(body)+lsaSignatureSize)
+	payload = m.appendBootEpoch(payload)
+	return appendLSASignature(payload, body, signature, lsa.Stub)
+}
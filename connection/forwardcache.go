@@ -0,0 +1,164 @@
+package connection
+
+import (
+	"hash/crc32"
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// Retransmissions of the source (and copies of hop-by-hop retransmissions) would otherwise traverse the whole path again,
+// although a later hop may already have delivered the packet.
+// Forwarding nodes remember the MSG/FILE/FIN packets they recently forwarded per destination and the destination's ACK once it passes back.
+// A copy of a delivered packet is dropped and the remembered ACK is sent towards the source instead, because the source retransmits if its ACK got lost.
+// A copy of a packet that isn't acknowledged yet is dropped if it arrives within FORWARD_DUPLICATE_WINDOW of the forwarded packet,
+// later copies are forwarded as the packet may have been lost after this node.
+// Copies are recognized by source, packet number and a hash of the payload, so a source that restarted and reuses packet numbers isn't mistaken for a copy.
+// forwardCacheState holds the recently forwarded packets.
+type forwardCacheState struct {
+	mu           sync.Mutex
+	destinations map[netip.Addr]*destinationCache
+}
+
+// destinationCache holds the recently forwarded packets to a destination.
+type destinationCache struct {
+	entries map[forwardedPacketKey]*forwardedPacket
+	order   []forwardedPacketKey // Insertion order, the oldest entries are evicted first
+}
+
+// forwardedPacketKey identifies a forwarded packet of a destination.
+type forwardedPacketKey struct {
+	source netip.Addr
+	pktNum [4]byte
+}
+
+type forwardedPacket struct {
+	forwarded   time.Time
+	payloadHash uint32
+	ack         *pkt.Packet // ACK of the destination as we forwarded it, nil until it passes
+}
+
+// isCachedMsgType returns whether forwarded packets of the message type are remembered.
+// These are the sequenced packets that carry the bulk of the transit traffic.
+func isCachedMsgType(msgType byte) bool {
+	return isDataMsgType(msgType) || msgType == pkt.MsgTypeFinish
+}
+
+// admitForwarded returns whether the packet should be forwarded or is a redundant copy.
+// Admitted packets are remembered. For a redundant copy of a delivered packet, the remembered ACK is returned.
+func (m *Manager) admitForwarded(packet *pkt.Packet) (admit bool, ack *pkt.Packet) {
+	if !isCachedMsgType(packet.GetMessageType()) {
+		return true, nil
+	}
+	if _, unreliable := ParseUnreliableExtension(packet); unreliable {
+		return true, nil // Unreliable messages all have packet number zero and are never retransmitted
+	}
+
+	dest := netip.AddrFrom4(packet.Header.DestAddr)
+	key := forwardedPacketKey{source: netip.AddrFrom4(packet.Header.SourceAddr), pktNum: packet.Header.PktNum}
+	payloadHash := crc32.ChecksumIEEE(packet.Payload)
+	now := time.Now()
+
+	m.forwardCache.mu.Lock()
+	defer m.forwardCache.mu.Unlock()
+
+	cache, exists := m.forwardCache.destinations[dest]
+	if !exists {
+		cache = &destinationCache{entries: make(map[forwardedPacketKey]*forwardedPacket)}
+		m.forwardCache.destinations[dest] = cache
+	}
+	cache.evictExpired(now)
+
+	entry, seen := cache.entries[key]
+	if seen && entry.payloadHash != payloadHash {
+		*entry = forwardedPacket{forwarded: now, payloadHash: payloadHash} // Another packet with the same number, e.g. after a restart of the source
+		return true, nil
+	}
+	if seen && entry.ack != nil {
+		return false, entry.ack
+	}
+	if seen && now.Sub(entry.forwarded) < common.FORWARD_DUPLICATE_WINDOW {
+		return false, nil
+	}
+
+	if seen {
+		entry.forwarded = now
+		return true, nil
+	}
+
+	if len(cache.order) >= common.FORWARD_CACHE_SIZE {
+		delete(cache.entries, cache.order[0])
+		cache.order = cache.order[1:]
+	}
+	cache.entries[key] = &forwardedPacket{forwarded: now, payloadHash: payloadHash}
+	cache.order = append(cache.order, key)
+
+	return true, nil
+}
+
+// evictExpired removes the entries that were forwarded longer than FORWARD_CACHE_TTL ago.
+func (c *destinationCache) evictExpired(now time.Time) {
+	for len(c.order) > 0 {
+		entry, exists := c.entries[c.order[0]]
+		if exists && now.Sub(entry.forwarded) < common.FORWARD_CACHE_TTL {
+			return
+		}
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// rememberForwardedAck remembers a forwarded ACK for the packet it acknowledges, if that packet was forwarded by us.
+func (m *Manager) rememberForwardedAck(ack *pkt.Packet) {
+	if ack.GetMessageType() != pkt.MsgTypeAcknowledgment {
+		return
+	}
+
+	// The ACK travels from the destination of the acknowledged packet to its source
+	dest := netip.AddrFrom4(ack.Header.SourceAddr)
+	key := forwardedPacketKey{source: netip.AddrFrom4(ack.Header.DestAddr), pktNum: ack.Header.PktNum}
+
+	m.forwardCache.mu.Lock()
+	defer m.forwardCache.mu.Unlock()
+
+	cache, exists := m.forwardCache.destinations[dest]
+	if !exists {
+		return
+	}
+	entry, seen := cache.entries[key]
+	if !seen {
+		return
+	}
+
+	ackCopy := *ack
+	ackCopy.Extensions = nil // Piggybacked ACKs, hop-by-hop markers and MACs only belong to the forwarded copy
+	pkt.SetChecksum(&ackCopy)
+	entry.ack = &ackCopy
+}
+
+// resendForwardedAck sends a copy of a remembered ACK towards the source of a redundant packet.
+func (m *Manager) resendForwardedAck(ack *pkt.Packet) {
+	source := netip.AddrFrom4(ack.Header.DestAddr)
+
+	nextHop, found := m.router.GetNextHop(source)
+	if !found {
+		return
+	}
+
+	err := m.sendPacketTo(nextHop, ack) // The remembered ACK isn't modified, so it can be sent concurrently
+	if err != nil {
+		logger.Debugf("Failed to resend the ACK %d of %v to %v: %v", ack.Header.PktNum, ack.Header.SourceAddr, source, err)
+	}
+}
+
+// clearForwardCache forgets the forwarded packets to the host.
+func (m *Manager) clearForwardCache(addr netip.Addr) {
+	m.forwardCache.mu.Lock()
+	defer m.forwardCache.mu.Unlock()
+
+	delete(m.forwardCache.destinations, addr)
+}
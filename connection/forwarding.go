@@ -0,0 +1,87 @@
+package connection
+
+import (
+	"maps"
+	"net/netip"
+	"sync"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// forwardingStatsState accounts the packets we forward for other hosts (transit traffic).
+type forwardingStatsState struct {
+	mu       sync.Mutex
+	flows    map[ForwardingFlow]TrafficCounter
+	ingress  map[netip.AddrPort]TrafficCounter // Per neighbor the packets were received from
+	nextHops map[netip.AddrPort]TrafficCounter // Per neighbor the packets were forwarded to
+
+	congestionMarked uint64 // Forwarded data packets marked as congestion experienced, see congestionMarkState
+}
+
+// TrafficCounter counts packets and their bytes on the wire (without MAC).
+type TrafficCounter struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// ForwardingFlow identifies forwarded packets by the neighbor they were received from and their destination.
+type ForwardingFlow struct {
+	Ingress netip.AddrPort
+	Dest    netip.Addr
+}
+
+// ForwardingStats is a snapshot of the forwarded packets since the start or the last ResetForwardingStats.
+// Neighbors are identified by the address and port packets are received from and sent to, like in the neighbor table.
+// Comparing Ingress and NextHops of a neighbor shows whether transit traffic is routed asymmetrically through us.
+type ForwardingStats struct {
+	Flows    map[ForwardingFlow]TrafficCounter
+	Ingress  map[netip.AddrPort]TrafficCounter
+	NextHops map[netip.AddrPort]TrafficCounter
+
+	CongestionMarked uint64 // Forwarded data packets marked as congestion experienced
+}
+
+// recordForwarded accounts a packet received from ingress that was forwarded to nextHop.
+func (m *Manager) recordForwarded(ingress netip.AddrPort, nextHop netip.AddrPort, packet *pkt.Packet) {
+	ingress = unmapAddrPort(ingress)
+	nextHop = unmapAddrPort(nextHop)
+	size := uint64(packet.Size())
+	flow := ForwardingFlow{Ingress: ingress, Dest: netip.AddrFrom4(packet.Header.DestAddr)}
+
+	m.forwarding.mu.Lock()
+	defer m.forwarding.mu.Unlock()
+
+	m.forwarding.flows[flow] = m.forwarding.flows[flow].add(size)
+	m.forwarding.ingress[ingress] = m.forwarding.ingress[ingress].add(size)
+	m.forwarding.nextHops[nextHop] = m.forwarding.nextHops[nextHop].add(size)
+}
+
+// add returns the counter with one more packet of size bytes.
+func (c TrafficCounter) add(size uint64) TrafficCounter {
+	return TrafficCounter{Packets: c.Packets + 1, Bytes: c.Bytes + size}
+}
+
+// ForwardingStats returns a snapshot of the forwarded packets.
+func (m *Manager) ForwardingStats() ForwardingStats {
+	m.forwarding.mu.Lock()
+	defer m.forwarding.mu.Unlock()
+
+	return ForwardingStats{
+		Flows:    maps.Clone(m.forwarding.flows),
+		Ingress:  maps.Clone(m.forwarding.ingress),
+		NextHops: maps.Clone(m.forwarding.nextHops),
+
+		CongestionMarked: m.forwarding.congestionMarked,
+	}
+}
+
+// ResetForwardingStats clears the accounted forwarded packets.
+func (m *Manager) ResetForwardingStats() {
+	m.forwarding.mu.Lock()
+	defer m.forwarding.mu.Unlock()
+
+	clear(m.forwarding.flows)
+	clear(m.forwarding.ingress)
+	clear(m.forwarding.nextHops)
+	m.forwarding.congestionMarked = 0
+}
@@ -0,0 +1,206 @@
+package connection
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// Normally only the source retransmits a packet, so a lossy link in the middle of a path delays the packet by the source's full RTO.
+// With hop-by-hop ARQ, a forwarding node additionally retransmits forwarded packets until the next hop acknowledges them.
+// The forwarding node marks the packet with an ExtTypeHopSeq extension carrying a sequence number of the link,
+// the next hop replies with an ACK carrying an ExtTypeHopAck extension (hop ACK) and replaces the marker when it forwards the packet itself.
+// Hop ACKs are consumed by the node they are sent to, they never acknowledge a packet end-to-end.
+// A link uses hop-by-hop ARQ only if both neighbors enabled it, they announce it with an ExtTypeHopARQ extension on the CONNECT and its ACK.
+// A retransmission may duplicate the packet downstream, the destination drops duplicates like end-to-end retransmissions.
+// hopARQState holds the links using hop-by-hop ARQ and the forwarded packets waiting for a hop ACK.
+type hopARQState struct {
+	enabled  atomic.Bool
+	mu       sync.Mutex
+	capable  map[netip.AddrPort]bool   // Next hops of neighbors that announced hop-by-hop ARQ
+	nextSeq  map[netip.AddrPort]uint32 // Next hop sequence number per next hop
+	inFlight map[netip.AddrPort]int    // Number of pending packets per next hop
+	pending  map[hopKey]*time.Timer    // Retransmission timer per packet waiting for a hop ACK
+}
+
+// hopKey identifies a forwarded packet waiting for a hop ACK.
+type hopKey struct {
+	nextHop netip.AddrPort
+	seq     uint32
+}
+
+// SetHopByHopARQ enables or disables hop-by-hop retransmission of forwarded packets.
+// Must be called before connecting to neighbors, links are negotiated when connecting.
+func (m *Manager) SetHopByHopARQ(enabled bool) {
+	m.hopARQ.enabled.Store(enabled)
+}
+
+// IsHopByHopARQEnabled returns whether hop-by-hop retransmission is enabled.
+func (m *Manager) IsHopByHopARQEnabled() bool {
+	return m.hopARQ.enabled.Load()
+}
+
+// announceHopARQ adds the ExtTypeHopARQ extension to a CONNECT or its ACK if hop-by-hop ARQ is enabled.
+func (m *Manager) announceHopARQ(packet *pkt.Packet) {
+	if !m.IsHopByHopARQEnabled() {
+		return
+	}
+	packet.AddExtension(pkt.ExtTypeHopARQ, nil)
+	pkt.SetChecksum(packet)
+}
+
+// RecordHopARQAnnouncement records whether the neighbor at addrPort announced hop-by-hop ARQ.
+// Must be called with CONNECTs and ACKs from neighbors, an ACK without announcement doesn't revoke an announcement.
+func (m *Manager) RecordHopARQAnnouncement(packet *pkt.Packet, addrPort netip.AddrPort) {
+	announced := len(packet.GetExtensions(pkt.ExtTypeHopARQ)) > 0
+	if !announced && packet.GetMessageType() != pkt.MsgTypeConnect {
+		return
+	}
+	addrPort = unmapAddrPort(addrPort)
+
+	m.hopARQ.mu.Lock()
+	defer m.hopARQ.mu.Unlock()
+
+	if announced {
+		m.hopARQ.capable[addrPort] = true
+	} else {
+		delete(m.hopARQ.capable, addrPort)
+	}
+}
+
+// SendConnectAcknowledgment acknowledges the CONNECT of the peer addr at addrPort like SendAcknowledgmentTo.
+// The ACK announces hop-by-hop ARQ if it is enabled, our capabilities and the public key our LSAs are signed with.
+func (m *Manager) SendConnectAcknowledgment(addr netip.Addr, addrPort netip.AddrPort, pktNum [4]byte) error {
+	ackPacket := m.buildPacket(pkt.MsgTypeAcknowledgment, nil, addr, pktNum)
+	m.announceHopARQ(ackPacket)
+	m.announceCapabilities(ackPacket)
+	m.announcePublicKey(ackPacket)
+	m.attachTimestamps(ackPacket) // Answers the time sync request of the CONNECT
+
+	return m.sendPacketTo(addrPort, ackPacket)
+}
+
+// prepareHopARQ replaces the hop-by-hop marker of the previous link of a packet that is forwarded to nextHop.
+// If the link to nextHop uses hop-by-hop ARQ, the packet is marked and retransmitted until the hop ACK arrives.
+// The checksum is recalculated, the packet must not be modified afterwards because retransmissions use it concurrently.
+func (m *Manager) prepareHopARQ(nextHop netip.AddrPort, packet *pkt.Packet) {
+	packet.RemoveExtensions(pkt.ExtTypeHopSeq)
+	nextHop = unmapAddrPort(nextHop)
+
+	if !m.IsHopByHopARQEnabled() || IsRelayedAddrPort(nextHop) {
+		pkt.SetChecksum(packet)
+		return
+	}
+
+	m.hopARQ.mu.Lock()
+	defer m.hopARQ.mu.Unlock()
+
+	if !m.hopARQ.capable[nextHop] || m.hopARQ.inFlight[nextHop] >= common.HOP_ARQ_WINDOW {
+		pkt.SetChecksum(packet)
+		return
+	}
+
+	seq := m.hopARQ.nextSeq[nextHop]
+	m.hopARQ.nextSeq[nextHop] = seq + 1
+	m.hopARQ.inFlight[nextHop]++
+
+	packet.AddExtension(pkt.ExtTypeHopSeq, binary.BigEndian.AppendUint32(nil, seq))
+	pkt.SetChecksum(packet)
+
+	key := hopKey{nextHop: nextHop, seq: seq}
+	retries := 0
+	var retransmit func()
+	retransmit = func() {
+		defer panics.Recover("retransmitting forwarded packet %d to %s", seq, nextHop)
+
+		m.hopARQ.mu.Lock()
+		if _, waiting := m.hopARQ.pending[key]; !waiting {
+			m.hopARQ.mu.Unlock()
+			return
+		}
+		if retries >= common.HOP_ARQ_RETRIES {
+			m.removeHopPendingLocked(key)
+			m.hopARQ.mu.Unlock()
+			logger.Debugf("No hop ACK from %v for forwarded packet %d, leaving the retransmission to the source", nextHop, seq)
+			return
+		}
+		retries++
+		m.hopARQ.pending[key] = time.AfterFunc(common.HOP_ARQ_TIMEOUT, retransmit)
+		m.hopARQ.mu.Unlock()
+
+		logger.Debugf("Retransmitting forwarded %s %d to %v (hop seq %d)", msgTypeNames[packet.GetMessageType()], packet.Header.PktNum, nextHop, seq)
+		_ = m.sendPacketTo(nextHop, packet)
+	}
+	m.hopARQ.pending[key] = time.AfterFunc(common.HOP_ARQ_TIMEOUT, retransmit)
+}
+
+// removeHopPendingLocked stops waiting for the hop ACK of the packet.
+// The caller must hold m.hopARQ.mu.
+func (m *Manager) removeHopPendingLocked(key hopKey) {
+	timer, waiting := m.hopARQ.pending[key]
+	if !waiting {
+		return
+	}
+
+	timer.Stop()
+	delete(m.hopARQ.pending, key)
+	m.hopARQ.inFlight[key.nextHop]--
+	if m.hopARQ.inFlight[key.nextHop] == 0 {
+		delete(m.hopARQ.inFlight, key.nextHop)
+	}
+}
+
+// AcknowledgeHop sends a hop ACK to the neighbor at srcAddrPort if the packet carries an ExtTypeHopSeq extension.
+func (m *Manager) AcknowledgeHop(packet *pkt.Packet, srcAddrPort netip.AddrPort) {
+	seq, marked := packet.GetHopSequenceNumber(pkt.ExtTypeHopSeq)
+	if !marked {
+		return
+	}
+
+	neighborAddr := srcAddrPort.Addr()
+	for addr, addrPort := range m.router.GetNeighbors() {
+		if addrPort == srcAddrPort {
+			neighborAddr = addr
+			break
+		}
+	}
+
+	ackPacket := m.buildPacket(pkt.MsgTypeAcknowledgment, nil, neighborAddr, [4]byte{})
+	ackPacket.AddExtension(pkt.ExtTypeHopAck, binary.BigEndian.AppendUint32(nil, seq))
+	pkt.SetChecksum(ackPacket)
+
+	err := m.sendPacketTo(srcAddrPort, ackPacket)
+	if err != nil {
+		logger.Debugf("Failed to send hop ACK %d to %v: %v", seq, srcAddrPort, err)
+	}
+}
+
+// HandleHopAck stops the retransmission of the forwarded packet acknowledged by a hop ACK from srcAddrPort.
+// Returns false if the packet is no hop ACK.
+func (m *Manager) HandleHopAck(packet *pkt.Packet, srcAddrPort netip.AddrPort) bool {
+	seq, isHopAck := packet.GetHopSequenceNumber(pkt.ExtTypeHopAck)
+	if !isHopAck {
+		return false
+	}
+
+	logger.Tracef("HOP ACK RECEIVED %v %d", srcAddrPort, seq)
+
+	m.hopARQ.mu.Lock()
+	defer m.hopARQ.mu.Unlock()
+
+	m.removeHopPendingLocked(hopKey{nextHop: unmapAddrPort(srcAddrPort), seq: seq})
+	return true
+}
+
+// unmapAddrPort returns addrPort with an IPv4 address instead of an IPv4-mapped IPv6 address.
+// Addresses of received packets may be mapped while addresses entered by the user aren't, this makes them comparable.
+func unmapAddrPort(addrPort netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
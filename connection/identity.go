@@ -0,0 +1,92 @@
+package connection
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// A CONNECT whose source address differs from the IP address it was sent from (a node ID or an address behind a NAT) must prove that the sender owns the address,
+// otherwise any host could take over the neighbor entry, and with it the packets, of another host.
+// Every CONNECT is signed with the key the sender signs its LSAs with (see lsasign.go) in an ExtTypeConnectSignature extension.
+// The signature covers source and destination address, packet number and payload, the key is announced in the ExtTypePublicKey extension.
+// A node ID is proven if the CONNECT is signed with the pinned key of the address, or, if no key is pinned, if the node ID is derived
+// from the announced key (see NodeIDFromKey). An introducer that observed the peer at the sender's address vouches for it (see RecordIntroduction).
+// With packet authentication, the MAC proves that the sender is a member of the network.
+// Replayed CONNECTs don't help an attacker, they are dropped as duplicates or for their old boot epoch before any state changes.
+
+// ConnectIdentity is how a CONNECT proves the source address it claims, see ProveConnectIdentity.
+type ConnectIdentity int
+
+const (
+	IdentityUnproven      ConnectIdentity = iota
+	IdentityAuthenticated                 // The CONNECT carries a valid MAC of the pre-shared key
+	IdentityIntroduced                    // An introducer observed the peer at the sender's address
+	IdentitySigned                        // The CONNECT is signed with the pinned key of the address or a key the address is derived from
+)
+
+// NodeIDFromKey returns the node ID derived from a public key, the first 32 bits of its SHA-256 hash.
+// A node with a derived node ID can prove its identity to peers that haven't pinned a key for it yet.
+// The ID has only 32 bits, a pinned key therefore always takes precedence over the derivation.
+func NodeIDFromKey(key ed25519.PublicKey) netip.Addr {
+	hash := sha256.Sum256(key)
+	return netip.AddrFrom4([4]byte(hash[:4]))
+}
+
+// DerivedNodeID returns the node ID derived from our signing key, see NodeIDFromKey.
+// Must be called after LoadSigningKey, the node ID changes with the key.
+func (m *Manager) DerivedNodeID() netip.Addr {
+	return NodeIDFromKey(m.PublicKey())
+}
+
+// connectSignedData returns the part of a CONNECT its signature covers.
+func connectSignedData(packet *pkt.Packet) []byte {
+	data := make([]byte, 0, 12+len(packet.Payload))
+	data = append(data, packet.Header.SourceAddr[:]...)
+	data = append(data, packet.Header.DestAddr[:]...)
+	data = append(data, packet.Header.PktNum[:]...)
+	return append(data, packet.Payload...)
+}
+
+// signConnect adds the ExtTypeConnectSignature extension to a CONNECT, must be called after the payload and the packet number are set.
+func (m *Manager) signConnect(packet *pkt.Packet) {
+	packet.AddExtension(pkt.ExtTypeConnectSignature, ed25519.Sign(m.signingKey(), connectSignedData(packet)))
+	pkt.SetChecksum(packet)
+}
+
+// ProveConnectIdentity returns how the CONNECT received from sender proves that its sender owns the source address srcAddr.
+// Must only be called for CONNECTs whose source address differs from the IP address they were sent from.
+func (m *Manager) ProveConnectIdentity(packet *pkt.Packet, srcAddr netip.Addr, sender netip.AddrPort) ConnectIdentity {
+	if m.verifyConnectSignature(packet, srcAddr) {
+		return IdentitySigned
+	}
+	if m.IsIntroducedAt(srcAddr, sender) {
+		return IdentityIntroduced
+	}
+	if m.IsAuthenticationEnabled() {
+		return IdentityAuthenticated // The MAC was verified when the packet was received
+	}
+	return IdentityUnproven
+}
+
+// verifyConnectSignature returns whether the CONNECT is signed with the pinned key of srcAddr,
+// or with the announced key if no key is pinned and srcAddr is derived from it.
+func (m *Manager) verifyConnectSignature(packet *pkt.Packet, srcAddr netip.Addr) bool {
+	keys := packet.GetExtensions(pkt.ExtTypePublicKey)
+	signatures := packet.GetExtensions(pkt.ExtTypeConnectSignature)
+	if len(keys) != 1 || len(keys[0].Value) != ed25519.PublicKeySize || len(signatures) != 1 || len(signatures[0].Value) != ed25519.SignatureSize {
+		return false
+	}
+	key := ed25519.PublicKey(keys[0].Value)
+
+	if !ed25519.Verify(key, connectSignedData(packet), signatures[0].Value) {
+		return false
+	}
+
+	if pinned, known := m.GetPeerKey(srcAddr); known {
+		return key.Equal(pinned)
+	}
+	return NodeIDFromKey(key) == srcAddr
+}
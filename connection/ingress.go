@@ -0,0 +1,237 @@
+package connection
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// Every sender address has a packet and a byte budget per second for control and for data packets, so a misbehaving or malicious neighbor
+// flooding the node can't starve the handling of the others. Packets over budget are dropped before they are parsed.
+// ACKs count as data, their rate follows the rate we send data at. The budgets refill continuously and hold up to common.INGRESS_BURST of them.
+// A sender that exceeds a budget without a break of a second for common.INGRESS_AUTO_BLOCK_AFTER is abusive, it may be blocked automatically.
+
+// IngressClass is the budget an inbound packet is charged to.
+type IngressClass int
+
+const (
+	IngressControl IngressClass = iota
+	IngressData
+	ingressClasses
+)
+
+func (c IngressClass) String() string {
+	if c == IngressData {
+		return "data"
+	}
+	return "control"
+}
+
+// IngressVerdict is the result of AdmitIngress.
+type IngressVerdict int
+
+const (
+	IngressAdmitted IngressVerdict = iota // The packet is within the budget of its sender
+	IngressDropped                        // The packet exceeds the budget of its sender and must be dropped
+	IngressAbusive                        // The packet must be dropped and its sender is abusive, it should be blocked
+)
+
+// IngressDrops is the number of packets and bytes of a class dropped because they exceeded the budget of their sender.
+type IngressDrops struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// IngressSourceStats is the ingress state of a sender that exceeded its budget, see IngressStats.
+type IngressSourceStats struct {
+	Addr         netip.Addr
+	Drops        [ingressClasses]IngressDrops // Indexed by IngressClass
+	LastDrop     time.Time
+	LimitedSince time.Time // Start of the current period of drops without a break of a second, zero if the sender isn't limited anymore
+}
+
+// ingressBucket is a token bucket of packets and bytes.
+type ingressBucket struct {
+	packets float64
+	bytes   float64
+}
+
+type ingressSource struct {
+	buckets      [ingressClasses]ingressBucket
+	refilledAt   time.Time
+	drops        [ingressClasses]IngressDrops
+	lastDrop     time.Time
+	limitedSince time.Time
+	abusive      bool // Reported as abusive during the current period of drops
+}
+
+// ingressLimitState holds the budgets of the senders.
+type ingressLimitState struct {
+	autoBlock atomic.Bool
+	mu        sync.Mutex
+	sources   map[netip.Addr]*ingressSource
+}
+
+// ingressRates returns the packets and bytes per second of the class.
+func ingressRates(class IngressClass) (packets float64, bytes float64) {
+	if class == IngressData {
+		return common.INGRESS_DATA_PACKETS_PER_SECOND, common.INGRESS_DATA_BYTES_PER_SECOND
+	}
+	return common.INGRESS_CONTROL_PACKETS_PER_SECOND, common.INGRESS_CONTROL_BYTES_PER_SECOND
+}
+
+// classifyIngress returns the budget a serialized packet is charged to, packets too short for a message type are control packets.
+func classifyIngress(data []byte) IngressClass {
+	msgType, ok := pkt.PeekMessageType(data)
+	if !ok {
+		return IngressControl
+	}
+	switch msgType {
+	case pkt.MsgTypeConnect, pkt.MsgTypeDisconnect, pkt.MsgTypeDD, pkt.MsgTypeLSA, pkt.MsgTypeMTUProbe, pkt.MsgTypeIntroduce,
+		pkt.MsgTypeAbort, pkt.MsgTypePresence, pkt.MsgTypeRebind:
+		return IngressControl
+	default:
+		return IngressData
+	}
+}
+
+// SetIngressAutoBlock enables or disables reporting senders that exceed their budget for common.INGRESS_AUTO_BLOCK_AFTER as abusive.
+// Can be called at any time.
+func (m *Manager) SetIngressAutoBlock(enabled bool) {
+	m.ingressLimits.autoBlock.Store(enabled)
+}
+
+// IsIngressAutoBlockEnabled returns whether abusive senders are reported, see SetIngressAutoBlock.
+func (m *Manager) IsIngressAutoBlockEnabled() bool {
+	return m.ingressLimits.autoBlock.Load()
+}
+
+// AdmitIngress charges a datagram received from sender to the sender's budget of its class.
+// Returns IngressDropped if the budget is exhausted, and IngressAbusive once per period of drops if auto-blocking is enabled
+// and the sender exceeded its budgets for common.INGRESS_AUTO_BLOCK_AFTER.
+// Can be called concurrently.
+func (m *Manager) AdmitIngress(sender netip.Addr, data []byte) IngressVerdict {
+	class := classifyIngress(data)
+	now := time.Now()
+
+	m.ingressLimits.mu.Lock()
+	defer m.ingressLimits.mu.Unlock()
+
+	source, exists := m.ingressLimits.sources[sender]
+	if !exists {
+		m.forgetIdleIngressSources(now)
+		source = &ingressSource{refilledAt: now}
+		for c := range source.buckets {
+			packets, bytes := ingressRates(IngressClass(c))
+			source.buckets[c] = ingressBucket{packets: packets * common.INGRESS_BURST.Seconds(), bytes: bytes * common.INGRESS_BURST.Seconds()}
+		}
+		m.ingressLimits.sources[sender] = source
+	}
+	source.refill(now)
+
+	bucket := &source.buckets[class]
+	if bucket.packets >= 1 && bucket.bytes >= float64(len(data)) {
+		bucket.packets--
+		bucket.bytes -= float64(len(data))
+		return IngressAdmitted
+	}
+
+	source.drops[class].Packets++
+	source.drops[class].Bytes += uint64(len(data))
+	if now.Sub(source.lastDrop) > time.Second {
+		source.limitedSince = now
+		source.abusive = false
+		logger.Warnf("%v exceeds its %s ingress budget, dropping its packets", sender, class)
+	}
+	source.lastDrop = now
+
+	if !source.abusive && m.IsIngressAutoBlockEnabled() && now.Sub(source.limitedSince) >= common.INGRESS_AUTO_BLOCK_AFTER {
+		source.abusive = true
+		return IngressAbusive
+	}
+	return IngressDropped
+}
+
+// refill adds the budget accumulated since the last refill, up to common.INGRESS_BURST of it.
+func (s *ingressSource) refill(now time.Time) {
+	elapsed := now.Sub(s.refilledAt).Seconds()
+	s.refilledAt = now
+
+	for c := range s.buckets {
+		packets, bytes := ingressRates(IngressClass(c))
+		s.buckets[c].packets = min(s.buckets[c].packets+elapsed*packets, packets*common.INGRESS_BURST.Seconds())
+		s.buckets[c].bytes = min(s.buckets[c].bytes+elapsed*bytes, bytes*common.INGRESS_BURST.Seconds())
+	}
+}
+
+// forgetIdleIngressSources makes room for a new sender once there are common.INGRESS_MAX_SOURCES.
+// Senders whose buckets are full again are removed, those that never exceeded a budget first, as IngressStats reports the drops of the others.
+// If that isn't enough, the sender that sent the longest time ago is removed, so the number of senders stays bounded also while many senders are limited.
+// Must be called with ingressLimits.mu held.
+func (m *Manager) forgetIdleIngressSources(now time.Time) {
+	sources := m.ingressLimits.sources
+	if len(sources) < common.INGRESS_MAX_SOURCES {
+		return
+	}
+
+	for _, withDrops := range []bool{false, true} {
+		for addr, source := range sources {
+			if (withDrops || source.lastDrop.IsZero()) && now.Sub(source.refilledAt) >= common.INGRESS_BURST {
+				delete(sources, addr)
+			}
+		}
+		if len(sources) < common.INGRESS_MAX_SOURCES {
+			return
+		}
+	}
+
+	var oldest netip.Addr
+	for addr, source := range sources {
+		if !oldest.IsValid() || source.refilledAt.Before(sources[oldest].refilledAt) {
+			oldest = addr
+		}
+	}
+	delete(sources, oldest)
+}
+
+// IngressStats returns the senders that exceeded a budget, ordered by address.
+func (m *Manager) IngressStats() []IngressSourceStats {
+	m.ingressLimits.mu.Lock()
+	defer m.ingressLimits.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]IngressSourceStats, 0)
+	for addr, source := range m.ingressLimits.sources {
+		if source.lastDrop.IsZero() {
+			continue
+		}
+		sourceStats := IngressSourceStats{Addr: addr, Drops: source.drops, LastDrop: source.lastDrop}
+		if now.Sub(source.lastDrop) <= time.Second {
+			sourceStats.LimitedSince = source.limitedSince
+		}
+		stats = append(stats, sourceStats)
+	}
+	slices.SortFunc(stats, func(a, b IngressSourceStats) int {
+		return a.Addr.Compare(b.Addr)
+	})
+	return stats
+}
+
+// ResetIngressStats forgets the drops of all senders, their budgets are kept.
+func (m *Manager) ResetIngressStats() {
+	m.ingressLimits.mu.Lock()
+	defer m.ingressLimits.mu.Unlock()
+
+	for _, source := range m.ingressLimits.sources {
+		source.drops = [ingressClasses]IngressDrops{}
+		source.lastDrop = time.Time{}
+		source.limitedSince = time.Time{}
+		source.abusive = false
+	}
+}
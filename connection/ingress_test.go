@@ -0,0 +1,91 @@
+package connection
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+func serializedPacket(msgType byte) []byte {
+	packet := &pkt.Packet{Header: pkt.Header{Control: pkt.MakeControlByte(msgType, common.TEAM_ID), TTL: common.INITIAL_TTL}}
+	return packet.ToByteArray()
+}
+
+// TestIngressBudgets verifies that a sender flooding control packets is limited without affecting its data packets or other senders,
+// and that a sender over budget for common.INGRESS_AUTO_BLOCK_AFTER is reported as abusive once.
+func TestIngressBudgets(t *testing.T) {
+	m := NewManager(nil, nil, nil, nil, nil)
+	flooder := netip.MustParseAddr("10.0.0.2")
+	other := netip.MustParseAddr("10.0.0.3")
+	lsa := serializedPacket(pkt.MsgTypeLSA)
+	msg := serializedPacket(pkt.MsgTypeChatMessage)
+
+	burst := int(common.INGRESS_CONTROL_PACKETS_PER_SECOND * common.INGRESS_BURST.Seconds())
+	dropped := 0
+	for range burst * 2 {
+		if m.AdmitIngress(flooder, lsa) != IngressAdmitted {
+			dropped++
+		}
+	}
+	if dropped < burst/2 {
+		t.Errorf("Dropped %d of %d control packets, want at least %d", dropped, burst*2, burst/2)
+	}
+
+	if verdict := m.AdmitIngress(flooder, msg); verdict != IngressAdmitted {
+		t.Errorf("Data packet of the control flooder got %v, want it admitted", verdict)
+	}
+	if verdict := m.AdmitIngress(other, lsa); verdict != IngressAdmitted {
+		t.Errorf("Control packet of another sender got %v, want it admitted", verdict)
+	}
+
+	stats := m.IngressStats()
+	if len(stats) != 1 || stats[0].Addr != flooder || stats[0].Drops[IngressControl].Packets != uint64(dropped) || stats[0].Drops[IngressData].Packets != 0 {
+		t.Fatalf("Ingress stats %+v, want %d control drops of %v", stats, dropped, flooder)
+	}
+
+	m.SetIngressAutoBlock(true)
+	m.ingressLimits.mu.Lock()
+	m.ingressLimits.sources[flooder].limitedSince = time.Now().Add(-common.INGRESS_AUTO_BLOCK_AFTER)
+	m.ingressLimits.mu.Unlock()
+
+	verdicts := map[IngressVerdict]int{}
+	for range 10 {
+		verdicts[m.AdmitIngress(flooder, lsa)]++
+	}
+	if verdicts[IngressAbusive] != 1 {
+		t.Errorf("Sustained flooder was reported as abusive %d times, want once", verdicts[IngressAbusive])
+	}
+
+	m.ResetIngressStats()
+	if stats := m.IngressStats(); len(stats) != 0 {
+		t.Errorf("Ingress stats %+v after reset, want none", stats)
+	}
+}
+
+// TestIngressSourcesAreBounded verifies that senders with drops are forgotten once common.INGRESS_MAX_SOURCES senders are tracked,
+// the idle ones first and the least recently active one if all are active.
+func TestIngressSourcesAreBounded(t *testing.T) {
+	m := NewManager(nil, nil, nil, nil, nil)
+	now := time.Now()
+
+	m.ingressLimits.mu.Lock()
+	for i := range common.INGRESS_MAX_SOURCES {
+		addr := netip.AddrFrom4([4]byte{10, 1, byte(i >> 8), byte(i)})
+		m.ingressLimits.sources[addr] = &ingressSource{refilledAt: now.Add(time.Duration(i) * time.Millisecond), lastDrop: now}
+	}
+	m.ingressLimits.mu.Unlock()
+
+	m.AdmitIngress(netip.MustParseAddr("10.2.0.1"), serializedPacket(pkt.MsgTypeChatMessage))
+
+	m.ingressLimits.mu.Lock()
+	defer m.ingressLimits.mu.Unlock()
+	if len(m.ingressLimits.sources) > common.INGRESS_MAX_SOURCES {
+		t.Fatalf("Tracking %d senders, want at most %d", len(m.ingressLimits.sources), common.INGRESS_MAX_SOURCES)
+	}
+	if _, exists := m.ingressLimits.sources[netip.AddrFrom4([4]byte{10, 1, 0, 0})]; exists {
+		t.Errorf("Least recently active sender wasn't forgotten")
+	}
+}
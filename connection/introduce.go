@@ -0,0 +1,118 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// INTRODUCE packets let a publicly reachable introducer tell two NATed peers each other's external address.
+// Both peers then send CONNECTs to each other at the same time, which opens (punches) their NATs for the other peer.
+//
+// Request (peer -> introducer):
+//
+//	+----------+------------------------------------+
+//	| 0x00     | Peer Address (32 bits)             |
+//	+----------+------------------------------------+
+//
+// Introduction (introducer -> both peers):
+//
+//	+----------+------------------------+-----------------------------------+---------------------------------+
+//	| 0x01     | Peer Address (32 bits) | Peer External Address/Port (48)   | Your External Address/Port (48) |
+//	+----------+------------------------+-----------------------------------+---------------------------------+
+//
+// External addresses are the UDP addresses the introducer observes for its neighbors.
+const (
+	introduceRequest      = 0x00
+	introduceIntroduction = 0x01
+	introductionSize      = 1 + 4 + 2*externalAddrSize
+)
+
+// Introduction is an introduction received from an introducer.
+type Introduction struct {
+	Peer         netip.Addr     // Address of the peer to connect to
+	PeerExternal netip.AddrPort // UDP address the peer is reachable at
+	OwnExternal  netip.AddrPort // UDP address the introducer observed for us
+}
+
+// SendIntroductionRequest asks the introducer to introduce us and the peer to each other.
+// The introducer must be a neighbor of both.
+func (m *Manager) SendIntroductionRequest(introducer netip.Addr, peer netip.Addr) (chan bool, error) {
+	peerBytes := peer.As4()
+	payload := append(pkt.Payload{introduceRequest}, peerBytes[:]...)
+
+	return m.SendReliableRoutedPacket(context.Background(), m.BuildSequencedPacket(pkt.MsgTypeIntroduce, payload, introducer))
+}
+
+// IntroducePeers sends each of the two neighbors the external address of the other.
+// Errors if one of them isn't a neighbor, because only the UDP addresses of neighbors are known.
+func (m *Manager) IntroducePeers(a netip.Addr, b netip.Addr) error {
+	isNeighborA, externalA := m.router.IsNeighbor(a)
+	isNeighborB, externalB := m.router.IsNeighbor(b)
+	if !isNeighborA || !isNeighborB {
+		return fmt.Errorf("%w: can't introduce %s and %s, both must be neighbors", ErrPeerUnknown, a, b)
+	}
+
+	_, err := m.SendReliableRoutedPacket(context.Background(), m.BuildSequencedPacket(pkt.MsgTypeIntroduce, buildIntroduction(b, externalB, externalA), a))
+	if err != nil {
+		return err
+	}
+
+	_, err = m.SendReliableRoutedPacket(context.Background(), m.BuildSequencedPacket(pkt.MsgTypeIntroduce, buildIntroduction(a, externalA, externalB), b))
+	return err
+}
+
+func buildIntroduction(peer netip.Addr, peerExternal netip.AddrPort, ownExternal netip.AddrPort) pkt.Payload {
+	payload := make(pkt.Payload, 0, introductionSize)
+	payload = append(payload, introduceIntroduction)
+	peerBytes := peer.As4()
+	payload = append(payload, peerBytes[:]...)
+	payload = appendAddrPort(payload, peerExternal)
+	return appendAddrPort(payload, ownExternal)
+}
+
+// ParseIntroducePayload parses an INTRODUCE payload.
+// For requests, the requested peer is returned and the introduction is nil.
+func ParseIntroducePayload(payload pkt.Payload) (requestedPeer netip.Addr, introduction *Introduction, err error) {
+	if len(payload) < 5 {
+		return netip.Addr{}, nil, errors.New("INTRODUCE payload too short")
+	}
+
+	peer := netip.AddrFrom4([4]byte(payload[1:5]))
+
+	switch payload[0] {
+	case introduceRequest:
+		return peer, nil, nil
+	case introduceIntroduction:
+		if len(payload) < introductionSize {
+			return netip.Addr{}, nil, errors.New("introduction payload too short")
+		}
+		return netip.Addr{}, &Introduction{
+			Peer:         peer,
+			PeerExternal: parseAddrPort(payload[5:11]),
+			OwnExternal:  parseAddrPort(payload[11:17]),
+		}, nil
+	default:
+		return netip.Addr{}, nil, fmt.Errorf("unknown INTRODUCE operation %d", payload[0])
+	}
+}
+
+// PunchTo connects to an introduced peer. The peer connects to us at the same time, so both NATs let the other peer's packets in.
+// Lost CONNECTs (while the NATs aren't open yet) are resent like any reliable packet.
+func (m *Manager) PunchTo(introduction *Introduction) (<-chan bool, error) {
+	if isNeighbor, _ := m.router.IsNeighbor(introduction.Peer); isNeighbor {
+		return nil, fmt.Errorf("already connected to %s", introduction.Peer)
+	}
+
+	var payload pkt.Payload
+	if introduction.OwnExternal == m.socket.MustGetLocalAddress() {
+		payload = m.BuildConnectPayload() // We aren't behind a NAT
+	} else {
+		payload = m.BuildConnectPayloadWithExternal(introduction.OwnExternal)
+	}
+
+	return m.ConnectTo(introduction.Peer, introduction.PeerExternal, payload)
+}
@@ -0,0 +1,277 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// Every node signs its own LSAs with an Ed25519 key, so a node can't poison the routes of others by flooding LSAs in their name.
+// Neighbors announce their public key with an ExtTypePublicKey extension on the CONNECT and its ACK.
+// The key of a host is pinned from its first announcement or its first signed LSA until the host becomes unreachable
+// or an operator forgets it, a CONNECT announcing another key for the host is rejected.
+// An LSA of a host with a known key must be signed with that key, otherwise it is neither stored nor flooded.
+//
+// The signature block follows the neighbors and precedes the stub marker, legacy nodes read it as neighbors without an LSA,
+// which are never routable, and still recognize the stub marker. The signature covers the LSA without boot epoch and signature block.
+//
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|    LSA Owner Address (32 bits)    |     Sequence Number (32 bits)     |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|                  Neighbor Addresses (32 bits each) ...                |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	| Marker 255.255.255.255 (32 bits)  |   Public Key (256 bits) ...       |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|                          Signature (512 bits) ...                     |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|  Stub Marker 0.0.0.0 (optional)   |
+//	+--------+--------+--------+--------+
+
+// lsaSignatureMarker starts the signature block of a signed LSA.
+var lsaSignatureMarker = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+
+const lsaSignatureSize = 4 + ed25519.PublicKeySize + ed25519.SignatureSize
+
+// Errors of VerifyLSA.
+var (
+	// ErrUnsignedLSA is returned for an unsigned LSA whose owner has a known key, or for any unsigned LSA if common.REQUIRE_SIGNED_LSAS is set.
+	ErrUnsignedLSA = errors.New("LSA is not signed")
+
+	// ErrBadLSASignature is returned if the signature doesn't match the LSA and the key it carries.
+	ErrBadLSASignature = errors.New("LSA signature is invalid")
+
+	// ErrLSAKeyMismatch is returned if the LSA is signed with another key than the known key of its owner.
+	ErrLSAKeyMismatch = errors.New("LSA is signed with another key than its owner's")
+)
+
+// lsaSigningState holds the key our LSAs are signed with and the public keys of the other hosts.
+type lsaSigningState struct {
+	mu         sync.Mutex
+	privateKey ed25519.PrivateKey
+	keys       map[netip.Addr]ed25519.PublicKey // Announced by neighbors or pinned from the first signed LSA of the host
+}
+
+// newLSASigningState returns the signing state with a new random key.
+func newLSASigningState() lsaSigningState {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate the LSA signing key: %v", err))
+	}
+	return lsaSigningState{
+		privateKey: privateKey,
+		keys:       make(map[netip.Addr]ed25519.PublicKey),
+	}
+}
+
+// LoadSigningKey signs our LSAs with the key whose seed is stored in the file at path.
+// If the file doesn't exist, a new key is generated and its seed written to it, so the node keeps its key across restarts.
+// Otherwise hosts that pinned the key of an earlier run reject our CONNECTs and LSAs until they consider us unreachable.
+// Must be called before connecting to neighbors, the public key is announced when connecting.
+func (m *Manager) LoadSigningKey(path string) error {
+	seed, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		seed = m.signingKey().Seed()
+		if err := os.WriteFile(path, seed, 0600); err != nil {
+			return fmt.Errorf("failed to store the signing key: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the signing key: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("signing key file %s has %d bytes, want %d", path, len(seed), ed25519.SeedSize)
+	}
+
+	m.lsaSigning.mu.Lock()
+	defer m.lsaSigning.mu.Unlock()
+
+	m.lsaSigning.privateKey = ed25519.NewKeyFromSeed(seed)
+	return nil
+}
+
+func (m *Manager) signingKey() ed25519.PrivateKey {
+	m.lsaSigning.mu.Lock()
+	defer m.lsaSigning.mu.Unlock()
+
+	return m.lsaSigning.privateKey
+}
+
+// PublicKey returns the public key our LSAs are signed with.
+func (m *Manager) PublicKey() ed25519.PublicKey {
+	return m.signingKey().Public().(ed25519.PublicKey)
+}
+
+// GetPeerKey returns the public key of the host, announced on its CONNECT or pinned from its first signed LSA.
+// Returns false if the host's LSAs are accepted unsigned.
+func (m *Manager) GetPeerKey(addr netip.Addr) (ed25519.PublicKey, bool) {
+	m.lsaSigning.mu.Lock()
+	defer m.lsaSigning.mu.Unlock()
+
+	key, exists := m.lsaSigning.keys[addr]
+	return key, exists
+}
+
+// announcePublicKey adds the ExtTypePublicKey extension to a CONNECT or its ACK.
+func (m *Manager) announcePublicKey(packet *pkt.Packet) {
+	packet.AddExtension(pkt.ExtTypePublicKey, m.PublicKey())
+	pkt.SetChecksum(packet)
+}
+
+// announcedKey returns the public key announced with an ExtTypePublicKey extension, false if the packet carries none.
+func announcedKey(packet *pkt.Packet) (ed25519.PublicKey, bool) {
+	for _, ext := range packet.GetExtensions(pkt.ExtTypePublicKey) {
+		if len(ext.Value) == ed25519.PublicKeySize {
+			return ed25519.PublicKey(ext.Value), true
+		}
+	}
+	return nil, false
+}
+
+// ConflictsWithPinnedKey returns whether the CONNECT or ACK of addr announces another key than the key pinned for addr.
+// A pinned key is only replaced once the host became unreachable or an operator forgot it (see ForgetPeerKey),
+// otherwise any host could take over the LSAs of another by announcing its own key in its name.
+func (m *Manager) ConflictsWithPinnedKey(packet *pkt.Packet, addr netip.Addr) bool {
+	key, announced := announcedKey(packet)
+	if !announced {
+		return false
+	}
+	pinned, known := m.GetPeerKey(addr)
+	return known && !key.Equal(pinned)
+}
+
+// RecordPublicKey pins the public key the neighbor addr announced if no key is pinned for addr yet, a pinned key is kept.
+// Must be called with CONNECTs and ACKs from neighbors, packets without announcement are ignored.
+func (m *Manager) RecordPublicKey(packet *pkt.Packet, addr netip.Addr) {
+	key, announced := announcedKey(packet)
+	if !announced {
+		return
+	}
+
+	m.lsaSigning.mu.Lock()
+	defer m.lsaSigning.mu.Unlock()
+
+	if pinned, known := m.lsaSigning.keys[addr]; known {
+		if !key.Equal(pinned) {
+			logger.Warnf("%v announced another key than its pinned key, keeping the pinned key", addr)
+		}
+		return
+	}
+	m.lsaSigning.keys[addr] = bytes.Clone(key)
+}
+
+// ForgetPeerKey forgets the pinned key of the host, e.g. after the operator of the host replaced its key file.
+// The next key the host announces or signs an LSA with is pinned instead. Returns false if no key was pinned.
+func (m *Manager) ForgetPeerKey(addr netip.Addr) bool {
+	m.lsaSigning.mu.Lock()
+	defer m.lsaSigning.mu.Unlock()
+
+	_, known := m.lsaSigning.keys[addr]
+	delete(m.lsaSigning.keys, addr)
+	return known
+}
+
+// clearPeerKey forgets the key of an unreachable host, its next signed LSA pins a key again.
+func (m *Manager) clearPeerKey(addr netip.Addr) {
+	m.lsaSigning.mu.Lock()
+	defer m.lsaSigning.mu.Unlock()
+
+	delete(m.lsaSigning.keys, addr)
+}
+
+// signLSA returns the public key and the signature of the LSA body, see appendLSASignature.
+func (m *Manager) signLSA(body []byte) []byte {
+	privateKey := m.signingKey()
+	signature := make([]byte, 0, ed25519.PublicKeySize+ed25519.SignatureSize)
+	signature = append(signature, privateKey.Public().(ed25519.PublicKey)...)
+	return append(signature, ed25519.Sign(privateKey, body)...)
+}
+
+// appendLSASignature appends the LSA body to the payload with the signature block (public key and signature) in front of the stub marker.
+// The body is appended as is if the signature is nil.
+func appendLSASignature(payload pkt.Payload, body []byte, signature []byte, stub bool) pkt.Payload {
+	if signature == nil {
+		return append(payload, body...)
+	}
+
+	neighborsEnd := len(body)
+	if stub {
+		neighborsEnd -= 4
+	}
+	markerBytes := lsaSignatureMarker.As4()
+
+	payload = append(payload, body[:neighborsEnd]...)
+	payload = append(payload, markerBytes[:]...)
+	payload = append(payload, signature...)
+	return append(payload, body[neighborsEnd:]...)
+}
+
+// SplitLSASignature returns the signed body of an LSA payload without boot epoch and the signature block (public key and signature).
+// The signature is nil and the body the payload itself if the LSA isn't signed.
+func SplitLSASignature(lsaPayload pkt.Payload) (body pkt.Payload, signature []byte) {
+	stubMarker := routing.StubMarker.As4()
+	markerBytes := lsaSignatureMarker.As4()
+
+	hasBlockAt := func(end int) bool {
+		start := end - lsaSignatureSize
+		return start >= 8 && bytes.Equal(lsaPayload[start:start+4], markerBytes[:])
+	}
+
+	end := len(lsaPayload)
+	if !hasBlockAt(end) {
+		if end < 4 || !bytes.Equal(lsaPayload[end-4:], stubMarker[:]) || !hasBlockAt(end-4) {
+			return lsaPayload, nil
+		}
+		end -= 4
+	}
+
+	start := end - lsaSignatureSize
+	body = make(pkt.Payload, 0, len(lsaPayload)-lsaSignatureSize)
+	body = append(body, lsaPayload[:start]...)
+	body = append(body, lsaPayload[end:]...)
+	return body, bytes.Clone(lsaPayload[start+4 : end])
+}
+
+// VerifyLSA checks the signature of an LSA of owner before it is stored or flooded.
+// A signed LSA must be valid and signed with the known key of the owner; the key of an owner without known key is pinned.
+// Unsigned LSAs are only accepted from owners without known key (legacy nodes) unless common.REQUIRE_SIGNED_LSAS is set,
+// LSAs in our name must be signed with our key.
+// Returns ErrUnsignedLSA, ErrBadLSASignature or ErrLSAKeyMismatch if the LSA must be rejected.
+func (m *Manager) VerifyLSA(owner netip.Addr, body []byte, signature []byte) error {
+	m.lsaSigning.mu.Lock()
+	defer m.lsaSigning.mu.Unlock()
+
+	knownKey, known := m.lsaSigning.keys[owner]
+	if owner == m.socket.MustGetLocalAddress().Addr() {
+		knownKey, known = m.lsaSigning.privateKey.Public().(ed25519.PublicKey), true
+	}
+
+	if signature == nil {
+		if known || common.REQUIRE_SIGNED_LSAS {
+			return ErrUnsignedLSA
+		}
+		return nil
+	}
+
+	key := ed25519.PublicKey(signature[:ed25519.PublicKeySize])
+	if !ed25519.Verify(key, body, signature[ed25519.PublicKeySize:]) {
+		return ErrBadLSASignature
+	}
+	if known && !key.Equal(knownKey) {
+		return ErrLSAKeyMismatch
+	}
+	if !known {
+		m.lsaSigning.keys[owner] = bytes.Clone(key)
+	}
+	return nil
+}
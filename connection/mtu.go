@@ -0,0 +1,223 @@
+package connection
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// MTU probes are unsequenced, a lost probe must not leave a gap in the packet number space.
+// The packet number field carries a probe ID instead.
+//
+// Probe payload:
+//
+//	+----------+---------------------------+
+//	| 0x00     | Padding (probe size - 1)  |
+//	+----------+---------------------------+
+//
+// Reply payload:
+//
+//	+----------+---------------------------+
+//	| 0x01     | Probe size (16 bits)      |
+//	+----------+---------------------------+
+const (
+	mtuProbeRequest = 0x00
+	mtuProbeReply   = 0x01
+)
+
+// mtuProbeSizes are the payload sizes that are probed in ascending order.
+// They correspond to minimal IPv4 paths, the default payload size, Ethernet (1500 bytes) and jumbo frames (9000 bytes).
+var mtuProbeSizes = []int{508, common.MAX_PAYLOAD_SIZE_BYTES, 1456, 4056, common.UDP_BUFFER_SIZE_BYTES - 28 - pkt.HEADER_SIZE}
+
+// pathMTUState holds the discovered path MTUs and the open probes.
+type pathMTUState struct {
+	mu            sync.Mutex
+	payloadLimits map[netip.Addr]int    // Discovered maximum payload size per destination
+	pending       map[uint32]chan<- int // Open probes by probe ID
+}
+
+// GetMaxPayloadSize returns the maximum payload size for packets to the destination.
+// Returns the discovered path limit or common.MAX_PAYLOAD_SIZE_BYTES if the path hasn't been probed,
+// lowered to the maximum payload size a neighbor announced in its capabilities.
+// Can be called concurrently.
+func (m *Manager) GetMaxPayloadSize(destAddr netip.Addr) int {
+	m.pathMTU.mu.Lock()
+	limit, exists := m.pathMTU.payloadLimits[destAddr]
+	m.pathMTU.mu.Unlock()
+	if !exists {
+		limit = common.MAX_PAYLOAD_SIZE_BYTES
+	}
+
+	if announced := m.announcedPayloadLimit(destAddr); announced > 0 {
+		limit = min(limit, max(announced-pkt.EXTENSION_RESERVE_BYTES, 1))
+	}
+	return limit
+}
+
+// HasDiscoveredPathMTU returns whether the path to the destination has been probed.
+func (m *Manager) HasDiscoveredPathMTU(destAddr netip.Addr) bool {
+	m.pathMTU.mu.Lock()
+	defer m.pathMTU.mu.Unlock()
+
+	_, exists := m.pathMTU.payloadLimits[destAddr]
+	return exists
+}
+
+// DiscoverPathMTU probes the path to the destination with packets of increasing size and stores the largest acknowledged payload size.
+// The stored limit leaves pkt.EXTENSION_RESERVE_BYTES free for extensions.
+// Blocks until probing is done. Returns the new payload limit.
+// If no probe is answered (e.g. the peer doesn't support probes), common.MAX_PAYLOAD_SIZE_BYTES is kept.
+// Probes are sent with the Don't-Fragment bit, also by the forwarding nodes (see sendPacketTo), otherwise an oversized probe
+// would arrive fragmented and be answered. If the socket can't set the bit, common.MAX_PAYLOAD_SIZE_BYTES is kept as well.
+func (m *Manager) DiscoverPathMTU(destAddr netip.Addr) int {
+	if !m.socket.DontFragment() {
+		logger.Infof("Can't send MTU probes without the Don't-Fragment bit on this platform, keeping default payload size %d for %s", common.MAX_PAYLOAD_SIZE_BYTES, destAddr)
+		return m.keepDefaultPathMTU(destAddr)
+	}
+
+	limit := 0
+
+	for _, size := range mtuProbeSizes {
+		if !m.probeSize(destAddr, size) {
+			break
+		}
+		limit = size
+	}
+
+	if limit == 0 {
+		logger.Infof("No MTU probe to %s was answered, keeping default payload size %d", destAddr, common.MAX_PAYLOAD_SIZE_BYTES)
+		return m.keepDefaultPathMTU(destAddr)
+	}
+
+	logger.Infof("Discovered maximum packet payload %d for %s", limit, destAddr)
+
+	limit -= pkt.EXTENSION_RESERVE_BYTES // Leave room for extensions like piggybacked ACKs
+
+	m.pathMTU.mu.Lock()
+	m.pathMTU.payloadLimits[destAddr] = limit
+	m.pathMTU.mu.Unlock()
+
+	return limit
+}
+
+// keepDefaultPathMTU stores common.MAX_PAYLOAD_SIZE_BYTES as the payload limit of the destination and returns it.
+func (m *Manager) keepDefaultPathMTU(destAddr netip.Addr) int {
+	m.pathMTU.mu.Lock()
+	defer m.pathMTU.mu.Unlock()
+
+	m.pathMTU.payloadLimits[destAddr] = common.MAX_PAYLOAD_SIZE_BYTES
+	return common.MAX_PAYLOAD_SIZE_BYTES
+}
+
+// ClearPathMTU removes the discovered payload limit of the destination.
+func (m *Manager) ClearPathMTU(destAddr netip.Addr) {
+	m.pathMTU.mu.Lock()
+	defer m.pathMTU.mu.Unlock()
+
+	delete(m.pathMTU.payloadLimits, destAddr)
+}
+
+// probeSize sends up to common.MTU_PROBE_ATTEMPTS probes with the given payload size.
+// Returns true if any of them was answered.
+func (m *Manager) probeSize(destAddr netip.Addr, size int) bool {
+	for range common.MTU_PROBE_ATTEMPTS {
+		nextHop, found := m.router.GetNextHop(destAddr)
+		if !found {
+			return false
+		}
+
+		probeID := m.nextProbeID.Add(1)
+		replyChan := make(chan int, 1)
+
+		m.pathMTU.mu.Lock()
+		m.pathMTU.pending[probeID] = replyChan
+		m.pathMTU.mu.Unlock()
+
+		payload := make(pkt.Payload, size-m.authenticationOverhead()) // The MAC must fit into the probed size
+		payload[0] = mtuProbeRequest
+
+		var pktNum [4]byte
+		binary.BigEndian.PutUint32(pktNum[:], probeID)
+
+		err := m.sendPacketTo(nextHop, m.buildPacket(pkt.MsgTypeMTUProbe, payload, destAddr, pktNum))
+
+		var answered bool
+		if err == nil {
+			select {
+			case replySize := <-replyChan:
+				answered = replySize == len(payload)
+			case <-time.After(common.MTU_PROBE_TIMEOUT):
+			}
+		}
+
+		m.pathMTU.mu.Lock()
+		delete(m.pathMTU.pending, probeID)
+		m.pathMTU.mu.Unlock()
+
+		if answered {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isMTUProbeRequest returns whether the packet is an MTU probe, as opposed to a probe reply or a path trace.
+func isMTUProbeRequest(packet *pkt.Packet) bool {
+	return packet.GetMessageType() == pkt.MsgTypeMTUProbe && len(packet.Payload) > 0 && packet.Payload[0] == mtuProbeRequest
+}
+
+// HandleMTUProbe processes an MTU probe or probe reply that is destined for us.
+// Probes are answered with a small reply carrying the received probe size.
+// Path traces and their replies share the message type (see pathRecordState).
+func (m *Manager) HandleMTUProbe(packet *pkt.Packet) error {
+	if len(packet.Payload) < 1 {
+		return errors.New("empty MTU probe payload")
+	}
+
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+
+	switch packet.Payload[0] {
+	case traceRequest, traceReply:
+		return m.handleTrace(packet)
+	case mtuProbeRequest:
+		nextHop, found := m.router.GetNextHop(srcAddr)
+		if !found {
+			return fmt.Errorf("%w %s, the source of the MTU probe", ErrNoRoute, srcAddr)
+		}
+
+		payload := make(pkt.Payload, 3)
+		payload[0] = mtuProbeReply
+		binary.BigEndian.PutUint16(payload[1:], uint16(len(packet.Payload)))
+
+		return m.sendPacketTo(nextHop, m.buildPacket(pkt.MsgTypeMTUProbe, payload, srcAddr, packet.Header.PktNum))
+	case mtuProbeReply:
+		if len(packet.Payload) < 3 {
+			return errors.New("MTU probe reply too short")
+		}
+
+		probeID := binary.BigEndian.Uint32(packet.Header.PktNum[:])
+		size := int(binary.BigEndian.Uint16(packet.Payload[1:3]))
+
+		m.pathMTU.mu.Lock()
+		replyChan, exists := m.pathMTU.pending[probeID]
+		m.pathMTU.mu.Unlock()
+
+		if exists {
+			select {
+			case replyChan <- size:
+			default: // A reply for this probe was already delivered
+			}
+		}
+		return nil
+	default:
+		return errors.New("unknown MTU probe kind")
+	}
+}
@@ -0,0 +1,75 @@
+package connection
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// startProbingManager opens a socket at addr and returns a manager that answers the MTU probes and probe replies it receives.
+func startProbingManager(t *testing.T, network *sock.MemoryNetwork, addr net.IP) *Manager {
+	t.Helper()
+
+	socket := network.NewSocket()
+	if _, err := socket.Open(addr); err != nil {
+		t.Fatalf("Failed to open socket: %v", err)
+	}
+	t.Cleanup(func() { _ = socket.Close() })
+
+	m := NewManager(socket, routing.NewRouter(socket), sequencing.NewIncomingPktNumHandler(socket), sequencing.NewOutgoingPktNumHandler(common.INITIAL_CWND, common.IGNORE_CWND), reconstruction.NewManager())
+
+	packets := socket.Subscribe()
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case datagram := <-packets:
+				packet, err := pkt.ParsePacket(datagram.Data)
+				if err == nil && packet.GetMessageType() == pkt.MsgTypeMTUProbe {
+					_ = m.HandleMTUProbe(packet)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return m
+}
+
+// TestDiscoverPathMTU verifies that the largest answered probe size is stored as the payload limit, less the extension reserve.
+func TestDiscoverPathMTU(t *testing.T) {
+	network := sock.NewMemoryNetwork()
+	network.SetMTU(1500 - 28) // Ethernet less the IPv4 and UDP headers, the 1456 bytes probe fits, the 4056 bytes probe is dropped
+
+	local := startProbingManager(t, network, net.IPv4(10, 0, 0, 1))
+	remote := startProbingManager(t, network, net.IPv4(10, 0, 0, 2))
+	localAddr, remoteAddr := local.socket.MustGetLocalAddress().Addr(), remote.socket.MustGetLocalAddress().Addr()
+	local.router.AddNeighbor(remote.socket.MustGetLocalAddress())
+	local.router.UpdateLSA(remoteAddr, 1, []netip.Addr{localAddr}, false, remoteAddr)
+	remote.router.AddNeighbor(local.socket.MustGetLocalAddress())
+	remote.router.UpdateLSA(localAddr, 1, []netip.Addr{remoteAddr}, false, localAddr)
+
+	if local.HasDiscoveredPathMTU(remoteAddr) {
+		t.Fatalf("Path to %v is discovered before probing", remoteAddr)
+	}
+
+	want := 1456 - pkt.EXTENSION_RESERVE_BYTES
+	if limit := local.DiscoverPathMTU(remoteAddr); limit != want {
+		t.Errorf("DiscoverPathMTU returned %d, want %d", limit, want)
+	}
+	if !local.HasDiscoveredPathMTU(remoteAddr) {
+		t.Errorf("Path to %v isn't discovered after probing", remoteAddr)
+	}
+	if limit := local.GetMaxPayloadSize(remoteAddr); limit != want {
+		t.Errorf("GetMaxPayloadSize returned %d, want %d", limit, want)
+	}
+}
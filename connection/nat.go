@@ -0,0 +1,200 @@
+package connection
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/nat"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// CONNECT payloads may carry the external address of the sender after the boot epoch:
+//
+//	+--------+--------+--------+--------+--------+--------+
+//	|  External IPv4 Address (32 bits)  |  Ext Port (16)  |
+//	+--------+--------+--------+--------+--------+--------+
+//
+// Peers behind a NAT send from their external address, which doesn't match the source address in the header.
+// Receivers accept such packets if the sender matches the advertised external address. The advertisement alone proves nothing,
+// the CONNECT is only accepted if an introducer observed the peer at the address or the CONNECT is authenticated (see ProveConnectIdentity).
+const externalAddrSize = 6
+
+// natTraversalState holds our port mapping and the external addresses advertised by peers.
+type natTraversalState struct {
+	mu         sync.Mutex
+	mapper     nat.PortMapper
+	mapping    *nat.Mapping
+	stop       chan struct{}
+	advertised map[netip.Addr]netip.AddrPort // External addresses peers proved in CONNECT
+	introduced map[netip.Addr]netip.AddrPort // External addresses of peers observed by the introducers that introduced them
+}
+
+// StartNATTraversal requests a port mapping for the local socket address from the gateway in the background.
+// The mapping is renewed periodically until StopNATTraversal is called.
+// Once mapped, the external address is advertised in CONNECT packets.
+func (m *Manager) StartNATTraversal(localAddr netip.AddrPort) {
+	m.StopNATTraversal()
+
+	stop := make(chan struct{})
+
+	m.natState.mu.Lock()
+	m.natState.stop = stop
+	m.natState.mu.Unlock()
+
+	go m.runNATTraversal(localAddr, stop)
+}
+
+func (m *Manager) runNATTraversal(localAddr netip.AddrPort, stop <-chan struct{}) {
+	mapper, err := nat.Discover(localAddr.Addr())
+	if err != nil {
+		logger.Warnf("NAT traversal unavailable: %v", err)
+		return
+	}
+
+	for {
+		mapping, err := mapper.AddMapping(localAddr.Port(), common.NAT_MAPPING_LIFETIME)
+
+		renewIn := common.NAT_MAPPING_RETRY_DELAY
+		if err != nil {
+			logger.Warnf("Failed to map port %d via %s: %v", localAddr.Port(), mapper.Name(), err)
+		} else {
+			m.natState.mu.Lock()
+			if m.natState.mapping == nil || m.natState.mapping.External != mapping.External {
+				logger.Infof("Mapped %s to external address %s via %s", localAddr, mapping.External, mapper.Name())
+			}
+			m.natState.mapper = mapper
+			m.natState.mapping = &mapping
+			m.natState.mu.Unlock()
+
+			renewIn = mapping.Lifetime / 2
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(renewIn):
+		}
+	}
+}
+
+// StopNATTraversal stops renewing the port mapping and removes it from the gateway.
+// Does nothing if NAT traversal isn't running.
+func (m *Manager) StopNATTraversal() {
+	m.natState.mu.Lock()
+	stop, mapper, mapping := m.natState.stop, m.natState.mapper, m.natState.mapping
+	m.natState.stop, m.natState.mapper, m.natState.mapping = nil, nil, nil
+	m.natState.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+	}
+
+	if mapper != nil && mapping != nil {
+		if err := mapper.DeleteMapping(*mapping); err != nil {
+			logger.Debugf("Failed to delete port mapping %s: %v", mapping.External, err)
+		}
+	}
+}
+
+// GetExternalAddress returns the external address of the current port mapping.
+func (m *Manager) GetExternalAddress() (netip.AddrPort, bool) {
+	m.natState.mu.Lock()
+	defer m.natState.mu.Unlock()
+
+	if m.natState.mapping == nil {
+		return netip.AddrPort{}, false
+	}
+	return m.natState.mapping.External, true
+}
+
+// appendExternalAddress appends the external address to a CONNECT payload if a port mapping exists.
+func (m *Manager) appendExternalAddress(payload pkt.Payload) pkt.Payload {
+	external, ok := m.GetExternalAddress()
+	if !ok {
+		return payload
+	}
+	return appendAddrPort(payload, external)
+}
+
+// appendAddrPort appends an IPv4 address and port (6 bytes) to the payload.
+func appendAddrPort(payload pkt.Payload, addrPort netip.AddrPort) pkt.Payload {
+	addr := addrPort.Addr().As4()
+	payload = append(payload, addr[:]...)
+	return binary.BigEndian.AppendUint16(payload, addrPort.Port())
+}
+
+// parseAddrPort parses an IPv4 address and port (6 bytes) from the start of data.
+func parseAddrPort(data []byte) netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte(data[:4])), binary.BigEndian.Uint16(data[4:6]))
+}
+
+// ParseExternalAddress parses the optional external address following the boot epoch of a CONNECT payload.
+func ParseExternalAddress(rest pkt.Payload) (netip.AddrPort, bool) {
+	if len(rest) < externalAddrSize {
+		return netip.AddrPort{}, false
+	}
+	return parseAddrPort(rest), true
+}
+
+// RecordAdvertisedAddress remembers the external (NAT) address or the socket of a node ID a peer proved on its CONNECT.
+func (m *Manager) RecordAdvertisedAddress(addr netip.Addr, external netip.AddrPort) {
+	m.natState.mu.Lock()
+	defer m.natState.mu.Unlock()
+
+	m.natState.advertised[addr] = external
+}
+
+// IsValidSender returns whether a packet with the source address srcAddr may have been sent from sender.
+// This is the case if the addresses match or if the peer proved on its CONNECT that it sends from sender (see ProveConnectIdentity).
+func (m *Manager) IsValidSender(srcAddr netip.Addr, sender netip.AddrPort) bool {
+	if srcAddr == sender.Addr() {
+		return true
+	}
+
+	m.natState.mu.Lock()
+	defer m.natState.mu.Unlock()
+
+	return m.natState.advertised[srcAddr] == sender
+}
+
+// clearAdvertisedAddress forgets the advertised external address of the peer.
+func (m *Manager) clearAdvertisedAddress(addr netip.Addr) {
+	m.natState.mu.Lock()
+	defer m.natState.mu.Unlock()
+
+	delete(m.natState.advertised, addr)
+}
+
+// RecordIntroduction remembers the external address of an introduced peer, so its CONNECT from that address is accepted (see IsIntroducedAt).
+// Only introductions sent by the introducer itself count, sender is the address the introduction was received from.
+func (m *Manager) RecordIntroduction(introducer netip.Addr, sender netip.AddrPort, introduction *Introduction) {
+	if isNeighbor, addrPort := m.router.IsNeighbor(introducer); !isNeighbor || addrPort != sender {
+		return
+	}
+
+	m.natState.mu.Lock()
+	defer m.natState.mu.Unlock()
+
+	m.natState.introduced[introduction.Peer] = introduction.PeerExternal
+}
+
+// IsIntroducedAt returns whether an introducer observed the peer addr at sender.
+func (m *Manager) IsIntroducedAt(addr netip.Addr, sender netip.AddrPort) bool {
+	m.natState.mu.Lock()
+	defer m.natState.mu.Unlock()
+
+	introduced, exists := m.natState.introduced[addr]
+	return exists && introduced == sender
+}
+
+// clearIntroduction forgets the introduced external address of an unreachable peer.
+func (m *Manager) clearIntroduction(addr netip.Addr) {
+	m.natState.mu.Lock()
+	defer m.natState.mu.Unlock()
+
+	delete(m.natState.introduced, addr)
+}
@@ -0,0 +1,93 @@
+package connection
+
+import (
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// netemState impairs the datagrams the node writes to its socket like Linux netem, e.g. to soak test the protocol on loopback.
+// Dropped datagrams are reported as sent, so the protocol only notices the loss by missing ACKs.
+type netemState struct {
+	mu        sync.Mutex
+	config    NetemConfig
+	dropped   atomic.Uint64
+	reordered atomic.Uint64
+}
+
+// NetemConfig configures the impairment of outgoing datagrams, the zero value disables it.
+type NetemConfig struct {
+	Loss    float64 // Probability in [0, 1] that a datagram is dropped
+	Reorder float64 // Probability in [0, 1] that a datagram is held back for common.NETEM_REORDER_DELAY, so the following datagrams overtake it
+}
+
+// NetemStats counts the impaired datagrams.
+type NetemStats struct {
+	Dropped   uint64
+	Reordered uint64
+}
+
+// Enabled returns whether any datagram is impaired.
+func (c NetemConfig) Enabled() bool {
+	return c.Loss > 0 || c.Reorder > 0
+}
+
+// SetNetem sets the impairment of the datagrams sent from now on.
+func (m *Manager) SetNetem(config NetemConfig) {
+	m.netem.mu.Lock()
+	defer m.netem.mu.Unlock()
+
+	m.netem.config = config
+}
+
+// Netem returns the impairment of outgoing datagrams.
+func (m *Manager) Netem() NetemConfig {
+	m.netem.mu.Lock()
+	defer m.netem.mu.Unlock()
+
+	return m.netem.config
+}
+
+// NetemStats returns the number of datagrams impaired since the node started.
+func (m *Manager) NetemStats() NetemStats {
+	return NetemStats{
+		Dropped:   m.netem.dropped.Load(),
+		Reordered: m.netem.reordered.Load(),
+	}
+}
+
+// writeToSocket writes a serialized packet to the next hop, impaired as configured with SetNetem.
+// data isn't retained, a held back datagram is copied.
+func (m *Manager) writeToSocket(nextHop *net.UDPAddr, data []byte) error {
+	config := m.Netem()
+	if !config.Enabled() {
+		return m.socket.SendTo(nextHop, data)
+	}
+
+	if rand.Float64() < config.Loss {
+		m.netem.dropped.Add(1)
+		return nil
+	}
+
+	if rand.Float64() < config.Reorder {
+		m.netem.reordered.Add(1)
+
+		held := append([]byte(nil), data...)
+		time.AfterFunc(common.NETEM_REORDER_DELAY, func() {
+			defer panics.Recover("sending a held back datagram to %v", nextHop)
+
+			if err := m.socket.SendTo(nextHop, held); err != nil {
+				logger.Debugf("Failed to send held back datagram to %v: %v", nextHop, err)
+			}
+		})
+		return nil
+	}
+
+	return m.socket.SendTo(nextHop, data)
+}
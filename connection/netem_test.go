@@ -0,0 +1,67 @@
+package connection
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// TestNetemImpairsDatagrams verifies that dropped datagrams never arrive and held back datagrams are overtaken by later ones.
+func TestNetemImpairsDatagrams(t *testing.T) {
+	network := sock.NewMemoryNetwork()
+	socket := network.NewSocket()
+	if _, err := socket.Open(net.IPv4(10, 0, 0, 1)); err != nil {
+		t.Fatalf("Failed to open socket: %v", err)
+	}
+	peerSocket := network.NewSocket()
+	peer, err := peerSocket.Open(net.IPv4(10, 0, 0, 2))
+	if err != nil {
+		t.Fatalf("Failed to open peer socket: %v", err)
+	}
+	received := peerSocket.Subscribe()
+
+	m := NewManager(socket, routing.NewRouter(socket), sequencing.NewIncomingPktNumHandler(socket), sequencing.NewOutgoingPktNumHandler(common.INITIAL_CWND, common.IGNORE_CWND), reconstruction.NewManager())
+	send := func(pktNum byte) {
+		packet := m.buildPacket(pkt.MsgTypeAcknowledgment, nil, peer.AddrPort().Addr(), [4]byte{0, 0, 0, pktNum})
+		if err := m.sendPacketTo(peer.AddrPort(), packet); err != nil {
+			t.Fatalf("Failed to send packet %d: %v", pktNum, err)
+		}
+	}
+
+	m.SetNetem(NetemConfig{Loss: 1})
+	send(1)
+
+	m.SetNetem(NetemConfig{Reorder: 1})
+	send(2)
+
+	m.SetNetem(NetemConfig{})
+	send(3)
+
+	var order []byte
+	for len(order) < 2 {
+		select {
+		case datagram := <-received:
+			packet, err := pkt.ParsePacket(datagram.Data)
+			if err != nil {
+				t.Fatalf("Failed to parse received datagram: %v", err)
+			}
+			order = append(order, packet.Header.PktNum[3])
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for the datagrams, received %v", order)
+		}
+	}
+
+	if string(order) != string([]byte{3, 2}) {
+		t.Errorf("Received packets %v, want [3 2]", order)
+	}
+	if stats := m.NetemStats(); stats.Dropped != 1 || stats.Reordered != 1 {
+		t.Errorf("Got %+v, want 1 dropped and 1 reordered", stats)
+	}
+}
@@ -0,0 +1,222 @@
+package connection
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// Path recording is a debug mode to find routing loops and asymmetric routes.
+// Packets built by a node in this mode carry an ExtTypePath extension with the address of the node.
+// Every node that forwards a packet with this extension appends its address, up to common.PATH_RECORD_MAX_HOPS addresses.
+// A node that finds its own address in the recorded path logs a routing loop with the full path.
+// Forwarding nodes append their address also if they aren't in the debug mode themselves.
+// The path is kept within the extension reserve of the packet (see pkt.Packet.ExtensionReserveLeft), further hops aren't recorded.
+// Piggybacked ACKs leave room for common.PATH_RECORD_MAX_HOPS addresses, so the path only stays short if the source added other extensions.
+//
+// Path traces use the MTU probe message type and are unsequenced like probes, the packet number field carries a trace ID.
+// Traces always record their path, independent of the debug mode.
+//
+// Trace payload:
+//
+//	+----------+
+//	| 0x02     |
+//	+----------+
+//
+// Trace reply payload:
+//
+//	+----------+-----------------------------------------------+
+//	| 0x03     | Path recorded by the trace (32 bits per hop)  |
+//	+----------+-----------------------------------------------+
+const (
+	traceRequest = 0x02
+	traceReply   = 0x03
+)
+
+// pathRecordState holds the path recording debug mode and the open traces.
+type pathRecordState struct {
+	enabled atomic.Bool
+	mu      sync.Mutex
+	pending map[uint32]chan<- TracedPath // Open traces by trace ID
+}
+
+// TracedPath is the result of a path trace.
+// Both paths start at their source, a path with common.PATH_RECORD_MAX_HOPS addresses may be truncated.
+type TracedPath struct {
+	Forward []netip.Addr // Path of the trace to the destination, excluding the destination
+	Return  []netip.Addr // Path of the reply back to us, excluding us
+}
+
+// SetPathRecording enables or disables recording the path of our packets.
+func (m *Manager) SetPathRecording(enabled bool) {
+	m.pathRecord.enabled.Store(enabled)
+}
+
+// IsPathRecordingEnabled returns whether the path of our packets is recorded.
+func (m *Manager) IsPathRecordingEnabled() bool {
+	return m.pathRecord.enabled.Load()
+}
+
+// startPath adds an ExtTypePath extension with our address to the packet if it fits into the extension reserve.
+// The checksum must be (re)calculated afterwards.
+func (m *Manager) startPath(packet *pkt.Packet) {
+	if packet.ExtensionReserveLeft() < pkt.ExtensionSize(packet.Header.SourceAddr[:]) {
+		return
+	}
+	packet.SetRecordedPath([][4]byte{packet.Header.SourceAddr})
+}
+
+// unrecordedPathBytes returns the number of bytes the recorded path of the packet can still grow by, zero if no path is recorded.
+func unrecordedPathBytes(packet *pkt.Packet) int {
+	path, recorded := packet.GetRecordedPath()
+	if !recorded {
+		return 0
+	}
+	return max(common.PATH_RECORD_MAX_HOPS-len(path), 0) * 4
+}
+
+// recordHop appends our address to the recorded path of a packet we forward.
+// Logs a routing loop if we are already part of the path.
+// The checksum must be (re)calculated afterwards.
+func (m *Manager) recordHop(packet *pkt.Packet) {
+	path, recorded := packet.GetRecordedPath()
+	if !recorded {
+		return
+	}
+
+	localAddr := m.socket.MustGetLocalAddress().Addr().As4()
+	if slices.Contains(path, localAddr) {
+		logger.Warnf("Routing loop: %s %d from %v to %v passed us again, path: %s", msgTypeNames[packet.GetMessageType()], packet.Header.PktNum,
+			netip.AddrFrom4(packet.Header.SourceAddr), netip.AddrFrom4(packet.Header.DestAddr), FormatPath(append(toAddrs(path), netip.AddrFrom4(localAddr))))
+	}
+
+	if len(path) >= common.PATH_RECORD_MAX_HOPS || packet.ExtensionReserveLeft() < len(localAddr) {
+		return
+	}
+	packet.SetRecordedPath(append(path, localAddr))
+}
+
+// TracePath sends a trace to the destination and returns the paths recorded by the trace and its reply.
+// Blocks until the reply arrives or common.MTU_PROBE_TIMEOUT passes.
+func (m *Manager) TracePath(destAddr netip.Addr) (TracedPath, error) {
+	nextHop, found := m.router.GetNextHop(destAddr)
+	if !found {
+		return TracedPath{}, fmt.Errorf("%w %s", ErrNoRoute, destAddr)
+	}
+
+	traceID := m.nextProbeID.Add(1)
+	replyChan := make(chan TracedPath, 1)
+
+	m.pathRecord.mu.Lock()
+	m.pathRecord.pending[traceID] = replyChan
+	m.pathRecord.mu.Unlock()
+
+	defer func() {
+		m.pathRecord.mu.Lock()
+		delete(m.pathRecord.pending, traceID)
+		m.pathRecord.mu.Unlock()
+	}()
+
+	var pktNum [4]byte
+	binary.BigEndian.PutUint32(pktNum[:], traceID)
+
+	packet := m.buildPacket(pkt.MsgTypeMTUProbe, pkt.Payload{traceRequest}, destAddr, pktNum)
+	if !m.IsPathRecordingEnabled() {
+		m.startPath(packet)
+		pkt.SetChecksum(packet)
+	}
+
+	err := m.sendPacketTo(nextHop, packet)
+	if err != nil {
+		return TracedPath{}, err
+	}
+
+	select {
+	case traced := <-replyChan:
+		return traced, nil
+	case <-time.After(common.MTU_PROBE_TIMEOUT):
+		return TracedPath{}, errors.New("no trace reply received")
+	}
+}
+
+// handleTrace processes a trace or trace reply that is destined for us.
+// Traces are answered with a reply carrying the recorded path, the reply records its own path.
+func (m *Manager) handleTrace(packet *pkt.Packet) error {
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+	path, _ := packet.GetRecordedPath()
+
+	switch packet.Payload[0] {
+	case traceRequest:
+		nextHop, found := m.router.GetNextHop(srcAddr)
+		if !found {
+			return fmt.Errorf("%w %s, the source of the trace", ErrNoRoute, srcAddr)
+		}
+
+		payload := make(pkt.Payload, 1, 1+len(path)*4)
+		payload[0] = traceReply
+		for _, addr := range path {
+			payload = append(payload, addr[:]...)
+		}
+
+		reply := m.buildPacket(pkt.MsgTypeMTUProbe, payload, srcAddr, packet.Header.PktNum)
+		if !m.IsPathRecordingEnabled() {
+			m.startPath(reply)
+			pkt.SetChecksum(reply)
+		}
+
+		return m.sendPacketTo(nextHop, reply)
+	case traceReply:
+		if (len(packet.Payload)-1)%4 != 0 {
+			return errors.New("malformed trace reply")
+		}
+
+		traced := TracedPath{Return: toAddrs(path)}
+		for i := 1; i < len(packet.Payload); i += 4 {
+			traced.Forward = append(traced.Forward, netip.AddrFrom4([4]byte(packet.Payload[i:i+4])))
+		}
+
+		traceID := binary.BigEndian.Uint32(packet.Header.PktNum[:])
+
+		m.pathRecord.mu.Lock()
+		replyChan, exists := m.pathRecord.pending[traceID]
+		m.pathRecord.mu.Unlock()
+
+		if exists {
+			select {
+			case replyChan <- traced:
+			default: // A reply for this trace was already delivered
+			}
+		}
+		return nil
+	default:
+		return errors.New("unknown trace kind")
+	}
+}
+
+// toAddrs converts a recorded path to addresses.
+func toAddrs(path [][4]byte) []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(path))
+	for _, addr := range path {
+		addrs = append(addrs, netip.AddrFrom4(addr))
+	}
+	return addrs
+}
+
+// FormatPath returns the path as "a -> b -> c".
+func FormatPath(path []netip.Addr) string {
+	hops := make([]string, 0, len(path))
+	for _, addr := range path {
+		hops = append(hops, addr.String())
+	}
+	return strings.Join(hops, " -> ")
+}
@@ -0,0 +1,59 @@
+package connection
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// TestRecordedPathStaysWithinReserve verifies that a full-size chunk with piggybacked ACKs, a path recorded over
+// common.PATH_RECORD_MAX_HOPS hops, a hop sequence number, a congestion mark and a MAC still fits its payload limit.
+func TestRecordedPathStaysWithinReserve(t *testing.T) {
+	network := sock.NewMemoryNetwork()
+	newManager := func(addr net.IP) *Manager {
+		socket := network.NewSocket()
+		if _, err := socket.Open(addr); err != nil {
+			t.Fatalf("Failed to open socket: %v", err)
+		}
+		t.Cleanup(func() { _ = socket.Close() })
+		return NewManager(socket, routing.NewRouter(socket), sequencing.NewIncomingPktNumHandler(socket), sequencing.NewOutgoingPktNumHandler(common.INITIAL_CWND, common.IGNORE_CWND), reconstruction.NewManager())
+	}
+
+	source := newManager(net.IPv4(10, 0, 0, 1))
+	source.SetPathRecording(true)
+	destAddr := netip.MustParseAddr("10.0.0.2")
+
+	source.piggyback.lastDataSent[destAddr] = time.Now()
+	for i := range common.MAX_PIGGYBACKED_ACKS {
+		source.piggyback.pending[destAddr] = append(source.piggyback.pending[destAddr], [4]byte{0, 0, 0, byte(i)})
+	}
+
+	payload := make(pkt.Payload, common.MAX_PAYLOAD_SIZE_BYTES)
+	packet := source.buildPacket(pkt.MsgTypeFileTransfer, payload, destAddr, [4]byte{})
+	source.attachPiggybackedAcks(packet)
+
+	for hop := 2; hop <= common.PATH_RECORD_MAX_HOPS; hop++ {
+		forwarder := newManager(net.IPv4(10, 0, 1, byte(hop)))
+		forwarder.recordHop(packet)
+	}
+	packet.AddExtension(pkt.ExtTypeHopSeq, binary.BigEndian.AppendUint32(nil, 1))
+	packet.AddExtension(pkt.ExtTypeCE, nil)
+
+	if path, _ := packet.GetRecordedPath(); len(path) != common.PATH_RECORD_MAX_HOPS {
+		t.Errorf("Recorded %d hops, want %d", len(path), common.PATH_RECORD_MAX_HOPS)
+	}
+
+	wire := packet.AppendAuthenticatedTo(nil, make([]byte, 32))
+	if extensions := len(wire) - pkt.HEADER_SIZE - len(payload); extensions > pkt.EXTENSION_RESERVE_BYTES {
+		t.Errorf("Extensions take %d bytes, the reserve is %d", extensions, pkt.EXTENSION_RESERVE_BYTES)
+	}
+}
@@ -0,0 +1,266 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/assert"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// PeerState is the state of the connection to a neighbor.
+// Connections move only along the transitions in peerTransitions, CONNECTs, DDs and DISCONNECTs drive them:
+//
+//	Down                       -> Connecting:           we sent a CONNECT
+//	Down, Connecting           -> EstablishedWaitingDD: a CONNECT was acknowledged in either direction, the peer is a neighbor
+//	EstablishedWaitingDD       -> Full:                 the peer's DD arrived and we sent it the LSAs it misses
+//	EstablishedWaitingDD, Full -> Disconnecting:       we sent a DISCONNECT
+//	any                        -> Down:                 our CONNECT wasn't acknowledged or the neighbor was removed
+type PeerState int
+
+const (
+	PeerDown                 PeerState = iota // No connection, also the state of unknown peers
+	PeerConnecting                            // Our CONNECT waits for its ACK
+	PeerEstablishedWaitingDD                  // The peer is a neighbor, its DD hasn't arrived yet
+	PeerFull                                  // The peer is a neighbor and sent its DD
+	PeerDisconnecting                         // Our DISCONNECT waits for its ACK
+)
+
+var peerStateNames = map[PeerState]string{
+	PeerDown:                 "Down",
+	PeerConnecting:           "Connecting",
+	PeerEstablishedWaitingDD: "EstablishedWaitingDD",
+	PeerFull:                 "Full",
+	PeerDisconnecting:        "Disconnecting",
+}
+
+func (s PeerState) String() string {
+	name, exists := peerStateNames[s]
+	if !exists {
+		return fmt.Sprintf("PeerState(%d)", int(s))
+	}
+	return name
+}
+
+// peerTransitions are the valid transitions per state.
+var peerTransitions = map[PeerState][]PeerState{
+	PeerDown:                 {PeerConnecting, PeerEstablishedWaitingDD},
+	PeerConnecting:           {PeerEstablishedWaitingDD, PeerDown},
+	PeerEstablishedWaitingDD: {PeerFull, PeerDisconnecting, PeerDown},
+	PeerFull:                 {PeerDisconnecting, PeerDown},
+	PeerDisconnecting:        {PeerDown},
+}
+
+// ConnectedPeer is a snapshot of the connection to a peer we were connected to or are connecting to.
+type ConnectedPeer struct {
+	Addr     netip.Addr
+	AddrPort netip.AddrPort // Address the peer is reached at
+	State    PeerState
+	Since    time.Time // Time of the last transition
+}
+
+// peerStateMachine holds the connection state per peer.
+// Peers stay in the Down state after a disconnect, so their last transition is still visible.
+type peerStateMachine struct {
+	mu    sync.Mutex
+	peers map[netip.Addr]*peerConnection
+}
+
+type peerConnection struct {
+	ConnectedPeer
+	ddReceived    bool               // The peer's DD arrived while our CONNECT was waiting for its ACK
+	cancelConnect context.CancelFunc // Gives up our CONNECT, set while it waits for its ACK
+}
+
+// transitionPeerLocked moves the connection to the peer to the state if the transition is valid.
+// Returns false and leaves the state unchanged otherwise.
+// The caller must hold m.peerStates.mu.
+func (m *Manager) transitionPeerLocked(addr netip.Addr, addrPort netip.AddrPort, to PeerState) bool {
+	peer, exists := m.peerStates.peers[addr]
+	if !exists {
+		peer = &peerConnection{ConnectedPeer: ConnectedPeer{Addr: addr, State: PeerDown}}
+		m.peerStates.peers[addr] = peer
+	}
+
+	if !slices.Contains(peerTransitions[peer.State], to) {
+		logger.Debugf("Ignoring transition of %v from %v to %v", addr, peer.State, to)
+		return false
+	}
+
+	logger.Debugf("Connection to %v: %v -> %v", addr, peer.State, to)
+
+	peer.State = to
+	peer.Since = time.Now()
+	if addrPort.IsValid() {
+		peer.AddrPort = addrPort
+	}
+	if to == PeerDown || to == PeerConnecting {
+		peer.ddReceived = false
+	}
+	if to != PeerConnecting {
+		peer.cancelConnect = nil
+	}
+	return true
+}
+
+// transitionPeer is like transitionPeerLocked but acquires the lock.
+func (m *Manager) transitionPeer(addr netip.Addr, addrPort netip.AddrPort, to PeerState) bool {
+	m.peerStates.mu.Lock()
+	defer m.peerStates.mu.Unlock()
+
+	return m.transitionPeerLocked(addr, addrPort, to)
+}
+
+// GetPeerState returns the state of the connection to the peer.
+// Can be called concurrently.
+func (m *Manager) GetPeerState(addr netip.Addr) PeerState {
+	m.peerStates.mu.Lock()
+	defer m.peerStates.mu.Unlock()
+
+	peer, exists := m.peerStates.peers[addr]
+	if !exists {
+		return PeerDown
+	}
+	return peer.State
+}
+
+// ConnectedPeers returns the peers we are, were or are becoming connected to, sorted by address.
+// Can be called concurrently.
+func (m *Manager) ConnectedPeers() []ConnectedPeer {
+	neighbors := m.router.GetNeighbors()
+
+	m.peerStates.mu.Lock()
+	peers := make([]ConnectedPeer, 0, len(m.peerStates.peers))
+	for _, peer := range m.peerStates.peers {
+		snapshot := peer.ConnectedPeer
+		if nextHop, isNeighbor := neighbors[peer.Addr]; isNeighbor {
+			snapshot.AddrPort = nextHop // The neighbor may have moved, see ApplyRebind
+		}
+		peers = append(peers, snapshot)
+	}
+	m.peerStates.mu.Unlock()
+
+	slices.SortFunc(peers, func(a, b ConnectedPeer) int {
+		return a.Addr.Compare(b.Addr)
+	})
+	return peers
+}
+
+// EstablishNeighbor makes the peer at addrPort a neighbor after its CONNECT was acknowledged in either direction.
+// The peer is added to the router, our LSA is flooded and a DD is sent to the peer, the connection waits for the peer's DD.
+// Returns false if the peer is already established, e.g. because both peers sent a CONNECT at the same time.
+func (m *Manager) EstablishNeighbor(addr netip.Addr, addrPort netip.AddrPort) bool {
+	m.peerStates.mu.Lock()
+	if !m.transitionPeerLocked(addr, addrPort, PeerEstablishedWaitingDD) {
+		m.peerStates.mu.Unlock()
+		return false
+	}
+	if m.peerStates.peers[addr].ddReceived {
+		m.transitionPeerLocked(addr, addrPort, PeerFull)
+	}
+	m.peerStates.mu.Unlock()
+
+	m.router.AddNeighborVia(addr, addrPort)
+
+	localAddr := m.socket.MustGetLocalAddress().Addr()
+
+	localLSA, exists := m.router.GetLSA(localAddr)
+	assert.Assert(exists, "Local LSA should exist for the local address")
+	m.FloodLSA(localAddr, localLSA)
+
+	err := m.SendDD(addr, addrPort)
+	if err != nil {
+		logger.Warnf("Failed to send database description to %s: %v", addrPort, err)
+	}
+
+	m.NotifyConnected(addr, addrPort)
+	return true
+}
+
+// DefersCrossedConnect returns whether a CONNECT of the peer crossed our own CONNECT to it and only our CONNECT establishes the connection.
+// If two peers connect to each other at the same time, the peer with the lower address is the master.
+// The master acknowledges the other peer's CONNECT but establishes the connection only once its own CONNECT is acknowledged.
+// The other peer establishes the connection with whatever arrives first, the master's CONNECT or the ACK of its own CONNECT.
+// So both peers add each other as neighbor and send their DD exactly once.
+func (m *Manager) DefersCrossedConnect(addr netip.Addr) bool {
+	localAddr := m.socket.MustGetLocalAddress().Addr()
+	return localAddr.Less(addr) && m.GetPeerState(addr) == PeerConnecting
+}
+
+// HandleNeighborDD records that the DD of the peer arrived.
+// A DD that overtakes the ACK of our CONNECT completes the connection once the ACK arrives.
+func (m *Manager) HandleNeighborDD(addr netip.Addr) {
+	m.peerStates.mu.Lock()
+	defer m.peerStates.mu.Unlock()
+
+	peer, exists := m.peerStates.peers[addr]
+	if !exists {
+		return
+	}
+
+	switch peer.State {
+	case PeerConnecting:
+		peer.ddReceived = true
+	case PeerEstablishedWaitingDD:
+		m.transitionPeerLocked(addr, netip.AddrPort{}, PeerFull)
+	}
+}
+
+// RemoveNeighbor removes the neighbor from the router, clears the state of hosts that became unreachable and moves the connection to Down.
+// Our LSA isn't flooded, callers flood it if the neighbor doesn't reconnect immediately.
+func (m *Manager) RemoveNeighbor(addr netip.Addr) {
+	m.transitionPeer(addr, netip.AddrPort{}, PeerDown)
+	m.clearCapabilities(addr)
+
+	unreachableHosts := m.router.RemoveNeighbor(addr)
+	m.ClearUnreachableHosts(unreachableHosts)
+}
+
+// DisconnectNeighbor sends a DISCONNECT to the neighbor and removes it once the DISCONNECT is acknowledged or its retries are exhausted.
+// The returned channel receives whether the DISCONNECT was acknowledged, the neighbor is removed either way.
+// After the disconnect the peer might be still reachable through other neighbors, but the direct connection is closed.
+func (m *Manager) DisconnectNeighbor(addr netip.Addr) (<-chan bool, error) {
+	if isNeighbor, _ := m.router.IsNeighbor(addr); !isNeighbor {
+		return nil, fmt.Errorf("%w: not connected to %s", ErrPeerUnknown, addr)
+	}
+
+	if !m.transitionPeer(addr, netip.AddrPort{}, PeerDisconnecting) {
+		return nil, fmt.Errorf("already disconnecting from %s", addr)
+	}
+
+	packet := m.BuildSequencedPacket(pkt.MsgTypeDisconnect, nil, addr)
+
+	ackChan, err := m.SendReliableRoutedPacket(context.Background(), packet)
+	if err != nil {
+		m.removeDisconnectedNeighbor(addr)
+		return nil, fmt.Errorf("failed to send disconnect message: %w", err)
+	}
+
+	done := make(chan bool, 1)
+
+	go func() {
+		defer panics.Recover("handling disconnect acknowledgment of %s", addr)
+
+		success := <-ackChan
+		m.removeDisconnectedNeighbor(addr)
+		done <- success
+	}()
+
+	return done, nil
+}
+
+// removeDisconnectedNeighbor removes the neighbor we disconnected from and floods our LSA without it.
+func (m *Manager) removeDisconnectedNeighbor(addr netip.Addr) {
+	m.RemoveNeighbor(addr)
+
+	localAddr := m.socket.MustGetLocalAddress().Addr()
+	localLSA, exists := m.router.GetLSA(localAddr)
+	assert.Assert(exists, "LSA should exist for the local address")
+	m.FloodLSA(localAddr, localLSA)
+}
@@ -0,0 +1,84 @@
+package connection
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// peerTrafficState accounts the packets we exchange with other hosts as source or destination, transit traffic is accounted in forwardingStatsState.
+// The counters are kept when a peer becomes unreachable, so the last contact of lost peers stays known.
+type peerTrafficState struct {
+	mu    sync.Mutex
+	peers map[netip.Addr]*PeerTraffic
+}
+
+// PeerTraffic is a snapshot of the packets exchanged with a peer, including retransmissions and ACKs.
+type PeerTraffic struct {
+	Sent     TrafficCounter // Packets originated by us to the peer
+	Received TrafficCounter // Packets originated by the peer to us
+	LastSent time.Time
+	LastSeen time.Time // Last packet received from the peer, zero if none was received
+}
+
+// peerTrafficLocked returns the counters of the peer and creates them if they don't exist.
+// Must be called with m.peerTraffic.mu held.
+func (m *Manager) peerTrafficLocked(addr netip.Addr) *PeerTraffic {
+	traffic, exists := m.peerTraffic.peers[addr]
+	if !exists {
+		traffic = &PeerTraffic{}
+		m.peerTraffic.peers[addr] = traffic
+	}
+	return traffic
+}
+
+// recordSent accounts a packet sent to the next hop if we originated it.
+// Forwarded packets and relay encapsulations (accounted with their inner packet) are ignored.
+func (m *Manager) recordSent(packet *pkt.Packet) {
+	localAddr, err := m.socket.GetLocalAddress()
+	if err != nil || packet.GetMessageType() == pkt.MsgTypeRelay || netip.AddrFrom4(packet.Header.SourceAddr) != localAddr.Addr() {
+		return
+	}
+
+	m.peerTraffic.mu.Lock()
+	defer m.peerTraffic.mu.Unlock()
+
+	traffic := m.peerTrafficLocked(netip.AddrFrom4(packet.Header.DestAddr))
+	traffic.Sent = traffic.Sent.add(uint64(packet.Size()))
+	traffic.LastSent = time.Now()
+}
+
+// RecordReceived accounts a packet addressed to us and updates the last-seen time of its source.
+func (m *Manager) RecordReceived(packet *pkt.Packet) {
+	m.peerTraffic.mu.Lock()
+	defer m.peerTraffic.mu.Unlock()
+
+	traffic := m.peerTrafficLocked(netip.AddrFrom4(packet.Header.SourceAddr))
+	traffic.Received = traffic.Received.add(uint64(packet.Size()))
+	traffic.LastSeen = time.Now()
+}
+
+// GetPeerTraffic returns the packets exchanged with the peer.
+// Returns false if no packet was exchanged with the peer.
+func (m *Manager) GetPeerTraffic(addr netip.Addr) (PeerTraffic, bool) {
+	m.peerTraffic.mu.Lock()
+	defer m.peerTraffic.mu.Unlock()
+
+	traffic, exists := m.peerTraffic.peers[addr]
+	if !exists {
+		return PeerTraffic{}, false
+	}
+	return *traffic, true
+}
+
+// IncomingTransfers returns whether a message or file is currently being received from the peer and the bytes of the file received so far.
+func (m *Manager) IncomingTransfers(addr netip.Addr) (receivingMsg bool, receivingFile bool, fileBytes int64) {
+	_, receivingMsg = m.reconstructors.GetMsgReconstructor(addr)
+	file, receivingFile := m.reconstructors.GetFileReconstructor(addr)
+	if receivingFile {
+		fileBytes = file.GetStats().Bytes
+	}
+	return receivingMsg, receivingFile, fileBytes
+}
@@ -0,0 +1,124 @@
+package connection
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// ACKs for a peer we are currently sending data to are held back for a short time,
+// so they can ride on the next outgoing MSG/FILE packet to that peer instead of using a dedicated datagram.
+// piggybackState holds the ACKs that are held back.
+type piggybackState struct {
+	mu           sync.Mutex
+	pending      map[netip.Addr][][4]byte   // Packet numbers waiting to be acknowledged per peer
+	flushTimers  map[netip.Addr]*time.Timer // Sends the pending ACKs as standalone ACKs if no data packet picks them up
+	lastDataSent map[netip.Addr]time.Time   // Time of the last MSG/FILE packet sent to the peer
+}
+
+// isDataMsgType returns whether packets of the message type can carry piggybacked ACKs.
+func isDataMsgType(msgType byte) bool {
+	return msgType == pkt.MsgTypeChatMessage || msgType == pkt.MsgTypeFileTransfer
+}
+
+// queueAcknowledgment tries to hold back an ACK for piggybacking.
+// Returns false if there is no recent data traffic to the peer, in which case the ACK should be sent immediately.
+func (m *Manager) queueAcknowledgment(addr netip.Addr, pktNum [4]byte) bool {
+	if !common.ACK_PIGGYBACKING {
+		return false
+	}
+
+	m.piggyback.mu.Lock()
+	defer m.piggyback.mu.Unlock()
+
+	if time.Since(m.piggyback.lastDataSent[addr]) > common.ACK_PIGGYBACK_ACTIVITY_WINDOW {
+		return false // Not exchanging data in both directions, don't delay the ACK
+	}
+
+	m.piggyback.pending[addr] = append(m.piggyback.pending[addr], pktNum)
+
+	if _, exists := m.piggyback.flushTimers[addr]; !exists {
+		m.piggyback.flushTimers[addr] = time.AfterFunc(common.ACK_PIGGYBACK_DELAY, func() {
+			defer panics.Recover("flushing acknowledgments to %s", addr)
+			m.flushPendingAcknowledgments(addr)
+		})
+	}
+
+	return true
+}
+
+// flushPendingAcknowledgments sends all pending ACKs of the peer as standalone ACK packets.
+func (m *Manager) flushPendingAcknowledgments(addr netip.Addr) {
+	m.piggyback.mu.Lock()
+	pending := m.piggyback.pending[addr]
+	delete(m.piggyback.pending, addr)
+	delete(m.piggyback.flushTimers, addr)
+	m.piggyback.mu.Unlock()
+
+	for _, pktNum := range pending {
+		err := m.sendRoutedAcknowledgment(addr, pktNum)
+		if err != nil {
+			logger.Debugf("Failed to send pending ACK %v to %s: %v", pktNum, addr, err)
+		}
+	}
+}
+
+// attachPiggybackedAcks adds pending ACKs for the destination to an outgoing data packet and updates its checksum.
+// Only as many ACKs are added as fit into the extension reserve of the packet (see pkt.Packet.ExtensionReserveLeft).
+// Must be called before the packet is sent for the first time.
+// Non-data packets are left unchanged.
+func (m *Manager) attachPiggybackedAcks(packet *pkt.Packet) {
+	if !common.ACK_PIGGYBACKING || !isDataMsgType(packet.GetMessageType()) {
+		return
+	}
+
+	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
+
+	m.piggyback.mu.Lock()
+	defer m.piggyback.mu.Unlock()
+
+	m.piggyback.lastDataSent[destAddr] = time.Now()
+
+	pending := m.piggyback.pending[destAddr]
+	if len(pending) == 0 {
+		return
+	}
+
+	space := packet.ExtensionReserveLeft() - unrecordedPathBytes(packet) // The recorded path keeps room to grow by an address per hop
+	n := min(len(pending), common.MAX_PIGGYBACKED_ACKS, space/pkt.ExtensionSize(make([]byte, 4)))
+	if n <= 0 {
+		return // The pending ACKs wait for the next data packet or the flush timer
+	}
+	for _, pktNum := range pending[:n] {
+		packet.AddExtension(pkt.ExtTypeAck, pktNum[:])
+	}
+	pkt.SetChecksum(packet)
+
+	if n == len(pending) {
+		delete(m.piggyback.pending, destAddr)
+		if timer, exists := m.piggyback.flushTimers[destAddr]; exists {
+			timer.Stop()
+			delete(m.piggyback.flushTimers, destAddr)
+		}
+	} else {
+		m.piggyback.pending[destAddr] = pending[n:]
+	}
+}
+
+// clearPiggybackState drops pending ACKs and activity tracking of the peer.
+func (m *Manager) clearPiggybackState(addr netip.Addr) {
+	m.piggyback.mu.Lock()
+	defer m.piggyback.mu.Unlock()
+
+	if timer, exists := m.piggyback.flushTimers[addr]; exists {
+		timer.Stop()
+	}
+	delete(m.piggyback.flushTimers, addr)
+	delete(m.piggyback.pending, addr)
+	delete(m.piggyback.lastDataSent, addr)
+}
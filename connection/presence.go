@@ -0,0 +1,147 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// Presence statuses, the first byte of the PRESENCE payload.
+const (
+	PresenceOnline  byte = 0x0
+	PresenceAway    byte = 0x1
+	PresenceTyping  byte = 0x2 // Followed by the IPv4 address of the peer that is typed to
+	PresenceOffline byte = 0x3
+)
+
+var presenceStatusNames = map[byte]string{
+	PresenceOnline:  "online",
+	PresenceAway:    "away",
+	PresenceTyping:  "typing",
+	PresenceOffline: "offline",
+}
+
+// ErrPresenceRateLimited is returned if no presence update was sent because all hosts received one within common.PRESENCE_MIN_INTERVAL.
+var ErrPresenceRateLimited = errors.New("presence update rate limited")
+
+// presenceLimitState holds the times of the last presence updates per host, to rate limit them in both directions.
+type presenceLimitState struct {
+	mu           sync.Mutex
+	lastSent     map[netip.Addr]time.Time
+	lastAccepted map[netip.Addr]time.Time
+}
+
+// PresenceStatusString returns the name of a presence status.
+func PresenceStatusString(status byte) string {
+	if name, exists := presenceStatusNames[status]; exists {
+		return name
+	}
+	return "unknown"
+}
+
+// SendPresence sends a presence update to all reachable hosts, typing updates are only sent to the target.
+// Presence updates are unreliable, they are neither acknowledged nor resent.
+// Hosts that received an update within common.PRESENCE_MIN_INTERVAL are skipped to avoid flooding the network.
+// Returns the number of hosts the update was sent to.
+func (m *Manager) SendPresence(status byte, target netip.Addr) (int, error) {
+	if _, exists := presenceStatusNames[status]; !exists {
+		return 0, errors.New("unknown presence status")
+	}
+
+	payload := pkt.Payload{status}
+	var destinations []netip.Addr
+	if status == PresenceTyping {
+		payload = append(payload, target.AsSlice()...)
+		destinations = []netip.Addr{target}
+	} else {
+		for dest := range m.router.GetRoutingTable() {
+			destinations = append(destinations, dest)
+		}
+	}
+
+	sent := 0
+	var lastErr error
+	for _, dest := range destinations {
+		if !m.reservePresence(m.presenceLimits.lastSent, dest) {
+			continue
+		}
+
+		nextHop, found := m.router.GetNextHop(dest)
+		if !found {
+			lastErr = fmt.Errorf("%w %s", ErrNoRoute, dest)
+			continue
+		}
+
+		err := m.sendPacketTo(nextHop, m.buildPacket(pkt.MsgTypePresence, payload, dest, [4]byte{}))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+
+	if sent == 0 {
+		if lastErr != nil {
+			return 0, lastErr
+		}
+		if len(destinations) > 0 {
+			return 0, ErrPresenceRateLimited
+		}
+	}
+	return sent, nil
+}
+
+// AcceptPresence returns whether a presence update from the host should be processed.
+// Updates received within common.PRESENCE_MIN_INTERVAL of the last accepted update are dropped.
+func (m *Manager) AcceptPresence(srcAddr netip.Addr) bool {
+	return m.reservePresence(m.presenceLimits.lastAccepted, srcAddr)
+}
+
+// reservePresence records an update for the host in lastUpdates if the last one is at least common.PRESENCE_MIN_INTERVAL ago.
+func (m *Manager) reservePresence(lastUpdates map[netip.Addr]time.Time, addr netip.Addr) bool {
+	m.presenceLimits.mu.Lock()
+	defer m.presenceLimits.mu.Unlock()
+
+	now := time.Now()
+	if last, exists := lastUpdates[addr]; exists && now.Sub(last) < common.PRESENCE_MIN_INTERVAL {
+		return false
+	}
+	lastUpdates[addr] = now
+	return true
+}
+
+// clearPresenceLimits forgets the presence updates of an unreachable host.
+func (m *Manager) clearPresenceLimits(addr netip.Addr) {
+	m.presenceLimits.mu.Lock()
+	defer m.presenceLimits.mu.Unlock()
+
+	delete(m.presenceLimits.lastSent, addr)
+	delete(m.presenceLimits.lastAccepted, addr)
+}
+
+// ParsePresencePayload parses the payload of a PRESENCE packet.
+// target is only valid for PresenceTyping.
+func ParsePresencePayload(payload pkt.Payload) (status byte, target netip.Addr, err error) {
+	if len(payload) < 1 {
+		return 0, netip.Addr{}, errors.New("empty presence payload")
+	}
+
+	status = payload[0]
+	if _, exists := presenceStatusNames[status]; !exists {
+		return 0, netip.Addr{}, errors.New("unknown presence status")
+	}
+
+	if status == PresenceTyping {
+		if len(payload) < 5 {
+			return 0, netip.Addr{}, errors.New("typing presence payload is too short to contain the target address")
+		}
+		target = netip.AddrFrom4([4]byte(payload[1:5]))
+	}
+
+	return status, target, nil
+}
@@ -0,0 +1,123 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// REBIND packets are sent to all direct neighbors after our socket moved to a new address, e.g. after a network change.
+// The source address in the header stays our address in the protocol, the packet is sent from the new socket address.
+// Payload:
+//
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|                        Boot Epoch (64 bits)                           |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|   Old IPv4 Address (32 bits)      | Old Port (16)   |
+//	+--------+--------+--------+--------+--------+--------+
+//
+// Neighbors only accept the new address if the boot epoch is the one they know and the old address is the one they reached us at.
+// Neighbor relationships, the LSDB and packet numbers are kept on both sides.
+const rebindPayloadSize = BOOT_EPOCH_SIZE + 6
+
+// Rebind moves the socket to the IPv4 address and tells all direct neighbors to reach us there.
+// Relayed neighbors are reached through their relay, which learns the new address like every direct neighbor.
+// Returns the new socket address. The neighbors are notified in the background.
+func (m *Manager) Rebind(ipv4addr net.IP) (netip.AddrPort, error) {
+	oldAddr, err := m.socket.GetBoundAddress()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if external, mapped := m.GetExternalAddress(); mapped {
+		oldAddr = external // Neighbors reach us at the external address of the port mapping
+	}
+
+	newAddr, err := m.socket.Rebind(ipv4addr)
+	if err != nil {
+		return netip.AddrPort{}, errors.New("failed to rebind socket: " + err.Error())
+	}
+
+	payload := appendAddrPort(m.appendBootEpoch(make(pkt.Payload, 0, rebindPayloadSize)), oldAddr)
+
+	for addr, addrPort := range m.router.GetNeighbors() {
+		if IsRelayedAddrPort(addrPort) {
+			continue
+		}
+
+		packet := m.BuildSequencedPacket(pkt.MsgTypeRebind, payload, addr)
+		ackChan, err := m.SendReliablePacketTo(context.Background(), addrPort, packet)
+		if err != nil {
+			logger.Warnf("Failed to send REBIND to %v: %v", addr, err)
+			continue
+		}
+
+		go func() {
+			defer panics.Recover("waiting for the REBIND acknowledgment of %s", addr)
+
+			if !<-ackChan {
+				logger.Warnf("REBIND to %v was not acknowledged, the neighbor may not reach us anymore", addr)
+			}
+		}()
+	}
+
+	return newAddr.AddrPort(), nil
+}
+
+// ParseRebindPayload parses the boot epoch and the old address of a REBIND payload.
+func ParseRebindPayload(payload pkt.Payload) (epoch uint64, oldAddr netip.AddrPort, err error) {
+	if len(payload) != rebindPayloadSize {
+		return 0, netip.AddrPort{}, errors.New("invalid REBIND payload length")
+	}
+
+	epoch, rest, err := SplitBootEpoch(payload)
+	if err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+	return epoch, parseAddrPort(rest), nil
+}
+
+// ApplyRebind makes the neighbor reachable at newAddr.
+// Packets from newAddr are accepted as packets of the neighbor, see IsValidSender.
+// Returns false if addr isn't a neighbor.
+func (m *Manager) ApplyRebind(addr netip.Addr, newAddr netip.AddrPort) bool {
+	if !m.router.UpdateNeighborNextHop(addr, newAddr) {
+		return false
+	}
+
+	if newAddr.Addr() == addr {
+		m.clearAdvertisedAddress(addr)
+	} else {
+		m.RecordAdvertisedAddress(addr, newAddr)
+	}
+	return true
+}
+
+// UpdateNeighborAddress makes the neighbor reachable at addrPort if it contacted us from another address than known,
+// e.g. because it reopened its socket on another port or its NAT mapping changed without a REBIND.
+// Without authentication or a CONNECT signed with the neighbor's key (signed, see ProveConnectIdentity) only a changed port on the known IP address
+// is accepted, otherwise any host could redirect the traffic of a neighbor to itself.
+// Relayed neighbors keep being reached through their relay.
+// Returns whether the address of the neighbor changed.
+func (m *Manager) UpdateNeighborAddress(addr netip.Addr, addrPort netip.AddrPort, signed bool) bool {
+	isNeighbor, known := m.router.IsNeighbor(addr)
+	if !isNeighbor || known == addrPort || IsRelayedAddrPort(known) {
+		return false
+	}
+
+	if !signed && !m.IsAuthenticationEnabled() && known.Addr() != addrPort.Addr() {
+		logger.Warnf("Ignoring new address %v of neighbor %v, only the port may change without authentication (known address %v)", addrPort, addr, known)
+		return false
+	}
+
+	if !m.ApplyRebind(addr, addrPort) {
+		return false
+	}
+
+	logger.Infof("Neighbor %v changed its address from %v to %v", addr, known, addrPort)
+	return true
+}
@@ -0,0 +1,143 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// Relayed neighbors are peers we can't reach directly but through a common neighbor, the relay.
+// Packets to a relayed neighbor are encapsulated in RELAY packets, so the relay doesn't process them itself.
+// RELAY packets are unsequenced, the encapsulated packets are sequenced and acknowledged as usual.
+//
+// Payload:
+//
+//	+----------+------------------------+---------------------------------+
+//	| Op       | Peer Address (32 bits) | Encapsulated Packet ...         |
+//	+----------+------------------------+---------------------------------+
+//
+// Op 0x00 (to the relay): Peer is the relayed neighbor the packet is for.
+// Op 0x01 (from the relay): Peer is the relayed neighbor the packet is from.
+//
+// Relayed neighbors are stored in the neighbor table with a relayed address (port 0, see RelayedAddrPort),
+// so all handlers can treat them like direct neighbors.
+const (
+	relayToPeer   = 0x00
+	relayFromPeer = 0x01
+	relayPrefix   = 5
+)
+
+// relayState holds the relays of our relayed neighbors.
+type relayState struct {
+	mu     sync.Mutex
+	relays map[netip.Addr]netip.Addr // Relayed neighbor -> relay
+}
+
+// RelayedAddrPort returns the address used for a relayed neighbor in the neighbor table.
+// Port 0 is never used by real peers, so sendPacketTo can tell relayed neighbors apart.
+func RelayedAddrPort(addr netip.Addr) netip.AddrPort {
+	return netip.AddrPortFrom(addr, 0)
+}
+
+// IsRelayedAddrPort returns whether the address is the address of a relayed neighbor.
+func IsRelayedAddrPort(addrPort netip.AddrPort) bool {
+	return addrPort.Port() == 0
+}
+
+// AddRelay makes packets to the target go through the relay, which must be a direct neighbor.
+func (m *Manager) AddRelay(target netip.Addr, relay netip.Addr) {
+	m.relays.mu.Lock()
+	defer m.relays.mu.Unlock()
+
+	m.relays.relays[target] = relay
+}
+
+// GetRelay returns the relay of a relayed neighbor.
+func (m *Manager) GetRelay(target netip.Addr) (netip.Addr, bool) {
+	m.relays.mu.Lock()
+	defer m.relays.mu.Unlock()
+
+	relay, exists := m.relays.relays[target]
+	return relay, exists
+}
+
+// clearRelay forgets the relay of the target.
+func (m *Manager) clearRelay(target netip.Addr) {
+	m.relays.mu.Lock()
+	defer m.relays.mu.Unlock()
+
+	delete(m.relays.relays, target)
+}
+
+// sendRelayed encapsulates the packet for the relay of the target and sends it to the relay.
+func (m *Manager) sendRelayed(target netip.Addr, packet *pkt.Packet) error {
+	relay, exists := m.GetRelay(target)
+	if !exists {
+		return fmt.Errorf("%w %s, no relay known", ErrNoRoute, target)
+	}
+
+	isNeighbor, relayAddrPort := m.router.IsNeighbor(relay)
+	if !isNeighbor || IsRelayedAddrPort(relayAddrPort) {
+		return fmt.Errorf("%w %s, relay %s is not a direct neighbor", ErrNoRoute, target, relay)
+	}
+
+	buf := outputBufferPool.Get().(*[]byte)
+	defer outputBufferPool.Put(buf)
+
+	targetBytes := target.As4()
+	payload := append((*buf)[:0], relayToPeer)
+	payload = append(payload, targetBytes[:]...)
+	payload = m.appendWireFormat(payload, packet)
+	*buf = payload[:0] // Keep a grown buffer
+
+	return m.sendPacketTo(relayAddrPort, m.buildPacket(pkt.MsgTypeRelay, payload, relay, [4]byte{}))
+}
+
+// HandleRelay processes a RELAY packet from the direct neighbor sender.
+// Packets to relay are passed on to the peer and nil is returned.
+// Packets relayed to us are returned with the relayed neighbor they are from, they must be processed like received packets.
+func (m *Manager) HandleRelay(packet *pkt.Packet) (encapsulated []byte, from netip.Addr, err error) {
+	if len(packet.Payload) < relayPrefix+pkt.HEADER_SIZE {
+		return nil, netip.Addr{}, errors.New("RELAY payload too short")
+	}
+
+	peer := netip.AddrFrom4([4]byte(packet.Payload[1:5]))
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+
+	switch packet.Payload[0] {
+	case relayToPeer:
+		if !common.ALLOW_RELAYING {
+			return nil, netip.Addr{}, errors.New("relaying is disabled")
+		}
+
+		isNeighbor, peerAddrPort := m.router.IsNeighbor(peer)
+		if !isNeighbor || IsRelayedAddrPort(peerAddrPort) {
+			return nil, netip.Addr{}, fmt.Errorf("can't relay to %s, it is not a direct neighbor", peer)
+		}
+
+		srcBytes := srcAddr.As4()
+		payload := make(pkt.Payload, 0, len(packet.Payload))
+		payload = append(payload, relayFromPeer)
+		payload = append(payload, srcBytes[:]...)
+		payload = append(payload, packet.Payload[relayPrefix:]...)
+
+		logger.Tracef("RELAYING from %s to %s", srcAddr, peer)
+
+		return nil, netip.Addr{}, m.sendPacketTo(peerAddrPort, m.buildPacket(pkt.MsgTypeRelay, payload, peer, [4]byte{}))
+	case relayFromPeer:
+		if isNeighbor, addrPort := m.router.IsNeighbor(peer); isNeighbor && !IsRelayedAddrPort(addrPort) {
+			return nil, netip.Addr{}, fmt.Errorf("%s relayed a packet from direct neighbor %s", srcAddr, peer)
+		}
+
+		m.AddRelay(peer, srcAddr) // Replies go back through the same relay
+
+		return packet.Payload[relayPrefix:], peer, nil
+	default:
+		return nil, netip.Addr{}, fmt.Errorf("unknown RELAY operation %d", packet.Payload[0])
+	}
+}
@@ -0,0 +1,129 @@
+package connection
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// A RESET restarts our packet numbers to a peer after its view of them diverged from ours, e.g. because we cleared the peer while it was still receiving from us.
+// All message types are in use, so a RESET is an ABORT of pkt.MsgTypeAbort.
+//
+// Payload:
+//
+//	+------------------------+--------------------+
+//	| Message Type (8 bits)  | Reset ID (32 bits) |
+//	+------------------------+--------------------+
+//
+// The message type is pkt.MsgTypeAbort, the reset ID is random.
+// The packet number of the RESET is the first packet number of the new sequence.
+// The receiver clears its incoming packet numbers and unfinished transfers of the sender and acknowledges the RESET.
+// A retransmitted RESET is recognized by its ID and only acknowledged again.
+const RESET_ID_SIZE = 4
+
+// resetState limits the automatic RESETs sent because of spurious ACKs, see HandleSpuriousAck.
+type resetState struct {
+	mu        sync.Mutex
+	lastReset map[netip.Addr]time.Time // Time of the latest RESET per peer, also of manual ones
+}
+
+// ResetPeer restarts our packet numbers to the peer with a RESET.
+// Open acknowledgments and unfinished transfers to the peer are dropped.
+// The RESET is sent reliably, the returned channel reports whether it was acknowledged.
+func (m *Manager) ResetPeer(addr netip.Addr) (chan bool, error) {
+	m.resets.mu.Lock()
+	m.resets.lastReset[addr] = time.Now()
+	m.resets.mu.Unlock()
+
+	return m.sendReset(addr)
+}
+
+// sendReset clears our packet numbers to the peer and sends the RESET, the caller records the time of the RESET.
+func (m *Manager) sendReset(addr netip.Addr) (chan bool, error) {
+	if _, found := m.router.GetNextHop(addr); !found {
+		return nil, fmt.Errorf("%w %s", ErrNoRoute, addr)
+	}
+
+	logger.Infof("Resetting our packet numbers to %s", addr)
+	m.outgoingSequencing.ClearPacketNumbers(addr)
+	m.outgoingSequencing.ClearBlockers(addr)
+
+	payload := binary.BigEndian.AppendUint32(pkt.Payload{pkt.MsgTypeAbort}, rand.Uint32())
+	return m.SendReliableRoutedPacket(context.Background(), m.BuildSequencedPacket(pkt.MsgTypeAbort, payload, addr))
+}
+
+// ParseResetPayload returns the reset ID of a RESET.
+func ParseResetPayload(payload pkt.Payload) (resetID uint32, err error) {
+	if len(payload) < 1+RESET_ID_SIZE || payload[0] != pkt.MsgTypeAbort {
+		return 0, errors.New("invalid RESET payload")
+	}
+	return binary.BigEndian.Uint32(payload[1 : 1+RESET_ID_SIZE]), nil
+}
+
+// ApplyReset processes the RESET of a peer, the incoming packet numbers of the peer restart at the packet number of the RESET.
+// Unfinished transfers of the peer to us are dropped, the peer dropped them as well.
+// Returns false if the RESET was applied already.
+func (m *Manager) ApplyReset(packet *pkt.Packet, resetID uint32) bool {
+	if !m.incomingSequencing.ApplyReset(packet, resetID) {
+		return false
+	}
+
+	addr := netip.AddrFrom4(packet.Header.SourceAddr)
+	logger.Infof("Peer %s reset its packet numbers", addr)
+	m.reconstructors.ClearPeer(addr)
+	m.clearPiggybackState(addr)
+	m.clearCongestionMark(addr)
+	return true
+}
+
+// HandleSpuriousAck resets our packet numbers to the peer after it acknowledged a packet we never sent (see sequencing.AckSpurious).
+// The peer still knows packet numbers of a sequence we cleared, it would drop our new packets as duplicates.
+// No RESET is sent within common.AUTO_RESET_MIN_INTERVAL after the previous RESET to the peer, ACKs of the old sequence may still be on the way.
+func (m *Manager) HandleSpuriousAck(addr netip.Addr) {
+	if !common.AUTO_RESET {
+		return
+	}
+
+	// Checked and recorded at once, spurious ACKs of the same peer arrive concurrently and must trigger a single RESET
+	m.resets.mu.Lock()
+	if last, exists := m.resets.lastReset[addr]; exists && time.Since(last) < common.AUTO_RESET_MIN_INTERVAL {
+		m.resets.mu.Unlock()
+		return
+	}
+	m.resets.lastReset[addr] = time.Now()
+	m.resets.mu.Unlock()
+
+	logger.Warnf("%s acknowledged a packet we never sent, its packet numbers diverged from ours", addr)
+
+	ackChan, err := m.sendReset(addr)
+	if err != nil {
+		logger.Warnf("Failed to reset %s: %v", addr, err)
+		return
+	}
+
+	go func() {
+		defer panics.Recover("waiting for the RESET acknowledgment of %s", addr)
+
+		if !<-ackChan {
+			logger.Warnf("RESET to %s was not acknowledged", addr)
+		}
+	}()
+}
+
+// clearResets forgets the RESETs sent to the peer.
+func (m *Manager) clearResets(addr netip.Addr) {
+	m.resets.mu.Lock()
+	defer m.resets.mu.Unlock()
+
+	delete(m.resets.lastReset, addr)
+}
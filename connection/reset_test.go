@@ -0,0 +1,70 @@
+package connection
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// TestConcurrentSpuriousAcksSendOneReset verifies that spurious ACKs of a peer arriving at the same time trigger a single RESET.
+func TestConcurrentSpuriousAcksSendOneReset(t *testing.T) {
+	network := sock.NewMemoryNetwork()
+	socket := network.NewSocket()
+	if _, err := socket.Open(net.IPv4(10, 0, 0, 1)); err != nil {
+		t.Fatalf("Failed to open socket: %v", err)
+	}
+	defer socket.Close()
+	peerSocket := network.NewSocket()
+	if _, err := peerSocket.Open(net.IPv4(10, 0, 0, 2)); err != nil {
+		t.Fatalf("Failed to open peer socket: %v", err)
+	}
+	defer peerSocket.Close()
+	packets := peerSocket.Subscribe()
+
+	m := NewManager(socket, routing.NewRouter(socket), sequencing.NewIncomingPktNumHandler(socket), sequencing.NewOutgoingPktNumHandler(common.INITIAL_CWND, common.IGNORE_CWND), reconstruction.NewManager())
+	localAddr, peer := socket.MustGetLocalAddress().Addr(), peerSocket.MustGetLocalAddress().Addr()
+	m.router.AddNeighbor(peerSocket.MustGetLocalAddress())
+	m.router.UpdateLSA(peer, 1, []netip.Addr{localAddr}, false, peer)
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			m.HandleSpuriousAck(peer)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	resetIDs := make(map[uint32]bool) // Retransmissions of a RESET carry its ID again
+	timeout := time.After(100 * time.Millisecond)
+	for {
+		select {
+		case datagram := <-packets:
+			packet, err := pkt.ParsePacket(datagram.Data)
+			if err != nil || packet.GetMessageType() != pkt.MsgTypeAbort {
+				continue
+			}
+			if resetID, err := ParseResetPayload(packet.Payload); err == nil {
+				resetIDs[resetID] = true
+			}
+		case <-timeout:
+			if len(resetIDs) != 1 {
+				t.Errorf("Peer received %d RESETs, want 1", len(resetIDs))
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,523 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// A room is hosted on a node, members join it at the host and post their messages to the host, which fans them out to the other members.
+// Room traffic consists of reliable routed chat messages marked with an ExtTypeRoom extension carrying the operation and the room name,
+// so it is forwarded like chat messages by every node of the path. The payload depends on the operation.
+// Members send keepalives every common.ROOM_KEEPALIVE_INTERVAL, the host removes members that weren't heard within common.ROOM_MEMBER_TIMEOUT
+// or didn't acknowledge a packet of the room. A member leaves a room whose host doesn't acknowledge its keepalive.
+// The host is a member of its rooms without joining them.
+
+// Room operations, the first byte of the ExtTypeRoom value.
+const (
+	RoomJoin         byte = 0x0 // Member to host, no payload
+	RoomLeave        byte = 0x1 // Member to host, or host to a member it removed, no payload
+	RoomKeepalive    byte = 0x2 // Member to host, no payload
+	RoomPost         byte = 0x3 // Member to host, payload: text
+	RoomMessage      byte = 0x4 // Host to members, payload: author (32 bits) and text
+	RoomMembers      byte = 0x5 // Host to a member that joined, payload: the other members (32 bits each)
+	RoomMemberJoined byte = 0x6 // Host to members, payload: new member (32 bits)
+	RoomMemberLeft   byte = 0x7 // Host to members, payload: removed member (32 bits)
+)
+
+const roomAddrSize = 4
+
+// roomState holds the rooms we host and the rooms we joined.
+type roomState struct {
+	mu     sync.Mutex
+	hosted map[string]*hostedRoom
+	joined map[string]*joinedRoom
+	timer  *time.Timer // Runs the keepalives and timeouts while there are rooms
+}
+
+type hostedRoom struct {
+	members map[netip.Addr]time.Time // Time each member was last heard
+}
+
+type joinedRoom struct {
+	host      netip.Addr
+	members   []netip.Addr // Other members including the host, nil until the host answered the join
+	requested time.Time    // Time the join was sent
+}
+
+// RoomInfo describes a room we host or joined.
+type RoomInfo struct {
+	Name    string
+	Host    netip.Addr
+	Hosted  bool
+	Joined  bool         // False while the join isn't answered by the host, always true for hosted rooms
+	Members []netip.Addr // Sorted, without us
+}
+
+// ParseRoomExtension returns the operation and room name of the ExtTypeRoom extension of a chat message.
+// Returns false if the message isn't room traffic.
+func ParseRoomExtension(packet *pkt.Packet) (op byte, name string, ok bool) {
+	for _, ext := range packet.GetExtensions(pkt.ExtTypeRoom) {
+		if len(ext.Value) >= 1 {
+			return ext.Value[0], string(ext.Value[1:]), true
+		}
+	}
+	return 0, "", false
+}
+
+// validateRoomName errors if the name can't be used as room name.
+func validateRoomName(name string) error {
+	if name == "" {
+		return errors.New("room name is empty")
+	}
+	if len(name) > common.ROOM_NAME_MAX_LENGTH {
+		return fmt.Errorf("room name is longer than %d bytes", common.ROOM_NAME_MAX_LENGTH)
+	}
+	return nil
+}
+
+// CreateRoom starts hosting a room.
+func (m *Manager) CreateRoom(name string) error {
+	if err := validateRoomName(name); err != nil {
+		return err
+	}
+
+	m.rooms.mu.Lock()
+	defer m.rooms.mu.Unlock()
+
+	if m.roomExistsLocked(name) {
+		return fmt.Errorf("room %q already exists", name)
+	}
+	m.rooms.hosted[name] = &hostedRoom{members: make(map[netip.Addr]time.Time)}
+	m.scheduleRoomMaintenanceLocked()
+	return nil
+}
+
+// CloseRoom stops hosting a room, its members are told that they were removed.
+func (m *Manager) CloseRoom(name string) error {
+	m.rooms.mu.Lock()
+	room, exists := m.rooms.hosted[name]
+	if !exists {
+		m.rooms.mu.Unlock()
+		return fmt.Errorf("not hosting room %q", name)
+	}
+	delete(m.rooms.hosted, name)
+	m.rooms.mu.Unlock()
+
+	for member := range room.members {
+		_ = m.sendRoomPacket(member, RoomLeave, name, nil, nil)
+	}
+	return nil
+}
+
+// JoinRoom asks the host to add us to its room.
+// The join completes asynchronously, a RoomMembershipEvent is published once the host answered.
+func (m *Manager) JoinRoom(host netip.Addr, name string) error {
+	if err := validateRoomName(name); err != nil {
+		return err
+	}
+	if host == m.socket.MustGetLocalAddress().Addr() {
+		return errors.New("can't join a room we host")
+	}
+
+	m.rooms.mu.Lock()
+	if m.roomExistsLocked(name) {
+		m.rooms.mu.Unlock()
+		return fmt.Errorf("room %q already exists", name)
+	}
+	m.rooms.joined[name] = &joinedRoom{host: host, requested: time.Now()}
+	m.scheduleRoomMaintenanceLocked()
+	m.rooms.mu.Unlock()
+
+	if err := m.sendRoomPacket(host, RoomJoin, name, nil, nil); err != nil {
+		m.forgetJoinedRoom(name, host)
+		return err
+	}
+	return nil
+}
+
+// LeaveRoom leaves a room we joined.
+func (m *Manager) LeaveRoom(name string) error {
+	m.rooms.mu.Lock()
+	room, exists := m.rooms.joined[name]
+	if !exists {
+		m.rooms.mu.Unlock()
+		return fmt.Errorf("not a member of room %q", name)
+	}
+	delete(m.rooms.joined, name)
+	m.rooms.mu.Unlock()
+
+	return m.sendRoomPacket(room.host, RoomLeave, name, nil, nil)
+}
+
+// SendRoomMessage posts a message to a room we host or joined.
+// The message isn't published as RoomMessageEvent to ourselves.
+func (m *Manager) SendRoomMessage(name string, text string) error {
+	if len(text) > common.MAX_PAYLOAD_SIZE_BYTES-roomAddrSize {
+		return fmt.Errorf("message is longer than %d bytes", common.MAX_PAYLOAD_SIZE_BYTES-roomAddrSize)
+	}
+
+	m.rooms.mu.Lock()
+	_, hosted := m.rooms.hosted[name]
+	joined, isMember := m.rooms.joined[name]
+	m.rooms.mu.Unlock()
+
+	switch {
+	case hosted:
+		m.fanOutRoomMessage(name, m.socket.MustGetLocalAddress().Addr(), text)
+		return nil
+	case isMember && joined.members != nil:
+		return m.sendRoomPacket(joined.host, RoomPost, name, pkt.Payload(text), nil)
+	case isMember:
+		return fmt.Errorf("join of room %q isn't answered yet", name)
+	default:
+		return fmt.Errorf("not a member of room %q", name)
+	}
+}
+
+// Rooms returns the rooms we host and joined, sorted by name.
+func (m *Manager) Rooms() []RoomInfo {
+	m.rooms.mu.Lock()
+	defer m.rooms.mu.Unlock()
+
+	localAddr := m.socket.MustGetLocalAddress().Addr()
+	rooms := make([]RoomInfo, 0, len(m.rooms.hosted)+len(m.rooms.joined))
+	for name, room := range m.rooms.hosted {
+		info := RoomInfo{Name: name, Host: localAddr, Hosted: true, Joined: true}
+		for member := range room.members {
+			info.Members = append(info.Members, member)
+		}
+		slices.SortFunc(info.Members, netip.Addr.Compare)
+		rooms = append(rooms, info)
+	}
+	for name, room := range m.rooms.joined {
+		info := RoomInfo{Name: name, Host: room.host, Joined: room.members != nil, Members: slices.Clone(room.members)}
+		slices.SortFunc(info.Members, netip.Addr.Compare)
+		rooms = append(rooms, info)
+	}
+
+	slices.SortFunc(rooms, func(a, b RoomInfo) int { return strings.Compare(a.Name, b.Name) })
+	return rooms
+}
+
+// HandleRoomPacket processes room traffic addressed to us, see ParseRoomExtension.
+// The packet must already be acknowledged and deduplicated.
+func (m *Manager) HandleRoomPacket(srcAddr netip.Addr, op byte, name string, payload pkt.Payload) error {
+	switch op {
+	case RoomJoin, RoomKeepalive, RoomPost:
+		return m.handleRoomPacketAsHost(srcAddr, op, name, payload)
+	case RoomLeave:
+		m.rooms.mu.Lock()
+		_, hosted := m.rooms.hosted[name]
+		m.rooms.mu.Unlock()
+		if hosted {
+			return m.handleRoomPacketAsHost(srcAddr, op, name, payload)
+		}
+		return m.handleRoomPacketAsMember(srcAddr, op, name, payload)
+	case RoomMessage, RoomMembers, RoomMemberJoined, RoomMemberLeft:
+		return m.handleRoomPacketAsMember(srcAddr, op, name, payload)
+	default:
+		return fmt.Errorf("unknown room operation %d", op)
+	}
+}
+
+func (m *Manager) handleRoomPacketAsHost(member netip.Addr, op byte, name string, payload pkt.Payload) error {
+	m.rooms.mu.Lock()
+	room, hosted := m.rooms.hosted[name]
+	if !hosted {
+		m.rooms.mu.Unlock()
+		if op != RoomLeave {
+			_ = m.sendRoomPacket(member, RoomLeave, name, nil, nil) // Tells the member that it isn't in the room (anymore)
+		}
+		return nil
+	}
+
+	_, isMember := room.members[member]
+	switch op {
+	case RoomJoin:
+		room.members[member] = time.Now()
+		others := make(pkt.Payload, 0, len(room.members)*roomAddrSize)
+		others = append(others, m.socket.MustGetLocalAddress().Addr().AsSlice()...)
+		for other := range room.members {
+			if other != member {
+				others = append(others, other.AsSlice()...)
+			}
+		}
+		m.rooms.mu.Unlock()
+
+		_ = m.sendRoomPacket(member, RoomMembers, name, others, nil)
+		if !isMember {
+			m.announceRoomMember(name, member, RoomMemberJoined, "")
+		}
+		return nil
+	case RoomLeave:
+		delete(room.members, member)
+		m.rooms.mu.Unlock()
+
+		if isMember {
+			m.announceRoomMember(name, member, RoomMemberLeft, "")
+		}
+		return nil
+	}
+
+	if !isMember {
+		m.rooms.mu.Unlock()
+		_ = m.sendRoomPacket(member, RoomLeave, name, nil, nil)
+		return nil
+	}
+	room.members[member] = time.Now()
+	m.rooms.mu.Unlock()
+
+	if op == RoomPost {
+		m.fanOutRoomMessage(name, member, string(payload))
+	}
+	return nil
+}
+
+func (m *Manager) handleRoomPacketAsMember(host netip.Addr, op byte, name string, payload pkt.Payload) error {
+	m.rooms.mu.Lock()
+	room, isMember := m.rooms.joined[name]
+	if !isMember || room.host != host {
+		m.rooms.mu.Unlock()
+		return fmt.Errorf("not a member of room %q hosted by %s", name, host)
+	}
+
+	localAddr := m.socket.MustGetLocalAddress().Addr()
+	switch op {
+	case RoomLeave:
+		delete(m.rooms.joined, name)
+		m.rooms.mu.Unlock()
+
+		events.RoomMembership.NotifyObservers(events.RoomMembershipEvent{Room: name, Host: host, Member: localAddr, Reason: "removed by the host"})
+		return nil
+	case RoomMembers:
+		if len(payload)%roomAddrSize != 0 {
+			m.rooms.mu.Unlock()
+			return errors.New("member list length is not a multiple of 4")
+		}
+		room.members = make([]netip.Addr, 0, len(payload)/roomAddrSize)
+		for i := 0; i < len(payload); i += roomAddrSize {
+			room.members = append(room.members, netip.AddrFrom4([4]byte(payload[i:i+roomAddrSize])))
+		}
+		m.rooms.mu.Unlock()
+
+		events.RoomMembership.NotifyObservers(events.RoomMembershipEvent{Room: name, Host: host, Member: localAddr, Joined: true})
+		return nil
+	}
+
+	if len(payload) < roomAddrSize {
+		m.rooms.mu.Unlock()
+		return errors.New("payload is too short to contain an address")
+	}
+	addr := netip.AddrFrom4([4]byte(payload[:roomAddrSize]))
+
+	switch op {
+	case RoomMemberJoined:
+		if !slices.Contains(room.members, addr) {
+			room.members = append(room.members, addr)
+		}
+		m.rooms.mu.Unlock()
+
+		events.RoomMembership.NotifyObservers(events.RoomMembershipEvent{Room: name, Host: host, Member: addr, Joined: true})
+	case RoomMemberLeft:
+		room.members = slices.DeleteFunc(room.members, func(member netip.Addr) bool { return member == addr })
+		m.rooms.mu.Unlock()
+
+		events.RoomMembership.NotifyObservers(events.RoomMembershipEvent{Room: name, Host: host, Member: addr})
+	default: // RoomMessage
+		m.rooms.mu.Unlock()
+
+		events.RoomMessage.NotifyObservers(events.RoomMessageEvent{Room: name, Host: host, From: addr, Text: string(payload[roomAddrSize:])})
+	}
+	return nil
+}
+
+// fanOutRoomMessage sends a message of the author to all members of a hosted room except the author and publishes it unless we are the author.
+func (m *Manager) fanOutRoomMessage(name string, author netip.Addr, text string) {
+	localAddr := m.socket.MustGetLocalAddress().Addr()
+	if author != localAddr {
+		events.RoomMessage.NotifyObservers(events.RoomMessageEvent{Room: name, Host: localAddr, From: author, Text: text})
+	}
+
+	payload := append(pkt.Payload(author.AsSlice()), text...)
+	for _, member := range m.hostedRoomMembers(name) {
+		if member != author {
+			m.sendToRoomMember(name, member, RoomMessage, payload)
+		}
+	}
+}
+
+// announceRoomMember tells the other members of a hosted room that a member joined or left and publishes it.
+func (m *Manager) announceRoomMember(name string, member netip.Addr, op byte, reason string) {
+	events.RoomMembership.NotifyObservers(events.RoomMembershipEvent{
+		Room:   name,
+		Host:   m.socket.MustGetLocalAddress().Addr(),
+		Member: member,
+		Joined: op == RoomMemberJoined,
+		Reason: reason,
+	})
+
+	for _, other := range m.hostedRoomMembers(name) {
+		if other != member {
+			m.sendToRoomMember(name, other, op, pkt.Payload(member.AsSlice()))
+		}
+	}
+}
+
+// hostedRoomMembers returns the members of a hosted room.
+func (m *Manager) hostedRoomMembers(name string) []netip.Addr {
+	m.rooms.mu.Lock()
+	defer m.rooms.mu.Unlock()
+
+	room, hosted := m.rooms.hosted[name]
+	if !hosted {
+		return nil
+	}
+	members := make([]netip.Addr, 0, len(room.members))
+	for member := range room.members {
+		members = append(members, member)
+	}
+	return members
+}
+
+// sendToRoomMember sends a packet of a hosted room to a member, the member is removed if it doesn't acknowledge it.
+func (m *Manager) sendToRoomMember(name string, member netip.Addr, op byte, payload pkt.Payload) {
+	_ = m.sendRoomPacket(member, op, name, payload, func() {
+		m.removeRoomMember(name, member, "unreachable")
+	})
+}
+
+// removeRoomMember removes a member from a hosted room, e.g. after a timeout, and tells the other members.
+func (m *Manager) removeRoomMember(name string, member netip.Addr, reason string) {
+	m.rooms.mu.Lock()
+	room, hosted := m.rooms.hosted[name]
+	if !hosted {
+		m.rooms.mu.Unlock()
+		return
+	}
+	if _, isMember := room.members[member]; !isMember {
+		m.rooms.mu.Unlock()
+		return
+	}
+	delete(room.members, member)
+	m.rooms.mu.Unlock()
+
+	logger.Infof("Removed %s from room %q: %s", member, name, reason)
+	m.announceRoomMember(name, member, RoomMemberLeft, reason)
+}
+
+// forgetJoinedRoom leaves a joined room without telling the host, e.g. because the host is unreachable.
+func (m *Manager) forgetJoinedRoom(name string, host netip.Addr) bool {
+	m.rooms.mu.Lock()
+	defer m.rooms.mu.Unlock()
+
+	if room, isMember := m.rooms.joined[name]; !isMember || room.host != host {
+		return false
+	}
+	delete(m.rooms.joined, name)
+	return true
+}
+
+// sendRoomPacket reliably sends room traffic to dest. onLoss is called if the packet isn't acknowledged, it may be nil.
+func (m *Manager) sendRoomPacket(dest netip.Addr, op byte, name string, payload pkt.Payload, onLoss func()) error {
+	packet := m.BuildSequencedPacket(pkt.MsgTypeChatMessage, payload, dest)
+	packet.AddExtension(pkt.ExtTypeRoom, append([]byte{op}, name...))
+	pkt.SetChecksum(packet)
+
+	ackChan, err := m.SendReliableRoutedPacket(context.Background(), packet)
+	if err != nil {
+		logger.Debugf("Failed to send room operation %d of %q to %s: %v", op, name, dest, err)
+		if onLoss != nil {
+			go onLoss()
+		}
+		return err
+	}
+
+	go func() {
+		defer panics.Recover("waiting for the acknowledgment of room operation %d to %s", op, dest)
+
+		if acknowledged := <-ackChan; !acknowledged && onLoss != nil {
+			onLoss()
+		}
+	}()
+	return nil
+}
+
+// roomExistsLocked returns whether we host or joined a room with the name.
+// Must be called with m.rooms.mu held.
+func (m *Manager) roomExistsLocked(name string) bool {
+	_, hosted := m.rooms.hosted[name]
+	_, joined := m.rooms.joined[name]
+	return hosted || joined
+}
+
+// scheduleRoomMaintenanceLocked starts the keepalives and timeouts of the rooms if they aren't running.
+// Must be called with m.rooms.mu held.
+func (m *Manager) scheduleRoomMaintenanceLocked() {
+	if m.rooms.timer == nil {
+		m.rooms.timer = time.AfterFunc(common.ROOM_KEEPALIVE_INTERVAL, m.maintainRooms)
+	}
+}
+
+// maintainRooms sends the keepalives of joined rooms and removes timed out members and joins.
+// Reschedules itself while there are rooms.
+func (m *Manager) maintainRooms() {
+	defer panics.Recover("maintaining rooms")
+
+	now := time.Now()
+	type membership struct {
+		name   string
+		member netip.Addr
+	}
+	var expired, keepalives, unanswered []membership
+
+	m.rooms.mu.Lock()
+	for name, room := range m.rooms.hosted {
+		for member, lastHeard := range room.members {
+			if now.Sub(lastHeard) > common.ROOM_MEMBER_TIMEOUT {
+				expired = append(expired, membership{name, member})
+			}
+		}
+	}
+	for name, room := range m.rooms.joined {
+		if room.members == nil && now.Sub(room.requested) > common.ROOM_MEMBER_TIMEOUT {
+			unanswered = append(unanswered, membership{name, room.host})
+			delete(m.rooms.joined, name)
+		} else {
+			keepalives = append(keepalives, membership{name, room.host})
+		}
+	}
+	m.rooms.timer = nil
+	if len(m.rooms.hosted) > 0 || len(m.rooms.joined) > 0 {
+		m.scheduleRoomMaintenanceLocked()
+	}
+	m.rooms.mu.Unlock()
+
+	for _, timedOut := range expired {
+		m.removeRoomMember(timedOut.name, timedOut.member, "timed out")
+	}
+
+	localAddr := m.socket.MustGetLocalAddress().Addr()
+	for _, join := range unanswered {
+		events.RoomMembership.NotifyObservers(events.RoomMembershipEvent{Room: join.name, Host: join.member, Member: localAddr, Reason: "join wasn't answered"})
+	}
+	for _, keepalive := range keepalives {
+		name, host := keepalive.name, keepalive.member
+		_ = m.sendRoomPacket(host, RoomKeepalive, name, nil, func() {
+			if m.forgetJoinedRoom(name, host) {
+				events.RoomMembership.NotifyObservers(events.RoomMembershipEvent{Room: name, Host: host, Member: localAddr, Reason: "host unreachable"})
+			}
+		})
+	}
+}
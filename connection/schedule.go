@@ -0,0 +1,112 @@
+package connection
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/panics"
+)
+
+// MSG/FILE packets are queued per next hop and written by one goroutine per next hop,
+// while control packets (ACK, LSA, DD, CONNECT, DISCONNECT, ...) are written immediately by the sender.
+// So control packets always bypass queued data packets, a bulk transfer can't delay the ACKs and LSAs that keep a neighbor alive.
+// sendSchedulerState holds the data queues.
+type sendSchedulerState struct {
+	mu     sync.Mutex
+	queues map[netip.AddrPort]*dataQueue // Only contains next hops with queued packets or a running writer
+	drops  atomic.Uint64                 // Data packets dropped because the queue of their next hop was full
+}
+
+// dataQueue holds the serialized data packets waiting to be written to a next hop in FIFO order.
+type dataQueue struct {
+	packets []queuedPacket
+}
+
+// queuedPacket is a serialized data packet, buf is returned to outputBufferPool after it was written.
+type queuedPacket struct {
+	buf     *[]byte
+	msgType byte
+	pktNum  [4]byte
+	dest    [4]byte
+}
+
+// DroppedDataPackets returns the number of outgoing MSG/FILE packets dropped because the send queue of their next hop was full.
+// Dropped packets are retransmitted like lost packets.
+func (m *Manager) DroppedDataPackets() uint64 {
+	return m.scheduler.drops.Load()
+}
+
+// enqueueDataPacket serializes the data packet and queues it for the next hop.
+// A writer goroutine is started if the next hop has none.
+// If the queue is full, the packet is dropped.
+func (m *Manager) enqueueDataPacket(addrPort netip.AddrPort, packet *pkt.Packet) {
+	buf := outputBufferPool.Get().(*[]byte)
+	*buf = m.appendWireFormat((*buf)[:0], packet)
+
+	queued := queuedPacket{
+		buf:     buf,
+		msgType: packet.GetMessageType(),
+		pktNum:  packet.Header.PktNum,
+		dest:    packet.Header.DestAddr,
+	}
+
+	m.scheduler.mu.Lock()
+	defer m.scheduler.mu.Unlock()
+
+	queue, running := m.scheduler.queues[addrPort]
+	if !running {
+		queue = &dataQueue{}
+		m.scheduler.queues[addrPort] = queue
+		go m.writeDataQueue(addrPort, queue)
+	}
+
+	if len(queue.packets) >= common.SEND_QUEUE_SIZE_PACKETS {
+		m.scheduler.drops.Add(1)
+		outputBufferPool.Put(buf)
+		logger.Debugf("Send queue to %v is full, dropping %s %d", addrPort, msgTypeNames[queued.msgType], queued.pktNum)
+		return
+	}
+
+	queue.packets = append(queue.packets, queued)
+}
+
+// writeDataQueue writes the queued packets of the next hop until the queue is empty.
+func (m *Manager) writeDataQueue(addrPort netip.AddrPort, queue *dataQueue) {
+	defer panics.Recover("writing the send queue to %s", addrPort)
+
+	nextHop := &net.UDPAddr{
+		IP:   addrPort.Addr().AsSlice(),
+		Port: int(addrPort.Port()),
+	}
+
+	for {
+		m.scheduler.mu.Lock()
+		if len(queue.packets) == 0 {
+			delete(m.scheduler.queues, addrPort)
+			m.scheduler.mu.Unlock()
+			return
+		}
+		queued := queue.packets[0]
+		queue.packets[0] = queuedPacket{}
+		queue.packets = queue.packets[1:]
+		m.scheduler.mu.Unlock()
+
+		err := m.writeToSocket(nextHop, *queued.buf)
+
+		*queued.buf = (*queued.buf)[:0]
+		outputBufferPool.Put(queued.buf)
+
+		if err != nil {
+			logger.Debugf("Failed to send queued %s %d to %v: %v", msgTypeNames[queued.msgType], queued.pktNum, addrPort, err)
+			continue
+		}
+
+		name := msgTypeNames[queued.msgType]
+		logger.LimitedTracef("SENT "+name, "SENT %s %d to %v", name, queued.pktNum, queued.dest)
+	}
+}
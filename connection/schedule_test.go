@@ -0,0 +1,93 @@
+package connection
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// stallingSocket records the message types of sent packets and stalls the first sent data packet until released.
+type stallingSocket struct {
+	*sock.MemorySocket
+	mu       sync.Mutex
+	sent     []byte
+	stalled  chan struct{} // Closed once the first data packet is stalled
+	release  chan struct{}
+	didStall bool
+}
+
+func (s *stallingSocket) SendTo(addr *net.UDPAddr, data []byte) error {
+	packet, err := pkt.ParsePacket(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.sent = append(s.sent, packet.GetMessageType())
+	stall := isDataMsgType(packet.GetMessageType()) && !s.didStall
+	s.didStall = s.didStall || stall
+	s.mu.Unlock()
+
+	if stall {
+		close(s.stalled)
+		<-s.release
+	}
+	return s.MemorySocket.SendTo(addr, data)
+}
+
+func (s *stallingSocket) sentTypes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.sent...)
+}
+
+// TestControlPacketsBypassQueuedData verifies that an ACK is sent before data packets that were queued earlier for the same next hop.
+func TestControlPacketsBypassQueuedData(t *testing.T) {
+	socket := &stallingSocket{
+		MemorySocket: sock.NewMemoryNetwork().NewSocket(),
+		stalled:      make(chan struct{}),
+		release:      make(chan struct{}),
+	}
+	if _, err := socket.Open(net.IPv4(10, 0, 0, 1)); err != nil {
+		t.Fatalf("Failed to open socket: %v", err)
+	}
+
+	m := NewManager(socket, routing.NewRouter(socket), sequencing.NewIncomingPktNumHandler(socket), sequencing.NewOutgoingPktNumHandler(common.INITIAL_CWND, common.IGNORE_CWND), reconstruction.NewManager())
+
+	peer := netip.MustParseAddrPort("10.0.0.2:20000")
+	for i := range 3 {
+		if err := m.sendPacketTo(peer, m.buildPacket(pkt.MsgTypeFileTransfer, []byte("chunk"), peer.Addr(), [4]byte{0, 0, 0, byte(i)})); err != nil {
+			t.Fatalf("Failed to send FILE packet: %v", err)
+		}
+	}
+
+	<-socket.stalled
+
+	if err := m.sendPacketTo(peer, m.buildPacket(pkt.MsgTypeAcknowledgment, nil, peer.Addr(), [4]byte{})); err != nil {
+		t.Fatalf("Failed to send ACK: %v", err)
+	}
+
+	close(socket.release)
+
+	want := []byte{pkt.MsgTypeFileTransfer, pkt.MsgTypeAcknowledgment, pkt.MsgTypeFileTransfer, pkt.MsgTypeFileTransfer}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(socket.sentTypes()) < len(want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the queued packets, sent %v", socket.sentTypes())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := socket.sentTypes(); string(got) != string(want) {
+		t.Errorf("Sent message types %v, want %v", got, want)
+	}
+}
@@ -2,31 +2,160 @@
 package connection
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
 	"net/netip"
-	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"bjoernblessin.de/chatprotogol/common"
 	"bjoernblessin.de/chatprotogol/pkt"
 	"bjoernblessin.de/chatprotogol/routing"
 	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
 	"bjoernblessin.de/chatprotogol/sock"
 	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
-var socket sock.Socket
-var router *routing.Router
-var incomingSequencing *sequencing.IncomingPktNumHandler
-var outgoingSequencing *sequencing.OutgoingPktNumHandler
+// Manager manages the connections of a local node.
+// Each node in the process has its own Manager, so multiple nodes don't share any connection state.
+type Manager struct {
+	socket             sock.Socket
+	router             *routing.Router
+	incomingSequencing *sequencing.IncomingPktNumHandler
+	outgoingSequencing *sequencing.OutgoingPktNumHandler
+	reconstructors     *reconstruction.Manager
+
+	preSharedKey    []byte            // Network-wide key used to authenticate packets between neighbors, nil disables authentication
+	bootEpoch       uint64            // Start time of this node in nanoseconds, so it increases with every restart
+	teamID          byte              // Team ID of outgoing packets, incoming packets of other teams are dropped
+	promiscuous     atomic.Bool       // Disables the team check of incoming packets, e.g. for interoperability tests with other teams
+	teamDrops       [16]atomic.Uint64 // Dropped incoming packets per team ID
+	nextProbeID     atomic.Uint32     // ID of the next path MTU probe
+	lsaFlooding     lsaFloodingState
+	pathMTU         pathMTUState
+	natState        natTraversalState
+	piggyback       piggybackState
+	presenceLimits  presenceLimitState
+	relays          relayState
+	scheduler       sendSchedulerState
+	forwarding      forwardingStatsState
+	hopARQ          hopARQState
+	forwardCache    forwardCacheState
+	pathRecord      pathRecordState
+	peerStates      peerStateMachine
+	ddRequests      ddRequestState
+	fairShare       fairShareState
+	congestionMarks congestionMarkState
+	peerTraffic     peerTrafficState
+	timeSync        timeSyncState
+	violations      violationState
+	capabilities    capabilityState
+	rooms           roomState
+	session         sessionState
+	netem           netemState
+	discovery       discoveryState
+	resets          resetState
+	lsaSigning      lsaSigningState
+	ingressLimits   ingressLimitState
+}
 
-func SetGlobalVars(s sock.Socket, r *routing.Router, in *sequencing.IncomingPktNumHandler, out *sequencing.OutgoingPktNumHandler) {
-	socket = s
-	router = r
-	incomingSequencing = in
-	outgoingSequencing = out
+// NewManager creates the connection manager of a node from its components.
+func NewManager(s sock.Socket, r *routing.Router, in *sequencing.IncomingPktNumHandler, out *sequencing.OutgoingPktNumHandler, rm *reconstruction.Manager) *Manager {
+	return &Manager{
+		socket:             s,
+		router:             r,
+		incomingSequencing: in,
+		outgoingSequencing: out,
+		reconstructors:     rm,
+		bootEpoch:          uint64(time.Now().UnixNano()),
+		teamID:             common.TEAM_ID,
+		lsaFlooding: lsaFloodingState{
+			sent:         make(map[lsaFloodKey]time.Time),
+			originTokens: common.LSA_ORIGINATION_BURST,
+		},
+		pathMTU: pathMTUState{
+			payloadLimits: make(map[netip.Addr]int),
+			pending:       make(map[uint32]chan<- int),
+		},
+		natState: natTraversalState{
+			advertised: make(map[netip.Addr]netip.AddrPort),
+			introduced: make(map[netip.Addr]netip.AddrPort),
+		},
+		piggyback: piggybackState{
+			pending:      make(map[netip.Addr][][4]byte),
+			flushTimers:  make(map[netip.Addr]*time.Timer),
+			lastDataSent: make(map[netip.Addr]time.Time),
+		},
+		presenceLimits: presenceLimitState{
+			lastSent:     make(map[netip.Addr]time.Time),
+			lastAccepted: make(map[netip.Addr]time.Time),
+		},
+		relays: relayState{
+			relays: make(map[netip.Addr]netip.Addr),
+		},
+		scheduler: sendSchedulerState{
+			queues: make(map[netip.AddrPort]*dataQueue),
+		},
+		forwarding: forwardingStatsState{
+			flows:    make(map[ForwardingFlow]TrafficCounter),
+			ingress:  make(map[netip.AddrPort]TrafficCounter),
+			nextHops: make(map[netip.AddrPort]TrafficCounter),
+		},
+		hopARQ: hopARQState{
+			capable:  make(map[netip.AddrPort]bool),
+			nextSeq:  make(map[netip.AddrPort]uint32),
+			inFlight: make(map[netip.AddrPort]int),
+			pending:  make(map[hopKey]*time.Timer),
+		},
+		forwardCache: forwardCacheState{
+			destinations: make(map[netip.Addr]*destinationCache),
+		},
+		pathRecord: pathRecordState{
+			pending: make(map[uint32]chan<- TracedPath),
+		},
+		peerStates: peerStateMachine{
+			peers: make(map[netip.Addr]*peerConnection),
+		},
+		ddRequests: ddRequestState{
+			pending: make(map[netip.Addr]chan<- []DDEntry),
+		},
+		fairShare: fairShareState{
+			flows: make(map[netip.AddrPort]map[netip.Addr]time.Time),
+		},
+		congestionMarks: congestionMarkState{
+			pending: make(map[netip.Addr][4]byte),
+		},
+		peerTraffic: peerTrafficState{
+			peers: make(map[netip.Addr]*PeerTraffic),
+		},
+		timeSync: timeSyncState{
+			peers: make(map[netip.Addr]*peerClock),
+		},
+		capabilities: capabilityState{
+			local: implementedCapabilities(),
+			peers: make(map[netip.Addr]Capabilities),
+		},
+		rooms: roomState{
+			hosted: make(map[string]*hostedRoom),
+			joined: make(map[string]*joinedRoom),
+		},
+		session: sessionState{
+			start:     time.Now(),
+			neighbors: make(map[netip.Addr]bool),
+		},
+		resets: resetState{
+			lastReset: make(map[netip.Addr]time.Time),
+		},
+		lsaSigning: newLSASigningState(),
+		ingressLimits: ingressLimitState{
+			sources: make(map[netip.Addr]*ingressSource),
+		},
+	}
 }
 
 var msgTypeNames = map[byte]string{
@@ -38,47 +167,82 @@ var msgTypeNames = map[byte]string{
 	pkt.MsgTypeLSA:            "LSA",
 	pkt.MsgTypeDD:             "DD",
 	pkt.MsgTypeFinish:         "FIN",
+	pkt.MsgTypeMTUProbe:       "PROBE",
+	pkt.MsgTypeIntroduce:      "INTRO",
+	pkt.MsgTypeRelay:          "RELAY",
+	pkt.MsgTypeAbort:          "ABORT",
+	pkt.MsgTypePresence:       "PRESENCE",
+	pkt.MsgTypeRebind:         "REBIND",
 }
 
 // SendReliableRoutedPacket sends a packet.
 // Reliable: Resends and timeouts are handled.
 // Routed: Uses the routing table to determine the next hop.
-// Errors if the destination address is not reachable or sending fails.
-func SendReliableRoutedPacket(packet *pkt.Packet) (chan bool, error) {
+// Errors if the destination address is not reachable (ErrNoRoute), sending fails (e.g. ErrSocketClosed) or ctx is cancelled before the packet could be sent.
+// If ctx is cancelled while the packet waits for the congestion window, the error matches ErrWindowFull and the error of ctx.
+// Once ctx is cancelled, the packet isn't resent anymore and the returned channel receives false.
+func (m *Manager) SendReliableRoutedPacket(ctx context.Context, packet *pkt.Packet) (chan bool, error) {
+	return m.SendTrackedRoutedPacket(ctx, packet, nil)
+}
+
+// SendTrackedRoutedPacket acts like SendReliableRoutedPacket but records retransmissions and losses of the packet in stats.
+// stats may be nil.
+func (m *Manager) SendTrackedRoutedPacket(ctx context.Context, packet *pkt.Packet, stats *sequencing.TransferStats) (chan bool, error) {
 	destinationIP := netip.AddrFrom4(packet.Header.DestAddr)
 
-	nextHop, found := router.GetNextHop(destinationIP)
+	nextHop, found := m.router.GetNextHop(destinationIP)
 	if !found {
-		return nil, errors.New("no next hop found for the destination address")
+		return nil, fmt.Errorf("%w %s", ErrNoRoute, destinationIP)
 	}
 
 	var ackChan chan bool
 	var err error
+	windowFull := false // Whether the packet waited for the congestion window
 
 	for {
-		ackChan, err = outgoingSequencing.AddOpenAck(packet, func() {
-			nextHop, found := router.GetNextHop(destinationIP) // Get the current next hop again (it may have changed)
+		if isDataMsgType(packet.GetMessageType()) && m.exceedsFairShare(nextHop, destinationIP) {
+			// Other destinations behind the same next hop get their share first
+			if err := sleepContext(ctx, common.CWND_FULL_RETRY_DELAY); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		ackChan, err = m.outgoingSequencing.AddTrackedOpenAck(ctx, packet, func() {
+			nextHop, found := m.router.GetNextHop(destinationIP) // Get the current next hop again (it may have changed)
 			if !found {
 				logger.Infof("Host %s is no longer reachable, removing open acknowledgment for packet number %v", destinationIP, packet.Header.PktNum)
 				return // Peer no longer reachable (e.g., disconnected)
 			}
 
-			_ = sendPacketTo(nextHop, packet)
-		})
+			_ = m.sendPacketTo(nextHop, packet)
+		}, stats)
 
 		if err == nil {
 			break
 		}
 
-		if errors.Is(err, sequencing.CongestionWindowFullError) {
-			time.Sleep(common.CWND_FULL_RETRY_DELAY)
+		if errors.Is(err, sequencing.ErrWindowFull) {
+			windowFull = true
+			if err := sleepContext(ctx, common.CWND_FULL_RETRY_DELAY); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrWindowFull, err)
+			}
 			continue
 		}
+		if windowFull && ctx.Err() != nil {
+			return nil, fmt.Errorf("%w: %w", ErrWindowFull, err) // Cancelled right after waiting for the window
+		}
+
+		return nil, fmt.Errorf("failed to add open acknowledgment: %w", err)
+	}
 
-		return nil, errors.New("failed to add open acknowledgment: " + err.Error())
+	if isDataMsgType(packet.GetMessageType()) {
+		m.attachCongestionEcho(packet)
 	}
+	m.attachTimestamps(packet)
+	m.attachPiggybackedAcks(packet) // Right before the first send, so the ACKs are as fresh as possible
 
-	err = sendPacketTo(nextHop, packet)
+	err = m.sendPacketTo(nextHop, packet)
 	if err != nil {
 		return nil, err
 	}
@@ -89,28 +253,38 @@ func SendReliableRoutedPacket(packet *pkt.Packet) (chan bool, error) {
 // SendReliablePacketTo sends a packet.
 // Reliable: Resends and timeouts are handled.
 // To: Send the packet to a specific address and port.
-func SendReliablePacketTo(addrPort netip.AddrPort, packet *pkt.Packet) (chan bool, error) {
+// Errors if sending fails or ctx is cancelled before the packet could be sent, see SendReliableRoutedPacket.
+func (m *Manager) SendReliablePacketTo(ctx context.Context, addrPort netip.AddrPort, packet *pkt.Packet) (chan bool, error) {
 	var ackChan chan bool
 	var err error
+	windowFull := false // Whether the packet waited for the congestion window
 
 	for {
-		ackChan, err = outgoingSequencing.AddOpenAck(packet, func() {
-			_ = sendPacketTo(addrPort, packet)
+		ackChan, err = m.outgoingSequencing.AddOpenAck(ctx, packet, func() {
+			_ = m.sendPacketTo(addrPort, packet)
 		})
 
 		if err == nil {
 			break
 		}
 
-		if errors.Is(err, sequencing.CongestionWindowFullError) {
-			time.Sleep(common.CWND_FULL_RETRY_DELAY)
+		if errors.Is(err, sequencing.ErrWindowFull) {
+			windowFull = true
+			if err := sleepContext(ctx, common.CWND_FULL_RETRY_DELAY); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrWindowFull, err)
+			}
 			continue
 		}
+		if windowFull && ctx.Err() != nil {
+			return nil, fmt.Errorf("%w: %w", ErrWindowFull, err) // Cancelled right after waiting for the window
+		}
 
-		return nil, errors.New("failed to add open acknowledgment: " + err.Error())
+		return nil, fmt.Errorf("failed to add open acknowledgment: %w", err)
 	}
 
-	err = sendPacketTo(addrPort, packet)
+	m.attachTimestamps(packet)
+
+	err = m.sendPacketTo(addrPort, packet)
 	if err != nil {
 		return nil, err
 	}
@@ -118,57 +292,157 @@ func SendReliablePacketTo(addrPort netip.AddrPort, packet *pkt.Packet) (chan boo
 	return ackChan, nil
 }
 
+// sleepContext waits for the duration or until ctx is cancelled, in which case it returns the error of ctx.
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// outputBufferPool holds reusable buffers for serializing outgoing packets.
+var outputBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, common.UDP_BUFFER_SIZE_BYTES)
+		return &buf
+	},
+}
+
 // sendPacketTo sends a packet to an AddrPort.
-func sendPacketTo(addrPort netip.AddrPort, packet *pkt.Packet) error {
+// The packet is serialized into a pooled buffer, the socket must not retain the data after SendTo returns.
+// If authentication is enabled, the serialized packet carries a MAC, the packet itself is not modified.
+// Relayed neighbors (see RelayedAddrPort) are reached by encapsulating the packet for their relay.
+// MSG/FILE packets are queued behind the other data packets to the next hop, all other packets are sent immediately (see sendSchedulerState).
+// Write errors of queued packets are only logged, but a closed socket is reported for them as well.
+// MTU probes are sent with the Don't-Fragment bit and bypass netem (see DiscoverPathMTU).
+func (m *Manager) sendPacketTo(addrPort netip.AddrPort, packet *pkt.Packet) error {
+	m.recordSent(packet)
+
+	if IsRelayedAddrPort(addrPort) {
+		return m.sendRelayed(addrPort.Addr(), packet)
+	}
+
+	if isDataMsgType(packet.GetMessageType()) {
+		if _, err := m.socket.GetBoundAddress(); err != nil {
+			return wrapSocketError(net.ErrClosed)
+		}
+		m.enqueueDataPacket(addrPort, packet)
+		return nil
+	}
+
 	nextHop := &net.UDPAddr{
 		IP:   addrPort.Addr().AsSlice(),
 		Port: int(addrPort.Port()),
 	}
 
-	err := socket.SendTo(nextHop, packet.ToByteArray())
+	buf := outputBufferPool.Get().(*[]byte)
+	data := m.appendWireFormat((*buf)[:0], packet)
+
+	var err error
+	if isMTUProbeRequest(packet) {
+		err = m.socket.SendDontFragmentTo(nextHop, data) // A fragmented probe would be answered for a size the path can't carry
+	} else {
+		err = m.writeToSocket(nextHop, data)
+	}
+
+	*buf = data[:0] // Keep a grown buffer
+	outputBufferPool.Put(buf)
+
 	if err != nil {
-		return errors.New("failed to send packet to peer: " + err.Error())
+		return wrapSocketError(err)
 	}
 
-	logger.Tracef("SENT %s %d to %v", msgTypeNames[packet.GetMessageType()], packet.Header.PktNum, packet.Header.DestAddr)
+	name := msgTypeNames[packet.GetMessageType()]
+	logger.LimitedTracef("SENT "+name, "SENT %s %d to %v", name, packet.Header.PktNum, packet.Header.DestAddr)
 
 	return nil
 }
 
+// appendWireFormat serializes the packet as it is sent on the wire, i.e. with a MAC if authentication is enabled.
+func (m *Manager) appendWireFormat(buf []byte, packet *pkt.Packet) []byte {
+	if m.IsAuthenticationEnabled() {
+		return packet.AppendAuthenticatedTo(buf, m.preSharedKey)
+	}
+	return packet.AppendTo(buf)
+}
+
 // BuildSequencedPacket constructs a packet with the next packet number for the destination address.
 // This function creates a copy of the payload so that the original payload can be modified without affecting the packet.
-func BuildSequencedPacket(msgType byte, payload pkt.Payload, destAddr netip.Addr) *pkt.Packet {
+func (m *Manager) BuildSequencedPacket(msgType byte, payload pkt.Payload, destAddr netip.Addr) *pkt.Packet {
 	payloadCopy := make(pkt.Payload, len(payload))
 	copy(payloadCopy, payload)
-	return buildPacket(msgType, payloadCopy, destAddr, outgoingSequencing.GetNextpacketNumber(destAddr))
+	return m.buildPacket(msgType, payloadCopy, destAddr, m.outgoingSequencing.GetNextpacketNumber(destAddr))
 }
 
-func buildPacket(msgType byte, payload pkt.Payload, destAddr netip.Addr, pktNum [4]byte) *pkt.Packet {
+// BuildSequencedPacketShared acts like BuildSequencedPacket but does not copy the payload.
+// The caller must not modify the payload until the packet is acknowledged, because resends use the same payload.
+// This avoids a copy per chunk when the payload already is a dedicated slice (e.g. of a file read buffer).
+func (m *Manager) BuildSequencedPacketShared(msgType byte, payload pkt.Payload, destAddr netip.Addr) *pkt.Packet {
+	return m.buildPacket(msgType, payload, destAddr, m.outgoingSequencing.GetNextpacketNumber(destAddr))
+}
+
+// BuildFileNamePacket builds the first packet of a file transfer.
+// It carries the file name as payload and advertises the file size, so the receiver can reject files that don't fit.
+// A negative file size isn't advertised, e.g. for files streamed from a pipe.
+func (m *Manager) BuildFileNamePacket(fileName string, fileSize int64, destAddr netip.Addr) *pkt.Packet {
+	packet := m.BuildSequencedPacket(pkt.MsgTypeFileTransfer, []byte(fileName), destAddr)
+	if fileSize >= 0 {
+		packet.AddExtension(pkt.ExtTypeFileSize, binary.BigEndian.AppendUint64(nil, uint64(fileSize)))
+		pkt.SetChecksum(packet)
+	}
+	return packet
+}
+
+func (m *Manager) buildPacket(msgType byte, payload pkt.Payload, destAddr netip.Addr, pktNum [4]byte) *pkt.Packet {
 	packet := &pkt.Packet{
 		Header: pkt.Header{
-			SourceAddr: socket.MustGetLocalAddress().Addr().As4(),
+			SourceAddr: m.socket.MustGetLocalAddress().Addr().As4(),
 			DestAddr:   destAddr.As4(),
-			Control:    pkt.MakeControlByte(msgType, common.TEAM_ID),
+			Control:    pkt.MakeControlByte(msgType, m.teamID),
 			TTL:        common.INITIAL_TTL,
 			PktNum:     pktNum,
 		},
 		Payload: payload,
 	}
+	if m.IsPathRecordingEnabled() {
+		m.startPath(packet)
+	}
 	pkt.SetChecksum(packet)
 	return packet
 }
 
 // SendRoutedAcknowledgment sends an acknowledgment packet to the specified peer address.
 // Routed: Uses the routing table to determine the next hop.
-func SendRoutedAcknowledgment(addr netip.Addr, pktNum [4]byte) error {
-	nextHop, found := router.GetNextHop(addr)
+// If we are currently sending data to the peer, the ACK may be held back shortly to be piggybacked on the next data packet.
+func (m *Manager) SendRoutedAcknowledgment(addr netip.Addr, pktNum [4]byte) error {
+	if _, found := m.router.GetNextHop(addr); !found {
+		return fmt.Errorf("%w %s (is the peer disconnected?)", ErrNoRoute, addr)
+	}
+
+	if m.queueAcknowledgment(addr, pktNum) {
+		return nil
+	}
+
+	return m.sendRoutedAcknowledgment(addr, pktNum)
+}
+
+// sendRoutedAcknowledgment sends a standalone acknowledgment packet to the specified peer address.
+func (m *Manager) sendRoutedAcknowledgment(addr netip.Addr, pktNum [4]byte) error {
+	nextHop, found := m.router.GetNextHop(addr)
 	if !found {
-		return errors.New("no next hop found for the peer address (is the peer disconnected?)")
+		return fmt.Errorf("%w %s (is the peer disconnected?)", ErrNoRoute, addr)
 	}
 
-	ackPacket := buildPacket(pkt.MsgTypeAcknowledgment, nil, addr, pktNum)
+	ackPacket := m.buildPacket(pkt.MsgTypeAcknowledgment, nil, addr, pktNum)
+	m.attachCongestionEcho(ackPacket)
+	m.attachTimestamps(ackPacket)
 
-	err := sendPacketTo(nextHop, ackPacket)
+	err := m.sendPacketTo(nextHop, ackPacket)
 	if err != nil {
 		return err
 	}
@@ -176,12 +450,13 @@ func SendRoutedAcknowledgment(addr netip.Addr, pktNum [4]byte) error {
 	return nil
 }
 
-// SendAcknowledgmentTo sends an acknowledgment packet to the specified address and port.
+// SendAcknowledgmentTo sends an acknowledgment packet for the peer addr to the specified address and port.
 // To: Send the packet to a specific address and port.
-func SendAcknowledgmentTo(addrPort netip.AddrPort, pktNum [4]byte) error {
-	ackPacket := buildPacket(pkt.MsgTypeAcknowledgment, nil, addrPort.Addr(), pktNum)
+// addr differs from the address of addrPort if the peer identifies by a node ID.
+func (m *Manager) SendAcknowledgmentTo(addr netip.Addr, addrPort netip.AddrPort, pktNum [4]byte) error {
+	ackPacket := m.buildPacket(pkt.MsgTypeAcknowledgment, nil, addr, pktNum)
 
-	err := sendPacketTo(addrPort, ackPacket)
+	err := m.sendPacketTo(addrPort, ackPacket)
 	if err != nil {
 		return err
 	}
@@ -189,49 +464,11 @@ func SendAcknowledgmentTo(addrPort netip.AddrPort, pktNum [4]byte) error {
 	return nil
 }
 
-// FloodLSA sends a Link State Advertisement (LSA) to all neighbors.
-// Optionally, it can exclude certain addresses (neighbors) from receiving the LSA.
-func FloodLSA(lsaOwner netip.Addr, lsa routing.LSAEntry, exceptAddrs ...netip.Addr) {
-	payload := make(pkt.Payload, 0, 8+len(lsa.Neighbors)*4)
-
-	lsaOwnerBytes := lsaOwner.As4()
-	payload = append(payload, lsaOwnerBytes[:]...)
-
-	seqNumBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(seqNumBytes, lsa.SeqNum)
-	payload = append(payload, seqNumBytes...)
-
-	for _, neighborAddr := range lsa.Neighbors {
-		addrBytes := neighborAddr.As4()
-		payload = append(payload, addrBytes[:]...)
-	}
-
-	for destAddr, destAddrPort := range router.GetNeighbors() {
-		if slices.Contains(exceptAddrs, destAddr) {
-			continue
-		}
-
-		packet := BuildSequencedPacket(pkt.MsgTypeLSA, payload, destAddr)
+// SendDD sends a Database Description representing our LSDB to the neighbor destAddr at destAddrPort.
+func (m *Manager) SendDD(destAddr netip.Addr, destAddrPort netip.AddrPort) error {
+	packet := m.BuildSequencedPacket(pkt.MsgTypeDD, m.buildDDPayload(false), destAddr)
 
-		_, err := SendReliablePacketTo(destAddrPort, packet)
-		if err != nil {
-			logger.Warnf("Failed to send LSA for %s: %v", destAddr, err)
-		}
-	}
-}
-
-// SendDD sends a Database Description representing our LSDB to the destination address.
-func SendDD(destAddrPort netip.AddrPort) error {
-	existingLSAs := router.GetAvailableLSAs()
-	payload := make(pkt.Payload, 0, len(existingLSAs))
-	for _, addr := range existingLSAs {
-		addrBytes := addr.As4()
-		payload = append(payload, addrBytes[:]...)
-	}
-
-	packet := BuildSequencedPacket(pkt.MsgTypeDD, payload, destAddrPort.Addr())
-
-	_, err := SendReliablePacketTo(destAddrPort, packet)
+	_, err := m.SendReliablePacketTo(context.Background(), destAddrPort, packet)
 	return err
 }
 
@@ -239,27 +476,46 @@ func SendDD(destAddrPort netip.AddrPort) error {
 // Routed: Uses the routing table to determine the next hop.
 // This function automatically decrements the TTL by one.
 // Timeouts and resends are NOT handled (should be handled by source peer).
-// Errors if the TTL is already zero or less.
-func ForwardRouted(packet *pkt.Packet) error {
+// Redundant copies of recently forwarded packets are dropped (see forwardCacheState).
+// Our address is appended to a recorded path (see pathRecordState).
+// Errors if the TTL is one or less, the next hop would receive the packet with TTL zero, which the wire format doesn't allow.
+// ingress is the address the packet was received from, forwarded packets are accounted per ingress neighbor and next hop (see ForwardingStats).
+func (m *Manager) ForwardRouted(packet *pkt.Packet, ingress netip.AddrPort) error {
 	destinationIP := netip.AddrFrom4(packet.Header.DestAddr)
 
-	nextHop, found := router.GetNextHop(destinationIP)
+	nextHop, found := m.router.GetNextHop(destinationIP)
 	if !found {
-		return errors.New("no next hop found for the destination address")
+		return fmt.Errorf("%w %s", ErrNoRoute, destinationIP)
 	}
 
-	if packet.Header.TTL <= 0 {
-		return errors.New("packet TTL is already zero or less, cannot forward")
+	if packet.Header.TTL <= 1 {
+		return errors.New("packet TTL expires, cannot forward")
 	}
+
+	if admit, ack := m.admitForwarded(packet); !admit {
+		logger.Debugf("Dropping redundant copy of %s %d from %v to %v", msgTypeNames[packet.GetMessageType()], packet.Header.PktNum, packet.Header.SourceAddr, packet.Header.DestAddr)
+		if ack != nil {
+			m.resendForwardedAck(ack)
+		}
+		return nil
+	}
+
 	packet.Header.TTL--
-	pkt.SetChecksum(packet)
+	m.recordHop(packet)
+	m.markIfCongested(nextHop, packet)
+	m.prepareHopARQ(nextHop, packet) // Also updates the checksum
 
-	err := sendPacketTo(nextHop, packet)
+	err := m.sendPacketTo(nextHop, packet)
 	if err != nil {
 		return err
 	}
 
-	logger.Debugf("FORWARDED %s %d to %v", msgTypeNames[packet.GetMessageType()], packet.Header.PktNum, packet.Header.DestAddr)
+	m.rememberForwardedAck(packet)
+
+	m.recordForwarded(ingress, nextHop, packet)
+
+	name := msgTypeNames[packet.GetMessageType()]
+	logger.LimitedDebugf("FORWARDED "+name, "FORWARDED %s %d to %v", name, packet.Header.PktNum, packet.Header.DestAddr)
 
 	return nil
 }
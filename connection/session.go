@@ -0,0 +1,142 @@
+package connection
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// sessionState counts what happened since the node started, for the summary printed on exit (see SessionSummary).
+type sessionState struct {
+	mu        sync.Mutex
+	start     time.Time
+	neighbors map[netip.Addr]bool // Neighbors connected at any time of the session
+	messages  TransferCounts
+	files     TransferCounts
+}
+
+// TransferCounts counts completed messages or files in both directions.
+type TransferCounts struct {
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+}
+
+// SessionSummary is a summary of the session of a node, e.g. for lab assignments and experiments.
+type SessionSummary struct {
+	Start              time.Time            `json:"start"`
+	Duration           time.Duration        `json:"durationNs"`
+	Addr               netip.Addr           `json:"addr"`
+	NeighborsConnected int                  `json:"neighborsConnected"` // Neighbors connected at any time of the session
+	Messages           TransferCounts       `json:"messages"`
+	Files              TransferCounts       `json:"files"`
+	Sent               TrafficCounter       `json:"sent"`     // Packets originated by us, including retransmissions and ACKs
+	Received           TrafficCounter       `json:"received"` // Packets addressed to us
+	ReliablePackets    uint64               `json:"reliablePackets"`
+	Retransmissions    uint64               `json:"retransmissions"`
+	RouteChanges       uint64               `json:"routeChanges"` // Routes added, removed or moved to another next hop, see routing.Router.RouteChanges
+	Peers              []PeerSessionSummary `json:"peers"`        // Sorted by address
+}
+
+// PeerSessionSummary summarizes the session with a single peer.
+type PeerSessionSummary struct {
+	Addr            netip.Addr     `json:"addr"`
+	Sent            TrafficCounter `json:"sent"`
+	Received        TrafficCounter `json:"received"`
+	ReliablePackets uint64         `json:"reliablePackets"`
+	Retransmissions uint64         `json:"retransmissions"`
+	MaxCwnd         int64          `json:"maxCwnd"` // Largest congestion window in packets, 0 if no reliable packets were sent
+}
+
+// RetransmissionRate returns the share of retransmissions in all transmissions of reliable packets.
+func (s SessionSummary) RetransmissionRate() float64 {
+	transmissions := s.ReliablePackets + s.Retransmissions
+	if transmissions == 0 {
+		return 0
+	}
+	return float64(s.Retransmissions) / float64(transmissions)
+}
+
+// recordSessionNeighbor counts a connected neighbor.
+func (m *Manager) recordSessionNeighbor(addr netip.Addr) {
+	m.session.mu.Lock()
+	defer m.session.mu.Unlock()
+
+	m.session.neighbors[addr] = true
+}
+
+// RecordTransfer counts a completed message or file (msgType pkt.MsgTypeChatMessage or pkt.MsgTypeFileTransfer) that was sent or received.
+func (m *Manager) RecordTransfer(msgType byte, sent bool) {
+	m.session.mu.Lock()
+	defer m.session.mu.Unlock()
+
+	counts := &m.session.messages
+	if msgType == pkt.MsgTypeFileTransfer {
+		counts = &m.session.files
+	}
+
+	if sent {
+		counts.Sent++
+	} else {
+		counts.Received++
+	}
+}
+
+// SessionSummary returns a summary of the session since the node started.
+func (m *Manager) SessionSummary() SessionSummary {
+	m.session.mu.Lock()
+	summary := SessionSummary{
+		Start:              m.session.start,
+		Duration:           time.Since(m.session.start),
+		NeighborsConnected: len(m.session.neighbors),
+		Messages:           m.session.messages,
+		Files:              m.session.files,
+	}
+	m.session.mu.Unlock()
+
+	if localAddr, err := m.socket.GetLocalAddress(); err == nil {
+		summary.Addr = localAddr.Addr()
+	}
+	summary.RouteChanges = m.router.RouteChanges()
+
+	peers := make(map[netip.Addr]*PeerSessionSummary)
+	peerSummary := func(addr netip.Addr) *PeerSessionSummary {
+		if _, exists := peers[addr]; !exists {
+			peers[addr] = &PeerSessionSummary{Addr: addr}
+		}
+		return peers[addr]
+	}
+
+	m.peerTraffic.mu.Lock()
+	for addr, traffic := range m.peerTraffic.peers {
+		peer := peerSummary(addr)
+		peer.Sent = traffic.Sent
+		peer.Received = traffic.Received
+
+		summary.Sent.Packets += traffic.Sent.Packets
+		summary.Sent.Bytes += traffic.Sent.Bytes
+		summary.Received.Packets += traffic.Received.Packets
+		summary.Received.Bytes += traffic.Received.Bytes
+	}
+	m.peerTraffic.mu.Unlock()
+
+	for addr, totals := range m.outgoingSequencing.GetPeerTotals() {
+		peer := peerSummary(addr)
+		peer.ReliablePackets = totals.Packets
+		peer.Retransmissions = totals.Retransmissions
+		peer.MaxCwnd = totals.MaxCwnd
+
+		summary.ReliablePackets += totals.Packets
+		summary.Retransmissions += totals.Retransmissions
+	}
+
+	summary.Peers = make([]PeerSessionSummary, 0, len(peers))
+	for _, peer := range peers {
+		summary.Peers = append(summary.Peers, *peer)
+	}
+	slices.SortFunc(summary.Peers, func(a, b PeerSessionSummary) int { return a.Addr.Compare(b.Addr) })
+
+	return summary
+}
@@ -0,0 +1,53 @@
+package connection
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// A message that fits into one packet is usually followed by a FIN, so a one-liner costs two data packets and two ACKs.
+// If the receiver announced CapabilitySinglePacket, the MSG instead carries the FIN in an ExtTypeFinish extension.
+// The extension holds the FIN payload fields that aren't in the header of the MSG: the send time and the boot epoch.
+// The last and first packet number of the message ID are the packet number of the MSG.
+// Capabilities are only exchanged between neighbors, so messages to other peers are still followed by a FIN.
+
+const finishExtensionSize = 16
+
+// implementedCapabilities returns the capabilities announced by default.
+func implementedCapabilities() Capability {
+	var capabilities Capability
+	if common.SINGLE_PACKET_MESSAGES {
+		capabilities |= CapabilitySinglePacket
+	}
+	return capabilities
+}
+
+// BuildSinglePacketMessage returns a sequenced MSG with the whole message that finishes the message itself.
+// Must only be sent to peers that support CapabilitySinglePacket, others would wait for a FIN.
+func (m *Manager) BuildSinglePacketMessage(text pkt.Payload, destAddr netip.Addr, sentAt time.Time) *pkt.Packet {
+	packet := m.BuildSequencedPacket(pkt.MsgTypeChatMessage, text, destAddr)
+
+	value := binary.BigEndian.AppendUint64(make([]byte, 0, finishExtensionSize), uint64(sentAt.UnixNano()))
+	value = binary.BigEndian.AppendUint64(value, m.BootEpoch())
+	packet.AddExtension(pkt.ExtTypeFinish, value)
+	pkt.SetChecksum(packet)
+	return packet
+}
+
+// ParseFinishExtension returns the send time and boot epoch of a single-packet message.
+// Returns false if the packet doesn't finish its message.
+func ParseFinishExtension(packet *pkt.Packet) (sentAt time.Time, epoch uint64, ok bool) {
+	if packet.GetMessageType() != pkt.MsgTypeChatMessage {
+		return time.Time{}, 0, false
+	}
+	for _, ext := range packet.GetExtensions(pkt.ExtTypeFinish) {
+		if len(ext.Value) == finishExtensionSize {
+			return time.Unix(0, int64(binary.BigEndian.Uint64(ext.Value[:8]))), binary.BigEndian.Uint64(ext.Value[8:]), true
+		}
+	}
+	return time.Time{}, 0, false
+}
@@ -0,0 +1,54 @@
+package connection
+
+import (
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/assert"
+)
+
+// SetTeamID sets the team ID of outgoing packets and the team incoming packets must belong to.
+// Must be called before the socket is opened.
+func (m *Manager) SetTeamID(id byte) {
+	assert.Assert(id <= 0b1111, "teamID must be 4 bits (0-15)")
+	m.teamID = id
+}
+
+// TeamID returns the configured team ID.
+func (m *Manager) TeamID() byte {
+	return m.teamID
+}
+
+// SetPromiscuous enables or disables the processing of packets of other teams.
+// Can be called at any time.
+func (m *Manager) SetPromiscuous(enabled bool) {
+	m.promiscuous.Store(enabled)
+}
+
+// IsPromiscuous returns whether packets of other teams are processed.
+func (m *Manager) IsPromiscuous() bool {
+	return m.promiscuous.Load()
+}
+
+// VerifyTeam returns whether an incoming packet may be processed.
+// The packet must belong to our team unless promiscuous mode is enabled.
+// Dropped packets are counted per team.
+func (m *Manager) VerifyTeam(packet *pkt.Packet) bool {
+	packetTeamID := packet.GetTeamID()
+	if packetTeamID == m.teamID || m.IsPromiscuous() {
+		return true
+	}
+
+	m.teamDrops[packetTeamID].Add(1)
+	return false
+}
+
+// TeamDrops returns the number of dropped incoming packets per team ID.
+// Teams without dropped packets are omitted.
+func (m *Manager) TeamDrops() map[byte]uint64 {
+	drops := make(map[byte]uint64)
+	for id := range m.teamDrops {
+		if count := m.teamDrops[id].Load(); count > 0 {
+			drops[byte(id)] = count
+		}
+	}
+	return drops
+}
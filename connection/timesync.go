@@ -0,0 +1,173 @@
+package connection
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/ringbuffer"
+)
+
+// Hosts without synchronized clocks (e.g. without NTP) see the timestamps of other hosts shifted by the offset of their clocks.
+// The offset to a peer is estimated like NTP does: a packet carrying its send time t1 (ExtTypeTimestamp) is answered with the next ACK or reliable packet to its source,
+// which echoes t1 together with its receive time t2 and its own send time t3 (ExtTypeTimeEcho). The source receives the echo at t4 and computes
+//
+//	offset = ((t2 - t1) + (t3 - t4)) / 2
+//	delay  = (t4 - t1) - (t3 - t2)
+//
+// Queueing and retransmissions make the delay asymmetric, so the sample with the smallest delay of the last common.TIME_SYNC_SAMPLES samples is used.
+// A new sample is requested every common.TIME_SYNC_INTERVAL, the echo usually carries the request of the peer, so both sides get a sample from one exchange (starting with CONNECT and its ACK).
+// timeSyncState holds the clock state per peer.
+type timeSyncState struct {
+	mu    sync.Mutex
+	peers map[netip.Addr]*peerClock
+}
+
+type peerClock struct {
+	lastRequested time.Time
+	echo          *timestampEcho // Pending echo of the latest request of the peer, nil if none
+	samples       *ringbuffer.RingBuffer[ClockSample]
+}
+
+// timestampEcho is a received ExtTypeTimestamp that wasn't echoed yet.
+type timestampEcho struct {
+	origin     int64 // Send time in the clock of the peer (Unix nanoseconds)
+	receivedAt int64 // Unix nanoseconds
+}
+
+// ClockSample is a single estimate of the clock offset to a peer.
+type ClockSample struct {
+	Offset time.Duration // Clock of the peer minus the local clock
+	Delay  time.Duration // Round-trip delay of the exchange without the time the peer held the echo back
+	Time   time.Time     // When the sample was taken
+}
+
+// ClockOffset is the current clock offset estimate of a peer, the sample with the smallest delay.
+type ClockOffset struct {
+	ClockSample
+	Samples int // Number of samples the best sample was chosen from
+}
+
+// clockSample computes an offset sample from the send time t1 of the request, the receive time t2 and send time t3 of the echo in the clock of the peer and the receive time t4 of the echo.
+func clockSample(t1 int64, t2 int64, t3 int64, t4 int64) ClockSample {
+	return ClockSample{
+		Offset: time.Duration(((t2 - t1) + (t3 - t4)) / 2),
+		Delay:  time.Duration((t4 - t1) - (t3 - t2)),
+		Time:   time.Unix(0, t4),
+	}
+}
+
+// peerClockLocked returns the clock state of the peer and creates it if it doesn't exist.
+// Must be called with m.timeSync.mu held.
+func (m *Manager) peerClockLocked(addr netip.Addr) *peerClock {
+	clock, exists := m.timeSync.peers[addr]
+	if !exists {
+		clock = &peerClock{samples: ringbuffer.New[ClockSample](common.TIME_SYNC_SAMPLES)}
+		m.timeSync.peers[addr] = clock
+	}
+	return clock
+}
+
+// attachTimestamps adds the pending echo of the destination and, once per common.TIME_SYNC_INTERVAL, a new request to an outgoing packet and updates its checksum.
+// Must be called right before the packet is sent for the first time, retransmissions carry the same times.
+func (m *Manager) attachTimestamps(packet *pkt.Packet) {
+	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
+	now := time.Now()
+	nowNanos := now.UnixNano()
+
+	m.timeSync.mu.Lock()
+	clock := m.peerClockLocked(destAddr)
+	echo := clock.echo
+	clock.echo = nil
+	request := now.Sub(clock.lastRequested) >= common.TIME_SYNC_INTERVAL
+	if request {
+		clock.lastRequested = now
+	}
+	m.timeSync.mu.Unlock()
+
+	if echo != nil {
+		value := binary.BigEndian.AppendUint64(nil, uint64(echo.origin))
+		value = binary.BigEndian.AppendUint64(value, uint64(echo.receivedAt))
+		value = binary.BigEndian.AppendUint64(value, uint64(nowNanos))
+		packet.AddExtension(pkt.ExtTypeTimeEcho, value)
+	}
+	if request {
+		packet.AddExtension(pkt.ExtTypeTimestamp, binary.BigEndian.AppendUint64(nil, uint64(nowNanos)))
+	}
+	if echo != nil || request {
+		pkt.SetChecksum(packet)
+	}
+}
+
+// RecordTimestamps handles the time sync extensions of a packet addressed to us.
+// A request is echoed with the next packet to its source, an echo adds a clock offset sample of its source.
+func (m *Manager) RecordTimestamps(packet *pkt.Packet) {
+	receivedAt := time.Now().UnixNano()
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+
+	origin, hasRequest := packet.GetTimestamp()
+	t1, t2, t3, hasEcho := packet.GetTimeEcho()
+	if !hasRequest && !hasEcho {
+		return
+	}
+
+	m.timeSync.mu.Lock()
+	defer m.timeSync.mu.Unlock()
+
+	clock := m.peerClockLocked(srcAddr)
+	if hasRequest {
+		clock.echo = &timestampEcho{origin: origin, receivedAt: receivedAt}
+	}
+	if hasEcho {
+		sample := clockSample(t1, t2, t3, receivedAt)
+		if sample.Delay < 0 {
+			logger.Debugf("Dropping clock offset sample of %v with negative delay %v", srcAddr, sample.Delay)
+			return
+		}
+		clock.samples.Push(sample)
+		logger.Debugf("Clock offset sample of %v: offset %v, delay %v", srcAddr, sample.Offset, sample.Delay)
+	}
+}
+
+// GetClockOffset returns the current clock offset estimate of the peer.
+// Returns false if no sample was taken yet.
+func (m *Manager) GetClockOffset(addr netip.Addr) (ClockOffset, bool) {
+	m.timeSync.mu.Lock()
+	defer m.timeSync.mu.Unlock()
+
+	clock, exists := m.timeSync.peers[addr]
+	if !exists || clock.samples.Len() == 0 {
+		return ClockOffset{}, false
+	}
+
+	samples := clock.samples.Items()
+	best := samples[0]
+	for _, sample := range samples[1:] {
+		if sample.Delay < best.Delay {
+			best = sample
+		}
+	}
+	return ClockOffset{ClockSample: best, Samples: len(samples)}, true
+}
+
+// ToLocalTime converts a timestamp of the peer to the local clock.
+// Returns the timestamp unchanged and false if the clock offset of the peer is unknown.
+func (m *Manager) ToLocalTime(addr netip.Addr, remote time.Time) (time.Time, bool) {
+	offset, exists := m.GetClockOffset(addr)
+	if !exists {
+		return remote, false
+	}
+	return remote.Add(-offset.Offset), true
+}
+
+// clearTimeSync drops the clock state of the peer.
+func (m *Manager) clearTimeSync(addr netip.Addr) {
+	m.timeSync.mu.Lock()
+	defer m.timeSync.mu.Unlock()
+
+	delete(m.timeSync.peers, addr)
+}
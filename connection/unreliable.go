@@ -0,0 +1,57 @@
+package connection
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// Unreliable messages are sent as a single MSG with an ExtTypeUnreliable extension carrying the send time.
+// They have packet number zero and are neither sequenced, acknowledged nor resent, and aren't followed by a FIN.
+// This avoids the per-chunk ACKs for ephemeral messages like typing indicators where a late message is worthless.
+// Older nodes treat an unreliable message as the first chunk of a message that is never finished.
+
+// ErrUnreliableMessageTooLarge is returned if an unreliable message doesn't fit into a single packet.
+var ErrUnreliableMessageTooLarge = errors.New("message doesn't fit into a single packet")
+
+// SendUnreliableMessage sends the text as unreliable message to the peer.
+// Errors with ErrUnreliableMessageTooLarge if the text exceeds GetMaxPayloadSize, unreliable messages aren't split.
+// Returns the size of the packet in bytes, to compare the overhead with reliable messages.
+func (m *Manager) SendUnreliableMessage(peer netip.Addr, text string, sentAt time.Time) (int, error) {
+	if limit := m.GetMaxPayloadSize(peer); len(text) > limit {
+		return 0, fmt.Errorf("%w (%d bytes, limit %d)", ErrUnreliableMessageTooLarge, len(text), limit)
+	}
+
+	nextHop, found := m.router.GetNextHop(peer)
+	if !found {
+		return 0, fmt.Errorf("%w %s (is the peer disconnected?)", ErrNoRoute, peer)
+	}
+
+	packet := m.buildPacket(pkt.MsgTypeChatMessage, pkt.Payload(text), peer, [4]byte{})
+	packet.AddExtension(pkt.ExtTypeUnreliable, binary.BigEndian.AppendUint64(nil, uint64(sentAt.UnixNano())))
+	pkt.SetChecksum(packet)
+	size := packet.Size() // Before sending, the send queue may still add piggybacked ACKs
+
+	if err := m.sendPacketTo(nextHop, packet); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// ParseUnreliableExtension returns the send time of an unreliable message.
+// Returns false if the packet isn't an unreliable message.
+func ParseUnreliableExtension(packet *pkt.Packet) (sentAt time.Time, ok bool) {
+	if packet.GetMessageType() != pkt.MsgTypeChatMessage {
+		return time.Time{}, false
+	}
+	for _, ext := range packet.GetExtensions(pkt.ExtTypeUnreliable) {
+		if len(ext.Value) == 8 {
+			return time.Unix(0, int64(binary.BigEndian.Uint64(ext.Value))), true
+		}
+	}
+	return time.Time{}, false
+}
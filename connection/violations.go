@@ -0,0 +1,171 @@
+package connection
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/ringbuffer"
+)
+
+// The handlers accept everything they can make sense of, so packets of other implementations that bend the wire format mostly work until they don't.
+// ValidatePacket checks every inbound packet against the constraints of the wire format (see pkt.DescribeWireFormat) and counts the violations with recent samples,
+// which shows what another implementation does differently when interoperating in the same network.
+// In strict mode, violating packets are dropped instead of processed.
+
+// ViolationKind is a constraint of the wire format an inbound packet violated.
+type ViolationKind int
+
+const (
+	ViolationMalformed     ViolationKind = iota // Packet couldn't be parsed
+	ViolationChecksum                           // Checksum doesn't match
+	ViolationTeam                               // Team ID differs from ours
+	ViolationTTL                                // TTL is 0 or above common.INITIAL_TTL
+	ViolationPayloadLength                      // Payload length fits no payload layout of the message type
+	ViolationReserved                           // Reserved field isn't zero
+	ViolationExtension                          // Value length doesn't fit the extension type
+	violationKinds
+)
+
+func (k ViolationKind) String() string {
+	switch k {
+	case ViolationMalformed:
+		return "malformed"
+	case ViolationChecksum:
+		return "checksum"
+	case ViolationTeam:
+		return "team ID"
+	case ViolationTTL:
+		return "TTL bounds"
+	case ViolationPayloadLength:
+		return "payload length"
+	case ViolationReserved:
+		return "reserved bits"
+	case ViolationExtension:
+		return "extension length"
+	default:
+		return "unknown"
+	}
+}
+
+// ViolationSample is a packet that violated the wire format.
+type ViolationSample struct {
+	Time   time.Time
+	Sender netip.AddrPort // Neighbor the packet was received from
+	Packet string         // Header summary, empty if the packet couldn't be parsed
+	Detail string
+}
+
+// ViolationReport is the number of violations of a kind and the most recent samples, oldest first.
+type ViolationReport struct {
+	Kind    ViolationKind
+	Count   uint64
+	Samples []ViolationSample
+}
+
+type violationState struct {
+	strict  atomic.Bool
+	mu      sync.Mutex
+	counts  [violationKinds]uint64
+	samples [violationKinds]*ringbuffer.RingBuffer[ViolationSample] // Created with the first violation of the kind
+}
+
+// wireFormat is the registry inbound packets are validated against.
+var wireFormat = pkt.DescribeWireFormat()
+
+// SetStrict enables or disables dropping inbound packets that violate the wire format.
+// Can be called at any time.
+func (m *Manager) SetStrict(enabled bool) {
+	m.violations.strict.Store(enabled)
+}
+
+// IsStrict returns whether inbound packets that violate the wire format are dropped.
+func (m *Manager) IsStrict() bool {
+	return m.violations.strict.Load()
+}
+
+// ValidatePacket checks a parsed inbound packet with a valid checksum against the wire format and records its violations.
+// Returns false if the packet violates the wire format and strict mode is enabled, so it must be dropped.
+func (m *Manager) ValidatePacket(packet *pkt.Packet, sender netip.AddrPort) bool {
+	valid := true
+	violate := func(kind ViolationKind, format string, args ...any) {
+		m.RecordViolation(kind, sender, packet, fmt.Sprintf(format, args...))
+		valid = false
+	}
+
+	if packet.GetTeamID() != m.teamID {
+		violate(ViolationTeam, "team %d, want %d", packet.GetTeamID(), m.teamID)
+	}
+	if packet.Header.TTL == 0 || packet.Header.TTL > common.INITIAL_TTL {
+		violate(ViolationTTL, "TTL %d, want 1-%d", packet.Header.TTL, common.INITIAL_TTL)
+	}
+
+	if msg, known := wireFormat.FindMessageType(packet.GetMessageType()); known {
+		if !msg.AcceptsPayloadLength(len(packet.Payload)) {
+			violate(ViolationPayloadLength, "%s payload of %d bytes", msg.Name, len(packet.Payload))
+		}
+		_, unreliable := ParseUnreliableExtension(packet)
+		unnumbered := msg.Type == pkt.MsgTypeRelay || msg.Type == pkt.MsgTypePresence || unreliable
+		if unnumbered && packet.Header.PktNum != [4]byte{} {
+			violate(ViolationReserved, "%s packet number 0x%X, want zero", msg.Name, packet.Header.PktNum)
+		}
+	}
+
+	for _, extension := range packet.Extensions {
+		if ext, known := wireFormat.FindExtension(extension.Type); known && !ext.AcceptsValueLength(len(extension.Value)) {
+			violate(ViolationExtension, "%s extension value of %d bytes", ext.Name, len(extension.Value))
+		}
+	}
+
+	return valid || !m.IsStrict()
+}
+
+// RecordViolation counts a violation of the wire format by an inbound packet and keeps it as a sample.
+// packet is nil if it couldn't be parsed.
+func (m *Manager) RecordViolation(kind ViolationKind, sender netip.AddrPort, packet *pkt.Packet, detail string) {
+	sample := ViolationSample{Time: time.Now(), Sender: sender, Detail: detail}
+	if packet != nil {
+		sample.Packet = packet.String()
+	}
+
+	m.violations.mu.Lock()
+	defer m.violations.mu.Unlock()
+
+	m.violations.counts[kind]++
+	if m.violations.samples[kind] == nil {
+		m.violations.samples[kind] = ringbuffer.New[ViolationSample](common.VIOLATION_SAMPLES)
+	}
+	m.violations.samples[kind].Push(sample)
+}
+
+// Violations returns the recorded violations per kind, kinds without violations are omitted.
+func (m *Manager) Violations() []ViolationReport {
+	m.violations.mu.Lock()
+	defer m.violations.mu.Unlock()
+
+	reports := make([]ViolationReport, 0)
+	for kind, count := range m.violations.counts {
+		if count == 0 {
+			continue
+		}
+		reports = append(reports, ViolationReport{
+			Kind:    ViolationKind(kind),
+			Count:   count,
+			Samples: m.violations.samples[kind].Items(),
+		})
+	}
+	return reports
+}
+
+// ResetViolations drops all recorded violations.
+func (m *Manager) ResetViolations() {
+	m.violations.mu.Lock()
+	defer m.violations.mu.Unlock()
+
+	m.violations.counts = [violationKinds]uint64{}
+	m.violations.samples = [violationKinds]*ringbuffer.RingBuffer[ViolationSample]{}
+}
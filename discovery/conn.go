@@ -0,0 +1,81 @@
+package discovery
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// Conn sends and receives beacons on a multicast group.
+type Conn struct {
+	group    *net.UDPAddr
+	listener *net.UDPConn // Joined the group, shared with other processes on the host
+	sender   *net.UDPConn // Bound to the local address, so beacons leave through its interface
+}
+
+// Listen joins the multicast group on the interface with the local address and opens a socket to send beacons from the local address.
+// Nodes on the same host receive each other's beacons, as multicast loopback is enabled by default.
+func Listen(group netip.AddrPort, localAddr netip.Addr) (*Conn, error) {
+	if !group.Addr().Is4() || !group.Addr().IsMulticast() {
+		return nil, errors.New("discovery group must be an IPv4 multicast address")
+	}
+
+	ifi, err := interfaceOf(localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	groupAddr := net.UDPAddrFromAddrPort(group)
+	listener, err := net.ListenMulticastUDP("udp4", ifi, groupAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localAddr.AsSlice()})
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &Conn{group: groupAddr, listener: listener, sender: sender}, nil
+}
+
+// Send sends a serialized beacon to the group.
+func (c *Conn) Send(beacon []byte) error {
+	_, err := c.sender.WriteToUDP(beacon, c.group)
+	return err
+}
+
+// Receive blocks until a datagram arrives on the group and returns it with its sender.
+// Errors with net.ErrClosed once the Conn is closed.
+func (c *Conn) Receive(buf []byte) (n int, from netip.AddrPort, err error) {
+	n, from, err = c.listener.ReadFromUDPAddrPort(buf)
+	return n, netip.AddrPortFrom(from.Addr().Unmap(), from.Port()), err
+}
+
+// Close leaves the group and closes both sockets.
+func (c *Conn) Close() error {
+	return errors.Join(c.listener.Close(), c.sender.Close())
+}
+
+// interfaceOf returns the network interface that has the address.
+func interfaceOf(addr netip.Addr) (*net.Interface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ifi := range interfaces {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, ifiAddr := range addrs {
+			if ipNet, ok := ifiAddr.(*net.IPNet); ok && net.IP(addr.AsSlice()).Equal(ipNet.IP) {
+				return &ifi, nil
+			}
+		}
+	}
+
+	return nil, errors.New("no network interface has the address " + addr.String())
+}
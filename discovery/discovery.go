@@ -0,0 +1,98 @@
+// Package discovery finds nodes on the local network by multicast beacons.
+// Nodes that take part periodically send a beacon with their node ID and the address their socket listens on to a multicast group
+// and listen for the beacons of other nodes. Beacons are sent from separate sockets, they aren't protocol packets.
+// The multicast TTL is 1, so beacons don't leave the local network.
+//
+// Beacon:
+//
+//	+--------+--------+--------+--------+--------+--------+
+//	| Magic "CPGD" (32 bits)            | Version| Team   |
+//	+--------+--------+--------+--------+--------+--------+
+//	| Node ID (32 bits)                 |
+//	+--------+--------+--------+--------+--------+--------+
+//	| Listen IPv4 Address (32 bits)     | Port (16 bits)  |
+//	+--------+--------+--------+--------+--------+--------+
+//	| HMAC-SHA256 of the fields above (256 bits), only with a pre-shared key |
+//	+------------------------------------------------------------------------+
+package discovery
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+const (
+	beaconVersion = 1
+	beaconSize    = 16
+	macSize       = sha256.Size
+)
+
+var beaconMagic = []byte("CPGD")
+
+// Beacon announces a node on the local network.
+type Beacon struct {
+	NodeID   netip.Addr     // Address the node is identified by in the protocol
+	AddrPort netip.AddrPort // Address the socket of the node listens on, the CONNECT is sent there
+	Team     byte           // Team ID of the node
+}
+
+// ErrNotABeacon is returned for datagrams that don't start with the beacon magic, e.g. of other applications using the group.
+var ErrNotABeacon = errors.New("not a beacon")
+
+// AppendBeacon appends the serialized beacon to buf.
+// If key isn't nil, the beacon is authenticated with it.
+func AppendBeacon(buf []byte, beacon Beacon, key []byte) []byte {
+	start := len(buf)
+
+	nodeID := beacon.NodeID.As4()
+	addr := beacon.AddrPort.Addr().As4()
+
+	buf = append(buf, beaconMagic...)
+	buf = append(buf, beaconVersion, beacon.Team)
+	buf = append(buf, nodeID[:]...)
+	buf = append(buf, addr[:]...)
+	buf = binary.BigEndian.AppendUint16(buf, beacon.AddrPort.Port())
+
+	if key != nil {
+		buf = append(buf, computeMAC(key, buf[start:])...)
+	}
+	return buf
+}
+
+// ParseBeacon parses a received beacon.
+// If key isn't nil, beacons without a valid MAC for it are rejected.
+func ParseBeacon(data []byte, key []byte) (Beacon, error) {
+	if !bytes.HasPrefix(data, beaconMagic) {
+		return Beacon{}, ErrNotABeacon
+	}
+	if len(data) < beaconSize {
+		return Beacon{}, errors.New("beacon too short")
+	}
+	if data[4] != beaconVersion {
+		return Beacon{}, errors.New("unsupported beacon version")
+	}
+
+	if key != nil {
+		if len(data) != beaconSize+macSize || !hmac.Equal(data[beaconSize:], computeMAC(key, data[:beaconSize])) {
+			return Beacon{}, errors.New("beacon isn't authenticated with the pre-shared key")
+		}
+	} else if len(data) != beaconSize && len(data) != beaconSize+macSize {
+		return Beacon{}, errors.New("invalid beacon length")
+	}
+
+	return Beacon{
+		Team:     data[5],
+		NodeID:   netip.AddrFrom4([4]byte(data[6:10])),
+		AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte(data[10:14])), binary.BigEndian.Uint16(data[14:16])),
+	}, nil
+}
+
+func computeMAC(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,95 @@
+package discovery
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBeaconRoundTrip(t *testing.T) {
+	beacon := Beacon{
+		NodeID:   netip.MustParseAddr("172.16.0.7"),
+		AddrPort: netip.MustParseAddrPort("192.168.1.20:20001"),
+		Team:     0x2,
+	}
+
+	for _, key := range [][]byte{nil, []byte("secret")} {
+		parsed, err := ParseBeacon(AppendBeacon(nil, beacon, key), key)
+		if err != nil {
+			t.Fatalf("Failed to parse beacon (key %q): %v", key, err)
+		}
+		if parsed != beacon {
+			t.Errorf("Parsed %+v, want %+v", parsed, beacon)
+		}
+	}
+}
+
+func TestBeaconAuthentication(t *testing.T) {
+	beacon := Beacon{NodeID: netip.MustParseAddr("10.0.0.1"), AddrPort: netip.MustParseAddrPort("10.0.0.1:20000")}
+
+	if _, err := ParseBeacon(AppendBeacon(nil, beacon, nil), []byte("secret")); err == nil {
+		t.Errorf("Accepted an unauthenticated beacon with a pre-shared key")
+	}
+	if _, err := ParseBeacon(AppendBeacon(nil, beacon, []byte("other")), []byte("secret")); err == nil {
+		t.Errorf("Accepted a beacon authenticated with another key")
+	}
+
+	tampered := AppendBeacon(nil, beacon, []byte("secret"))
+	tampered[15]++ // Port
+	if _, err := ParseBeacon(tampered, []byte("secret")); err == nil {
+		t.Errorf("Accepted a modified beacon")
+	}
+
+	// Without a key, authenticated beacons are accepted too
+	if _, err := ParseBeacon(AppendBeacon(nil, beacon, []byte("secret")), nil); err != nil {
+		t.Errorf("Rejected an authenticated beacon without a pre-shared key: %v", err)
+	}
+}
+
+func TestParseBeaconRejectsForeignDatagrams(t *testing.T) {
+	if _, err := ParseBeacon([]byte("M-SEARCH * HTTP/1.1"), nil); !errors.Is(err, ErrNotABeacon) {
+		t.Errorf("Got %v for a foreign datagram, want ErrNotABeacon", err)
+	}
+	if _, err := ParseBeacon([]byte("CPGD\x01"), nil); err == nil {
+		t.Errorf("Accepted a truncated beacon")
+	}
+}
+
+// TestConnLoopback sends a beacon on the loopback interface and receives it, it is skipped where multicast isn't available.
+func TestConnLoopback(t *testing.T) {
+	conn, err := Listen(netip.MustParseAddrPort("239.255.67.71:20199"), netip.MustParseAddr("127.0.0.1"))
+	if err != nil {
+		t.Skipf("Multicast not available: %v", err)
+	}
+	defer conn.Close()
+
+	beacon := Beacon{NodeID: netip.MustParseAddr("127.0.0.1"), AddrPort: netip.MustParseAddrPort("127.0.0.1:20000")}
+	if err := conn.Send(AppendBeacon(nil, beacon, nil)); err != nil {
+		t.Skipf("Multicast not available: %v", err)
+	}
+
+	received := make(chan Beacon, 1)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, _, err := conn.Receive(buf)
+			if err != nil {
+				return
+			}
+			if parsed, err := ParseBeacon(buf[:n], nil); err == nil {
+				received <- parsed
+				return
+			}
+		}
+	}()
+
+	select {
+	case parsed := <-received:
+		if parsed != beacon {
+			t.Errorf("Received %+v, want %+v", parsed, beacon)
+		}
+	case <-time.After(time.Second):
+		t.Skip("Multicast loopback not available, no beacon received")
+	}
+}
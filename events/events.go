@@ -0,0 +1,144 @@
+// Package events provides a typed event bus for things that happen in the network, e.g. received messages or lost peers.
+// Handlers publish events, consumers like the CLI subscribe to the observables they are interested in.
+// Publishing never blocks, events are dropped for subscribers that don't keep up (see observer.Observable).
+package events
+
+import (
+	"net/netip"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/util/observer"
+)
+
+// MessageReceivedEvent is published when a chat message was completely received.
+type MessageReceivedEvent struct {
+	From           netip.Addr
+	Text           string
+	SentAt         time.Time     // Time the peer started sending the message, the zero value if the peer didn't send it
+	Delay          time.Duration // One-way delay from SentAt until the message was completely received
+	ClockCorrected bool          // SentAt is converted to the local clock with the estimated clock offset to the peer, otherwise SentAt and Delay depend on the offset
+	Reordered      bool          // The message was sent before a previously received message of the peer
+	Streamed       int           // Length of the prefix of Text that was already published in MessageChunkReceivedEvents
+	Unreliable     bool          // The message was sent unreliably, a lost unreliable message isn't noticed
+}
+
+// MessageChunkReceivedEvent is published with the next part of a message that is still being received, if common.STREAM_MESSAGES is enabled.
+// The parts of a message are published in order, the rest follows in the MessageReceivedEvent (see MessageReceivedEvent.Streamed).
+type MessageChunkReceivedEvent struct {
+	From netip.Addr
+	Text string
+}
+
+// FileReceivedEvent is published when a file was completely received and stored.
+type FileReceivedEvent struct {
+	From         netip.Addr
+	Path         string // Final path of the stored file, its name may differ from OriginalName after sanitization and collision handling
+	OriginalName string // File name as sent by the peer
+	Summary      sequencing.TransferSummary
+}
+
+// FileSentEvent is published when a file transfer we started finished.
+type FileSentEvent struct {
+	To      netip.Addr
+	Name    string
+	Summary sequencing.TransferSummary
+	Err     error // Why the file wasn't sent completely, nil if it was sent
+}
+
+// PeerConnectedEvent is published when a peer became our neighbor.
+type PeerConnectedEvent struct {
+	Addr     netip.Addr
+	AddrPort netip.AddrPort // UDP address the neighbor is reached at
+	Relay    netip.Addr     // Relay of a relayed neighbor, the zero value for direct neighbors
+}
+
+// PeerDiscoveredEvent is published when a node was discovered on the local network, see connection.Manager.StartDiscovery.
+type PeerDiscoveredEvent struct {
+	NodeID   netip.Addr
+	AddrPort netip.AddrPort // UDP address the node listens on
+}
+
+// PeerLostEvent is published when a peer is no longer reachable and its state was cleared.
+type PeerLostEvent struct {
+	Addr netip.Addr
+}
+
+// RouteChangedEvent is published when the route to a destination was added, removed or moved to another next hop.
+type RouteChangedEvent struct {
+	Dest        netip.Addr
+	NextHop     netip.AddrPort // The zero value if the destination is no longer routable
+	PrevNextHop netip.AddrPort // The zero value if the destination wasn't routable before
+}
+
+// TransferDirection tells whether a transfer is sent or received.
+type TransferDirection int
+
+const (
+	Sending TransferDirection = iota
+	Receiving
+)
+
+func (d TransferDirection) String() string {
+	if d == Sending {
+		return "sending"
+	}
+	return "receiving"
+}
+
+// TransferProgressEvent is published while a file is transferred.
+type TransferProgressEvent struct {
+	Peer      netip.Addr
+	Direction TransferDirection
+	Name      string // File name, empty for received files until they are finished
+	Bytes     int64  // Bytes transferred so far
+	Total     int64  // Total size in bytes, 0 if unknown
+}
+
+// TransferAbortedEvent is published when a message or file transfer was aborted by the receiver.
+type TransferAbortedEvent struct {
+	Peer      netip.Addr
+	Direction TransferDirection // Sending if the peer aborted our transfer, Receiving if we aborted the peer's transfer
+	File      bool              // True for file transfers, false for messages
+	Reason    string
+}
+
+// PresenceChangedEvent is published when a peer sent a presence update.
+type PresenceChangedEvent struct {
+	From   netip.Addr
+	Status string // "online", "away", "typing" (to us) or "offline"
+}
+
+// RoomMessageEvent is published when a message was posted to a room we host or joined.
+type RoomMessageEvent struct {
+	Room string
+	Host netip.Addr
+	From netip.Addr // Member that posted the message
+	Text string
+}
+
+// RoomMembershipEvent is published when a member joined or left a room we host or joined, including ourselves.
+type RoomMembershipEvent struct {
+	Room   string
+	Host   netip.Addr
+	Member netip.Addr
+	Joined bool
+	Reason string // Why the member left, empty if it left by itself
+}
+
+var (
+	MessageReceived  = observer.NewObservable[MessageReceivedEvent](common.EVENT_BUFFER_SIZE)
+	MessageChunk     = observer.NewObservable[MessageChunkReceivedEvent](common.EVENT_BUFFER_SIZE)
+	FileReceived     = observer.NewObservable[FileReceivedEvent](common.EVENT_BUFFER_SIZE)
+	FileSent         = observer.NewObservable[FileSentEvent](common.EVENT_BUFFER_SIZE)
+	PeerConnected    = observer.NewObservable[PeerConnectedEvent](common.EVENT_BUFFER_SIZE)
+	PeerLost         = observer.NewObservable[PeerLostEvent](common.EVENT_BUFFER_SIZE)
+	PeerDiscovered   = observer.NewObservable[PeerDiscoveredEvent](common.EVENT_BUFFER_SIZE)
+	RouteChanged     = observer.NewObservable[RouteChangedEvent](common.EVENT_BUFFER_SIZE)
+	TransferProgress = observer.NewObservable[TransferProgressEvent](common.EVENT_BUFFER_SIZE)
+	TransferAborted  = observer.NewObservable[TransferAbortedEvent](common.EVENT_BUFFER_SIZE)
+	PresenceChanged  = observer.NewObservable[PresenceChangedEvent](common.EVENT_BUFFER_SIZE)
+	RoomMessage      = observer.NewObservable[RoomMessageEvent](common.EVENT_BUFFER_SIZE)
+	RoomMembership   = observer.NewObservable[RoomMembershipEvent](common.EVENT_BUFFER_SIZE)
+)
@@ -2,10 +2,13 @@ module bjoernblessin.de/chatprotogol
 
 go 1.24.3
 
+require (
+	github.com/schollz/progressbar/v3 v3.18.0
+	golang.org/x/sys v0.33.0
+)
+
 require (
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	github.com/schollz/progressbar/v3 v3.18.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/term v0.32.0 // indirect
 )
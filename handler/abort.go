@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"errors"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
+	"bjoernblessin.de/chatprotogol/sock"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// handleAbort processes an ABORT of one of our transfers by the receiver.
+// The transfer's sequence blocker is marked as aborted, so the sending goroutine stops sending chunks.
+// An ABORT of a CONNECT refuses our connection to the sender instead, an ABORT of an ABORT is a RESET of the sender's packet numbers.
+func handleAbort(packet *pkt.Packet, srcAddrPort netip.AddrPort, socket sock.Socket, inSequencing *sequencing.IncomingPktNumHandler, outSequencing *sequencing.OutgoingPktNumHandler, connections *connection.Manager) {
+	logger.Tracef("ABORT RECEIVED %v %d", packet.Header.SourceAddr, packet.Header.PktNum)
+
+	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
+
+	if destAddr != socket.MustGetLocalAddress().Addr() {
+		// The packet is for another peer
+		connections.ForwardRouted(packet, srcAddrPort)
+		return
+	}
+
+	// The packet is for us
+
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+
+	msgType, reason, err := connection.ParseAbortPayload(packet.Payload)
+	if err != nil {
+		logger.Warnf("Invalid ABORT from %v: %v", srcAddr, err)
+		return
+	}
+
+	if msgType == pkt.MsgTypeConnect {
+		// Not sequenced and not acknowledged, see connection.RefuseConnect
+		connections.HandleConnectRefused(srcAddr, srcAddrPort, reason)
+		return
+	}
+
+	if msgType == pkt.MsgTypeAbort {
+		handleReset(packet, srcAddr, connections)
+		return
+	}
+
+	duplicate, dupErr := inSequencing.IsDuplicatePacket(packet)
+	if dupErr != nil {
+		logger.Warnf(dupErr.Error())
+		return
+	} else if duplicate {
+		_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+		return
+	}
+
+	_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+
+	if msgType != pkt.MsgTypeChatMessage && msgType != pkt.MsgTypeFileTransfer {
+		logger.Warnf("Received ABORT from %v for unsupported message type %d", srcAddr, msgType)
+		return
+	}
+
+	outSequencing.GetSequenceBlocker(srcAddr, msgType).Abort()
+
+	events.TransferAborted.NotifyObservers(events.TransferAbortedEvent{
+		Peer:      srcAddr,
+		Direction: events.Sending,
+		File:      msgType == pkt.MsgTypeFileTransfer,
+		Reason:    connection.AbortReasonString(reason),
+	})
+}
+
+// handleReset processes a RESET of the peer's packet numbers, see connection.Manager.ResetPeer.
+// It isn't checked for duplicates, the packet numbers of the peer restart with it. Retransmissions are recognized by the reset ID and only acknowledged.
+func handleReset(packet *pkt.Packet, srcAddr netip.Addr, connections *connection.Manager) {
+	resetID, err := connection.ParseResetPayload(packet.Payload)
+	if err != nil {
+		logger.Warnf("Invalid RESET from %v: %v", srcAddr, err)
+		return
+	}
+
+	if !connections.ApplyReset(packet, resetID) {
+		logger.Debugf("Received retransmitted RESET %d from %v", resetID, srcAddr)
+	}
+
+	_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+}
+
+// rejectTransfer clears our state of the peer's transfer, drops its further packets and tells the peer to stop sending.
+func rejectTransfer(reconstructors *reconstruction.Manager, srcAddr netip.Addr, msgType byte, reason byte, connections *connection.Manager) {
+	logger.Warnf("Rejecting transfer of type %d from %v: %s", msgType, srcAddr, connection.AbortReasonString(reason))
+
+	reconstructors.RejectTransfer(srcAddr, msgType)
+
+	_, err := connections.SendAbort(srcAddr, msgType, reason)
+	if err != nil {
+		logger.Warnf("Failed to send ABORT to %v: %v", srcAddr, err)
+	}
+
+	events.TransferAborted.NotifyObservers(events.TransferAbortedEvent{
+		Peer:      srcAddr,
+		Direction: events.Receiving,
+		File:      msgType == pkt.MsgTypeFileTransfer,
+		Reason:    connection.AbortReasonString(reason),
+	})
+}
+
+// abortReasonFor returns the ABORT reason for an error of the reconstruction package.
+func abortReasonFor(err error) byte {
+	switch {
+	case errors.Is(err, reconstruction.ErrMessageTooLarge):
+		return connection.AbortReasonMessageTooLarge
+	case errors.Is(err, reconstruction.ErrFileTooLarge):
+		return connection.AbortReasonFileTooLarge
+	case errors.Is(err, reconstruction.ErrInsufficientDiskSpace):
+		return connection.AbortReasonInsufficientSpace
+	case errors.Is(err, reconstruction.ErrTooManyReconstructors):
+		return connection.AbortReasonTooManyTransfers
+	default:
+		return connection.AbortReasonReconstructorError
+	}
+}
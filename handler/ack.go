@@ -10,19 +10,69 @@ import (
 	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
-func handleAck(packet *pkt.Packet, socket sock.Socket, outSequencing *sequencing.OutgoingPktNumHandler) {
-	logger.Tracef("ACK RECEIVED %v %d", packet.Header.SourceAddr, packet.Header.PktNum)
+func handleAck(packet *pkt.Packet, srcAddrPort netip.AddrPort, socket sock.Socket, outSequencing *sequencing.OutgoingPktNumHandler, connections *connection.Manager) {
+	if connections.HandleHopAck(packet, srcAddrPort) {
+		return // Hop ACKs only concern the link to the neighbor, see connection.hopARQState
+	}
+
+	logger.LimitedTracef("ACK RECEIVED", "ACK RECEIVED %v %d", packet.Header.SourceAddr, packet.Header.PktNum)
 
 	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
 	if destAddr != socket.MustGetLocalAddress().Addr() {
 		// The acknowledgment is for another peer, forward it
 
-		connection.ForwardRouted(packet)
+		connections.ForwardRouted(packet, srcAddrPort)
 		return
 	}
 
 	// The acknowledgment is for us, remove the open acknowledgment
 
 	srcAddr := netip.AddrFrom4([4]byte(packet.Header.SourceAddr))
-	outSequencing.RemoveOpenAck(srcAddr, packet.Header.PktNum)
+	if !connections.IsPlausibleAckSender(srcAddr, srcAddrPort) {
+		logger.Warnf("Dropping ACK of %v for packet %v received from %v, which is not on a path to %v", srcAddr, packet.Header.PktNum, srcAddrPort, srcAddr)
+		return
+	}
+
+	connections.RecordHopARQAnnouncement(packet, srcAddrPort) // The ACK of our CONNECT announces whether the neighbor supports hop-by-hop ARQ
+	connections.RecordCapabilities(packet, srcAddr)
+	connections.RecordPublicKey(packet, srcAddr)
+
+	if outSequencing.RemoveOpenAck(srcAddr, packet.Header.PktNum) == sequencing.AckSpurious {
+		connections.HandleSpuriousAck(srcAddr)
+	}
+	handleCongestionEchoes(packet, srcAddr, outSequencing)
+}
+
+// handlePiggybackedAcks processes ACKs carried in the extensions of a packet destined for us.
+// They are treated exactly like standalone ACKs from the packet's source.
+func handlePiggybackedAcks(packet *pkt.Packet, srcAddrPort netip.AddrPort, socket sock.Socket, outSequencing *sequencing.OutgoingPktNumHandler, connections *connection.Manager) {
+	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
+	if destAddr != socket.MustGetLocalAddress().Addr() {
+		return // Piggybacked ACKs are forwarded together with their packet
+	}
+
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+	if len(packet.GetPiggybackedAcks()) > 0 && !connections.IsPlausibleAckSender(srcAddr, srcAddrPort) {
+		logger.Warnf("Dropping piggybacked ACKs of %v received from %v, which is not on a path to %v", srcAddr, srcAddrPort, srcAddr)
+		return
+	}
+
+	for _, pktNum := range packet.GetPiggybackedAcks() {
+		logger.LimitedTracef("ACK RECEIVED", "PIGGYBACKED ACK RECEIVED %v %d", packet.Header.SourceAddr, pktNum)
+		if outSequencing.RemoveOpenAck(srcAddr, pktNum) == sequencing.AckSpurious {
+			connections.HandleSpuriousAck(srcAddr)
+		}
+	}
+
+	if len(packet.GetPiggybackedAcks()) > 0 {
+		handleCongestionEchoes(packet, srcAddr, outSequencing) // Data packets without piggybacked ACKs weren't checked for plausibility
+	}
+}
+
+// handleCongestionEchoes reduces the congestion window to the source for each congestion mark it echoes, see connection.congestionMarkState.
+func handleCongestionEchoes(packet *pkt.Packet, srcAddr netip.Addr, outSequencing *sequencing.OutgoingPktNumHandler) {
+	for _, pktNum := range packet.GetCongestionEchoes() {
+		logger.Debugf("CONGESTION ECHO RECEIVED %v %d", srcAddr, pktNum)
+		outSequencing.HandleCongestionMark(srcAddr, pktNum)
+	}
 }
@@ -1,7 +1,6 @@
 package handler
 
 import (
-	"fmt"
 	"net/netip"
 
 	"bjoernblessin.de/chatprotogol/connection"
@@ -9,29 +8,75 @@ import (
 	"bjoernblessin.de/chatprotogol/routing"
 	"bjoernblessin.de/chatprotogol/sequencing"
 	"bjoernblessin.de/chatprotogol/sock"
-	"bjoernblessin.de/chatprotogol/util/assert"
 	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
 // handleConnect processes a connection request from a peer.
-func handleConnect(packet *pkt.Packet, srcAddrPort netip.AddrPort, router *routing.Router, inSequencing *sequencing.IncomingPktNumHandler, socket sock.Socket) {
+// A CONNECT with a newer boot epoch from a known neighbor means the neighbor restarted, it is then reconnected.
+// A CONNECT of a new peer is refused while our LSDB is overloaded.
+// A CONNECT from a known neighbor at another address means the neighbor's port or, for a proven node ID, its address changed,
+// it is then reached at the new address (see connection.Manager.UpdateNeighborAddress).
+// A CONNECT announcing another key than the pinned key of the peer is rejected, also if it looks like a restart.
+func handleConnect(packet *pkt.Packet, srcAddrPort netip.AddrPort, router *routing.Router, inSequencing *sequencing.IncomingPktNumHandler, socket sock.Socket, connections *connection.Manager) {
+	epoch, rest, err := connection.SplitBootEpoch(packet.Payload)
+	if err != nil {
+		logger.Warnf("Malformed CON packet from %v: %v", srcAddrPort, err)
+		return
+	}
+
+	// The source address is accepted if it's the sender's IP address, or if it's a node ID or the sender is its advertised external (NAT) address
+	// and the CONNECT proves it (see connection.Manager.ProveConnectIdentity)
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+	external, hasExternal := connection.ParseExternalAddress(rest)
+	nodeID, hasNodeID := connection.ParseNodeID(packet)
+	identity := connection.IdentityUnproven
+	if srcAddr != srcAddrPort.Addr() {
+		if (!hasExternal || external != srcAddrPort) && (!hasNodeID || nodeID != srcAddr) {
+			logger.Warnf("Malformed CON packet: source address %v does not match sender %v", srcAddr, srcAddrPort)
+			return
+		}
+		identity = connections.ProveConnectIdentity(packet, srcAddr, srcAddrPort)
+		if identity == connection.IdentityUnproven {
+			logger.Warnf("Rejecting CON packet from %v: source address %v is not proven", srcAddrPort, srcAddr)
+			return
+		}
+	}
+
+	// Only the owner of an address that isn't the sender's IP address may move the neighbor to another socket,
+	// any member of the network (proven by the pre-shared key) could claim it
+	if isNeighbor, neighborAddrPort := router.IsNeighbor(srcAddr); isNeighbor && srcAddr != srcAddrPort.Addr() && neighborAddrPort != srcAddrPort && identity != connection.IdentitySigned {
+		logger.Warnf("Rejecting CON packet from %v: neighbor %v is connected at %v and the CONNECT isn't signed with its key", srcAddrPort, srcAddr, neighborAddrPort)
+		return
+	}
+
+	if connections.ConflictsWithPinnedKey(packet, srcAddr) {
+		logger.Warnf("Rejecting CON packet from %v: %v announces another key than its pinned key", srcAddrPort, srcAddr)
+		return
+	}
+
+	epochStatus := inSequencing.CheckBootEpoch(srcAddr, epoch)
+	if epochStatus == sequencing.EpochStale {
+		logger.Warnf("Dropping replayed CON packet from %v with old boot epoch %d", srcAddr, epoch)
+		return
+	}
+
+	if refusesNeighbor(srcAddr, router, connections) {
+		// Not acknowledged and not recorded as received, so the retransmissions are refused as well
+		_ = connections.RefuseConnect(srcAddr, srcAddrPort, connection.AbortReasonOverloaded)
+		return
+	}
+
 	duplicate, dupErr := inSequencing.IsDuplicatePacket(packet)
 	if dupErr != nil {
 		logger.Warnf(dupErr.Error())
 		return
 	} else if duplicate {
-		_ = connection.SendAcknowledgmentTo(srcAddrPort, packet.Header.PktNum)
+		_ = connections.SendConnectAcknowledgment(srcAddr, srcAddrPort, packet.Header.PktNum)
 		return
 	}
 
 	logger.Tracef("CONN FROM %v %v", packet.Header.SourceAddr, packet.Header.PktNum)
 
-	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
-	if srcAddr != srcAddrPort.Addr() {
-		logger.Warnf("Malformed CON packet: source address %v does not match sender %v", srcAddr, srcAddrPort)
-		return
-	}
-
 	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
 	localAddr := socket.MustGetLocalAddress().Addr()
 	if destAddr != localAddr {
@@ -39,25 +84,49 @@ func handleConnect(packet *pkt.Packet, srcAddrPort netip.AddrPort, router *routi
 		return
 	}
 
+	if epochStatus == sequencing.EpochRestart {
+		connections.ResetRestartedPeer(srcAddr)
+	}
+
+	connections.RecordHopARQAnnouncement(packet, srcAddrPort)
+	connections.RecordCapabilities(packet, srcAddr)
+	connections.RecordPublicKey(packet, srcAddr)
+
 	if isNeighbor, _ := router.IsNeighbor(srcAddr); isNeighbor {
-		logger.Warnf("Received connection request from already known neighbor %v", srcAddr)
-		return
+		if epochStatus != sequencing.EpochRestart {
+			// Also happens if both peers connect at the same time (e.g. when punching a NAT), the CONNECT is acknowledged anyway
+			logger.Debugf("Received connection request from already known neighbor %v", srcAddr)
+			connections.UpdateNeighborAddress(srcAddr, srcAddrPort, identity == connection.IdentitySigned)
+			_ = connections.SendConnectAcknowledgment(srcAddr, srcAddrPort, packet.Header.PktNum)
+			return
+		}
+
+		connections.RemoveNeighbor(srcAddr)
 	}
 
 	// Valid packet
 
-	_ = connection.SendAcknowledgmentTo(srcAddrPort, packet.Header.PktNum)
+	if srcAddr != srcAddrPort.Addr() {
+		connections.RecordAdvertisedAddress(srcAddr, srcAddrPort) // Proven above, an advertisement alone isn't trusted
+	}
 
-	router.AddNeighbor(srcAddrPort)
+	_ = connections.SendConnectAcknowledgment(srcAddr, srcAddrPort, packet.Header.PktNum)
 
-	localLSA, exists := router.GetLSA(localAddr)
-	assert.Assert(exists, "Local LSA should exist for the local address")
-	connection.FloodLSA(localAddr, localLSA)
+	if connections.DefersCrossedConnect(srcAddr) {
+		logger.Debugf("CONNECT of %v crossed our CONNECT, waiting for its ACK", srcAddr)
+		return
+	}
 
-	err := connection.SendDD(srcAddrPort)
-	if err != nil {
-		logger.Warnf("Failed to send database description to %s: %v", srcAddrPort, err)
+	if !connections.EstablishNeighbor(srcAddr, srcAddrPort) {
+		logger.Debugf("Connection to %v is already %v", srcAddr, connections.GetPeerState(srcAddr))
 	}
+}
 
-	fmt.Printf("Connected to %s\n", srcAddrPort)
+// refusesNeighbor returns whether the CONNECT of the peer is refused because our LSDB is overloaded.
+// Known neighbors and peers we are connecting to ourselves are accepted, they don't add new hosts.
+func refusesNeighbor(srcAddr netip.Addr, router *routing.Router, connections *connection.Manager) bool {
+	if isNeighbor, _ := router.IsNeighbor(srcAddr); isNeighbor || connections.GetPeerState(srcAddr) != connection.PeerDown {
+		return false
+	}
+	return router.IsOverloaded()
 }
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"encoding/binary"
 	"errors"
 	"net/netip"
 
@@ -14,20 +15,20 @@ import (
 	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
-func handleDatabaseDescription(packet *pkt.Packet, router *routing.Router, inSequencing *sequencing.IncomingPktNumHandler, srcAddrPort netip.AddrPort, socket sock.Socket) {
+func handleDatabaseDescription(packet *pkt.Packet, router *routing.Router, inSequencing *sequencing.IncomingPktNumHandler, srcAddrPort netip.AddrPort, socket sock.Socket, connections *connection.Manager) {
 	duplicate, dupErr := inSequencing.IsDuplicatePacket(packet)
 	if dupErr != nil {
 		logger.Warnf(dupErr.Error())
 		return
 	} else if duplicate {
-		_ = connection.SendAcknowledgmentTo(srcAddrPort, packet.Header.PktNum)
+		_ = connections.SendAcknowledgmentTo(netip.AddrFrom4(packet.Header.SourceAddr), srcAddrPort, packet.Header.PktNum)
 		return
 	}
 
 	logger.Tracef("DD RECEIVED %v %d", packet.Header.SourceAddr, packet.Header.PktNum)
 
 	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
-	if srcAddr != srcAddrPort.Addr() {
+	if !connections.IsValidSender(srcAddr, srcAddrPort) {
 		logger.Warnf("Malformed DD packet: source address %v does not match sender %v", srcAddr, srcAddrPort)
 		return
 	}
@@ -39,7 +40,18 @@ func handleDatabaseDescription(packet *pkt.Packet, router *routing.Router, inSeq
 		return
 	}
 
-	existingAddresses, err := parseDatabaseDescriptionPayload(packet.Payload)
+	var existingAddresses []netip.Addr
+	var entries []connection.DDEntry
+	var err error
+	hasSeqNums := len(packet.GetExtensions(pkt.ExtTypeDDSeqNums)) > 0
+	if hasSeqNums {
+		entries, err = parseDatabaseDescriptionEntries(packet.Payload)
+		for _, entry := range entries {
+			existingAddresses = append(existingAddresses, entry.Addr)
+		}
+	} else {
+		existingAddresses, err = parseDatabaseDescriptionPayload(packet.Payload)
+	}
 	if err != nil {
 		logger.Warnf("Failed to parse DD payload: %v", err)
 		return
@@ -47,18 +59,35 @@ func handleDatabaseDescription(packet *pkt.Packet, router *routing.Router, inSeq
 
 	// Valid packet
 
-	_ = connection.SendAcknowledgmentTo(srcAddrPort, packet.Header.PktNum)
+	connections.HandleNeighborDD(srcAddr)
+	if hasSeqNums {
+		connections.HandleDDReply(srcAddr, entries)
+	}
+
+	_ = connections.SendAcknowledgmentTo(netip.AddrFrom4(packet.Header.SourceAddr), srcAddrPort, packet.Header.PktNum)
 
 	missing := getMissingLSAs(existingAddresses, router)
 
 	logger.Debugf("I have %v LSAs, peer has %v LSAs, missing %v LSAs\n", router.GetAvailableLSAs(), existingAddresses, missing)
 
+	// Only the peer is missing the LSAs, our other neighbors already received them
 	for _, missingAddr := range missing {
 		lsa, exists := router.GetLSA(missingAddr)
 		if !exists {
 			continue // LSDB changed between getMissingLSAs() and here (very unlikely)
 		}
-		connection.FloodLSA(missingAddr, lsa)
+
+		err := connections.SendLSA(srcAddr, srcAddrPort, missingAddr, lsa)
+		if err != nil {
+			logger.Warnf("Failed to send LSA of %v to %v: %v", missingAddr, srcAddr, err)
+		}
+	}
+
+	if len(packet.GetExtensions(pkt.ExtTypeDDRequest)) > 0 {
+		err := connections.SendDDReply(srcAddr, srcAddrPort)
+		if err != nil {
+			logger.Warnf("Failed to answer DD request of %v: %v", srcAddr, err)
+		}
 	}
 }
 
@@ -99,3 +128,23 @@ func parseDatabaseDescriptionPayload(payload pkt.Payload) ([]netip.Addr, error)
 
 	return entries, nil
 }
+
+// parseDatabaseDescriptionEntries parses the payload of a DD with sequence numbers (see connection.ddRequestState).
+func parseDatabaseDescriptionEntries(payload pkt.Payload) ([]connection.DDEntry, error) {
+	const bytesPerEntry = 8
+
+	if len(payload)%bytesPerEntry != 0 {
+		return nil, errors.New("invalid payload length for DD packet with sequence numbers")
+	}
+
+	entries := make([]connection.DDEntry, 0, len(payload)/bytesPerEntry)
+
+	for i := 0; i < len(payload); i += bytesPerEntry {
+		entries = append(entries, connection.DDEntry{
+			Addr:   netip.AddrFrom4([4]byte(payload[i : i+4])),
+			SeqNum: binary.BigEndian.Uint32(payload[i+4 : i+8]),
+		})
+	}
+
+	return entries, nil
+}
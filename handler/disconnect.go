@@ -13,20 +13,20 @@ import (
 )
 
 // handleDisconnect processes a disconnect request from a peer.
-func handleDisconnect(packet *pkt.Packet, inSequencing *sequencing.IncomingPktNumHandler, router *routing.Router, socket sock.Socket, srcAddrPort netip.AddrPort) {
+func handleDisconnect(packet *pkt.Packet, inSequencing *sequencing.IncomingPktNumHandler, router *routing.Router, socket sock.Socket, srcAddrPort netip.AddrPort, connections *connection.Manager) {
 	duplicate, dupErr := inSequencing.IsDuplicatePacket(packet)
 	if dupErr != nil {
 		logger.Warnf(dupErr.Error())
 		return
 	} else if duplicate {
-		_ = connection.SendAcknowledgmentTo(srcAddrPort, packet.Header.PktNum)
+		_ = connections.SendAcknowledgmentTo(netip.AddrFrom4(packet.Header.SourceAddr), srcAddrPort, packet.Header.PktNum)
 		return
 	}
 
 	logger.Tracef("DISCO FROM %v %v", packet.Header.SourceAddr, packet.Header.PktNum)
 
 	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
-	if srcAddr != srcAddrPort.Addr() {
+	if !connections.IsValidSender(srcAddr, srcAddrPort) {
 		logger.Warnf("Malformed CON packet: source address %v does not match sender %v", srcAddr, srcAddrPort)
 		return
 	}
@@ -43,12 +43,11 @@ func handleDisconnect(packet *pkt.Packet, inSequencing *sequencing.IncomingPktNu
 		return
 	}
 
-	_ = connection.SendAcknowledgmentTo(srcAddrPort, packet.Header.PktNum)
+	_ = connections.SendAcknowledgmentTo(netip.AddrFrom4(packet.Header.SourceAddr), srcAddrPort, packet.Header.PktNum)
 
-	unreachableHosts := router.RemoveNeighbor(srcAddr)
-	connection.ClearUnreachableHosts(unreachableHosts)
+	connections.RemoveNeighbor(srcAddr)
 
 	localLSA, exists := router.GetLSA(localAddr)
 	assert.Assert(exists, "Local LSA should exist for the local address")
-	connection.FloodLSA(localAddr, localLSA)
+	connections.FloodLSA(localAddr, localLSA)
 }
@@ -4,6 +4,7 @@ import (
 	"net/netip"
 
 	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/events"
 	"bjoernblessin.de/chatprotogol/pkt"
 	"bjoernblessin.de/chatprotogol/sequencing"
 	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
@@ -11,14 +12,14 @@ import (
 	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
-func handleFileTransfer(packet *pkt.Packet, socket sock.Socket, inSequencing *sequencing.IncomingPktNumHandler) {
-	logger.Tracef("FILE RECEIVED %v %d", packet.Header.SourceAddr, packet.Header.PktNum)
+func handleFileTransfer(packet *pkt.Packet, srcAddrPort netip.AddrPort, socket sock.Socket, inSequencing *sequencing.IncomingPktNumHandler, reconstructors *reconstruction.Manager, connections *connection.Manager) {
+	logger.LimitedTracef("FILE RECEIVED", "FILE RECEIVED %v %d", packet.Header.SourceAddr, packet.Header.PktNum)
 
 	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
 
 	if destAddr != socket.MustGetLocalAddress().Addr() {
 		// The file transfer is for another peer
-		connection.ForwardRouted(packet)
+		connections.ForwardRouted(packet, srcAddrPort)
 		return
 	}
 
@@ -31,11 +32,34 @@ func handleFileTransfer(packet *pkt.Packet, socket sock.Socket, inSequencing *se
 		logger.Warnf(dupErr.Error())
 		return
 	} else if duplicate {
-		_ = connection.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+		if fileReconstructor, exists := reconstructors.GetFileReconstructor(srcAddr); exists {
+			fileReconstructor.RecordDuplicate()
+		}
+		_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
 		return
 	}
 
-	reconstruction.GetOrCreateFileReconstructor(srcAddr).HandleIncomingFilePacket(packet)
+	if reconstructors.IsRejected(srcAddr, pkt.MsgTypeFileTransfer) {
+		logger.Tracef("Dropping file packet %v of rejected file from %v", packet.Header.PktNum, srcAddr)
+		_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+		return
+	}
+
+	fileReconstructor, err := reconstructors.GetOrCreateFileReconstructor(srcAddr)
+	if err == nil {
+		err = fileReconstructor.HandleIncomingFilePacket(packet)
+	}
+	if err != nil {
+		_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+		rejectTransfer(reconstructors, srcAddr, pkt.MsgTypeFileTransfer, abortReasonFor(err), connections)
+		return
+	}
+
+	events.TransferProgress.NotifyObservers(events.TransferProgressEvent{
+		Peer:      srcAddr,
+		Direction: events.Receiving,
+		Bytes:     fileReconstructor.GetStats().Bytes,
+	})
 
-	_ = connection.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+	_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
 }
@@ -2,10 +2,12 @@ package handler
 
 import (
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"net/netip"
+	"time"
 
 	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/events"
 	"bjoernblessin.de/chatprotogol/pkt"
 	"bjoernblessin.de/chatprotogol/sequencing"
 	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
@@ -13,40 +15,42 @@ import (
 	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
-func handleFinish(packet *pkt.Packet, inSequencing *sequencing.IncomingPktNumHandler, socket sock.Socket) {
+func handleFinish(packet *pkt.Packet, srcAddrPort netip.AddrPort, inSequencing *sequencing.IncomingPktNumHandler, socket sock.Socket, reconstructors *reconstruction.Manager, connections *connection.Manager) {
 	logger.Tracef("FINISH FROM %v %d", packet.Header.SourceAddr, packet.Header.PktNum)
 
 	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
 
 	if destAddr != socket.MustGetLocalAddress().Addr() {
 		// The message is for another peer
-		connection.ForwardRouted(packet)
+		connections.ForwardRouted(packet, srcAddrPort)
 		return
 	}
 
 	// The message is for us
 
-	if len(packet.Payload) < 4 {
-		logger.Warnf("Received FINISH packet with insufficient payload length from %v", packet.Header.SourceAddr)
+	receivedAt := time.Now()
+
+	finish, err := parseFinishPayload(packet.Payload)
+	if err != nil {
+		logger.Warnf("Malformed FINISH packet from %v: %v", packet.Header.SourceAddr, err)
 		return
 	}
 
-	lastPktNum := binary.BigEndian.Uint32(packet.Payload[:4])
-
 	duplicate, dupErr := inSequencing.IsDuplicatePacket(packet)
 	if dupErr != nil {
 		logger.Warnf(dupErr.Error())
 		return
 	} else if duplicate {
-		_ = connection.SendRoutedAcknowledgment(netip.AddrFrom4(packet.Header.SourceAddr), packet.Header.PktNum)
+		_ = connections.SendRoutedAcknowledgment(netip.AddrFrom4(packet.Header.SourceAddr), packet.Header.PktNum)
 		return
 	}
 
 	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+	lastPktNum := finish.lastPktNum
 
-	_ = connection.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+	_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
 
-	fileReconstructor, exists := reconstruction.GetFileReconstructor(srcAddr)
+	fileReconstructor, exists := reconstructors.GetFileReconstructor(srcAddr)
 	if exists {
 		highestFilePktNum, err := fileReconstructor.GetHighestPktNum()
 		if err == nil && highestFilePktNum == lastPktNum {
@@ -59,32 +63,108 @@ func handleFinish(packet *pkt.Packet, inSequencing *sequencing.IncomingPktNumHan
 				logger.Warnf("Failed to finish file packet sequence: %v", err)
 			}
 
-			reconstruction.ClearFileReconstructor(srcAddr)
+			stats := fileReconstructor.GetStats()
+			reconstructors.ClearFileReconstructor(srcAddr)
+			connections.RecordTransfer(pkt.MsgTypeFileTransfer, false)
 
-			fmt.Printf("FILE %v: %s\n", srcAddr, filePath)
+			events.FileReceived.NotifyObservers(events.FileReceivedEvent{
+				From:         srcAddr,
+				Path:         filePath,
+				OriginalName: fileReconstructor.GetOriginalFileName(),
+				Summary:      stats,
+			})
 			return
 		}
 	}
 
-	msgReconstructor, exists := reconstruction.GetMsgReconstructor(srcAddr)
+	msgReconstructor, exists := reconstructors.GetMsgReconstructor(srcAddr)
 	if exists {
 		highestMsgPktNum, err := msgReconstructor.GetHighestPktNum()
 		if err == nil && highestMsgPktNum == lastPktNum {
 			// This is a message completion packet
+			completeMessage(srcAddr, msgReconstructor, finish, receivedAt, reconstructors, connections)
+			return
+		}
+	}
+
+	if reconstructors.IsRejected(srcAddr, pkt.MsgTypeChatMessage) || reconstructors.IsRejected(srcAddr, pkt.MsgTypeFileTransfer) {
+		// The FIN ends a transfer we rejected, further transfers of the peer are accepted again
+		logger.Infof("Rejected transfer of %v finished", srcAddr)
+		reconstructors.ClearRejections(srcAddr)
+		return
+	}
 
-			logger.Infof("Message transfer completed for %v", srcAddr)
+	logger.Warnf("Received FINISH packet of %v with last packet number %d, but no reconstructor found", srcAddr, lastPktNum)
+}
 
-			completeMsg, err := msgReconstructor.FinishMsgPacketSequence()
-			if err != nil {
-				logger.Warnf("Failed to finish packet sequence: %v", err)
-			}
+// completeMessage publishes the message of msgReconstructor that is finished by a FIN or a single-packet message.
+// The message is dropped if the message ID of finish shows that it was already delivered.
+func completeMessage(srcAddr netip.Addr, msgReconstructor *reconstruction.InMemoryReconstructor, finish finishPayload, receivedAt time.Time, reconstructors *reconstruction.Manager, connections *connection.Manager) {
+	logger.Infof("Message transfer completed for %v", srcAddr)
+
+	completeMsg, err := msgReconstructor.FinishMsgPacketSequence()
+	if err != nil {
+		logger.Warnf("Failed to finish packet sequence: %v", err)
+	}
+	streamed := min(msgReconstructor.StreamedBytes(), len(completeMsg))
 
-			reconstruction.ClearMsgReconstructor(srcAddr)
+	reconstructors.ClearMsgReconstructor(srcAddr)
 
-			fmt.Printf("MSG %v: %s\n", srcAddr, completeMsg)
+	if finish.hasMessageID {
+		id := reconstruction.MessageID{Origin: srcAddr, Epoch: finish.epoch, FirstPktNum: finish.firstPktNum, LastPktNum: finish.lastPktNum}
+		if reconstructors.MarkDelivered(id) {
+			logger.Infof("Dropping message %v of %v, it was already delivered", id, srcAddr)
 			return
 		}
 	}
 
-	logger.Warnf("Received FINISH packet of %v with last packet number %d, but no reconstructor found", srcAddr, lastPktNum)
+	connections.RecordTransfer(pkt.MsgTypeChatMessage, false)
+
+	event := events.MessageReceivedEvent{From: srcAddr, Text: string(completeMsg), Streamed: streamed}
+	if !finish.sentAt.IsZero() {
+		event.SentAt, event.ClockCorrected = connections.ToLocalTime(srcAddr, finish.sentAt)
+		event.Delay = receivedAt.Sub(event.SentAt)
+		event.Reordered = reconstructors.RecordMessageSentAt(srcAddr, finish.sentAt) // In the clock of the peer, so the order doesn't depend on offset estimates
+	}
+
+	events.MessageReceived.NotifyObservers(event)
+}
+
+// finishPayload is the parsed payload of a FIN packet.
+// Messages optionally carry their send time and the parts of their message ID that aren't in the header.
+//
+//	+--------+--------+--------+--------+
+//	|     Last Packet Number (32 bits)  |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|               Send Time in Unix Nanoseconds (64 bits, optional)       |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|               Boot Epoch of the Sender (64 bits, optional)            |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|    First Packet Number (32 bits)  |
+//	+--------+--------+--------+--------+
+type finishPayload struct {
+	lastPktNum   uint32
+	sentAt       time.Time // The zero value if the send time is missing
+	epoch        uint64
+	firstPktNum  uint32
+	hasMessageID bool // Whether epoch and firstPktNum are set
+}
+
+// parseFinishPayload parses the payload of a FIN packet.
+func parseFinishPayload(payload pkt.Payload) (finish finishPayload, err error) {
+	if len(payload) < 4 {
+		return finishPayload{}, errors.New("payload is too short to contain the last packet number")
+	}
+	finish.lastPktNum = binary.BigEndian.Uint32(payload[:4])
+
+	if len(payload) >= 12 {
+		finish.sentAt = time.Unix(0, int64(binary.BigEndian.Uint64(payload[4:12])))
+	}
+
+	if len(payload) >= 24 {
+		finish.epoch = binary.BigEndian.Uint64(payload[12:20])
+		finish.firstPktNum = binary.BigEndian.Uint32(payload[20:24])
+		finish.hasMessageID = true
+	}
+	return finish, nil
 }
@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+func FuzzParseLSAPayload(f *testing.F) {
+	f.Add([]byte{10, 0, 0, 1, 0, 0, 0, 1, 10, 0, 0, 2})
+	f.Add([]byte{10, 0, 0, 1, 0, 0, 0, 1})
+	f.Add([]byte{10, 0, 0, 1, 0, 0, 0, 1, 10, 0, 0, 2, 0, 0, 0, 0})
+	f.Add([]byte{10, 0, 0, 1})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		owner, _, neighbors, stub, err := parseLSAPayload(payload)
+		if err != nil {
+			return
+		}
+
+		wantNeighbors := (len(payload) - 8) / 4
+		if stub {
+			wantNeighbors-- // The stub marker isn't a neighbor
+		}
+		if !owner.Is4() || len(neighbors) != wantNeighbors {
+			t.Errorf("Parsed owner %v and %d neighbors from %d bytes", owner, len(neighbors), len(payload))
+		}
+	})
+}
+
+func FuzzParseDatabaseDescriptionPayload(f *testing.F) {
+	f.Add([]byte{10, 0, 0, 1, 10, 0, 0, 2})
+	f.Add([]byte{10, 0, 0})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		addrs, err := parseDatabaseDescriptionPayload(payload)
+		if err != nil {
+			return
+		}
+
+		if len(addrs) != len(payload)/4 {
+			t.Errorf("Parsed %d addresses from %d bytes", len(addrs), len(payload))
+		}
+	})
+}
+
+func FuzzParseDatabaseDescriptionEntries(f *testing.F) {
+	f.Add([]byte{10, 0, 0, 1, 0, 0, 0, 3, 10, 0, 0, 2, 0, 0, 0, 7})
+	f.Add([]byte{10, 0, 0, 1})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		entries, err := parseDatabaseDescriptionEntries(payload)
+		if err != nil {
+			return
+		}
+
+		if len(entries) != len(payload)/8 {
+			t.Errorf("Parsed %d entries from %d bytes", len(entries), len(payload))
+		}
+	})
+}
+
+func FuzzParseFinishPayload(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 7})
+	f.Add([]byte{0, 0, 0, 7, 0x18, 0x2a, 0x5c, 0x3b, 0x1f, 0x00, 0x00, 0x00})
+	f.Add([]byte{0, 0})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		finish, err := parseFinishPayload(payload)
+		if err != nil {
+			return
+		}
+
+		if finish.lastPktNum != binary.BigEndian.Uint32(payload) {
+			t.Errorf("Parsed last packet number %d from %v", finish.lastPktNum, payload)
+		}
+		if finish.sentAt.IsZero() != (len(payload) < 12) {
+			t.Errorf("Parsed send time %v from %d bytes", finish.sentAt, len(payload))
+		}
+		if finish.hasMessageID != (len(payload) >= 24) {
+			t.Errorf("Parsed message ID %v from %d bytes", finish.hasMessageID, len(payload))
+		}
+	})
+}
+
+// FuzzProcessPacket passes arbitrary packets from a peer that isn't connected through the complete packet handler.
+// Packets that parse get a valid checksum, so they reach the handlers of their message type.
+func FuzzProcessPacket(f *testing.F) {
+	peer := netip.MustParseAddr("10.0.255.254")
+	nodeAddr := node.addrPort.Addr()
+
+	for msgType := range byte(0xC) {
+		for _, payload := range [][]byte{nil, {0}, {0, 0, 0, 0}, make([]byte, 8), make([]byte, 20)} {
+			packet := &pkt.Packet{
+				Header: pkt.Header{
+					SourceAddr: peer.As4(),
+					DestAddr:   nodeAddr.As4(),
+					Control:    pkt.MakeControlByte(msgType, common.TEAM_ID),
+					TTL:        common.INITIAL_TTL,
+				},
+				Payload: payload,
+			}
+			f.Add(packet.ToByteArray())
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if packet, err := pkt.ParsePacket(data); err == nil {
+			pkt.SetChecksum(packet)
+			data = packet.ToByteArray()
+		}
+
+		node.handler.processPacket(&sock.Packet{
+			Addr: net.UDPAddrFromAddrPort(netip.AddrPortFrom(peer, sock.PREFERRED_PORT)),
+			Data: data,
+		})
+
+		// A fuzzed CONNECT makes the peer a neighbor, it is removed so the node doesn't keep sending to it
+		if isNeighbor, _ := node.router.IsNeighbor(peer); isNeighbor {
+			node.connections.RemoveNeighbor(peer)
+		}
+	})
+}
@@ -3,41 +3,79 @@
 package handler
 
 import (
+	"fmt"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/access"
 	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/connection"
 	"bjoernblessin.de/chatprotogol/pkt"
 	"bjoernblessin.de/chatprotogol/routing"
 	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
 	"bjoernblessin.de/chatprotogol/sock"
 	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/panics"
 )
 
 type PacketHandler struct {
-	socket        sock.Socket
-	router        *routing.Router
-	inSequencing  *sequencing.IncomingPktNumHandler
-	outSequencing *sequencing.OutgoingPktNumHandler
+	socket         sock.Socket
+	router         *routing.Router
+	inSequencing   *sequencing.IncomingPktNumHandler
+	outSequencing  *sequencing.OutgoingPktNumHandler
+	accessList     *access.AccessList
+	reconstructors *reconstruction.Manager
+	connections    *connection.Manager
 }
 
-func NewPacketHandler(socket sock.Socket, router *routing.Router, inSequencing *sequencing.IncomingPktNumHandler, outSequencing *sequencing.OutgoingPktNumHandler) *PacketHandler {
+func NewPacketHandler(socket sock.Socket, router *routing.Router, inSequencing *sequencing.IncomingPktNumHandler, outSequencing *sequencing.OutgoingPktNumHandler, accessList *access.AccessList, reconstructors *reconstruction.Manager, connections *connection.Manager) *PacketHandler {
 	return &PacketHandler{
-		socket:        socket,
-		router:        router,
-		inSequencing:  inSequencing,
-		outSequencing: outSequencing,
+		socket:         socket,
+		router:         router,
+		inSequencing:   inSequencing,
+		outSequencing:  outSequencing,
+		accessList:     accessList,
+		reconstructors: reconstructors,
+		connections:    connections,
 	}
 }
 
-// ListenToPackets starts listening to incoming packets on the socket.
-// It should be called in a separate goroutine to avoid blocking.
-func (ph *PacketHandler) ListenToPackets() {
+// Start starts listening to incoming packets on the socket.
+// The packets are processed in separate goroutines, no packet received after Start returns is missed.
+func (ph *PacketHandler) Start() {
+	go ph.listenTo(ph.socket.Subscribe())
+}
+
+// listenTo processes the packets of a subscription of the socket.
+// Packets exceeding the ingress budget of their sender are dropped first, see admitIngress.
+// ACKs bypass the PACKET_HANDLER_GOROUTINES, see processAcks.
+func (ph *PacketHandler) listenTo(packets chan *sock.Packet) {
 	var sem = make(chan struct{}, common.PACKET_HANDLER_GOROUTINES)
+	acks := make(chan *sock.Packet, common.ACK_QUEUE_SIZE_PACKETS)
+	defer close(acks)
+	go ph.processAcks(acks)
+
+	for packet := range packets {
+		if !ph.admitIngress(packet) {
+			continue
+		}
+
+		if isAck(packet.Data) {
+			select {
+			case acks <- packet:
+			default:
+				logger.Tracef("ACK queue is full, dropping ACK from %v", packet.Addr.AddrPort())
+			}
+			continue
+		}
 
-	for packet := range ph.socket.Subscribe() {
 		select {
 		case sem <- struct{}{}: // Acquire a semaphore slot
 			go func() {
+				defer func() { <-sem }() // Release the semaphore slot
+				defer panics.Recover("processing packet from %v", packet.Addr)
+
 				ph.processPacket(packet)
-				<-sem // Release the semaphore slot
 			}()
 		default:
 			logger.Tracef("Packet handler is busy, dropping packet from %v", packet.Addr.AddrPort())
@@ -45,19 +83,118 @@ func (ph *PacketHandler) ListenToPackets() {
 	}
 }
 
+// admitIngress returns whether the packet is within the ingress budget of its sender (see connection.Manager.AdmitIngress).
+// An abusive sender is blocked and disconnected if it is a neighbor, in another goroutine so the listener isn't held up.
+func (ph *PacketHandler) admitIngress(packet *sock.Packet) bool {
+	sender := packet.Addr.AddrPort()
+	sender = netip.AddrPortFrom(sender.Addr().Unmap(), sender.Port())
+
+	switch ph.connections.AdmitIngress(sender.Addr(), packet.Data) {
+	case connection.IngressAdmitted:
+		return true
+	case connection.IngressAbusive:
+		go func() {
+			defer panics.Recover("blocking abusive sender %v", sender)
+			ph.blockAbusiveSender(sender)
+		}()
+	}
+	return false
+}
+
+// blockAbusiveSender blocks the protocol address of the abusive sender socket and disconnects it if it is a neighbor.
+// The IP address of the socket isn't the protocol address of a neighbor behind a NAT or with a node ID, the neighbor reached at the socket is blocked instead.
+// A sender that isn't a neighbor is blocked by its IP address, unless a neighbor shares the address, its packets stay limited by the budget.
+func (ph *PacketHandler) blockAbusiveSender(sender netip.AddrPort) {
+	neighbors := ph.router.GetNeighbors()
+
+	addr, isNeighbor := sender.Addr(), false
+	for neighbor, addrPort := range neighbors {
+		if addrPort == sender {
+			addr, isNeighbor = neighbor, true
+			break
+		}
+	}
+	if !isNeighbor {
+		for neighbor, addrPort := range neighbors {
+			if addrPort.Addr() == sender.Addr() {
+				logger.Warnf("%v exceeded its ingress budget for %v, not blocking it as neighbor %v shares its address", sender, common.INGRESS_AUTO_BLOCK_AFTER, neighbor)
+				return
+			}
+		}
+	}
+
+	logger.Warnf("Blocking %v, it exceeded its ingress budget from %v for %v; unblock it with 'unblock %v'", addr, sender, common.INGRESS_AUTO_BLOCK_AFTER, addr)
+	if err := ph.accessList.Block(addr); err != nil {
+		logger.Warnf("Blocked %v, but failed to persist the access list: %v", addr, err)
+	}
+	if isNeighbor {
+		if _, err := ph.connections.DisconnectNeighbor(addr); err != nil {
+			logger.Warnf("Failed to disconnect from blocked neighbor %v: %v", addr, err)
+		}
+	}
+}
+
+// processAcks processes the ACKs separated by listenTo one after another, until acks is closed.
+// An ACK dropped because all handler goroutines are busy with data packets would cause a spurious retransmission, adding to the load.
+// Only ACKs take this path: other control packets may flood or wait for a congestion window (e.g. a DISCONNECT), which must not hold up the ACKs behind them.
+func (ph *PacketHandler) processAcks(acks chan *sock.Packet) {
+	for packet := range acks {
+		ph.processAck(packet)
+	}
+}
+
+func (ph *PacketHandler) processAck(packet *sock.Packet) {
+	defer panics.Recover("processing ACK from %v", packet.Addr)
+	ph.processPacket(packet)
+}
+
+// isAck returns whether the serialized packet is an ACK, also one with extensions.
+func isAck(data []byte) bool {
+	msgType, ok := pkt.PeekMessageType(data)
+	return ok && msgType == pkt.MsgTypeAcknowledgment
+}
+
 // processPacket processes an incoming UDP packet.
-// It parses the packet, verifies the checksum, checks TTL and handles it based on its message type.
+// It drops packets of denied peers, parses the packet, verifies the checksum, wire format and MAC, checks TTL and handles it based on its message type.
 // This is the general entry for all incoming packets.
 func (ph *PacketHandler) processPacket(udpPacket *sock.Packet) {
+	senderAddr := udpPacket.Addr.AddrPort().Addr().Unmap()
+	if !ph.accessList.IsAllowed(senderAddr) {
+		logger.Tracef("Dropping packet from denied sender %v", senderAddr)
+		return
+	}
+
 	packet, err := pkt.ParsePacket(udpPacket.Data)
 	if err != nil {
 		logger.Warnf("Failed to parse packet: %v", err)
+		ph.connections.RecordViolation(connection.ViolationMalformed, udpPacket.Addr.AddrPort(), nil, err.Error())
 		return
 	}
 
 	isValid := pkt.VerifyChecksum(packet)
 	if !isValid {
 		logger.Warnf("Invalid checksum for packet from %v to %v, received checksum: 0x%04X", packet.Header.SourceAddr, packet.Header.DestAddr, packet.Header.Checksum)
+		ph.connections.RecordViolation(connection.ViolationChecksum, udpPacket.Addr.AddrPort(), packet, fmt.Sprintf("checksum 0x%04X", packet.Header.Checksum))
+		return
+	}
+
+	if !ph.connections.ValidatePacket(packet, udpPacket.Addr.AddrPort()) {
+		logger.Debugf("Dropping packet from %v (%v) that violates the wire format in strict mode", packet.Header.SourceAddr, senderAddr)
+		return
+	}
+
+	if !ph.connections.VerifyTeam(packet) {
+		logger.Tracef("Dropping packet of team %d from %v (%v)", packet.GetTeamID(), packet.Header.SourceAddr, senderAddr)
+		return
+	}
+
+	if !ph.connections.VerifyAuthentication(packet) {
+		logger.Warnf("Invalid or missing MAC for packet from %v (%v), dropping packet", packet.Header.SourceAddr, senderAddr)
+		return
+	}
+
+	if srcAddr := netip.AddrFrom4(packet.Header.SourceAddr); !ph.accessList.IsAllowed(srcAddr) {
+		logger.Tracef("Dropping packet from denied source %v", srcAddr)
 		return
 	}
 
@@ -68,27 +205,48 @@ func (ph *PacketHandler) processPacket(udpPacket *sock.Packet) {
 
 	logger.Tracef(packet.String())
 
+	handlePiggybackedAcks(packet, udpPacket.Addr.AddrPort(), ph.socket, ph.outSequencing, ph.connections)
+
+	if netip.AddrFrom4(packet.Header.DestAddr) == ph.socket.MustGetLocalAddress().Addr() {
+		ph.connections.RecordReceived(packet)
+		ph.connections.RecordTimestamps(packet)
+		ph.connections.RecordCongestionMark(packet) // Echoed with the next ACK or data packet to the source
+	}
+
+	ph.connections.AcknowledgeHop(packet, udpPacket.Addr.AddrPort())
+
 	// TODO handle duplicates for packets that have destaddr == localaddress
 
 	switch packet.GetMessageType() {
 	case pkt.MsgTypeConnect:
-		handleConnect(packet, udpPacket.Addr.AddrPort(), ph.router, ph.inSequencing, ph.socket)
+		handleConnect(packet, udpPacket.Addr.AddrPort(), ph.router, ph.inSequencing, ph.socket, ph.connections)
 	case pkt.MsgTypeDisconnect:
-		handleDisconnect(packet, ph.inSequencing, ph.router, ph.socket, udpPacket.Addr.AddrPort())
+		handleDisconnect(packet, ph.inSequencing, ph.router, ph.socket, udpPacket.Addr.AddrPort(), ph.connections)
 	case pkt.MsgTypeAcknowledgment:
-		handleAck(packet, ph.socket, ph.outSequencing)
+		handleAck(packet, udpPacket.Addr.AddrPort(), ph.socket, ph.outSequencing, ph.connections)
 	case pkt.MsgTypeChatMessage:
-		handleMsg(packet, ph.socket, ph.inSequencing)
+		handleMsg(packet, udpPacket.Addr.AddrPort(), ph.socket, ph.inSequencing, ph.reconstructors, ph.connections)
 	case pkt.MsgTypeDD:
-		handleDatabaseDescription(packet, ph.router, ph.inSequencing, udpPacket.Addr.AddrPort(), ph.socket)
+		handleDatabaseDescription(packet, ph.router, ph.inSequencing, udpPacket.Addr.AddrPort(), ph.socket, ph.connections)
 	case pkt.MsgTypeLSA:
-		handleLSA(packet, ph.router, ph.inSequencing, udpPacket.Addr.AddrPort(), ph.socket)
+		handleLSA(packet, ph.router, ph.inSequencing, udpPacket.Addr.AddrPort(), ph.socket, ph.connections)
 	case pkt.MsgTypeFinish:
-		handleFinish(packet, ph.inSequencing, ph.socket)
+		handleFinish(packet, udpPacket.Addr.AddrPort(), ph.inSequencing, ph.socket, ph.reconstructors, ph.connections)
 	case pkt.MsgTypeFileTransfer:
-		handleFileTransfer(packet, ph.socket, ph.inSequencing)
+		handleFileTransfer(packet, udpPacket.Addr.AddrPort(), ph.socket, ph.inSequencing, ph.reconstructors, ph.connections)
+	case pkt.MsgTypeMTUProbe:
+		handleMTUProbe(packet, udpPacket.Addr.AddrPort(), ph.socket, ph.connections)
+	case pkt.MsgTypeIntroduce:
+		handleIntroduce(packet, udpPacket.Addr.AddrPort(), ph.socket, ph.inSequencing, ph.accessList, ph.connections)
+	case pkt.MsgTypeRelay:
+		ph.handleRelay(packet, udpPacket.Addr.AddrPort())
+	case pkt.MsgTypeAbort:
+		handleAbort(packet, udpPacket.Addr.AddrPort(), ph.socket, ph.inSequencing, ph.outSequencing, ph.connections)
+	case pkt.MsgTypePresence:
+		handlePresence(packet, udpPacket.Addr.AddrPort(), ph.socket, ph.connections)
+	case pkt.MsgTypeRebind:
+		handleRebind(packet, ph.router, ph.inSequencing, udpPacket.Addr.AddrPort(), ph.socket, ph.connections)
 	default:
-		logger.Warnf("Unhandled packet type: %v from %v to %v", packet.GetMessageType(), packet.Header.SourceAddr, packet.Header.DestAddr)
-		return
+		handleCustom(packet, udpPacket.Addr.AddrPort(), ph.socket, ph.inSequencing, ph.connections)
 	}
 }
@@ -0,0 +1,501 @@
+package handler
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/access"
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// All tests share one complete node started by TestMain, so like a long-running node it keeps the state of many earlier peers.
+// Its peers are virtual peers, scripted endpoints that send and expect raw packets on the same in-memory network.
+// Every virtual peer gets a new address, so the state the node keeps of earlier peers doesn't interfere.
+
+const (
+	expectTimeout             = time.Second * 2
+	connectRetransmitInterval = time.Millisecond * 50
+)
+
+var (
+	network      *sock.MemoryNetwork
+	node         *testNode
+	lastPeerHost atomic.Uint32 // Host part of the last virtual peer address in 10.0.0.0/16, the node is 10.0.0.1
+)
+
+func TestMain(m *testing.M) {
+	receivedFilesDir, err := os.MkdirTemp("", "chatprotogol-handler-test")
+	if err != nil {
+		panic(err)
+	}
+	common.RECEIVED_FILES_DIR = receivedFilesDir
+
+	network = sock.NewMemoryNetwork()
+	node = startNode(network, "10.0.0.1", filepath.Join(receivedFilesDir, "access.json"))
+
+	lastPeerHost.Store(1)
+	code := m.Run()
+
+	os.RemoveAll(receivedFilesDir)
+	os.Exit(code)
+}
+
+// testNode is a complete node (socket, router, sequencing, packet handler) on an in-memory network.
+type testNode struct {
+	socket      *sock.MemorySocket
+	router      *routing.Router
+	connections *connection.Manager
+	handler     *PacketHandler
+	addrPort    netip.AddrPort
+}
+
+// startNode wires a node like main does and opens its socket at addr.
+func startNode(network *sock.MemoryNetwork, addr string, accessListPath string) *testNode {
+	socket := network.NewSocket()
+	inSequencing := sequencing.NewIncomingPktNumHandler(socket)
+	outSequencing := sequencing.NewOutgoingPktNumHandler(common.INITIAL_CWND, common.IGNORE_CWND)
+	router := routing.NewRouter(socket)
+	accessList := access.NewAccessList(accessListPath)
+	reconstructors := reconstruction.NewManager()
+
+	connections := connection.NewManager(socket, router, inSequencing, outSequencing, reconstructors)
+
+	packetHandler := NewPacketHandler(socket, router, inSequencing, outSequencing, accessList, reconstructors, connections)
+	packetHandler.Start()
+
+	localAddr, err := socket.Open(net.ParseIP(addr))
+	if err != nil {
+		panic(err)
+	}
+
+	return &testNode{socket: socket, router: router, connections: connections, handler: packetHandler, addrPort: localAddr.AddrPort()}
+}
+
+// newPeerNode starts another complete node with a new address on the network of the node.
+// When the test ends, it disconnects from its neighbors, so they stop sending to it, and closes its socket.
+func newPeerNode(t testing.TB) *testNode {
+	t.Helper()
+
+	host := lastPeerHost.Add(1)
+	addr := netip.AddrFrom4([4]byte{10, 0, byte(host >> 8), byte(host)})
+	peer := startNode(network, addr.String(), filepath.Join(t.TempDir(), "access.json"))
+
+	t.Cleanup(func() {
+		// Relayed neighbors first, while the relays still pass on the DISCONNECTs
+		neighbors := peer.router.GetNeighbors()
+		for _, relayed := range []bool{true, false} {
+			for neighbor, addrPort := range neighbors {
+				if connection.IsRelayedAddrPort(addrPort) != relayed {
+					continue
+				}
+				if disconnected, err := peer.connections.DisconnectNeighbor(neighbor); err == nil {
+					<-disconnected
+				}
+			}
+		}
+		peer.socket.Close()
+	})
+
+	return peer
+}
+
+// connectNodes connects from to the node to and waits until both route to each other.
+func connectNodes(t testing.TB, from *testNode, to *testNode) {
+	t.Helper()
+
+	connected, err := from.connections.ConnectTo(to.addrPort.Addr(), to.addrPort, from.connections.BuildConnectPayload())
+	if err != nil {
+		t.Fatalf("Failed to connect %v to %v: %v", from.addrPort.Addr(), to.addrPort.Addr(), err)
+	}
+	select {
+	case success := <-connected:
+		if !success {
+			t.Fatalf("Connection of %v to %v failed", from.addrPort.Addr(), to.addrPort.Addr())
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Connection of %v to %v wasn't established", from.addrPort.Addr(), to.addrPort.Addr())
+	}
+
+	waitForRoute(t, from, to.addrPort.Addr())
+	waitForRoute(t, to, from.addrPort.Addr())
+}
+
+// waitForRoute waits until the node has a route to dest, that is until the LSAs of both ends were exchanged.
+func waitForRoute(t testing.TB, n *testNode, dest netip.Addr) {
+	t.Helper()
+
+	deadline := time.Now().Add(expectTimeout)
+	for time.Now().Before(deadline) {
+		if _, found := n.router.GetNextHop(dest); found {
+			return
+		}
+		time.Sleep(connectRetransmitInterval)
+	}
+	t.Fatalf("%v has no route to %v", n.addrPort.Addr(), dest)
+}
+
+// virtualPeer is a scripted peer that speaks the protocol packet by packet.
+// Reliable packets of the node are acknowledged automatically while waiting for an expected packet.
+type virtualPeer struct {
+	t          testing.TB
+	socket     *sock.MemorySocket
+	addr       netip.Addr
+	packets    chan *sock.Packet
+	nextPktNum uint32
+	bootEpoch  uint64
+	connected  bool
+	hopARQ     bool               // Announces hop-by-hop ARQ on the CONNECT
+	clockSkew  time.Duration      // Offset of the peer's clock to the node's clock, the CONNECT requests a time sync echo if set
+	signingKey ed25519.PrivateKey // Announced on the CONNECT and used to sign the LSAs of the peer if set
+}
+
+// newVirtualPeer opens a virtual peer with a new address on the network of the node.
+func newVirtualPeer(t testing.TB) *virtualPeer {
+	t.Helper()
+
+	host := lastPeerHost.Add(1)
+	socket := network.NewSocket()
+	localAddr, err := socket.Open(net.IPv4(10, 0, byte(host>>8), byte(host)))
+	if err != nil {
+		t.Fatalf("Failed to open virtual peer socket: %v", err)
+	}
+
+	peer := &virtualPeer{
+		t:         t,
+		socket:    socket,
+		addr:      localAddr.AddrPort().Addr(),
+		packets:   socket.Subscribe(),
+		bootEpoch: uint64(time.Now().UnixNano()),
+	}
+	t.Cleanup(peer.close)
+
+	return peer
+}
+
+// newVirtualPeerWithNodeID opens a virtual peer that identifies by a node ID instead of its socket address.
+// The node ID is derived from the peer's signing key, so the node accepts it on the first CONNECT.
+func newVirtualPeerWithNodeID(t testing.TB) *virtualPeer {
+	t.Helper()
+
+	peer := newVirtualPeer(t)
+	_, peer.signingKey, _ = ed25519.GenerateKey(nil)
+	peer.addr = connection.NodeIDFromKey(peer.signingKey.Public().(ed25519.PublicKey))
+	return peer
+}
+
+// close disconnects the peer from the node, so the node stops sending to it, and closes its socket.
+func (p *virtualPeer) close() {
+	if p.connected {
+		dis := p.build(pkt.MsgTypeDisconnect, nil, node.addrPort.Addr())
+		p.send(dis)
+		p.expectAck(dis)
+	}
+
+	p.socket.Close()
+}
+
+// build returns a sequenced packet from the peer.
+func (p *virtualPeer) build(msgType byte, payload pkt.Payload, dest netip.Addr) *pkt.Packet {
+	var pktNum [4]byte
+	binary.BigEndian.PutUint32(pktNum[:], p.nextPktNum)
+	p.nextPktNum++
+
+	packet := &pkt.Packet{
+		Header: pkt.Header{
+			SourceAddr: p.addr.As4(),
+			DestAddr:   dest.As4(),
+			Control:    pkt.MakeControlByte(msgType, common.TEAM_ID),
+			TTL:        common.INITIAL_TTL,
+			PktNum:     pktNum,
+		},
+		Payload: payload,
+	}
+	pkt.SetChecksum(packet)
+	return packet
+}
+
+// send sends the packet to the node.
+func (p *virtualPeer) send(packet *pkt.Packet) {
+	p.t.Helper()
+
+	err := p.socket.SendTo(net.UDPAddrFromAddrPort(node.addrPort), packet.ToByteArray())
+	if err != nil {
+		p.t.Fatalf("Failed to send packet: %v", err)
+	}
+}
+
+// expect waits for a packet of the message type from the node and returns it.
+// Other packets are acknowledged (if they are reliable) and skipped.
+func (p *virtualPeer) expect(msgType byte) *pkt.Packet {
+	p.t.Helper()
+
+	packet, received := p.expectWithin(msgType, expectTimeout)
+	if !received {
+		p.t.Fatalf("Virtual peer %v didn't receive a packet of type %d within %v", p.addr, msgType, expectTimeout)
+	}
+	return packet
+}
+
+// receive returns the next packet from the node without acknowledging it.
+func (p *virtualPeer) receive() *pkt.Packet {
+	p.t.Helper()
+
+	select {
+	case udpPacket := <-p.packets:
+		packet, err := pkt.ParsePacket(udpPacket.Data)
+		if err != nil {
+			p.t.Fatalf("Node sent an unparsable packet: %v", err)
+		}
+		return packet
+	case <-time.After(expectTimeout):
+		p.t.Fatalf("Virtual peer %v didn't receive a packet within %v", p.addr, expectTimeout)
+		return nil
+	}
+}
+
+// expectWithin is like expect but returns false instead of failing the test if no packet arrives within the timeout.
+func (p *virtualPeer) expectWithin(msgType byte, timeout time.Duration) (*pkt.Packet, bool) {
+	p.t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case udpPacket := <-p.packets:
+			packet, err := pkt.ParsePacket(udpPacket.Data)
+			if err != nil {
+				p.t.Fatalf("Node sent an unparsable packet: %v", err)
+			}
+			if !pkt.VerifyChecksum(packet) {
+				p.t.Fatalf("Node sent a packet with an invalid checksum: %v", packet)
+			}
+
+			if packet.GetMessageType() != pkt.MsgTypeAcknowledgment && packet.GetMessageType() != pkt.MsgTypeMTUProbe {
+				p.acknowledge(packet)
+			}
+
+			if packet.GetMessageType() == msgType {
+				return packet, true
+			}
+		case <-deadline:
+			return nil, false
+		}
+	}
+}
+
+// expectUntil passes every packet from the node to done until done returns true.
+// It is used if the order of the expected packets isn't fixed.
+func (p *virtualPeer) expectUntil(done func(packet *pkt.Packet) bool) {
+	p.t.Helper()
+
+	deadline := time.After(expectTimeout)
+	for {
+		select {
+		case udpPacket := <-p.packets:
+			packet, err := pkt.ParsePacket(udpPacket.Data)
+			if err != nil {
+				p.t.Fatalf("Node sent an unparsable packet: %v", err)
+			}
+
+			if packet.GetMessageType() != pkt.MsgTypeAcknowledgment && packet.GetMessageType() != pkt.MsgTypeMTUProbe {
+				p.acknowledge(packet)
+			}
+
+			if done(packet) {
+				return
+			}
+		case <-deadline:
+			p.t.Fatalf("Virtual peer %v didn't receive the expected packets within %v", p.addr, expectTimeout)
+		}
+	}
+}
+
+// expectAck waits for the acknowledgment of the packet.
+func (p *virtualPeer) expectAck(packet *pkt.Packet) {
+	p.t.Helper()
+
+	for {
+		ack := p.expect(pkt.MsgTypeAcknowledgment)
+		if ack.Header.PktNum == packet.Header.PktNum {
+			return
+		}
+	}
+}
+
+func (p *virtualPeer) acknowledge(packet *pkt.Packet) {
+	ack := &pkt.Packet{
+		Header: pkt.Header{
+			SourceAddr: p.addr.As4(),
+			DestAddr:   packet.Header.SourceAddr,
+			Control:    pkt.MakeControlByte(pkt.MsgTypeAcknowledgment, common.TEAM_ID),
+			TTL:        common.INITIAL_TTL,
+			PktNum:     packet.Header.PktNum,
+		},
+	}
+	pkt.SetChecksum(ack)
+	p.send(ack)
+}
+
+// connect sends a CONNECT to the node and returns its acknowledgment.
+// The CONNECT is retransmitted until it is acknowledged, as the node may not listen to its socket yet.
+func (p *virtualPeer) connect() *pkt.Packet {
+	p.t.Helper()
+
+	packet := p.buildConnect()
+
+	for range expectTimeout / connectRetransmitInterval {
+		p.send(packet)
+
+		ack, received := p.expectWithin(pkt.MsgTypeAcknowledgment, connectRetransmitInterval)
+		if received && ack.Header.PktNum == packet.Header.PktNum {
+			p.connected = true
+			return ack
+		}
+	}
+	p.t.Fatalf("Node didn't acknowledge the CONNECT of %v", p.addr)
+	return nil
+}
+
+// buildConnect returns a CONNECT of the peer to the node.
+func (p *virtualPeer) buildConnect() *pkt.Packet {
+	payload := binary.BigEndian.AppendUint64(nil, p.bootEpoch)
+	packet := p.build(pkt.MsgTypeConnect, payload, node.addrPort.Addr())
+	if boundAddr, _ := p.socket.GetBoundAddress(); boundAddr.Addr() != p.addr {
+		nodeID := p.addr.As4()
+		packet.AddExtension(pkt.ExtTypeNodeID, nodeID[:])
+		pkt.SetChecksum(packet)
+	}
+	if p.hopARQ {
+		packet.AddExtension(pkt.ExtTypeHopARQ, nil)
+		pkt.SetChecksum(packet)
+	}
+	if p.clockSkew != 0 {
+		packet.AddExtension(pkt.ExtTypeTimestamp, binary.BigEndian.AppendUint64(nil, uint64(p.now().UnixNano())))
+		pkt.SetChecksum(packet)
+	}
+	if p.signingKey != nil {
+		signed := append(packet.Header.SourceAddr[:], packet.Header.DestAddr[:]...)
+		signed = append(signed, packet.Header.PktNum[:]...)
+		signed = append(signed, packet.Payload...)
+		packet.AddExtension(pkt.ExtTypePublicKey, p.signingKey.Public().(ed25519.PublicKey))
+		packet.AddExtension(pkt.ExtTypeConnectSignature, ed25519.Sign(p.signingKey, signed))
+		pkt.SetChecksum(packet)
+	}
+	return packet
+}
+
+// now returns the current time in the clock of the peer.
+func (p *virtualPeer) now() time.Time {
+	return time.Now().Add(p.clockSkew)
+}
+
+// floodLSA sends the peer's LSA with the given neighbors to the node.
+// The LSA is signed if the peer has a signing key, the signature block is inserted in front of a trailing routing.StubMarker.
+func (p *virtualPeer) floodLSA(seqNum uint32, neighbors ...netip.Addr) {
+	p.t.Helper()
+
+	owner := p.addr.As4()
+	body := append([]byte(nil), owner[:]...)
+	body = binary.BigEndian.AppendUint32(body, seqNum)
+	for _, neighbor := range neighbors {
+		neighborBytes := neighbor.As4()
+		body = append(body, neighborBytes[:]...)
+	}
+
+	payload := binary.BigEndian.AppendUint64(nil, p.bootEpoch)
+	if p.signingKey == nil {
+		payload = append(payload, body...)
+	} else {
+		neighborsEnd := len(body)
+		if len(neighbors) > 0 && neighbors[len(neighbors)-1] == routing.StubMarker {
+			neighborsEnd -= 4
+		}
+		payload = append(payload, body[:neighborsEnd]...)
+		payload = append(payload, 255, 255, 255, 255)
+		payload = append(payload, p.signingKey.Public().(ed25519.PublicKey)...)
+		payload = append(payload, ed25519.Sign(p.signingKey, body)...)
+		payload = append(payload, body[neighborsEnd:]...)
+	}
+
+	packet := p.build(pkt.MsgTypeLSA, payload, node.addrPort.Addr())
+	p.send(packet)
+	p.expectAck(packet)
+}
+
+// sendMessage sends the chunks as one message to dest (through the node) followed by the FIN.
+// Every packet is acknowledged by dest, so the acknowledgments are only awaited if dest is the node.
+func (p *virtualPeer) sendMessage(dest netip.Addr, chunks ...string) {
+	p.t.Helper()
+
+	var lastPktNum [4]byte
+	for _, chunk := range chunks {
+		packet := p.build(pkt.MsgTypeChatMessage, pkt.Payload(chunk), dest)
+		p.send(packet)
+		if dest == node.addrPort.Addr() {
+			p.expectAck(packet)
+		}
+		lastPktNum = packet.Header.PktNum
+	}
+
+	fin := p.build(pkt.MsgTypeFinish, pkt.Payload(lastPktNum[:]), dest)
+	p.send(fin)
+	if dest == node.addrPort.Addr() {
+		p.expectAck(fin)
+	}
+}
+
+// parseLSANeighbors returns the owner and the neighbors of an LSA packet, the signature block isn't part of the neighbors.
+func parseLSANeighbors(t *testing.T, packet *pkt.Packet) (owner netip.Addr, neighbors []netip.Addr) {
+	t.Helper()
+
+	_, lsaPayload, err := connection.SplitBootEpoch(packet.Payload)
+	if err != nil || len(lsaPayload) < 8 || len(lsaPayload)%4 != 0 {
+		t.Fatalf("Malformed LSA payload %v", packet.Payload)
+	}
+	rest, _ := connection.SplitLSASignature(lsaPayload)
+
+	owner = netip.AddrFrom4([4]byte(rest[:4]))
+	for i := 8; i < len(rest); i += 4 {
+		neighbors = append(neighbors, netip.AddrFrom4([4]byte(rest[i:i+4])))
+	}
+	return owner, neighbors
+}
+
+// sendRoomPacket sends room traffic of the peer to the node and waits for its acknowledgment.
+func (p *virtualPeer) sendRoomPacket(op byte, room string, payload pkt.Payload) {
+	p.t.Helper()
+
+	packet := p.build(pkt.MsgTypeChatMessage, payload, node.addrPort.Addr())
+	packet.AddExtension(pkt.ExtTypeRoom, append([]byte{op}, room...))
+	pkt.SetChecksum(packet)
+	p.send(packet)
+	p.expectAck(packet)
+}
+
+// expectRoomPacket waits for room traffic of the operation from the node and returns its payload.
+func (p *virtualPeer) expectRoomPacket(op byte, room string) pkt.Payload {
+	p.t.Helper()
+
+	var payload pkt.Payload
+	p.expectUntil(func(packet *pkt.Packet) bool {
+		receivedOp, receivedRoom, isRoomTraffic := connection.ParseRoomExtension(packet)
+		if isRoomTraffic && receivedOp == op && receivedRoom == room {
+			payload = packet.Payload
+			return true
+		}
+		return false
+	})
+	return payload
+}
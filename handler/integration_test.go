@@ -0,0 +1,1462 @@
+package handler
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+func TestConnectMessageFinish(t *testing.T) {
+	peer := newVirtualPeer(t)
+
+	messages := events.MessageReceived.Subscribe()
+	defer events.MessageReceived.Unsubscribe(messages)
+
+	peer.connect()
+
+	// The node announces the new neighbor in its LSA and describes its database
+	// The LSA may follow the DD if the node's LSA origination rate is exceeded
+	var lsaSeen, ddSeen bool
+	peer.expectUntil(func(packet *pkt.Packet) bool {
+		switch packet.GetMessageType() {
+		case pkt.MsgTypeLSA:
+			owner, neighbors := parseLSANeighbors(t, packet)
+			lsaSeen = lsaSeen || owner == node.addrPort.Addr() && slices.Contains(neighbors, peer.addr)
+		case pkt.MsgTypeDD:
+			ddSeen = true
+		}
+		return lsaSeen && ddSeen
+	})
+
+	peer.floodLSA(1, node.addrPort.Addr())
+
+	peer.sendMessage(node.addrPort.Addr(), "Hello, ", "world!")
+
+	select {
+	case msg := <-messages:
+		if msg.From != peer.addr || msg.Text != "Hello, world!" {
+			t.Errorf("Received message %q from %v, want %q from %v", msg.Text, msg.From, "Hello, world!", peer.addr)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Message was not received")
+	}
+}
+
+func TestLSAFloodAndForwarding(t *testing.T) {
+	peerB := newVirtualPeer(t)
+	peerC := newVirtualPeer(t)
+	nodeAddr := node.addrPort.Addr()
+
+	peerB.connect()
+	peerB.expect(pkt.MsgTypeDD)
+	peerB.floodLSA(1, nodeAddr)
+
+	peerC.connect()
+	peerC.expect(pkt.MsgTypeDD)
+	peerC.floodLSA(1, nodeAddr)
+
+	// B learns about C through the node's flooded LSAs, the node's own LSA may be delayed by its origination rate limit
+	var nodeLSASeen, peerCLSASeen bool
+	waitForLSA(t, peerB, func(owner netip.Addr, neighbors []netip.Addr) bool {
+		nodeLSASeen = nodeLSASeen || owner == nodeAddr && slices.Contains(neighbors, peerC.addr)
+		peerCLSASeen = peerCLSASeen || owner == peerC.addr
+		return nodeLSASeen && peerCLSASeen
+	})
+
+	// A message from B to C is forwarded by the node
+	peerB.sendMessage(peerC.addr, "via node")
+
+	// The FIN isn't queued behind the message like data packets, so it may arrive first
+	var forwarded, fin *pkt.Packet
+	peerC.expectUntil(func(packet *pkt.Packet) bool {
+		switch packet.GetMessageType() {
+		case pkt.MsgTypeChatMessage:
+			forwarded = packet
+		case pkt.MsgTypeFinish:
+			fin = packet
+		}
+		return forwarded != nil && fin != nil
+	})
+	if netip.AddrFrom4(forwarded.Header.SourceAddr) != peerB.addr || string(forwarded.Payload) != "via node" {
+		t.Errorf("Unexpected forwarded packet %v", forwarded)
+	}
+	if forwarded.Header.TTL >= common.INITIAL_TTL {
+		t.Errorf("TTL of the forwarded packet wasn't decremented: %d", forwarded.Header.TTL)
+	}
+
+	// The forwarded message and FIN are accounted for B as ingress and C as next hop
+	stats := node.connections.ForwardingStats()
+	ingress, _ := peerB.socket.GetBoundAddress()
+	nextHop, _ := peerC.socket.GetBoundAddress()
+	want := connection.TrafficCounter{Packets: 2, Bytes: uint64(forwarded.Size() + fin.Size())}
+	if flow := stats.Flows[connection.ForwardingFlow{Ingress: ingress, Dest: peerC.addr}]; flow != want {
+		t.Errorf("Forwarded from B to C: %+v, want %+v", flow, want)
+	}
+	if stats.Ingress[ingress] != want || stats.NextHops[nextHop] != want {
+		t.Errorf("Forwarded per neighbor: received from B %+v, forwarded to C %+v, want %+v", stats.Ingress[ingress], stats.NextHops[nextHop], want)
+	}
+}
+
+// TestExpiringTTLIsNotForwarded verifies that a packet with TTL 1 is dropped instead of being forwarded with TTL 0.
+func TestExpiringTTLIsNotForwarded(t *testing.T) {
+	peerB := newVirtualPeer(t)
+	peerC := newVirtualPeer(t)
+	nodeAddr := node.addrPort.Addr()
+
+	peerB.connect()
+	peerB.expect(pkt.MsgTypeDD)
+	peerB.floodLSA(1, nodeAddr)
+
+	peerC.connect()
+	peerC.expect(pkt.MsgTypeDD)
+	peerC.floodLSA(1, nodeAddr)
+
+	waitForLSA(t, peerB, func(owner netip.Addr, neighbors []netip.Addr) bool {
+		return owner == nodeAddr && slices.Contains(neighbors, peerC.addr)
+	})
+
+	for _, ttl := range []byte{1, 2} {
+		packet := peerB.build(pkt.MsgTypeChatMessage, pkt.Payload("ttl"), peerC.addr)
+		packet.Header.TTL = ttl
+		pkt.SetChecksum(packet)
+		peerB.send(packet)
+
+		forwarded, received := peerC.expectWithin(pkt.MsgTypeChatMessage, connectRetransmitInterval*4)
+		if ttl == 1 && received {
+			t.Errorf("Packet with TTL 1 was forwarded with TTL %d", forwarded.Header.TTL)
+		}
+		if ttl == 2 && (!received || forwarded.Header.TTL != 1) {
+			t.Errorf("Packet with TTL 2 wasn't forwarded with TTL 1 (received %v)", received)
+		}
+	}
+}
+
+func TestHopByHopRetransmission(t *testing.T) {
+	node.connections.SetHopByHopARQ(true)
+	defer node.connections.SetHopByHopARQ(false)
+
+	peerB := newVirtualPeer(t)
+	peerC := newVirtualPeer(t)
+	peerC.hopARQ = true
+	nodeAddr := node.addrPort.Addr()
+	connectThroughNode(t, peerB, peerC)
+
+	// B marks the packet for hop-by-hop ARQ, the node acknowledges it to B
+	msg := peerB.build(pkt.MsgTypeChatMessage, pkt.Payload("lossy"), peerC.addr)
+	msg.AddExtension(pkt.ExtTypeHopSeq, binary.BigEndian.AppendUint32(nil, 7))
+	pkt.SetChecksum(msg)
+	peerB.send(msg)
+
+	peerB.expectUntil(func(packet *pkt.Packet) bool {
+		seq, isHopAck := packet.GetHopSequenceNumber(pkt.ExtTypeHopAck)
+		return isHopAck && seq == 7
+	})
+
+	// C announced hop-by-hop ARQ, so the node retransmits the packet until C acknowledges the hop
+	forwarded := peerC.expect(pkt.MsgTypeChatMessage)
+	seq, marked := forwarded.GetHopSequenceNumber(pkt.ExtTypeHopSeq)
+	if !marked || seq == 7 {
+		t.Fatalf("Forwarded packet isn't marked for the link to C: %v", forwarded.Extensions)
+	}
+
+	retransmitted, received := peerC.expectWithin(pkt.MsgTypeChatMessage, common.HOP_ARQ_TIMEOUT*3)
+	if !received {
+		t.Fatalf("Node didn't retransmit the forwarded packet without hop ACK")
+	}
+	if retransmittedSeq, _ := retransmitted.GetHopSequenceNumber(pkt.ExtTypeHopSeq); retransmitted.Header.PktNum != msg.Header.PktNum || retransmittedSeq != seq {
+		t.Fatalf("Unexpected retransmission %v", retransmitted)
+	}
+
+	hopAck := peerC.build(pkt.MsgTypeAcknowledgment, nil, nodeAddr)
+	hopAck.AddExtension(pkt.ExtTypeHopAck, binary.BigEndian.AppendUint32(nil, seq))
+	pkt.SetChecksum(hopAck)
+	peerC.send(hopAck)
+
+	if _, received := peerC.expectWithin(pkt.MsgTypeChatMessage, common.HOP_ARQ_TIMEOUT*3); received {
+		t.Errorf("Node retransmitted the forwarded packet after the hop ACK")
+	}
+}
+
+func TestForwardedCopyIsSuppressed(t *testing.T) {
+	peerB := newVirtualPeer(t)
+	peerC := newVirtualPeer(t)
+	connectThroughNode(t, peerB, peerC)
+
+	msg := peerB.build(pkt.MsgTypeChatMessage, pkt.Payload("once"), peerC.addr)
+	peerB.send(msg)
+	peerC.expect(pkt.MsgTypeChatMessage) // Acknowledged by expect
+	peerB.expectAck(msg)
+
+	// The node remembers the ACK of C, a retransmission of B is answered by the node instead of reaching C again
+	peerB.send(msg)
+	peerB.expectAck(msg)
+	if _, received := peerC.expectWithin(pkt.MsgTypeChatMessage, connectRetransmitInterval*4); received {
+		t.Errorf("Retransmission of a delivered packet was forwarded")
+	}
+}
+
+func TestPathRecordingAndTrace(t *testing.T) {
+	peerB := newVirtualPeer(t)
+	peerC := newVirtualPeer(t)
+	nodeAddr := node.addrPort.Addr()
+	connectThroughNode(t, peerB, peerC)
+
+	// The node appends its address to the path recorded by B
+	msg := peerB.build(pkt.MsgTypeChatMessage, pkt.Payload("recorded"), peerC.addr)
+	msg.SetRecordedPath([][4]byte{peerB.addr.As4()})
+	pkt.SetChecksum(msg)
+	peerB.send(msg)
+
+	forwarded := peerC.expect(pkt.MsgTypeChatMessage)
+	path, recorded := forwarded.GetRecordedPath()
+	if !recorded || len(path) != 2 || path[0] != peerB.addr.As4() || path[1] != nodeAddr.As4() {
+		t.Fatalf("Expected path [%v %v], got %v", peerB.addr, nodeAddr, path)
+	}
+
+	// A trace of the node records the path to C, C replies with it
+	traced := make(chan connection.TracedPath, 1)
+	go func() {
+		result, err := node.connections.TracePath(peerC.addr)
+		if err != nil {
+			t.Errorf("Trace failed: %v", err)
+		}
+		traced <- result
+	}()
+
+	trace := peerC.expect(pkt.MsgTypeMTUProbe)
+	tracePath, recorded := trace.GetRecordedPath()
+	if !recorded || len(tracePath) != 1 || tracePath[0] != nodeAddr.As4() {
+		t.Fatalf("Expected trace path [%v], got %v", nodeAddr, tracePath)
+	}
+
+	reply := peerC.build(pkt.MsgTypeMTUProbe, append(pkt.Payload{0x03}, tracePath[0][:]...), nodeAddr)
+	reply.Header.PktNum = trace.Header.PktNum
+	reply.SetRecordedPath([][4]byte{peerC.addr.As4()})
+	pkt.SetChecksum(reply)
+	peerC.send(reply)
+
+	result := <-traced
+	if !slices.Equal(result.Forward, []netip.Addr{nodeAddr}) || !slices.Equal(result.Return, []netip.Addr{peerC.addr}) {
+		t.Errorf("Unexpected traced path %+v", result)
+	}
+}
+
+// connectThroughNode connects both peers to the node and waits until B can reach C through the node.
+func connectThroughNode(t *testing.T, peerB *virtualPeer, peerC *virtualPeer) {
+	t.Helper()
+
+	nodeAddr := node.addrPort.Addr()
+
+	peerB.connect()
+	peerB.expect(pkt.MsgTypeDD)
+	peerB.floodLSA(1, nodeAddr)
+
+	peerC.connect()
+	peerC.expect(pkt.MsgTypeDD)
+	peerC.floodLSA(1, nodeAddr)
+
+	waitForLSA(t, peerB, func(owner netip.Addr, neighbors []netip.Addr) bool {
+		return owner == peerC.addr
+	})
+}
+
+func TestConnectAfterLoss(t *testing.T) {
+	peer := newVirtualPeer(t)
+
+	network.SetLoss(1)
+	defer network.SetLoss(0)
+	connect := peer.build(pkt.MsgTypeConnect, make(pkt.Payload, 8), node.addrPort.Addr())
+	peer.send(connect)
+	if _, received := peer.expectWithin(pkt.MsgTypeAcknowledgment, connectRetransmitInterval*4); received {
+		t.Fatalf("CONNECT was acknowledged despite 100%% loss")
+	}
+	if isNeighbor, _ := node.router.IsNeighbor(peer.addr); isNeighbor {
+		t.Fatalf("Peer became a neighbor despite 100%% loss")
+	}
+
+	network.SetLoss(0)
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+
+	if isNeighbor, _ := node.router.IsNeighbor(peer.addr); !isNeighbor {
+		t.Errorf("Peer is no neighbor after the CONNECT was acknowledged")
+	}
+}
+
+func TestForeignTeamIsDropped(t *testing.T) {
+	peer := newVirtualPeer(t)
+
+	foreignTeam := (node.connections.TeamID() + 1) & 0b1111
+	connect := peer.build(pkt.MsgTypeConnect, make(pkt.Payload, 8), node.addrPort.Addr())
+	connect.Header.Control = pkt.MakeControlByte(pkt.MsgTypeConnect, foreignTeam)
+	pkt.SetChecksum(connect)
+
+	dropsBefore := node.connections.TeamDrops()[foreignTeam]
+	peer.send(connect)
+	if _, received := peer.expectWithin(pkt.MsgTypeAcknowledgment, connectRetransmitInterval*4); received {
+		t.Fatalf("CONNECT of another team was acknowledged")
+	}
+	if drops := node.connections.TeamDrops()[foreignTeam]; drops != dropsBefore+1 {
+		t.Errorf("Expected %d dropped packets of team %d, got %d", dropsBefore+1, foreignTeam, drops)
+	}
+
+	node.connections.SetPromiscuous(true)
+	defer node.connections.SetPromiscuous(false)
+	peer.send(connect)
+	peer.expectAck(connect)
+	peer.connected = true
+}
+
+const msgTypeGameState = 0xE
+
+var registerGameState sync.Once
+var gameStateReceived = make(chan Context, 2)
+
+func TestRegisteredType(t *testing.T) {
+	registerGameState.Do(func() {
+		RegisterType(msgTypeGameState, func(packet *pkt.Packet, ctx Context) {
+			if string(packet.Payload) == "turn 1" {
+				gameStateReceived <- ctx
+			}
+		})
+	})
+
+	peer := newVirtualPeer(t)
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, node.addrPort.Addr())
+
+	state := peer.build(msgTypeGameState, pkt.Payload("turn 1"), node.addrPort.Addr())
+	peer.send(state)
+	peer.expectAck(state)
+	peer.send(state) // Duplicates are acknowledged but not handled again
+	peer.expectAck(state)
+
+	select {
+	case ctx := <-gameStateReceived:
+		if ctx.Source != peer.addr {
+			t.Errorf("Handler was called with source %v, want %v", ctx.Source, peer.addr)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Handler of the registered type wasn't called")
+	}
+
+	select {
+	case <-gameStateReceived:
+		t.Errorf("Handler was called for a duplicate")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPresenceIsRateLimited(t *testing.T) {
+	updates := events.PresenceChanged.Subscribe()
+	defer events.PresenceChanged.Unsubscribe(updates)
+
+	peer := newVirtualPeer(t)
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, node.addrPort.Addr())
+
+	away := peer.build(pkt.MsgTypePresence, pkt.Payload{connection.PresenceAway}, node.addrPort.Addr())
+	peer.send(away)
+	peer.send(away) // Within the rate limit
+
+	select {
+	case update := <-updates:
+		if update.From != peer.addr || update.Status != "away" {
+			t.Errorf("Unexpected presence update %+v", update)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Presence update wasn't published")
+	}
+
+	select {
+	case update := <-updates:
+		t.Errorf("Rate limited presence update was published: %+v", update)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, received := peer.expectWithin(pkt.MsgTypeAcknowledgment, 100*time.Millisecond); received {
+		t.Errorf("Presence update was acknowledged")
+	}
+}
+
+func TestStubLSA(t *testing.T) {
+	peerB := newVirtualPeer(t)
+	peerC := newVirtualPeer(t)
+	nodeAddr := node.addrPort.Addr()
+
+	peerB.connect()
+	peerB.expect(pkt.MsgTypeDD)
+	peerC.connect()
+	peerC.expect(pkt.MsgTypeDD)
+	peerC.floodLSA(1, nodeAddr)
+
+	// B goes into standby, the node keeps the flag when re-flooding B's LSA
+	peerB.floodLSA(1, nodeAddr, routing.StubMarker)
+	waitForLSA(t, peerC, func(owner netip.Addr, neighbors []netip.Addr) bool {
+		return owner == peerB.addr && slices.Contains(neighbors, routing.StubMarker)
+	})
+
+	lsa, exists := node.router.GetLSA(peerB.addr)
+	if !exists || !lsa.Stub || !slices.Equal(lsa.Neighbors, []netip.Addr{nodeAddr}) {
+		t.Fatalf("Unexpected LSA of stub host %v: %+v", peerB.addr, lsa)
+	}
+	if _, found := node.router.GetNextHop(peerB.addr); !found {
+		t.Errorf("Stub host %v isn't routable", peerB.addr)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	peer := newVirtualPeer(t)
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, node.addrPort.Addr())
+
+	oldAddr, _ := peer.socket.GetBoundAddress()
+	host := lastPeerHost.Add(1)
+	newAddr, err := peer.socket.Rebind(net.IPv4(10, 0, byte(host>>8), byte(host)))
+	if err != nil {
+		t.Fatalf("Failed to rebind virtual peer socket: %v", err)
+	}
+
+	payload := binary.BigEndian.AppendUint64(nil, peer.bootEpoch)
+	oldAddrBytes := oldAddr.Addr().As4()
+	payload = append(payload, oldAddrBytes[:]...)
+	payload = binary.BigEndian.AppendUint16(payload, oldAddr.Port())
+
+	// The ACK is only received if the node sends it to the new address
+	rebind := peer.build(pkt.MsgTypeRebind, payload, node.addrPort.Addr())
+	peer.send(rebind)
+	peer.expectAck(rebind)
+
+	isNeighbor, nextHop := node.router.IsNeighbor(peer.addr)
+	if !isNeighbor || nextHop != newAddr.AddrPort() {
+		t.Fatalf("Peer %v is reached at %v, want %v", peer.addr, nextHop, newAddr.AddrPort())
+	}
+	if nextHop, _ := node.router.GetNextHop(peer.addr); nextHop != newAddr.AddrPort() {
+		t.Errorf("Route to %v uses next hop %v, want %v", peer.addr, nextHop, newAddr.AddrPort())
+	}
+}
+
+func TestNeighborPortChange(t *testing.T) {
+	peer := newVirtualPeer(t)
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, node.addrPort.Addr())
+
+	// Rebinding to the same IP address moves the socket to another port, like a neighbor reopening its socket
+	newAddr, err := peer.socket.Rebind(peer.addr.AsSlice())
+	if err != nil {
+		t.Fatalf("Failed to rebind virtual peer socket: %v", err)
+	}
+
+	// The ACK is only received if the node sends it to the new port
+	connect := peer.buildConnect()
+	peer.send(connect)
+	peer.expectAck(connect)
+
+	if isNeighbor, nextHop := node.router.IsNeighbor(peer.addr); !isNeighbor || nextHop != newAddr.AddrPort() {
+		t.Fatalf("Peer %v is reached at %v, want %v", peer.addr, nextHop, newAddr.AddrPort())
+	}
+	if nextHop, _ := node.router.GetNextHop(peer.addr); nextHop != newAddr.AddrPort() {
+		t.Errorf("Route to %v uses next hop %v, want %v", peer.addr, nextHop, newAddr.AddrPort())
+	}
+}
+
+// waitForLSA waits until the node floods an LSA to the peer that matches.
+func waitForLSA(t *testing.T, peer *virtualPeer, matches func(owner netip.Addr, neighbors []netip.Addr) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(expectTimeout)
+	for time.Now().Before(deadline) {
+		owner, neighbors := parseLSANeighbors(t, peer.expect(pkt.MsgTypeLSA))
+		if matches(owner, neighbors) {
+			return
+		}
+	}
+	t.Fatalf("Node didn't flood the expected LSA to %v", peer.addr)
+}
+
+func TestNodeConnects(t *testing.T) {
+	peer := newVirtualPeer(t)
+	peerAddrPort, _ := peer.socket.GetBoundAddress()
+
+	connected, err := node.connections.ConnectTo(peer.addr, peerAddrPort, node.connections.BuildConnectPayload())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	peer.expect(pkt.MsgTypeConnect) // Acknowledged by expect
+	peer.connected = true
+
+	select {
+	case success := <-connected:
+		if !success {
+			t.Fatalf("Connection to %v failed", peer.addr)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Connection to %v wasn't established", peer.addr)
+	}
+}
+
+// TestIntroducedPeersConnect verifies that two neighbors of the node connect to each other at the addresses the node observed
+// for them, after one of them asked the node for an introduction.
+func TestIntroducedPeersConnect(t *testing.T) {
+	peerA := newPeerNode(t)
+	peerB := newPeerNode(t)
+	connectNodes(t, peerA, node)
+	connectNodes(t, peerB, node)
+
+	if _, err := peerA.connections.SendIntroductionRequest(node.addrPort.Addr(), peerB.addrPort.Addr()); err != nil {
+		t.Fatalf("Failed to send the introduction request: %v", err)
+	}
+
+	deadline := time.Now().Add(expectTimeout)
+	for time.Now().Before(deadline) {
+		isNeighborA, atA := peerB.router.IsNeighbor(peerA.addrPort.Addr())
+		isNeighborB, atB := peerA.router.IsNeighbor(peerB.addrPort.Addr())
+		if isNeighborA && isNeighborB {
+			if atA != peerA.addrPort || atB != peerB.addrPort {
+				t.Errorf("Introduced peers are reached at %v and %v, want %v and %v", atA, atB, peerA.addrPort, peerB.addrPort)
+			}
+			return
+		}
+		time.Sleep(connectRetransmitInterval)
+	}
+	t.Fatalf("Introduced peers %v and %v didn't connect", peerA.addrPort.Addr(), peerB.addrPort.Addr())
+}
+
+// TestRelayedNeighborsExchangeMessage verifies that two neighbors of the node connect through it (con --via)
+// and that a MSG sent to the relayed neighbor is encapsulated for the node and acknowledged by the neighbor.
+func TestRelayedNeighborsExchangeMessage(t *testing.T) {
+	peerA := newPeerNode(t)
+	peerB := newPeerNode(t)
+	connectNodes(t, peerA, node)
+	connectNodes(t, peerB, node)
+	addrB := peerB.addrPort.Addr()
+
+	peerA.connections.AddRelay(addrB, node.addrPort.Addr())
+	connected, err := peerA.connections.ConnectTo(addrB, connection.RelayedAddrPort(addrB), peerA.connections.BuildConnectPayload())
+	if err != nil {
+		t.Fatalf("Failed to connect via %v: %v", node.addrPort.Addr(), err)
+	}
+	select {
+	case success := <-connected:
+		if !success {
+			t.Fatalf("Connection to %v via %v failed", addrB, node.addrPort.Addr())
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Connection to %v via %v wasn't established", addrB, node.addrPort.Addr())
+	}
+
+	if isNeighbor, addrPort := peerB.router.IsNeighbor(peerA.addrPort.Addr()); !isNeighbor || !connection.IsRelayedAddrPort(addrPort) {
+		t.Fatalf("%v is reached at %v (neighbor %v), want a relayed neighbor", peerA.addrPort.Addr(), addrPort, isNeighbor)
+	}
+
+	// The direct link is shorter than the route through the node, so the MSG is sent to the relayed address
+	deadline := time.Now().Add(expectTimeout)
+	for nextHop, _ := peerA.router.GetNextHop(addrB); nextHop != connection.RelayedAddrPort(addrB); nextHop, _ = peerA.router.GetNextHop(addrB) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Route to %v uses next hop %v, want %v", addrB, nextHop, connection.RelayedAddrPort(addrB))
+		}
+		time.Sleep(connectRetransmitInterval)
+	}
+
+	acked, err := peerA.connections.SendReliableRoutedPacket(context.Background(), peerA.connections.BuildSequencedPacket(pkt.MsgTypeChatMessage, pkt.Payload("hello"), addrB))
+	if err != nil {
+		t.Fatalf("Failed to send MSG to %v: %v", addrB, err)
+	}
+	select {
+	case success := <-acked:
+		if !success {
+			t.Errorf("MSG to %v wasn't acknowledged", addrB)
+		}
+	case <-time.After(expectTimeout):
+		t.Errorf("MSG to %v wasn't acknowledged", addrB)
+	}
+}
+
+func TestNeighborStateTransitions(t *testing.T) {
+	peer := newVirtualPeer(t)
+	peerAddrPort, _ := peer.socket.GetBoundAddress()
+	nodeAddr := node.addrPort.Addr()
+
+	connected, err := node.connections.ConnectTo(peer.addr, peerAddrPort, node.connections.BuildConnectPayload())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if state := node.connections.GetPeerState(peer.addr); state != connection.PeerConnecting {
+		t.Fatalf("Expected state Connecting after sending the CONNECT, got %v", state)
+	}
+	if _, err := node.connections.ConnectTo(peer.addr, peerAddrPort, node.connections.BuildConnectPayload()); err == nil {
+		t.Errorf("Second CONNECT to a connecting peer was accepted")
+	}
+
+	peer.expect(pkt.MsgTypeConnect) // Acknowledged by expect
+	peer.connected = true
+	if success := <-connected; !success {
+		t.Fatalf("Connection to %v failed", peer.addr)
+	}
+	peer.expect(pkt.MsgTypeDD)
+	if state := node.connections.GetPeerState(peer.addr); state != connection.PeerEstablishedWaitingDD {
+		t.Fatalf("Expected state EstablishedWaitingDD before the peer's DD, got %v", state)
+	}
+
+	dd := peer.build(pkt.MsgTypeDD, nil, nodeAddr)
+	peer.send(dd)
+	peer.expectAck(dd)
+	if state := node.connections.GetPeerState(peer.addr); state != connection.PeerFull {
+		t.Fatalf("Expected state Full after the peer's DD, got %v", state)
+	}
+
+	peer.close()
+	peer.connected = false
+
+	// The node removes the neighbor after acknowledging the DISCONNECT
+	deadline := time.Now().Add(expectTimeout)
+	for node.connections.GetPeerState(peer.addr) != connection.PeerDown && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if state := node.connections.GetPeerState(peer.addr); state != connection.PeerDown {
+		t.Errorf("Expected state Down after the DISCONNECT, got %v", state)
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	peer := newVirtualPeer(t)
+	peerAddrPort, _ := peer.socket.GetBoundAddress()
+
+	connected, err := node.connections.ConnectTo(peer.addr, peerAddrPort, node.connections.BuildConnectPayload())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if connect := peer.receive(); connect.GetMessageType() != pkt.MsgTypeConnect {
+		t.Fatalf("Expected a CONNECT, got message type %d", connect.GetMessageType())
+	}
+
+	// The peer's LSDB is overloaded, it refuses the CONNECT instead of acknowledging it
+	refusal := peer.build(pkt.MsgTypeAbort, pkt.Payload{pkt.MsgTypeConnect, connection.AbortReasonOverloaded}, node.addrPort.Addr())
+	refusal.Header.PktNum = [4]byte{}
+	pkt.SetChecksum(refusal)
+	peer.send(refusal)
+
+	select {
+	case success := <-connected:
+		if success {
+			t.Fatalf("Refused connection to %v was established", peer.addr)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Refused CONNECT to %v wasn't given up", peer.addr)
+	}
+	if state := node.connections.GetPeerState(peer.addr); state != connection.PeerDown {
+		t.Errorf("Expected state Down after the refusal, got %v", state)
+	}
+}
+
+func TestReset(t *testing.T) {
+	messages := events.MessageReceived.Subscribe()
+	defer events.MessageReceived.Unsubscribe(messages)
+
+	peer := newVirtualPeer(t)
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, node.addrPort.Addr())
+
+	peer.sendMessage(node.addrPort.Addr(), "before")
+	select {
+	case <-messages:
+	case <-time.After(expectTimeout):
+		t.Fatalf("Message before the RESET was not received")
+	}
+
+	// The peer lost its outgoing packet numbers, it restarts them with a RESET
+	peer.nextPktNum = 0
+	reset := peer.build(pkt.MsgTypeAbort, binary.BigEndian.AppendUint32(pkt.Payload{pkt.MsgTypeAbort}, 42), node.addrPort.Addr())
+	peer.send(reset)
+	peer.expectAck(reset)
+	peer.send(reset) // Retransmission, acknowledged again without clearing the packet numbers
+	peer.expectAck(reset)
+
+	peer.sendMessage(node.addrPort.Addr(), "after")
+	select {
+	case msg := <-messages:
+		if msg.Text != "after" {
+			t.Errorf("Received message %q after the RESET, want %q", msg.Text, "after")
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Message after the RESET was dropped")
+	}
+
+	// The node restarts its own packet numbers to the peer
+	acked, err := node.connections.ResetPeer(peer.addr)
+	if err != nil {
+		t.Fatalf("Failed to reset: %v", err)
+	}
+	nodeReset := peer.expect(pkt.MsgTypeAbort)
+	if _, err := connection.ParseResetPayload(nodeReset.Payload); err != nil {
+		t.Errorf("Node sent an invalid RESET: %v", err)
+	}
+	if pktNum := binary.BigEndian.Uint32(nodeReset.Header.PktNum[:]); pktNum != 0 {
+		t.Errorf("RESET has packet number %d, want 0", pktNum)
+	}
+	select {
+	case success := <-acked:
+		if !success {
+			t.Errorf("Acknowledged RESET reported as failed")
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Acknowledged RESET wasn't reported")
+	}
+}
+
+func TestCrossedConnectAsMaster(t *testing.T) {
+	peer := newVirtualPeer(t) // Higher address than the node, so the node's CONNECT establishes the connection
+	peerAddrPort, _ := peer.socket.GetBoundAddress()
+
+	connected, err := node.connections.ConnectTo(peer.addr, peerAddrPort, node.connections.BuildConnectPayload())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	nodeConnect := peer.receive()
+
+	peerConnect := peer.buildConnect()
+	peer.send(peerConnect)
+	peer.expectAck(peerConnect)
+	peer.connected = true
+
+	if state := node.connections.GetPeerState(peer.addr); state != connection.PeerConnecting {
+		t.Fatalf("Master established the connection with the crossed CONNECT, state %v", state)
+	}
+
+	peer.acknowledge(nodeConnect)
+	if success := <-connected; !success {
+		t.Fatalf("Connection to %v failed", peer.addr)
+	}
+	peer.expect(pkt.MsgTypeDD)
+	if _, received := peer.expectWithin(pkt.MsgTypeDD, connectRetransmitInterval*4); received {
+		t.Errorf("Master sent a second DD")
+	}
+	if state := node.connections.GetPeerState(peer.addr); state != connection.PeerEstablishedWaitingDD {
+		t.Errorf("Expected state EstablishedWaitingDD, got %v", state)
+	}
+}
+
+func TestCrossedConnectAsSlave(t *testing.T) {
+	// The node ID is lower than the node's address, so the peer's CONNECT establishes the connection
+	peer := newVirtualPeerWithNodeID(t)
+	for !peer.addr.Less(node.addrPort.Addr()) {
+		_, peer.signingKey, _ = ed25519.GenerateKey(nil)
+		peer.addr = connection.NodeIDFromKey(peer.signingKey.Public().(ed25519.PublicKey))
+	}
+	peerAddrPort, _ := peer.socket.GetBoundAddress()
+
+	connected, err := node.connections.ConnectTo(peer.addr, peerAddrPort, node.connections.BuildConnectPayload())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	nodeConnect := peer.receive()
+
+	peerConnect := peer.buildConnect()
+	peer.send(peerConnect)
+	peer.expectAck(peerConnect)
+	peer.connected = true
+	peer.expect(pkt.MsgTypeDD)
+
+	if state := node.connections.GetPeerState(peer.addr); state != connection.PeerEstablishedWaitingDD {
+		t.Fatalf("Slave didn't establish the connection with the master's CONNECT, state %v", state)
+	}
+
+	// The ACK of the node's own CONNECT doesn't establish the connection again
+	peer.acknowledge(nodeConnect)
+	if success := <-connected; !success {
+		t.Fatalf("Connection to %v failed", peer.addr)
+	}
+	if _, received := peer.expectWithin(pkt.MsgTypeDD, connectRetransmitInterval*4); received {
+		t.Errorf("Slave sent a second DD")
+	}
+	if isNeighbor, nextHop := node.router.IsNeighbor(peer.addr); !isNeighbor || nextHop != peerAddrPort {
+		t.Errorf("Peer %v is reached at %v (neighbor %v), want %v", peer.addr, nextHop, isNeighbor, peerAddrPort)
+	}
+}
+
+func TestDDRequest(t *testing.T) {
+	peer := newVirtualPeer(t)
+	nodeAddr := node.addrPort.Addr()
+
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(3, nodeAddr)
+
+	// The node acknowledges the LSA before storing it
+	deadline := time.Now().Add(expectTimeout)
+	for _, exists := node.router.GetLSA(peer.addr); !exists && time.Now().Before(deadline); _, exists = node.router.GetLSA(peer.addr) {
+		time.Sleep(time.Millisecond)
+	}
+	if lsa, _ := node.router.GetLSA(peer.addr); lsa.ReceivedFrom != peer.addr || lsa.Updated.IsZero() {
+		t.Errorf("LSA of the peer was received from %v at %v, want %v", lsa.ReceivedFrom, lsa.Updated, peer.addr)
+	}
+
+	// The node answers a DD request with its DD including sequence numbers
+	request := peer.build(pkt.MsgTypeDD, nil, nodeAddr)
+	request.AddExtension(pkt.ExtTypeDDRequest, nil)
+	pkt.SetChecksum(request)
+	peer.send(request)
+
+	var reply *pkt.Packet
+	peer.expectUntil(func(packet *pkt.Packet) bool {
+		if packet.GetMessageType() == pkt.MsgTypeDD && len(packet.GetExtensions(pkt.ExtTypeDDSeqNums)) > 0 {
+			reply = packet
+		}
+		return reply != nil
+	})
+	entries, err := parseDatabaseDescriptionEntries(reply.Payload)
+	if err != nil {
+		t.Fatalf("Failed to parse DD reply: %v", err)
+	}
+	if !slices.Contains(entries, connection.DDEntry{Addr: peer.addr, SeqNum: 3}) {
+		t.Errorf("DD reply %v doesn't list the LSA of the peer with seqnum 3", entries)
+	}
+
+	// The node requests the DD of the peer
+	requested := make(chan []connection.DDEntry, 1)
+	go func() {
+		entries, err := node.connections.RequestDD(peer.addr)
+		if err != nil {
+			t.Errorf("DD request failed: %v", err)
+		}
+		requested <- entries
+	}()
+
+	peer.expectUntil(func(packet *pkt.Packet) bool {
+		return packet.GetMessageType() == pkt.MsgTypeDD && len(packet.GetExtensions(pkt.ExtTypeDDRequest)) > 0
+	})
+	peerDD := peer.build(pkt.MsgTypeDD, append(peer.addr.AsSlice(), 0, 0, 0, 3), nodeAddr)
+	peerDD.AddExtension(pkt.ExtTypeDDSeqNums, nil)
+	pkt.SetChecksum(peerDD)
+	peer.send(peerDD)
+
+	if got := <-requested; !slices.Equal(got, []connection.DDEntry{{Addr: peer.addr, SeqNum: 3}}) {
+		t.Errorf("Requested DD %v, want the LSA of the peer with seqnum 3", got)
+	}
+}
+
+func TestNodeIDConnect(t *testing.T) {
+	messages := events.MessageReceived.Subscribe()
+	defer events.MessageReceived.Unsubscribe(messages)
+
+	peer := newVirtualPeerWithNodeID(t)
+	boundAddr, _ := peer.socket.GetBoundAddress()
+
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, node.addrPort.Addr())
+
+	if isNeighbor, nextHop := node.router.IsNeighbor(peer.addr); !isNeighbor || nextHop != boundAddr {
+		t.Fatalf("Node ID %v is reached at %v, want %v", peer.addr, nextHop, boundAddr)
+	}
+
+	peer.sendMessage(node.addrPort.Addr(), "Hello from ", peer.addr.String())
+
+	select {
+	case msg := <-messages:
+		if msg.From != peer.addr {
+			t.Errorf("Received message from %v, want %v", msg.From, peer.addr)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Message was not received")
+	}
+}
+
+func TestNodeConnectsToNodeID(t *testing.T) {
+	peer := newVirtualPeerWithNodeID(t)
+	boundAddr, _ := peer.socket.GetBoundAddress()
+
+	connected, err := node.connections.ConnectTo(peer.addr, boundAddr, node.connections.BuildConnectPayload())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	connect := peer.expect(pkt.MsgTypeConnect) // Acknowledged by expect
+	peer.connected = true
+	if netip.AddrFrom4(connect.Header.DestAddr) != peer.addr {
+		t.Errorf("CONNECT is addressed to %v, want the node ID %v", netip.AddrFrom4(connect.Header.DestAddr), peer.addr)
+	}
+
+	select {
+	case success := <-connected:
+		if !success {
+			t.Fatalf("Connection to %v failed", peer.addr)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Connection to %v wasn't established", peer.addr)
+	}
+}
+
+// TestNodeIDHijackIsRejected verifies that a CONNECT claiming the address of a neighbor as node ID doesn't take over the neighbor,
+// neither unsigned nor signed with a key the address isn't derived from.
+func TestNodeIDHijackIsRejected(t *testing.T) {
+	victim := newVirtualPeer(t)
+	victim.connect()
+	victim.expect(pkt.MsgTypeDD)
+	victim.floodLSA(1, node.addrPort.Addr())
+	victimAddrPort, _ := victim.socket.GetBoundAddress()
+
+	attacker := newVirtualPeer(t)
+	attacker.addr = victim.addr
+	attacker.bootEpoch = victim.bootEpoch + 1 // Looks like a restart of the victim
+
+	for _, signed := range []bool{false, true} {
+		attacker.signingKey = nil
+		if signed {
+			_, attacker.signingKey, _ = ed25519.GenerateKey(nil)
+		}
+
+		connect := attacker.buildConnect()
+		attacker.send(connect)
+		if ack, received := attacker.expectWithin(pkt.MsgTypeAcknowledgment, connectRetransmitInterval*4); received && ack.Header.PktNum == connect.Header.PktNum {
+			t.Errorf("CONNECT claiming the node ID %v (signed: %v) was acknowledged", victim.addr, signed)
+		}
+
+		if isNeighbor, nextHop := node.router.IsNeighbor(victim.addr); !isNeighbor || nextHop != victimAddrPort {
+			t.Fatalf("Neighbor %v is reached at %v (neighbor %v) after the hijack attempt (signed: %v), want %v", victim.addr, nextHop, isNeighbor, signed, victimAddrPort)
+		}
+	}
+}
+
+// TestNodeIDRoaming verifies that a neighbor identified by a node ID moves to another socket with a CONNECT signed with its key.
+func TestNodeIDRoaming(t *testing.T) {
+	peer := newVirtualPeerWithNodeID(t)
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, node.addrPort.Addr())
+
+	host := lastPeerHost.Add(1)
+	newAddr, err := peer.socket.Rebind(net.IPv4(10, 0, byte(host>>8), byte(host)))
+	if err != nil {
+		t.Fatalf("Failed to rebind virtual peer socket: %v", err)
+	}
+
+	// The ACK is only received if the node sends it to the new address
+	connect := peer.buildConnect()
+	peer.send(connect)
+	peer.expectAck(connect)
+
+	if isNeighbor, nextHop := node.router.IsNeighbor(peer.addr); !isNeighbor || nextHop != newAddr.AddrPort() {
+		t.Errorf("Node ID %v is reached at %v (neighbor %v), want %v", peer.addr, nextHop, isNeighbor, newAddr.AddrPort())
+	}
+}
+
+// TestSelfAssertedExternalAddressIsRejected verifies that a CONNECT whose source address differs from the sender isn't accepted
+// just because it advertises the sender as its external (NAT) address, without an introduction or authentication.
+func TestSelfAssertedExternalAddressIsRejected(t *testing.T) {
+	peer := newVirtualPeer(t)
+	boundAddr, _ := peer.socket.GetBoundAddress()
+	host := lastPeerHost.Add(1)
+	peer.addr = netip.AddrFrom4([4]byte{10, 0, byte(host >> 8), byte(host)})
+
+	external := boundAddr.Addr().As4()
+	payload := binary.BigEndian.AppendUint64(nil, peer.bootEpoch)
+	payload = append(payload, external[:]...)
+	payload = binary.BigEndian.AppendUint16(payload, boundAddr.Port())
+	connect := peer.build(pkt.MsgTypeConnect, payload, node.addrPort.Addr())
+
+	peer.send(connect)
+	if ack, received := peer.expectWithin(pkt.MsgTypeAcknowledgment, connectRetransmitInterval*4); received && ack.Header.PktNum == connect.Header.PktNum {
+		t.Errorf("CONNECT of %v with the self-asserted external address %v was acknowledged", peer.addr, boundAddr)
+	}
+	if isNeighbor, _ := node.router.IsNeighbor(peer.addr); isNeighbor {
+		t.Errorf("%v became a neighbor with a self-asserted external address", peer.addr)
+	}
+}
+
+// TestPinnedKeyIsKept verifies that a CONNECT announcing another key for a neighbor with a pinned key is rejected,
+// also from the neighbor's IP address, and that the key is only replaced after the operator forgot it.
+func TestPinnedKeyIsKept(t *testing.T) {
+	_, ownerKey, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	owner := newVirtualPeer(t)
+	owner.signingKey = ownerKey
+	owner.connect()
+	owner.expect(pkt.MsgTypeDD)
+	ownerAddrPort, _ := owner.socket.GetBoundAddress()
+
+	// Another host at the owner's IP address, looks like a restart of the owner with a new key
+	socket := network.NewSocket()
+	if _, err := socket.Open(net.IP(owner.addr.AsSlice())); err != nil {
+		t.Fatalf("Failed to open socket of the claimant: %v", err)
+	}
+	claimant := &virtualPeer{t: t, socket: socket, addr: owner.addr, packets: socket.Subscribe(), bootEpoch: owner.bootEpoch + 1, signingKey: otherKey}
+	t.Cleanup(claimant.close)
+
+	connect := claimant.buildConnect()
+	claimant.send(connect)
+	if ack, received := claimant.expectWithin(pkt.MsgTypeAcknowledgment, connectRetransmitInterval*4); received && ack.Header.PktNum == connect.Header.PktNum {
+		t.Errorf("CONNECT announcing another key for %v was acknowledged", owner.addr)
+	}
+	if key, known := node.connections.GetPeerKey(owner.addr); !known || !key.Equal(ownerKey.Public()) {
+		t.Errorf("Node replaced the pinned key of %v with %v (known %v)", owner.addr, key, known)
+	}
+	if isNeighbor, nextHop := node.router.IsNeighbor(owner.addr); !isNeighbor || nextHop != ownerAddrPort {
+		t.Fatalf("Neighbor %v is reached at %v (neighbor %v) after the claim, want %v", owner.addr, nextHop, isNeighbor, ownerAddrPort)
+	}
+
+	// The operator resets the key, e.g. after the owner lost its key file
+	if !node.connections.ForgetPeerKey(owner.addr) {
+		t.Fatalf("No key was pinned for %v", owner.addr)
+	}
+	owner.signingKey = otherKey
+	owner.bootEpoch += 2
+	owner.connect()
+	if key, known := node.connections.GetPeerKey(owner.addr); !known || !key.Equal(otherKey.Public()) {
+		t.Errorf("Node recorded key %v (known %v) after the reset, want the new key", key, known)
+	}
+}
+
+// TestAbusiveNeighborIsBlockedByNodeID verifies that an abusive neighbor with a node ID is blocked by its node ID instead of the IP address it sends from.
+func TestAbusiveNeighborIsBlockedByNodeID(t *testing.T) {
+	peer := newVirtualPeerWithNodeID(t)
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, node.addrPort.Addr())
+	sender, _ := peer.socket.GetBoundAddress()
+	t.Cleanup(func() { _ = node.handler.accessList.Unblock(peer.addr) })
+
+	node.handler.blockAbusiveSender(sender)
+	peer.expect(pkt.MsgTypeDisconnect) // The node disconnects the blocked neighbor
+	peer.connected = false
+
+	if node.handler.accessList.IsAllowed(peer.addr) {
+		t.Errorf("Node ID %v of the abusive neighbor isn't blocked", peer.addr)
+	}
+	if !node.handler.accessList.IsAllowed(sender.Addr()) {
+		t.Errorf("IP address %v of the abusive neighbor is blocked instead of its node ID", sender.Addr())
+	}
+}
+
+// BenchmarkProcessPacketForward measures the packets per second a node forwards between two of its neighbors.
+// Packets are processed synchronously, so the socket and the handler goroutines don't distort the measurement.
+func BenchmarkProcessPacketForward(b *testing.B) {
+	from := newVirtualPeer(b)
+	to := newVirtualPeer(b)
+	from.connect()
+	to.connect()
+	to.floodLSA(1, node.addrPort.Addr())
+
+	packet := from.build(pkt.MsgTypeChatMessage, make(pkt.Payload, common.MAX_PAYLOAD_SIZE_BYTES), to.addr)
+	udpPacket := &sock.Packet{
+		Addr: net.UDPAddrFromAddrPort(from.socket.MustGetLocalAddress()),
+		Data: packet.ToByteArray(),
+	}
+
+	b.SetBytes(int64(len(udpPacket.Data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		node.handler.processPacket(udpPacket)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+}
+
+func TestCongestionMarkIsEchoed(t *testing.T) {
+	peer := newVirtualPeer(t)
+	nodeAddr := node.addrPort.Addr()
+
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, nodeAddr)
+
+	chunk := peer.build(pkt.MsgTypeChatMessage, pkt.Payload("congested"), nodeAddr)
+	chunk.AddExtension(pkt.ExtTypeCE, nil)
+	pkt.SetChecksum(chunk)
+	peer.send(chunk)
+
+	var ack *pkt.Packet
+	for ack == nil || ack.Header.PktNum != chunk.Header.PktNum {
+		ack = peer.expect(pkt.MsgTypeAcknowledgment)
+	}
+	if echoes := ack.GetCongestionEchoes(); !slices.Equal(echoes, [][4]byte{chunk.Header.PktNum}) {
+		t.Errorf("ACK echoes congestion marks %v, want %v", echoes, chunk.Header.PktNum)
+	}
+
+	fin := peer.build(pkt.MsgTypeFinish, pkt.Payload(chunk.Header.PktNum[:]), nodeAddr)
+	peer.send(fin)
+	ack = peer.expect(pkt.MsgTypeAcknowledgment)
+	if echoes := ack.GetCongestionEchoes(); len(echoes) != 0 {
+		t.Errorf("ACK of the FIN echoes congestion marks %v, want none", echoes)
+	}
+}
+
+// TestClockSkewIsCorrected verifies that the CONNECT handshake and the following ACK exchange estimate the clock offset of a peer whose clock is an hour ahead,
+// so the send time of its message is converted to the node's clock.
+func TestClockSkewIsCorrected(t *testing.T) {
+	peer := newVirtualPeer(t)
+	peer.clockSkew = time.Hour
+	nodeAddr := node.addrPort.Addr()
+
+	messages := events.MessageReceived.Subscribe()
+	defer events.MessageReceived.Unsubscribe(messages)
+
+	ack := peer.connect()
+	origin, received, sent, found := ack.GetTimeEcho()
+	if !found {
+		t.Fatalf("ACK of the CONNECT doesn't echo its timestamp")
+	}
+	if diff := time.Duration(origin-received) - time.Hour; diff < -time.Second || diff > time.Second {
+		t.Errorf("Echoed send time is %v ahead of the receive time, want about %v", time.Duration(origin-received), time.Hour)
+	}
+	if sent < received {
+		t.Errorf("Echo was sent at %d before its request was received at %d", sent, received)
+	}
+	request, found := ack.GetTimestamp()
+	if !found {
+		t.Fatalf("ACK of the CONNECT doesn't request a time sync echo")
+	}
+
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, nodeAddr)
+
+	chunk := peer.build(pkt.MsgTypeChatMessage, pkt.Payload("from the future"), nodeAddr)
+	now := uint64(peer.now().UnixNano())
+	echo := binary.BigEndian.AppendUint64(nil, uint64(request))
+	echo = binary.BigEndian.AppendUint64(echo, now)
+	echo = binary.BigEndian.AppendUint64(echo, now)
+	chunk.AddExtension(pkt.ExtTypeTimeEcho, echo)
+	pkt.SetChecksum(chunk)
+	peer.send(chunk)
+	peer.expectAck(chunk)
+
+	offset, found := node.connections.GetClockOffset(peer.addr)
+	if !found {
+		t.Fatalf("Node has no clock offset estimate of the peer")
+	}
+	if diff := offset.Offset - time.Hour; diff < -time.Second || diff > time.Second {
+		t.Errorf("Estimated clock offset %v, want about %v", offset.Offset, time.Hour)
+	}
+
+	sentAt := peer.now()
+	payload := append(pkt.Payload(chunk.Header.PktNum[:]), binary.BigEndian.AppendUint64(nil, uint64(sentAt.UnixNano()))...)
+	fin := peer.build(pkt.MsgTypeFinish, payload, nodeAddr)
+	peer.send(fin)
+	peer.expectAck(fin)
+
+	select {
+	case msg := <-messages:
+		if !msg.ClockCorrected {
+			t.Fatalf("Send time of the message isn't corrected for the clock offset")
+		}
+		if diff := msg.SentAt.Sub(sentAt.Add(-time.Hour)); diff < -time.Second || diff > time.Second {
+			t.Errorf("Message was sent at %v in the node's clock, want about %v", msg.SentAt, sentAt.Add(-time.Hour))
+		}
+		if msg.Delay < 0 || msg.Delay > time.Second {
+			t.Errorf("One-way delay is %v, want a small positive delay", msg.Delay)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Message was not received")
+	}
+}
+
+// TestStrictModeDropsViolations verifies that a packet violating the wire format is recorded and only processed if strict mode is disabled.
+func TestStrictModeDropsViolations(t *testing.T) {
+	peer := newVirtualPeer(t)
+	nodeAddr := node.addrPort.Addr()
+
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, nodeAddr)
+
+	before := ttlViolations()
+
+	chunk := peer.build(pkt.MsgTypeChatMessage, pkt.Payload("too far"), nodeAddr)
+	chunk.Header.TTL = common.INITIAL_TTL + 1
+	pkt.SetChecksum(chunk)
+
+	node.connections.SetStrict(true)
+	defer node.connections.SetStrict(false)
+	peer.send(chunk)
+	if ack, received := peer.expectWithin(pkt.MsgTypeAcknowledgment, connectRetransmitInterval*4); received && ack.Header.PktNum == chunk.Header.PktNum {
+		t.Errorf("Node acknowledged a packet that violates the TTL bounds in strict mode")
+	}
+
+	node.connections.SetStrict(false)
+	peer.send(chunk)
+	peer.expectAck(chunk)
+
+	if violations := ttlViolations() - before; violations != 2 {
+		t.Errorf("Node recorded %d TTL violations, want 2", violations)
+	}
+}
+
+// ttlViolations returns the number of TTL violations the node recorded.
+func ttlViolations() uint64 {
+	for _, report := range node.connections.Violations() {
+		if report.Kind == connection.ViolationTTL {
+			return report.Count
+		}
+	}
+	return 0
+}
+
+// TestCapabilityAnnouncement verifies that capabilities are exchanged on the CONNECT and its ACK and that legacy neighbors have none.
+func TestCapabilityAnnouncement(t *testing.T) {
+	defer node.connections.SetCapabilities(node.connections.LocalCapabilities().Flags)
+	node.connections.SetCapabilities(connection.CapabilitySACK | connection.CapabilityCRC32C)
+
+	peer := newVirtualPeer(t)
+	connect := peer.buildConnect()
+	connect.AddExtension(pkt.ExtTypeCapabilities, []byte{2, 0x00, byte(connection.CapabilitySACK), 0x02, 0x58}) // Version 2, max payload 600
+	pkt.SetChecksum(connect)
+	peer.send(connect)
+	peer.expectAck(connect)
+	peer.connected = true
+
+	announced, ok := node.connections.GetPeerCapabilities(peer.addr)
+	if !ok || announced.Version != 2 || announced.MaxPayloadSize != 600 {
+		t.Fatalf("Node recorded capabilities %+v (announced %v), want version 2 with max payload 600", announced, ok)
+	}
+	if !node.connections.PeerSupports(peer.addr, connection.CapabilitySACK) {
+		t.Errorf("SACK announced by both sides isn't supported")
+	}
+	if node.connections.PeerSupports(peer.addr, connection.CapabilityCRC32C) {
+		t.Errorf("CRC32C announced by the node only is supported")
+	}
+	if limit := node.connections.GetMaxPayloadSize(peer.addr); limit != 600-pkt.EXTENSION_RESERVE_BYTES {
+		t.Errorf("Max payload size to the peer is %d, want %d", limit, 600-pkt.EXTENSION_RESERVE_BYTES)
+	}
+
+	legacy := newVirtualPeer(t)
+	ack := legacy.connect()
+	if local, ok := connection.ParseCapabilities(ack); !ok || local.Version != connection.PROTOCOL_VERSION || !local.Has(connection.CapabilitySACK|connection.CapabilityCRC32C) {
+		t.Errorf("ACK of the CONNECT announces %+v (announced %v), want the node's capabilities", local, ok)
+	}
+	if _, ok := node.connections.GetPeerCapabilities(legacy.addr); ok {
+		t.Errorf("Legacy neighbor without announcement has capabilities")
+	}
+	if limit := node.connections.GetMaxPayloadSize(legacy.addr); limit != common.MAX_PAYLOAD_SIZE_BYTES {
+		t.Errorf("Max payload size to the legacy neighbor is %d, want %d", limit, common.MAX_PAYLOAD_SIZE_BYTES)
+	}
+}
+
+// TestRoomFanOut verifies that the node hosting a room answers joins and fans out posts and membership changes to the members.
+func TestRoomFanOut(t *testing.T) {
+	nodeAddr := node.addrPort.Addr()
+	if err := node.connections.CreateRoom("lobby"); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	defer node.connections.CloseRoom("lobby")
+
+	roomMessages := events.RoomMessage.Subscribe()
+	defer events.RoomMessage.Unsubscribe(roomMessages)
+
+	peerA := newVirtualPeer(t)
+	peerB := newVirtualPeer(t)
+	for _, peer := range []*virtualPeer{peerA, peerB} {
+		peer.connect()
+		peer.expect(pkt.MsgTypeDD)
+		peer.floodLSA(1, nodeAddr)
+	}
+
+	peerA.sendRoomPacket(connection.RoomJoin, "lobby", nil)
+	if members := peerA.expectRoomPacket(connection.RoomMembers, "lobby"); !slices.Equal(members, pkt.Payload(nodeAddr.AsSlice())) {
+		t.Errorf("First member received members %v, want the host only", members)
+	}
+
+	peerB.sendRoomPacket(connection.RoomJoin, "lobby", nil)
+	if members := peerB.expectRoomPacket(connection.RoomMembers, "lobby"); !slices.Equal(members, append(nodeAddr.AsSlice(), peerA.addr.AsSlice()...)) {
+		t.Errorf("Second member received members %v, want the host and the first member", members)
+	}
+	if joined := peerA.expectRoomPacket(connection.RoomMemberJoined, "lobby"); !slices.Equal(joined, pkt.Payload(peerB.addr.AsSlice())) {
+		t.Errorf("First member was told that %v joined, want %v", joined, peerB.addr)
+	}
+
+	peerB.sendRoomPacket(connection.RoomPost, "lobby", pkt.Payload("hi"))
+	if message := peerA.expectRoomPacket(connection.RoomMessage, "lobby"); !slices.Equal(message, append(peerB.addr.AsSlice(), "hi"...)) {
+		t.Errorf("First member received room message %v, want the post of the second member", message)
+	}
+	select {
+	case msg := <-roomMessages:
+		if msg.Room != "lobby" || msg.From != peerB.addr || msg.Text != "hi" {
+			t.Errorf("Host published room message %+v, want %q from %v in lobby", msg, "hi", peerB.addr)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Host didn't publish the room message")
+	}
+
+	peerA.sendRoomPacket(connection.RoomLeave, "lobby", nil)
+	if left := peerB.expectRoomPacket(connection.RoomMemberLeft, "lobby"); !slices.Equal(left, pkt.Payload(peerA.addr.AsSlice())) {
+		t.Errorf("Second member was told that %v left, want %v", left, peerA.addr)
+	}
+
+	rooms := node.connections.Rooms()
+	if len(rooms) != 1 || !slices.Equal(rooms[0].Members, []netip.Addr{peerB.addr}) {
+		t.Errorf("Host has rooms %+v, want lobby with the second member", rooms)
+	}
+}
+
+// TestUnreliableMessage verifies that unreliable messages are delivered without ACK and sent with packet number zero.
+func TestUnreliableMessage(t *testing.T) {
+	nodeAddr := node.addrPort.Addr()
+
+	messages := events.MessageReceived.Subscribe()
+	defer events.MessageReceived.Unsubscribe(messages)
+
+	peer := newVirtualPeer(t)
+	peer.connect()
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, nodeAddr)
+
+	packet := peer.build(pkt.MsgTypeChatMessage, pkt.Payload("typing..."), nodeAddr)
+	packet.Header.PktNum = [4]byte{}
+	packet.AddExtension(pkt.ExtTypeUnreliable, binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+	pkt.SetChecksum(packet)
+	peer.send(packet)
+
+	select {
+	case msg := <-messages:
+		if msg.From != peer.addr || msg.Text != "typing..." || !msg.Unreliable {
+			t.Errorf("Node published message %+v, want unreliable %q from %v", msg, "typing...", peer.addr)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Node didn't publish the unreliable message")
+	}
+	if ack, acknowledged := peer.expectWithin(pkt.MsgTypeAcknowledgment, 200*time.Millisecond); acknowledged {
+		t.Errorf("Node acknowledged the unreliable message with %v", ack)
+	}
+
+	if _, err := node.connections.SendUnreliableMessage(peer.addr, "hello", time.Now()); err != nil {
+		t.Fatalf("Failed to send unreliable message: %v", err)
+	}
+	sent := peer.expect(pkt.MsgTypeChatMessage)
+	if _, unreliable := connection.ParseUnreliableExtension(sent); !unreliable || sent.Header.PktNum != [4]byte{} || string(sent.Payload) != "hello" {
+		t.Errorf("Node sent %v, want an unreliable message with packet number zero", sent)
+	}
+
+	tooLarge := strings.Repeat("x", node.connections.GetMaxPayloadSize(peer.addr)+1)
+	if _, err := node.connections.SendUnreliableMessage(peer.addr, tooLarge, time.Now()); !errors.Is(err, connection.ErrUnreliableMessageTooLarge) {
+		t.Errorf("Sending a message larger than a packet returned %v, want ErrUnreliableMessageTooLarge", err)
+	}
+}
+
+// TestSinglePacketMessage verifies that a message carrying its FIN is delivered once without a separate FIN.
+func TestSinglePacketMessage(t *testing.T) {
+	nodeAddr := node.addrPort.Addr()
+
+	messages := events.MessageReceived.Subscribe()
+	defer events.MessageReceived.Unsubscribe(messages)
+
+	peer := newVirtualPeer(t)
+	if local, _ := connection.ParseCapabilities(peer.connect()); !local.Has(connection.CapabilitySinglePacket) {
+		t.Errorf("Node announces %v, want single-packet messages", local.Flags)
+	}
+	peer.expect(pkt.MsgTypeDD)
+	peer.floodLSA(1, nodeAddr)
+
+	received := node.connections.SessionSummary().Messages.Received
+
+	packet := peer.build(pkt.MsgTypeChatMessage, pkt.Payload("one-liner"), nodeAddr)
+	value := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	packet.AddExtension(pkt.ExtTypeFinish, binary.BigEndian.AppendUint64(value, peer.bootEpoch))
+	pkt.SetChecksum(packet)
+	peer.send(packet)
+	peer.expectAck(packet)
+
+	select {
+	case msg := <-messages:
+		if msg.From != peer.addr || msg.Text != "one-liner" || msg.SentAt.IsZero() {
+			t.Errorf("Node published message %+v, want %q from %v with send time", msg, "one-liner", peer.addr)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatalf("Node didn't publish the single-packet message")
+	}
+
+	// A retransmission whose ACK got lost is acknowledged again but not delivered twice
+	peer.send(packet)
+	peer.expectAck(packet)
+	select {
+	case msg := <-messages:
+		t.Errorf("Node published the retransmitted message again: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if summary := node.connections.SessionSummary(); summary.Messages.Received != received+1 {
+		t.Errorf("Session summary counts %d received messages, want %d", summary.Messages.Received, received+1)
+	}
+}
+
+// TestSignedLSA verifies that the node signs its LSAs and only accepts LSAs of a peer with a known key if they are signed with it.
+func TestSignedLSA(t *testing.T) {
+	nodeAddr := node.addrPort.Addr()
+
+	_, peerKey, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	peer := newVirtualPeer(t)
+	peer.signingKey = peerKey
+	ack := peer.connect()
+	if announced := ack.GetExtensions(pkt.ExtTypePublicKey); len(announced) != 1 || !node.connections.PublicKey().Equal(ed25519.PublicKey(announced[0].Value)) {
+		t.Errorf("ACK of the CONNECT announces %v, want the node's public key", announced)
+	}
+	if key, known := node.connections.GetPeerKey(peer.addr); !known || !key.Equal(peerKey.Public()) {
+		t.Errorf("Node recorded key %v (known %v) of the peer, want the announced key", key, known)
+	}
+
+	// The node's own LSA is signed with its key
+	peer.expectUntil(func(packet *pkt.Packet) bool {
+		if packet.GetMessageType() != pkt.MsgTypeLSA {
+			return false
+		}
+		_, lsaPayload, _ := connection.SplitBootEpoch(packet.Payload)
+		body, signature := connection.SplitLSASignature(lsaPayload)
+		if netip.AddrFrom4([4]byte(body[:4])) != nodeAddr {
+			return false
+		}
+		if signature == nil || !node.connections.PublicKey().Equal(ed25519.PublicKey(signature[:ed25519.PublicKeySize])) || !ed25519.Verify(node.connections.PublicKey(), body, signature[ed25519.PublicKeySize:]) {
+			t.Errorf("Node flooded its LSA with invalid signature %v", signature)
+		}
+		return true
+	})
+
+	peer.floodLSA(1, nodeAddr)
+	if lsa, exists := node.router.GetLSA(peer.addr); !exists || lsa.SeqNum != 1 || lsa.Signature == nil {
+		t.Fatalf("Signed LSA of the peer wasn't stored with its signature: %+v", lsa)
+	}
+
+	peer.signingKey = nil
+	peer.floodLSA(2, nodeAddr)
+	peer.signingKey = otherKey
+	peer.floodLSA(3, nodeAddr)
+	if lsa, _ := node.router.GetLSA(peer.addr); lsa.SeqNum != 1 {
+		t.Errorf("Node stored LSA with seqnum %d, the unsigned and the foreign-signed LSA should have been rejected", lsa.SeqNum)
+	}
+
+	// Another peer can't poison the routes by flooding an LSA in the node's name
+	forger := newVirtualPeer(t)
+	forger.connect()
+	forger.expect(pkt.MsgTypeDD)
+	localLSA, _ := node.router.GetLSA(nodeAddr)
+	body := append(nodeAddr.AsSlice(), binary.BigEndian.AppendUint32(nil, localLSA.SeqNum+100)...)
+	payload := binary.BigEndian.AppendUint64(nil, forger.bootEpoch)
+	payload = append(payload, body...)
+	payload = append(payload, 255, 255, 255, 255)
+	payload = append(payload, otherKey.Public().(ed25519.PublicKey)...)
+	payload = append(payload, ed25519.Sign(otherKey, body)...)
+	forged := forger.build(pkt.MsgTypeLSA, payload, nodeAddr)
+	forger.send(forged)
+	forger.expectAck(forged)
+	if lsa, _ := node.router.GetLSA(nodeAddr); lsa.SeqNum >= localLSA.SeqNum+100 {
+		t.Errorf("Node accepted a forged LSA in its name")
+	}
+}
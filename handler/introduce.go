@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"fmt"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/access"
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sock"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// handleIntroduce processes introduction requests (we are the introducer) and introductions (we should connect to a peer).
+func handleIntroduce(packet *pkt.Packet, srcAddrPort netip.AddrPort, socket sock.Socket, inSequencing *sequencing.IncomingPktNumHandler, accessList *access.AccessList, connections *connection.Manager) {
+	logger.Tracef("INTRO RECEIVED %v %d", packet.Header.SourceAddr, packet.Header.PktNum)
+
+	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
+
+	if destAddr != socket.MustGetLocalAddress().Addr() {
+		// The packet is for another peer
+
+		connections.ForwardRouted(packet, srcAddrPort)
+		return
+	}
+
+	// The packet is for us
+
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+
+	duplicate, dupErr := inSequencing.IsDuplicatePacket(packet)
+	if dupErr != nil {
+		logger.Warnf(dupErr.Error())
+		return
+	} else if duplicate {
+		_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+		return
+	}
+
+	requestedPeer, introduction, err := connection.ParseIntroducePayload(packet.Payload)
+	if err != nil {
+		logger.Warnf("Malformed INTRODUCE packet from %v: %v", srcAddr, err)
+		return
+	}
+
+	_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+
+	if introduction == nil {
+		err = connections.IntroducePeers(srcAddr, requestedPeer)
+		if err != nil {
+			logger.Warnf("Failed to introduce %v to %v: %v", srcAddr, requestedPeer, err)
+			return
+		}
+		fmt.Printf("Introduced %s and %s to each other\n", srcAddr, requestedPeer)
+		return
+	}
+
+	if !accessList.IsAllowed(introduction.Peer) {
+		logger.Infof("Ignoring introduction to denied peer %v from %v", introduction.Peer, srcAddr)
+		return
+	}
+
+	fmt.Printf("%s introduced %s at %s, connecting...\n", srcAddr, introduction.Peer, introduction.PeerExternal)
+
+	connections.RecordIntroduction(srcAddr, srcAddrPort, introduction) // The peer's CONNECT is sent from its external address
+
+	_, err = connections.PunchTo(introduction)
+	if err != nil {
+		logger.Infof("Not connecting to introduced peer %v: %v", introduction.Peer, err)
+	}
+}
@@ -13,24 +13,38 @@ import (
 	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
-func handleLSA(packet *pkt.Packet, router *routing.Router, inSequencing *sequencing.IncomingPktNumHandler, srcAddrPort netip.AddrPort, socket sock.Socket) {
+func handleLSA(packet *pkt.Packet, router *routing.Router, inSequencing *sequencing.IncomingPktNumHandler, srcAddrPort netip.AddrPort, socket sock.Socket, connections *connection.Manager) {
+	epoch, lsaPayload, err := connection.SplitBootEpoch(packet.Payload)
+	if err != nil {
+		logger.Warnf("Malformed LSA packet from %v: %v", srcAddrPort, err)
+		return
+	}
+
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+	if !connections.IsValidSender(srcAddr, srcAddrPort) {
+		logger.Warnf("Malformed LSA packet: source address %v does not match sender %v", srcAddr, srcAddrPort)
+		return
+	}
+
+	switch inSequencing.CheckBootEpoch(srcAddr, epoch) {
+	case sequencing.EpochStale:
+		logger.Warnf("Dropping replayed LSA packet from %v with old boot epoch %d", srcAddr, epoch)
+		return
+	case sequencing.EpochRestart:
+		connections.ResetRestartedPeer(srcAddr)
+	}
+
 	duplicate, dupErr := inSequencing.IsDuplicatePacket(packet)
 	if dupErr != nil {
 		logger.Warnf(dupErr.Error())
 		return
 	} else if duplicate {
-		_ = connection.SendAcknowledgmentTo(srcAddrPort, packet.Header.PktNum)
+		_ = connections.SendAcknowledgmentTo(netip.AddrFrom4(packet.Header.SourceAddr), srcAddrPort, packet.Header.PktNum)
 		return
 	}
 
 	logger.Tracef("LSA RECEIVED %v %d", packet.Header.SourceAddr, packet.Header.PktNum)
 
-	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
-	if srcAddr != srcAddrPort.Addr() {
-		logger.Warnf("Malformed LSA packet: source address %v does not match sender %v", srcAddr, srcAddrPort)
-		return
-	}
-
 	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
 	localAddr := socket.MustGetLocalAddress().Addr()
 	if destAddr != localAddr {
@@ -38,7 +52,8 @@ func handleLSA(packet *pkt.Packet, router *routing.Router, inSequencing *sequenc
 		return
 	}
 
-	lsaOwnerAddr, seqNum, neighborAddresses, err := parseLSAPayload(packet.Payload)
+	lsaBody, signature := connection.SplitLSASignature(lsaPayload)
+	lsaOwnerAddr, seqNum, neighborAddresses, stub, err := parseLSAPayload(lsaBody)
 	if err != nil {
 		logger.Warnf("Failed to parse LSA payload: %v", err)
 		return
@@ -46,9 +61,9 @@ func handleLSA(packet *pkt.Packet, router *routing.Router, inSequencing *sequenc
 
 	// Valid packet
 
-	_ = connection.SendAcknowledgmentTo(srcAddrPort, packet.Header.PktNum)
+	_ = connections.SendAcknowledgmentTo(netip.AddrFrom4(packet.Header.SourceAddr), srcAddrPort, packet.Header.PktNum)
 
-	logger.Debugf("LSA of %v with seqnum %d, neighbors: %v", lsaOwnerAddr, seqNum, neighborAddresses)
+	logger.Debugf("LSA of %v with seqnum %d, neighbors: %v, stub: %v", lsaOwnerAddr, seqNum, neighborAddresses, stub)
 
 	existingLSA, exists := router.GetLSA(lsaOwnerAddr)
 	if exists && existingLSA.SeqNum >= seqNum {
@@ -56,26 +71,32 @@ func handleLSA(packet *pkt.Packet, router *routing.Router, inSequencing *sequenc
 		return
 	}
 
-	notRoutableHosts := router.UpdateLSA(lsaOwnerAddr, seqNum, neighborAddresses)
-	connection.ClearUnreachableHosts(notRoutableHosts)
+	if err := connections.VerifyLSA(lsaOwnerAddr, lsaBody, signature); err != nil {
+		logger.Warnf("Rejecting LSA of %v with seqnum %d from %v: %v", lsaOwnerAddr, seqNum, srcAddr, err)
+		return
+	}
+
+	notRoutableHosts := router.UpdateSignedLSA(lsaOwnerAddr, seqNum, neighborAddresses, stub, srcAddr, signature)
+	connections.ClearUnreachableHosts(notRoutableHosts)
 
 	updatedLSA, exists := router.GetLSA(lsaOwnerAddr)
-	if !exists {
-		logger.Warnf("LSA for %v not found after adding it to the LSDB", lsaOwnerAddr)
-		return
+	if !exists || updatedLSA.SeqNum < seqNum {
+		return // Rejected by the routing policy or because the LSDB is full
 	}
 
-	connection.FloodLSA(lsaOwnerAddr, updatedLSA, srcAddr)
+	connections.FloodLSA(lsaOwnerAddr, updatedLSA, srcAddr)
 }
 
-func parseLSAPayload(payload pkt.Payload) (srcAddr netip.Addr, seqNum uint32, neighborAddresses []netip.Addr, err error) {
-	if 8+len(payload)%4 != 8 {
-		return netip.Addr{}, 0, nil, errors.New("invalid payload length for LSA packet")
+// parseLSAPayload parses the LSA owner, sequence number and neighbors.
+// A trailing routing.StubMarker isn't a neighbor, it marks the owner as stub.
+func parseLSAPayload(payload pkt.Payload) (srcAddr netip.Addr, seqNum uint32, neighborAddresses []netip.Addr, stub bool, err error) {
+	if len(payload) < 8 || len(payload)%4 != 0 {
+		return netip.Addr{}, 0, nil, false, errors.New("invalid payload length for LSA packet")
 	}
 
 	srcAddr, ok := netip.AddrFromSlice(payload[:4])
 	if !ok || !srcAddr.Is4() {
-		return netip.Addr{}, 0, nil, errors.New("invalid source address in LSA packet")
+		return netip.Addr{}, 0, nil, false, errors.New("invalid source address in LSA packet")
 	}
 
 	seqNum = binary.BigEndian.Uint32(payload[4:8])
@@ -87,11 +108,16 @@ func parseLSAPayload(payload pkt.Payload) (srcAddr netip.Addr, seqNum uint32, ne
 
 		addr, ok := netip.AddrFromSlice(addrBytes)
 		if !ok || !addr.Is4() {
-			return netip.Addr{}, 0, nil, errors.New("invalid neighbor IPv4 address in LSA packet")
+			return netip.Addr{}, 0, nil, false, errors.New("invalid neighbor IPv4 address in LSA packet")
 		}
 
 		neighborAddresses = append(neighborAddresses, addr)
 	}
 
+	if len(neighborAddresses) > 0 && neighborAddresses[len(neighborAddresses)-1] == routing.StubMarker {
+		neighborAddresses = neighborAddresses[:len(neighborAddresses)-1]
+		stub = true
+	}
+
 	return
 }
@@ -1,9 +1,13 @@
 package handler
 
 import (
+	"encoding/binary"
 	"net/netip"
+	"time"
 
+	"bjoernblessin.de/chatprotogol/common"
 	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/events"
 	"bjoernblessin.de/chatprotogol/pkt"
 	"bjoernblessin.de/chatprotogol/sequencing"
 	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
@@ -11,32 +15,97 @@ import (
 	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
-func handleMsg(packet *pkt.Packet, socket sock.Socket, inSequencing *sequencing.IncomingPktNumHandler) {
-	logger.Tracef("MSG RECEIVED %v %d", packet.Header.SourceAddr, packet.Header.PktNum)
+func handleMsg(packet *pkt.Packet, srcAddrPort netip.AddrPort, socket sock.Socket, inSequencing *sequencing.IncomingPktNumHandler, reconstructors *reconstruction.Manager, connections *connection.Manager) {
+	logger.LimitedTracef("MSG RECEIVED", "MSG RECEIVED %v %d", packet.Header.SourceAddr, packet.Header.PktNum)
 
 	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
 
 	if destAddr != socket.MustGetLocalAddress().Addr() {
 		// The message is for another peer
 
-		connection.ForwardRouted(packet)
+		connections.ForwardRouted(packet, srcAddrPort)
 		return
 	}
 
 	// The message is for us
 
+	receivedAt := time.Now()
+
+	if sentAt, unreliable := connection.ParseUnreliableExtension(packet); unreliable {
+		handleUnreliableMsg(packet, sentAt, receivedAt, connections)
+		return
+	}
+
 	duplicate, dupErr := inSequencing.IsDuplicatePacket(packet)
 	if dupErr != nil {
 		logger.Warnf(dupErr.Error())
 		return
 	} else if duplicate {
-		_ = connection.SendRoutedAcknowledgment(netip.AddrFrom4(packet.Header.SourceAddr), packet.Header.PktNum)
+		_ = connections.SendRoutedAcknowledgment(netip.AddrFrom4(packet.Header.SourceAddr), packet.Header.PktNum)
+		return
+	}
+
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+
+	_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+
+	if op, room, isRoomTraffic := connection.ParseRoomExtension(packet); isRoomTraffic {
+		if err := connections.HandleRoomPacket(srcAddr, op, room, packet.Payload); err != nil {
+			logger.Warnf("Invalid room packet from %v for room %q: %v", srcAddr, room, err)
+		}
 		return
 	}
 
+	if reconstructors.IsRejected(srcAddr, pkt.MsgTypeChatMessage) {
+		logger.Tracef("Dropping message packet %v of rejected message from %v", packet.Header.PktNum, srcAddr)
+		return
+	}
+
+	sentAt, epoch, singlePacket := connection.ParseFinishExtension(packet)
+
+	msgReconstructor, err := reconstructors.GetOrCreateMsgReconstructor(srcAddr)
+	if err == nil {
+		err = msgReconstructor.HandleIncomingMsgPacket(packet)
+	}
+	if err != nil {
+		rejectTransfer(reconstructors, srcAddr, pkt.MsgTypeChatMessage, abortReasonFor(err), connections)
+		if singlePacket {
+			reconstructors.ClearRejections(srcAddr) // No FIN follows that would end the rejected transfer
+		}
+		return
+	}
+
+	if singlePacket {
+		// The packet is the whole message and its FIN
+		pktNum := binary.BigEndian.Uint32(packet.Header.PktNum[:])
+		finish := finishPayload{lastPktNum: pktNum, sentAt: sentAt, epoch: epoch, firstPktNum: pktNum, hasMessageID: true}
+		completeMessage(srcAddr, msgReconstructor, finish, receivedAt, reconstructors, connections)
+		return
+	}
+
+	if common.STREAM_MESSAGES {
+		streamMessage(srcAddr, msgReconstructor, inSequencing)
+	}
+}
+
+// streamMessage publishes the part of the message that is ready to be displayed.
+func streamMessage(srcAddr netip.Addr, msgReconstructor *reconstruction.InMemoryReconstructor, inSequencing *sequencing.IncomingPktNumHandler) {
+	err := msgReconstructor.ConsumeContiguous(inSequencing.GetHighestContiguousSeqNum(srcAddr), func(data []byte) {
+		events.MessageChunk.NotifyObservers(events.MessageChunkReceivedEvent{From: srcAddr, Text: string(data)})
+	})
+	if err != nil {
+		logger.Debugf("Failed to stream message of %v: %v", srcAddr, err)
+	}
+}
+
+// handleUnreliableMsg publishes an unreliable message, it is complete and neither acknowledged nor passed to the reconstructor.
+func handleUnreliableMsg(packet *pkt.Packet, sentAt time.Time, receivedAt time.Time, connections *connection.Manager) {
 	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
 
-	_ = connection.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+	event := events.MessageReceivedEvent{From: srcAddr, Text: string(packet.Payload), Unreliable: true}
+	event.SentAt, event.ClockCorrected = connections.ToLocalTime(srcAddr, sentAt)
+	event.Delay = receivedAt.Sub(event.SentAt)
 
-	reconstruction.GetOrCreateMsgReconstructor(srcAddr).HandleIncomingMsgPacket(packet)
+	connections.RecordTransfer(pkt.MsgTypeChatMessage, false)
+	events.MessageReceived.NotifyObservers(event)
 }
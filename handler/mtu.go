@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sock"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// handleMTUProbe processes path MTU probes and their replies.
+// Probes are unsequenced, so no duplicate detection or acknowledgment is done.
+func handleMTUProbe(packet *pkt.Packet, srcAddrPort netip.AddrPort, socket sock.Socket, connections *connection.Manager) {
+	logger.Tracef("PROBE RECEIVED %v %d", packet.Header.SourceAddr, packet.Header.PktNum)
+
+	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
+
+	if destAddr != socket.MustGetLocalAddress().Addr() {
+		// The probe is for another peer
+		connections.ForwardRouted(packet, srcAddrPort)
+		return
+	}
+
+	err := connections.HandleMTUProbe(packet)
+	if err != nil {
+		logger.Warnf("Failed to handle MTU probe from %v: %v", packet.Header.SourceAddr, err)
+	}
+}
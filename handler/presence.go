@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sock"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// handlePresence processes presence updates.
+// Presence updates are unsequenced, so no duplicate detection or acknowledgment is done.
+func handlePresence(packet *pkt.Packet, srcAddrPort netip.AddrPort, socket sock.Socket, connections *connection.Manager) {
+	logger.Tracef("PRESENCE RECEIVED %v", packet.Header.SourceAddr)
+
+	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
+	localAddr := socket.MustGetLocalAddress().Addr()
+
+	if destAddr != localAddr {
+		// The update is for another peer
+		connections.ForwardRouted(packet, srcAddrPort)
+		return
+	}
+
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+
+	status, target, err := connection.ParsePresencePayload(packet.Payload)
+	if err != nil {
+		logger.Warnf("Invalid PRESENCE from %v: %v", srcAddr, err)
+		return
+	}
+
+	if status == connection.PresenceTyping && target != localAddr {
+		return // Typing to someone else
+	}
+
+	if !connections.AcceptPresence(srcAddr) {
+		logger.Tracef("Dropping rate limited PRESENCE from %v", srcAddr)
+		return
+	}
+
+	events.PresenceChanged.NotifyObservers(events.PresenceChangedEvent{
+		From:   srcAddr,
+		Status: connection.PresenceStatusString(status),
+	})
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sock"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// handleRebind processes a REBIND of a direct neighbor that moved to a new address.
+// The neighbor is reached at the address the REBIND was sent from afterwards, see connection.Manager.Rebind.
+func handleRebind(packet *pkt.Packet, router *routing.Router, inSequencing *sequencing.IncomingPktNumHandler, srcAddrPort netip.AddrPort, socket sock.Socket, connections *connection.Manager) {
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+
+	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
+	localAddr := socket.MustGetLocalAddress().Addr()
+	if destAddr != localAddr {
+		logger.Warnf("Malformed REBIND packet: destination address %v does not match local address %v", destAddr, localAddr)
+		return
+	}
+
+	epoch, oldAddr, err := connection.ParseRebindPayload(packet.Payload)
+	if err != nil {
+		logger.Warnf("Malformed REBIND packet from %v: %v", srcAddrPort, err)
+		return
+	}
+
+	isNeighbor, nextHop := router.IsNeighbor(srcAddr)
+	if !isNeighbor {
+		logger.Warnf("Received REBIND from non-neighbor peer %v", srcAddr)
+		return
+	}
+
+	switch inSequencing.CheckBootEpoch(srcAddr, epoch) {
+	case sequencing.EpochStale:
+		logger.Warnf("Dropping replayed REBIND packet from %v with old boot epoch %d", srcAddr, epoch)
+		return
+	case sequencing.EpochRestart:
+		connections.ResetRestartedPeer(srcAddr)
+		logger.Warnf("Dropping REBIND packet from restarted peer %v, it must connect again", srcAddr)
+		return
+	}
+
+	// The next hop is the sender already if the REBIND is retransmitted because our ACK was lost
+	if nextHop != oldAddr && nextHop != srcAddrPort {
+		logger.Warnf("Dropping REBIND packet from %v: old address %v does not match the known address %v", srcAddr, oldAddr, nextHop)
+		return
+	}
+
+	duplicate, dupErr := inSequencing.IsDuplicatePacket(packet)
+	if dupErr != nil {
+		logger.Warnf(dupErr.Error())
+		return
+	} else if duplicate {
+		_ = connections.SendAcknowledgmentTo(netip.AddrFrom4(packet.Header.SourceAddr), srcAddrPort, packet.Header.PktNum)
+		return
+	}
+
+	if !connections.ApplyRebind(srcAddr, srcAddrPort) {
+		logger.Warnf("Neighbor %v disconnected while processing its REBIND", srcAddr)
+		return
+	}
+
+	_ = connections.SendAcknowledgmentTo(netip.AddrFrom4(packet.Header.SourceAddr), srcAddrPort, packet.Header.PktNum)
+
+	logger.Infof("Neighbor %v moved from %v to %v", srcAddr, nextHop, srcAddrPort)
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sock"
+	"bjoernblessin.de/chatprotogol/util/assert"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// Context describes a received packet of a registered message type.
+type Context struct {
+	Source netip.Addr     // Peer that sent the packet
+	Sender netip.AddrPort // Neighbor the packet was received from, differs from Source for routed packets
+
+	connections *connection.Manager
+}
+
+// Reply reliably sends a packet of the given message type with the payload back to the source.
+// The returned channel reports whether the packet was acknowledged, see connection.Manager.SendReliableRoutedPacket.
+func (c Context) Reply(ctx context.Context, msgType byte, payload pkt.Payload) (chan bool, error) {
+	packet := c.connections.BuildSequencedPacket(msgType, payload, c.Source)
+	return c.connections.SendReliableRoutedPacket(ctx, packet)
+}
+
+// customTypes holds the handlers of message types registered by embedders.
+var customTypes = struct {
+	mu       sync.RWMutex
+	handlers map[byte]func(*pkt.Packet, Context)
+}{
+	handlers: make(map[byte]func(*pkt.Packet, Context)),
+}
+
+// RegisterType registers a handler for a message type that is not built into the protocol.
+// Packets of the type are sent with connection.Manager.BuildSequencedPacket and SendReliableRoutedPacket like chat messages.
+// They are routed, deduplicated and acknowledged like chat messages, h is only called once per packet addressed to us.
+// h is called concurrently from the packet handler goroutines and must not block.
+// Only the unused message type 0xE can be registered, at most once.
+func RegisterType(msgType byte, h func(*pkt.Packet, Context)) {
+	if msgType <= pkt.MsgTypeRebind || msgType >= pkt.MsgTypeExtended {
+		assert.Never("message type", msgType, "is built in or reserved and can't be registered")
+		return
+	}
+	if h == nil {
+		assert.Never("handler of message type", msgType, "is nil")
+		return
+	}
+
+	customTypes.mu.Lock()
+	defer customTypes.mu.Unlock()
+
+	if _, exists := customTypes.handlers[msgType]; exists {
+		assert.Never("message type", msgType, "is already registered")
+		return
+	}
+	customTypes.handlers[msgType] = h
+}
+
+// getCustomHandler returns the registered handler of the message type.
+func getCustomHandler(msgType byte) (func(*pkt.Packet, Context), bool) {
+	customTypes.mu.RLock()
+	defer customTypes.mu.RUnlock()
+
+	h, exists := customTypes.handlers[msgType]
+	return h, exists
+}
+
+// handleCustom processes a packet of a message type that is not built in.
+// Packets for other peers are forwarded even if the type isn't registered, so embedders don't need to run on every host of the path.
+func handleCustom(packet *pkt.Packet, srcAddrPort netip.AddrPort, socket sock.Socket, inSequencing *sequencing.IncomingPktNumHandler, connections *connection.Manager) {
+	logger.Tracef("CUSTOM %d RECEIVED %v %d", packet.GetMessageType(), packet.Header.SourceAddr, packet.Header.PktNum)
+
+	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
+
+	if destAddr != socket.MustGetLocalAddress().Addr() {
+		// The packet is for another peer
+		connections.ForwardRouted(packet, srcAddrPort)
+		return
+	}
+
+	// The packet is for us
+
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+
+	h, registered := getCustomHandler(packet.GetMessageType())
+	if !registered {
+		logger.Warnf("Unhandled packet type: %v from %v to %v", packet.GetMessageType(), packet.Header.SourceAddr, packet.Header.DestAddr)
+		return
+	}
+
+	duplicate, dupErr := inSequencing.IsDuplicatePacket(packet)
+	if dupErr != nil {
+		logger.Warnf(dupErr.Error())
+		return
+	} else if duplicate {
+		_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+		return
+	}
+
+	_ = connections.SendRoutedAcknowledgment(srcAddr, packet.Header.PktNum)
+
+	h(packet, Context{Source: srcAddr, Sender: srcAddrPort, connections: connections})
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"net"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sock"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// handleRelay processes a RELAY packet from a direct neighbor.
+// We either relay the encapsulated packet to another neighbor or process it as if it was received from the relayed neighbor.
+// RELAY packets are unsequenced, the encapsulated packet is acknowledged instead.
+func (ph *PacketHandler) handleRelay(packet *pkt.Packet, srcAddrPort netip.AddrPort) {
+	logger.Tracef("RELAY RECEIVED %v", packet.Header.SourceAddr)
+
+	if connection.IsRelayedAddrPort(srcAddrPort) {
+		logger.Warnf("Dropping nested RELAY packet from %v", srcAddrPort.Addr())
+		return
+	}
+
+	srcAddr := netip.AddrFrom4(packet.Header.SourceAddr)
+	if !ph.connections.IsValidSender(srcAddr, srcAddrPort) {
+		logger.Warnf("Malformed RELAY packet: source address %v does not match sender %v", srcAddr, srcAddrPort)
+		return
+	}
+
+	destAddr := netip.AddrFrom4(packet.Header.DestAddr)
+	if destAddr != ph.socket.MustGetLocalAddress().Addr() {
+		logger.Warnf("Malformed RELAY packet: destination address %v is not us", destAddr)
+		return
+	}
+
+	if isNeighbor, _ := ph.router.IsNeighbor(srcAddr); !isNeighbor {
+		logger.Warnf("Dropping RELAY packet from non-neighbor %v", srcAddr)
+		return
+	}
+
+	encapsulated, from, err := ph.connections.HandleRelay(packet)
+	if err != nil {
+		logger.Warnf("Failed to handle RELAY packet from %v: %v", srcAddr, err)
+		return
+	}
+
+	if encapsulated == nil {
+		return // Relayed to the peer
+	}
+
+	ph.processPacket(&sock.Packet{
+		Addr: net.UDPAddrFromAddrPort(connection.RelayedAddrPort(from)),
+		Data: encapsulated,
+	})
+}
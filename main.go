@@ -4,94 +4,293 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
 
 	"bjoernblessin.de/chatprotogol/cmd"
 	"bjoernblessin.de/chatprotogol/cmd/inputreader"
 	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/conformance"
 	"bjoernblessin.de/chatprotogol/connection"
-	"bjoernblessin.de/chatprotogol/handler"
-	"bjoernblessin.de/chatprotogol/routing"
-	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/node"
+	"bjoernblessin.de/chatprotogol/simulation"
 	"bjoernblessin.de/chatprotogol/sock"
+	"bjoernblessin.de/chatprotogol/util/env"
 	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		err := simulation.Run(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Simulation failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "conformance" {
+		err := conformance.Run(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Conformance check failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Printf("Running...")
 
 	logger.SetFileEnable(false) // Disable logging for faster file receiving
+	logger.SetRateLimit(common.LOG_RATE_LIMIT_PER_SECOND)
+	logger.StartAsync(common.LOG_QUEUE_SIZE_LINES)
+	logger.SetHistorySize(common.LOG_HISTORY_SIZE_LINES)
+	defer logger.Flush()
 
-	udpSocket := sock.NewUDPSocket()
+	udpSocket := newSocket()
 
-	inSequencing := sequencing.NewIncomingPktNumHandler(udpSocket)
-	outSequencing := sequencing.NewOutgoingPktNumHandler(common.INITIAL_CWND, common.IGNORE_CWND)
+	localNode := node.New(udpSocket, common.ACCESS_LIST_FILE)
 
-	router := routing.NewRouter(udpSocket)
+	cmd.AddNode(localNode)
 
-	cmd.SetGlobalVars(udpSocket, router, outSequencing)
+	cmd.SubscribeToEvents()
+	cmd.StartTimeline()
+	cmd.RegisterSoakEcho()
 
-	reader := inputreader.NewInputReader(udpSocket)
+	reader := inputreader.NewInputReader(cmd.Prompt)
 
 	reader.AddHandler("con", cmd.HandleConnect)
 	reader.AddHandler("dis", cmd.HandleDisconnect)
-	reader.AddHandler("msg", cmd.HandleSend)
-	reader.AddHandler("file", cmd.HandleSendFile)
+	reader.AddHandler("msg", cmd.NewSendHandler(reader))
+	reader.AddHandler("file", cmd.NewSendFileHandler(reader))
 	reader.AddHandler("init", cmd.HandleInit)
 	reader.AddHandler("ls", cmd.HandleList)
 	reader.AddHandler("exit", cmd.HandleExit)
 	reader.AddHandler("lsdb", cmd.HandleListDatabase)
-	reader.AddHandler("infmsg", cmd.HandleInfiniteMsg)
+	reader.AddHandler("loadgen", cmd.HandleLoadGen)
 	reader.AddHandler("i", cmd.HandleInit)
 	reader.AddHandler("acks", cmd.HandleListAcks)
 	reader.AddHandler("loglvl", cmd.HandleLogLevel)
+	reader.AddHandler("ccstats", cmd.HandleCongestionStats)
+	reader.AddHandler("mtu", cmd.HandleMTU)
+	reader.AddHandler("block", cmd.HandleBlock)
+	reader.AddHandler("unblock", cmd.HandleUnblock)
+	reader.AddHandler("allowonly", cmd.HandleAllowOnly)
+	reader.AddHandler("meet", cmd.HandleMeet)
+	reader.AddHandler("panics", cmd.HandlePanics)
+	reader.AddHandler("cancel", cmd.HandleCancel)
+	reader.AddHandler("team", cmd.HandleTeam)
+	reader.AddHandler("presence", cmd.HandlePresence)
+	reader.AddHandler("typing", cmd.HandleTyping)
+	reader.AddHandler("standby", cmd.HandleStandby)
+	reader.AddHandler("resume", cmd.HandleResume)
+	reader.AddHandler("rebind", cmd.HandleRebind)
+	reader.AddHandler("stats", cmd.HandleStats)
+	reader.AddHandler("trace", cmd.HandleTrace)
+	reader.AddHandler("export", cmd.HandleExport)
+	reader.AddHandler("import", cmd.HandleImport)
+	reader.AddHandler("watch", cmd.HandleWatch)
+	reader.AddHandler("queue", cmd.HandleQueue)
+	reader.AddHandler("peer", cmd.HandlePeer)
+	reader.AddHandler("rtt", cmd.HandleRTT)
+	reader.AddHandler("wireformat", cmd.HandleWireFormat)
+	reader.AddHandler("violations", cmd.HandleViolations)
+	reader.AddHandler("replay", cmd.HandleReplay)
+	reader.AddHandler("sockets", cmd.HandleSockets)
+	reader.AddHandler("room", cmd.HandleRoom)
+	reader.AddHandler("send-raw", cmd.NewSendRawHandler(reader))
+	reader.AddHandler("craft", cmd.HandleCraft)
+	reader.AddHandler("soak", cmd.HandleSoak)
+	reader.AddHandler("netem", cmd.HandleNetem)
+	reader.AddHandler("discover", cmd.HandleDiscover)
+	reader.AddHandler("route", cmd.HandleRoute)
+	reader.AddHandler("blockers", cmd.HandleBlockers)
+	reader.AddHandler("reset", cmd.HandleReset)
+	reader.AddHandler("forgetkey", cmd.HandleForgetKey)
+	reader.AddHandler("timeline", cmd.HandleTimeline)
+	reader.AddHandler("doctor", cmd.HandleDoctor)
+	reader.AddHandler("ingress", cmd.HandleIngress)
+	reader.AddHandler("spawn", cmd.HandleSpawn)
+	reader.AddHandler("node", cmd.NewNodeHandler(reader.Dispatch))
 
-	handler := handler.NewPacketHandler(udpSocket, router, inSequencing, outSequencing)
-	go handler.ListenToPackets()
+	if key, ok := env.ReadOptionalEnv(common.PRE_SHARED_KEY_ENV); ok && key != "" {
+		localNode.Connections.SetPreSharedKey([]byte(key))
+		fmt.Println("Packet authentication with pre-shared key enabled")
+	}
+
+	if path, ok := env.ReadOptionalEnv(common.SIGNING_KEY_ENV); ok && path != "" {
+		if err := localNode.Connections.LoadSigningKey(path); err != nil {
+			logger.Warnf("Failed to load the LSA signing key, signing with a new key: %v", err)
+		} else {
+			fmt.Printf("Signing LSAs with the key in %s\n", path)
+		}
+	}
 
-	connection.SetGlobalVars(udpSocket, router, inSequencing, outSequencing)
+	if value, ok := env.ReadOptionalEnv(common.HOP_ARQ_ENV); ok && (value == "1" || value == "true") {
+		localNode.Connections.SetHopByHopARQ(true)
+		fmt.Println("Hop-by-hop retransmission of forwarded packets enabled")
+	}
+
+	if value, ok := env.ReadOptionalEnv(common.PATH_RECORDING_ENV); ok && (value == "1" || value == "true") {
+		localNode.Connections.SetPathRecording(true)
+		fmt.Println("Path recording debug mode enabled")
+	}
 
-	localAddr, err := udpSocket.Open(net.IPv4(127, 0, 0, 1))
+	if path, ok := env.ReadOptionalEnv(common.JOURNAL_ENV); ok && path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			logger.Warnf("Failed to create the sequencing journal %s: %v", path, err)
+		} else {
+			localNode.OutSequencing.SetJournal(file)
+			fmt.Printf("Journaling reliable packets to %s\n", path)
+		}
+	}
+
+	if value, ok := env.ReadOptionalEnv(common.STRICT_ENV); ok && (value == "1" || value == "true") {
+		localNode.Connections.SetStrict(true)
+		fmt.Println("Strict mode enabled, packets that violate the wire format are dropped")
+	}
+
+	if value, ok := env.ReadOptionalEnv(common.INGRESS_AUTO_BLOCK_ENV); ok && (value == "1" || value == "true") {
+		localNode.Connections.SetIngressAutoBlock(true)
+		fmt.Println("Senders that exceed their ingress budget are blocked automatically")
+	}
+
+	if value, ok := env.ReadOptionalEnv(common.CONNECTED_UDP_ENV); ok && (value == "1" || value == "true") {
+		if err := udpSocket.SetConnectedMode(true); err != nil {
+			logger.Warnf("Failed to enable the connected-UDP fast path: %v", err)
+		} else {
+			fmt.Println("Connected-UDP fast path enabled")
+		}
+	}
+
+	if value, ok := env.ReadOptionalEnv(common.UNRELIABLE_MESSAGES_ENV); ok && (value == "1" || value == "true") {
+		cmd.SetUnreliableMessages(true)
+		fmt.Println("Messages are sent unreliably by default, use 'msg --reliable' for reliable messages")
+	}
+
+	configureTeam(localNode.Connections)
+	configureNodeID(udpSocket, localNode.Connections)
+
+	localAddr, err := udpSocket.Open(net.IP(selectStartupAddress().AsSlice()))
 	if err != nil {
 		logger.Errorf("Failed to open UDP socket: %v", err)
 		return
 	}
 	fmt.Printf("Listening on %s:%d\n", localAddr.IP, localAddr.Port)
 
-	printAvailableNetworkAddresses()
+	cmd.PrintInterfaceAddresses()
+
+	if common.NAT_TRAVERSAL {
+		localNode.Connections.StartNATTraversal(localAddr.AddrPort())
+	}
+
+	if value, ok := env.ReadOptionalEnv(common.DISCOVERY_ENV); ok && (value == "1" || value == "true" || value == "auto") {
+		cmd.StartDiscovery(localAddr.AddrPort(), value == "auto")
+	}
 
 	reader.InputLoop()
+
+	reportPath, _ := env.ReadOptionalEnv(common.SESSION_REPORT_ENV)
+	cmd.ReportSession(reportPath)
 }
 
-func printAvailableNetworkAddresses() {
-	inter, err := net.Interfaces()
-	if err != nil {
-		logger.Warnf("Failed to get network interfaces: %v", err)
+// configureTeam sets the team ID and promiscuous mode from the environment variables common.TEAM_ID_ENV and common.PROMISCUOUS_ENV.
+// Invalid team IDs are ignored and common.TEAM_ID is used instead.
+func configureTeam(connections *connection.Manager) {
+	if value, ok := env.ReadOptionalEnv(common.TEAM_ID_ENV); ok && value != "" {
+		id, err := strconv.ParseUint(value, 0, 4)
+		if err != nil {
+			logger.Warnf("Invalid %s %q, must be 0-15, using team %d", common.TEAM_ID_ENV, value, common.TEAM_ID)
+		} else {
+			connections.SetTeamID(byte(id))
+		}
+	}
+
+	if value, ok := env.ReadOptionalEnv(common.PROMISCUOUS_ENV); ok && (value == "1" || value == "true") {
+		connections.SetPromiscuous(true)
+	}
+
+	if connections.IsPromiscuous() {
+		fmt.Printf("Team %d, processing packets of all teams\n", connections.TeamID())
+	} else {
+		fmt.Printf("Team %d\n", connections.TeamID())
+	}
+}
+
+// configureNodeID sets the node ID from the environment variable common.NODE_ID_ENV.
+// The node ID is given in IPv4 notation or "random" derives one from the signing key, which peers can verify on the first CONNECT.
+// Without a valid node ID, the node is identified by the IP address of its socket.
+func configureNodeID(socket sock.Socket, connections *connection.Manager) {
+	value, ok := env.ReadOptionalEnv(common.NODE_ID_ENV)
+	if !ok || value == "" {
 		return
 	}
 
-	fmt.Println("Available network interfaces:")
+	var nodeID netip.Addr
+	if value == "random" {
+		nodeID = connections.DerivedNodeID()
+	} else {
+		addr, err := netip.ParseAddr(value)
+		if err != nil || !addr.Is4() || addr.IsUnspecified() {
+			logger.Warnf("Invalid %s %q, must be an IPv4 address or \"random\", identifying by the socket address", common.NODE_ID_ENV, value)
+			return
+		}
+		nodeID = addr
+	}
 
-	for _, iface := range inter {
-		if iface.Flags&net.FlagUp == 0 {
-			continue // Skip down interfaces
+	if nodeID != connections.DerivedNodeID() && !connections.IsAuthenticationEnabled() {
+		logger.Warnf("Node ID %s isn't derived from the signing key, peers only accept it with a pre-shared key or a key pinned for it", nodeID)
+	}
+
+	socket.SetNodeID(nodeID)
+	fmt.Printf("Node ID %s\n", nodeID)
+}
+
+// newSocket returns the UDP socket of the node.
+// If the environment variable common.BIND_ALSO_ENV lists further addresses, it returns a socket set that also listens on them.
+func newSocket() sock.Socket {
+	value, ok := env.ReadOptionalEnv(common.BIND_ALSO_ENV)
+	if !ok || value == "" {
+		return sock.NewUDPSocket()
+	}
+
+	set := sock.NewSocketSet(sock.NewUDPSocket())
+	for entry := range strings.SplitSeq(value, ",") {
+		entry = strings.TrimSpace(entry)
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			addr, err = sock.GetInterfaceAddress(entry)
 		}
-		addrs, err2 := iface.Addrs()
-		if err2 != nil {
-			logger.Warnf("Failed to get addresses for interface %s: %v", iface.Name, err2)
-			continue
+		if err == nil {
+			err = set.AddSocket(sock.NewUDPSocket(), addr)
 		}
+		if err != nil {
+			logger.Warnf("Invalid address %q in %s: %v, not listening on it", entry, common.BIND_ALSO_ENV, err)
+		}
+	}
+	return set
+}
 
-		for _, addr := range addrs {
-			ip, ok := addr.(*net.IPNet)
-			if !ok {
-				continue // Skip non-IP addresses
-			}
+// selectStartupAddress returns the address the socket is opened on at startup.
+// It is read from the environment variable common.BIND_ADDRESS_ENV (an IPv4 address or interface name).
+// If the variable is not set, the first non-loopback address is selected so that peers on other machines can connect.
+func selectStartupAddress() netip.Addr {
+	value, ok := env.ReadOptionalEnv(common.BIND_ADDRESS_ENV)
+	if !ok || value == "" {
+		return sock.SelectDefaultAddress()
+	}
 
-			if ip.IP.To4() == nil {
-				continue // Skip non-IPv4 addresses
-			}
+	if addr, err := netip.ParseAddr(value); err == nil && addr.Is4() {
+		return addr
+	}
 
-			fmt.Printf("  Interface: %s, Address: %s\n", iface.Name, ip.IP)
-		}
+	addr, err := sock.GetInterfaceAddress(value)
+	if err != nil {
+		logger.Warnf("Invalid %s %q: %v, selecting an address automatically", common.BIND_ADDRESS_ENV, value, err)
+		return sock.SelectDefaultAddress()
 	}
+	return addr
 }
@@ -0,0 +1,64 @@
+package nat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// DefaultGateway returns the IPv4 default gateway.
+// It is read from the kernel routing table on Linux. On other systems (or if there is no default route),
+// the first address of the local /24 network is assumed, which is the gateway in most home networks.
+func DefaultGateway(localAddr netip.Addr) (netip.Addr, error) {
+	if gateway, err := readLinuxDefaultGateway("/proc/net/route"); err == nil {
+		return gateway, nil
+	}
+
+	if !localAddr.Is4() || localAddr.IsLoopback() {
+		return netip.Addr{}, errors.New("can't guess the gateway of a non-IPv4 or loopback address")
+	}
+
+	octets := localAddr.As4()
+	octets[3] = 1
+	return netip.AddrFrom4(octets), nil
+}
+
+// readLinuxDefaultGateway parses a routing table in the format of /proc/net/route.
+// Addresses in the file are hex encoded in host (little endian) byte order.
+func readLinuxDefaultGateway(path string) (netip.Addr, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // Skip header line
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue // Not the default route
+		}
+
+		gatewayBytes, err := hex.DecodeString(fields[2])
+		if err != nil || len(gatewayBytes) != 4 {
+			continue
+		}
+
+		var octets [4]byte
+		binary.BigEndian.PutUint32(octets[:], binary.LittleEndian.Uint32(gatewayBytes))
+
+		gateway := netip.AddrFrom4(octets)
+		if gateway.IsUnspecified() {
+			continue // Directly connected, no gateway
+		}
+		return gateway, nil
+	}
+
+	return netip.Addr{}, errors.New("no default route found")
+}
@@ -0,0 +1,49 @@
+// Package nat requests port mappings from the local gateway so that peers behind a NAT can accept inbound connections.
+// NAT-PMP (RFC 6886) is tried first, UPnP IGD is the fallback.
+package nat
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// Mapping is a UDP port mapping on the gateway.
+type Mapping struct {
+	InternalPort uint16
+	External     netip.AddrPort // External address and port peers can send to
+	Lifetime     time.Duration  // The mapping must be renewed before it expires
+}
+
+// PortMapper requests UDP port mappings from a gateway.
+type PortMapper interface {
+	// Name returns the name of the used protocol.
+	Name() string
+
+	// AddMapping maps the internal UDP port to an external port for the given lifetime.
+	// Calling it again for the same port renews the mapping.
+	AddMapping(internalPort uint16, lifetime time.Duration) (Mapping, error)
+
+	// DeleteMapping removes the mapping from the gateway.
+	DeleteMapping(mapping Mapping) error
+}
+
+// Discover returns a port mapper for the gateway of the local address.
+// NAT-PMP is tried first because it is cheaper, UPnP IGD is the fallback.
+// Errors if no gateway answers.
+func Discover(localAddr netip.Addr) (PortMapper, error) {
+	gateway, err := DefaultGateway(localAddr)
+	if err == nil {
+		pmp := NewNATPMPClient(gateway)
+		if _, err := pmp.ExternalAddress(); err == nil {
+			return pmp, nil
+		}
+	}
+
+	upnp, err := DiscoverUPnP(localAddr)
+	if err == nil {
+		return upnp, nil
+	}
+
+	return nil, errors.New("no NAT-PMP or UPnP gateway found: " + err.Error())
+}
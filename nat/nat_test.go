@@ -0,0 +1,132 @@
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startFakeNATPMPGateway answers NAT-PMP requests with the external address 203.0.113.7 and maps every port to port+1000.
+func startFakeNATPMPGateway(t *testing.T) netip.AddrPort {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to open fake gateway: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			switch {
+			case n == 2 && buffer[1] == natpmpOpExternalAddr:
+				response := []byte{0, 128, 0, 0, 0, 0, 0, 1, 203, 0, 113, 7}
+				_, _ = conn.WriteToUDP(response, addr)
+			case n == 12 && buffer[1] == natpmpOpMapUDP:
+				internalPort := binary.BigEndian.Uint16(buffer[4:6])
+				response := make([]byte, 16)
+				response[1] = 129
+				binary.BigEndian.PutUint16(response[8:10], internalPort)
+				binary.BigEndian.PutUint16(response[10:12], internalPort+1000)
+				copy(response[12:16], buffer[8:12]) // Grant the requested lifetime
+				_, _ = conn.WriteToUDP(response, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestNATPMPAddMapping(t *testing.T) {
+	client := &NATPMPClient{gateway: startFakeNATPMPGateway(t)}
+
+	mapping, err := client.AddMapping(20000, time.Hour)
+	if err != nil {
+		t.Fatalf("AddMapping failed: %v", err)
+	}
+
+	expected := netip.MustParseAddrPort("203.0.113.7:21000")
+	if mapping.External != expected {
+		t.Errorf("Expected external address %v, got %v", expected, mapping.External)
+	}
+	if mapping.Lifetime != time.Hour {
+		t.Errorf("Expected lifetime %v, got %v", time.Hour, mapping.Lifetime)
+	}
+}
+
+func TestNATPMPNoGateway(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to open silent gateway: %v", err)
+	}
+	defer conn.Close()
+
+	client := &NATPMPClient{gateway: conn.LocalAddr().(*net.UDPAddr).AddrPort()}
+
+	if _, err := client.ExternalAddress(); err == nil {
+		t.Errorf("Expected an error for a gateway that doesn't answer")
+	}
+}
+
+func TestParseDeviceDescription(t *testing.T) {
+	description := []byte(`<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`)
+
+	controlURL, serviceType, err := parseDeviceDescription(description, "http://192.168.1.1:5000/rootDesc.xml")
+	if err != nil {
+		t.Fatalf("Failed to parse description: %v", err)
+	}
+	if controlURL != "http://192.168.1.1:5000/ctl/IPConn" {
+		t.Errorf("Unexpected control URL %s", controlURL)
+	}
+	if serviceType != "urn:schemas-upnp-org:service:WANIPConnection:1" {
+		t.Errorf("Unexpected service type %s", serviceType)
+	}
+}
+
+func TestReadLinuxDefaultGateway(t *testing.T) {
+	routeFile := filepath.Join(t.TempDir(), "route")
+	content := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n"
+	if err := os.WriteFile(routeFile, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write route file: %v", err)
+	}
+
+	gateway, err := readLinuxDefaultGateway(routeFile)
+	if err != nil {
+		t.Fatalf("Failed to read gateway: %v", err)
+	}
+	if gateway != netip.MustParseAddr("192.168.1.1") {
+		t.Errorf("Expected gateway 192.168.1.1, got %v", gateway)
+	}
+}
@@ -0,0 +1,131 @@
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// NAT-PMP (RFC 6886) messages are sent to UDP port 5351 of the gateway.
+//
+// External address request: version (0), opcode (0).
+// External address response: version, opcode (128), result code (16 bits), epoch (32 bits), external IPv4 address (32 bits).
+//
+// UDP mapping request: version, opcode (1), reserved (16 bits), internal port (16 bits), suggested external port (16 bits), lifetime in seconds (32 bits).
+// UDP mapping response: version, opcode (129), result code, epoch, internal port, mapped external port, lifetime.
+// A lifetime of 0 deletes the mapping.
+const (
+	natpmpPort            = 5351
+	natpmpVersion         = 0
+	natpmpOpExternalAddr  = 0
+	natpmpOpMapUDP        = 1
+	natpmpResponseBit     = 128
+	natpmpInitialTimeout  = 250 * time.Millisecond
+	natpmpMaxAttempts     = 4
+	natpmpExternalRespLen = 12
+	natpmpMapRespLen      = 16
+)
+
+// NATPMPClient requests port mappings via NAT-PMP.
+type NATPMPClient struct {
+	gateway netip.AddrPort
+}
+
+func NewNATPMPClient(gateway netip.Addr) *NATPMPClient {
+	return &NATPMPClient{gateway: netip.AddrPortFrom(gateway, natpmpPort)}
+}
+
+func (c *NATPMPClient) Name() string {
+	return "NAT-PMP"
+}
+
+// ExternalAddress returns the external IPv4 address of the gateway.
+func (c *NATPMPClient) ExternalAddress() (netip.Addr, error) {
+	response, err := c.request([]byte{natpmpVersion, natpmpOpExternalAddr}, natpmpExternalRespLen)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return netip.AddrFrom4([4]byte(response[8:12])), nil
+}
+
+func (c *NATPMPClient) AddMapping(internalPort uint16, lifetime time.Duration) (Mapping, error) {
+	externalAddr, err := c.ExternalAddress()
+	if err != nil {
+		return Mapping{}, err
+	}
+
+	response, err := c.request(buildNATPMPMapRequest(internalPort, internalPort, lifetime), natpmpMapRespLen)
+	if err != nil {
+		return Mapping{}, err
+	}
+
+	externalPort := binary.BigEndian.Uint16(response[10:12])
+	grantedLifetime := time.Duration(binary.BigEndian.Uint32(response[12:16])) * time.Second
+
+	return Mapping{
+		InternalPort: internalPort,
+		External:     netip.AddrPortFrom(externalAddr, externalPort),
+		Lifetime:     grantedLifetime,
+	}, nil
+}
+
+func (c *NATPMPClient) DeleteMapping(mapping Mapping) error {
+	_, err := c.request(buildNATPMPMapRequest(mapping.InternalPort, 0, 0), natpmpMapRespLen)
+	return err
+}
+
+func buildNATPMPMapRequest(internalPort uint16, suggestedExternalPort uint16, lifetime time.Duration) []byte {
+	request := make([]byte, 12)
+	request[0] = natpmpVersion
+	request[1] = natpmpOpMapUDP
+	binary.BigEndian.PutUint16(request[4:6], internalPort)
+	binary.BigEndian.PutUint16(request[6:8], suggestedExternalPort)
+	binary.BigEndian.PutUint32(request[8:12], uint32(lifetime/time.Second))
+	return request
+}
+
+// request sends the request to the gateway and waits for the matching response.
+// The request is retransmitted with a doubling timeout as recommended by RFC 6886.
+func (c *NATPMPClient) request(request []byte, responseLen int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(c.gateway))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout := natpmpInitialTimeout
+	buffer := make([]byte, 16)
+
+	for range natpmpMaxAttempts {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				break // Timeout, retransmit
+			}
+
+			if n < responseLen || buffer[0] != natpmpVersion || buffer[1] != natpmpResponseBit|request[1] {
+				continue // Not the response to our request
+			}
+
+			if resultCode := binary.BigEndian.Uint16(buffer[2:4]); resultCode != 0 {
+				return nil, fmt.Errorf("NAT-PMP gateway returned result code %d", resultCode)
+			}
+
+			return buffer[:n], nil
+		}
+
+		timeout *= 2
+	}
+
+	return nil, errors.New("NAT-PMP gateway did not respond")
+}
@@ -0,0 +1,253 @@
+package nat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpAddr         = "239.255.255.250:1900"
+	ssdpTimeout      = 2 * time.Second
+	upnpHTTPTimeout  = 3 * time.Second
+	upnpSearchTarget = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	upnpDescription  = "chatprotogol"
+)
+
+// UPnPClient requests port mappings from an Internet Gateway Device via its WANIPConnection or WANPPPConnection service.
+type UPnPClient struct {
+	controlURL  string
+	serviceType string
+	localAddr   netip.Addr
+	httpClient  *http.Client
+}
+
+// DiscoverUPnP searches for an Internet Gateway Device with SSDP and returns a client for its WAN connection service.
+func DiscoverUPnP(localAddr netip.Addr) (*UPnPClient, error) {
+	location, err := searchGateway(localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{Timeout: upnpHTTPTimeout}
+
+	resp, err := httpClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	description, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	controlURL, serviceType, err := parseDeviceDescription(description, location)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UPnPClient{
+		controlURL:  controlURL,
+		serviceType: serviceType,
+		localAddr:   localAddr,
+		httpClient:  httpClient,
+	}, nil
+}
+
+// searchGateway sends an SSDP M-SEARCH and returns the description location of the first gateway that answers.
+func searchGateway(localAddr netip.Addr) (string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localAddr.AsSlice()})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	dest, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+
+	request := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: " + upnpSearchTarget + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+
+	if _, err := conn.WriteToUDP([]byte(request), dest); err != nil {
+		return "", err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(ssdpTimeout))
+	buffer := make([]byte, 2048)
+
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return "", errors.New("no UPnP gateway answered the SSDP search")
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		if location := resp.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// upnpDevice is the part of a UPnP device description that is needed to find the WAN connection service.
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// parseDeviceDescription finds the WANIPConnection (or WANPPPConnection) service in a device description.
+// Returns the absolute control URL and the service type.
+func parseDeviceDescription(description []byte, location string) (controlURL string, serviceType string, err error) {
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.Unmarshal(description, &root); err != nil {
+		return "", "", err
+	}
+
+	base := location
+	if root.URLBase != "" {
+		base = root.URLBase
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", "", err
+	}
+
+	devices := []upnpDevice{root.Device}
+	for len(devices) > 0 {
+		device := devices[0]
+		devices = append(devices[1:], device.Devices...)
+
+		for _, service := range device.Services {
+			if !strings.Contains(service.ServiceType, "WANIPConnection") && !strings.Contains(service.ServiceType, "WANPPPConnection") {
+				continue
+			}
+
+			ref, err := url.Parse(service.ControlURL)
+			if err != nil {
+				return "", "", err
+			}
+			return baseURL.ResolveReference(ref).String(), service.ServiceType, nil
+		}
+	}
+
+	return "", "", errors.New("gateway has no WANIPConnection or WANPPPConnection service")
+}
+
+func (c *UPnPClient) Name() string {
+	return "UPnP"
+}
+
+func (c *UPnPClient) AddMapping(internalPort uint16, lifetime time.Duration) (Mapping, error) {
+	port := strconv.Itoa(int(internalPort))
+
+	_, err := c.soapRequest("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", port},
+		{"NewProtocol", "UDP"},
+		{"NewInternalPort", port},
+		{"NewInternalClient", c.localAddr.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", upnpDescription},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	})
+	if err != nil {
+		return Mapping{}, err
+	}
+
+	response, err := c.soapRequest("GetExternalIPAddress", nil)
+	if err != nil {
+		return Mapping{}, err
+	}
+
+	var result struct {
+		ExternalIP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := xml.Unmarshal(response, &result); err != nil {
+		return Mapping{}, err
+	}
+
+	externalAddr, err := netip.ParseAddr(strings.TrimSpace(result.ExternalIP))
+	if err != nil {
+		return Mapping{}, fmt.Errorf("gateway returned invalid external address %q", result.ExternalIP)
+	}
+
+	return Mapping{
+		InternalPort: internalPort,
+		External:     netip.AddrPortFrom(externalAddr, internalPort),
+		Lifetime:     lifetime,
+	}, nil
+}
+
+func (c *UPnPClient) DeleteMapping(mapping Mapping) error {
+	_, err := c.soapRequest("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(mapping.External.Port()))},
+		{"NewProtocol", "UDP"},
+	})
+	return err
+}
+
+// soapRequest invokes an action of the WAN connection service and returns the response body.
+// Arguments are ordered because some gateways require the order of the service description.
+func (c *UPnPClient) soapRequest(action string, args [][2]string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + c.serviceType + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		_ = xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequest(http.MethodPost, c.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+c.serviceType+"#"+action+`"`)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	response, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("UPnP action %s failed with status %s", action, resp.Status)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,55 @@
+// Package node wires the components of a local node together.
+// A process can run multiple nodes, each with its own socket, router, sequencing and connections.
+package node
+
+import (
+	"bjoernblessin.de/chatprotogol/access"
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/connection"
+	"bjoernblessin.de/chatprotogol/handler"
+	"bjoernblessin.de/chatprotogol/routing"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sequencing/reconstruction"
+	"bjoernblessin.de/chatprotogol/sock"
+)
+
+// Node is a local node of the network.
+type Node struct {
+	Socket         sock.Socket
+	Router         *routing.Router
+	InSequencing   *sequencing.IncomingPktNumHandler
+	OutSequencing  *sequencing.OutgoingPktNumHandler
+	AccessList     *access.AccessList
+	Reconstructors *reconstruction.Manager
+	Connections    *connection.Manager
+}
+
+// New creates a node on the socket and starts handling the packets it receives.
+// The socket isn't opened, settings of the connection manager (e.g. the team ID) must be applied before opening it.
+// The access list is persisted to accessListFile, an empty path keeps it in memory only.
+func New(socket sock.Socket, accessListFile string) *Node {
+	inSequencing := sequencing.NewIncomingPktNumHandler(socket)
+	outSequencing := sequencing.NewOutgoingPktNumHandler(common.INITIAL_CWND, common.IGNORE_CWND)
+	outSequencing.StartGarbageCollection(common.OPEN_ACK_GC_INTERVAL)
+
+	router := routing.NewRouter(socket)
+
+	accessList := access.NewAccessList(accessListFile)
+
+	reconstructors := reconstruction.NewManager()
+
+	connections := connection.NewManager(socket, router, inSequencing, outSequencing, reconstructors)
+
+	packetHandler := handler.NewPacketHandler(socket, router, inSequencing, outSequencing, accessList, reconstructors, connections)
+	packetHandler.Start()
+
+	return &Node{
+		Socket:         socket,
+		Router:         router,
+		InSequencing:   inSequencing,
+		OutSequencing:  outSequencing,
+		AccessList:     accessList,
+		Reconstructors: reconstructors,
+		Connections:    connections,
+	}
+}
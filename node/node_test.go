@@ -0,0 +1,176 @@
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sock"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// TestNodesInOneProcess verifies that two nodes in the same process connect to each other without sharing state.
+func TestNodesInOneProcess(t *testing.T) {
+	network := sock.NewMemoryNetwork()
+
+	first := New(network.NewSocket(), "")
+	second := New(network.NewSocket(), "")
+
+	second.Connections.SetTeamID(0x5)
+	if first.Connections.TeamID() == 0x5 {
+		t.Fatalf("Team ID of the second node changed the team ID of the first node")
+	}
+	second.Connections.SetTeamID(first.Connections.TeamID())
+
+	if _, err := first.Socket.Open(net.IPv4(10, 0, 0, 1)); err != nil {
+		t.Fatalf("Failed to open socket of the first node: %v", err)
+	}
+	secondAddr, err := second.Socket.Open(net.IPv4(10, 0, 0, 2))
+	if err != nil {
+		t.Fatalf("Failed to open socket of the second node: %v", err)
+	}
+
+	connected, err := first.Connections.ConnectTo(secondAddr.AddrPort().Addr(), secondAddr.AddrPort(), first.Connections.BuildConnectPayload())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	select {
+	case success := <-connected:
+		if !success {
+			t.Fatalf("CONNECT was not acknowledged")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the connection")
+	}
+
+	if isNeighbor, _ := first.Router.IsNeighbor(secondAddr.AddrPort().Addr()); !isNeighbor {
+		t.Errorf("Second node is not a neighbor of the first node")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if isNeighbor, _ := second.Router.IsNeighbor(first.Socket.MustGetLocalAddress().Addr()); isNeighbor {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("First node is not a neighbor of the second node")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BenchmarkFileTransfer measures the throughput of a file transfer between two nodes over UDP on the loopback interface.
+func BenchmarkFileTransfer(b *testing.B) {
+	common.RECEIVED_FILES_DIR = b.TempDir()
+	logger.SetEnable(false)
+	defer logger.SetEnable(true)
+
+	sender, receiver := connectLoopbackNodes(b)
+	receiverID := receiver.Socket.MustGetLocalAddress().Addr()
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	files := events.FileReceived.Subscribe()
+	defer events.FileReceived.Unsubscribe(files)
+
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		sendFile(b, sender, receiverID, data)
+
+		select {
+		case <-files:
+		case <-time.After(10 * time.Second):
+			b.Fatalf("File was not received")
+		}
+	}
+}
+
+// connectLoopbackNodes opens two nodes on UDP sockets of the loopback interface and connects them.
+// Both sockets are bound to 127.0.0.1, so the nodes identify by node IDs.
+func connectLoopbackNodes(tb testing.TB) (first *Node, second *Node) {
+	tb.Helper()
+
+	first = New(sock.NewUDPSocket(), "")
+	second = New(sock.NewUDPSocket(), "")
+
+	for i, n := range []*Node{first, second} {
+		n.Socket.SetNodeID(netip.AddrFrom4([4]byte{10, 254, 0, byte(i + 1)}))
+		if _, err := n.Socket.Open(net.IPv4(127, 0, 0, 1)); err != nil {
+			tb.Fatalf("Failed to open socket: %v", err)
+		}
+		tb.Cleanup(func() { _ = n.Socket.Close() })
+	}
+
+	secondAddr, err := second.Socket.GetBoundAddress()
+	if err != nil {
+		tb.Fatalf("Failed to get bound address: %v", err)
+	}
+
+	connected, err := first.Connections.ConnectTo(second.Socket.MustGetLocalAddress().Addr(), secondAddr, first.Connections.BuildConnectPayload())
+	if err != nil {
+		tb.Fatalf("Failed to connect: %v", err)
+	}
+	if !<-connected {
+		tb.Fatalf("CONNECT was not acknowledged")
+	}
+
+	// The routing table is built after the LSAs were exchanged
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, found := first.Router.GetNextHop(second.Socket.MustGetLocalAddress().Addr()); found {
+			break
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("No route from the first to the second node")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return first, second
+}
+
+// sendFile sends the data as file like the file command and waits until all packets are acknowledged.
+func sendFile(tb testing.TB, sender *Node, dest netip.Addr, data []byte) {
+	tb.Helper()
+
+	send := func(packet *pkt.Packet) chan bool {
+		ackChan, err := sender.Connections.SendReliableRoutedPacket(context.Background(), packet)
+		if err != nil {
+			tb.Fatalf("Failed to send packet %v: %v", packet.Header.PktNum, err)
+		}
+		return ackChan
+	}
+
+	if !<-send(sender.Connections.BuildFileNamePacket("benchmark.bin", int64(len(data)), dest)) {
+		tb.Fatalf("File name packet was not acknowledged")
+	}
+
+	chunkSize := sender.Connections.GetMaxPayloadSize(dest)
+	ackChans := make([]chan bool, 0, len(data)/chunkSize+1)
+	var lastChunkPktNum [4]byte
+
+	for start := 0; start < len(data); start += chunkSize {
+		chunk := data[start:min(start+chunkSize, len(data))]
+		packet := sender.Connections.BuildSequencedPacketShared(pkt.MsgTypeFileTransfer, chunk, dest)
+		ackChans = append(ackChans, send(packet))
+		lastChunkPktNum = packet.Header.PktNum
+	}
+
+	for _, ackChan := range ackChans {
+		if !<-ackChan {
+			tb.Fatalf("File chunk was not acknowledged")
+		}
+	}
+
+	if !<-send(sender.Connections.BuildSequencedPacket(pkt.MsgTypeFinish, lastChunkPktNum[:], dest)) {
+		tb.Fatalf("FIN was not acknowledged")
+	}
+}
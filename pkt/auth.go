@@ -0,0 +1,81 @@
+package pkt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// Authenticated packets carry an ExtTypeMAC extension as their last extension.
+// The MAC is an HMAC-SHA256, truncated to MAC_SIZE bytes, over the serialized packet with the checksum field and the MAC value set to zero.
+// The checksum is calculated after the MAC, so it also covers the MAC.
+// The MAC covers the TTL, forwarding peers therefore verify and then re-authenticate the packet with the shared key.
+const ExtTypeMAC = 0x2
+
+// MAC_SIZE is the length of the truncated HMAC in bytes.
+const MAC_SIZE = 16
+
+// AUTHENTICATION_OVERHEAD is the maximum number of bytes authentication adds to a packet on the wire.
+// This is the extension prefix (if the packet has no other extensions) and the MAC extension.
+const AUTHENTICATION_OVERHEAD = extensionPrefixSize + 2 + MAC_SIZE
+
+// AppendAuthenticatedTo acts like AppendTo but adds a MAC extension computed with key and sets the checksum accordingly.
+// An existing MAC extension (e.g. of a packet that is forwarded) is replaced.
+// The packet itself is not modified, so it can be resent concurrently.
+func (p *Packet) AppendAuthenticatedTo(buf []byte, key []byte) []byte {
+	signed := p.withZeroMAC()
+
+	start := len(buf)
+	buf = signed.AppendTo(buf)
+	data := buf[start:]
+
+	macOffset := HEADER_SIZE + signed.extensionsSize() - MAC_SIZE
+	copy(data[macOffset:], computeMAC(key, data))
+
+	checksum := foldChecksum(sumWords(data))
+	data[10] = ^checksum[0]
+	data[11] = ^checksum[1]
+
+	return buf
+}
+
+// VerifyMAC returns whether the packet carries a valid MAC for key as its last extension.
+// Packets without a MAC are invalid.
+func VerifyMAC(packet *Packet, key []byte) bool {
+	if len(packet.Extensions) == 0 {
+		return false
+	}
+
+	last := packet.Extensions[len(packet.Extensions)-1]
+	if last.Type != ExtTypeMAC || len(last.Value) != MAC_SIZE || len(packet.GetExtensions(ExtTypeMAC)) != 1 {
+		return false
+	}
+
+	unsigned := packet.withZeroMAC()
+	expected := computeMAC(key, unsigned.ToByteArray())
+
+	return hmac.Equal(last.Value, expected)
+}
+
+// withZeroMAC returns a shallow copy of the packet with a cleared checksum and a zeroed MAC extension as last extension.
+// Other MAC extensions are removed.
+func (p *Packet) withZeroMAC() *Packet {
+	signed := *p
+	signed.Header.Checksum = [2]byte{0, 0}
+
+	signed.Extensions = make(Extensions, 0, len(p.Extensions)+1)
+	for _, ext := range p.Extensions {
+		if ext.Type != ExtTypeMAC {
+			signed.Extensions = append(signed.Extensions, ext)
+		}
+	}
+	signed.Extensions = append(signed.Extensions, Extension{Type: ExtTypeMAC, Value: make([]byte, MAC_SIZE)})
+
+	return &signed
+}
+
+// computeMAC returns the truncated HMAC-SHA256 of data.
+func computeMAC(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:MAC_SIZE]
+}
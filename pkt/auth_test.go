@@ -0,0 +1,77 @@
+package pkt
+
+import (
+	"testing"
+)
+
+var testKey = []byte("shared secret")
+
+func signAndParse(t *testing.T, packet *Packet, key []byte) *Packet {
+	t.Helper()
+
+	parsed, err := ParsePacket(packet.AppendAuthenticatedTo(nil, key))
+	if err != nil {
+		t.Fatalf("Failed to parse authenticated packet: %v", err)
+	}
+	if !VerifyChecksum(parsed) {
+		t.Fatalf("Checksum of authenticated packet is invalid")
+	}
+	return parsed
+}
+
+func TestAuthenticatedPacketVerifies(t *testing.T) {
+	packet := makeBenchmarkPacket()
+	packet.AddExtension(ExtTypeAck, []byte{0, 0, 0, 7})
+	SetChecksum(packet)
+
+	parsed := signAndParse(t, packet, testKey)
+
+	if !VerifyMAC(parsed, testKey) {
+		t.Errorf("MAC of authenticated packet is invalid")
+	}
+	if len(parsed.GetPiggybackedAcks()) != 1 {
+		t.Errorf("Expected the existing extension to be kept")
+	}
+	if len(packet.GetExtensions(ExtTypeMAC)) != 0 {
+		t.Errorf("AppendAuthenticatedTo modified the original packet")
+	}
+}
+
+func TestVerifyMACRejectsWrongKey(t *testing.T) {
+	parsed := signAndParse(t, makeBenchmarkPacket(), testKey)
+
+	if VerifyMAC(parsed, []byte("other secret")) {
+		t.Errorf("MAC verified with the wrong key")
+	}
+}
+
+func TestVerifyMACRejectsModifiedPacket(t *testing.T) {
+	parsed := signAndParse(t, makeBenchmarkPacket(), testKey)
+
+	parsed.Payload[0] ^= 0xFF
+	SetChecksum(parsed) // An attacker can always fix the checksum
+
+	if VerifyMAC(parsed, testKey) {
+		t.Errorf("MAC verified for a modified payload")
+	}
+}
+
+func TestVerifyMACRejectsUnauthenticatedPacket(t *testing.T) {
+	if VerifyMAC(makeBenchmarkPacket(), testKey) {
+		t.Errorf("Packet without MAC verified")
+	}
+}
+
+func TestReauthenticationReplacesMAC(t *testing.T) {
+	parsed := signAndParse(t, makeBenchmarkPacket(), testKey)
+
+	parsed.Header.TTL-- // Forwarding changes the TTL
+	reparsed := signAndParse(t, parsed, testKey)
+
+	if len(reparsed.GetExtensions(ExtTypeMAC)) != 1 {
+		t.Errorf("Expected exactly one MAC extension, got %d", len(reparsed.GetExtensions(ExtTypeMAC)))
+	}
+	if !VerifyMAC(reparsed, testKey) {
+		t.Errorf("MAC of re-authenticated packet is invalid")
+	}
+}
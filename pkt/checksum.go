@@ -18,9 +18,33 @@ func SetChecksum(packet *Packet) {
 // calculateChecksum computes the checksum for a given packet.
 // It calculates the Checksum using the TCP/IP checksum algorithm,
 // which involves summing 16-bit words and folding the result to 16 bits.
+// For plain packets the header is serialized into a stack buffer, so no allocations are made.
 func calculateChecksum(packet *Packet) [2]byte {
-	data := packet.ToByteArray()
+	var sum uint32
+	if packet.Extensions == nil {
+		var headerBuf [HEADER_SIZE]byte
+		header := packet.Header.appendTo(headerBuf[:0], packet.Header.Control)
+
+		sum = sumWords(header) // The header has an even length, so the payload words are aligned
+		sum += sumWords(packet.Payload)
+	} else {
+		sum = sumWords(packet.ToByteArray()) // Extensions may have an odd length, sum the contiguous wire format
+	}
+
+	return foldChecksum(sum)
+}
+
+// foldChecksum folds a 32-bit word sum to the 16-bit (not inverted) checksum.
+func foldChecksum(sum uint32) [2]byte {
+	for sum>>16 > 0 { // While loop because we might have overflow after adding
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
 
+	return [2]byte{byte(sum >> 8), byte(sum & 0xFF)}
+}
+
+// sumWords sums the data as big endian 16-bit words. An odd last byte is padded with zero.
+func sumWords(data []byte) uint32 {
 	var sum uint32
 	for i := 0; i < len(data); i += 2 {
 		if i+1 < len(data) {
@@ -29,13 +53,7 @@ func calculateChecksum(packet *Packet) [2]byte {
 			sum += uint32(data[i]) << 8
 		}
 	}
-
-	// Fold 32-bit sum to 16 bits
-	for sum>>16 > 0 { // While loop because we might have overflow after adding
-		sum = (sum & 0xFFFF) + (sum >> 16)
-	}
-
-	return [2]byte{byte(sum >> 8), byte(sum & 0xFF)}
+	return sum
 }
 
 // VerifyChecksum validates the checksum of a packet to ensure data integrity.
@@ -2,6 +2,7 @@ package pkt
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 )
 
@@ -119,3 +120,22 @@ func TestVerifyChecksum(t *testing.T) {
 		})
 	}
 }
+
+// BenchmarkVerifyChecksum measures the checksum verification of every received packet for common payload sizes.
+func BenchmarkVerifyChecksum(b *testing.B) {
+	for _, size := range []int{0, 64, 1200, 8972} {
+		b.Run(fmt.Sprintf("payload=%d", size), func(b *testing.B) {
+			packet := makeBenchmarkPacket()
+			packet.Payload = bytes.Repeat([]byte{0xAB}, size)
+			SetChecksum(packet)
+
+			b.SetBytes(int64(HEADER_SIZE + size))
+			b.ReportAllocs()
+			for b.Loop() {
+				if !VerifyChecksum(packet) {
+					b.Fatal("Checksum of the packet is invalid")
+				}
+			}
+		})
+	}
+}
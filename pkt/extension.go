@@ -0,0 +1,310 @@
+package pkt
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"bjoernblessin.de/chatprotogol/util/assert"
+)
+
+// Extended packets carry optional TLV extensions between the header and the payload.
+// They are marked by the message type MsgTypeExtended in the header, the real message type follows the header.
+// Format:
+//
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|                      Header (16 bytes, Type = 0xF)                    |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	| Inner  |   Extensions    |  Ext   |  Ext   |                          |
+//	| Type   |   Length        |  Type  | Length |    Ext Value ...         |
+//	|(8 bits)|   (16 bits)     |(8 bits)|(8 bits)|                          |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//	|                           Payload ...                                 |
+//	+--------+--------+--------+--------+--------+--------+--------+--------+
+//
+// Extensions Length is the total length of all following extensions (type, length and value).
+// In memory, Header.Control always holds the inner message type, the wrapping is done during (de)serialization.
+const MsgTypeExtended = 0xF
+
+const (
+	ExtTypeAck = 0x1 // Piggybacked acknowledgment, value: acknowledged packet number (32 bits)
+	// ExtTypeMAC = 0x2 is defined in auth.go
+	ExtTypeFileSize         = 0x3  // Size of the file, carried by the file name packet of a file transfer, value: size in bytes (64 bits)
+	ExtTypeNodeID           = 0x4  // Marks the source address of a CONNECT as node ID that differs from the sender's IP address, value: node ID (32 bits)
+	ExtTypeHopARQ           = 0x5  // Announces hop-by-hop retransmission support on a CONNECT and its ACK, no value
+	ExtTypeHopSeq           = 0x6  // Asks the next hop to acknowledge a forwarded packet, value: hop sequence number of the link (32 bits)
+	ExtTypeHopAck           = 0x7  // Makes an ACK a hop ACK for a packet carrying ExtTypeHopSeq, value: acknowledged hop sequence number (32 bits)
+	ExtTypePath             = 0x8  // Path recorded by the source and the forwarding nodes, value: their addresses in order (32 bits each)
+	ExtTypeDDRequest        = 0x9  // Asks the receiver of a DD to reply with its own DD carrying sequence numbers, no value
+	ExtTypeDDSeqNums        = 0xA  // Marks a DD whose entries carry the sequence number of the LSA (32 bits) after the address, no value
+	ExtTypeCE               = 0xB  // Set by a forwarding node whose send queue to the next hop is congested (congestion experienced), no value
+	ExtTypeCEEcho           = 0xC  // Echoes a received ExtTypeCE mark to the source of the marked packet, value: packet number of the marked packet (32 bits)
+	ExtTypeTimestamp        = 0xD  // Asks the destination to echo the send time for a clock offset estimate, value: send time in Unix nanoseconds (64 bits)
+	ExtTypeTimeEcho         = 0xE  // Echoes a received ExtTypeTimestamp to its source, value: echoed send time, receive time and send time of the echo in Unix nanoseconds (64 bits each)
+	ExtTypeCapabilities     = 0xF  // Announces the protocol version and capabilities of the sender on a CONNECT and its ACK, value: version (8 bits), capability flags (16 bits), maximum payload size (16 bits)
+	ExtTypeRoom             = 0x10 // Marks a chat message as room traffic, value: room operation (8 bits) followed by the room name
+	ExtTypeUnreliable       = 0x11 // Marks a chat message as a complete message that is neither sequenced nor acknowledged, value: send time in Unix nanoseconds (64 bits)
+	ExtTypeFinish           = 0x12 // Makes a chat message of one packet its own FIN, value: send time in Unix nanoseconds (64 bits) and boot epoch of the sender (64 bits)
+	ExtTypePublicKey        = 0x13 // Announces the public key the sender signs its LSAs with on a CONNECT and its ACK, value: Ed25519 public key (256 bits)
+	ExtTypeConnectSignature = 0x14 // Proves that the sender of a CONNECT owns its source address, value: Ed25519 signature (512 bits) over source and destination address, packet number and payload
+)
+
+// EXTENSION_RESERVE_BYTES is the number of bytes that payload size limits leave free for extensions.
+// Part of it is kept for the extensions that are added on the way (see onTheWayExtensionBytes): the extension prefix,
+// the MAC added when the packet is sent, and the hop sequence number and congestion mark a forwarding node may add.
+// The rest holds the extensions of the source, e.g. a congestion echo, the time sync extensions, a FIN or file size extension,
+// piggybacked ACKs and a recorded path. Piggybacked ACKs and the recorded path are optional, they are only added while they fit (see ExtensionReserveLeft).
+const EXTENSION_RESERVE_BYTES = 128
+
+// onTheWayExtensionBytes is the part of EXTENSION_RESERVE_BYTES that is kept for the extension prefix, a MAC (ExtTypeMAC),
+// a hop sequence number (ExtTypeHopSeq) and a congestion mark (ExtTypeCE).
+const onTheWayExtensionBytes = extensionPrefixSize + 2 + MAC_SIZE + 2 + 4 + 2
+
+const extensionPrefixSize = 3 // Inner type and extensions length
+
+// Extension is a single TLV extension of a packet.
+type Extension struct {
+	Type  byte
+	Value []byte
+}
+
+// Extensions is the list of extensions of a packet.
+// A non-nil (possibly empty) list makes the packet an extended packet on the wire.
+type Extensions []Extension
+
+// AddExtension appends an extension to the packet.
+// The checksum must be (re)calculated afterwards.
+func (p *Packet) AddExtension(extType byte, value []byte) {
+	assert.Assert(len(value) <= 0xFF, "extension value must not be longer than 255 bytes")
+
+	if p.Extensions == nil {
+		p.Extensions = make(Extensions, 0, 1)
+	}
+	p.Extensions = append(p.Extensions, Extension{Type: extType, Value: value})
+}
+
+// ExtensionReserveLeft returns the number of bytes of EXTENSION_RESERVE_BYTES that the extensions of the packet leave free.
+// The extensions added on the way (see onTheWayExtensionBytes) are accounted for, also if the packet doesn't carry them yet.
+func (p *Packet) ExtensionReserveLeft() int {
+	used := onTheWayExtensionBytes
+	for _, ext := range p.Extensions {
+		switch ext.Type {
+		case ExtTypeMAC, ExtTypeHopSeq, ExtTypeCE:
+			continue // Part of onTheWayExtensionBytes
+		}
+		used += ExtensionSize(ext.Value)
+	}
+	return EXTENSION_RESERVE_BYTES - used
+}
+
+// GetExtensions returns all extensions of the given type in the order they appear in the packet.
+func (p *Packet) GetExtensions(extType byte) []Extension {
+	var result []Extension
+	for _, ext := range p.Extensions {
+		if ext.Type == extType {
+			result = append(result, ext)
+		}
+	}
+	return result
+}
+
+// RemoveExtensions removes all extensions of the given type.
+// A packet without remaining extensions becomes a plain packet, the checksum must be (re)calculated afterwards.
+func (p *Packet) RemoveExtensions(extType byte) {
+	if p.Extensions == nil {
+		return
+	}
+
+	kept := make(Extensions, 0, len(p.Extensions))
+	for _, ext := range p.Extensions {
+		if ext.Type != extType {
+			kept = append(kept, ext)
+		}
+	}
+
+	if len(kept) == 0 {
+		p.Extensions = nil
+		return
+	}
+	p.Extensions = kept
+}
+
+// GetHopSequenceNumber returns the 32-bit value of the first valid extension of the given type (ExtTypeHopSeq or ExtTypeHopAck).
+// Returns false if the packet carries no such extension.
+func (p *Packet) GetHopSequenceNumber(extType byte) (uint32, bool) {
+	for _, ext := range p.GetExtensions(extType) {
+		if len(ext.Value) != 4 {
+			continue
+		}
+		return binary.BigEndian.Uint32(ext.Value), true
+	}
+	return 0, false
+}
+
+// GetRecordedPath returns the addresses of an ExtTypePath extension.
+// Returns false if the packet carries no valid path.
+func (p *Packet) GetRecordedPath() ([][4]byte, bool) {
+	for _, ext := range p.GetExtensions(ExtTypePath) {
+		if len(ext.Value)%4 != 0 {
+			continue
+		}
+		path := make([][4]byte, 0, len(ext.Value)/4)
+		for i := 0; i < len(ext.Value); i += 4 {
+			path = append(path, [4]byte(ext.Value[i:i+4]))
+		}
+		return path, true
+	}
+	return nil, false
+}
+
+// SetRecordedPath replaces the ExtTypePath extension of the packet with the path.
+// The path must not have more than 63 addresses. The checksum must be (re)calculated afterwards.
+func (p *Packet) SetRecordedPath(path [][4]byte) {
+	value := make([]byte, 0, len(path)*4)
+	for _, addr := range path {
+		value = append(value, addr[:]...)
+	}
+
+	p.RemoveExtensions(ExtTypePath)
+	p.AddExtension(ExtTypePath, value)
+}
+
+// GetPiggybackedAcks returns the packet numbers acknowledged by ExtTypeAck extensions.
+// Malformed ACK extensions are ignored.
+func (p *Packet) GetPiggybackedAcks() [][4]byte {
+	var acks [][4]byte
+	for _, ext := range p.GetExtensions(ExtTypeAck) {
+		if len(ext.Value) != 4 {
+			continue
+		}
+		acks = append(acks, [4]byte(ext.Value))
+	}
+	return acks
+}
+
+// IsCongestionMarked returns whether a forwarding node marked the packet with an ExtTypeCE extension.
+func (p *Packet) IsCongestionMarked() bool {
+	return len(p.GetExtensions(ExtTypeCE)) > 0
+}
+
+// GetCongestionEchoes returns the packet numbers of the marked packets echoed by ExtTypeCEEcho extensions.
+// Malformed echo extensions are ignored.
+func (p *Packet) GetCongestionEchoes() [][4]byte {
+	var echoes [][4]byte
+	for _, ext := range p.GetExtensions(ExtTypeCEEcho) {
+		if len(ext.Value) != 4 {
+			continue
+		}
+		echoes = append(echoes, [4]byte(ext.Value))
+	}
+	return echoes
+}
+
+// GetTimestamp returns the send time of an ExtTypeTimestamp extension in Unix nanoseconds.
+// Returns false if the packet carries no valid timestamp.
+func (p *Packet) GetTimestamp() (int64, bool) {
+	for _, ext := range p.GetExtensions(ExtTypeTimestamp) {
+		if len(ext.Value) != 8 {
+			continue
+		}
+		return int64(binary.BigEndian.Uint64(ext.Value)), true
+	}
+	return 0, false
+}
+
+// GetTimeEcho returns the times of an ExtTypeTimeEcho extension in Unix nanoseconds.
+// origin is the echoed send time in the clock of the receiver of the echo, received and sent are in the clock of the sender of the echo.
+// Returns false if the packet carries no valid echo.
+func (p *Packet) GetTimeEcho() (origin int64, received int64, sent int64, found bool) {
+	for _, ext := range p.GetExtensions(ExtTypeTimeEcho) {
+		if len(ext.Value) != 24 {
+			continue
+		}
+		origin = int64(binary.BigEndian.Uint64(ext.Value[0:8]))
+		received = int64(binary.BigEndian.Uint64(ext.Value[8:16]))
+		sent = int64(binary.BigEndian.Uint64(ext.Value[16:24]))
+		return origin, received, sent, true
+	}
+	return 0, 0, 0, false
+}
+
+// GetFileSize returns the file size of an ExtTypeFileSize extension.
+// Returns false if the packet carries no valid file size.
+func (p *Packet) GetFileSize() (int64, bool) {
+	for _, ext := range p.GetExtensions(ExtTypeFileSize) {
+		if len(ext.Value) != 8 {
+			continue
+		}
+		size := binary.BigEndian.Uint64(ext.Value)
+		if size > math.MaxInt64 {
+			continue
+		}
+		return int64(size), true
+	}
+	return 0, false
+}
+
+// ExtensionSize returns the number of bytes an extension occupies on the wire.
+func ExtensionSize(value []byte) int {
+	return 2 + len(value)
+}
+
+// extensionsLength returns the length of all extensions on the wire, excluding the extension prefix.
+func (e Extensions) extensionsLength() int {
+	length := 0
+	for _, ext := range e {
+		length += ExtensionSize(ext.Value)
+	}
+	return length
+}
+
+// appendTo appends the extension prefix (inner message type and extensions length) and all extensions to buf.
+func (e Extensions) appendTo(buf []byte, innerControl byte) []byte {
+	buf = append(buf, innerControl>>4)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(e.extensionsLength()))
+	for _, ext := range e {
+		buf = append(buf, ext.Type, byte(len(ext.Value)))
+		buf = append(buf, ext.Value...)
+	}
+	return buf
+}
+
+// parseExtensions parses the extension prefix and extensions at the start of data.
+// Returns the inner message type, the extensions and the remaining payload.
+func parseExtensions(data []byte) (innerType byte, extensions Extensions, payload []byte, err error) {
+	if len(data) < extensionPrefixSize {
+		return 0, nil, nil, errors.New("extended packet is shorter than the extension prefix")
+	}
+
+	innerType = data[0]
+	if innerType > 0b1111 || innerType == MsgTypeExtended {
+		return 0, nil, nil, errors.New("invalid inner message type in extended packet")
+	}
+
+	length := int(binary.BigEndian.Uint16(data[1:3]))
+	if len(data) < extensionPrefixSize+length {
+		return 0, nil, nil, errors.New("extensions length exceeds packet length")
+	}
+
+	extensions = make(Extensions, 0)
+	extData := data[extensionPrefixSize : extensionPrefixSize+length]
+
+	for len(extData) > 0 {
+		if len(extData) < 2 {
+			return 0, nil, nil, errors.New("truncated extension header")
+		}
+
+		extType, valueLen := extData[0], int(extData[1])
+		if len(extData) < 2+valueLen {
+			return 0, nil, nil, errors.New("truncated extension value")
+		}
+
+		value := make([]byte, valueLen)
+		copy(value, extData[2:2+valueLen])
+		extensions = append(extensions, Extension{Type: extType, Value: value})
+
+		extData = extData[2+valueLen:]
+	}
+
+	return innerType, extensions, data[extensionPrefixSize+length:], nil
+}
@@ -39,12 +39,16 @@ type Header struct {
 	PktNum     [4]byte // Packet number (32 bits)
 }
 
+// HEADER_SIZE is the size of the serialized header in bytes.
+const HEADER_SIZE = 16
+
 // Payload represents the data carried by the packet.
 type Payload []byte
 
 type Packet struct {
-	Header  Header
-	Payload Payload
+	Header     Header
+	Extensions Extensions // Optional extensions, nil for plain packets, see MsgTypeExtended
+	Payload    Payload
 }
 
 const (
@@ -56,10 +60,17 @@ const (
 	MsgTypeFileTransfer   = 0x5
 	MsgTypeAcknowledgment = 0x6
 	MsgTypeFinish         = 0x7
+	MsgTypeMTUProbe       = 0x8
+	MsgTypeIntroduce      = 0x9
+	MsgTypeRelay          = 0xA
+	MsgTypeAbort          = 0xB
+	MsgTypePresence       = 0xC
+	MsgTypeRebind         = 0xD
+	// 0xF is reserved for MsgTypeExtended
 )
 
 func ParsePacket(data []byte) (*Packet, error) {
-	if len(data) < 16 {
+	if len(data) < HEADER_SIZE {
 		return &Packet{}, errors.New("data length is less than 16 bytes, this is shorter than the header size, invalid packet")
 	}
 
@@ -72,29 +83,90 @@ func ParsePacket(data []byte) (*Packet, error) {
 		PktNum:     [4]byte{data[12], data[13], data[14], data[15]},
 	}
 
-	payload := make(Payload, len(data)-16)
-	copy(payload, data[16:])
+	var extensions Extensions
+	rest := data[HEADER_SIZE:]
+
+	if header.Control>>4 == MsgTypeExtended {
+		innerType, exts, remaining, err := parseExtensions(rest)
+		if err != nil {
+			return &Packet{}, err
+		}
+
+		header.Control = innerType<<4 | header.Control&0xF
+		extensions = exts
+		rest = remaining
+	}
+
+	payload := make(Payload, len(rest))
+	copy(payload, rest)
 
 	return &Packet{
-		Header:  header,
-		Payload: payload,
+		Header:     header,
+		Extensions: extensions,
+		Payload:    payload,
 	}, nil
 }
 
+// PeekMessageType returns the message type of a serialized packet without parsing it, the inner message type of an extended packet.
+// The type isn't validated. Returns false if data is too short to contain it.
+func PeekMessageType(data []byte) (byte, bool) {
+	if len(data) < HEADER_SIZE {
+		return 0, false
+	}
+
+	msgType := data[8] >> 4
+	if msgType != MsgTypeExtended {
+		return msgType, true
+	}
+	if len(data) < HEADER_SIZE+extensionPrefixSize {
+		return 0, false
+	}
+	return data[HEADER_SIZE], true
+}
+
 // ToByteArray serializes the Packet struct into a byte array.
 // Makes a complete copy of all packet data into a new byte slice.
 // Returns a byte array containing the header (16 bytes) followed by the payload.
 func (p *Packet) ToByteArray() []byte {
-	data := make([]byte, 0, 16+len(p.Payload))
-	data = append(data, p.Header.DestAddr[:]...)
-	data = append(data, p.Header.SourceAddr[:]...)
-	data = append(data, p.Header.Control)
-	data = append(data, p.Header.TTL)
-	data = append(data, p.Header.Checksum[:]...)
-	data = append(data, p.Header.PktNum[:]...)
-	data = append(data, p.Payload...)
-
-	return data
+	return p.AppendTo(make([]byte, 0, p.Size()))
+}
+
+// Size returns the number of bytes of the serialized packet, without a MAC.
+func (p *Packet) Size() int {
+	return HEADER_SIZE + p.extensionsSize() + len(p.Payload)
+}
+
+// AppendTo serializes the packet by appending the header followed by the payload to buf.
+// Returns the extended buffer. If buf has enough capacity, no allocation is made.
+// This allows sending packets from a reused (pooled) output buffer.
+func (p *Packet) AppendTo(buf []byte) []byte {
+	if p.Extensions == nil {
+		buf = p.Header.appendTo(buf, p.Header.Control)
+		return append(buf, p.Payload...)
+	}
+
+	buf = p.Header.appendTo(buf, MsgTypeExtended<<4|p.Header.Control&0xF)
+	buf = p.Extensions.appendTo(buf, p.Header.Control)
+	return append(buf, p.Payload...)
+}
+
+// extensionsSize returns the number of bytes the extensions occupy on the wire.
+func (p *Packet) extensionsSize() int {
+	if p.Extensions == nil {
+		return 0
+	}
+	return extensionPrefixSize + p.Extensions.extensionsLength()
+}
+
+// appendTo appends the serialized header to buf, using the given control byte on the wire.
+func (h *Header) appendTo(buf []byte, control byte) []byte {
+	buf = append(buf, h.DestAddr[:]...)
+	buf = append(buf, h.SourceAddr[:]...)
+	buf = append(buf, control)
+	buf = append(buf, h.TTL)
+	buf = append(buf, h.Checksum[:]...)
+	buf = append(buf, h.PktNum[:]...)
+	return buf
 }
 
 func (p *Packet) GetMessageType() byte {
@@ -128,5 +200,6 @@ func (p *Packet) String() string {
 		fmt.Sprintf("TTL:%d ", p.Header.TTL) +
 		fmt.Sprintf("Chksum:0x%04X ", p.Header.Checksum) +
 		fmt.Sprintf("PktNum:%d ", binary.BigEndian.Uint32(p.Header.PktNum[:])) +
+		fmt.Sprintf("Exts:%d ", len(p.Extensions)) +
 		"}"
 }
@@ -0,0 +1,217 @@
+package pkt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func makeBenchmarkPacket() *Packet {
+	packet := &Packet{
+		Header: Header{
+			DestAddr:   [4]byte{10, 0, 0, 2},
+			SourceAddr: [4]byte{10, 0, 0, 1},
+			Control:    MakeControlByte(MsgTypeFileTransfer, 0x2),
+			TTL:        30,
+			PktNum:     [4]byte{0, 0, 1, 2},
+		},
+		Payload: bytes.Repeat([]byte{0xAB}, 1200),
+	}
+	SetChecksum(packet)
+	return packet
+}
+
+func TestAppendToMatchesToByteArray(t *testing.T) {
+	packet := makeBenchmarkPacket()
+
+	prefix := []byte{0x01, 0x02}
+	got := packet.AppendTo(prefix)
+
+	if !bytes.Equal(got[:len(prefix)], prefix) {
+		t.Errorf("AppendTo modified the existing buffer content")
+	}
+	if !bytes.Equal(got[len(prefix):], packet.ToByteArray()) {
+		t.Errorf("AppendTo result differs from ToByteArray")
+	}
+
+	parsed, err := ParsePacket(got[len(prefix):])
+	if err != nil {
+		t.Fatalf("Failed to parse appended packet: %v", err)
+	}
+	if !VerifyChecksum(parsed) {
+		t.Errorf("Checksum of parsed packet is invalid")
+	}
+}
+
+func BenchmarkToByteArray(b *testing.B) {
+	packet := makeBenchmarkPacket()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = packet.ToByteArray()
+	}
+}
+
+func BenchmarkAppendTo(b *testing.B) {
+	packet := makeBenchmarkPacket()
+	buf := make([]byte, 0, HEADER_SIZE+len(packet.Payload))
+
+	b.ReportAllocs()
+	for b.Loop() {
+		buf = packet.AppendTo(buf[:0])
+	}
+}
+
+func BenchmarkSetChecksum(b *testing.B) {
+	packet := makeBenchmarkPacket()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		SetChecksum(packet)
+	}
+}
+
+func TestExtendedPacketRoundTrip(t *testing.T) {
+	packet := makeBenchmarkPacket()
+	packet.AddExtension(ExtTypeAck, []byte{0, 0, 0, 7})
+	packet.AddExtension(ExtTypeAck, []byte{0, 0, 0, 9})
+	packet.AddExtension(0x7, []byte{0xAA}) // Odd length extension
+	SetChecksum(packet)
+
+	data := packet.ToByteArray()
+	if data[8]>>4 != MsgTypeExtended {
+		t.Fatalf("Expected wire message type 0x%X, got 0x%X", MsgTypeExtended, data[8]>>4)
+	}
+
+	parsed, err := ParsePacket(data)
+	if err != nil {
+		t.Fatalf("Failed to parse extended packet: %v", err)
+	}
+
+	if !VerifyChecksum(parsed) {
+		t.Errorf("Checksum of parsed extended packet is invalid")
+	}
+	if parsed.GetMessageType() != MsgTypeFileTransfer {
+		t.Errorf("Expected inner message type 0x%X, got 0x%X", MsgTypeFileTransfer, parsed.GetMessageType())
+	}
+	if !bytes.Equal(parsed.Payload, packet.Payload) {
+		t.Errorf("Payload mismatch after round trip")
+	}
+
+	acks := parsed.GetPiggybackedAcks()
+	if len(acks) != 2 || acks[0] != [4]byte{0, 0, 0, 7} || acks[1] != [4]byte{0, 0, 0, 9} {
+		t.Errorf("Unexpected piggybacked acks %v", acks)
+	}
+	if len(parsed.Extensions) != 3 {
+		t.Errorf("Expected 3 extensions, got %d", len(parsed.Extensions))
+	}
+}
+
+func TestPeekMessageType(t *testing.T) {
+	packet := makeBenchmarkPacket()
+	if msgType, ok := PeekMessageType(packet.ToByteArray()); !ok || msgType != MsgTypeFileTransfer {
+		t.Errorf("Expected message type 0x%X, got 0x%X (%v)", MsgTypeFileTransfer, msgType, ok)
+	}
+
+	packet.AddExtension(ExtTypeCEEcho, []byte{0, 0, 0, 7})
+	data := packet.ToByteArray()
+	if msgType, ok := PeekMessageType(data); !ok || msgType != MsgTypeFileTransfer {
+		t.Errorf("Expected inner message type 0x%X of the extended packet, got 0x%X (%v)", MsgTypeFileTransfer, msgType, ok)
+	}
+
+	if _, ok := PeekMessageType(data[:HEADER_SIZE]); ok {
+		t.Errorf("Expected no message type for an extended packet without extension prefix")
+	}
+	if _, ok := PeekMessageType(data[:HEADER_SIZE-1]); ok {
+		t.Errorf("Expected no message type for a truncated header")
+	}
+}
+
+func TestParseMalformedExtendedPacket(t *testing.T) {
+	packet := makeBenchmarkPacket()
+	packet.AddExtension(ExtTypeAck, []byte{0, 0, 0, 7})
+	data := packet.ToByteArray()
+
+	// Extensions length larger than the packet
+	data[HEADER_SIZE+1] = 0xFF
+	data[HEADER_SIZE+2] = 0xFF
+
+	if _, err := ParsePacket(data); err == nil {
+		t.Errorf("Expected error for extensions length exceeding the packet")
+	}
+
+	if _, err := ParsePacket(data[:HEADER_SIZE+1]); err == nil {
+		t.Errorf("Expected error for truncated extension prefix")
+	}
+}
+
+func TestFileSizeExtension(t *testing.T) {
+	packet := makeBenchmarkPacket()
+	if _, ok := packet.GetFileSize(); ok {
+		t.Fatalf("Plain packet should carry no file size")
+	}
+
+	packet.AddExtension(ExtTypeFileSize, binary.BigEndian.AppendUint64(nil, 300000))
+	SetChecksum(packet)
+
+	parsed, err := ParsePacket(packet.ToByteArray())
+	if err != nil {
+		t.Fatalf("Failed to parse packet with file size: %v", err)
+	}
+
+	size, ok := parsed.GetFileSize()
+	if !ok || size != 300000 {
+		t.Errorf("Expected file size 300000, got %d (%v)", size, ok)
+	}
+}
+
+func TestRemoveExtensions(t *testing.T) {
+	packet := makeBenchmarkPacket()
+	packet.AddExtension(ExtTypeHopSeq, binary.BigEndian.AppendUint32(nil, 5))
+	packet.AddExtension(ExtTypeAck, []byte{0, 0, 0, 7})
+
+	packet.RemoveExtensions(ExtTypeHopSeq)
+	if _, marked := packet.GetHopSequenceNumber(ExtTypeHopSeq); marked || len(packet.Extensions) != 1 {
+		t.Errorf("Expected only the ACK extension to remain, got %v", packet.Extensions)
+	}
+
+	packet.RemoveExtensions(ExtTypeAck)
+	SetChecksum(packet)
+	if packet.Extensions != nil {
+		t.Errorf("Packet without extensions should become a plain packet, got %v", packet.Extensions)
+	}
+	if data := packet.ToByteArray(); data[8]>>4 != MsgTypeFileTransfer {
+		t.Errorf("Expected wire message type 0x%X, got 0x%X", MsgTypeFileTransfer, data[8]>>4)
+	}
+}
+
+func FuzzParsePacket(f *testing.F) {
+	f.Add(makeBenchmarkPacket().ToByteArray())
+	extended := makeBenchmarkPacket()
+	extended.AddExtension(ExtTypeAck, []byte{0, 0, 0, 7})
+	extended.AddExtension(ExtTypeFileSize, binary.BigEndian.AppendUint64(nil, 1234))
+	f.Add(extended.ToByteArray())
+	f.Add(extended.ToByteArray()[:HEADER_SIZE+2])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := ParsePacket(data)
+		if err != nil {
+			return
+		}
+
+		// A parsed packet serializes to a packet that parses to the same packet
+		serialized := packet.ToByteArray()
+		reparsed, err := ParsePacket(serialized)
+		if err != nil {
+			t.Fatalf("Failed to parse serialized packet: %v", err)
+		}
+		if !bytes.Equal(reparsed.ToByteArray(), serialized) {
+			t.Errorf("Packet changed after serializing and parsing again")
+		}
+
+		packet.GetPiggybackedAcks()
+		packet.GetFileSize()
+		VerifyChecksum(packet)
+	})
+}
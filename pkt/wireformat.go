@@ -0,0 +1,332 @@
+package pkt
+
+// The wire format registry describes the header, the message types with their payloads and the extensions for implementers of interoperable clients.
+// It is rendered by the wireformat command and must be updated together with the code that builds and parses the packets.
+// All multi-byte fields are big endian.
+
+// Field is a field of the wire format, fields are listed in the order they appear on the wire.
+type Field struct {
+	Name        string `json:"name"`
+	Bits        int    `json:"bits"`               // 0 for variable length
+	Optional    bool   `json:"optional,omitempty"` // The field and all following fields may be missing
+	Repeated    bool   `json:"repeated,omitempty"` // The field and the following fields repeat as a group until the end of the payload
+	Description string `json:"description,omitempty"`
+}
+
+// PayloadFormat is a payload layout of a message type, message types with several layouts name each of them.
+type PayloadFormat struct {
+	Name   string  `json:"name,omitempty"`
+	Fields []Field `json:"fields"` // Empty if the payload is empty
+}
+
+// MessageFormat describes a message type.
+type MessageFormat struct {
+	Type        byte            `json:"type"`
+	Name        string          `json:"name"`
+	Sequenced   bool            `json:"sequenced"` // Carries the next packet number to the destination and is acknowledged, otherwise the packet number field is described in PktNum
+	PktNum      string          `json:"pktNum,omitempty"`
+	Description string          `json:"description"`
+	Payloads    []PayloadFormat `json:"payloads"`
+}
+
+// ExtensionFormat describes an extension type.
+type ExtensionFormat struct {
+	Type        byte    `json:"type"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Value       []Field `json:"value"` // Empty if the extension has no value
+}
+
+// WireFormat is the complete wire format of the protocol.
+type WireFormat struct {
+	HeaderSize      int               `json:"headerSize"`
+	Header          []Field           `json:"header"`
+	Checksum        string            `json:"checksum"`
+	ExtendedType    byte              `json:"extendedType"`
+	ExtensionPrefix []Field           `json:"extensionPrefix"`
+	Extension       []Field           `json:"extension"`
+	MessageTypes    []MessageFormat   `json:"messageTypes"`
+	Extensions      []ExtensionFormat `json:"extensions"`
+}
+
+var bootEpochField = Field{Name: "Boot Epoch", Bits: 64, Description: "Start time of the sender in Unix nanoseconds, increases with every restart"}
+
+// DescribeWireFormat returns the registry of the wire format.
+func DescribeWireFormat() WireFormat {
+	return WireFormat{
+		HeaderSize: HEADER_SIZE,
+		Header: []Field{
+			{Name: "Destination IPv4 Address", Bits: 32},
+			{Name: "Source IPv4 Address", Bits: 32, Description: "Address of the node that built the packet, stays the same while it is forwarded"},
+			{Name: "Message Type", Bits: 4, Description: "See the message types, 0xF marks an extended packet"},
+			{Name: "Team ID", Bits: 4, Description: "Packets of other teams are dropped unless the receiver is promiscuous"},
+			{Name: "TTL", Bits: 8, Description: "Decremented by every forwarding node, packets with TTL 0 are dropped"},
+			{Name: "Checksum", Bits: 16},
+			{Name: "Packet Number", Bits: 32, Description: "Per source and destination, see the message types"},
+		},
+		Checksum:     "Internet checksum (RFC 1071) over the whole serialized packet with the checksum field set to zero, an odd last byte is padded with zero",
+		ExtendedType: MsgTypeExtended,
+		ExtensionPrefix: []Field{
+			{Name: "Inner Message Type", Bits: 8, Description: "The actual message type of the packet"},
+			{Name: "Extensions Length", Bits: 16, Description: "Total length of all following extensions in bytes"},
+		},
+		Extension: []Field{
+			{Name: "Extension Type", Bits: 8, Description: "Unknown extension types are ignored"},
+			{Name: "Extension Length", Bits: 8, Description: "Length of the value in bytes"},
+			{Name: "Extension Value", Bits: 0},
+		},
+		MessageTypes: []MessageFormat{
+			{
+				Type: MsgTypeConnect, Name: "CONNECT", Sequenced: true,
+				Description: "Establishes a neighbor relationship, sent directly to the peer",
+				Payloads: []PayloadFormat{{Fields: []Field{
+					bootEpochField,
+					{Name: "External IPv4 Address", Bits: 32, Optional: true, Description: "Address the sender is reachable at behind a NAT"},
+					{Name: "External Port", Bits: 16},
+				}}},
+			},
+			{
+				Type: MsgTypeDisconnect, Name: "DISCONNECT", Sequenced: true,
+				Description: "Ends a neighbor relationship",
+				Payloads:    []PayloadFormat{{}},
+			},
+			{
+				Type: MsgTypeDD, Name: "DD", Sequenced: true,
+				Description: "Database description: the owners of the LSAs in the LSDB of the sender, sent to a new neighbor",
+				Payloads: []PayloadFormat{
+					{Name: "Plain", Fields: []Field{
+						{Name: "LSA Owner Address", Bits: 32, Repeated: true},
+					}},
+					{Name: "With sequence numbers (ExtTypeDDSeqNums)", Fields: []Field{
+						{Name: "LSA Owner Address", Bits: 32, Repeated: true},
+						{Name: "LSA Sequence Number", Bits: 32},
+					}},
+				},
+			},
+			{
+				Type: MsgTypeLSA, Name: "LSA", Sequenced: true,
+				Description: "Link state advertisement, flooded to all neighbors",
+				Payloads: []PayloadFormat{{Fields: []Field{
+					bootEpochField,
+					{Name: "LSA Owner Address", Bits: 32},
+					{Name: "Sequence Number", Bits: 32},
+					{Name: "Neighbor Address", Bits: 32, Repeated: true, Description: "A trailing 0.0.0.0 marks a stub owner that doesn't forward packets. " +
+						"A signed LSA carries 255.255.255.255, the public key of the owner (256 bits) and the Ed25519 signature (512 bits) of the LSA without boot epoch and signature in front of it"},
+				}}},
+			},
+			{
+				Type: MsgTypeChatMessage, Name: "MSG", Sequenced: true,
+				Description: "Chunk of a chat message, the chunks of a message are sent in order and end with a FIN",
+				Payloads: []PayloadFormat{{Fields: []Field{
+					{Name: "Text", Bits: 0, Description: "UTF-8, chunks are split at character boundaries"},
+				}}},
+			},
+			{
+				Type: MsgTypeFileTransfer, Name: "FILE", Sequenced: true,
+				Description: "File transfer, the metadata packet is followed by the data chunks in order and a FIN",
+				Payloads: []PayloadFormat{
+					{Name: "Metadata", Fields: []Field{
+						{Name: "File Name", Bits: 0, Description: "UTF-8, the size follows in ExtTypeFileSize if it is known"},
+					}},
+					{Name: "Data", Fields: []Field{
+						{Name: "File Content", Bits: 0},
+					}},
+				},
+			},
+			{
+				Type: MsgTypeAcknowledgment, Name: "ACK",
+				PktNum:      "Acknowledged packet number",
+				Description: "Acknowledges a sequenced packet of the destination",
+				Payloads:    []PayloadFormat{{}},
+			},
+			{
+				Type: MsgTypeFinish, Name: "FIN", Sequenced: true,
+				Description: "Ends a message or file transfer",
+				Payloads: []PayloadFormat{{Fields: []Field{
+					{Name: "Last Packet Number", Bits: 32, Description: "Packet number of the last MSG or FILE packet of the transfer"},
+					{Name: "Send Time", Bits: 64, Optional: true, Description: "Unix nanoseconds, messages only"},
+					{Name: bootEpochField.Name, Bits: bootEpochField.Bits, Optional: true, Description: bootEpochField.Description},
+					{Name: "First Packet Number", Bits: 32, Description: "Identifies the message together with the boot epoch"},
+				}}},
+			},
+			{
+				Type: MsgTypeMTUProbe, Name: "PROBE",
+				PktNum:      "Probe or trace ID, replies carry the ID of the request",
+				Description: "Path MTU probes and path traces",
+				Payloads: []PayloadFormat{
+					{Name: "Probe", Fields: []Field{
+						{Name: "Op (0x00)", Bits: 8},
+						{Name: "Padding", Bits: 0, Description: "Fills the payload to the probed size"},
+					}},
+					{Name: "Probe reply", Fields: []Field{
+						{Name: "Op (0x01)", Bits: 8},
+						{Name: "Probe Size", Bits: 16},
+					}},
+					{Name: "Trace", Fields: []Field{
+						{Name: "Op (0x02)", Bits: 8, Description: "Records its path in ExtTypePath"},
+					}},
+					{Name: "Trace reply", Fields: []Field{
+						{Name: "Op (0x03)", Bits: 8},
+						{Name: "Hop Address", Bits: 32, Repeated: true, Description: "Path recorded by the trace"},
+					}},
+				},
+			},
+			{
+				Type: MsgTypeIntroduce, Name: "INTRODUCE", Sequenced: true,
+				Description: "Lets an introducer tell two NATed peers each other's external address",
+				Payloads: []PayloadFormat{
+					{Name: "Request", Fields: []Field{
+						{Name: "Op (0x00)", Bits: 8},
+						{Name: "Peer Address", Bits: 32},
+					}},
+					{Name: "Introduction", Fields: []Field{
+						{Name: "Op (0x01)", Bits: 8},
+						{Name: "Peer Address", Bits: 32},
+						{Name: "Peer External IPv4 Address", Bits: 32},
+						{Name: "Peer External Port", Bits: 16},
+						{Name: "Your External IPv4 Address", Bits: 32},
+						{Name: "Your External Port", Bits: 16},
+					}},
+				},
+			},
+			{
+				Type: MsgTypeRelay, Name: "RELAY",
+				PktNum:      "Zero",
+				Description: "Encapsulates a packet to or from a relayed neighbor",
+				Payloads: []PayloadFormat{{Fields: []Field{
+					{Name: "Op", Bits: 8, Description: "0x00 to the relay, 0x01 from the relay"},
+					{Name: "Peer Address", Bits: 32, Description: "Relayed neighbor the packet is for or from"},
+					{Name: "Encapsulated Packet", Bits: 0},
+				}}},
+			},
+			{
+				Type: MsgTypeAbort, Name: "ABORT", Sequenced: true,
+				Description: "Tells a sender that its message or file transfer was rejected, or refuses a CONNECT with packet number zero and without ACK. An ABORT of ABORT is a RESET, it restarts the sender's packet numbers at its own packet number",
+				Payloads: []PayloadFormat{
+					{Name: "Abort", Fields: []Field{
+						{Name: "Message Type", Bits: 8, Description: "MSG, FILE or CONNECT"},
+						{Name: "Reason", Bits: 8, Description: "0x00 message too large, 0x01 file too large, 0x02 too many transfers, 0x03 receiver error, 0x04 insufficient disk space, 0x05 LSDB overloaded"},
+					}},
+					{Name: "Reset", Fields: []Field{
+						{Name: "Message Type", Bits: 8, Description: "ABORT"},
+						{Name: "Reset ID", Bits: 32, Description: "Random, a retransmitted RESET is only acknowledged again"},
+					}},
+				},
+			},
+			{
+				Type: MsgTypePresence, Name: "PRESENCE",
+				PktNum:      "Zero",
+				Description: "Unreliable presence update",
+				Payloads: []PayloadFormat{{Fields: []Field{
+					{Name: "Status", Bits: 8, Description: "0x0 online, 0x1 away, 0x2 typing, 0x3 offline"},
+					{Name: "Target Address", Bits: 32, Optional: true, Description: "Peer that is typed to, typing only"},
+				}}},
+			},
+			{
+				Type: MsgTypeRebind, Name: "REBIND", Sequenced: true,
+				Description: "Tells the neighbors that the socket of the sender moved, sent from the new address",
+				Payloads: []PayloadFormat{{Fields: []Field{
+					bootEpochField,
+					{Name: "Old IPv4 Address", Bits: 32},
+					{Name: "Old Port", Bits: 16},
+				}}},
+			},
+		},
+		Extensions: []ExtensionFormat{
+			{Type: ExtTypeAck, Name: "Ack", Description: "Piggybacked acknowledgment", Value: []Field{{Name: "Acknowledged Packet Number", Bits: 32}}},
+			{Type: ExtTypeMAC, Name: "MAC", Description: "Truncated HMAC-SHA256 over the packet with zero checksum and MAC, always the last extension", Value: []Field{{Name: "MAC", Bits: MAC_SIZE * 8}}},
+			{Type: ExtTypeFileSize, Name: "FileSize", Description: "Size of the file, on the metadata packet of a file transfer", Value: []Field{{Name: "Size", Bits: 64}}},
+			{Type: ExtTypeNodeID, Name: "NodeID", Description: "Node ID of the sender of a CONNECT that differs from its IP address", Value: []Field{{Name: "Node ID", Bits: 32}}},
+			{Type: ExtTypeHopARQ, Name: "HopARQ", Description: "Announces hop-by-hop retransmission support on a CONNECT and its ACK"},
+			{Type: ExtTypeHopSeq, Name: "HopSeq", Description: "Asks the next hop to acknowledge a forwarded packet", Value: []Field{{Name: "Hop Sequence Number", Bits: 32}}},
+			{Type: ExtTypeHopAck, Name: "HopAck", Description: "Makes an ACK a hop ACK", Value: []Field{{Name: "Acknowledged Hop Sequence Number", Bits: 32}}},
+			{Type: ExtTypePath, Name: "Path", Description: "Path recorded by the source and the forwarding nodes", Value: []Field{{Name: "Hop Address", Bits: 32, Repeated: true}}},
+			{Type: ExtTypeDDRequest, Name: "DDRequest", Description: "Asks the receiver of a DD to reply with its DD with sequence numbers"},
+			{Type: ExtTypeDDSeqNums, Name: "DDSeqNums", Description: "Marks a DD whose entries carry sequence numbers"},
+			{Type: ExtTypeCE, Name: "CE", Description: "Congestion experienced, set by a forwarding node with a congested send queue"},
+			{Type: ExtTypeCEEcho, Name: "CEEcho", Description: "Echoes a congestion mark to the source of the marked packet", Value: []Field{{Name: "Marked Packet Number", Bits: 32}}},
+			{Type: ExtTypeTimestamp, Name: "Timestamp", Description: "Asks the destination to echo the send time for a clock offset estimate", Value: []Field{{Name: "Send Time", Bits: 64, Description: "Unix nanoseconds"}}},
+			{Type: ExtTypeTimeEcho, Name: "TimeEcho", Description: "Echoes a Timestamp extension to its source", Value: []Field{
+				{Name: "Echoed Send Time", Bits: 64, Description: "Unix nanoseconds in the clock of the receiver of the echo"},
+				{Name: "Receive Time", Bits: 64, Description: "Unix nanoseconds"},
+				{Name: "Send Time", Bits: 64, Description: "Unix nanoseconds"},
+			}},
+			{Type: ExtTypeCapabilities, Name: "Capabilities", Description: "Announces the protocol version and capabilities of the sender on a CONNECT and its ACK", Value: []Field{
+				{Name: "Protocol Version", Bits: 8},
+				{Name: "Capability Flags", Bits: 16, Description: "Bit 0 compression, bit 1 SACK, bit 2 CRC32C, bit 3 encryption, bit 4 single-packet messages, unknown bits are ignored"},
+				{Name: "Maximum Payload Size", Bits: 16, Description: "Largest payload in bytes the sender can receive"},
+			}},
+			{Type: ExtTypeRoom, Name: "Room", Description: "Marks a chat message as room traffic between a room host and its members, the payload depends on the operation", Value: []Field{
+				{Name: "Room Operation", Bits: 8},
+				{Name: "Room Name", Bits: 8, Repeated: true},
+			}},
+			{Type: ExtTypeUnreliable, Name: "Unreliable", Description: "Marks a chat message as a complete single-packet message with packet number zero that is neither sequenced nor acknowledged", Value: []Field{{Name: "Send Time", Bits: 64, Description: "Unix nanoseconds"}}},
+			{Type: ExtTypeFinish, Name: "Finish", Description: "Makes a chat message of one packet its own FIN, only sent to neighbors that announced the single-packet capability", Value: []Field{
+				{Name: "Send Time", Bits: 64, Description: "Unix nanoseconds"},
+				{Name: "Boot Epoch", Bits: 64, Description: "Boot epoch of the sender, the message ID is completed by the packet number of the message"},
+			}},
+			{Type: ExtTypePublicKey, Name: "PublicKey", Description: "Announces the public key the sender signs its LSAs with on a CONNECT and its ACK", Value: []Field{{Name: "Public Key", Bits: 256, Description: "Ed25519"}}},
+			{Type: ExtTypeConnectSignature, Name: "ConnectSignature", Description: "Ed25519 signature of a CONNECT with the announced public key over source and destination address, packet number and payload, proves a node ID", Value: []Field{{Name: "Signature", Bits: 512}}},
+		},
+	}
+}
+
+// FindMessageType returns the format of a message type.
+// Returns false for message types that aren't built into the protocol.
+func (w WireFormat) FindMessageType(msgType byte) (MessageFormat, bool) {
+	for _, msg := range w.MessageTypes {
+		if msg.Type == msgType {
+			return msg, true
+		}
+	}
+	return MessageFormat{}, false
+}
+
+// FindExtension returns the format of an extension type.
+// Returns false for unknown extension types.
+func (w WireFormat) FindExtension(extType byte) (ExtensionFormat, bool) {
+	for _, ext := range w.Extensions {
+		if ext.Type == extType {
+			return ext, true
+		}
+	}
+	return ExtensionFormat{}, false
+}
+
+// AcceptsPayloadLength returns whether a payload of n bytes fits one of the payload layouts of the message type.
+func (m MessageFormat) AcceptsPayloadLength(n int) bool {
+	for _, payload := range m.Payloads {
+		if fieldsAcceptLength(payload.Fields, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptsValueLength returns whether a value of n bytes fits the value layout of the extension type.
+func (e ExtensionFormat) AcceptsValueLength(n int) bool {
+	return fieldsAcceptLength(e.Value, n)
+}
+
+// fieldsAcceptLength returns whether n bytes fit the byte-aligned fields.
+// Optional fields may end the layout, a variable field takes the rest and a repeated group must repeat completely.
+func fieldsAcceptLength(fields []Field, n int) bool {
+	length := 0
+	for i, field := range fields {
+		if field.Optional && n == length {
+			return true
+		}
+		if field.Bits == 0 {
+			return n >= length
+		}
+		if field.Repeated {
+			group := 0
+			for _, member := range fields[i:] {
+				group += member.Bits / 8
+			}
+			return n >= length && (n-length)%group == 0
+		}
+		length += field.Bits / 8
+	}
+	return n == length
+}
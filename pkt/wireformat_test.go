@@ -0,0 +1,99 @@
+package pkt
+
+import "testing"
+
+func TestWireFormatMatchesCode(t *testing.T) {
+	format := DescribeWireFormat()
+
+	headerBits := 0
+	for _, field := range format.Header {
+		headerBits += field.Bits
+	}
+	if headerBits != HEADER_SIZE*8 {
+		t.Errorf("Documented header has %d bits, want %d", headerBits, HEADER_SIZE*8)
+	}
+
+	prefixBits := 0
+	for _, field := range format.ExtensionPrefix {
+		prefixBits += field.Bits
+	}
+	if prefixBits != extensionPrefixSize*8 {
+		t.Errorf("Documented extension prefix has %d bits, want %d", prefixBits, extensionPrefixSize*8)
+	}
+
+	msgTypes := []byte{
+		MsgTypeConnect, MsgTypeDisconnect, MsgTypeDD, MsgTypeLSA, MsgTypeChatMessage, MsgTypeFileTransfer, MsgTypeAcknowledgment,
+		MsgTypeFinish, MsgTypeMTUProbe, MsgTypeIntroduce, MsgTypeRelay, MsgTypeAbort, MsgTypePresence, MsgTypeRebind,
+	}
+	documented := make(map[byte]int)
+	for _, msg := range format.MessageTypes {
+		documented[msg.Type]++
+		if !msg.Sequenced && msg.PktNum == "" {
+			t.Errorf("Unsequenced message type %s doesn't describe its packet number", msg.Name)
+		}
+	}
+	for _, msgType := range msgTypes {
+		if documented[msgType] != 1 {
+			t.Errorf("Message type 0x%X is documented %d times, want once", msgType, documented[msgType])
+		}
+	}
+	if len(format.MessageTypes) != len(msgTypes) {
+		t.Errorf("%d message types are documented, want %d", len(format.MessageTypes), len(msgTypes))
+	}
+
+	extTypes := make(map[byte]bool)
+	for _, ext := range format.Extensions {
+		if extTypes[ext.Type] {
+			t.Errorf("Extension type 0x%X is documented twice", ext.Type)
+		}
+		extTypes[ext.Type] = true
+	}
+	for extType := byte(ExtTypeAck); extType <= ExtTypeTimeEcho; extType++ {
+		if !extTypes[extType] {
+			t.Errorf("Extension type 0x%X isn't documented", extType)
+		}
+	}
+}
+
+func TestWireFormatPayloadLengths(t *testing.T) {
+	format := DescribeWireFormat()
+
+	tests := []struct {
+		msgType byte
+		lengths map[int]bool
+	}{
+		{MsgTypeConnect, map[int]bool{8: true, 14: true, 12: false, 0: false}},
+		{MsgTypeDisconnect, map[int]bool{0: true, 1: false}},
+		{MsgTypeDD, map[int]bool{0: true, 8: true, 12: true, 6: false}},
+		{MsgTypeLSA, map[int]bool{16: true, 24: true, 12: false, 18: false}},
+		{MsgTypeFinish, map[int]bool{4: true, 12: true, 24: true, 8: false, 16: false}},
+		{MsgTypeMTUProbe, map[int]bool{1: true, 3: true, 1200: true, 0: false}},
+		{MsgTypeAbort, map[int]bool{2: true, 1: false, 3: false}},
+		{MsgTypePresence, map[int]bool{1: true, 5: true, 2: false}},
+		{MsgTypeRelay, map[int]bool{5: true, 5 + HEADER_SIZE: true, 4: false}},
+	}
+	for _, test := range tests {
+		msg, found := format.FindMessageType(test.msgType)
+		if !found {
+			t.Fatalf("Message type 0x%X isn't documented", test.msgType)
+		}
+		for length, want := range test.lengths {
+			if got := msg.AcceptsPayloadLength(length); got != want {
+				t.Errorf("%s accepts a payload of %d bytes: %v, want %v", msg.Name, length, got, want)
+			}
+		}
+	}
+
+	if _, found := format.FindMessageType(0xE); found {
+		t.Errorf("Unused message type 0xE is documented")
+	}
+
+	path, _ := format.FindExtension(ExtTypePath)
+	if !path.AcceptsValueLength(8) || path.AcceptsValueLength(6) {
+		t.Errorf("Path extension doesn't accept exactly multiples of 4 bytes")
+	}
+	ce, _ := format.FindExtension(ExtTypeCE)
+	if !ce.AcceptsValueLength(0) || ce.AcceptsValueLength(1) {
+		t.Errorf("CE extension doesn't accept exactly an empty value")
+	}
+}
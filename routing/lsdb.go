@@ -2,15 +2,25 @@ package routing
 
 import (
 	"net/netip"
+	"time"
 
-	"bjoernblessin.de/chatprotogol/util/assert"
+	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
 type LSAEntry struct {
 	SeqNum    uint32 // The sequence number ("version") of the LSA
 	Neighbors []netip.Addr
+	Stub      bool // The owner doesn't forward packets of other hosts (standby), it's reachable but routes don't pass through it
+
+	Updated      time.Time  // When the LSA was stored
+	ReceivedFrom netip.Addr // Neighbor the LSA was received from, invalid for the local LSA
+	Signature    []byte     // Public key and signature of the owner to flood the LSA with, nil for unsigned LSAs and the local LSA
 }
 
+// StubMarker is appended to the neighbors of a stub LSA on the wire.
+// Hosts that don't know the marker treat it as a neighbor without an LSA, which is never routable.
+var StubMarker = netip.IPv4Unspecified()
+
 // recalculateLocalLSA recalculates the local LSA.
 // The sequence number is incremented for the local address.
 func (r *Router) recalculateLocalLSA() {
@@ -19,6 +29,8 @@ func (r *Router) recalculateLocalLSA() {
 	localLSA := LSAEntry{
 		SeqNum:    r.getNextSequenceNumber(localAddr),
 		Neighbors: make([]netip.Addr, 0, len(r.neighborTable)),
+		Stub:      r.stub,
+		Updated:   r.clock.Now(),
 	}
 
 	for neighborAddr := range r.neighborTable {
@@ -28,16 +40,25 @@ func (r *Router) recalculateLocalLSA() {
 	r.lsdb[localAddr] = localLSA
 }
 
-// updateLSA adds a new LSA to the LSDB.
-// Asserts that the sequence number is greater than any existing LSA for the same address.
-func (r *Router) updateLSA(addr netip.Addr, seqNum uint32, neighbors []netip.Addr) {
+// updateLSA adds a new LSA received from the neighbor receivedFrom to the LSDB.
+// An LSA with an older or equal sequence number than the existing LSA for the same address is ignored.
+// Returns whether the LSDB was updated.
+func (r *Router) updateLSA(addr netip.Addr, seqNum uint32, neighbors []netip.Addr, stub bool, receivedFrom netip.Addr, signature []byte) bool {
 	existingLSA, exists := r.lsdb[addr]
-	assert.Assert(!(exists && existingLSA.SeqNum >= seqNum), "Cannot add LSA with older or equal sequence number")
+	if exists && existingLSA.SeqNum >= seqNum {
+		logger.Warnf("Ignoring LSA of %s with sequence number %d, existing LSA has %d", addr, seqNum, existingLSA.SeqNum)
+		return false
+	}
 
 	r.lsdb[addr] = LSAEntry{
-		SeqNum:    seqNum,
-		Neighbors: neighbors,
+		SeqNum:       seqNum,
+		Neighbors:    neighbors,
+		Stub:         stub,
+		Updated:      r.clock.Now(),
+		ReceivedFrom: receivedFrom,
+		Signature:    signature,
 	}
+	return true
 }
 
 // getNextSequenceNumber returns the next sequence number for the given address's LSA.
@@ -0,0 +1,97 @@
+package routing
+
+import (
+	"net/netip"
+)
+
+// LSDBStats describes the fill level of the LSDB, see SetMaxLSAs.
+type LSDBStats struct {
+	Size       int    // Number of LSAs in the LSDB, including the local LSA
+	Max        int    // Maximum number of LSAs
+	Evicted    uint64 // Unreachable LSAs evicted for new LSAs since the start
+	Rejected   uint64 // New LSAs rejected since the start because no LSA could be evicted
+	Overloaded bool   // The LSDB is full and no LSA can be evicted, see IsOverloaded
+}
+
+// SetMaxLSAs sets the maximum number of LSAs in the LSDB, common.MAX_LSDB_ENTRIES by default.
+// LSAs already in the LSDB are kept, even if they exceed max.
+// Can be called concurrently.
+func (r *Router) SetMaxLSAs(max int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.maxLSAs = max
+}
+
+// IsOverloaded returns whether the LSDB is full and none of its LSAs is unreachable, so new LSAs are rejected.
+// New neighbors should be refused while the router is overloaded, they would only add LSAs that don't fit.
+// Can be called concurrently.
+func (r *Router) IsOverloaded() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.isOverloaded()
+}
+
+// GetLSDBStats returns the fill level of the LSDB.
+// Can be called concurrently.
+func (r *Router) GetLSDBStats() LSDBStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return LSDBStats{
+		Size:       len(r.lsdb),
+		Max:        r.maxLSAs,
+		Evicted:    r.evictedLSAs.Load(),
+		Rejected:   r.rejectedLSAs.Load(),
+		Overloaded: r.isOverloaded(),
+	}
+}
+
+func (r *Router) isOverloaded() bool {
+	if len(r.lsdb) < r.maxLSAs {
+		return false
+	}
+	_, evictable := r.oldestUnreachableLSA()
+	return !evictable
+}
+
+// makeRoomForLSA evicts the oldest unreachable LSAs until the LSA of owner fits into the LSDB.
+// Evicted LSAs aren't in the routing table, so the routes don't change.
+// Returns false if the LSA doesn't fit because no more LSAs can be evicted.
+func (r *Router) makeRoomForLSA(owner netip.Addr) bool {
+	if _, exists := r.lsdb[owner]; exists {
+		return true // Replaces the existing LSA
+	}
+
+	for len(r.lsdb) >= r.maxLSAs {
+		oldest, evictable := r.oldestUnreachableLSA()
+		if !evictable {
+			return false
+		}
+		delete(r.lsdb, oldest)
+		r.evictedLSAs.Add(1)
+	}
+	return true
+}
+
+// oldestUnreachableLSA returns the owner of the least recently updated LSA that isn't in the routing table.
+// The local LSA is never returned.
+func (r *Router) oldestUnreachableLSA() (owner netip.Addr, found bool) {
+	localAddr := r.socket.MustGetLocalAddress().Addr()
+	routingTable := r.table()
+
+	var oldest LSAEntry
+	for addr, lsa := range r.lsdb {
+		if addr == localAddr {
+			continue
+		}
+		if _, routable := routingTable[addr]; routable {
+			continue
+		}
+		if !found || lsa.Updated.Before(oldest.Updated) {
+			owner, oldest, found = addr, lsa, true
+		}
+	}
+	return owner, found
+}
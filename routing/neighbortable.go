@@ -3,7 +3,7 @@ package routing
 import (
 	"net/netip"
 
-	"bjoernblessin.de/chatprotogol/util/assert"
+	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
 // NeighborEntry represents a neighbor in the neighbor table.
@@ -12,19 +12,22 @@ type NeighborEntry struct {
 }
 
 // addNeighbor adds a new neighbor to the neighbor table.
-// It checks if the neighbor already exists and asserts that it does not.
-func (r *Router) addNeighbor(nextHop netip.AddrPort) {
-	_, exists := r.neighborTable[nextHop.Addr()]
-	assert.Assert(!exists, "Neighbor already exists in the neighbor table: %s", nextHop.Addr().String())
+// If the neighbor already exists, only its next hop is updated.
+func (r *Router) addNeighbor(addr netip.Addr, nextHop netip.AddrPort) {
+	if _, exists := r.neighborTable[addr]; exists {
+		logger.Warnf("Neighbor already exists in the neighbor table: %s", addr)
+	}
 
-	r.neighborTable[nextHop.Addr()] = NeighborEntry{NextHop: nextHop}
+	r.neighborTable[addr] = NeighborEntry{NextHop: nextHop}
 }
 
 // removeNeighbor removes a neighbor from the neighbor table.
-// Asserts that the neighbor exists before removing it.
+// Removing a neighbor that doesn't exist logs a warning and does nothing.
 func (r *Router) removeNeighbor(addr netip.Addr) {
-	_, exists := r.neighborTable[addr]
-	assert.Assert(exists, "Neighbor does not exist in the neighbor table: %s", addr.String())
+	if _, exists := r.neighborTable[addr]; !exists {
+		logger.Warnf("Neighbor does not exist in the neighbor table: %s", addr)
+		return
+	}
 
 	delete(r.neighborTable, addr)
 }
@@ -0,0 +1,58 @@
+package routing
+
+import (
+	"net/netip"
+)
+
+// Policy decides which LSAs the router accepts into the LSDB and which LSAs are flooded to the neighbors.
+// Embedders implement it to e.g. reject LSAs of certain origins, limit the LSDB size or keep selected hosts from being advertised.
+// Its methods are called with the router's lock held, so they must not call the router.
+type Policy interface {
+	// AcceptLSA returns whether the LSA of owner received from a neighbor is stored in the LSDB.
+	// lsdbSize is the number of LSAs of other hosts in the LSDB, including the local LSA.
+	AcceptLSA(owner netip.Addr, lsa LSAEntry, lsdbSize int) bool
+	// FloodLSA returns whether the LSA of owner is flooded to the neighbors, this includes the local LSA.
+	FloodLSA(owner netip.Addr, lsa LSAEntry) bool
+}
+
+// AllowAll is the default policy, it accepts and floods every LSA.
+type AllowAll struct{}
+
+func (AllowAll) AcceptLSA(owner netip.Addr, lsa LSAEntry, lsdbSize int) bool {
+	return true
+}
+
+func (AllowAll) FloodLSA(owner netip.Addr, lsa LSAEntry) bool {
+	return true
+}
+
+// SetPolicy replaces the policy of the router, nil restores AllowAll.
+// LSAs already in the LSDB are kept, the policy applies to the LSAs received and flooded afterwards.
+// Can be called concurrently.
+func (r *Router) SetPolicy(policy Policy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if policy == nil {
+		policy = AllowAll{}
+	}
+	r.policy = policy
+}
+
+// ShouldFloodLSA returns whether the policy allows flooding the LSA of owner to the neighbors.
+// Can be called concurrently.
+func (r *Router) ShouldFloodLSA(owner netip.Addr, lsa LSAEntry) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.policy.FloodLSA(owner, lsa)
+}
+
+// acceptLSA returns whether the policy allows storing the LSA of owner in the LSDB.
+func (r *Router) acceptLSA(owner netip.Addr, lsa LSAEntry) bool {
+	lsdbSize := len(r.lsdb)
+	if _, exists := r.lsdb[owner]; exists {
+		lsdbSize--
+	}
+	return r.policy.AcceptLSA(owner, lsa, lsdbSize)
+}
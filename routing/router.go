@@ -4,26 +4,58 @@ import (
 	"net/netip"
 	"slices"
 	"sync"
+	"sync/atomic"
 
+	"bjoernblessin.de/chatprotogol/common"
 	"bjoernblessin.de/chatprotogol/sock"
 	"bjoernblessin.de/chatprotogol/util/assert"
+	"bjoernblessin.de/chatprotogol/util/clock"
+	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
 type Router struct {
 	lsdb          map[netip.Addr]LSAEntry // Link State Database (LSDB) that holds the Link State Advertisements (LSAs) of every host (including the local LSA)
 	socket        sock.Socket
 	neighborTable map[netip.Addr]NeighborEntry
-	routingTable  map[netip.Addr]netip.AddrPort // Maps destination IP addresses to the next hop they should use
-	mu            sync.Mutex                    // Protects access to the router's state, including the LSDB, neighbor table, and routing table
+	stub          bool                                          // Whether the local LSA advertises us as non-forwarding
+	routingTable  atomic.Pointer[map[netip.Addr]netip.AddrPort] // Maps destination IP addresses to the next hop they should use; replaced as a whole and never modified, so it's read without mu
+	hopCounts     atomic.Pointer[map[netip.Addr]int]            // Maps destination IP addresses to the number of hops of their route; replaced together with routingTable
+	predecessors  atomic.Pointer[map[netip.Addr]netip.Addr]     // Maps destination IP addresses to the previous host of their route, neighbors have none; replaced together with routingTable
+	upstreamIndex atomic.Pointer[upstreamIndex]                 // Neighbors the packets of a host may arrive through, see IsOnPath; replaced together with routingTable
+	mu            sync.Mutex                                    // Protects access to the router's state, including the LSDB and neighbor table, and serializes routing table updates
+	clock         clock.Clock                                   // Time source of the LSA timestamps
+	routeChanges  atomic.Uint64                                 // Routes added, removed or moved to another next hop since the start, see RouteChanges
+	staticRoutes  map[netip.Addr]netip.Addr                     // Maps destination IP addresses to the neighbor their packets are sent to, overriding the computed routes, see AddStaticRoute
+	policy        Policy                                        // Decides which LSAs are accepted and flooded, see SetPolicy
+	maxLSAs       int                                           // Maximum number of LSAs in the LSDB, see SetMaxLSAs
+	evictedLSAs   atomic.Uint64                                 // Unreachable LSAs evicted for new LSAs since the start
+	rejectedLSAs  atomic.Uint64                                 // New LSAs rejected since the start because the LSDB was full
 }
 
 func NewRouter(socket sock.Socket) *Router {
-	return &Router{
+	r := &Router{
 		lsdb:          make(map[netip.Addr]LSAEntry),
 		socket:        socket,
 		neighborTable: make(map[netip.Addr]NeighborEntry),
-		routingTable:  make(map[netip.Addr]netip.AddrPort),
+		staticRoutes:  make(map[netip.Addr]netip.Addr),
+		policy:        AllowAll{},
+		maxLSAs:       common.MAX_LSDB_ENTRIES,
+		clock:         clock.Real,
 	}
+	r.routingTable.Store(&map[netip.Addr]netip.AddrPort{})
+	r.hopCounts.Store(&map[netip.Addr]int{})
+	r.predecessors.Store(&map[netip.Addr]netip.Addr{})
+	r.upstreamIndex.Store(&upstreamIndex{})
+	return r
+}
+
+// SetClock replaces the time source of the router, e.g. with a clock.Virtual in tests.
+// Must be called before the router is used.
+func (r *Router) SetClock(c clock.Clock) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clock = c
 }
 
 // AddNeighbor adds a new neighbor to the router.
@@ -32,10 +64,17 @@ func NewRouter(socket sock.Socket) *Router {
 // Returns a slice of unreachable addresses that are safe to clear state for.
 // Can be called concurrently.
 func (r *Router) AddNeighbor(nextHop netip.AddrPort) {
+	r.AddNeighborVia(nextHop.Addr(), nextHop)
+}
+
+// AddNeighborVia acts like AddNeighbor but the neighbor's address differs from the UDP address it is reached at.
+// This is the case for neighbors behind a NAT, they are reached at their external address.
+// Can be called concurrently.
+func (r *Router) AddNeighborVia(addr netip.Addr, nextHop netip.AddrPort) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	r.addNeighbor(nextHop)
+	r.addNeighbor(addr, nextHop)
 	localAddr := r.socket.MustGetLocalAddress().Addr()
 	oldLocalLSA := r.lsdb[localAddr] // oldLocalLSA may be the zero value
 	r.recalculateLocalLSA()
@@ -62,16 +101,81 @@ func (r *Router) RemoveNeighbor(addr netip.Addr) (unreachableHosts []netip.Addr)
 	return r.getUnreachableHosts(notRoutable, localAddr, oldLocalLSA)
 }
 
-// UpdateLSA adds a new LSA to the router.
+// UpdateNeighborNextHop changes the address a neighbor is reached at, e.g. after the neighbor moved to a new network address.
+// The topology doesn't change, only the routes through the neighbor are updated.
+// Returns false if addr isn't a neighbor.
+// Can be called concurrently.
+func (r *Router) UpdateNeighborNextHop(addr netip.Addr, nextHop netip.AddrPort) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if isNeighbor, _ := r.isNeighbor(addr); !isNeighbor {
+		return false
+	}
+
+	r.neighborTable[addr] = NeighborEntry{NextHop: nextHop}
+	r.buildRoutingTable()
+	return true
+}
+
+// SetStub sets whether we advertise ourselves as non-forwarding, e.g. during planned maintenance.
+// Neighbor relationships are kept, other hosts only stop routing through us.
+// Returns whether the local LSA changed and must be flooded.
+// Can be called concurrently.
+func (r *Router) SetStub(stub bool) (changed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stub == stub {
+		return false
+	}
+
+	r.stub = stub
+	r.recalculateLocalLSA()
+	r.buildRoutingTable() // Our own routes don't pass through us, no host becomes unreachable
+	return true
+}
+
+// IsStub returns whether we advertise ourselves as non-forwarding.
+// Can be called concurrently.
+func (r *Router) IsStub() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.stub
+}
+
+// UpdateLSA adds a new LSA received from the neighbor receivedFrom to the router.
 // It updates the LSA in the LSDB and builds the routing table.
+// Stub LSAs don't remove any neighbor relationship, so hosts only reachable through a stub host are not routable but aren't considered unreachable.
+// LSAs the policy rejects are ignored, see SetPolicy.
+// If the LSDB is full, the oldest unreachable LSAs are evicted for the LSA of a new host; if none is unreachable, the LSA is ignored.
 // Returns a slice of unreachable addresses that are safe to clear state for.
 // Can be called concurrently.
-func (r *Router) UpdateLSA(srcAddr netip.Addr, seqNum uint32, neighborAddresses []netip.Addr) (unreachableHosts []netip.Addr) {
+func (r *Router) UpdateLSA(srcAddr netip.Addr, seqNum uint32, neighborAddresses []netip.Addr, stub bool, receivedFrom netip.Addr) (unreachableHosts []netip.Addr) {
+	return r.UpdateSignedLSA(srcAddr, seqNum, neighborAddresses, stub, receivedFrom, nil)
+}
+
+// UpdateSignedLSA acts like UpdateLSA but stores the signature of the owner, so the LSA is flooded with it.
+// The signature must have been verified, the router doesn't interpret it.
+// Can be called concurrently.
+func (r *Router) UpdateSignedLSA(srcAddr netip.Addr, seqNum uint32, neighborAddresses []netip.Addr, stub bool, receivedFrom netip.Addr, signature []byte) (unreachableHosts []netip.Addr) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	oldLSA := r.lsdb[srcAddr] // oldLSA may be the zero value
-	r.updateLSA(srcAddr, seqNum, neighborAddresses)
+	if !r.acceptLSA(srcAddr, LSAEntry{SeqNum: seqNum, Neighbors: neighborAddresses, Stub: stub, ReceivedFrom: receivedFrom, Signature: signature}) {
+		logger.Debugf("Ignoring LSA of %s with sequence number %d, rejected by the routing policy", srcAddr, seqNum)
+		return nil
+	}
+	if !r.makeRoomForLSA(srcAddr) {
+		r.rejectedLSAs.Add(1)
+		logger.Warnf("Ignoring LSA of %s, the LSDB is full (%d LSAs) and none of its LSAs is unreachable", srcAddr, len(r.lsdb))
+		return nil
+	}
+	if !r.updateLSA(srcAddr, seqNum, neighborAddresses, stub, receivedFrom, signature) {
+		return nil
+	}
 	notRoutable := r.buildRoutingTable()
 	return r.getUnreachableHosts(notRoutable, srcAddr, oldLSA)
 }
@@ -104,7 +208,7 @@ func (r *Router) getUnreachableHosts(notRoutableHosts []netip.Addr, lsaOwner net
 	}
 
 	// Check if the removed neighbor is still reachable
-	_, exists = r.routingTable[removedNeighbor]
+	_, exists = r.table()[removedNeighbor]
 	if exists || removedNeighbor == r.socket.MustGetLocalAddress().Addr() { // We aren't "routable" but still considered reachable
 		// The removed neighbor is still routable, so no hosts are unreachable
 		return nil
@@ -150,6 +254,10 @@ func (r *Router) getUnreachableHosts(notRoutableHosts []netip.Addr, lsaOwner net
 		}
 
 		visited[node] = true
+		if _, routable := r.table()[node]; routable {
+			// Still reachable on another path, the LSA that led here may list a link that is gone already
+			continue
+		}
 		// assert.Assert(len(unreachableHosts) < len(notRoutableHosts), "Unreachable hosts slice should not exceed notRoutableHosts length") // TODO
 		if node == r.socket.MustGetLocalAddress().Addr() { // TODO shouldn't happen
 			// If the local address is in the unreachable hosts, we don't want to add it to the unreachable hosts list
@@ -4,8 +4,145 @@ import (
 	"maps"
 	"net/netip"
 	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/util/clock"
 )
 
+func TestLSATimestampsUseClock(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	virtual := clock.NewVirtual(start)
+	router := NewRouter(&mockSocket{})
+	router.SetClock(virtual)
+
+	owner := netip.MustParseAddr("10.0.0.9")
+	router.UpdateLSA(owner, 1, nil, false, owner)
+	virtual.Advance(time.Hour)
+	router.UpdateLSA(owner, 1, nil, false, owner) // Same sequence number, ignored
+
+	lsa, found := router.GetLSA(owner)
+	if !found {
+		t.Fatalf("Expected an LSA of %s", owner)
+	}
+	if age := virtual.Now().Sub(lsa.Updated); age != time.Hour {
+		t.Errorf("Expected the LSA to be an hour old, got %v", age)
+	}
+
+	router.UpdateLSA(owner, 2, nil, false, owner)
+	if lsa, _ := router.GetLSA(owner); !lsa.Updated.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected the newer LSA to be stored at %v, got %v", start.Add(time.Hour), lsa.Updated)
+	}
+}
+
+// testPolicy rejects the LSAs of one origin, limits the LSDB size and doesn't flood the LSAs of one host.
+type testPolicy struct {
+	rejected   netip.Addr
+	maxLSAs    int
+	notFlooded netip.Addr
+}
+
+func (p testPolicy) AcceptLSA(owner netip.Addr, lsa LSAEntry, lsdbSize int) bool {
+	return owner != p.rejected && lsdbSize < p.maxLSAs
+}
+
+func (p testPolicy) FloodLSA(owner netip.Addr, lsa LSAEntry) bool {
+	return owner != p.notFlooded
+}
+
+func TestPolicy(t *testing.T) {
+	router := NewRouter(&mockSocket{})
+	rejected := netip.MustParseAddr("10.0.0.2")
+	accepted := netip.MustParseAddr("10.0.0.3")
+	overLimit := netip.MustParseAddr("10.0.0.4")
+
+	if !router.ShouldFloodLSA(rejected, LSAEntry{}) {
+		t.Errorf("Expected the default policy to flood every LSA")
+	}
+
+	router.SetPolicy(testPolicy{rejected: rejected, maxLSAs: 1, notFlooded: accepted})
+
+	router.UpdateLSA(rejected, 1, nil, false, rejected)
+	if _, found := router.GetLSA(rejected); found {
+		t.Errorf("Expected the LSA of %s to be rejected", rejected)
+	}
+
+	router.UpdateLSA(accepted, 1, nil, false, accepted)
+	router.UpdateLSA(overLimit, 1, nil, false, overLimit)
+	if _, found := router.GetLSA(overLimit); found {
+		t.Errorf("Expected the LSA of %s to exceed the LSDB limit", overLimit)
+	}
+
+	router.UpdateLSA(accepted, 2, nil, false, accepted)
+	if lsa, _ := router.GetLSA(accepted); lsa.SeqNum != 2 {
+		t.Errorf("Expected a newer LSA of a stored host to be accepted at the LSDB limit, got seqnum %d", lsa.SeqNum)
+	}
+	if router.ShouldFloodLSA(accepted, LSAEntry{SeqNum: 2}) {
+		t.Errorf("Expected the LSA of %s not to be flooded", accepted)
+	}
+
+	router.SetPolicy(nil)
+	router.UpdateLSA(rejected, 1, nil, false, rejected)
+	if _, found := router.GetLSA(rejected); !found {
+		t.Errorf("Expected the LSA of %s to be accepted after restoring the default policy", rejected)
+	}
+}
+
+func TestLSDBCap(t *testing.T) {
+	virtual := clock.NewVirtual(time.Unix(1700000000, 0))
+	router := NewRouter(&mockSocket{})
+	router.SetClock(virtual)
+	localAddr := netip.MustParseAddr(LOCAL_ADDR)
+	neighbor := netip.MustParseAddr("10.0.0.2")
+	unreachableOld := netip.MustParseAddr("10.0.0.3")
+	unreachableNew := netip.MustParseAddr("10.0.0.4")
+
+	router.AddNeighbor(netip.AddrPortFrom(neighbor, LOCAL_PORT))
+	router.UpdateLSA(neighbor, 1, []netip.Addr{localAddr}, false, neighbor)
+	router.UpdateLSA(unreachableOld, 1, nil, false, neighbor)
+	virtual.Advance(time.Second)
+	router.UpdateLSA(unreachableNew, 1, nil, false, neighbor)
+	router.SetMaxLSAs(4)
+
+	if router.IsOverloaded() {
+		t.Errorf("Expected a full LSDB with unreachable LSAs not to be overloaded")
+	}
+
+	newHost := netip.MustParseAddr("10.0.0.5")
+	router.UpdateLSA(newHost, 1, nil, false, neighbor)
+	if _, found := router.GetLSA(newHost); !found {
+		t.Fatalf("Expected the LSA of %s to replace an unreachable LSA", newHost)
+	}
+	if _, found := router.GetLSA(unreachableOld); found {
+		t.Errorf("Expected the oldest unreachable LSA of %s to be evicted", unreachableOld)
+	}
+	if _, found := router.GetLSA(unreachableNew); !found {
+		t.Errorf("Expected the newer unreachable LSA of %s to be kept", unreachableNew)
+	}
+
+	// Connect the remaining hosts through the neighbor, nothing can be evicted anymore
+	router.UpdateLSA(neighbor, 2, []netip.Addr{localAddr, unreachableNew, newHost}, false, neighbor)
+	router.UpdateLSA(unreachableNew, 2, []netip.Addr{neighbor}, false, neighbor)
+	router.UpdateLSA(newHost, 2, []netip.Addr{neighbor}, false, neighbor)
+	if !router.IsOverloaded() {
+		t.Fatalf("Expected a full LSDB without unreachable LSAs to be overloaded")
+	}
+
+	rejected := netip.MustParseAddr("10.0.0.6")
+	router.UpdateLSA(rejected, 1, nil, false, neighbor)
+	if _, found := router.GetLSA(rejected); found {
+		t.Errorf("Expected the LSA of %s to be rejected by the overloaded LSDB", rejected)
+	}
+	router.UpdateLSA(newHost, 3, []netip.Addr{neighbor}, false, neighbor)
+	if lsa, _ := router.GetLSA(newHost); lsa.SeqNum != 3 {
+		t.Errorf("Expected newer LSAs of stored hosts to be accepted while overloaded, got seqnum %d", lsa.SeqNum)
+	}
+
+	stats := router.GetLSDBStats()
+	if stats.Size != 4 || stats.Max != 4 || stats.Evicted != 1 || stats.Rejected != 1 || !stats.Overloaded {
+		t.Errorf("Unexpected LSDB stats %+v", stats)
+	}
+}
+
 func TestGetUnreachableHosts(t *testing.T) {
 	n1 := netip.MustParseAddr("10.0.0.1")
 	n2 := netip.MustParseAddr("10.0.0.2")
@@ -131,6 +268,23 @@ func TestGetUnreachableHosts(t *testing.T) {
 			oldLSA:          LSAEntry{Neighbors: []netip.Addr{n1, n4, n5}},
 			expectedUnreach: []netip.Addr{},
 		},
+		{
+			name: "host listed by the stale LSA of the removed neighbor still routable",
+			lsdb: map[netip.Addr]LSAEntry{
+				// n1 <-> n2 <-> n3 <-> n1
+				// n3 dropped n2 before, but the LSA of n2 without n3 wasn't received yet
+				n1: {Neighbors: []netip.Addr{n3}}, // n1 drops n2
+				n2: {Neighbors: []netip.Addr{n1, n3}},
+				n3: {Neighbors: []netip.Addr{n1}},
+			},
+			routingTable: map[netip.Addr]netip.AddrPort{
+				n3: {},
+			},
+			notRoutable:     []netip.Addr{n2},
+			lsaOwner:        n1,
+			oldLSA:          LSAEntry{Neighbors: []netip.Addr{n2, n3}},
+			expectedUnreach: []netip.Addr{n2},
+		},
 		{
 			name: "unreachable host that is not in LSDB is ignored",
 			lsdb: map[netip.Addr]LSAEntry{
@@ -166,12 +320,11 @@ func TestGetUnreachableHosts(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &Router{
-				lsdb:         make(map[netip.Addr]LSAEntry),
-				routingTable: make(map[netip.Addr]netip.AddrPort),
-				socket:       &mockSocket{},
+				lsdb:   make(map[netip.Addr]LSAEntry),
+				socket: &mockSocket{},
 			}
 			maps.Copy(r.lsdb, tt.lsdb)
-			maps.Copy(r.routingTable, tt.routingTable)
+			r.routingTable.Store(&tt.routingTable)
 
 			got := r.getUnreachableHosts(tt.notRoutable, tt.lsaOwner, tt.oldLSA)
 			if !DeepEqualUnordered(got, tt.expectedUnreach) {
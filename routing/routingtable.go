@@ -4,15 +4,14 @@ import (
 	"container/heap"
 	"math"
 	"net/netip"
+	"slices"
 
+	"bjoernblessin.de/chatprotogol/events"
 	"bjoernblessin.de/chatprotogol/util/assert"
 )
 
 func (r *Router) GetNextHop(destinationIP netip.Addr) (addrPort netip.AddrPort, found bool) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	entry, exists := r.routingTable[destinationIP]
+	entry, exists := r.table()[destinationIP]
 	if !exists {
 		return netip.AddrPort{}, false
 	}
@@ -21,18 +20,63 @@ func (r *Router) GetNextHop(destinationIP netip.Addr) (addrPort netip.AddrPort,
 }
 
 // GetRoutingTable returns the current routing table entries.
+// The returned map must not be modified, it is shared with concurrent readers.
 func (r *Router) GetRoutingTable() map[netip.Addr]netip.AddrPort {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	return r.table()
+}
+
+// GetHopCount returns the number of hops of the route to the destination, 1 for neighbors.
+// Can be called concurrently.
+func (r *Router) GetHopCount(destinationIP netip.Addr) (hops int, found bool) {
+	hops, found = (*r.hopCounts.Load())[destinationIP]
+	return hops, found
+}
 
-	return r.routingTable
+// Path is the route to a destination computed from the LSDB.
+type Path struct {
+	Hops []netip.Addr // Hosts the route passes, from the next hop to the destination
+	Cost int          // Total cost of the route, every link costs 1
+}
+
+// GetPath returns the hosts the route to the destination passes, as computed by the last routing table build.
+// Other hosts may break ties between paths of equal cost differently, so packets may take another path of the same cost.
+// Can be called concurrently.
+func (r *Router) GetPath(destinationIP netip.Addr) (path Path, found bool) {
+	predecessors := *r.predecessors.Load()
+	hops, found := (*r.hopCounts.Load())[destinationIP]
+	if !found {
+		return Path{}, false
+	}
+
+	path.Cost = hops
+	path.Hops = make([]netip.Addr, hops)
+	current := destinationIP
+	for i := hops - 1; i >= 0; i-- {
+		if !current.IsValid() {
+			return Path{}, false // Tables of different builds, the route changed concurrently
+		}
+		path.Hops[i] = current
+		current = predecessors[current]
+	}
+	if current.IsValid() {
+		return Path{}, false
+	}
+
+	return path, true
+}
+
+// table returns the current routing table.
+// It doesn't need mu, the routing table is swapped atomically after it was built, so forwarding isn't stalled while routes are computed.
+func (r *Router) table() map[netip.Addr]netip.AddrPort {
+	return *r.routingTable.Load()
 }
 
 type DijkstraNode struct {
 	Addr    netip.Addr
 	NextHop *netip.AddrPort
-	Dist    int // Distance from the source node
-	index   int // Index in the priority queue for heap operations
+	Prev    netip.Addr // Previous host on the shortest path, invalid for neighbors
+	Dist    int        // Distance from the source node
+	index   int        // Index in the priority queue for heap operations
 }
 
 type dijkstraPriorityQueue []*DijkstraNode
@@ -65,9 +109,10 @@ func (pq *dijkstraPriorityQueue) Pop() any {
 	return item
 }
 
-func (pq *dijkstraPriorityQueue) update(node *DijkstraNode, newDist int, nextHop *netip.AddrPort) {
+func (pq *dijkstraPriorityQueue) update(node *DijkstraNode, newDist int, nextHop *netip.AddrPort, prev netip.Addr) {
 	node.Dist = newDist
 	node.NextHop = nextHop
+	node.Prev = prev
 	heap.Fix(pq, node.index)
 }
 
@@ -102,9 +147,23 @@ func (r *Router) buildRoutingTable() (notRoutable []netip.Addr) {
 		})
 	}
 
+	queued := make(map[netip.Addr]*DijkstraNode, len(queue))
+	for i, node := range queue {
+		node.index = i // heap.Init only sets the index of swapped nodes
+		queued[node.Addr] = node
+	}
+
 	heap.Init(&queue)
 
-	r.routingTable = make(map[netip.Addr]netip.AddrPort, len(queue))
+	// The new table is built separately and swapped in when it is complete, readers keep using the old table until then
+	routingTable := make(map[netip.Addr]netip.AddrPort, len(queue))
+	hopCounts := make(map[netip.Addr]int, len(queue))
+	predecessors := make(map[netip.Addr]netip.Addr, len(queue))
+	defer r.upstreamIndex.Store(r.buildUpstreamIndex(localAddr))
+	defer r.routingTable.Store(&routingTable)
+	defer r.hopCounts.Store(&hopCounts)
+	defer r.predecessors.Store(&predecessors)
+
 	notRoutable = make([]netip.Addr, 0)
 
 	for queue.Len() > 0 {
@@ -116,11 +175,19 @@ func (r *Router) buildRoutingTable() (notRoutable []netip.Addr) {
 			continue
 		}
 
-		r.routingTable[currentNode.Addr] = *currentNode.NextHop
+		routingTable[currentNode.Addr] = *currentNode.NextHop
+		hopCounts[currentNode.Addr] = currentNode.Dist
+		if currentNode.Prev.IsValid() {
+			predecessors[currentNode.Addr] = currentNode.Prev
+		}
+
+		if r.lsdb[currentNode.Addr].Stub {
+			continue // Stub hosts are reachable themselves but don't forward packets of other hosts
+		}
 
 		// Update the distance of adjacent nodes that are still unvisited (not in the routing table and not the local address)
 		for _, neighborAddr := range r.lsdb[currentNode.Addr].Neighbors {
-			if _, exists := r.routingTable[neighborAddr]; exists {
+			if _, exists := routingTable[neighborAddr]; exists {
 				continue // Skip if the neighbor is already in the routing table
 			}
 			if neighborAddr == localAddr {
@@ -128,15 +195,8 @@ func (r *Router) buildRoutingTable() (notRoutable []netip.Addr) {
 			}
 
 			// Find the corresponding node in the queue for the neighbor
-			var neighborNode *DijkstraNode
-			for i := range queue.Len() { // TODO optimize using map
-				if queue[i].Addr == neighborAddr {
-					neighborNode = queue[i]
-					break
-				}
-			}
-
-			if neighborNode == nil {
+			neighborNode, exists := queued[neighborAddr]
+			if !exists {
 				// If the neighbor is not in the queue, it means it's LSA is not present (yet) but it's a neighbor of another node where we have the LSA.
 				// We don't add here, the neighbor is considered not routable for now.
 				continue
@@ -144,10 +204,125 @@ func (r *Router) buildRoutingTable() (notRoutable []netip.Addr) {
 
 			// Update the neighbor if a shorter path is found
 			if currentNode.Dist+1 < neighborNode.Dist {
-				queue.update(neighborNode, currentNode.Dist+1, currentNode.NextHop)
+				queue.update(neighborNode, currentNode.Dist+1, currentNode.NextHop, currentNode.Addr)
 			}
 		}
 	}
 
+	notRoutable = r.applyStaticRoutes(routingTable, hopCounts, predecessors, notRoutable)
+	r.countRouteChanges(routingTable)
+
 	return notRoutable
 }
+
+// countRouteChanges adds the routes that differ between the current routing table and the new one to the route changes.
+// A RouteChanged event is published for each of them.
+// Must be called before the new table is stored.
+func (r *Router) countRouteChanges(newTable map[netip.Addr]netip.AddrPort) {
+	oldTable := r.table()
+
+	var changes uint64
+	for dest, nextHop := range newTable {
+		if oldNextHop, exists := oldTable[dest]; !exists || oldNextHop != nextHop {
+			changes++
+			events.RouteChanged.NotifyObservers(events.RouteChangedEvent{Dest: dest, NextHop: nextHop, PrevNextHop: oldNextHop})
+		}
+	}
+	for dest, oldNextHop := range oldTable {
+		if _, exists := newTable[dest]; !exists {
+			changes++
+			events.RouteChanged.NotifyObservers(events.RouteChangedEvent{Dest: dest, PrevNextHop: oldNextHop})
+		}
+	}
+	r.routeChanges.Add(changes)
+}
+
+// RouteChanges returns the number of routes that were added, removed or moved to another next hop since the start.
+// It measures the routing churn, e.g. of flapping links.
+// Can be called concurrently.
+func (r *Router) RouteChanges() uint64 {
+	return r.routeChanges.Load()
+}
+
+// IsOnPath returns whether the neighbor is the last hop of some path from src to us.
+// Packets of src, e.g. ACKs, plausibly arrive through such a neighbor, also if it isn't on a shortest path:
+// src may route by static routes or a policy we don't know about, and the topology may still be converging.
+// Uses the result of the last routing table build, see buildUpstreamIndex.
+// Can be called concurrently.
+func (r *Router) IsOnPath(src netip.Addr, neighbor netip.Addr) bool {
+	index := r.upstreamIndex.Load()
+
+	component, forwards := index.neighbors[neighbor]
+	if !forwards {
+		return false
+	}
+	if srcComponent, exists := index.components[src]; exists {
+		return srcComponent == component
+	}
+	return slices.Contains(index.stubComponents[src], component)
+}
+
+// upstreamIndex tells which neighbors the packets of a host may arrive through, see IsOnPath.
+// Forwarding hosts are grouped in components whose hosts reach each other without passing through us or a stub host.
+type upstreamIndex struct {
+	neighbors      map[netip.Addr]int   // Component of every forwarding neighbor
+	components     map[netip.Addr]int   // Component of every forwarding host
+	stubComponents map[netip.Addr][]int // Components a stub host is linked to, it sends its own packets into each of them
+}
+
+// buildUpstreamIndex groups the hosts of the LSDB in components, see upstreamIndex.
+// Links are followed in both directions, so hosts whose LSA is missing or was rejected by the policy are found through the LSAs of their neighbors.
+func (r *Router) buildUpstreamIndex(localAddr netip.Addr) *upstreamIndex {
+	links := make(map[netip.Addr][]netip.Addr, len(r.lsdb))
+	for addr, lsa := range r.lsdb {
+		for _, neighbor := range lsa.Neighbors {
+			links[addr] = append(links[addr], neighbor)
+			links[neighbor] = append(links[neighbor], addr)
+		}
+	}
+
+	index := &upstreamIndex{
+		neighbors:      make(map[netip.Addr]int, len(r.neighborTable)),
+		components:     make(map[netip.Addr]int, len(links)),
+		stubComponents: make(map[netip.Addr][]int),
+	}
+
+	nextComponent := 0
+	for start := range links {
+		if _, labeled := index.components[start]; labeled || start == localAddr || r.lsdb[start].Stub {
+			continue
+		}
+
+		component := nextComponent
+		nextComponent++
+		index.components[start] = component
+		queue := []netip.Addr{start}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+
+			for _, next := range links[current] {
+				if next == localAddr {
+					continue
+				}
+				if r.lsdb[next].Stub {
+					if !slices.Contains(index.stubComponents[next], component) {
+						index.stubComponents[next] = append(index.stubComponents[next], component)
+					}
+					continue
+				}
+				if _, labeled := index.components[next]; !labeled {
+					index.components[next] = component
+					queue = append(queue, next)
+				}
+			}
+		}
+	}
+
+	for neighbor := range r.neighborTable {
+		if component, forwards := index.components[neighbor]; forwards {
+			index.neighbors[neighbor] = component // Stub neighbors only send their own packets, which are accepted without a path
+		}
+	}
+	return index
+}
@@ -4,10 +4,12 @@ import (
 	"net"
 	"net/netip"
 	"slices"
+	"strings"
 	"testing"
 
 	"fmt"
 
+	"bjoernblessin.de/chatprotogol/events"
 	"bjoernblessin.de/chatprotogol/sock"
 )
 
@@ -39,10 +41,43 @@ func (m *mockSocket) Open(ipv4addr net.IP) (*net.UDPAddr, error) {
 	}, nil
 }
 
+func (m *mockSocket) GetBoundAddress() (netip.AddrPort, error) {
+	return m.MustGetLocalAddress(), nil
+}
+
+func (m *mockSocket) SetNodeID(id netip.Addr) {}
+
+func (m *mockSocket) Rebind(ipv4addr net.IP) (*net.UDPAddr, error) {
+	return &net.UDPAddr{
+		IP:   ipv4addr,
+		Port: 0,
+	}, nil
+}
+
 func (m *mockSocket) Subscribe() chan *sock.Packet {
 	return nil
 }
 
+func (m *mockSocket) DroppedPackets() uint64 {
+	return 0
+}
+
+func (m *mockSocket) SetConnectedMode(enabled bool) error {
+	return nil
+}
+
+func (m *mockSocket) SendDontFragmentTo(addr *net.UDPAddr, data []byte) error {
+	return nil
+}
+
+func (m *mockSocket) DontFragment() bool {
+	return false
+}
+
+func (m *mockSocket) ConnectedPeer() (netip.AddrPort, bool) {
+	return netip.AddrPort{}, false
+}
+
 // Helper function to compare two maps
 func mapsEqual(m1, m2 map[netip.Addr]netip.AddrPort) bool {
 	if len(m1) != len(m2) {
@@ -228,6 +263,61 @@ func TestBuildRoutingTable(t *testing.T) {
 				netip.MustParseAddr("10.0.0.5"): netip.MustParseAddrPort("10.0.0.6:60000"),
 			},
 		},
+		{
+			// (10.0.0.1) <-> (10.0.0.2, stub) <-> (10.0.0.3) <-> (10.0.0.4) <-> (10.0.0.5)
+			//     ^-----------------------------------------------------------------^
+			name: "Route around stub host",
+			lsdb: map[netip.Addr]LSAEntry{
+				netip.MustParseAddr(LOCAL_ADDR): {
+					Neighbors: []netip.Addr{
+						netip.MustParseAddr("10.0.0.2"),
+						netip.MustParseAddr("10.0.0.5"),
+					},
+				},
+				netip.MustParseAddr("10.0.0.2"): {
+					Neighbors: []netip.Addr{
+						netip.MustParseAddr("10.0.0.1"),
+						netip.MustParseAddr("10.0.0.3"),
+					},
+					Stub: true,
+				},
+				netip.MustParseAddr("10.0.0.3"): {
+					Neighbors: []netip.Addr{
+						netip.MustParseAddr("10.0.0.2"),
+						netip.MustParseAddr("10.0.0.4"),
+					},
+				},
+				netip.MustParseAddr("10.0.0.4"): {
+					Neighbors: []netip.Addr{
+						netip.MustParseAddr("10.0.0.3"),
+						netip.MustParseAddr("10.0.0.5"),
+					},
+				},
+				netip.MustParseAddr("10.0.0.5"): {
+					Neighbors: []netip.Addr{
+						netip.MustParseAddr("10.0.0.1"),
+						netip.MustParseAddr("10.0.0.4"),
+					},
+				},
+			},
+			neighborTable: map[netip.Addr]NeighborEntry{
+				netip.MustParseAddr("10.0.0.2"): {
+					NextHop: netip.MustParseAddrPort("10.0.0.2:20000"),
+				},
+				netip.MustParseAddr("10.0.0.5"): {
+					NextHop: netip.MustParseAddrPort("10.0.0.5:50000"),
+				},
+			},
+			expected: map[netip.Addr]netip.AddrPort{
+				// The stub host is still reachable directly
+				netip.MustParseAddr("10.0.0.2"): netip.MustParseAddrPort("10.0.0.2:20000"),
+				netip.MustParseAddr("10.0.0.5"): netip.MustParseAddrPort("10.0.0.5:50000"),
+
+				// The shorter paths through the stub host aren't used
+				netip.MustParseAddr("10.0.0.3"): netip.MustParseAddrPort("10.0.0.5:50000"),
+				netip.MustParseAddr("10.0.0.4"): netip.MustParseAddrPort("10.0.0.5:50000"),
+			},
+		},
 		{
 			//     ✅             ✅            ❌
 			// (10.0.0.1) <-> (10.0.0.2) <-> (10.0.0.3)
@@ -349,9 +439,293 @@ func TestBuildRoutingTable(t *testing.T) {
 				}
 			}
 
-			if !mapsEqual(router.routingTable, tt.expected) {
-				t.Errorf("expected %v, got %v", tt.expected, router.routingTable)
+			if !mapsEqual(router.table(), tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, router.table())
+			}
+		})
+	}
+}
+
+func TestIsOnPath(t *testing.T) {
+	// 10.0.0.5 reaches us (10.0.0.1) through 10.0.0.2 or 10.0.0.3, 10.0.0.4 only through the stub host 10.0.0.6.
+	// 10.0.0.7 has no LSA, it is only known from the LSA of 10.0.0.3.
+	socket := &mockSocket{}
+	router := NewRouter(socket)
+	router.lsdb = map[netip.Addr]LSAEntry{
+		netip.MustParseAddr(LOCAL_ADDR): {Neighbors: []netip.Addr{netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.3"), netip.MustParseAddr("10.0.0.4")}},
+		netip.MustParseAddr("10.0.0.2"): {Neighbors: []netip.Addr{netip.MustParseAddr(LOCAL_ADDR), netip.MustParseAddr("10.0.0.5")}},
+		netip.MustParseAddr("10.0.0.3"): {Neighbors: []netip.Addr{netip.MustParseAddr(LOCAL_ADDR), netip.MustParseAddr("10.0.0.5"), netip.MustParseAddr("10.0.0.7")}},
+		netip.MustParseAddr("10.0.0.4"): {Neighbors: []netip.Addr{netip.MustParseAddr(LOCAL_ADDR), netip.MustParseAddr("10.0.0.6")}},
+		netip.MustParseAddr("10.0.0.5"): {Neighbors: []netip.Addr{netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.3"), netip.MustParseAddr("10.0.0.6")}},
+		netip.MustParseAddr("10.0.0.6"): {Neighbors: []netip.Addr{netip.MustParseAddr("10.0.0.4"), netip.MustParseAddr("10.0.0.5")}, Stub: true},
+	}
+	for _, neighbor := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		addr := netip.MustParseAddr(neighbor)
+		router.neighborTable[addr] = NeighborEntry{NextHop: netip.AddrPortFrom(addr, LOCAL_PORT)}
+	}
+	router.buildRoutingTable()
+
+	tests := []struct {
+		src      string
+		neighbor string
+		expected bool
+	}{
+		{"10.0.0.5", "10.0.0.2", true},
+		{"10.0.0.5", "10.0.0.3", true},
+		{"10.0.0.5", "10.0.0.4", false}, // Only through the stub host
+		{"10.0.0.6", "10.0.0.4", true},  // The stub host sends its own packets
+		{"10.0.0.6", "10.0.0.2", true},
+		{"10.0.0.2", "10.0.0.2", true},
+		{"10.0.0.2", "10.0.0.3", true}, // Not a shortest path, but a path through 10.0.0.5
+		{"10.0.0.7", "10.0.0.3", true}, // Without LSA
+		{"10.0.0.7", "10.0.0.2", true},
+		{"10.0.0.8", "10.0.0.2", false}, // Unknown source
+		{"10.0.0.2", "10.0.0.5", false}, // Not a neighbor
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src+" via "+tt.neighbor, func(t *testing.T) {
+			got := router.IsOnPath(netip.MustParseAddr(tt.src), netip.MustParseAddr(tt.neighbor))
+			if got != tt.expected {
+				t.Errorf("IsOnPath(%s, %s) = %v, expected %v", tt.src, tt.neighbor, got, tt.expected)
 			}
 		})
 	}
 }
+
+// gridRouter returns a router whose LSDB is a size x size grid, the local host is in a corner.
+func gridRouter(size int) (router *Router, hosts []netip.Addr) {
+	hosts = make([]netip.Addr, size*size)
+	for i := range hosts {
+		hosts[i] = netip.AddrFrom4([4]byte{10, 0, byte(i / 250), byte(i%250 + 1)}) // hosts[0] is LOCAL_ADDR
+	}
+
+	router = NewRouter(&mockSocket{})
+	for i, host := range hosts {
+		var neighbors []netip.Addr
+		if i%size > 0 {
+			neighbors = append(neighbors, hosts[i-1])
+		}
+		if i%size < size-1 {
+			neighbors = append(neighbors, hosts[i+1])
+		}
+		if i >= size {
+			neighbors = append(neighbors, hosts[i-size])
+		}
+		if i < size*(size-1) {
+			neighbors = append(neighbors, hosts[i+size])
+		}
+		router.lsdb[host] = LSAEntry{SeqNum: 1, Neighbors: neighbors}
+	}
+	for _, neighbor := range router.lsdb[hosts[0]].Neighbors {
+		router.neighborTable[neighbor] = NeighborEntry{NextHop: netip.AddrPortFrom(neighbor, LOCAL_PORT)}
+	}
+	router.buildRoutingTable()
+
+	return router, hosts
+}
+
+// BenchmarkBuildRoutingTable measures Dijkstra on grid LSDBs of increasing size.
+func BenchmarkBuildRoutingTable(b *testing.B) {
+	for _, size := range []int{10, 30, 100} {
+		b.Run(fmt.Sprintf("hosts=%d", size*size), func(b *testing.B) {
+			router, _ := gridRouter(size)
+
+			b.ReportAllocs()
+			for b.Loop() {
+				router.mu.Lock()
+				router.buildRoutingTable()
+				router.mu.Unlock()
+			}
+		})
+	}
+}
+
+// BenchmarkGetNextHopDuringLSAStorm measures route lookups of the forwarding path while LSAs are received continuously.
+func BenchmarkGetNextHopDuringLSAStorm(b *testing.B) {
+	router, hosts := gridRouter(30)
+	farthest := hosts[len(hosts)-1]
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for seqNum := uint32(2); ; seqNum++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			owner := hosts[int(seqNum)%len(hosts)]
+			lsa, _ := router.GetLSA(owner)
+			router.UpdateLSA(owner, seqNum, lsa.Neighbors, false, netip.Addr{})
+		}
+	}()
+
+	for b.Loop() {
+		if _, found := router.GetNextHop(farthest); !found {
+			b.Fatal("No route to the farthest host")
+		}
+	}
+
+	close(stop)
+	<-stopped
+}
+
+func TestBuildRoutingTableGrid(t *testing.T) {
+	router, hosts := gridRouter(30)
+
+	if routes := len(router.GetRoutingTable()); routes != len(hosts)-1 {
+		t.Errorf("expected routes to all %d other hosts, got %d", len(hosts)-1, routes)
+	}
+}
+
+func TestGetHopCount(t *testing.T) {
+	router, hosts := gridRouter(5)
+
+	if hops, found := router.GetHopCount(hosts[1]); !found || hops != 1 {
+		t.Errorf("expected 1 hop to a neighbor, got %d (found: %v)", hops, found)
+	}
+	if hops, found := router.GetHopCount(hosts[len(hosts)-1]); !found || hops != 8 {
+		t.Errorf("expected 8 hops to the opposite corner, got %d (found: %v)", hops, found)
+	}
+	if _, found := router.GetHopCount(netip.MustParseAddr("10.0.9.9")); found {
+		t.Errorf("expected no hop count for an unknown host")
+	}
+}
+
+func TestGetPath(t *testing.T) {
+	router, hosts := gridRouter(5)
+
+	path, found := router.GetPath(hosts[1])
+	if !found || path.Cost != 1 || !slices.Equal(path.Hops, []netip.Addr{hosts[1]}) {
+		t.Errorf("expected the path to a neighbor to be the neighbor itself, got %v (found: %v)", path, found)
+	}
+
+	corner := hosts[len(hosts)-1]
+	path, found = router.GetPath(corner)
+	if !found || path.Cost != 8 || len(path.Hops) != 8 {
+		t.Fatalf("expected 8 hops to the opposite corner, got %v (found: %v)", path, found)
+	}
+	if nextHop, _ := router.GetNextHop(corner); path.Hops[0] != nextHop.Addr() {
+		t.Errorf("expected the path to start at the next hop %s, got %v", nextHop, path.Hops)
+	}
+	if path.Hops[len(path.Hops)-1] != corner {
+		t.Errorf("expected the path to end at the destination, got %v", path.Hops)
+	}
+	previous := hosts[0]
+	for _, hop := range path.Hops {
+		if lsa, _ := router.GetLSA(previous); !slices.Contains(lsa.Neighbors, hop) {
+			t.Errorf("expected consecutive hops to be neighbors, %s isn't a neighbor of %s in %v", hop, previous, path.Hops)
+		}
+		previous = hop
+	}
+
+	if _, found := router.GetPath(netip.MustParseAddr("10.0.9.9")); found {
+		t.Errorf("expected no path to an unknown host")
+	}
+}
+
+func TestRouteChanges(t *testing.T) {
+	router := NewRouter(&mockSocket{})
+	localAddr := netip.MustParseAddr(LOCAL_ADDR)
+	neighborA := netip.MustParseAddrPort("10.0.0.2:1234")
+	neighborB := netip.MustParseAddrPort("10.0.0.3:1234")
+
+	for _, neighbor := range []netip.AddrPort{neighborA, neighborB} {
+		router.AddNeighbor(neighbor)
+		router.UpdateLSA(neighbor.Addr(), 1, []netip.Addr{localAddr}, false, neighbor.Addr())
+	}
+	if changes := router.RouteChanges(); changes != 2 {
+		t.Fatalf("expected 2 route changes after adding two neighbors, got %d", changes)
+	}
+
+	router.UpdateLSA(neighborB.Addr(), 2, []netip.Addr{localAddr}, false, neighborB.Addr())
+	if changes := router.RouteChanges(); changes != 2 {
+		t.Errorf("expected an unchanged LSA to cause no route change, got %d changes", changes)
+	}
+
+	changed := events.RouteChanged.Subscribe()
+	defer events.RouteChanged.Unsubscribe(changed)
+
+	router.RemoveNeighbor(neighborA.Addr())
+	if changes := router.RouteChanges(); changes != 3 {
+		t.Errorf("expected 3 route changes after removing a neighbor, got %d", changes)
+	}
+	select {
+	case change := <-changed:
+		if change.Dest != neighborA.Addr() || change.NextHop.IsValid() || change.PrevNextHop != neighborA {
+			t.Errorf("expected the removal of the route to %s via %s, got %+v", neighborA.Addr(), neighborA, change)
+		}
+	default:
+		t.Errorf("expected a RouteChanged event for the removed neighbor")
+	}
+}
+
+func TestStaticRoutes(t *testing.T) {
+	router, hosts := gridRouter(5)
+	corner := hosts[len(hosts)-1]
+	shortestNextHop, _ := router.GetNextHop(corner)
+	via := hosts[1]
+	if shortestNextHop.Addr() == via {
+		via = hosts[5]
+	}
+
+	if router.AddStaticRoute(corner, hosts[6]) {
+		t.Errorf("expected a static route through a non-neighbor to be rejected")
+	}
+	if !router.AddStaticRoute(corner, via) {
+		t.Fatalf("expected the static route through %s to be added", via)
+	}
+	if nextHop, _ := router.GetNextHop(corner); nextHop.Addr() != via {
+		t.Errorf("expected the static route to override the next hop %s, got %s", shortestNextHop, nextHop)
+	}
+	if path, found := router.GetPath(corner); !found || !slices.Equal(path.Hops, []netip.Addr{via, corner}) {
+		t.Errorf("expected the path to pass via only, got %v (found: %v)", path, found)
+	}
+
+	lsa, _ := router.GetLSA(corner)
+	router.UpdateLSA(corner, 2, lsa.Neighbors, false, netip.Addr{})
+	if nextHop, _ := router.GetNextHop(corner); nextHop.Addr() != via {
+		t.Errorf("expected the static route to survive a rebuild, got next hop %s", nextHop)
+	}
+
+	router.RemoveNeighbor(via)
+	if routes := router.GetStaticRoutes(); len(routes) != 1 || routes[0].Active {
+		t.Errorf("expected the static route to be inactive without its neighbor, got %v", routes)
+	}
+	if nextHop, found := router.GetNextHop(corner); !found || nextHop.Addr() == via {
+		t.Errorf("expected the computed route while the static route is inactive, got %s (found: %v)", nextHop, found)
+	}
+
+	if !router.RemoveStaticRoute(corner) || router.RemoveStaticRoute(corner) {
+		t.Errorf("expected the static route to be removed exactly once")
+	}
+}
+
+func TestVerifyRoutingTable(t *testing.T) {
+	router, hosts := gridRouter(4)
+	corner := hosts[len(hosts)-1]
+	router.AddStaticRoute(corner, hosts[1])
+	if problems := router.VerifyRoutingTable(); len(problems) != 0 {
+		t.Fatalf("expected a consistent routing table, got %v", problems)
+	}
+
+	// A link of the LSDB is removed without rebuilding the routing table
+	router.mu.Lock()
+	lsa := router.lsdb[hosts[1]]
+	lsa.Neighbors = slices.DeleteFunc(slices.Clone(lsa.Neighbors), func(addr netip.Addr) bool { return addr == hosts[2] })
+	router.lsdb[hosts[1]] = lsa
+	router.mu.Unlock()
+
+	problems := router.VerifyRoutingTable()
+	if len(problems) == 0 {
+		t.Fatalf("expected the routes over the removed link to be inconsistent")
+	}
+	link := fmt.Sprintf("link %s -> %s", hosts[1], hosts[2])
+	for _, problem := range problems {
+		if !strings.Contains(problem, link) || strings.HasPrefix(problem, "route to "+corner.String()+":") {
+			t.Errorf("expected only routes over the removed link %s, got %q", link, problem)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package routing
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// StaticRoute is an administrative route that takes precedence over the paths computed from the LSDB.
+type StaticRoute struct {
+	Dest   netip.Addr
+	Via    netip.Addr // Neighbor the packets to Dest are sent to
+	Active bool       // Whether Via is currently a neighbor, inactive routes apply again once it is
+}
+
+// AddStaticRoute routes the packets to dest through the neighbor via, regardless of the shortest path.
+// The route is kept across routing table rebuilds, e.g. to debug asymmetric paths or to force traffic through a specific relay.
+// It applies while via is a neighbor, dest doesn't need to be known. A static route that leads back to us causes a routing loop.
+// Returns false if via isn't a neighbor or dest is the local address.
+// Can be called concurrently.
+func (r *Router) AddStaticRoute(dest netip.Addr, via netip.Addr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if isNeighbor, _ := r.isNeighbor(via); !isNeighbor || dest == r.socket.MustGetLocalAddress().Addr() {
+		return false
+	}
+
+	r.staticRoutes[dest] = via
+	r.buildRoutingTable()
+	return true
+}
+
+// RemoveStaticRoute removes the static route to dest, the shortest path applies again.
+// Returns false if there is no static route to dest.
+// Can be called concurrently.
+func (r *Router) RemoveStaticRoute(dest netip.Addr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.staticRoutes[dest]; !exists {
+		return false
+	}
+
+	delete(r.staticRoutes, dest)
+	r.buildRoutingTable() // The LSDB holds at least our local LSA, via was a neighbor when the route was added
+	return true
+}
+
+// GetStaticRoutes returns the static routes ordered by destination.
+// Can be called concurrently.
+func (r *Router) GetStaticRoutes() []StaticRoute {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routes := make([]StaticRoute, 0, len(r.staticRoutes))
+	for dest, via := range r.staticRoutes {
+		isNeighbor, _ := r.isNeighbor(via)
+		routes = append(routes, StaticRoute{Dest: dest, Via: via, Active: isNeighbor})
+	}
+	slices.SortFunc(routes, func(a, b StaticRoute) int { return a.Dest.Compare(b.Dest) })
+	return routes
+}
+
+// applyStaticRoutes overrides the computed routes with the active static routes.
+// The path of a static route is only known up to via, so via is recorded as the predecessor of dest.
+// Returns notRoutable without the destinations that are reachable by a static route.
+func (r *Router) applyStaticRoutes(routingTable map[netip.Addr]netip.AddrPort, hopCounts map[netip.Addr]int, predecessors map[netip.Addr]netip.Addr, notRoutable []netip.Addr) []netip.Addr {
+	for dest, via := range r.staticRoutes {
+		neighbor, isNeighbor := r.neighborTable[via]
+		if !isNeighbor {
+			continue
+		}
+
+		routingTable[dest] = neighbor.NextHop
+		if dest == via {
+			hopCounts[dest] = 1
+			delete(predecessors, dest)
+		} else {
+			hopCounts[dest] = 2
+			predecessors[dest] = via
+		}
+	}
+
+	return slices.DeleteFunc(notRoutable, func(addr netip.Addr) bool {
+		_, static := r.staticRoutes[addr]
+		return static && routingTable[addr].IsValid()
+	})
+}
@@ -0,0 +1,87 @@
+package routing
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// VerifyRoutingTable checks the routing table against the LSDB and the neighbor table, e.g. for the doctor command.
+// Every route must lead to a known host through a neighbor, along links advertised in the LSDB and without passing a stub host.
+// The hop between the via neighbor of a static route and its destination isn't checked, it needn't be in the LSDB.
+// Returns a description of each inconsistency, ordered by destination; none if the table is consistent.
+// The socket must be open.
+// Can be called concurrently.
+func (r *Router) VerifyRoutingTable() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	localAddr := r.socket.MustGetLocalAddress().Addr()
+	table := r.table()
+	hopCounts := *r.hopCounts.Load()
+	predecessors := *r.predecessors.Load()
+
+	dests := make([]netip.Addr, 0, len(table))
+	for dest := range table {
+		dests = append(dests, dest)
+	}
+	slices.SortFunc(dests, netip.Addr.Compare)
+
+	var problems []string
+	for _, dest := range dests {
+		if problem := r.verifyRoute(localAddr, dest, table[dest], hopCounts, predecessors); problem != "" {
+			problems = append(problems, fmt.Sprintf("route to %s: %s", dest, problem))
+		}
+	}
+	return problems
+}
+
+// verifyRoute checks a single route of the routing table, see VerifyRoutingTable.
+// Returns an empty string if the route is consistent.
+// Must be called with mu held.
+func (r *Router) verifyRoute(localAddr netip.Addr, dest netip.Addr, nextHop netip.AddrPort, hopCounts map[netip.Addr]int, predecessors map[netip.Addr]netip.Addr) string {
+	if dest == localAddr {
+		return "leads to the local address"
+	}
+
+	via, static := r.staticRoutes[dest]
+	if _, known := r.lsdb[dest]; !known && !static {
+		if isNeighbor, _ := r.isNeighbor(dest); !isNeighbor {
+			return "destination has no LSA"
+		}
+	}
+
+	hops, exists := hopCounts[dest]
+	if !exists || hops < 1 {
+		return "no hop count"
+	}
+
+	// Walk the path back from the destination to the neighbor it starts at
+	current := dest
+	for i := hops - 1; i > 0; i-- {
+		prev, exists := predecessors[current]
+		if !exists {
+			return fmt.Sprintf("path breaks off at %s", current)
+		}
+		lastHopOfStatic := static && current == dest && prev == via
+		if !lastHopOfStatic && !slices.Contains(r.lsdb[prev].Neighbors, current) {
+			return fmt.Sprintf("link %s -> %s isn't in the LSDB", prev, current)
+		}
+		if !lastHopOfStatic && r.lsdb[prev].Stub {
+			return fmt.Sprintf("passes the stub host %s", prev)
+		}
+		current = prev
+	}
+	if prev, exists := predecessors[current]; exists {
+		return fmt.Sprintf("path is longer than its hop count %d, %s follows %s", hops, current, prev)
+	}
+
+	isNeighbor, neighborNextHop := r.isNeighbor(current)
+	if !isNeighbor {
+		return fmt.Sprintf("path starts at %s, which isn't a neighbor", current)
+	}
+	if neighborNextHop != nextHop {
+		return fmt.Sprintf("next hop %s, but the neighbor %s is reached at %s", nextHop, current, neighborNextHop)
+	}
+	return ""
+}
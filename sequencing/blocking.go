@@ -1,64 +1,248 @@
 package sequencing
 
 import (
+	"context"
 	"net/netip"
+	"slices"
 	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
-var blockerManager = struct {
-	mu      sync.Mutex
-	blocked map[SequenceBlocker]bool
-}{
-	blocked: make(map[SequenceBlocker]bool),
+// blockerManager holds the blocked sequences of a node.
+type blockerManager struct {
+	mu           sync.Mutex
+	blocked      map[blockerKey]*blockedSequence
+	releaseDelay time.Duration // Delay after which a cancelled sequence is released if its sender didn't unblock it
 }
 
-// SequenceBlocker is a struct that provides state to block the sending of packets of a specific message type until the previous sent packets are acknowledged.
-type SequenceBlocker struct {
+func newBlockerManager() *blockerManager {
+	return &blockerManager{
+		blocked:      make(map[blockerKey]*blockedSequence),
+		releaseDelay: common.SEQUENCE_BLOCKER_RELEASE_DELAY,
+	}
+}
+
+// blockerKey identifies the sequence of a message type to a destination.
+type blockerKey struct {
 	destinationAddr netip.Addr
 	msgType         byte
 }
 
-func GetSequenceBlocker(destAddr netip.Addr, msgType byte) *SequenceBlocker {
+// blockedSequence is the state of a sequence that is currently being sent.
+type blockedSequence struct {
+	owner       string    // Operation that sends the sequence, e.g. "msg"
+	since       time.Time // When the sequence was blocked
+	aborted     bool      // True if the receiver aborted the sequence
+	ctx         context.Context
+	cancel      context.CancelFunc
+	stopRelease func() bool // Stops the release of the sequence once its context is cancelled
+}
+
+// SequenceBlocker is a struct that provides state to block the sending of packets of a specific message type until the previous sent packets are acknowledged.
+type SequenceBlocker struct {
+	manager  *blockerManager
+	key      blockerKey
+	sequence *blockedSequence // Sequence blocked by this blocker, nil if it didn't block one
+}
+
+// BlockerInfo describes a sequence that is currently being sent, see Blockers.
+type BlockerInfo struct {
+	Dest      netip.Addr
+	MsgType   byte
+	Owner     string    // Operation that sends the sequence
+	Since     time.Time // When the sequence was blocked
+	Cancelled bool      // The sequence was cancelled, it is released once its sender unblocks it or after common.SEQUENCE_BLOCKER_RELEASE_DELAY
+	Aborted   bool      // The receiver aborted the sequence
+}
+
+func (h *OutgoingPktNumHandler) GetSequenceBlocker(destAddr netip.Addr, msgType byte) *SequenceBlocker {
 	return &SequenceBlocker{
-		destinationAddr: destAddr,
-		msgType:         msgType,
+		manager: h.blockers,
+		key:     blockerKey{destinationAddr: destAddr, msgType: msgType},
 	}
 }
 
 // ClearBlockers clears all blockers for the given destination address.
-func ClearBlockers(destAddr netip.Addr) {
-	blockerManager.mu.Lock()
-	defer blockerManager.mu.Unlock()
+// The contexts of their sequences are cancelled.
+func (h *OutgoingPktNumHandler) ClearBlockers(destAddr netip.Addr) {
+	h.blockers.mu.Lock()
+	defer h.blockers.mu.Unlock()
 
-	for b := range blockerManager.blocked {
-		if b.destinationAddr == destAddr {
-			delete(blockerManager.blocked, b)
+	for key, sequence := range h.blockers.blocked {
+		if key.destinationAddr == destAddr {
+			h.blockers.remove(key, sequence)
 		}
 	}
 }
 
+// Blockers returns the sequences that are currently being sent, ordered by destination and message type.
+// Can be called concurrently.
+func (h *OutgoingPktNumHandler) Blockers() []BlockerInfo {
+	h.blockers.mu.Lock()
+	defer h.blockers.mu.Unlock()
+
+	blockers := make([]BlockerInfo, 0, len(h.blockers.blocked))
+	for key, sequence := range h.blockers.blocked {
+		blockers = append(blockers, BlockerInfo{
+			Dest:      key.destinationAddr,
+			MsgType:   key.msgType,
+			Owner:     sequence.owner,
+			Since:     sequence.since,
+			Cancelled: sequence.ctx.Err() != nil,
+			Aborted:   sequence.aborted,
+		})
+	}
+	slices.SortFunc(blockers, func(a, b BlockerInfo) int {
+		if c := a.Dest.Compare(b.Dest); c != 0 {
+			return c
+		}
+		return int(a.MsgType) - int(b.MsgType)
+	})
+	return blockers
+}
+
+// ReleaseBlocker force-unblocks the sequence of the message type to the destination, e.g. if its sending goroutine crashed.
+// The context of the sequence is cancelled, a later Unblock of its sender doesn't affect the next sequence.
+// Returns false if no sequence of the message type is being sent to the destination.
+// Can be called concurrently.
+func (h *OutgoingPktNumHandler) ReleaseBlocker(destAddr netip.Addr, msgType byte) bool {
+	h.blockers.mu.Lock()
+	defer h.blockers.mu.Unlock()
+
+	key := blockerKey{destinationAddr: destAddr, msgType: msgType}
+	sequence, exists := h.blockers.blocked[key]
+	if exists {
+		h.blockers.remove(key, sequence)
+	}
+	return exists
+}
+
+// remove cancels the sequence and unblocks it.
+// Must be called with mu held.
+func (m *blockerManager) remove(key blockerKey, sequence *blockedSequence) {
+	sequence.stopRelease()
+	sequence.cancel()
+	delete(m.blocked, key)
+}
+
+// releaseCancelled unblocks the cancelled sequence after releaseDelay unless its sender unblocked it by then.
+func (m *blockerManager) releaseCancelled(key blockerKey, sequence *blockedSequence) {
+	time.AfterFunc(m.releaseDelay, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if m.blocked[key] == sequence {
+			logger.Warnf("Releasing the cancelled %q sequence of type %d to %v, its sender didn't unblock it within %v", sequence.owner, key.msgType, key.destinationAddr, m.releaseDelay)
+			delete(m.blocked, key)
+		}
+	})
+}
+
 // Block blocks tries to set the blocker to the blocked state.
 // If the blocker is already blocked, it returns false, indicating that another message of the same type is currently being sent.
-// If the blocker is not blocked, it sets the blocker to the blocked state and returns true
-func (b *SequenceBlocker) Block() bool {
-	blockerManager.mu.Lock()
-	defer blockerManager.mu.Unlock()
+// If the blocker is not blocked, it sets the blocker to the blocked state and returns true.
+// owner names the operation sending the sequence, see Blockers.
+// Once the sequence is cancelled, it is released after common.SEQUENCE_BLOCKER_RELEASE_DELAY even if the sender never unblocks it.
+func (b *SequenceBlocker) Block(owner string) bool {
+	b.manager.mu.Lock()
+	defer b.manager.mu.Unlock()
 
-	if _, exists := blockerManager.blocked[*b]; exists {
+	if _, exists := b.manager.blocked[b.key]; exists {
 		// Already blocked, meaning another message of the same type is currently being sent.
 		return false
 	}
 
-	blockerManager.blocked[*b] = true
+	ctx, cancel := context.WithCancel(context.Background())
+	sequence := &blockedSequence{owner: owner, since: time.Now(), ctx: ctx, cancel: cancel}
+	key := b.key
+	sequence.stopRelease = context.AfterFunc(ctx, func() { b.manager.releaseCancelled(key, sequence) })
+	b.manager.blocked[b.key] = sequence
+	b.sequence = sequence
 
 	return true
 }
 
-// Unblock removes the blocker from the blocked state.
+// lookup returns the sequence the blocker refers to, the sequence it blocked itself or, if it didn't block one, the sequence currently being sent.
+// Returns false if there is no such sequence, also if the blocker's own sequence was released meanwhile.
+// Must be called with manager.mu held.
+func (b *SequenceBlocker) lookup() (*blockedSequence, bool) {
+	sequence, exists := b.manager.blocked[b.key]
+	if !exists || b.sequence != nil && sequence != b.sequence {
+		return nil, false
+	}
+	return sequence, true
+}
+
+// IsBlocked returns whether a sequence of the message type is currently being sent to the destination.
+func (b *SequenceBlocker) IsBlocked() bool {
+	b.manager.mu.Lock()
+	defer b.manager.mu.Unlock()
+
+	_, exists := b.lookup()
+	return exists
+}
+
+// Abort marks the currently blocked sequence as aborted by the receiver.
 // If the blocker isn't blocked, this is a no-op.
+func (b *SequenceBlocker) Abort() {
+	b.manager.mu.Lock()
+	defer b.manager.mu.Unlock()
+
+	if sequence, exists := b.lookup(); exists {
+		sequence.aborted = true
+	}
+}
+
+// IsAborted returns whether the receiver aborted the currently blocked sequence.
+// The sender should stop sending the remaining packets of the sequence.
+func (b *SequenceBlocker) IsAborted() bool {
+	b.manager.mu.Lock()
+	defer b.manager.mu.Unlock()
+
+	sequence, exists := b.lookup()
+	return exists && sequence.aborted
+}
+
+// Context returns the context of the currently blocked sequence, all packets of the sequence should be sent with it.
+// It is cancelled when the sequence is cancelled or released, the destination is cleared or the blocker is unblocked.
+// If the blocker isn't blocked, the returned context is already cancelled.
+func (b *SequenceBlocker) Context() context.Context {
+	b.manager.mu.Lock()
+	defer b.manager.mu.Unlock()
+
+	if sequence, exists := b.lookup(); exists {
+		return sequence.ctx
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+// Cancel cancels the currently blocked sequence, e.g. because the user stopped it.
+// The blocker stays blocked until the sender unblocks it, at most for common.SEQUENCE_BLOCKER_RELEASE_DELAY.
+// Returns false if the blocker isn't blocked.
+func (b *SequenceBlocker) Cancel() bool {
+	b.manager.mu.Lock()
+	defer b.manager.mu.Unlock()
+
+	sequence, exists := b.lookup()
+	if exists {
+		sequence.cancel()
+	}
+	return exists
+}
+
+// Unblock removes the blocker from the blocked state and cancels the context of the sequence.
+// If the blocker isn't blocked, or the sequence it blocked was released meanwhile, this is a no-op.
 func (b *SequenceBlocker) Unblock() {
-	blockerManager.mu.Lock()
-	defer blockerManager.mu.Unlock()
+	b.manager.mu.Lock()
+	defer b.manager.mu.Unlock()
 
-	delete(blockerManager.blocked, *b)
+	if sequence, exists := b.lookup(); exists {
+		b.manager.remove(b.key, sequence)
+	}
 }
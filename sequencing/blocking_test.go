@@ -0,0 +1,63 @@
+package sequencing
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+func TestReleaseBlocker(t *testing.T) {
+	out := NewOutgoingPktNumHandler(10, false)
+	dest := netip.MustParseAddr("10.0.0.2")
+
+	crashed := out.GetSequenceBlocker(dest, pkt.MsgTypeChatMessage)
+	if !crashed.Block("msg") {
+		t.Fatalf("expected the first sequence to block")
+	}
+	if blockers := out.Blockers(); len(blockers) != 1 || blockers[0].Dest != dest || blockers[0].Owner != "msg" {
+		t.Fatalf("expected the blocked sequence to be listed, got %+v", blockers)
+	}
+
+	if !out.ReleaseBlocker(dest, pkt.MsgTypeChatMessage) || out.ReleaseBlocker(dest, pkt.MsgTypeChatMessage) {
+		t.Errorf("expected the sequence to be released exactly once")
+	}
+	if crashed.Context().Err() == nil {
+		t.Errorf("expected the context of the released sequence to be cancelled")
+	}
+
+	next := out.GetSequenceBlocker(dest, pkt.MsgTypeChatMessage)
+	if !next.Block("msg") {
+		t.Fatalf("expected a new sequence to block after the release")
+	}
+	crashed.Unblock() // A late unblock of the released sequence doesn't release the next one
+	if !next.IsBlocked() || next.Context().Err() != nil {
+		t.Errorf("expected the next sequence to stay blocked")
+	}
+	next.Unblock()
+	if len(out.Blockers()) != 0 {
+		t.Errorf("expected no blocked sequences, got %+v", out.Blockers())
+	}
+}
+
+func TestCancelledBlockerIsReleased(t *testing.T) {
+	out := NewOutgoingPktNumHandler(10, false)
+	out.blockers.releaseDelay = 10 * time.Millisecond
+	dest := netip.MustParseAddr("10.0.0.2")
+
+	blocker := out.GetSequenceBlocker(dest, pkt.MsgTypeFileTransfer)
+	blocker.Block("file")
+	out.GetSequenceBlocker(dest, pkt.MsgTypeFileTransfer).Cancel()
+	if blockers := out.Blockers(); len(blockers) != 1 || !blockers[0].Cancelled {
+		t.Fatalf("expected the cancelled sequence to stay blocked until it is released, got %+v", blockers)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for blocker.IsBlocked() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if blocker.IsBlocked() {
+		t.Errorf("expected the cancelled sequence to be released without an unblock of its sender")
+	}
+}
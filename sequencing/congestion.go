@@ -0,0 +1,147 @@
+package sequencing
+
+import (
+	"math"
+	"net/netip"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/util/ringbuffer"
+)
+
+// CongestionEventKind describes what happened in a CongestionEvent.
+type CongestionEventKind int
+
+const (
+	CwndIncrease       CongestionEventKind = iota // cwnd grew after an ACK
+	CwndDecrease                                  // cwnd shrank after a timeout
+	SsthreshUpdate                                // ssthresh was set after a timeout
+	AckTimeout                                    // An ACK timed out (first try of the packet)
+	EnterSlowStart                                // The peer switched from congestion avoidance to slow start
+	EnterCongAvoidance                            // The peer switched from slow start to congestion avoidance
+	CongestionMark                                // The receiver echoed a congestion mark of a forwarding node
+	IdleDecay                                     // cwnd was decayed because nothing was sent to the peer for a while
+)
+
+func (k CongestionEventKind) String() string {
+	switch k {
+	case CwndIncrease:
+		return "CWND+"
+	case CwndDecrease:
+		return "CWND-"
+	case SsthreshUpdate:
+		return "SSTHRESH"
+	case AckTimeout:
+		return "TIMEOUT"
+	case EnterSlowStart:
+		return "SLOWSTART"
+	case EnterCongAvoidance:
+		return "AVOIDANCE"
+	case CongestionMark:
+		return "CE"
+	case IdleDecay:
+		return "IDLE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// CongestionEvent is a single entry of the congestion timeline of a peer.
+type CongestionEvent struct {
+	Time     time.Time
+	Kind     CongestionEventKind
+	PktNum   uint32 // Packet number that triggered the event
+	Cwnd     int64  // cwnd after the event
+	Ssthresh int64  // ssthresh after the event
+}
+
+// CongestionStats is a snapshot of the congestion state of a single peer.
+type CongestionStats struct {
+	Cwnd                         int64
+	Ssthresh                     int64
+	CAvoidanceAcc                int64
+	SlowStart                    bool
+	HighestAckedContiguousPktNum int64
+	OpenAcks                     int
+	InFlightBytes                int64         // Sum of the sizes of the packets with open acknowledgments
+	SRTT                         time.Duration // Smoothed round-trip time, zero without samples
+	RTTVar                       time.Duration // Round-trip time variation
+	RTTSamples                   int
+	DuplicateAcks                uint64            // ACKs for packets that were already acknowledged
+	LateAcks                     uint64            // ACKs that arrived after the retries of their packet were exhausted or its sequence was cancelled
+	SpuriousAcks                 uint64            // ACKs for packet numbers that were never sent
+	Timeline                     []CongestionEvent // Recent events, oldest first
+}
+
+// recordCongestionEvent appends an event to the timeline of the peer.
+// Must be called with p.mu held.
+func (p *peerState) recordCongestionEvent(kind CongestionEventKind, pktNum uint32) {
+	if p.ccTimeline == nil {
+		p.ccTimeline = ringbuffer.New[CongestionEvent](common.CONGESTION_TIMELINE_SIZE)
+	}
+
+	ssthresh := p.ssthresh
+	if ssthresh == 0 {
+		ssthresh = math.MaxInt64
+	}
+
+	p.recordTotals(p.cwnd)
+
+	p.ccTimeline.Push(CongestionEvent{
+		Time:     p.h.now(),
+		Kind:     kind,
+		PktNum:   pktNum,
+		Cwnd:     p.cwnd,
+		Ssthresh: ssthresh,
+	})
+}
+
+// GetCongestionStats returns the current congestion state and the recent congestion timeline of the given peer.
+// Returns false if there is no congestion state for the peer.
+// This is thread-safe.
+func (h *OutgoingPktNumHandler) GetCongestionStats(addr netip.Addr) (CongestionStats, bool) {
+	peer, exists := h.lookupPeer(addr)
+	if !exists {
+		return CongestionStats{}, false
+	}
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if !peer.sending {
+		return CongestionStats{}, false
+	}
+
+	ssthresh := peer.ssthresh
+	if ssthresh == 0 {
+		ssthresh = math.MaxInt64
+	}
+
+	stats := CongestionStats{
+		Cwnd:                         peer.cwnd,
+		Ssthresh:                     ssthresh,
+		CAvoidanceAcc:                peer.cAvoidanceAcc,
+		SlowStart:                    peer.cwnd < ssthresh,
+		HighestAckedContiguousPktNum: peer.highestAcked,
+		OpenAcks:                     len(peer.openAcks),
+		InFlightBytes:                peer.inFlightBytes,
+	}
+
+	if peer.rtt != nil {
+		stats.SRTT = peer.rtt.srtt
+		stats.RTTVar = peer.rtt.rttvar
+		stats.RTTSamples = peer.rtt.samples
+	}
+
+	if counts := peer.unexpectedAcks; counts != nil {
+		stats.DuplicateAcks = counts.duplicate
+		stats.LateAcks = counts.late
+		stats.SpuriousAcks = counts.spurious
+	}
+
+	if peer.ccTimeline != nil {
+		stats.Timeline = peer.ccTimeline.Items()
+	}
+
+	return stats, true
+}
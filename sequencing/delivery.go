@@ -0,0 +1,122 @@
+package sequencing
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DeliveryTracker aggregates the ACK results of the chunks and the FIN of a sequence (a message or file) into its delivery status.
+// The ACK channels of reliable packets (see OutgoingPktNumHandler.AddOpenAck) report false if the retries are exhausted or the sequence is aborted.
+// DeliveryTracker is thread-safe.
+type DeliveryTracker struct {
+	wg          sync.WaitGroup
+	mu          sync.Mutex
+	chunks      int
+	ackedChunks int
+	finishAcked bool
+}
+
+// DeliveryStatus is a snapshot of DeliveryTracker.
+type DeliveryStatus struct {
+	Chunks      int
+	AckedChunks int
+	FinishAcked bool // A single-packet message is its own FIN
+}
+
+func NewDeliveryTracker() *DeliveryTracker {
+	return &DeliveryTracker{}
+}
+
+// TrackChunk records the result of a chunk once it arrives on ackChan, done is called with the result afterwards if not nil.
+// Wait waits for all tracked chunks.
+func (d *DeliveryTracker) TrackChunk(ackChan chan bool, done func(acked bool)) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		acked := <-ackChan
+		d.RecordChunk(acked)
+		if done != nil {
+			done(acked)
+		}
+	}()
+}
+
+// RecordChunk records a chunk that was acknowledged or not, e.g. because it couldn't be sent.
+func (d *DeliveryTracker) RecordChunk(acked bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.chunks++
+	if acked {
+		d.ackedChunks++
+	}
+}
+
+// RecordFinish records whether the FIN of the sequence was acknowledged.
+func (d *DeliveryTracker) RecordFinish(acked bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.finishAcked = acked
+}
+
+// Wait blocks until the results of all chunks passed to TrackChunk are recorded.
+func (d *DeliveryTracker) Wait() {
+	d.wg.Wait()
+}
+
+// Status returns the delivery status recorded so far.
+func (d *DeliveryTracker) Status() DeliveryStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return DeliveryStatus{
+		Chunks:      d.chunks,
+		AckedChunks: d.ackedChunks,
+		FinishAcked: d.finishAcked,
+	}
+}
+
+// Delivered returns whether all chunks and the FIN were acknowledged, i.e. the receiver has the complete sequence.
+func (s DeliveryStatus) Delivered() bool {
+	return s.AckedChunks == s.Chunks && s.FinishAcked
+}
+
+// Failed returns whether no chunk was acknowledged.
+func (s DeliveryStatus) Failed() bool {
+	return !s.Delivered() && s.AckedChunks == 0
+}
+
+// Outcome returns "delivered", "partially delivered" or "failed".
+func (s DeliveryStatus) Outcome() string {
+	switch {
+	case s.Delivered():
+		return "delivered"
+	case s.Failed():
+		return "failed"
+	default:
+		return "partially delivered"
+	}
+}
+
+// Detail returns the acknowledged chunks of a partially delivered sequence, e.g. "2/3 chunks" or "3/3 chunks, FIN unacknowledged".
+// Returns an empty string for delivered and failed sequences.
+func (s DeliveryStatus) Detail() string {
+	switch {
+	case s.Delivered() || s.Failed():
+		return ""
+	case s.AckedChunks == s.Chunks:
+		return fmt.Sprintf("%d/%d chunks, FIN unacknowledged", s.AckedChunks, s.Chunks)
+	default:
+		return fmt.Sprintf("%d/%d chunks", s.AckedChunks, s.Chunks)
+	}
+}
+
+// String returns the outcome with the detail, e.g. "delivered" or "partially delivered (2/3 chunks)".
+func (s DeliveryStatus) String() string {
+	if detail := s.Detail(); detail != "" {
+		return fmt.Sprintf("%s (%s)", s.Outcome(), detail)
+	}
+	return s.Outcome()
+}
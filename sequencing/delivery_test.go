@@ -0,0 +1,44 @@
+package sequencing
+
+import (
+	"testing"
+)
+
+func TestDeliveryTrackerStatus(t *testing.T) {
+	tracker := NewDeliveryTracker()
+
+	for _, acked := range []bool{true, false, true} {
+		ackChan := make(chan bool, 1)
+		ackChan <- acked
+		tracker.TrackChunk(ackChan, nil)
+	}
+	tracker.Wait()
+	tracker.RecordFinish(true)
+
+	status := tracker.Status()
+	if status.Chunks != 3 || status.AckedChunks != 2 {
+		t.Fatalf("Expected 2 of 3 chunks acknowledged, got %+v", status)
+	}
+	if got := status.String(); got != "partially delivered (2/3 chunks)" {
+		t.Errorf("Expected partially delivered, got %q", got)
+	}
+}
+
+func TestDeliveryStatusOutcome(t *testing.T) {
+	tests := []struct {
+		status DeliveryStatus
+		want   string
+	}{
+		{DeliveryStatus{Chunks: 2, AckedChunks: 2, FinishAcked: true}, "delivered"},
+		{DeliveryStatus{Chunks: 1, AckedChunks: 1, FinishAcked: true}, "delivered"},
+		{DeliveryStatus{Chunks: 2, AckedChunks: 2}, "partially delivered (2/2 chunks, FIN unacknowledged)"},
+		{DeliveryStatus{Chunks: 2}, "failed"},
+		{DeliveryStatus{Chunks: 2, FinishAcked: true}, "failed"},
+	}
+
+	for _, test := range tests {
+		if got := test.status.String(); got != test.want {
+			t.Errorf("Expected %q for %+v, got %q", test.want, test.status, got)
+		}
+	}
+}
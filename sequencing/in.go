@@ -20,6 +20,8 @@ type IncomingPktNumHandler struct {
 	seqMu         sync.Mutex
 	highestPktNum map[netip.Addr]int64          // Highest contiguous seq num received per peer; int64 to allow for negative numbers
 	futurePktNums map[netip.Addr]map[int64]bool // Out-of-order seq nums > highest, bounded by common.RECEIVE_BUFFER_SIZE
+	bootEpochs    map[netip.Addr]uint64         // Latest boot epoch announced per peer, kept when packet numbers are cleared
+	resetIDs      map[netip.Addr]uint32         // ID of the latest RESET applied per peer, kept when packet numbers are cleared
 	socket        sock.Socket
 }
 
@@ -27,10 +29,45 @@ func NewIncomingPktNumHandler(socket sock.Socket) *IncomingPktNumHandler {
 	return &IncomingPktNumHandler{
 		highestPktNum: make(map[netip.Addr]int64),
 		futurePktNums: make(map[netip.Addr]map[int64]bool),
+		bootEpochs:    make(map[netip.Addr]uint64),
+		resetIDs:      make(map[netip.Addr]uint32),
 		socket:        socket,
 	}
 }
 
+// EpochStatus is the result of comparing a peer's announced boot epoch with the known one.
+type EpochStatus int
+
+const (
+	EpochCurrent EpochStatus = iota // Same epoch as before or the first epoch seen from the peer
+	EpochRestart                    // Newer epoch, the peer restarted and its packet numbers start at 0 again
+	EpochStale                      // Older epoch, the packet is a replay from before a restart
+)
+
+// CheckBootEpoch compares the boot epoch announced by a peer (in CONNECT or LSA packets) with the latest known epoch.
+// Must be called before IsDuplicatePacket for packets carrying an epoch.
+// On a restart, the incoming packet numbers of the peer are cleared so the fresh packet numbers aren't classified as duplicates.
+func (h *IncomingPktNumHandler) CheckBootEpoch(peerAddr netip.Addr, epoch uint64) EpochStatus {
+	h.seqMu.Lock()
+	defer h.seqMu.Unlock()
+
+	known, exists := h.bootEpochs[peerAddr]
+	switch {
+	case !exists:
+		h.bootEpochs[peerAddr] = epoch
+		return EpochCurrent
+	case epoch < known:
+		return EpochStale
+	case epoch > known:
+		h.bootEpochs[peerAddr] = epoch
+		delete(h.highestPktNum, peerAddr)
+		delete(h.futurePktNums, peerAddr)
+		return EpochRestart
+	default:
+		return EpochCurrent
+	}
+}
+
 func (h *IncomingPktNumHandler) ClearIncomingPacketNumbers(peerAddr netip.Addr) {
 	h.seqMu.Lock()
 	defer h.seqMu.Unlock()
@@ -54,8 +91,32 @@ func (h *IncomingPktNumHandler) IsDuplicatePacket(packet *pkt.Packet) (bool, err
 	h.seqMu.Lock()
 	defer h.seqMu.Unlock()
 
+	return h.recordPktNum(netip.AddrFrom4(packet.Header.SourceAddr), packet.Header.PktNum)
+}
+
+// ApplyReset restarts the incoming packet numbers of the peer for its RESET with the given ID.
+// The packet number of the RESET is the first packet number of the new sequence, it is recorded as received.
+// Returns false if the RESET with that ID was applied already, i.e. the packet is a retransmission whose ACK got lost.
+func (h *IncomingPktNumHandler) ApplyReset(packet *pkt.Packet, resetID uint32) bool {
+	h.seqMu.Lock()
+	defer h.seqMu.Unlock()
+
 	peerAddr := netip.AddrFrom4(packet.Header.SourceAddr)
-	seqNum32 := binary.BigEndian.Uint32(packet.Header.PktNum[:])
+	if applied, exists := h.resetIDs[peerAddr]; exists && applied == resetID {
+		return false
+	}
+
+	h.resetIDs[peerAddr] = resetID
+	delete(h.highestPktNum, peerAddr)
+	delete(h.futurePktNums, peerAddr)
+	_, _ = h.recordPktNum(peerAddr, packet.Header.PktNum) // The first packet number of a cleared peer is never a duplicate
+	return true
+}
+
+// recordPktNum records the packet number of the peer as received, see IsDuplicatePacket.
+// Must be called with h.seqMu held.
+func (h *IncomingPktNumHandler) recordPktNum(peerAddr netip.Addr, pktNum [4]byte) (bool, error) {
+	seqNum32 := binary.BigEndian.Uint32(pktNum[:])
 
 	seqNum := int64(seqNum32)
 
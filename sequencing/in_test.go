@@ -20,10 +20,20 @@ func (m *mockSocket) MustGetLocalAddress() netip.AddrPort {
 func (m *mockSocket) GetLocalAddress() (netip.AddrPort, error) {
 	return netip.AddrPortFrom(m.addr, 1234), nil
 }
-func (m *mockSocket) SendTo(addr *net.UDPAddr, data []byte) error { return nil }
-func (m *mockSocket) Open(ipv4addr net.IP) (*net.UDPAddr, error)  { return nil, nil }
-func (m *mockSocket) Close() error                                { return nil }
-func (m *mockSocket) Subscribe() chan *sock.Packet                { return nil }
+func (m *mockSocket) GetBoundAddress() (netip.AddrPort, error) {
+	return netip.AddrPortFrom(m.addr, 1234), nil
+}
+func (m *mockSocket) SendTo(addr *net.UDPAddr, data []byte) error             { return nil }
+func (m *mockSocket) Open(ipv4addr net.IP) (*net.UDPAddr, error)              { return nil, nil }
+func (m *mockSocket) SetNodeID(id netip.Addr)                                 {}
+func (m *mockSocket) Rebind(ipv4addr net.IP) (*net.UDPAddr, error)            { return nil, nil }
+func (m *mockSocket) Close() error                                            { return nil }
+func (m *mockSocket) Subscribe() chan *sock.Packet                            { return nil }
+func (m *mockSocket) DroppedPackets() uint64                                  { return 0 }
+func (m *mockSocket) SetConnectedMode(enabled bool) error                     { return nil }
+func (m *mockSocket) SendDontFragmentTo(addr *net.UDPAddr, data []byte) error { return nil }
+func (m *mockSocket) DontFragment() bool                                      { return false }
+func (m *mockSocket) ConnectedPeer() (netip.AddrPort, bool)                   { return netip.AddrPort{}, false }
 
 // Helper to create a packet with given src, dst, seqNum
 func makePacket(src, dst netip.Addr, seqNum uint32) *pkt.Packet {
@@ -123,3 +133,84 @@ func TestIsDuplicatePacket(t *testing.T) {
 		t.Errorf("Packet not destined for us should error")
 	}
 }
+
+func TestCheckBootEpoch(t *testing.T) {
+	local := netip.MustParseAddr("10.0.0.1")
+	peer := netip.MustParseAddr("10.0.0.2")
+	h := NewIncomingPktNumHandler(&mockSocket{addr: local})
+
+	if status := h.CheckBootEpoch(peer, 100); status != EpochCurrent {
+		t.Fatalf("First epoch: expected EpochCurrent, got %v", status)
+	}
+
+	for i := range uint32(5) {
+		if dup, _ := h.IsDuplicatePacket(makePacket(peer, local, i)); dup {
+			t.Fatalf("Packet %d unexpectedly classified as duplicate", i)
+		}
+	}
+
+	if status := h.CheckBootEpoch(peer, 100); status != EpochCurrent {
+		t.Errorf("Same epoch: expected EpochCurrent, got %v", status)
+	}
+	if dup, _ := h.IsDuplicatePacket(makePacket(peer, local, 0)); !dup {
+		t.Errorf("Packet 0 of the same epoch should be a duplicate")
+	}
+
+	if status := h.CheckBootEpoch(peer, 200); status != EpochRestart {
+		t.Fatalf("Newer epoch: expected EpochRestart, got %v", status)
+	}
+	if dup, _ := h.IsDuplicatePacket(makePacket(peer, local, 0)); dup {
+		t.Errorf("Packet 0 after a restart should not be a duplicate")
+	}
+
+	if status := h.CheckBootEpoch(peer, 100); status != EpochStale {
+		t.Errorf("Older epoch: expected EpochStale, got %v", status)
+	}
+	if highest := h.GetHighestContiguousSeqNum(peer); highest != 0 {
+		t.Errorf("Stale epoch must not change sequencing state, highest is %d", highest)
+	}
+
+	h.ClearIncomingPacketNumbers(peer)
+	if status := h.CheckBootEpoch(peer, 100); status != EpochStale {
+		t.Errorf("Epoch must be kept when packet numbers are cleared, got %v", status)
+	}
+}
+
+func TestApplyReset(t *testing.T) {
+	local := netip.MustParseAddr("10.0.0.1")
+	peer := netip.MustParseAddr("10.0.0.2")
+	h := NewIncomingPktNumHandler(&mockSocket{addr: local})
+
+	for i := range uint32(5) {
+		_, _ = h.IsDuplicatePacket(makePacket(peer, local, i))
+	}
+	_, _ = h.IsDuplicatePacket(makePacket(peer, local, 8)) // Out of order
+
+	if !h.ApplyReset(makePacket(peer, local, 0), 42) {
+		t.Fatalf("First RESET with ID 42 was not applied")
+	}
+	if highest := h.GetHighestContiguousSeqNum(peer); highest != 0 {
+		t.Errorf("Expected highest packet number 0 after the RESET, got %d", highest)
+	}
+	for _, i := range []uint32{1, 8} {
+		if dup, _ := h.IsDuplicatePacket(makePacket(peer, local, i)); dup {
+			t.Errorf("Packet %d after the RESET should not be a duplicate", i)
+		}
+	}
+
+	// A retransmission of the RESET must not clear the packets received since
+	if h.ApplyReset(makePacket(peer, local, 0), 42) {
+		t.Errorf("Retransmitted RESET with ID 42 was applied again")
+	}
+	if dup, _ := h.IsDuplicatePacket(makePacket(peer, local, 1)); !dup {
+		t.Errorf("Packet 1 should still be a duplicate after the retransmitted RESET")
+	}
+
+	h.ClearIncomingPacketNumbers(peer)
+	if h.ApplyReset(makePacket(peer, local, 0), 42) {
+		t.Errorf("The reset ID must be kept when packet numbers are cleared")
+	}
+	if !h.ApplyReset(makePacket(peer, local, 0), 43) {
+		t.Errorf("RESET with a new ID was not applied")
+	}
+}
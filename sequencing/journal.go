@@ -0,0 +1,327 @@
+package sequencing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/clock"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// The journal records every event that drives the sequencing logic of the outgoing packets (sends, ACKs, timeouts, congestion marks, aborts)
+// together with the congestion state of the peer right before the event, as one JSON object per line.
+// ReplayJournal feeds the events into a fresh handler with the recorded times, which reproduces the window and ACK handling of a node from the field
+// without its network. The replayed state is compared with the recorded state before every event, the first divergence points at the bug
+// or at an event the journal is missing.
+// Entries are written unbuffered while the peer is locked, so the journal is complete up to a crash but slows down sending.
+// The events of a peer are journaled in the order they were handled, the events of different peers may interleave in another order,
+// which doesn't change the replayed state of either peer.
+
+// JournalEventKind is the kind of a journaled event.
+type JournalEventKind string
+
+const (
+	JournalStart   JournalEventKind = "start"   // First entry, describes the handler
+	JournalSend    JournalEventKind = "send"    // AddOpenAck, the first transmission of a reliable packet
+	JournalTimeout JournalEventKind = "timeout" // ACK timeout of an open acknowledgment
+	JournalAck     JournalEventKind = "ack"     // RemoveOpenAck
+	JournalAckUpTo JournalEventKind = "ackUpTo" // RemoveOpenAcksUpTo
+	JournalMark    JournalEventKind = "mark"    // HandleCongestionMark
+	JournalAbort   JournalEventKind = "abort"   // AbortSequence from PktNum to ToPktNum
+	JournalCancel  JournalEventKind = "cancel"  // Context of a send was cancelled
+	JournalClear   JournalEventKind = "clear"   // ClearPacketNumbers
+	JournalGC      JournalEventKind = "gc"      // CollectGarbage
+)
+
+// JournalEntry is a journaled event.
+type JournalEntry struct {
+	Time         time.Time        `json:"time"`
+	Kind         JournalEventKind `json:"kind"`
+	Peer         netip.Addr       `json:"peer,omitzero"`
+	PktNum       uint32           `json:"pktNum,omitempty"`
+	ToPktNum     uint32           `json:"toPktNum,omitempty"`
+	Packet       *JournalPacket   `json:"packet,omitempty"`       // Sent packet, send only
+	State        *JournalState    `json:"state,omitempty"`        // State of the peer before the event, nil for events without a peer
+	InitialCwnd  int64            `json:"initialCwnd,omitempty"`  // start only
+	IgnoreCwnd   bool             `json:"ignoreCwnd,omitempty"`   // start only
+	IdleInterval time.Duration    `json:"idleInterval,omitempty"` // start only
+	MaxInFlight  int64            `json:"maxInFlight,omitempty"`  // start only
+}
+
+// JournalPacket is the header and a hash of the payload of a sent packet.
+type JournalPacket struct {
+	Source      netip.Addr `json:"source"`
+	MsgType     byte       `json:"msgType"`
+	TTL         byte       `json:"ttl"`
+	Extensions  int        `json:"extensions,omitempty"`
+	PayloadSize int        `json:"payloadSize"`
+	Size        int        `json:"size,omitempty"` // Size of the whole packet, 0 in journals written before the bytes in flight were capped
+	PayloadHash string     `json:"payloadHash"`    // First 8 bytes of the SHA-256 of the payload, hex
+}
+
+// JournalState is the sequencing and congestion state of a peer.
+type JournalState struct {
+	NextPktNum    int64         `json:"nextPktNum"` // -1 if no packet number was assigned since the peer was cleared
+	HighestAcked  int64         `json:"highestAcked"`
+	Cwnd          int64         `json:"cwnd"`
+	Ssthresh      int64         `json:"ssthresh"` // 0 if not set yet
+	CAvoidanceAcc int64         `json:"cAvoidanceAcc"`
+	OpenAcks      int           `json:"openAcks"`
+	SRTT          time.Duration `json:"srtt"`
+}
+
+type journal struct {
+	mu      sync.Mutex // The events of different peers are journaled concurrently
+	encoder *json.Encoder
+}
+
+// SetJournal starts journaling the events of the handler to w, nil stops journaling.
+// Journaling stops by itself once writing to w fails.
+func (h *OutgoingPktNumHandler) SetJournal(w io.Writer) {
+	h.journal.Store(nil)
+	if w == nil {
+		return
+	}
+
+	j := &journal{encoder: json.NewEncoder(w)}
+	if err := j.encoder.Encode(JournalEntry{Time: h.now(), Kind: JournalStart, InitialCwnd: h.initialCwnd, IgnoreCwnd: h.ignoreCwnd, IdleInterval: h.idleInterval, MaxInFlight: h.maxInFlight}); err != nil {
+		logger.Warnf("Failed to write the sequencing journal, journaling stopped: %v", err)
+		return
+	}
+	h.journal.Store(j)
+}
+
+// recordJournal writes an event that doesn't concern a single peer to the journal.
+// Can be called concurrently.
+func (h *OutgoingPktNumHandler) recordJournal(entry JournalEntry) {
+	if j := h.journal.Load(); j != nil {
+		h.writeJournal(j, entry)
+	}
+}
+
+// recordJournal writes an event of the peer to the journal together with the state of the peer.
+// Must be called with p.mu held, before the event changes the state.
+func (p *peerState) recordJournal(entry JournalEntry) {
+	j := p.h.journal.Load()
+	if j == nil {
+		return
+	}
+
+	entry.Peer = p.addr
+	state := p.journalState()
+	entry.State = &state
+	p.h.writeJournal(j, entry)
+}
+
+// writeJournal writes an entry with the current time to the journal j.
+// Journaling is stopped if writing fails.
+func (h *OutgoingPktNumHandler) writeJournal(j *journal, entry JournalEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry.Time = h.now()
+	if err := j.encoder.Encode(entry); err != nil {
+		if h.journal.CompareAndSwap(j, nil) {
+			logger.Warnf("Failed to write the sequencing journal, journaling stopped: %v", err)
+		}
+	}
+}
+
+// journalState returns the state of the peer.
+// Must be called with p.mu held.
+func (p *peerState) journalState() JournalState {
+	state := JournalState{
+		NextPktNum:    -1,
+		HighestAcked:  p.highestAcked,
+		Cwnd:          p.cwnd,
+		Ssthresh:      p.ssthresh,
+		CAvoidanceAcc: p.cAvoidanceAcc,
+		OpenAcks:      len(p.openAcks),
+	}
+	if nextPktNum, exists := p.h.nextPktNum(p.addr); exists {
+		state.NextPktNum = int64(nextPktNum)
+	}
+	if p.rtt != nil {
+		state.SRTT = p.rtt.srtt
+	}
+	return state
+}
+
+func newJournalPacket(packet *pkt.Packet) *JournalPacket {
+	hash := sha256.Sum256(packet.Payload)
+	return &JournalPacket{
+		Source:      netip.AddrFrom4(packet.Header.SourceAddr),
+		MsgType:     packet.GetMessageType(),
+		TTL:         packet.Header.TTL,
+		Extensions:  len(packet.Extensions),
+		PayloadSize: len(packet.Payload),
+		Size:        packet.Size(),
+		PayloadHash: hex.EncodeToString(hash[:8]),
+	}
+}
+
+// JournalDivergence is an event before which the replayed state of the peer differs from the recorded state.
+type JournalDivergence struct {
+	Line     int // Line of the event in the journal
+	Entry    JournalEntry
+	Replayed JournalState
+}
+
+// JournalReplay is the result of a replayed journal.
+type JournalReplay struct {
+	Entries     int
+	Kinds       map[JournalEventKind]int
+	Divergences []JournalDivergence
+	Peers       map[netip.Addr]JournalState // Replayed state of every peer after the last event
+}
+
+// ReplayJournal replays a journal written by SetJournal in a fresh handler and compares the replayed with the recorded states.
+// Time stands still between the events, so the replay is deterministic.
+func ReplayJournal(r io.Reader) (JournalReplay, error) {
+	decoder := json.NewDecoder(r)
+
+	var start JournalEntry
+	if err := decoder.Decode(&start); err != nil {
+		return JournalReplay{}, fmt.Errorf("reading the first entry: %w", err)
+	}
+	if start.Kind != JournalStart {
+		return JournalReplay{}, fmt.Errorf("journal starts with a %q entry instead of %q", start.Kind, JournalStart)
+	}
+
+	replayTime := &replayClock{now: start.Time}
+	h := NewOutgoingPktNumHandler(start.InitialCwnd, start.IgnoreCwnd)
+	h.SetClock(replayTime)
+	h.SetIdleInterval(start.IdleInterval)
+	h.SetMaxInFlightBytes(start.MaxInFlight)
+
+	replay := JournalReplay{
+		Entries: 1,
+		Kinds:   map[JournalEventKind]int{JournalStart: 1},
+		Peers:   make(map[netip.Addr]JournalState),
+	}
+	peers := make(map[netip.Addr]struct{})
+
+	for line := 2; ; line++ {
+		var entry JournalEntry
+		err := decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return replay, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		replay.Entries++
+		replay.Kinds[entry.Kind]++
+		replayTime.now = entry.Time
+
+		if entry.State != nil {
+			peers[entry.Peer] = struct{}{}
+			if replayed := h.prepareReplay(entry.Peer, entry.State.NextPktNum); replayed != *entry.State {
+				replay.Divergences = append(replay.Divergences, JournalDivergence{Line: line, Entry: entry, Replayed: replayed})
+			}
+		}
+
+		if err := h.replayEvent(entry); err != nil {
+			return replay, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+
+	for addr := range peers {
+		peer := h.peer(addr)
+		peer.mu.Lock()
+		replay.Peers[addr] = peer.journalState()
+		peer.mu.Unlock()
+	}
+
+	return replay, nil
+}
+
+// prepareReplay returns the replayed state of the peer and then applies the recorded next packet number, which is assigned outside of the journaled events.
+func (h *OutgoingPktNumHandler) prepareReplay(addr netip.Addr, nextPktNum int64) JournalState {
+	peer := h.peer(addr)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	state := peer.journalState()
+	state.NextPktNum = nextPktNum // Not part of the comparison
+	h.setNextPktNum(addr, nextPktNum)
+	return state
+}
+
+// replayClock shows the time of the replayed event.
+// The timeouts are journaled events, so its timers never run.
+type replayClock struct {
+	now time.Time
+}
+
+func (c *replayClock) Now() time.Time {
+	return c.now
+}
+
+func (c *replayClock) AfterFunc(d time.Duration, f func()) clock.Timer {
+	return stoppedTimer{}
+}
+
+type stoppedTimer struct{}
+
+func (stoppedTimer) Stop() bool                 { return false }
+func (stoppedTimer) Reset(d time.Duration) bool { return false }
+
+// replayEvent applies a journaled event to the handler.
+func (h *OutgoingPktNumHandler) replayEvent(entry JournalEntry) error {
+	var pktNum [4]byte
+	binary.BigEndian.PutUint32(pktNum[:], entry.PktNum)
+
+	switch entry.Kind {
+	case JournalSend:
+		if entry.Packet == nil {
+			return errors.New("send entry without packet")
+		}
+		packet := &pkt.Packet{Header: pkt.Header{
+			DestAddr:   entry.Peer.As4(),
+			SourceAddr: entry.Packet.Source.As4(),
+			TTL:        entry.Packet.TTL,
+			PktNum:     pktNum,
+		}}
+		packet.Payload = make(pkt.Payload, max(entry.Packet.Size-pkt.HEADER_SIZE, entry.Packet.PayloadSize)) // Stands in for the extensions as well
+		_, err := h.AddOpenAck(context.Background(), packet, func() {})
+		if err != nil {
+			logger.Debugf("Replayed send of packet %d to %s failed: %v", entry.PktNum, entry.Peer, err)
+		}
+	case JournalTimeout:
+		h.handleAckTimeout(entry.Peer, pktNum, func() {})
+	case JournalAck:
+		h.RemoveOpenAck(entry.Peer, pktNum)
+	case JournalAckUpTo:
+		h.RemoveOpenAcksUpTo(entry.Peer, pktNum)
+	case JournalMark:
+		h.HandleCongestionMark(entry.Peer, pktNum)
+	case JournalAbort:
+		h.AbortSequence(entry.Peer, entry.PktNum, entry.ToPktNum)
+	case JournalCancel:
+		peer := h.peer(entry.Peer)
+		peer.mu.Lock()
+		if _, exists := peer.openAcks[entry.PktNum]; exists {
+			peer.removeOpenAck(pktNum, false)
+		}
+		peer.mu.Unlock()
+	case JournalClear:
+		h.ClearPacketNumbers(entry.Peer)
+	case JournalGC:
+		h.CollectGarbage()
+	default:
+		return fmt.Errorf("unknown event kind %q", entry.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package sequencing
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/util/clock"
+)
+
+func TestJournalReplayReproducesState(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(2, false)
+	addr := netip.MustParseAddr("10.0.0.2")
+	virtual := clock.NewVirtual(time.Unix(1700000000, 0))
+	handler.SetClock(virtual)
+
+	var journal bytes.Buffer
+	handler.SetJournal(&journal)
+
+	send := func() uint32 {
+		pktNum := handler.GetNextpacketNumber(addr)
+		packet := makePkt(0, addr)
+		packet.Header.PktNum = pktNum
+		if _, err := handler.AddOpenAck(context.Background(), packet, func() {}); err != nil {
+			t.Fatalf("Failed to add open ack: %v", err)
+		}
+		return uint32(pktNum[3])
+	}
+
+	first, _ := send(), send()
+	virtual.Advance(30 * time.Millisecond)
+	handler.RemoveOpenAck(addr, makePkt(first, addr).Header.PktNum)
+	third := send()
+	virtual.Advance(3 * time.Second) // Times out the second and the third packet
+	handler.HandleCongestionMark(addr, makePkt(third, addr).Header.PktNum)
+	handler.RemoveOpenAcksUpTo(addr, makePkt(third, addr).Header.PktNum)
+
+	peer := handler.peer(addr)
+	peer.mu.Lock()
+	want := peer.journalState()
+	peer.mu.Unlock()
+	handler.ClearPacketNumbers(addr)
+
+	replay, err := ReplayJournal(bytes.NewReader(journal.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to replay the journal: %v", err)
+	}
+	if replay.Kinds[JournalSend] != 3 || replay.Kinds[JournalTimeout] != 2 || replay.Kinds[JournalClear] != 1 {
+		t.Errorf("Expected 3 sends, 2 timeouts and 1 clear, got %v", replay.Kinds)
+	}
+	if len(replay.Divergences) != 0 {
+		t.Errorf("Expected no divergences, first one at line %d: recorded %+v, replayed %+v", replay.Divergences[0].Line, *replay.Divergences[0].Entry.State, replay.Divergences[0].Replayed)
+	}
+
+	// Replaying without the clear shows the state before it
+	lines := strings.Split(strings.TrimSpace(journal.String()), "\n")
+	replay, err = ReplayJournal(strings.NewReader(strings.Join(lines[:len(lines)-1], "\n")))
+	if err != nil {
+		t.Fatalf("Failed to replay the truncated journal: %v", err)
+	}
+	if got := replay.Peers[addr]; got != want {
+		t.Errorf("Expected the replayed state %+v, got %+v", want, got)
+	}
+}
+
+func TestJournalReplayFindsDivergence(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(2, false)
+	addr := netip.MustParseAddr("10.0.0.2")
+
+	var journal bytes.Buffer
+	handler.SetJournal(&journal)
+
+	pktNum := handler.GetNextpacketNumber(addr)
+	packet := makePkt(0, addr)
+	packet.Header.PktNum = pktNum
+	if _, err := handler.AddOpenAck(context.Background(), packet, func() {}); err != nil {
+		t.Fatalf("Failed to add open ack: %v", err)
+	}
+	handler.RemoveOpenAck(addr, pktNum)
+
+	tampered := strings.Replace(journal.String(), `"cwnd":2`, `"cwnd":5`, 1)
+	replay, err := ReplayJournal(strings.NewReader(tampered))
+	if err != nil {
+		t.Fatalf("Failed to replay the journal: %v", err)
+	}
+	if len(replay.Divergences) != 1 || replay.Divergences[0].Line != 3 {
+		t.Errorf("Expected a divergence before the ACK on line 3, got %+v", replay.Divergences)
+	}
+}
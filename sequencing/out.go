@@ -1,95 +1,135 @@
 package sequencing
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"maps"
 	"math"
 	"net/netip"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"bjoernblessin.de/chatprotogol/common"
 	"bjoernblessin.de/chatprotogol/pkt"
-	"bjoernblessin.de/chatprotogol/util/assert"
+	"bjoernblessin.de/chatprotogol/util/clock"
 	"bjoernblessin.de/chatprotogol/util/logger"
 	"bjoernblessin.de/chatprotogol/util/observer"
+	"bjoernblessin.de/chatprotogol/util/panics"
+	"bjoernblessin.de/chatprotogol/util/timerwheel"
 )
 
 // OpenAck represents an open acknowledgment for a specific addr and packet number.
 type OpenAck struct {
-	timer      *time.Timer
-	retries    int
-	observable *observer.Observable[bool]
+	timer         clock.Timer
+	retries       int
+	observable    *observer.Observable[bool]
+	stats         *TransferStats // Optional, counts retransmissions and losses of the sequence the packet belongs to
+	stopCancel    func() bool    // Stops removing the open acknowledgment once the context of the send is cancelled
+	sentAt        time.Time      // Time of the last transmission
+	retransmitted bool
+	size          int64 // Size of the packet in bytes, counted in the bytes in flight of the peer
 }
 
 type OutgoingPktNumHandler struct {
-	packetNumbers                map[netip.Addr]uint32 // Maps a host address to the last packet number that was used for that host.
-	openAcks                     map[netip.Addr]map[uint32]*OpenAck
-	mu                           sync.Mutex
-	highestAckedContiguousPktNum map[netip.Addr]int64 // Maps a host address to the highest packet number that has been acknowledged for that host.
-	cwnd                         map[netip.Addr]int64
-	ssthresh                     map[netip.Addr]int64
-	cAvoidanceAcc                map[netip.Addr]int64     // Used to count the number of packets acked in congestion avoidance phase
-	rtoStartTime                 map[netip.Addr]time.Time // Start time of the simulated RTO timer
-	initialCwnd                  int64
-	ignoreCwnd                   bool // If true, the congestion window will not limit the number of packets sent
+	packetNumbers sync.Map // Maps a host address to a *atomic.Uint32 with the next packet number for that host; allocated without locking a peer, see GetNextpacketNumber
+	mu            sync.RWMutex
+	peers         map[netip.Addr]*peerState // Guarded by mu, the state of every peer is guarded by its own lock
+	initialCwnd   int64
+	ignoreCwnd    bool                    // If true, the congestion window will not limit the number of packets sent
+	idleInterval  time.Duration           // cwnd is decayed for every such interval nothing was sent to a peer, 0 disables the decay
+	maxInFlight   int64                   // Maximum number of unacknowledged bytes per peer, 0 disables the cap
+	clock         clock.Clock             // Time source and ACK timeouts of all open acknowledgments
+	blockers      *blockerManager         // Sequences that are currently being sent
+	journal       atomic.Pointer[journal] // Records the events of the sequencing logic, nil if journaling is disabled
 }
 
-var CongestionWindowFullError = errors.New("Congestion window full, cannot send packet")
+// ErrWindowFull is returned if the packet doesn't fit into the congestion window of the peer or too many packets are unacknowledged.
+// The packet can be added again once packets are acknowledged.
+var ErrWindowFull = errors.New("congestion window full, cannot send packet")
+var DuplicateOpenAckError = errors.New("Open acknowledgment for packet already exists")
 
 func NewOutgoingPktNumHandler(initialCwnd int64, ignoreCwnd bool) *OutgoingPktNumHandler {
 	return &OutgoingPktNumHandler{
-		packetNumbers:                make(map[netip.Addr]uint32),
-		openAcks:                     make(map[netip.Addr]map[uint32]*OpenAck),
-		highestAckedContiguousPktNum: make(map[netip.Addr]int64),
-		cwnd:                         make(map[netip.Addr]int64),
-		ssthresh:                     make(map[netip.Addr]int64),
-		cAvoidanceAcc:                make(map[netip.Addr]int64),
-		rtoStartTime:                 make(map[netip.Addr]time.Time),
-		initialCwnd:                  initialCwnd,
-		ignoreCwnd:                   ignoreCwnd,
+		peers:        make(map[netip.Addr]*peerState),
+		initialCwnd:  initialCwnd,
+		ignoreCwnd:   ignoreCwnd,
+		idleInterval: common.CWND_IDLE_INTERVAL,
+		maxInFlight:  common.MAX_IN_FLIGHT_BYTES,
+		clock:        wheelClock{timerwheel.New(common.RETRANSMIT_TIMER_TICK, common.RETRANSMIT_TIMER_SLOTS)},
+		blockers:     newBlockerManager(),
 	}
 }
 
+// wheelClock is the default clock of the handler, the ACK timeouts of many open acknowledgments are cheaper on a timer wheel than as runtime timers.
+type wheelClock struct {
+	wheel *timerwheel.Wheel
+}
+
+func (c wheelClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c wheelClock) AfterFunc(d time.Duration, f func()) clock.Timer {
+	return c.wheel.AfterFunc(d, f)
+}
+
+// SetClock replaces the time source of the handler, e.g. with a clock.Virtual in tests.
+// Must be called before the first packet is sent, the clock is read without locking.
+func (h *OutgoingPktNumHandler) SetClock(c clock.Clock) {
+	h.clock = c
+}
+
+// SetIdleInterval sets the interval after which the congestion window of an idle peer is decayed, 0 disables the decay.
+// See validateIdleCwnd. Must be called before the first packet is sent.
+func (h *OutgoingPktNumHandler) SetIdleInterval(interval time.Duration) {
+	h.idleInterval = interval
+}
+
+// SetMaxInFlightBytes sets the maximum number of unacknowledged bytes per peer, 0 disables the cap.
+// Must be called before the first packet is sent.
+func (h *OutgoingPktNumHandler) SetMaxInFlightBytes(maxBytes int64) {
+	h.maxInFlight = maxBytes
+}
+
+// now returns the current time of the clock of the handler.
+func (h *OutgoingPktNumHandler) now() time.Time {
+	return h.clock.Now()
+}
+
 // ClearPacketNumbers clears the current packet number and open acknowledgments for the given peer.
 // ACK observers are notified that the connection is closed (ACK not received).
 // Can be called concurrently.
 func (h *OutgoingPktNumHandler) ClearPacketNumbers(addr netip.Addr) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	delete(h.packetNumbers, addr)
-	delete(h.cwnd, addr)
-	delete(h.ssthresh, addr)
-	delete(h.cAvoidanceAcc, addr)
-	delete(h.highestAckedContiguousPktNum, addr)
-	delete(h.rtoStartTime, addr)
-
-	if acks, exists := h.openAcks[addr]; exists {
-		for seqNum, ack := range acks {
-			ack.timer.Stop()
-			ack.observable.NotifyObservers(false) // Notify observers that the connection is closed
-
-			delete(h.openAcks[addr], seqNum)
-		}
+	peer := h.peer(addr)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	peer.recordJournal(JournalEntry{Kind: JournalClear})
+
+	h.packetNumbers.Delete(addr)
+
+	for _, ack := range peer.openAcks {
+		ack.timer.Stop()
+		ack.stopCancel()
+		ack.observable.NotifyObservers(false) // Notify observers that the connection is closed
 	}
+	peer.clear()
 }
 
 // GetNextpacketNumber returns the next packet number for the given address.
+// It doesn't lock the peer, so allocating packet numbers doesn't contend with ACK processing.
+// A packet number allocated concurrently with ClearPacketNumbers may still belong to the cleared sequence, like one allocated right before it.
 // Can be called concurrently.
 func (h *OutgoingPktNumHandler) GetNextpacketNumber(addr netip.Addr) [4]byte {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	seqNum, exists := h.packetNumbers[addr]
+	counter, exists := h.packetNumbers.Load(addr)
 	if !exists {
-		seqNum = 0
+		counter, _ = h.packetNumbers.LoadOrStore(addr, new(atomic.Uint32))
 	}
 
-	h.packetNumbers[addr] = seqNum + 1
+	seqNum := counter.(*atomic.Uint32).Add(1) - 1
 
 	return [4]byte{
 		byte(seqNum >> 24),
@@ -99,87 +139,176 @@ func (h *OutgoingPktNumHandler) GetNextpacketNumber(addr netip.Addr) [4]byte {
 	}
 }
 
+// nextPktNum returns the next packet number that will be allocated for the peer.
+// Returns false if no packet number was allocated since the peer was cleared.
+func (h *OutgoingPktNumHandler) nextPktNum(addr netip.Addr) (uint32, bool) {
+	counter, exists := h.packetNumbers.Load(addr)
+	if !exists {
+		return 0, false
+	}
+	return counter.(*atomic.Uint32).Load(), true
+}
+
+// setNextPktNum sets the next packet number of the peer, a negative number clears it.
+func (h *OutgoingPktNumHandler) setNextPktNum(addr netip.Addr, nextPktNum int64) {
+	if nextPktNum < 0 {
+		h.packetNumbers.Delete(addr)
+		return
+	}
+
+	counter := new(atomic.Uint32)
+	counter.Store(uint32(nextPktNum))
+	h.packetNumbers.Store(addr, counter)
+}
+
 // AddOpenAck adds a sequence number to the open acknowledgments for the given peer and starts a new timeout timer.
 // After the timeout, it will call the provided resend function to resend the packet.
+// Once ctx is cancelled, the packet isn't resent anymore and observers are notified that the ACK was not received.
 // Can be called concurrently.
-// Should only be called once per packet.
-func (h *OutgoingPktNumHandler) AddOpenAck(packet *pkt.Packet, resendFunc func()) (chan bool, error) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+// Should only be called once per packet, calling it again returns DuplicateOpenAckError.
+func (h *OutgoingPktNumHandler) AddOpenAck(ctx context.Context, packet *pkt.Packet, resendFunc func()) (chan bool, error) {
+	return h.AddTrackedOpenAck(ctx, packet, resendFunc, nil)
+}
+
+// AddTrackedOpenAck acts like AddOpenAck but additionally records retransmissions and losses of the packet in stats.
+// stats may be nil.
+func (h *OutgoingPktNumHandler) AddTrackedOpenAck(ctx context.Context, packet *pkt.Packet, resendFunc func(), stats *TransferStats) (chan bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	addr := netip.AddrFrom4(packet.Header.DestAddr)
 	pktNum := packet.Header.PktNum
 	pktNum32 := binary.BigEndian.Uint32(pktNum[:])
 	pktNum64 := int64(binary.BigEndian.Uint32(pktNum[:]))
 
-	_, exists := h.openAcks[addr][pktNum32]
-	assert.Assert(!exists, "Open acknowledgment for host", addr, "with packet number", pktNum, "already exists")
+	peer := h.peer(addr)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
 
-	highestAcked, ok := h.highestAckedContiguousPktNum[addr]
-	if !ok {
-		highestAcked = -1 // No packets have been acknowledged yet for this address
-		h.highestAckedContiguousPktNum[addr] = highestAcked
+	peer.recordJournal(JournalEntry{Kind: JournalSend, PktNum: pktNum32, Packet: newJournalPacket(packet)})
+
+	_, exists := peer.openAcks[pktNum32]
+	if exists {
+		return nil, fmt.Errorf("%w - Host: %s, PktNum: %d", DuplicateOpenAckError, addr, pktNum32)
 	}
 
-	cwnd, ok := h.cwnd[addr]
-	if !ok {
-		cwnd = h.initialCwnd
-		h.cwnd[addr] = cwnd
+	if !peer.sending {
+		peer.sending = true
+		peer.highestAcked = -1 // No packets have been acknowledged yet for this address
+		peer.cwnd = h.initialCwnd
+	} else if peer.openAcks == nil && !h.ignoreCwnd {
+		peer.validateIdleCwnd(pktNum32)
 	}
+
+	highestAcked := peer.highestAcked
+	cwnd := peer.cwnd
 	if pktNum64-highestAcked > cwnd && !h.ignoreCwnd {
-		return nil, fmt.Errorf("%w - PktNum: %d, [%d, %d]", CongestionWindowFullError, pktNum64, highestAcked, highestAcked+cwnd)
+		return nil, fmt.Errorf("%w - PktNum: %d, [%d, %d]", ErrWindowFull, pktNum64, highestAcked, highestAcked+cwnd)
+	}
+	// The window counts packets, a window of full chunks carries far more bytes than one of control packets
+	size := int64(packet.Size())
+	if peer.inFlightBytes > 0 && peer.inFlightBytes+size > h.maxInFlight && h.maxInFlight > 0 && !h.ignoreCwnd {
+		return nil, fmt.Errorf("%w - %d bytes in flight to %s, at most %d", ErrWindowFull, peer.inFlightBytes, addr, h.maxInFlight)
 	}
+	if len(peer.openAcks) >= common.MAX_OPEN_ACKS_PER_PEER {
+		// Bounds the memory of open acknowledgments even if the congestion window is ignored
+		return nil, fmt.Errorf("%w - %d open acknowledgments for %s", ErrWindowFull, len(peer.openAcks), addr)
+	}
+
+	openAck := peer.createOpenAck(pktNum)
+	openAck.stats = stats
+	openAck.size = size
+	peer.inFlightBytes += size
+	peer.recordTotals(cwnd).Packets++
+	openAck.sentAt = h.now() // The packet is sent right after adding the open acknowledgment
+	peer.lastSentAt = openAck.sentAt
+
+	openAck.timer = h.clock.AfterFunc(common.ACK_TIMEOUT_DURATION, func() {
+		defer panics.Recover("handling ACK timeout of packet %v to %s", pktNum, addr)
+		h.handleAckTimeout(addr, pktNum, resendFunc)
+	})
 
-	openAck := h.createOpenAck(addr, pktNum)
+	ackChan := openAck.observable.SubscribeOnce()
 
-	openAck.timer = time.AfterFunc(common.ACK_TIMEOUT_DURATION, func() { h.handleAckTimeout(addr, pktNum, resendFunc) })
+	openAck.stopCancel = context.AfterFunc(ctx, func() {
+		defer panics.Recover("cancelling open acknowledgment of packet %v to %s", pktNum, addr)
+		h.cancelOpenAck(addr, openAck, pktNum)
+	})
 
-	return openAck.observable.SubscribeOnce(), nil
+	return ackChan, nil
 }
 
-// createOpenAck creates a new OpenAck for the given address and packet number.
+// createOpenAck creates a new OpenAck for the given packet number.
 // It initializes the retries and observable. Timer is set to nil initially.
-func (h *OutgoingPktNumHandler) createOpenAck(addr netip.Addr, pktNum [4]byte) *OpenAck {
+// Must be called with p.mu held.
+func (p *peerState) createOpenAck(pktNum [4]byte) *OpenAck {
 	pktNum32 := binary.BigEndian.Uint32(pktNum[:])
 
-	if _, exists := h.openAcks[addr]; !exists {
-		h.openAcks[addr] = make(map[uint32]*OpenAck)
+	if p.openAcks == nil {
+		p.openAcks = make(map[uint32]*OpenAck)
 	}
 
-	h.openAcks[addr][pktNum32] = &OpenAck{
+	p.openAcks[pktNum32] = &OpenAck{
 		timer:      nil,
 		retries:    common.RETRIES_PER_PACKET,
 		observable: observer.NewObservable[bool](1),
 	}
 
-	return h.openAcks[addr][pktNum32]
+	return p.openAcks[pktNum32]
+}
+
+// cancelOpenAck removes the open acknowledgment after the context of its send was cancelled.
+// The packet number may have been reused after the peer was cleared, so only openAck itself is removed.
+func (h *OutgoingPktNumHandler) cancelOpenAck(addr netip.Addr, openAck *OpenAck, pktNum [4]byte) {
+	peer := h.peer(addr)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if peer.openAcks[binary.BigEndian.Uint32(pktNum[:])] != openAck {
+		return // Already acknowledged, timed out or cleared
+	}
+
+	peer.recordJournal(JournalEntry{Kind: JournalCancel, PktNum: binary.BigEndian.Uint32(pktNum[:])})
+	logger.Debugf("Cancelled open acknowledgment for host %s with packet number %v", addr, pktNum)
+	peer.removeOpenAck(pktNum, false)
 }
 
 // handleAckTimeout is called when an acknowledgment timeout occurs.
+// The packet is resent with the peer locked, which delays only the ACKs of this peer.
 func (h *OutgoingPktNumHandler) handleAckTimeout(addr netip.Addr, pktNum [4]byte, resendFunc func()) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+	peer := h.peer(addr)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
 
 	pktNum32 := binary.BigEndian.Uint32(pktNum[:])
 
-	openAck, exists := h.openAcks[addr][pktNum32]
+	openAck, exists := peer.openAcks[pktNum32]
 	if !exists {
 		return // The open acknowledgment has been removed already, no need to handle the timeout // TODO this seems to happen but if it happens, is returning the right thing?
 	}
 
+	peer.recordJournal(JournalEntry{Kind: JournalTimeout, PktNum: pktNum32})
 	logger.Debugf("ACK timeout for host %s with packet number %v\n", addr, pktNum)
 
 	if !h.ignoreCwnd {
 		if openAck.retries == common.RETRIES_PER_PACKET { // React only if the packet hasn't been resent yet (https://datatracker.ietf.org/doc/html/rfc5681#section-3.1)
-			if time.Since(h.rtoStartTime[addr]) > common.ACK_TIMEOUT_DURATION { // Simulate: per peer RTO
+			if h.now().Sub(peer.rtoStartTime) > common.ACK_TIMEOUT_DURATION { // Simulate: per peer RTO
 				// Multiplicative decrease
-				cwnd := h.cwnd[addr]
-				h.ssthresh[addr] = max(cwnd/2, 2)
-				h.cwnd[addr] = max(cwnd/2, h.initialCwnd)
-				h.cAvoidanceAcc[addr] = 0 // Reset accumulator after congestion event
-				logger.Debugf("CONGESTION EVENT for %s %d: Cwnd: %d, ssthresh set to %d, cwnd reset to %d", addr, pktNum32, cwnd, h.ssthresh[addr], h.cwnd[addr])
+				cwnd := peer.cwnd
+				wasSlowStart := peer.isSlowStart()
+				peer.recordCongestionEvent(AckTimeout, pktNum32)
+				peer.ssthresh = max(cwnd/2, 2)
+				peer.recordCongestionEvent(SsthreshUpdate, pktNum32)
+				peer.cwnd = max(cwnd/2, h.initialCwnd)
+				if peer.cwnd != cwnd {
+					peer.recordCongestionEvent(CwndDecrease, pktNum32)
+				}
+				peer.recordPhaseChange(wasSlowStart, pktNum32)
+				peer.cAvoidanceAcc = 0 // Reset accumulator after congestion event
+				logger.Debugf("CONGESTION EVENT for %s %d: Cwnd: %d, ssthresh set to %d, cwnd reset to %d", addr, pktNum32, cwnd, peer.ssthresh, peer.cwnd)
 
-				h.rtoStartTime[addr] = time.Now()
+				peer.rtoStartTime = h.now()
 			} else {
 				logger.Debugf("Ignoring (subsequent) timeout for %s; within RTO cooldown period.", addr)
 			}
@@ -187,105 +316,404 @@ func (h *OutgoingPktNumHandler) handleAckTimeout(addr netip.Addr, pktNum [4]byte
 	}
 
 	resendFunc()
+	openAck.sentAt = h.now()
+	peer.lastSentAt = openAck.sentAt
+	openAck.retransmitted = true
+	peer.recordTotals(peer.cwnd).Retransmissions++
+	if openAck.stats != nil {
+		openAck.stats.AddRetransmission()
+	}
 
 	openAck.retries--
 	if openAck.retries == 0 {
 		logger.Warnf("Removing open acknowledgment for host %s with packet number %v after retries exhausted\n", addr, pktNum)
-		h.removeOpenAck(addr, pktNum, false)
+		if openAck.stats != nil {
+			openAck.stats.AddLoss()
+		}
+		peer.removeOpenAck(pktNum, false)
 		return
 	}
 
 	openAck.timer.Reset(common.ACK_TIMEOUT_DURATION)
 }
 
+// HandleCongestionMark reduces the congestion window of the peer because a forwarding node marked the packet as congestion experienced.
+// Like a timeout, the mark halves cwnd and sets ssthresh, but no packet was lost.
+// The window is reduced at most once per window of packets: marks of packets that were sent before the last reduction are ignored.
+// Can be called concurrently.
+func (h *OutgoingPktNumHandler) HandleCongestionMark(addr netip.Addr, pktNum [4]byte) {
+	peer := h.peer(addr)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	pktNum32 := binary.BigEndian.Uint32(pktNum[:])
+	peer.recordJournal(JournalEntry{Kind: JournalMark, PktNum: pktNum32})
+
+	if h.ignoreCwnd {
+		return
+	}
+
+	if peer.marked && pktNum32 <= peer.markedWindowEnd {
+		return
+	}
+
+	if !peer.sending {
+		return // Nothing was sent to the peer since its state was cleared
+	}
+	cwnd := peer.cwnd
+
+	wasSlowStart := peer.isSlowStart()
+	peer.ssthresh = max(cwnd/2, 2)
+	peer.recordCongestionEvent(CongestionMark, pktNum32)
+	peer.cwnd = max(cwnd/2, h.initialCwnd)
+	if peer.cwnd != cwnd {
+		peer.recordCongestionEvent(CwndDecrease, pktNum32)
+	}
+	peer.recordPhaseChange(wasSlowStart, pktNum32)
+	peer.cAvoidanceAcc = 0
+	peer.marked = true
+	peer.markedWindowEnd = pktNum32
+	if next, _ := h.nextPktNum(addr); next > pktNum32 {
+		peer.markedWindowEnd = next - 1 // packetNumbers holds the next packet number
+	}
+	logger.Debugf("CONGESTION MARK for %s %d: Cwnd: %d, ssthresh set to %d, cwnd reset to %d", addr, pktNum32, cwnd, peer.ssthresh, peer.cwnd)
+}
+
+// AckKind classifies a received ACK, see RemoveOpenAck.
+type AckKind int
+
+const (
+	AckExpected  AckKind = iota // The ACK removed an open acknowledgment
+	AckDuplicate                // The packet was already acknowledged
+	AckLate                     // The ACK arrived after we stopped waiting for it
+	AckSpurious                 // The packet number was never sent, the peer's view of our packet numbers may have diverged
+)
+
 // RemoveOpenAck removes a packet from the open acknowledgments and notifies all observers that an ACK was received.
-// If the packet number does not exist, it does nothing.
+// If the packet number does not exist, the ACK is counted as duplicate, late or spurious and otherwise ignored.
 // Advances the highest acknowledged contiguous packet number if possible.
+// Returns the kind of the ACK.
 // Can be called concurrently.
-func (h *OutgoingPktNumHandler) RemoveOpenAck(addr netip.Addr, pktNum [4]byte) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+func (h *OutgoingPktNumHandler) RemoveOpenAck(addr netip.Addr, pktNum [4]byte) AckKind {
+	peer := h.peer(addr)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	pktNum32 := binary.BigEndian.Uint32(pktNum[:])
+	peer.recordJournal(JournalEntry{Kind: JournalAck, PktNum: pktNum32})
 
-	_, exists := h.openAcks[addr][binary.BigEndian.Uint32(pktNum[:])]
+	openAck, exists := peer.openAcks[pktNum32]
 	if !exists {
-		return
+		return peer.handleUnexpectedAck(pktNum32)
 	}
 
-	h.removeOpenAck(addr, pktNum, true)
+	peer.sampleRTT(openAck)
+	peer.removeOpenAck(pktNum, true)
+	return AckExpected
 }
 
 // removeOpenAck removes a packet from the open acknowledgments and notifies all observers that an ACK was received or not received.
-// If the packet number does not exist, it panics.
+// If the packet number does not exist, it logs a warning and does nothing.
 // See alternative impl at the end of this file for a second version that solves the "wrong highestAcked after congestion event" issue.
-func (h *OutgoingPktNumHandler) removeOpenAck(addr netip.Addr, pktNum [4]byte, ackReceived bool) {
+// Must be called with p.mu held.
+func (p *peerState) removeOpenAck(pktNum [4]byte, ackReceived bool) {
 	pktNum32 := binary.BigEndian.Uint32(pktNum[:])
 
-	openAck, exists := h.openAcks[addr][pktNum32]
-	assert.Assert(exists, "Open acknowledgment for host %s with packet number %v does not exist", addr, pktNum)
-
-	openAck.timer.Stop()
-	openAck.observable.NotifyObservers(ackReceived) // Notify observers that the ACK was received / not received
+	openAck, exists := p.openAcks[pktNum32]
+	if !exists {
+		logger.Warnf("Open acknowledgment for host %s with packet number %v does not exist", p.addr, pktNum)
+		return
+	}
 
-	delete(h.openAcks[addr], pktNum32)
-	if len(h.openAcks[addr]) == 0 {
-		delete(h.openAcks, addr)
+	p.detachOpenAck(pktNum32, openAck, ackReceived)
+	if len(p.openAcks) == 0 {
+		p.openAcks = nil
 	}
 
-	oldHighest := h.highestAckedContiguousPktNum[addr]
+	p.advanceHighestAcked()
 
-	// Advance highest if acked packets are now contiguous
-	for {
-		openAcks := h.openAcks[addr]
+	if ackReceived {
+		p.growCwnd(pktNum32, 1)
+	}
+}
 
-		nextHighestPktNum32 := uint32(h.highestAckedContiguousPktNum[addr] + 1)
+// RemoveOpenAcksUpTo removes the open acknowledgments of all packets of the peer up to pktNum (inclusive) as received, e.g. for a cumulative ACK.
+// Unlike calling RemoveOpenAck for every packet, the lock is acquired once and the highest contiguous packet number is advanced once.
+// Returns the number of removed open acknowledgments.
+// Can be called concurrently.
+func (h *OutgoingPktNumHandler) RemoveOpenAcksUpTo(addr netip.Addr, pktNum [4]byte) int {
+	peer := h.peer(addr)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
 
-		_, hasNextOpenAck := openAcks[nextHighestPktNum32]
+	pktNum32 := binary.BigEndian.Uint32(pktNum[:])
+	peer.recordJournal(JournalEntry{Kind: JournalAckUpTo, PktNum: pktNum32})
 
-		if hasNextOpenAck {
-			break
+	removed := 0
+	for openPktNum32, openAck := range peer.openAcks {
+		if openPktNum32 > pktNum32 {
+			continue
 		}
 
-		currentPktNum := h.packetNumbers[addr] - 1 // Last packet sent
-		if nextHighestPktNum32 > currentPktNum {
-			break // We've reached the end of sent packets
-		}
+		peer.sampleRTT(openAck)
+		peer.detachOpenAck(openPktNum32, openAck, true)
+		removed++
+	}
 
-		h.highestAckedContiguousPktNum[addr]++
+	if len(peer.openAcks) == 0 {
+		peer.openAcks = nil
 	}
 
-	newHighest := h.highestAckedContiguousPktNum[addr]
+	peer.advanceHighestAcked()
+	peer.growCwnd(pktNum32, removed)
 
-	if newHighest != oldHighest {
-		logger.Tracef("Advanced highest contiguous for %s from %d to %d (ACKed: %d)",
-			addr, oldHighest, newHighest, pktNum32)
-		h.rtoStartTime[addr] = time.Now() // Reset RTO start time after advancing highest contiguous
+	return removed
+}
+
+// detachOpenAck stops the open acknowledgment, notifies its observers and deletes it from the open acknowledgments of the peer.
+// The caller must reset the peer's map if it becomes empty and advance the highest contiguous packet number.
+// Must be called with p.mu held.
+func (p *peerState) detachOpenAck(pktNum32 uint32, openAck *OpenAck, ackReceived bool) {
+	openAck.timer.Stop()
+	openAck.stopCancel()
+	openAck.observable.NotifyObservers(ackReceived) // Notify observers that the ACK was received / not received
+	if !ackReceived {
+		p.recordExpired(pktNum32, openAck)
 	}
 
-	if ackReceived && !h.ignoreCwnd {
-		if _, exists := h.ssthresh[addr]; !exists {
-			h.ssthresh[addr] = math.MaxInt64
-		}
+	delete(p.openAcks, pktNum32)
+	p.inFlightBytes -= openAck.size
+}
 
-		cwnd := h.cwnd[addr]
-		ssthresh := h.ssthresh[addr]
+// growCwnd grows the congestion window of the peer for the given number of acknowledged packets.
+// pktNum32 is the packet number recorded in the congestion timeline.
+// Must be called with p.mu held.
+func (p *peerState) growCwnd(pktNum32 uint32, acked int) {
+	if p.h.ignoreCwnd || acked == 0 {
+		return
+	}
+
+	if p.ssthresh == 0 {
+		p.ssthresh = math.MaxInt64
+	}
+
+	for range acked {
+		cwnd := p.cwnd
+		ssthresh := p.ssthresh
 
 		if cwnd < ssthresh {
 			// Slow start
-			h.cwnd[addr] = h.cwnd[addr] + 1
-			h.cAvoidanceAcc[addr] = 0 // Reset accumulator when leaving slow start
+			p.cwnd = p.cwnd + 1
+			p.cAvoidanceAcc = 0 // Reset accumulator when leaving slow start
+			p.recordCongestionEvent(CwndIncrease, pktNum32)
+			p.recordPhaseChange(true, pktNum32)
 		} else {
 			// Congestion avoidance
-			accu := h.cAvoidanceAcc[addr]
+			accu := p.cAvoidanceAcc
 			accu++
 
 			if accu >= cwnd {
-				h.cwnd[addr] = h.cwnd[addr] + 1
-				// h.cAvoidanceAcc[addr] = 0 // This is faster (effectively always in slow start modus)
+				p.cwnd = p.cwnd + 1
+				// p.cAvoidanceAcc = 0 // This is faster (effectively always in slow start modus)
 				accu = 0 // But this should be correct
+				p.recordCongestionEvent(CwndIncrease, pktNum32)
 			}
 
-			h.cAvoidanceAcc[addr] = accu
+			p.cAvoidanceAcc = accu
+		}
+	}
+}
+
+// validateIdleCwnd decays the congestion window of the peer after an idle period (RFC 7661, RFC 2861).
+// The window was validated by the network before the peer went idle, sending it as a burst now could overflow a path whose state is unknown by now.
+// cwnd is halved for every idle interval since the last transmission, down to the restart window min(initial window, cwnd).
+// ssthresh keeps 3/4 of the old window, so slow start quickly regains it if the path is still good.
+// Must be called with p.mu held, while no packet of the peer is waiting for an ACK.
+func (p *peerState) validateIdleCwnd(pktNum32 uint32) {
+	interval := p.idleInterval()
+	if interval <= 0 || p.lastSentAt.IsZero() {
+		return
+	}
+
+	idle := p.h.now().Sub(p.lastSentAt)
+	restartWindow := min(p.h.initialCwnd, p.cwnd)
+	if idle < interval || p.cwnd <= restartWindow {
+		return
+	}
+
+	cwnd := p.cwnd
+	wasSlowStart := p.isSlowStart()
+	if p.ssthresh != 0 {
+		p.ssthresh = max(p.ssthresh, 3*cwnd/4)
+	}
+	for range idle / interval {
+		p.cwnd = max(p.cwnd/2, restartWindow)
+		if p.cwnd == restartWindow {
+			break
+		}
+	}
+	p.cAvoidanceAcc = 0
+	p.recordCongestionEvent(IdleDecay, pktNum32)
+	p.recordPhaseChange(wasSlowStart, pktNum32)
+	logger.Debugf("IDLE DECAY for %s after %v: cwnd %d decayed to %d, ssthresh %d", p.addr, idle, cwnd, p.cwnd, p.ssthresh)
+}
+
+// idleInterval returns the idle period after which the congestion window of the peer is decayed.
+// It is the configured interval, but at least the retransmission timeout estimated from the round-trip times of the peer, so a slow path isn't considered idle between two round trips.
+// Must be called with p.mu held.
+func (p *peerState) idleInterval() time.Duration {
+	interval := p.h.idleInterval
+	if interval > 0 && p.rtt != nil && p.rtt.samples > 0 {
+		interval = max(interval, p.rtt.rto())
+	}
+	return interval
+}
+
+// advanceHighestAcked advances the highest acknowledged contiguous packet number over all sent packets that have no open acknowledgment anymore.
+// Packet numbers that were never sent, e.g. because the send was cancelled, are skipped as well.
+// Must be called with p.mu held.
+func (p *peerState) advanceHighestAcked() {
+	nextPktNum, exists := p.h.nextPktNum(p.addr)
+	if !exists {
+		return // The peer was cleared, there are no sent packets to advance over
+	}
+
+	if !p.sending {
+		return
+	}
+	oldHighest := p.highestAcked
+
+	for {
+		nextHighestPktNum := p.highestAcked + 1
+
+		if nextHighestPktNum >= int64(nextPktNum) {
+			break // We've reached the end of sent packets
+		}
+
+		if _, hasNextOpenAck := p.openAcks[uint32(nextHighestPktNum)]; hasNextOpenAck {
+			break
+		}
+
+		p.highestAcked++
+	}
+
+	newHighest := p.highestAcked
+
+	if newHighest != oldHighest {
+		logger.Tracef("Advanced highest contiguous for %s from %d to %d", p.addr, oldHighest, newHighest)
+		p.rtoStartTime = p.h.now() // Reset RTO start time after advancing highest contiguous
+	}
+}
+
+// AbortSequence removes the open acknowledgments of the packets fromPktNum to toPktNum (inclusive) of the peer, e.g. after a transfer was cancelled.
+// The packets aren't resent anymore and their ACK observers are notified that the ACK was not received.
+// Returns the number of removed open acknowledgments.
+// Can be called concurrently.
+func (h *OutgoingPktNumHandler) AbortSequence(addr netip.Addr, fromPktNum uint32, toPktNum uint32) int {
+	peer := h.peer(addr)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	peer.recordJournal(JournalEntry{Kind: JournalAbort, PktNum: fromPktNum, ToPktNum: toPktNum})
+
+	aborted := 0
+	for pktNum32, openAck := range peer.openAcks {
+		if pktNum32 < fromPktNum || pktNum32 > toPktNum {
+			continue
+		}
+
+		peer.detachOpenAck(pktNum32, openAck, false)
+		aborted++
+	}
+
+	if len(peer.openAcks) == 0 {
+		peer.openAcks = nil
+	}
+
+	peer.advanceHighestAcked()
+
+	if aborted > 0 {
+		logger.Debugf("Aborted %d open acknowledgments for host %s between packet numbers %d and %d", aborted, addr, fromPktNum, toPktNum)
+	}
+	return aborted
+}
+
+// StartGarbageCollection runs CollectGarbage every interval.
+func (h *OutgoingPktNumHandler) StartGarbageCollection(interval time.Duration) {
+	var timer clock.Timer
+	timer = h.clock.AfterFunc(interval, func() {
+		defer timer.Reset(interval)
+		defer panics.Recover("collecting garbage of open acknowledgments")
+		h.CollectGarbage()
+	})
+}
+
+// CollectGarbage removes state of sequences that were abandoned mid-way.
+// Open acknowledgments and sequencing state of peers without packet numbers, i.e. peers that were cleared while a packet was being sent, are removed.
+// Empty open acknowledgment maps are reset and the highest acknowledged contiguous packet numbers are advanced over packet numbers that were never sent.
+// The peers are collected one after another, so the ACKs of one peer don't wait for the whole collection.
+// Returns the number of removed peers.
+// Can be called concurrently.
+func (h *OutgoingPktNumHandler) CollectGarbage() (removedPeers int) {
+	h.recordJournal(JournalEntry{Kind: JournalGC})
+
+	for _, peer := range h.allPeers() {
+		if peer.collectGarbage() {
+			removedPeers++
+		}
+	}
+
+	if removedPeers > 0 {
+		logger.Debugf("Removed stale sequencing state of %d peers", removedPeers)
+	}
+	return removedPeers
+}
+
+// collectGarbage removes the state of the peer if it has no packet numbers, see CollectGarbage.
+// Returns true if the state was removed.
+func (p *peerState) collectGarbage() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.openAcks == nil && !p.sending {
+		return false
+	}
+
+	if _, exists := p.h.nextPktNum(p.addr); exists {
+		if len(p.openAcks) == 0 {
+			p.openAcks = nil
 		}
+		p.advanceHighestAcked()
+		return false
+	}
+
+	for _, openAck := range p.openAcks {
+		openAck.timer.Stop()
+		openAck.stopCancel()
+		openAck.observable.NotifyObservers(false)
+	}
+	p.clear()
+	return true
+}
+
+// isSlowStart reports whether the peer is currently in the slow start phase.
+// Must be called with p.mu held.
+func (p *peerState) isSlowStart() bool {
+	return p.ssthresh == 0 || p.cwnd < p.ssthresh
+}
+
+// recordPhaseChange records a transition between slow start and congestion avoidance if the phase differs from wasSlowStart.
+// Must be called with p.mu held.
+func (p *peerState) recordPhaseChange(wasSlowStart bool, pktNum uint32) {
+	isSlowStart := p.isSlowStart()
+	if isSlowStart == wasSlowStart {
+		return
+	}
+
+	if isSlowStart {
+		p.recordCongestionEvent(EnterSlowStart, pktNum)
+	} else {
+		p.recordCongestionEvent(EnterCongAvoidance, pktNum)
 	}
 }
 
@@ -298,14 +726,12 @@ type OpenAckInfo struct {
 // GetOpenAcks returns a map of peers to their open acknowledgment packet numbers and timer status.
 // This is thread-safe.
 func (h *OutgoingPktNumHandler) GetOpenAcks() map[netip.Addr][]OpenAckInfo {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
 	result := make(map[netip.Addr][]OpenAckInfo)
-	for addr, acks := range h.openAcks {
-		if len(acks) > 0 {
-			ackInfos := make([]OpenAckInfo, 0, len(acks))
-			for pktNum, ack := range acks {
+	for _, peer := range h.allPeers() {
+		peer.mu.Lock()
+		if len(peer.openAcks) > 0 {
+			ackInfos := make([]OpenAckInfo, 0, len(peer.openAcks))
+			for pktNum, ack := range peer.openAcks {
 				status := "nil"
 				if ack.timer != nil {
 					status = "active"
@@ -314,34 +740,77 @@ func (h *OutgoingPktNumHandler) GetOpenAcks() map[netip.Addr][]OpenAckInfo {
 			}
 			// Sort for consistent output
 			sort.Slice(ackInfos, func(i, j int) bool { return ackInfos[i].PktNum < ackInfos[j].PktNum })
-			result[addr] = ackInfos
+			result[peer.addr] = ackInfos
 		}
+		peer.mu.Unlock()
 	}
 	return result
 }
 
+// PendingTimers returns the number of timers scheduled on the timer wheel of the handler, to detect leaked timers.
+// Every open acknowledgment with an active timer has one, the garbage collection (see StartGarbageCollection) another one.
+// Returns false if the handler doesn't use the timer wheel, see SetClock.
+// Can be called concurrently.
+func (h *OutgoingPktNumHandler) PendingTimers() (int, bool) {
+	c, ok := h.clock.(wheelClock)
+	if !ok {
+		return 0, false
+	}
+	return c.wheel.Len(), true
+}
+
 // GetCongestionWindows returns a map of peers to their current congestion window size.
 // This is thread-safe.
 func (h *OutgoingPktNumHandler) GetCongestionWindows() map[netip.Addr]int64 {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+	windows := make(map[netip.Addr]int64)
+	for _, peer := range h.allPeers() {
+		peer.mu.Lock()
+		if peer.sending {
+			windows[peer.addr] = peer.cwnd
+		}
+		peer.mu.Unlock()
+	}
+	return windows
+}
 
-	// Return a copy to prevent race conditions on the original map
-	windowsCopy := make(map[netip.Addr]int64, len(h.cwnd))
-	maps.Copy(windowsCopy, h.cwnd)
-	return windowsCopy
+// GetWindowUsage returns the congestion window of the peer and the number of packets to it waiting for an ACK.
+// The window is the initial window if nothing was sent to the peer yet, and -1 if the congestion window is ignored.
+// This is thread-safe.
+func (h *OutgoingPktNumHandler) GetWindowUsage(addr netip.Addr) (cwnd int64, openAcks int) {
+	peer, exists := h.lookupPeer(addr)
+	if !exists {
+		if h.ignoreCwnd {
+			return -1, 0
+		}
+		return h.initialCwnd, 0
+	}
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if h.ignoreCwnd {
+		return -1, len(peer.openAcks)
+	}
+
+	cwnd = h.initialCwnd
+	if peer.sending {
+		cwnd = peer.cwnd
+	}
+	return cwnd, len(peer.openAcks)
 }
 
 // GetSlowStartThresholds returns a map of peers to their current slow start threshold.
 // This is thread-safe.
 func (h *OutgoingPktNumHandler) GetSlowStartThresholds() map[netip.Addr]int64 {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	// Return a copy to prevent race conditions on the original map
-	thresholdsCopy := make(map[netip.Addr]int64, len(h.ssthresh))
-	maps.Copy(thresholdsCopy, h.ssthresh)
-	return thresholdsCopy
+	thresholds := make(map[netip.Addr]int64)
+	for _, peer := range h.allPeers() {
+		peer.mu.Lock()
+		if peer.ssthresh != 0 {
+			thresholds[peer.addr] = peer.ssthresh
+		}
+		peer.mu.Unlock()
+	}
+	return thresholds
 }
 
 // func (h *OutgoingPktNumHandler) removeOpenAck(addr netip.Addr, pktNum [4]byte, ackReceived bool) {
@@ -1,11 +1,21 @@
 package sequencing
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"net/netip"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"bjoernblessin.de/chatprotogol/common"
 	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/clock"
 )
 
 func makePkt(num uint32, dest netip.Addr) *pkt.Packet {
@@ -27,7 +37,7 @@ func TestSenderWindowBlocks(t *testing.T) {
 
 	// Cannot send too far ahead packet
 	pktTooFar := makePkt(uint32(window+10), dest)
-	_, err := out.AddOpenAck(pktTooFar, func() {})
+	_, err := out.AddOpenAck(context.Background(), pktTooFar, func() {})
 	if err == nil {
 		t.Fatalf("expected error when sending packet too far ahead, got nil")
 	}
@@ -35,7 +45,7 @@ func TestSenderWindowBlocks(t *testing.T) {
 	// Fill the window
 	for i := range window {
 		pkt := makePkt(uint32(i), dest)
-		_, err := out.AddOpenAck(pkt, func() {})
+		_, err := out.AddOpenAck(context.Background(), pkt, func() {})
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -43,31 +53,81 @@ func TestSenderWindowBlocks(t *testing.T) {
 
 	// Next send should fail (window full)
 	pkt := makePkt(uint32(window), dest)
-	_, err = out.AddOpenAck(pkt, func() {})
+	_, err = out.AddOpenAck(context.Background(), pkt, func() {})
 	if err == nil {
 		t.Fatalf("expected error when window is full, got nil")
 	}
 
 	// Still cannot send too far ahead packet
-	_, err = out.AddOpenAck(pktTooFar, func() {})
+	_, err = out.AddOpenAck(context.Background(), pktTooFar, func() {})
 	if err == nil {
 		t.Fatalf("expected error when sending packet too far ahead, got nil")
 	}
 
 	// Remove one ack, should allow another send
 	out.RemoveOpenAck(dest, makePkt(0, dest).Header.PktNum)
-	_, err = out.AddOpenAck(makePkt(uint32(window), dest), func() {})
+	_, err = out.AddOpenAck(context.Background(), makePkt(uint32(window), dest), func() {})
 	if err != nil {
 		t.Fatalf("expected to send after ack, got error: %v", err)
 	}
 
 	// Still cannot send too far ahead packet
-	_, err = out.AddOpenAck(pktTooFar, func() {})
+	_, err = out.AddOpenAck(context.Background(), pktTooFar, func() {})
 	if err == nil {
 		t.Fatalf("expected error when sending packet too far ahead, got nil")
 	}
 }
 
+func TestInFlightBytesCap(t *testing.T) {
+	out := NewOutgoingPktNumHandler(100, false)
+	out.SetMaxInFlightBytes(3000)
+	dest := netip.MustParseAddr("10.0.0.1")
+
+	send := func(num uint32, payloadSize int) error {
+		packet := makePkt(num, dest)
+		packet.Payload = make(pkt.Payload, payloadSize)
+		out.setNextPktNum(dest, int64(num)+1)
+		_, err := out.AddOpenAck(context.Background(), packet, func() {})
+		return err
+	}
+
+	// A packet larger than the cap is sent if nothing else is in flight
+	if err := send(0, 4000); err != nil {
+		t.Fatalf("Packet larger than the cap was not sent alone: %v", err)
+	}
+	out.RemoveOpenAck(dest, makePkt(0, dest).Header.PktNum)
+
+	for num := uint32(1); num <= 2; num++ {
+		if err := send(num, 1200); err != nil {
+			t.Fatalf("Chunk %d within the cap was not sent: %v", num, err)
+		}
+	}
+	if err := send(3, 1200); !errors.Is(err, ErrWindowFull) {
+		t.Fatalf("Expected ErrWindowFull for a chunk exceeding the cap, got %v", err)
+	}
+	if err := send(3, 16); err != nil {
+		t.Errorf("Control packet within the cap was not sent: %v", err)
+	}
+
+	stats, _ := out.GetCongestionStats(dest)
+	if want := int64(3*pkt.HEADER_SIZE + 2*1200 + 16); stats.InFlightBytes != want {
+		t.Errorf("Expected %d bytes in flight, got %d", want, stats.InFlightBytes)
+	}
+
+	out.RemoveOpenAck(dest, makePkt(1, dest).Header.PktNum)
+	if err := send(4, 1200); err != nil {
+		t.Errorf("Chunk was not sent after an ACK freed the cap: %v", err)
+	}
+
+	out.ClearPacketNumbers(dest)
+	if err := send(0, 16); err != nil {
+		t.Fatalf("Failed to send after clearing: %v", err)
+	}
+	if stats, _ := out.GetCongestionStats(dest); stats.InFlightBytes != pkt.HEADER_SIZE+16 {
+		t.Errorf("Expected the bytes in flight to be reset when the peer is cleared, got %d", stats.InFlightBytes)
+	}
+}
+
 func TestHighestAckedAdvancementWhenAllPacketsAcked(t *testing.T) {
 	handler := NewOutgoingPktNumHandler(10, false)
 	addr := netip.MustParseAddr("192.168.1.1")
@@ -80,17 +140,17 @@ func TestHighestAckedAdvancementWhenAllPacketsAcked(t *testing.T) {
 		packets = append(packets, packet)
 
 		// Manually update the packet counter to match what GetNextpacketNumber would do
-		handler.packetNumbers[addr] = uint32(i + 1)
+		handler.setNextPktNum(addr, int64(i+1))
 
-		_, err := handler.AddOpenAck(packet, func() {})
+		_, err := handler.AddOpenAck(context.Background(), packet, func() {})
 		if err != nil {
 			t.Fatalf("Failed to add open ack for packet %d: %v", i, err)
 		}
 	}
 
 	// Verify initial state: highest should be -1 (no packets ACKed yet)
-	if handler.highestAckedContiguousPktNum[addr] != -1 {
-		t.Errorf("Expected highest acked to be -1, got %d", handler.highestAckedContiguousPktNum[addr])
+	if handler.peer(addr).highestAcked != -1 {
+		t.Errorf("Expected highest acked to be -1, got %d", handler.peer(addr).highestAcked)
 	}
 
 	// ACK packets in order: 0, 1, 2
@@ -99,9 +159,9 @@ func TestHighestAckedAdvancementWhenAllPacketsAcked(t *testing.T) {
 
 		// After each ACK, highest should advance
 		expected := int64(i)
-		if handler.highestAckedContiguousPktNum[addr] != expected {
+		if handler.peer(addr).highestAcked != expected {
 			t.Errorf("After ACKing packet %d, expected highest acked to be %d, got %d",
-				i, expected, handler.highestAckedContiguousPktNum[addr])
+				i, expected, handler.peer(addr).highestAcked)
 		}
 	}
 
@@ -110,13 +170,13 @@ func TestHighestAckedAdvancementWhenAllPacketsAcked(t *testing.T) {
 
 	// After ACKing packet 3, highest should advance to 3
 	expected := int64(3)
-	if handler.highestAckedContiguousPktNum[addr] != expected {
+	if handler.peer(addr).highestAcked != expected {
 		t.Errorf("After ACKing final packet 3, expected highest acked to be %d, got %d",
-			expected, handler.highestAckedContiguousPktNum[addr])
+			expected, handler.peer(addr).highestAcked)
 	}
 
 	// Verify that openAcks for this addr has been deleted (expected behavior)
-	if _, exists := handler.openAcks[addr]; exists {
+	if handler.peer(addr).openAcks != nil {
 		t.Error("Expected openAcks[addr] to be deleted after all packets ACKed")
 	}
 }
@@ -126,99 +186,677 @@ func TestCongestionAvoidanceAccumulatorReset(t *testing.T) {
 	addr := netip.MustParseAddr("192.168.1.1")
 
 	// Force into congestion avoidance phase by setting ssthresh low
-	handler.ssthresh[addr] = 1
-	handler.cwnd[addr] = 2 // Start with cwnd = 2
-	handler.cAvoidanceAcc[addr] = 0
+	peer := handler.peer(addr)
+	peer.sending = true
+	peer.highestAcked = -1
+	peer.ssthresh = 1
+	peer.cwnd = 2 // Start with cwnd = 2
+	peer.cAvoidanceAcc = 0
 
 	// Initial state: cwnd=2, accumulator=0
-	if handler.cwnd[addr] != 2 {
-		t.Errorf("Expected initial cwnd to be 2, got %d", handler.cwnd[addr])
+	if peer.cwnd != 2 {
+		t.Errorf("Expected initial cwnd to be 2, got %d", peer.cwnd)
 	}
-	if handler.cAvoidanceAcc[addr] != 0 {
-		t.Errorf("Expected initial accumulator to be 0, got %d", handler.cAvoidanceAcc[addr])
+	if peer.cAvoidanceAcc != 0 {
+		t.Errorf("Expected initial accumulator to be 0, got %d", peer.cAvoidanceAcc)
 	}
 
 	// Send packet 0
 	packet0 := makePkt(uint32(0), addr)
-	handler.packetNumbers[addr] = 1
-	_, err := handler.AddOpenAck(packet0, func() {})
+	handler.setNextPktNum(addr, 1)
+	_, err := handler.AddOpenAck(context.Background(), packet0, func() {})
 	if err != nil {
 		t.Fatalf("Failed to add open ack for packet 0: %v", err)
 	}
 
 	// Send packet 1
 	packet1 := makePkt(uint32(1), addr)
-	handler.packetNumbers[addr] = 2
-	_, err = handler.AddOpenAck(packet1, func() {})
+	handler.setNextPktNum(addr, 2)
+	_, err = handler.AddOpenAck(context.Background(), packet1, func() {})
 	if err != nil {
 		t.Fatalf("Failed to add open ack for packet 1: %v", err)
 	}
 
 	// ACK packet 0: accumulator should become 1, cwnd stays 2
 	handler.RemoveOpenAck(addr, packet0.Header.PktNum)
-	if handler.cwnd[addr] != 2 {
-		t.Errorf("After 1st ACK, expected cwnd to be 2, got %d", handler.cwnd[addr])
+	if peer.cwnd != 2 {
+		t.Errorf("After 1st ACK, expected cwnd to be 2, got %d", peer.cwnd)
 	}
-	if handler.cAvoidanceAcc[addr] != 1 {
-		t.Errorf("After 1st ACK, expected accumulator to be 1, got %d", handler.cAvoidanceAcc[addr])
+	if peer.cAvoidanceAcc != 1 {
+		t.Errorf("After 1st ACK, expected accumulator to be 1, got %d", peer.cAvoidanceAcc)
 	}
 
 	// Now we can send packet 2 (window has room)
 	packet2 := makePkt(uint32(2), addr)
-	handler.packetNumbers[addr] = 3
-	_, err = handler.AddOpenAck(packet2, func() {})
+	handler.setNextPktNum(addr, 3)
+	_, err = handler.AddOpenAck(context.Background(), packet2, func() {})
 	if err != nil {
 		t.Fatalf("Failed to add open ack for packet 2: %v", err)
 	}
 
 	// ACK packet 1: accumulator reaches cwnd (2), should trigger window increase and reset
 	handler.RemoveOpenAck(addr, packet1.Header.PktNum)
-	if handler.cwnd[addr] != 3 {
-		t.Errorf("After 2nd ACK, expected cwnd to be 3, got %d", handler.cwnd[addr])
+	if peer.cwnd != 3 {
+		t.Errorf("After 2nd ACK, expected cwnd to be 3, got %d", peer.cwnd)
 	}
-	if handler.cAvoidanceAcc[addr] != 0 {
-		t.Errorf("After 2nd ACK, expected accumulator to be reset to 0, got %d", handler.cAvoidanceAcc[addr])
+	if peer.cAvoidanceAcc != 0 {
+		t.Errorf("After 2nd ACK, expected accumulator to be reset to 0, got %d", peer.cAvoidanceAcc)
 	}
 
 	// Now we can send packet 3 (window increased to 3)
 	packet3 := makePkt(uint32(3), addr)
-	handler.packetNumbers[addr] = 4
-	_, err = handler.AddOpenAck(packet3, func() {})
+	handler.setNextPktNum(addr, 4)
+	_, err = handler.AddOpenAck(context.Background(), packet3, func() {})
 	if err != nil {
 		t.Fatalf("Failed to add open ack for packet 3: %v", err)
 	}
 
 	// ACK packet 2: accumulator should become 1 again
 	handler.RemoveOpenAck(addr, packet2.Header.PktNum)
-	if handler.cwnd[addr] != 3 {
-		t.Errorf("After 3rd ACK, expected cwnd to stay 3, got %d", handler.cwnd[addr])
+	if peer.cwnd != 3 {
+		t.Errorf("After 3rd ACK, expected cwnd to stay 3, got %d", peer.cwnd)
 	}
-	if handler.cAvoidanceAcc[addr] != 1 {
-		t.Errorf("After 3rd ACK, expected accumulator to be 1, got %d", handler.cAvoidanceAcc[addr])
+	if peer.cAvoidanceAcc != 1 {
+		t.Errorf("After 3rd ACK, expected accumulator to be 1, got %d", peer.cAvoidanceAcc)
 	}
 
 	// ACK packet 3: accumulator becomes 2
 	handler.RemoveOpenAck(addr, packet3.Header.PktNum)
-	if handler.cwnd[addr] != 3 {
-		t.Errorf("After 4th ACK, expected cwnd to stay 3, got %d", handler.cwnd[addr])
+	if peer.cwnd != 3 {
+		t.Errorf("After 4th ACK, expected cwnd to stay 3, got %d", peer.cwnd)
 	}
-	if handler.cAvoidanceAcc[addr] != 2 {
-		t.Errorf("After 4th ACK, expected accumulator to be 2, got %d", handler.cAvoidanceAcc[addr])
+	if peer.cAvoidanceAcc != 2 {
+		t.Errorf("After 4th ACK, expected accumulator to be 2, got %d", peer.cAvoidanceAcc)
 	}
 
 	// Send and ACK one more packet to trigger the next window increase
 	packet4 := makePkt(uint32(4), addr)
-	handler.packetNumbers[addr] = 5
-	_, err = handler.AddOpenAck(packet4, func() {})
+	handler.setNextPktNum(addr, 5)
+	_, err = handler.AddOpenAck(context.Background(), packet4, func() {})
 	if err != nil {
 		t.Fatalf("Failed to add open ack for packet 4: %v", err)
 	}
 
 	handler.RemoveOpenAck(addr, packet4.Header.PktNum)
-	if handler.cwnd[addr] != 4 {
-		t.Errorf("After 5th ACK, expected cwnd to be 4, got %d", handler.cwnd[addr])
+	if peer.cwnd != 4 {
+		t.Errorf("After 5th ACK, expected cwnd to be 4, got %d", peer.cwnd)
+	}
+	if peer.cAvoidanceAcc != 0 {
+		t.Errorf("After 5th ACK, expected accumulator to be reset to 0, got %d", peer.cAvoidanceAcc)
+	}
+}
+
+func TestCongestionTimelineRecordsEvents(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(2, false)
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	packet0 := makePkt(0, addr)
+	handler.setNextPktNum(addr, 1)
+	_, err := handler.AddOpenAck(context.Background(), packet0, func() {})
+	if err != nil {
+		t.Fatalf("Failed to add open ack for packet 0: %v", err)
+	}
+
+	// ACK in slow start grows the window
+	handler.RemoveOpenAck(addr, packet0.Header.PktNum)
+
+	packet1 := makePkt(1, addr)
+	handler.setNextPktNum(addr, 2)
+	_, err = handler.AddOpenAck(context.Background(), packet1, func() {})
+	if err != nil {
+		t.Fatalf("Failed to add open ack for packet 1: %v", err)
+	}
+
+	// Simulate the timeout of packet 1
+	handler.peer(addr).rtoStartTime = time.Time{}
+	handler.handleAckTimeout(addr, packet1.Header.PktNum, func() {})
+
+	stats, exists := handler.GetCongestionStats(addr)
+	if !exists {
+		t.Fatalf("Expected congestion stats for %s", addr)
+	}
+
+	var kinds []CongestionEventKind
+	for _, event := range stats.Timeline {
+		kinds = append(kinds, event.Kind)
+	}
+
+	expected := []CongestionEventKind{CwndIncrease, AckTimeout, SsthreshUpdate, CwndDecrease, EnterCongAvoidance}
+	if !slices.Equal(kinds, expected) {
+		t.Errorf("Expected timeline %v, got %v", expected, kinds)
+	}
+
+	if stats.Cwnd != 2 || stats.Ssthresh != 2 || stats.SlowStart {
+		t.Errorf("Expected cwnd 2, ssthresh 2 in congestion avoidance, got cwnd %d, ssthresh %d, slow start %v", stats.Cwnd, stats.Ssthresh, stats.SlowStart)
+	}
+
+	handler.ClearPacketNumbers(addr)
+	if _, exists := handler.GetCongestionStats(addr); exists {
+		t.Errorf("Expected congestion stats to be cleared")
+	}
+
+	// The totals outlive the congestion state
+	totals := handler.GetPeerTotals()[addr]
+	if totals.Packets != 2 || totals.Retransmissions != 1 || totals.MaxCwnd != 3 {
+		t.Errorf("Expected 2 packets, 1 retransmission and max cwnd 3, got %+v", totals)
+	}
+}
+
+func TestDuplicateOpenAckReturnsError(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(4, false)
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	packet := makePkt(0, addr)
+	handler.setNextPktNum(addr, 1)
+	_, err := handler.AddOpenAck(context.Background(), packet, func() {})
+	if err != nil {
+		t.Fatalf("Failed to add open ack: %v", err)
+	}
+	defer handler.RemoveOpenAck(addr, packet.Header.PktNum)
+
+	_, err = handler.AddOpenAck(context.Background(), packet, func() {})
+	if !errors.Is(err, DuplicateOpenAckError) {
+		t.Errorf("Expected DuplicateOpenAckError, got %v", err)
+	}
+}
+
+func TestCancelledOpenAckIsRemoved(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(4, false)
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	packet := makePkt(0, addr)
+	handler.setNextPktNum(addr, 1)
+	ackChan, err := handler.AddOpenAck(ctx, packet, func() {})
+	if err != nil {
+		t.Fatalf("Failed to add open ack: %v", err)
+	}
+
+	cancel()
+
+	select {
+	case acked := <-ackChan:
+		if acked {
+			t.Error("Expected the cancelled packet to be reported as not acknowledged")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the ACK channel to be notified after cancelling")
+	}
+
+	if openAcks := handler.GetOpenAcks(); len(openAcks[addr]) != 0 {
+		t.Errorf("Expected no open acks after cancelling, got %v", openAcks[addr])
+	}
+
+	_, err = handler.AddOpenAck(ctx, makePkt(1, addr), func() {})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled for a cancelled context, got %v", err)
+	}
+}
+
+func TestAbortSequenceSkipsUnsentPackets(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(10, false)
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	handler.setNextPktNum(addr, 4) // Packet 1 was never sent, e.g. because its send was cancelled
+	var ackChans []chan bool
+	for _, num := range []uint32{0, 2, 3} {
+		ackChan, err := handler.AddOpenAck(context.Background(), makePkt(num, addr), func() {})
+		if err != nil {
+			t.Fatalf("Failed to add open ack for packet %d: %v", num, err)
+		}
+		ackChans = append(ackChans, ackChan)
+	}
+
+	if aborted := handler.AbortSequence(addr, 0, 2); aborted != 2 {
+		t.Errorf("Expected 2 aborted open acks, got %d", aborted)
+	}
+
+	for _, ackChan := range ackChans[:2] {
+		if acked := <-ackChan; acked {
+			t.Error("Expected aborted packets to be reported as not acknowledged")
+		}
+	}
+
+	if highest := handler.peer(addr).highestAcked; highest != 2 {
+		t.Errorf("Expected highest acked contiguous packet number 2, got %d", highest)
+	}
+
+	handler.RemoveOpenAck(addr, makePkt(3, addr).Header.PktNum)
+	if handler.peer(addr).openAcks != nil {
+		t.Error("Expected the open acks of the peer to be removed")
+	}
+}
+
+func TestRemoveOpenAcksUpTo(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(10, false)
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	handler.setNextPktNum(addr, 5)
+	var ackChans []chan bool
+	for num := range uint32(5) {
+		ackChan, err := handler.AddOpenAck(context.Background(), makePkt(num, addr), func() {})
+		if err != nil {
+			t.Fatalf("Failed to add open ack for packet %d: %v", num, err)
+		}
+		ackChans = append(ackChans, ackChan)
+	}
+
+	if removed := handler.RemoveOpenAcksUpTo(addr, makePkt(2, addr).Header.PktNum); removed != 3 {
+		t.Errorf("Expected 3 removed open acks, got %d", removed)
+	}
+
+	for _, ackChan := range ackChans[:3] {
+		if acked := <-ackChan; !acked {
+			t.Error("Expected removed packets to be reported as acknowledged")
+		}
+	}
+
+	if highest := handler.peer(addr).highestAcked; highest != 2 {
+		t.Errorf("Expected highest acked contiguous packet number 2, got %d", highest)
+	}
+	if cwnd := handler.peer(addr).cwnd; cwnd != 13 {
+		t.Errorf("Expected the cwnd to grow by 3 in slow start, got %d", cwnd)
+	}
+	if open := len(handler.peer(addr).openAcks); open != 2 {
+		t.Errorf("Expected 2 remaining open acks, got %d", open)
+	}
+
+	if removed := handler.RemoveOpenAcksUpTo(addr, makePkt(2, addr).Header.PktNum); removed != 0 {
+		t.Errorf("Expected no removed open acks for an already acknowledged range, got %d", removed)
+	}
+}
+
+func TestCollectGarbageRemovesStalePeers(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(10, false)
+	active := netip.MustParseAddr("192.168.1.1")
+	cleared := netip.MustParseAddr("192.168.1.2")
+
+	handler.setNextPktNum(active, 3) // Packets 0 to 2 were never sent
+	activePeer := handler.peer(active)
+	activePeer.sending = true
+	activePeer.highestAcked = -1
+	activePeer.openAcks = make(map[uint32]*OpenAck)
+
+	// The peer was cleared between building and sending the packet
+	handler.setNextPktNum(cleared, 1)
+	ackChan, err := handler.AddOpenAck(context.Background(), makePkt(0, cleared), func() {})
+	if err != nil {
+		t.Fatalf("Failed to add open ack: %v", err)
+	}
+	handler.setNextPktNum(cleared, -1)
+
+	if removed := handler.CollectGarbage(); removed != 1 {
+		t.Errorf("Expected 1 removed peer, got %d", removed)
+	}
+
+	if acked := <-ackChan; acked {
+		t.Error("Expected the open ack of the cleared peer to be reported as not acknowledged")
+	}
+	if handler.peer(cleared).sending {
+		t.Error("Expected the state of the cleared peer to be removed")
+	}
+	if activePeer.openAcks != nil {
+		t.Error("Expected the empty open ack map of the active peer to be removed")
+	}
+	if highest := handler.peer(active).highestAcked; highest != 2 {
+		t.Errorf("Expected highest acked contiguous packet number 2 of the active peer, got %d", highest)
+	}
+}
+
+func TestPendingTimers(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(4, false)
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	handler.setNextPktNum(addr, 2)
+	for num := range uint32(2) {
+		if _, err := handler.AddOpenAck(context.Background(), makePkt(num, addr), func() {}); err != nil {
+			t.Fatalf("Failed to add open ack %d: %v", num, err)
+		}
+	}
+	if timers, ok := handler.PendingTimers(); !ok || timers != 2 {
+		t.Errorf("Expected 2 pending timers for 2 open acks, got %d (ok: %v)", timers, ok)
+	}
+
+	handler.RemoveOpenAcksUpTo(addr, [4]byte{0, 0, 0, 1})
+	if timers, _ := handler.PendingTimers(); timers != 0 {
+		t.Errorf("Expected the timers to be stopped with their open acks, got %d pending timers", timers)
+	}
+
+	handler.SetClock(clock.NewVirtual(time.Now()))
+	if _, ok := handler.PendingTimers(); ok {
+		t.Error("Expected no pending timers without the timer wheel")
+	}
+}
+
+// BenchmarkOpenAcks measures adding and removing open acknowledgments while a window of packets is outstanding, like a sender whose packets are acknowledged in order.
+func BenchmarkOpenAcks(b *testing.B) {
+	for _, window := range []uint32{1, 64, 1024} {
+		b.Run(fmt.Sprintf("window=%d", window), func(b *testing.B) {
+			out := NewOutgoingPktNumHandler(int64(window), true)
+			dest := netip.MustParseAddr("10.0.0.1")
+
+			var pktNum uint32
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := out.AddOpenAck(context.Background(), makePkt(pktNum, dest), func() {}); err != nil {
+					b.Fatalf("Failed to add open ack for packet %d: %v", pktNum, err)
+				}
+				if pktNum+1 >= window {
+					out.RemoveOpenAck(dest, makePkt(pktNum+1-window, dest).Header.PktNum)
+				}
+				pktNum++
+			}
+		})
+	}
+}
+
+func TestCongestionMarkReducesCwndOncePerWindow(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(2, false)
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	for i := range 4 {
+		packet := makePkt(uint32(i), addr)
+		handler.setNextPktNum(addr, int64(i)+1)
+		if _, err := handler.AddOpenAck(context.Background(), packet, func() {}); err != nil {
+			t.Fatalf("Failed to add open ack for packet %d: %v", i, err)
+		}
+		if i < 2 {
+			handler.RemoveOpenAck(addr, packet.Header.PktNum) // Slow start grows the window to 4
+		}
+	}
+	peer := handler.peer(addr)
+	peer.cwnd = 8
+
+	handler.HandleCongestionMark(addr, makePkt(2, addr).Header.PktNum)
+	if peer.cwnd != 4 || peer.ssthresh != 4 {
+		t.Fatalf("Expected cwnd 4 and ssthresh 4 after the mark, got cwnd %d, ssthresh %d", peer.cwnd, peer.ssthresh)
+	}
+
+	// Packet 3 was sent before the window was reduced
+	handler.HandleCongestionMark(addr, makePkt(3, addr).Header.PktNum)
+	if peer.cwnd != 4 {
+		t.Errorf("Expected a mark of the same window to be ignored, got cwnd %d", peer.cwnd)
+	}
+
+	handler.setNextPktNum(addr, 5)
+	handler.HandleCongestionMark(addr, makePkt(4, addr).Header.PktNum)
+	if peer.cwnd != 2 {
+		t.Errorf("Expected a mark of the next window to halve cwnd, got cwnd %d", peer.cwnd)
+	}
+
+	stats, _ := handler.GetCongestionStats(addr)
+	marks := 0
+	for _, event := range stats.Timeline {
+		if event.Kind == CongestionMark {
+			marks++
+		}
+	}
+	if marks != 2 {
+		t.Errorf("Expected 2 congestion marks in the timeline, got %d", marks)
+	}
+}
+
+func TestAckTimeoutsInVirtualTime(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(8, false)
+	virtual := clock.NewVirtual(time.Unix(1700000000, 0))
+	handler.SetClock(virtual)
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	handler.setNextPktNum(addr, 4)
+	resends := 0
+	ackChans := make([]chan bool, 0, 4)
+	for num := range uint32(4) {
+		ackChan, err := handler.AddOpenAck(context.Background(), makePkt(num, addr), func() { resends++ })
+		if err != nil {
+			t.Fatalf("Failed to add open ack for packet %d: %v", num, err)
+		}
+		ackChans = append(ackChans, ackChan)
+	}
+
+	virtual.Advance(common.ACK_TIMEOUT_DURATION)
+	if resends != 4 {
+		t.Errorf("Expected every packet to be resent once after the ACK timeout, got %d resends", resends)
+	}
+	stats, _ := handler.GetCongestionStats(addr)
+	if stats.Ssthresh != 4 {
+		t.Errorf("Expected ssthresh 4 after the timeout, got %d", stats.Ssthresh)
 	}
-	if handler.cAvoidanceAcc[addr] != 0 {
-		t.Errorf("After 5th ACK, expected accumulator to be reset to 0, got %d", handler.cAvoidanceAcc[addr])
+	timeouts := 0
+	for _, event := range stats.Timeline {
+		if event.Kind == AckTimeout {
+			timeouts++
+		}
+	}
+	if timeouts != 1 {
+		t.Errorf("Expected the window to be reduced once per RTO, got %d timeout events", timeouts)
+	}
+
+	virtual.Advance(common.ACK_TIMEOUT_DURATION * common.RETRIES_PER_PACKET)
+	for num, ackChan := range ackChans {
+		select {
+		case acked := <-ackChan:
+			if acked {
+				t.Errorf("Expected packet %d to be reported as lost", num)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected packet %d to be given up after %d retries", num, common.RETRIES_PER_PACKET)
+		}
+	}
+	if virtual.Pending() != 0 {
+		t.Errorf("Expected no pending timers, got %d", virtual.Pending())
+	}
+}
+
+// BenchmarkGetNextpacketNumber measures packet number allocation by 8 concurrent senders, to one shared peer or one peer each.
+func BenchmarkGetNextpacketNumber(b *testing.B) {
+	const senders = 8
+
+	for _, shared := range []bool{true, false} {
+		b.Run(fmt.Sprintf("shared=%v", shared), func(b *testing.B) {
+			out := NewOutgoingPktNumHandler(common.INITIAL_CWND, false)
+
+			b.SetParallelism(max(senders/runtime.GOMAXPROCS(0), 1))
+			var nextSender atomic.Uint32
+			b.RunParallel(func(pb *testing.PB) {
+				sender := nextSender.Add(1)
+				dest := netip.AddrFrom4([4]byte{10, 0, 0, 1})
+				if !shared {
+					dest = netip.AddrFrom4([4]byte{10, 0, 1, byte(sender)})
+				}
+
+				for pb.Next() {
+					out.GetNextpacketNumber(dest)
+				}
+			})
+		})
+	}
+}
+
+func TestGetNextpacketNumberConcurrent(t *testing.T) {
+	const senders = 8
+	const perSender = 1000
+
+	out := NewOutgoingPktNumHandler(common.INITIAL_CWND, false)
+	dest := netip.MustParseAddr("10.0.0.1")
+
+	allocated := make(chan uint32, senders*perSender)
+	var wg sync.WaitGroup
+	for range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perSender {
+				pktNum := out.GetNextpacketNumber(dest)
+				allocated <- binary.BigEndian.Uint32(pktNum[:])
+			}
+		}()
+	}
+	wg.Wait()
+	close(allocated)
+
+	seen := make(map[uint32]bool, senders*perSender)
+	for pktNum := range allocated {
+		if seen[pktNum] {
+			t.Fatalf("Packet number %d was allocated twice", pktNum)
+		}
+		seen[pktNum] = true
+	}
+	if next, _ := out.nextPktNum(dest); next != senders*perSender {
+		t.Errorf("Expected the next packet number %d, got %d", senders*perSender, next)
+	}
+
+	out.ClearPacketNumbers(dest)
+	if pktNum := out.GetNextpacketNumber(dest); pktNum != [4]byte{} {
+		t.Errorf("Expected packet number 0 after clearing the peer, got %v", pktNum)
+	}
+}
+
+func TestSlowPeerDoesNotBlockOtherPeers(t *testing.T) {
+	const peers = 8
+	const perPeer = 500
+
+	handler := NewOutgoingPktNumHandler(common.INITIAL_CWND, false)
+	slow := netip.MustParseAddr("10.0.0.1")
+
+	// The resend to the slow peer hangs while its ACK timeout is handled, the slow peer stays locked meanwhile
+	handler.setNextPktNum(slow, 1)
+	if _, err := handler.AddOpenAck(context.Background(), makePkt(0, slow), func() {}); err != nil {
+		t.Fatalf("Failed to add open ack: %v", err)
+	}
+	resending := make(chan struct{})
+	release := make(chan struct{})
+	timeoutDone := make(chan struct{})
+	go func() {
+		defer close(timeoutDone)
+		handler.handleAckTimeout(slow, makePkt(0, slow).Header.PktNum, func() {
+			close(resending)
+			<-release
+		})
+	}()
+	<-resending
+
+	slowAcked := make(chan struct{})
+	go func() {
+		defer close(slowAcked)
+		handler.RemoveOpenAck(slow, makePkt(0, slow).Header.PktNum)
+	}()
+
+	var wg sync.WaitGroup
+	for i := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dest := netip.AddrFrom4([4]byte{10, 0, 1, byte(i)})
+			for range perPeer {
+				packet := makePkt(0, dest)
+				packet.Header.PktNum = handler.GetNextpacketNumber(dest)
+				if _, err := handler.AddOpenAck(context.Background(), packet, func() {}); err != nil {
+					t.Errorf("Failed to add open ack for %s: %v", dest, err)
+					return
+				}
+				handler.RemoveOpenAck(dest, packet.Header.PktNum)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the other peers to be served while the slow peer is locked")
+	}
+
+	select {
+	case <-slowAcked:
+		t.Error("Expected the ACK of the slow peer to wait for its resend")
+	default:
+	}
+
+	close(release)
+	<-timeoutDone
+	<-slowAcked
+
+	for i := range peers {
+		dest := netip.AddrFrom4([4]byte{10, 0, 1, byte(i)})
+		stats, exists := handler.GetCongestionStats(dest)
+		if !exists || stats.HighestAckedContiguousPktNum != perPeer-1 || stats.OpenAcks != 0 {
+			t.Errorf("Expected all %d packets to %s to be acknowledged, got %+v", perPeer, dest, stats)
+		}
+	}
+	if stats, _ := handler.GetCongestionStats(slow); stats.OpenAcks != 0 {
+		t.Errorf("Expected the ACK of the slow peer to be handled after its resend, got %d open acks", stats.OpenAcks)
+	}
+}
+
+func TestIdleCwndDecay(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(2, false)
+	virtual := clock.NewVirtual(time.Unix(1700000000, 0))
+	handler.SetClock(virtual)
+	handler.SetIdleInterval(time.Second) // Shorter than the ACK timeout
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	var pktNum uint32
+	send := func(ack bool) {
+		t.Helper()
+		packet := makePkt(pktNum, addr)
+		handler.setNextPktNum(addr, int64(pktNum)+1)
+		if _, err := handler.AddOpenAck(context.Background(), packet, func() {}); err != nil {
+			t.Fatalf("Failed to add open ack for packet %d: %v", pktNum, err)
+		}
+		if ack {
+			handler.RemoveOpenAck(addr, packet.Header.PktNum)
+		}
+		pktNum++
+	}
+
+	for range 14 {
+		send(true) // Slow start grows the window to 16
+	}
+	peer := handler.peer(addr)
+	peer.ssthresh = 8
+
+	// A packet is in flight, so the peer isn't idle
+	send(false)
+	virtual.Advance(1500 * time.Millisecond)
+	send(false)
+	if peer.cwnd != 16 {
+		t.Fatalf("Expected cwnd 16 while a packet was in flight, got %d", peer.cwnd)
+	}
+	handler.RemoveOpenAcksUpTo(addr, makePkt(pktNum-1, addr).Header.PktNum)
+	peer.rtt = nil // Depending on the order of the two samples, their retransmission timeout would exceed the idle period
+
+	virtual.Advance(1500 * time.Millisecond)
+	send(true)
+	if peer.cwnd != 9 || peer.ssthresh != 12 {
+		t.Errorf("Expected cwnd 8 after one idle interval grown to 9 in slow start and ssthresh 12, got cwnd %d, ssthresh %d", peer.cwnd, peer.ssthresh)
+	}
+
+	virtual.Advance(10 * time.Second)
+	send(true)
+	if peer.cwnd != 3 {
+		t.Errorf("Expected cwnd to decay to the initial window 2 and grow to 3, got %d", peer.cwnd)
+	}
+
+	stats, _ := handler.GetCongestionStats(addr)
+	decays := 0
+	for _, event := range stats.Timeline {
+		if event.Kind == IdleDecay {
+			decays++
+		}
+	}
+	if decays != 2 {
+		t.Errorf("Expected 2 idle decays in the timeline, got %d", decays)
+	}
+
+	handler.SetIdleInterval(0)
+	virtual.Advance(10 * time.Second)
+	send(true)
+	if peer.cwnd != 4 {
+		t.Errorf("Expected no decay once it is disabled, got cwnd %d", peer.cwnd)
 	}
 }
@@ -0,0 +1,96 @@
+package sequencing
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/util/ringbuffer"
+)
+
+// peerState is the sequencing and congestion state of the packets sent to a single peer.
+// Every peer has its own lock, so a transfer to one peer doesn't delay the ACK handling of the others.
+// The state of a peer is reset instead of deleted when the peer is cleared, so a peerState is never replaced once created.
+type peerState struct {
+	mu              sync.Mutex
+	h               *OutgoingPktNumHandler
+	addr            netip.Addr
+	openAcks        map[uint32]*OpenAck // nil if there are no open acknowledgments
+	inFlightBytes   int64               // Sum of the sizes of the packets with open acknowledgments
+	sending         bool                // Something was sent since the peer was cleared, highestAcked and cwnd are set
+	highestAcked    int64               // Highest packet number that has been acknowledged contiguously
+	cwnd            int64
+	ssthresh        int64                                   // 0 until the first ACK or congestion event
+	cAvoidanceAcc   int64                                   // Used to count the number of packets acked in congestion avoidance phase
+	rtoStartTime    time.Time                               // Start time of the simulated RTO timer
+	lastSentAt      time.Time                               // Time of the last transmission, to detect idle periods
+	marked          bool                                    // markedWindowEnd is set
+	markedWindowEnd uint32                                  // Last packet number sent when cwnd was reduced for a congestion mark, later marks of packets up to it are ignored
+	ccTimeline      *ringbuffer.RingBuffer[CongestionEvent] // Recent congestion events, nil if there are none
+	rtt             *rttEstimator
+	expired         *ringbuffer.RingBuffer[expiredPacket] // Recently expired packets, to recognize late ACKs
+	unexpectedAcks  *unexpectedAcks
+	totals          *PeerTotals // Kept when the peer is cleared, see GetPeerTotals
+}
+
+// peer returns the state of the peer, creating it if necessary.
+// Can be called concurrently.
+func (h *OutgoingPktNumHandler) peer(addr netip.Addr) *peerState {
+	if peer, exists := h.lookupPeer(addr); exists {
+		return peer
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	peer, exists := h.peers[addr]
+	if !exists {
+		peer = &peerState{h: h, addr: addr}
+		h.peers[addr] = peer
+	}
+	return peer
+}
+
+// lookupPeer returns the state of the peer without creating it.
+// Can be called concurrently.
+func (h *OutgoingPktNumHandler) lookupPeer(addr netip.Addr) (*peerState, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	peer, exists := h.peers[addr]
+	return peer, exists
+}
+
+// allPeers returns the states of all peers.
+// The peers are locked one after another by the caller, the handler isn't locked as a whole.
+func (h *OutgoingPktNumHandler) allPeers() []*peerState {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	peers := make([]*peerState, 0, len(h.peers))
+	for _, peer := range h.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// clear resets the congestion and round-trip time state of the peer, the totals are kept.
+// The open acknowledgments must have been detached before.
+// Must be called with p.mu held.
+func (p *peerState) clear() {
+	p.openAcks = nil
+	p.inFlightBytes = 0
+	p.sending = false
+	p.highestAcked = 0
+	p.cwnd = 0
+	p.ssthresh = 0
+	p.cAvoidanceAcc = 0
+	p.rtoStartTime = time.Time{}
+	p.lastSentAt = time.Time{}
+	p.marked = false
+	p.markedWindowEnd = 0
+	p.ccTimeline = nil
+	p.rtt = nil
+	p.expired = nil
+	p.unexpectedAcks = nil
+}
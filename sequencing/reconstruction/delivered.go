@@ -0,0 +1,45 @@
+package reconstruction
+
+import (
+	"fmt"
+	"net/netip"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/util/ringbuffer"
+)
+
+// MessageID identifies a message independently of the connection it was received on.
+// Packet numbers only restart with a new boot epoch, so the ID stays the same if the complete sequence is retransmitted after a reconnect.
+type MessageID struct {
+	Origin      netip.Addr
+	Epoch       uint64 // Boot epoch of the origin
+	FirstPktNum uint32
+	LastPktNum  uint32
+}
+
+func (id MessageID) String() string {
+	return fmt.Sprintf("%v/%d/%d-%d", id.Origin, id.Epoch, id.FirstPktNum, id.LastPktNum)
+}
+
+// MarkDelivered records the message as delivered to the user.
+// Returns true if the message was already delivered, it must not be shown again then.
+// The last common.DELIVERED_MESSAGE_HISTORY_SIZE message IDs are kept per peer, also if the peer's state is cleared.
+func (m *Manager) MarkDelivered(id MessageID) (alreadyDelivered bool) {
+	m.deliveredMu.Lock()
+	defer m.deliveredMu.Unlock()
+
+	history, exists := m.delivered[id.Origin]
+	if !exists {
+		history = ringbuffer.New[MessageID](common.DELIVERED_MESSAGE_HISTORY_SIZE)
+		m.delivered[id.Origin] = history
+	}
+
+	for _, delivered := range history.Items() {
+		if delivered == id {
+			return true
+		}
+	}
+
+	history.Push(id)
+	return false
+}
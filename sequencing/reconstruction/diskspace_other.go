@@ -0,0 +1,10 @@
+//go:build !(linux || darwin)
+
+package reconstruction
+
+import "errors"
+
+// availableDiskSpace isn't supported on this platform, the disk space check is skipped.
+func availableDiskSpace(dir string) (int64, error) {
+	return 0, errors.New("disk space check not supported on this platform")
+}
@@ -1,17 +1,25 @@
 package reconstruction
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"net/netip"
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
+	"time"
 
 	"bjoernblessin.de/chatprotogol/common"
 	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sequencing"
 	"bjoernblessin.de/chatprotogol/util/assert"
+	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
 // OnDiskReconstructor is responsible for reconstructing file transfer packets.
@@ -22,10 +30,16 @@ type OnDiskReconstructor struct {
 	lowestPktNum           int64
 	highestWrittenPktNum   int64
 	highestUnwrittenPktNum int64
+	receivedBytes          int64 // Sum of all received payload sizes including the file name, limited by common.MAX_FILE_SIZE_BYTES
 	file                   *os.File
+	originalFileName       string    // File name as sent by the peer, set by FinishFilePacketSequence
+	advertisedSize         int64     // File size advertised by the sender, -1 if unknown
+	startTime              time.Time // Time the first packet was received
+	hash                   hash.Hash // SHA-256 of the written file content
 	// inSequencing           *sequencing.IncomingPktNumHandler
 	peerAddr netip.Addr
-	mu       sync.Mutex // Mutex to protect concurrent access to the (whole) reconstructor
+	stats    *sequencing.TransferStats // Counts the written file bytes and the received duplicates
+	mu       sync.Mutex                // Mutex to protect concurrent access to the (whole) reconstructor
 }
 
 func NewOnDiskReconstructor(peerAddr netip.Addr) *OnDiskReconstructor {
@@ -34,29 +48,101 @@ func NewOnDiskReconstructor(peerAddr netip.Addr) *OnDiskReconstructor {
 		lowestPktNum:           -1,
 		highestWrittenPktNum:   -1,
 		highestUnwrittenPktNum: -1,
+		advertisedSize:         -1,
+		hash:                   sha256.New(),
 		// inSequencing:           inSeq,
 		peerAddr: peerAddr,
+		stats:    sequencing.NewTransferStats(),
 	}
 }
 
+// ErrFileTooLarge is returned if a file exceeds common.MAX_FILE_SIZE_BYTES.
+var ErrFileTooLarge = errors.New("file exceeds the maximum file size")
+
+// ErrInsufficientDiskSpace is returned if the advertised file size doesn't fit on the disk of common.RECEIVED_FILES_DIR.
+var ErrInsufficientDiskSpace = errors.New("not enough disk space for the file")
+
+// createReceiveFile creates the temporary file a received file is reconstructed in.
+// It is created inside common.RECEIVED_FILES_DIR, so the finished file can be renamed without crossing filesystems.
+func createReceiveFile() (*os.File, error) {
+	err := os.MkdirAll(common.RECEIVED_FILES_DIR, 0700) // owner read/write/execute, group and others no permissions
+	if err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(common.RECEIVED_FILES_DIR, ".recon_")
+}
+
+// checkFileSize checks the advertised size of a file against common.MAX_FILE_SIZE_BYTES and the available disk space.
+// common.MIN_FREE_DISK_SPACE_BYTES are kept free. The disk space check is skipped if the platform doesn't support it.
+func checkFileSize(fileSize int64) error {
+	if fileSize > common.MAX_FILE_SIZE_BYTES {
+		return ErrFileTooLarge
+	}
+
+	available, err := availableDiskSpace(common.RECEIVED_FILES_DIR)
+	if err != nil {
+		return nil
+	}
+
+	if fileSize > available-common.MIN_FREE_DISK_SPACE_BYTES {
+		return ErrInsufficientDiskSpace
+	}
+	return nil
+}
+
+// AvailableDiskSpace returns the number of bytes available on the disk of common.RECEIVED_FILES_DIR, including the common.MIN_FREE_DISK_SPACE_BYTES that are kept free.
+// If the directory doesn't exist yet, the disk of its closest existing parent is checked.
+// Errors if the platform doesn't support the check.
+func AvailableDiskSpace() (int64, error) {
+	dir := common.RECEIVED_FILES_DIR
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return availableDiskSpace(dir)
+}
+
 // HandleIncomingFilePacket processes an incoming file transfer packet.
+// Errors with ErrFileTooLarge if the file would exceed common.MAX_FILE_SIZE_BYTES, the packet is not stored then.
 func (r *OnDiskReconstructor) HandleIncomingFilePacket(packet *pkt.Packet) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	pktNum := int64(binary.BigEndian.Uint32(packet.Header.PktNum[:]))
+	if r.packetBuffer == nil {
+		return ErrReconstructorCleared
+	}
 
-	r.packetBuffer[pktNum] = packet.Payload
+	if r.receivedBytes+int64(len(packet.Payload)) > common.MAX_FILE_SIZE_BYTES {
+		return ErrFileTooLarge
+	}
 
 	if r.file == nil {
 		fmt.Printf("Creating new file for reconstruction for %v\n", r.peerAddr)
-		file, err := os.CreateTemp("", "recon_")
+		file, err := createReceiveFile()
 		if err != nil {
-			return errors.New("failed to create file for file reconstruction")
+			return fmt.Errorf("failed to create file for file reconstruction: %w", err)
 		}
 		r.file = file
+		r.startTime = time.Now()
 	}
 
+	if fileSize, ok := packet.GetFileSize(); ok {
+		// This is the file name packet, check the advertised size before accepting the file
+		err := checkFileSize(fileSize)
+		if err != nil {
+			return err
+		}
+		r.advertisedSize = fileSize
+	}
+
+	r.receivedBytes += int64(len(packet.Payload))
+
+	pktNum := int64(binary.BigEndian.Uint32(packet.Header.PktNum[:]))
+
+	r.packetBuffer[pktNum] = packet.Payload
+
 	if r.lowestPktNum < 0 {
 		// This is the first packet, initialize lowestPktNum
 		r.lowestPktNum = pktNum
@@ -79,6 +165,12 @@ func (r *OnDiskReconstructor) HandleIncomingFilePacket(packet *pkt.Packet) error
 	return nil
 }
 
+// writePayload appends the payload to the file and the file hash.
+func (r *OnDiskReconstructor) writePayload(payload pkt.Payload) (int, error) {
+	r.hash.Write(payload)
+	return r.file.Write(payload)
+}
+
 // flushBuffer writes buffered packets to disk and clears the buffer.
 func (r *OnDiskReconstructor) flushContiguousPayloads() {
 	// highestContiguousPktNum := r.inSequencing.GetHighestContiguousSeqNum(r.peerAddr)
@@ -98,11 +190,12 @@ func (r *OnDiskReconstructor) flushContiguousPayloads() {
 			return
 		}
 
-		_, err := r.file.Write(payload)
+		_, err := r.writePayload(payload)
 		if err != nil {
 			assert.IsNil(err, "failed to write payload to file in flushContiguousPayloads")
 			return
 		}
+		r.stats.AddPacket(len(payload))
 		delete(r.packetBuffer, i)
 		r.highestWrittenPktNum = i
 	}
@@ -115,11 +208,12 @@ func (r *OnDiskReconstructor) flushRemainingPayloads() {
 			continue // Skip if no payload for this packet number; this means that the packet with packet number i is not a file transfer packet
 		}
 
-		_, err := r.file.Write(payload)
+		_, err := r.writePayload(payload)
 		if err != nil {
 			assert.IsNil(err, "failed to write remaining payload to file in flushRemainingPayloads")
 			return
 		}
+		r.stats.AddPacket(len(payload))
 		delete(r.packetBuffer, i)
 	}
 }
@@ -140,20 +234,87 @@ func (r *OnDiskReconstructor) FinishFilePacketSequence() (string, error) {
 
 	const FILE_NAME_SIZE_BYTES = 1024
 	n := min(len(metadataPayload), FILE_NAME_SIZE_BYTES)
-	fileName := string(metadataPayload[:n])
+	r.originalFileName = string(metadataPayload[:n])
 
-	dir := common.RECEIVED_FILES_DIR
+	// Each transfer gets its own directory, so files of different peers and transfers never collide
+	dir := filepath.Join(common.RECEIVED_FILES_DIR, r.peerAddr.String(), r.startTime.Format(TRANSFER_DIR_TIME_FORMAT))
 	err = os.MkdirAll(dir, 0700) // owner read/write/execute, group and others no permissions
 	if err != nil {
 		return "", fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	err = os.Rename(r.file.Name(), filepath.Join(dir, fileName))
+	// The name is chosen by the peer, it must not escape the directory or overwrite an existing file
+	path, err := reserveUniquePath(dir, SanitizeFileName(r.originalFileName))
 	if err != nil {
+		return "", fmt.Errorf("failed to reserve file name: %w", err)
+	}
+
+	err = os.Rename(r.file.Name(), path) // Replaces the reserved empty file
+	if errors.Is(err, syscall.EXDEV) {
+		// The directory is on another filesystem than the temporary file
+		err = moveFile(r.file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(path)
 		return "", fmt.Errorf("failed to rename file: %w", err)
 	}
 
-	return filepath.Join(dir, fileName), nil
+	stats := r.stats.Snapshot()
+	metadata := FileMetadata{
+		Sender:         r.peerAddr,
+		OriginalName:   r.originalFileName,
+		StoredName:     filepath.Base(path),
+		Size:           stats.Bytes,
+		StartedAt:      r.startTime,
+		DurationMillis: time.Since(r.startTime).Milliseconds(),
+		SHA256:         hex.EncodeToString(r.hash.Sum(nil)),
+		ChecksumStatus: checksumStatus(stats.Bytes, r.advertisedSize),
+	}
+	if r.advertisedSize >= 0 {
+		metadata.AdvertisedSize = &r.advertisedSize
+	}
+
+	err = writeSidecar(path, metadata)
+	if err != nil {
+		logger.Warnf("Failed to write metadata sidecar of %s: %v", path, err)
+	}
+
+	return path, nil
+}
+
+// GetOriginalFileName returns the file name as sent by the peer.
+// It is only known after FinishFilePacketSequence.
+func (r *OnDiskReconstructor) GetOriginalFileName() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.originalFileName
+}
+
+// moveFile copies the file to the destination and deletes the source.
+// Used if the file can't be renamed because the destination is on another filesystem.
+func moveFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Remove(src)
 }
 
 // GetHighestPktNum returns the highest packet number that has been processed by this reconstructor.
@@ -168,6 +329,16 @@ func (r *OnDiskReconstructor) GetHighestPktNum() (uint32, error) {
 	return uint32(r.highestUnwrittenPktNum), nil
 }
 
+// RecordDuplicate records that a duplicate packet of this file transfer was received.
+func (r *OnDiskReconstructor) RecordDuplicate() {
+	r.stats.AddRetransmission()
+}
+
+// GetStats returns the statistics of the file transfer.
+func (r *OnDiskReconstructor) GetStats() sequencing.TransferSummary {
+	return r.stats.Snapshot()
+}
+
 func (r *OnDiskReconstructor) ClearState() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -176,10 +347,15 @@ func (r *OnDiskReconstructor) ClearState() error {
 	r.lowestPktNum = -1
 	r.highestWrittenPktNum = -1
 	r.highestUnwrittenPktNum = -1
+	r.receivedBytes = 0
 
 	var err error = nil
 	if r.file != nil {
 		err = r.file.Close()
+		// Remove the partial file of an unfinished transfer, a finished file was already renamed
+		if removeErr := os.Remove(r.file.Name()); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+			err = removeErr
+		}
 		r.file = nil
 	}
 
@@ -1,14 +1,34 @@
 package reconstruction
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"net/netip"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"bjoernblessin.de/chatprotogol/common"
 	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/util/strictjson"
 )
 
+// TestMain stores the reconstructed files of all tests in a temporary directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "chatprotogol_reconstruction_test")
+	if err != nil {
+		panic(err)
+	}
+	common.RECEIVED_FILES_DIR = dir
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func makePacket(seqNum uint32, payload []byte) *pkt.Packet {
 	var pktNum [4]byte
 	binary.BigEndian.PutUint32(pktNum[:], seqNum)
@@ -135,3 +155,131 @@ func Test_MetadataNotFirstPacket(t *testing.T) {
 		t.Errorf("file contents mismatch (metadata not first).\nGot:  %q\nWant: %q", got, want)
 	}
 }
+
+func TestOnDiskReconstructor_ClearStateRemovesPartialFile(t *testing.T) {
+	peerAddr := netip.MustParseAddr("10.0.0.2")
+	r := NewOnDiskReconstructor(peerAddr)
+
+	r.HandleIncomingFilePacket(makePacket(0, []byte("partial.bin")))
+	r.HandleIncomingFilePacket(makePacket(1, []byte("data")))
+	tempPath := r.file.Name()
+
+	if err := r.ClearState(); err != nil {
+		t.Fatalf("ClearState failed: %v", err)
+	}
+
+	if _, err := os.Stat(tempPath); !os.IsNotExist(err) {
+		t.Errorf("partial file %s still exists after ClearState", tempPath)
+	}
+}
+
+func TestOnDiskReconstructor_RejectsAdvertisedSize(t *testing.T) {
+	peerAddr := netip.MustParseAddr("10.0.0.2")
+	r := NewOnDiskReconstructor(peerAddr)
+	defer r.ClearState()
+
+	packet := makePacket(0, []byte("huge.bin"))
+	packet.AddExtension(pkt.ExtTypeFileSize, binary.BigEndian.AppendUint64(nil, common.MAX_FILE_SIZE_BYTES+1))
+
+	if err := r.HandleIncomingFilePacket(packet); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected ErrFileTooLarge, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(common.RECEIVED_FILES_DIR, "huge.bin")); !os.IsNotExist(err) {
+		t.Errorf("rejected file was stored")
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+
+	if err := os.WriteFile(src, []byte("content"), 0600); err != nil {
+		t.Fatalf("failed to write source file: %v", err)
+	}
+
+	if err := moveFile(src, dst); err != nil {
+		t.Fatalf("moveFile failed: %v", err)
+	}
+
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source file still exists after moveFile")
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil || string(got) != "content" {
+		t.Errorf("destination content mismatch: %q (%v)", got, err)
+	}
+}
+
+func TestOnDiskReconstructor_SanitizesAndDeduplicatesName(t *testing.T) {
+	// The fixed transfer directory must be empty, also if the test runs repeatedly
+	receivedFilesDir := common.RECEIVED_FILES_DIR
+	common.RECEIVED_FILES_DIR = t.TempDir()
+	t.Cleanup(func() { common.RECEIVED_FILES_DIR = receivedFilesDir })
+
+	peerAddr := netip.MustParseAddr("10.0.0.2")
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	var paths []string
+	for range 2 {
+		r := NewOnDiskReconstructor(peerAddr)
+		r.HandleIncomingFilePacket(makePacket(0, []byte("../../escape.txt")))
+		r.HandleIncomingFilePacket(makePacket(1, []byte("data")))
+		r.startTime = start // Both transfers share the transfer directory
+
+		path, err := r.FinishFilePacketSequence()
+		if err != nil {
+			t.Fatalf("FinishFilePacketSequence failed: %v", err)
+		}
+		if r.GetOriginalFileName() != "../../escape.txt" {
+			t.Errorf("original file name %q not kept", r.GetOriginalFileName())
+		}
+		paths = append(paths, path)
+	}
+
+	wantDir := filepath.Join(common.RECEIVED_FILES_DIR, "10.0.0.2", "2025-06-01_12-00-00")
+	want := []string{"escape.txt", "escape (1).txt"}
+	for i, path := range paths {
+		if path != filepath.Join(wantDir, want[i]) {
+			t.Errorf("file %d stored at %s, want %s", i, path, filepath.Join(wantDir, want[i]))
+		}
+	}
+}
+
+func TestOnDiskReconstructor_WritesSidecar(t *testing.T) {
+	peerAddr := netip.MustParseAddr("10.0.0.5")
+	content := []byte("sidecar content")
+
+	r := NewOnDiskReconstructor(peerAddr)
+	namePacket := makePacket(0, []byte("audit.txt"))
+	namePacket.AddExtension(pkt.ExtTypeFileSize, binary.BigEndian.AppendUint64(nil, uint64(len(content))))
+	r.HandleIncomingFilePacket(namePacket)
+	r.HandleIncomingFilePacket(makePacket(1, content))
+
+	path, err := r.FinishFilePacketSequence()
+	if err != nil {
+		t.Fatalf("FinishFilePacketSequence failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path + SIDECAR_SUFFIX)
+	if err != nil {
+		t.Fatalf("failed to read sidecar: %v", err)
+	}
+
+	var metadata FileMetadata
+	if err := strictjson.Unmarshal(data, &metadata); err != nil {
+		t.Fatalf("failed to parse sidecar: %v", err)
+	}
+
+	hash := sha256.Sum256(content)
+	if metadata.Sender != peerAddr || metadata.OriginalName != "audit.txt" || metadata.Size != int64(len(content)) {
+		t.Errorf("unexpected sidecar %+v", metadata)
+	}
+	if metadata.SHA256 != hex.EncodeToString(hash[:]) {
+		t.Errorf("sidecar hash %s, want %x", metadata.SHA256, hash)
+	}
+	if metadata.ChecksumStatus != ChecksumVerified {
+		t.Errorf("checksum status %q, want %q", metadata.ChecksumStatus, ChecksumVerified)
+	}
+}
@@ -0,0 +1,101 @@
+package reconstruction
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const MAX_FILE_NAME_BYTES = 255 // Most filesystems limit names to 255 bytes
+
+const defaultFileName = "received_file"
+
+// windowsReservedNames can't be used as file names on Windows, regardless of the extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFileName turns a file name received from a peer into a safe name inside the received files directory.
+// Directory components (of both / and \ separators) are stripped, control and reserved characters are replaced by '_'
+// and leading dots are removed, so the name can't escape the directory or hide the file.
+// The result is at most MAX_FILE_NAME_BYTES long and never empty.
+func SanitizeFileName(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	name = strings.TrimLeft(name, ". ")
+	name = strings.TrimRight(name, ". ") // Windows drops trailing dots and spaces
+
+	if name == "" {
+		return defaultFileName
+	}
+
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	if windowsReservedNames[strings.ToUpper(stem)] {
+		name = "_" + name
+	}
+
+	return truncateFileName(name, MAX_FILE_NAME_BYTES)
+}
+
+// truncateFileName shortens the name to maxBytes at a rune boundary and keeps the extension if possible.
+func truncateFileName(name string, maxBytes int) string {
+	if len(name) <= maxBytes {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) >= maxBytes {
+		ext = ""
+	}
+
+	stem := strings.TrimSuffix(name, ext)
+	limit := maxBytes - len(ext)
+	for limit > 0 && !utf8.RuneStart(stem[limit]) {
+		limit--
+	}
+
+	return stem[:limit] + ext
+}
+
+// reserveUniquePath creates an empty file for the name in dir and returns its path.
+// If the name is taken, " (1)", " (2)", ... is inserted before the extension until a free name is found.
+// The file is created exclusively, so concurrent transfers never get the same path.
+func reserveUniquePath(dir string, name string) (string, error) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			suffix := fmt.Sprintf(" (%d)", i)
+			candidate = truncateFileName(stem, MAX_FILE_NAME_BYTES-len(suffix)-len(ext)) + suffix + ext
+		}
+
+		path := filepath.Join(dir, candidate)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			file.Close()
+			return path, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package reconstruction
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{`..\..\Windows\system.ini`, "system.ini"},
+		{"/absolute/path.txt", "path.txt"},
+		{"..", defaultFileName},
+		{"", defaultFileName},
+		{".bashrc", "bashrc"},
+		{"a\x00b\nc.txt", "a_b_c.txt"},
+		{`what?<>:"|*.txt`, "what_______.txt"},
+		{"CON.txt", "_CON.txt"},
+		{"trailing. . ", "trailing"},
+		{"bad\xffutf8.txt", "bad_utf8.txt"},
+	}
+
+	for _, tt := range tests {
+		if got := SanitizeFileName(tt.name); got != tt.want {
+			t.Errorf("SanitizeFileName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFileName_Truncates(t *testing.T) {
+	name := strings.Repeat("ä", 200) + ".txt" // 404 bytes
+
+	got := SanitizeFileName(name)
+	if len(got) > MAX_FILE_NAME_BYTES {
+		t.Fatalf("sanitized name has %d bytes, want at most %d", len(got), MAX_FILE_NAME_BYTES)
+	}
+	if !strings.HasSuffix(got, ".txt") {
+		t.Errorf("extension lost: %q", got)
+	}
+	if !strings.HasPrefix(got, "ää") || strings.ContainsRune(got, '�') {
+		t.Errorf("name not cut at a rune boundary: %q", got)
+	}
+}
+
+func TestReserveUniquePath(t *testing.T) {
+	dir := t.TempDir()
+
+	want := []string{"file.txt", "file (1).txt", "file (2).txt"}
+	for _, wantName := range want {
+		path, err := reserveUniquePath(dir, "file.txt")
+		if err != nil {
+			t.Fatalf("reserveUniquePath failed: %v", err)
+		}
+		if filepath.Base(path) != wantName {
+			t.Errorf("got %q, want %q", filepath.Base(path), wantName)
+		}
+	}
+}
@@ -9,30 +9,160 @@ import (
 	"slices"
 	"sync"
 
+	"bjoernblessin.de/chatprotogol/common"
 	"bjoernblessin.de/chatprotogol/pkt"
 	"bjoernblessin.de/chatprotogol/util/assert"
+	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
+// InMemoryReconstructor reconstructs chat messages.
+// Payloads are buffered in memory until the message exceeds common.MSG_SPILL_THRESHOLD_BYTES,
+// then all payloads are moved to a spill file on disk and further payloads are appended there.
 type InMemoryReconstructor struct {
 	bufferedPayloads map[[4]byte]pkt.Payload
+	bufferedBytes    int        // Sum of the received payload sizes (in memory and spilled), limited by common.MAX_MESSAGE_SIZE_BYTES
+	spill            *spillFile // Non-nil after the message was spilled to disk
+	consumedUpTo     int64      // Packet number up to which payloads were passed to ConsumeContiguous, -1 before
+	consumedBytes    int        // Length of the message prefix passed to ConsumeContiguous
+	streamBroken     bool       // A payload arrived below consumedUpTo, so the consumed prefix is not the prefix of the message
 	mu               sync.Mutex
 }
 
+// ErrMessageTooLarge is returned if a message exceeds common.MAX_MESSAGE_SIZE_BYTES.
+var ErrMessageTooLarge = errors.New("message exceeds the maximum message size")
+
+// ErrReconstructorCleared is returned if a packet is added to a reconstructor after its state was cleared.
+var ErrReconstructorCleared = errors.New("reconstructor state was cleared")
+
 // NewInMemoryReconstructor creates a new InMemoryReconstructor instance.
 func NewInMemoryReconstructor() *InMemoryReconstructor {
 	return &InMemoryReconstructor{
 		bufferedPayloads: make(map[[4]byte]pkt.Payload),
+		consumedUpTo:     -1,
 	}
 }
 
 // HandleIncomingMsgPacket processes an incoming message packet.
 // It stores the payload in the reconstruction buffer.
 // The buffer can be read later using finishMsgPacketSequence.
-func (r *InMemoryReconstructor) HandleIncomingMsgPacket(packet *pkt.Packet) {
+// Errors with ErrMessageTooLarge if the message would exceed common.MAX_MESSAGE_SIZE_BYTES, the packet is not stored then.
+func (r *InMemoryReconstructor) HandleIncomingMsgPacket(packet *pkt.Packet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.bufferedPayloads == nil {
+		return ErrReconstructorCleared
+	}
+
+	if r.bufferedBytes+len(packet.Payload) > common.MAX_MESSAGE_SIZE_BYTES {
+		return ErrMessageTooLarge
+	}
+
+	if int64(binary.BigEndian.Uint32(packet.Header.PktNum[:])) <= r.consumedUpTo {
+		// The packet was marked as received by the sequencing before it was stored here, after a later payload was consumed
+		r.streamBroken = true
+	}
+
+	if r.spill == nil && r.bufferedBytes+len(packet.Payload) > common.MSG_SPILL_THRESHOLD_BYTES {
+		err := r.spillToDisk()
+		if err != nil {
+			logger.Warnf("Failed to spill message to disk, keeping it in memory: %v", err)
+		}
+	}
+
+	if r.spill != nil {
+		err := r.spill.Append(binary.BigEndian.Uint32(packet.Header.PktNum[:]), packet.Payload)
+		if err != nil {
+			return err
+		}
+	} else {
+		r.bufferedPayloads[packet.Header.PktNum] = packet.Payload
+	}
+
+	r.bufferedBytes += len(packet.Payload)
+	return nil
+}
+
+// spillToDisk moves all buffered payloads to a new spill file.
+func (r *InMemoryReconstructor) spillToDisk() error {
+	spill, err := newSpillFile()
+	if err != nil {
+		return err
+	}
+
+	for pktNum, payload := range r.bufferedPayloads {
+		err := spill.Append(binary.BigEndian.Uint32(pktNum[:]), payload)
+		if err != nil {
+			spill.Remove()
+			return err
+		}
+	}
+
+	logger.Debugf("Message exceeds %d bytes, spilled %d buffered payloads to disk", common.MSG_SPILL_THRESHOLD_BYTES, len(r.bufferedPayloads))
+
+	r.spill = spill
+	clear(r.bufferedPayloads)
+	return nil
+}
+
+// ConsumeContiguous passes the payloads with packet numbers up to upTo that weren't consumed yet to consume, ordered by packet number.
+// upTo must be a packet number up to which all packets of the peer were received (see sequencing.IncomingPktNumHandler.GetHighestContiguousSeqNum),
+// so all payloads of the message up to it are known and form a prefix of the message even though other transfers use packet numbers in between.
+// consume is called with the reconstructor locked, so concurrent calls consume the message in order.
+// It is not called if there is nothing new to consume or a payload arrived late, see StreamedBytes.
+// The payloads are kept, FinishMsgPacketSequence still returns the complete message.
+func (r *InMemoryReconstructor) ConsumeContiguous(upTo int64, consume func(data []byte)) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	r.bufferedPayloads[packet.Header.PktNum] = packet.Payload
+	if r.bufferedPayloads == nil {
+		return ErrReconstructorCleared
+	}
+	if r.streamBroken || upTo <= r.consumedUpTo {
+		return nil
+	}
+
+	var data []byte
+	if r.spill != nil {
+		var err error
+		data, err = r.spill.ReadRange(r.consumedUpTo, upTo)
+		if err != nil {
+			return err
+		}
+	} else {
+		pktNums := []uint32{}
+		for pktNum := range r.bufferedPayloads {
+			if num := int64(binary.BigEndian.Uint32(pktNum[:])); num > r.consumedUpTo && num <= upTo {
+				pktNums = append(pktNums, uint32(num))
+			}
+		}
+		slices.Sort(pktNums)
+
+		for _, pktNum := range pktNums {
+			data = append(data, r.bufferedPayloads[[4]byte(binary.BigEndian.AppendUint32(nil, pktNum))]...)
+		}
+	}
+
+	r.consumedUpTo = upTo
+	if len(data) == 0 {
+		return nil
+	}
+
+	r.consumedBytes += len(data)
+	consume(data)
+	return nil
+}
+
+// StreamedBytes returns the length of the message prefix that was passed to ConsumeContiguous.
+// Returns 0 if a payload arrived after a later payload was consumed, the consumed data is not a prefix of the message then.
+func (r *InMemoryReconstructor) StreamedBytes() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.streamBroken {
+		return 0
+	}
+	return r.consumedBytes
 }
 
 // FinishMsgPacketSequence completes the current packet sequence for a specific source address.
@@ -41,6 +171,10 @@ func (r *InMemoryReconstructor) FinishMsgPacketSequence() (completeMsg []byte, e
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if r.spill != nil {
+		return r.spill.ReadOrdered()
+	}
+
 	sortedSeqNums := []uint32{}
 	for seqNum := range r.bufferedPayloads {
 		sortedSeqNums = append(sortedSeqNums, binary.BigEndian.Uint32(seqNum[:]))
@@ -64,6 +198,10 @@ func (r *InMemoryReconstructor) GetHighestPktNum() (uint32, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if r.spill != nil {
+		return r.spill.HighestPktNum()
+	}
+
 	if len(r.bufferedPayloads) == 0 {
 		return 0, errors.New("no packets buffered")
 	}
@@ -84,5 +222,12 @@ func (r *InMemoryReconstructor) ClearState() error {
 	defer r.mu.Unlock()
 
 	r.bufferedPayloads = nil
-	return nil
+	r.bufferedBytes = 0
+
+	var err error = nil
+	if r.spill != nil {
+		err = r.spill.Remove()
+		r.spill = nil
+	}
+	return err
 }
@@ -1,11 +1,16 @@
 package reconstruction
 
 import (
-	"fmt"
+	"errors"
 	"net/netip"
+	"slices"
 	"sync"
+	"time"
 
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
 	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/ringbuffer"
 )
 
 type Reconstructor interface {
@@ -15,90 +20,277 @@ type Reconstructor interface {
 	ClearState() error
 }
 
-var (
-	fileReconstructors      = make(map[netip.Addr]*OnDiskReconstructor)
-	fileReconstructorsMutex sync.Mutex
-)
+// StreamKey identifies a reconstructed packet sequence by the sending peer and the message type of the sequence.
+type StreamKey struct {
+	Peer    netip.Addr
+	MsgType byte // pkt.MsgTypeChatMessage or pkt.MsgTypeFileTransfer
+}
 
-var (
-	msgReconstructors      = make(map[netip.Addr]*InMemoryReconstructor)
-	msgReconstructorsMutex sync.Mutex
-)
+// Registry holds the open reconstructors of one kind by stream.
+// The Registry is thread-safe and can be used concurrently.
+type Registry[T Reconstructor] struct {
+	reconstructors   map[StreamKey]T
+	newReconstructor func(key StreamKey) T
+	mu               sync.Mutex
+}
+
+// NewRegistry creates an empty registry. newReconstructor creates the reconstructor of a stream on first use.
+func NewRegistry[T Reconstructor](newReconstructor func(key StreamKey) T) *Registry[T] {
+	return &Registry[T]{
+		reconstructors:   make(map[StreamKey]T),
+		newReconstructor: newReconstructor,
+	}
+}
+
+// Get returns the reconstructor of the stream.
+func (reg *Registry[T]) Get(key StreamKey) (T, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
 
-func GetOrCreateFileReconstructor(addr netip.Addr) *OnDiskReconstructor {
-	fileReconstructorsMutex.Lock()
-	defer fileReconstructorsMutex.Unlock()
+	reconstructor, exists := reg.reconstructors[key]
+	return reconstructor, exists
+}
+
+// GetOrCreate returns the reconstructor of the stream and creates it if it doesn't exist.
+func (reg *Registry[T]) GetOrCreate(key StreamKey) T {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
 
-	reconstructor, exists := fileReconstructors[addr]
+	reconstructor, exists := reg.reconstructors[key]
 	if !exists {
-		fmt.Print("Creating new file reconstructor for ", addr, "\n")
-		reconstructor = NewOnDiskReconstructor(addr)
-		fileReconstructors[addr] = reconstructor
+		reconstructor = reg.newReconstructor(key)
+		reg.reconstructors[key] = reconstructor
 	}
 
-	fileReconstructors[addr] = reconstructor
 	return reconstructor
 }
 
-func GetFileReconstructor(addr netip.Addr) (*OnDiskReconstructor, bool) {
-	fileReconstructorsMutex.Lock()
-	defer fileReconstructorsMutex.Unlock()
+// Clear clears the state of the stream's reconstructor and removes it.
+func (reg *Registry[T]) Clear(key StreamKey) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
 
-	reconstructor, exists := fileReconstructors[addr]
+	reconstructor, exists := reg.reconstructors[key]
 	if !exists {
-		return nil, false
+		logger.Debugf("No reconstructor found for %v (type %d) to clear", key.Peer, key.MsgType)
+		return
 	}
 
-	return reconstructor, true
+	reconstructor.ClearState()
+	delete(reg.reconstructors, key)
+	logger.Debugf("Cleared reconstructor state for %v (type %d)", key.Peer, key.MsgType)
 }
 
-func GetOrCreateMsgReconstructor(addr netip.Addr) *InMemoryReconstructor {
-	msgReconstructorsMutex.Lock()
-	defer msgReconstructorsMutex.Unlock()
+// ClearPeer clears and removes all reconstructors of the peer.
+func (reg *Registry[T]) ClearPeer(peer netip.Addr) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
 
-	reconstructor, exists := msgReconstructors[addr]
-	if !exists {
-		reconstructor = NewInMemoryReconstructor()
-		msgReconstructors[addr] = reconstructor
+	for key, reconstructor := range reg.reconstructors {
+		if key.Peer == peer {
+			reconstructor.ClearState()
+			delete(reg.reconstructors, key)
+		}
 	}
+}
 
-	return reconstructor
+// Count returns the number of open reconstructors of the peer.
+func (reg *Registry[T]) Count(peer netip.Addr) int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	count := 0
+	for key := range reg.reconstructors {
+		if key.Peer == peer {
+			count++
+		}
+	}
+	return count
 }
 
-func GetMsgReconstructor(addr netip.Addr) (*InMemoryReconstructor, bool) {
-	msgReconstructorsMutex.Lock()
-	defer msgReconstructorsMutex.Unlock()
+// Len returns the number of open reconstructors of all peers.
+func (reg *Registry[T]) Len() int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
 
-	reconstructor, exists := msgReconstructors[addr]
-	if !exists {
-		return nil, false
+	return len(reg.reconstructors)
+}
+
+// Keys returns the streams with an open reconstructor.
+func (reg *Registry[T]) Keys() []StreamKey {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	keys := make([]StreamKey, 0, len(reg.reconstructors))
+	for key := range reg.reconstructors {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Manager owns the message and file reconstructors of all peers and the rejected transfers.
+// It is created once and injected into the packet handler and the connection package.
+// The Manager is thread-safe and can be used concurrently.
+type Manager struct {
+	files    *Registry[*OnDiskReconstructor]
+	messages *Registry[*InMemoryReconstructor]
+	createMu sync.Mutex         // Serializes the creation of reconstructors, so the limit holds across both registries
+	rejected map[StreamKey]bool // Aborted transfers, further packets are dropped until the transfer is finished
+	rejectMu sync.Mutex
+	sentAt   map[netip.Addr]time.Time // Sender timestamp of the latest received message per peer
+	sentAtMu sync.Mutex
+
+	delivered   map[netip.Addr]*ringbuffer.RingBuffer[MessageID] // IDs of recently delivered messages per peer, see MarkDelivered
+	deliveredMu sync.Mutex
+}
+
+// ErrTooManyReconstructors is returned if common.MAX_RECONSTRUCTORS transfers are open already.
+var ErrTooManyReconstructors = errors.New("too many concurrent transfers")
+
+func NewManager() *Manager {
+	return &Manager{
+		files: NewRegistry(func(key StreamKey) *OnDiskReconstructor {
+			return NewOnDiskReconstructor(key.Peer)
+		}),
+		messages: NewRegistry(func(key StreamKey) *InMemoryReconstructor {
+			return NewInMemoryReconstructor()
+		}),
+		rejected:  make(map[StreamKey]bool),
+		sentAt:    make(map[netip.Addr]time.Time),
+		delivered: make(map[netip.Addr]*ringbuffer.RingBuffer[MessageID]),
 	}
+}
 
-	return reconstructor, true
+// checkLimit errors with ErrTooManyReconstructors if no further transfer can be opened.
+// A peer has at most one message and one file open, the limit bounds the transfers of many peers (or of many addresses of one sender).
+// The caller must hold createMu, so no other reconstructor is created between the check and the creation.
+func (m *Manager) checkLimit() error {
+	if m.files.Len()+m.messages.Len() >= common.MAX_RECONSTRUCTORS {
+		return ErrTooManyReconstructors
+	}
+	return nil
 }
 
-func ClearFileReconstructor(addr netip.Addr) {
-	fileReconstructorsMutex.Lock()
-	defer fileReconstructorsMutex.Unlock()
+// GetOrCreateFileReconstructor returns the file reconstructor of the peer and creates it if it doesn't exist.
+// Errors with ErrTooManyReconstructors if creating it would exceed common.MAX_RECONSTRUCTORS.
+func (m *Manager) GetOrCreateFileReconstructor(addr netip.Addr) (*OnDiskReconstructor, error) {
+	m.createMu.Lock()
+	defer m.createMu.Unlock()
 
-	if reconstructor, exists := fileReconstructors[addr]; exists {
-		reconstructor.ClearState()
-		delete(fileReconstructors, addr)
-		logger.Debugf("Cleared file reconstructor state for %v", addr)
-	} else {
-		logger.Debugf("No file reconstructor found for %v to clear", addr)
+	if reconstructor, exists := m.GetFileReconstructor(addr); exists {
+		return reconstructor, nil
 	}
+
+	if err := m.checkLimit(); err != nil {
+		return nil, err
+	}
+
+	return m.files.GetOrCreate(StreamKey{addr, pkt.MsgTypeFileTransfer}), nil
+}
+
+func (m *Manager) GetFileReconstructor(addr netip.Addr) (*OnDiskReconstructor, bool) {
+	return m.files.Get(StreamKey{addr, pkt.MsgTypeFileTransfer})
+}
+
+// GetOrCreateMsgReconstructor returns the message reconstructor of the peer and creates it if it doesn't exist.
+// Errors with ErrTooManyReconstructors if creating it would exceed common.MAX_RECONSTRUCTORS.
+func (m *Manager) GetOrCreateMsgReconstructor(addr netip.Addr) (*InMemoryReconstructor, error) {
+	m.createMu.Lock()
+	defer m.createMu.Unlock()
+
+	if reconstructor, exists := m.GetMsgReconstructor(addr); exists {
+		return reconstructor, nil
+	}
+
+	if err := m.checkLimit(); err != nil {
+		return nil, err
+	}
+
+	return m.messages.GetOrCreate(StreamKey{addr, pkt.MsgTypeChatMessage}), nil
+}
+
+func (m *Manager) GetMsgReconstructor(addr netip.Addr) (*InMemoryReconstructor, bool) {
+	return m.messages.Get(StreamKey{addr, pkt.MsgTypeChatMessage})
+}
+
+func (m *Manager) ClearFileReconstructor(addr netip.Addr) {
+	m.files.Clear(StreamKey{addr, pkt.MsgTypeFileTransfer})
+}
+
+func (m *Manager) ClearMsgReconstructor(addr netip.Addr) {
+	m.messages.Clear(StreamKey{addr, pkt.MsgTypeChatMessage})
+}
+
+// OpenStreams returns the streams of all peers with an open message or file reconstructor, ordered by peer and message type.
+func (m *Manager) OpenStreams() []StreamKey {
+	streams := append(m.files.Keys(), m.messages.Keys()...)
+	slices.SortFunc(streams, func(a, b StreamKey) int {
+		if c := a.Peer.Compare(b.Peer); c != 0 {
+			return c
+		}
+		return int(a.MsgType) - int(b.MsgType)
+	})
+	return streams
+}
+
+// ClearPeer clears all reconstructors and rejected transfers of the peer.
+// Called when the peer is gone or restarted.
+func (m *Manager) ClearPeer(addr netip.Addr) {
+	m.files.ClearPeer(addr)
+	m.messages.ClearPeer(addr)
+	m.ClearRejections(addr)
+
+	m.sentAtMu.Lock()
+	delete(m.sentAt, addr)
+	m.sentAtMu.Unlock()
+}
+
+// RecordMessageSentAt remembers the sender timestamp of a received message of the peer.
+// Returns true if the message was sent before the previously received message of the peer, i.e. the messages were reordered.
+func (m *Manager) RecordMessageSentAt(addr netip.Addr, sentAt time.Time) (reordered bool) {
+	m.sentAtMu.Lock()
+	defer m.sentAtMu.Unlock()
+
+	if latest, exists := m.sentAt[addr]; exists && sentAt.Before(latest) {
+		return true
+	}
+	m.sentAt[addr] = sentAt
+	return false
+}
+
+// RejectTransfer clears the reconstructor of the peer's transfer with the message type and marks the transfer as rejected.
+// msgType is pkt.MsgTypeChatMessage or pkt.MsgTypeFileTransfer.
+func (m *Manager) RejectTransfer(addr netip.Addr, msgType byte) {
+	switch msgType {
+	case pkt.MsgTypeChatMessage:
+		m.ClearMsgReconstructor(addr)
+	case pkt.MsgTypeFileTransfer:
+		m.ClearFileReconstructor(addr)
+	}
+
+	m.rejectMu.Lock()
+	defer m.rejectMu.Unlock()
+
+	m.rejected[StreamKey{addr, msgType}] = true
+}
+
+// IsRejected returns whether the peer's transfer with the message type was rejected and not finished yet.
+func (m *Manager) IsRejected(addr netip.Addr, msgType byte) bool {
+	m.rejectMu.Lock()
+	defer m.rejectMu.Unlock()
+
+	return m.rejected[StreamKey{addr, msgType}]
 }
 
-func ClearMsgReconstructor(addr netip.Addr) {
-	msgReconstructorsMutex.Lock()
-	defer msgReconstructorsMutex.Unlock()
+// ClearRejections forgets all rejected transfers of the peer.
+// Called when a rejected transfer is finished or the peer is gone.
+func (m *Manager) ClearRejections(addr netip.Addr) {
+	m.rejectMu.Lock()
+	defer m.rejectMu.Unlock()
 
-	if reconstructor, exists := msgReconstructors[addr]; exists {
-		reconstructor.ClearState()
-		delete(msgReconstructors, addr)
-		logger.Debugf("Cleared message reconstructor state for %v", addr)
-	} else {
-		logger.Debugf("No message reconstructor found for %v to clear", addr)
+	for key := range m.rejected {
+		if key.Peer == addr {
+			delete(m.rejected, key)
+		}
 	}
 }
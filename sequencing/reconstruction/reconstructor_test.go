@@ -0,0 +1,252 @@
+package reconstruction
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+func TestInMemoryReconstructor_MessageTooLarge(t *testing.T) {
+	r := NewInMemoryReconstructor()
+
+	if err := r.HandleIncomingMsgPacket(makePacket(0, make([]byte, common.MAX_MESSAGE_SIZE_BYTES))); err != nil {
+		t.Fatalf("message of exactly the maximum size was rejected: %v", err)
+	}
+
+	err := r.HandleIncomingMsgPacket(makePacket(1, []byte("x")))
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+	}
+
+	highest, err := r.GetHighestPktNum()
+	if err != nil || highest != 0 {
+		t.Errorf("rejected packet was stored, highest packet number %d (%v)", highest, err)
+	}
+}
+
+func TestManager_Limit(t *testing.T) {
+	m := NewManager()
+
+	for i := range common.MAX_RECONSTRUCTORS {
+		peerAddr := netip.AddrFrom4([4]byte{10, 1, byte(i >> 8), byte(i)})
+		if _, err := m.GetOrCreateMsgReconstructor(peerAddr); err != nil {
+			t.Fatalf("failed to create message reconstructor %d: %v", i, err)
+		}
+	}
+
+	otherAddr := netip.MustParseAddr("10.2.0.1")
+	if _, err := m.GetOrCreateMsgReconstructor(otherAddr); !errors.Is(err, ErrTooManyReconstructors) {
+		t.Errorf("expected ErrTooManyReconstructors for a message, got %v", err)
+	}
+	if _, err := m.GetOrCreateFileReconstructor(otherAddr); !errors.Is(err, ErrTooManyReconstructors) {
+		t.Errorf("expected ErrTooManyReconstructors for a file, got %v", err)
+	}
+
+	// Existing reconstructors are returned regardless of the limit
+	if _, err := m.GetOrCreateMsgReconstructor(netip.MustParseAddr("10.1.0.0")); err != nil {
+		t.Errorf("failed to get existing message reconstructor: %v", err)
+	}
+
+	m.ClearMsgReconstructor(netip.MustParseAddr("10.1.0.0"))
+	if _, err := m.GetOrCreateFileReconstructor(otherAddr); err != nil {
+		t.Errorf("failed to create file reconstructor after a transfer finished: %v", err)
+	}
+}
+
+func TestManager_RejectTransfer(t *testing.T) {
+	m := NewManager()
+	peerAddr := netip.MustParseAddr("10.0.0.4")
+
+	r, err := m.GetOrCreateMsgReconstructor(peerAddr)
+	if err != nil {
+		t.Fatalf("failed to create message reconstructor: %v", err)
+	}
+
+	m.RejectTransfer(peerAddr, pkt.MsgTypeChatMessage)
+
+	if _, exists := m.GetMsgReconstructor(peerAddr); exists {
+		t.Error("reconstructor still registered after rejecting the transfer")
+	}
+	if !errors.Is(r.HandleIncomingMsgPacket(makePacket(0, []byte("x"))), ErrReconstructorCleared) {
+		t.Error("cleared reconstructor accepted a packet")
+	}
+	if !m.IsRejected(peerAddr, pkt.MsgTypeChatMessage) || m.IsRejected(peerAddr, pkt.MsgTypeFileTransfer) {
+		t.Error("only the message transfer should be rejected")
+	}
+
+	m.ClearRejections(peerAddr)
+
+	if m.IsRejected(peerAddr, pkt.MsgTypeChatMessage) {
+		t.Error("rejection not cleared")
+	}
+}
+
+func TestManager_RecordMessageSentAt(t *testing.T) {
+	m := NewManager()
+	peerAddr := netip.MustParseAddr("10.0.0.5")
+	start := time.Now()
+
+	if m.RecordMessageSentAt(peerAddr, start) {
+		t.Error("first message flagged as reordered")
+	}
+	if m.RecordMessageSentAt(peerAddr, start.Add(time.Second)) {
+		t.Error("later message flagged as reordered")
+	}
+	if !m.RecordMessageSentAt(peerAddr, start.Add(time.Millisecond)) {
+		t.Error("message sent before the previous one not flagged as reordered")
+	}
+
+	m.ClearPeer(peerAddr)
+
+	if m.RecordMessageSentAt(peerAddr, start) {
+		t.Error("message flagged as reordered after the peer was cleared")
+	}
+}
+
+func TestManager_MarkDelivered(t *testing.T) {
+	m := NewManager()
+	peerAddr := netip.MustParseAddr("10.0.0.6")
+	id := MessageID{Origin: peerAddr, Epoch: 1, FirstPktNum: 3, LastPktNum: 5}
+
+	if m.MarkDelivered(id) {
+		t.Error("new message reported as already delivered")
+	}
+
+	m.ClearPeer(peerAddr) // E.g. the peer reconnected
+
+	if !m.MarkDelivered(id) {
+		t.Error("retransmitted message not reported as already delivered")
+	}
+	if m.MarkDelivered(MessageID{Origin: peerAddr, Epoch: 2, FirstPktNum: 3, LastPktNum: 5}) {
+		t.Error("message of a new boot epoch reported as already delivered")
+	}
+
+	for i := range uint32(common.DELIVERED_MESSAGE_HISTORY_SIZE) {
+		m.MarkDelivered(MessageID{Origin: peerAddr, Epoch: 3, FirstPktNum: i, LastPktNum: i})
+	}
+	if m.MarkDelivered(id) {
+		t.Error("message ID was kept beyond the history size")
+	}
+}
+
+func TestRegistry_ClearPeer(t *testing.T) {
+	reg := NewRegistry(func(key StreamKey) *InMemoryReconstructor {
+		return NewInMemoryReconstructor()
+	})
+	a := netip.MustParseAddr("10.0.0.6")
+	b := netip.MustParseAddr("10.0.0.7")
+
+	first := reg.GetOrCreate(StreamKey{a, pkt.MsgTypeChatMessage})
+	if reg.GetOrCreate(StreamKey{a, pkt.MsgTypeChatMessage}) != first {
+		t.Fatalf("GetOrCreate created a second reconstructor for the same stream")
+	}
+	reg.GetOrCreate(StreamKey{a, pkt.MsgTypeFileTransfer})
+	reg.GetOrCreate(StreamKey{b, pkt.MsgTypeChatMessage})
+
+	if count := reg.Count(a); count != 2 {
+		t.Errorf("Count(a) = %d, want 2", count)
+	}
+
+	reg.ClearPeer(a)
+
+	if count := reg.Count(a); count != 0 {
+		t.Errorf("Count(a) = %d after ClearPeer, want 0", count)
+	}
+	if _, exists := reg.Get(StreamKey{b, pkt.MsgTypeChatMessage}); !exists {
+		t.Errorf("ClearPeer removed the reconstructor of another peer")
+	}
+}
+
+func TestInMemoryReconstructor_SpillsToDisk(t *testing.T) {
+	r := NewInMemoryReconstructor()
+	chunk := common.MSG_SPILL_THRESHOLD_BYTES / 2
+
+	// Out of order, the third packet exceeds the threshold
+	payloads := map[uint32][]byte{
+		0: bytes.Repeat([]byte("a"), chunk),
+		1: bytes.Repeat([]byte("b"), chunk),
+		2: bytes.Repeat([]byte("c"), chunk),
+		3: []byte("d"),
+	}
+	for _, pktNum := range []uint32{1, 0, 3, 2} {
+		if err := r.HandleIncomingMsgPacket(makePacket(pktNum, payloads[pktNum])); err != nil {
+			t.Fatalf("failed to add packet %d: %v", pktNum, err)
+		}
+	}
+
+	if r.spill == nil {
+		t.Fatalf("message wasn't spilled to disk")
+	}
+	if len(r.bufferedPayloads) != 0 {
+		t.Errorf("%d payloads still buffered in memory after spilling", len(r.bufferedPayloads))
+	}
+
+	highest, err := r.GetHighestPktNum()
+	if err != nil || highest != 3 {
+		t.Errorf("highest packet number %d (%v), want 3", highest, err)
+	}
+
+	got, err := r.FinishMsgPacketSequence()
+	if err != nil {
+		t.Fatalf("FinishMsgPacketSequence failed: %v", err)
+	}
+	want := slices.Concat(payloads[0], payloads[1], payloads[2], payloads[3])
+	if !bytes.Equal(got, want) {
+		t.Errorf("spilled message mismatch, got %d bytes, want %d", len(got), len(want))
+	}
+
+	spillPath := r.spill.file.Name()
+	if err := r.ClearState(); err != nil {
+		t.Fatalf("ClearState failed: %v", err)
+	}
+	if _, err := os.Stat(spillPath); !os.IsNotExist(err) {
+		t.Errorf("spill file %s still exists after ClearState", spillPath)
+	}
+}
+
+func TestInMemoryReconstructor_ConsumeContiguous(t *testing.T) {
+	r := NewInMemoryReconstructor()
+	var streamed []string
+	consume := func(data []byte) { streamed = append(streamed, string(data)) }
+
+	// Packet numbers 2 and 5 belong to other transfers of the peer
+	for pktNum, payload := range map[uint32]string{1: "Hel", 3: "lo, ", 6: "!"} {
+		if err := r.HandleIncomingMsgPacket(makePacket(pktNum, []byte(payload))); err != nil {
+			t.Fatalf("failed to add packet %d: %v", pktNum, err)
+		}
+	}
+
+	for _, upTo := range []int64{0, 3, 3, 5} {
+		if err := r.ConsumeContiguous(upTo, consume); err != nil {
+			t.Fatalf("ConsumeContiguous(%d) failed: %v", upTo, err)
+		}
+	}
+	if !slices.Equal(streamed, []string{"Hello, "}) {
+		t.Errorf("streamed %q, want [\"Hello, \"]", streamed)
+	}
+
+	if err := r.HandleIncomingMsgPacket(makePacket(4, []byte("world"))); err != nil {
+		t.Fatalf("failed to add packet 4: %v", err)
+	}
+	if err := r.ConsumeContiguous(6, consume); err != nil {
+		t.Fatalf("ConsumeContiguous(6) failed: %v", err)
+	}
+	if len(streamed) != 1 {
+		t.Errorf("streamed %q after a payload arrived below the consumed packet numbers", streamed)
+	}
+	if r.StreamedBytes() != 0 {
+		t.Errorf("StreamedBytes() = %d after the stream broke, want 0", r.StreamedBytes())
+	}
+
+	got, err := r.FinishMsgPacketSequence()
+	if err != nil || string(got) != "Hello, world!" {
+		t.Errorf("FinishMsgPacketSequence() = %q (%v), want \"Hello, world!\"", got, err)
+	}
+}
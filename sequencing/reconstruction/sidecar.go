@@ -0,0 +1,55 @@
+package reconstruction
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"time"
+)
+
+const SIDECAR_SUFFIX = ".meta.json" // Appended to the path of a received file to get the path of its sidecar
+
+const TRANSFER_DIR_TIME_FORMAT = "2006-01-02_15-04-05" // Name of the per-transfer directory, the start time of the transfer
+
+// Checksum statuses of a received file.
+// The packets of a file are protected by the header checksum, the file as a whole by its advertised size.
+const (
+	ChecksumVerified     = "verified"      // The stored size matches the advertised size
+	ChecksumSizeMismatch = "size_mismatch" // The stored size differs from the advertised size, packets are missing
+	ChecksumUnverified   = "unverified"    // The sender didn't advertise the file size
+)
+
+// FileMetadata is written as a JSON sidecar next to each received file, so users can audit what they received and from whom.
+type FileMetadata struct {
+	Sender         netip.Addr `json:"sender"`
+	OriginalName   string     `json:"original_name"`
+	StoredName     string     `json:"stored_name"`
+	Size           int64      `json:"size"`
+	AdvertisedSize *int64     `json:"advertised_size"` // nil if the sender didn't advertise the size
+	StartedAt      time.Time  `json:"started_at"`
+	DurationMillis int64      `json:"duration_ms"`
+	SHA256         string     `json:"sha256"` // Hex encoded hash of the stored file
+	ChecksumStatus string     `json:"checksum_status"`
+}
+
+// checksumStatus returns the checksum status of a file with the stored size and the advertised size (negative if unknown).
+func checksumStatus(size int64, advertisedSize int64) string {
+	switch {
+	case advertisedSize < 0:
+		return ChecksumUnverified
+	case size == advertisedSize:
+		return ChecksumVerified
+	default:
+		return ChecksumSizeMismatch
+	}
+}
+
+// writeSidecar writes the metadata next to the received file at filePath.
+func writeSidecar(filePath string, metadata FileMetadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filePath+SIDECAR_SUFFIX, data, 0600)
+}
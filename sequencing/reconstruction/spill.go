@@ -0,0 +1,101 @@
+package reconstruction
+
+import (
+	"errors"
+	"math"
+	"os"
+	"slices"
+
+	"bjoernblessin.de/chatprotogol/pkt"
+)
+
+// spillFile stores the payloads of a packet sequence on disk when they shouldn't be held in memory.
+// Payloads are appended in arrival order and an index keeps their position,
+// so out-of-order packets and gaps are handled like in memory and only the index stays in memory.
+// The file is created like the temporary files of the OnDiskReconstructor (see createReceiveFile).
+// spillFile is not thread-safe, the owning reconstructor must synchronize access.
+type spillFile struct {
+	file  *os.File
+	size  int64
+	index map[uint32]spillRecord
+}
+
+// spillRecord is the position of a payload in the spill file.
+type spillRecord struct {
+	offset int64
+	length int
+}
+
+func newSpillFile() (*spillFile, error) {
+	file, err := createReceiveFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return &spillFile{
+		file:  file,
+		index: make(map[uint32]spillRecord),
+	}, nil
+}
+
+// Append writes the payload of the packet number to the end of the file.
+func (s *spillFile) Append(pktNum uint32, payload pkt.Payload) error {
+	n, err := s.file.WriteAt(payload, s.size)
+	if err != nil {
+		return err
+	}
+
+	s.index[pktNum] = spillRecord{offset: s.size, length: n}
+	s.size += int64(n)
+	return nil
+}
+
+// HighestPktNum returns the highest packet number stored in the file.
+func (s *spillFile) HighestPktNum() (uint32, error) {
+	if len(s.index) == 0 {
+		return 0, errors.New("no packets spilled")
+	}
+
+	var highestPktNum uint32
+	for pktNum := range s.index {
+		highestPktNum = max(highestPktNum, pktNum)
+	}
+	return highestPktNum, nil
+}
+
+// ReadOrdered returns the concatenation of all stored payloads ordered by packet number.
+func (s *spillFile) ReadOrdered() ([]byte, error) {
+	return s.ReadRange(-1, math.MaxUint32)
+}
+
+// ReadRange returns the concatenation of the stored payloads with packet numbers in (after, upTo] ordered by packet number.
+func (s *spillFile) ReadRange(after int64, upTo int64) ([]byte, error) {
+	pktNums := make([]uint32, 0, len(s.index))
+	for pktNum := range s.index {
+		if int64(pktNum) > after && int64(pktNum) <= upTo {
+			pktNums = append(pktNums, pktNum)
+		}
+	}
+	slices.Sort(pktNums)
+
+	var data []byte
+	for _, pktNum := range pktNums {
+		record := s.index[pktNum]
+		payload := make([]byte, record.length)
+		_, err := s.file.ReadAt(payload, record.offset)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, payload...)
+	}
+	return data, nil
+}
+
+// Remove closes and deletes the file.
+func (s *spillFile) Remove() error {
+	err := s.file.Close()
+	if removeErr := os.Remove(s.file.Name()); removeErr != nil {
+		err = removeErr
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+package sequencing
+
+import (
+	"math"
+	"net/netip"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/ringbuffer"
+)
+
+// rttEstimator smooths the round-trip time samples of a peer like TCP (RFC 6298).
+// The samples are also counted in a histogram, which shows the jitter the smoothed values hide.
+type rttEstimator struct {
+	srtt      time.Duration // Smoothed round-trip time
+	rttvar    time.Duration // Round-trip time variation
+	samples   int
+	histogram [common.RTT_HISTOGRAM_BUCKETS]uint64 // Bucket i counts samples below common.RTT_HISTOGRAM_MIN << i, the last bucket counts all longer samples
+	min       time.Duration
+	max       time.Duration
+}
+
+// addSample updates the estimate with a measured round-trip time.
+func (e *rttEstimator) addSample(rtt time.Duration) {
+	if e.samples == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+	} else {
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4 // beta = 1/4
+		e.srtt = (7*e.srtt + rtt) / 8       // alpha = 1/8
+	}
+	if e.samples == 0 || rtt < e.min {
+		e.min = rtt
+	}
+	e.max = max(e.max, rtt)
+	e.histogram[rttBucket(rtt)]++
+	e.samples++
+}
+
+// rto returns the retransmission timeout derived from the estimate, without the lower bound of RFC 6298.
+func (e *rttEstimator) rto() time.Duration {
+	return e.srtt + 4*e.rttvar
+}
+
+// rttBucket returns the histogram bucket of a round-trip time sample.
+func rttBucket(rtt time.Duration) int {
+	for i := range common.RTT_HISTOGRAM_BUCKETS - 1 {
+		if rtt < common.RTT_HISTOGRAM_MIN<<i {
+			return i
+		}
+	}
+	return common.RTT_HISTOGRAM_BUCKETS - 1
+}
+
+// RTTBucket is a bucket of an RTTHistogram.
+type RTTBucket struct {
+	UpperBound time.Duration // Exclusive, math.MaxInt64 for the last bucket
+	Count      uint64
+}
+
+// RTTHistogram is the distribution of the ACK round trips of a peer, including late ACKs but not ACKs of retransmitted packets.
+type RTTHistogram struct {
+	Buckets []RTTBucket // Ordered by upper bound
+	Samples uint64
+	Min     time.Duration
+	Max     time.Duration
+}
+
+// Percentile returns the upper bound of the bucket that contains the p-th percentile (0-100) of the samples, capped at the maximum sample.
+// Returns 0 if there are no samples.
+func (h RTTHistogram) Percentile(p float64) time.Duration {
+	if h.Samples == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(p / 100 * float64(h.Samples)))
+	var count uint64
+	for _, bucket := range h.Buckets {
+		count += bucket.Count
+		if count >= rank {
+			return min(bucket.UpperBound, h.Max)
+		}
+	}
+	return h.Max
+}
+
+// GetRTTHistogram returns the distribution of the ACK round trips of the peer.
+// Returns false if no round trip of the peer was measured yet.
+func (h *OutgoingPktNumHandler) GetRTTHistogram(addr netip.Addr) (RTTHistogram, bool) {
+	peer, exists := h.lookupPeer(addr)
+	if !exists {
+		return RTTHistogram{}, false
+	}
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	estimator := peer.rtt
+	if estimator == nil || estimator.samples == 0 {
+		return RTTHistogram{}, false
+	}
+
+	histogram := RTTHistogram{
+		Buckets: make([]RTTBucket, common.RTT_HISTOGRAM_BUCKETS),
+		Samples: uint64(estimator.samples),
+		Min:     estimator.min,
+		Max:     estimator.max,
+	}
+	for i, count := range estimator.histogram {
+		histogram.Buckets[i] = RTTBucket{UpperBound: common.RTT_HISTOGRAM_MIN << i, Count: count}
+	}
+	histogram.Buckets[common.RTT_HISTOGRAM_BUCKETS-1].UpperBound = math.MaxInt64
+	return histogram, true
+}
+
+// expiredPacket is a packet we stopped waiting for an ACK for, because its retries were exhausted or its sequence was cancelled.
+type expiredPacket struct {
+	pktNum     uint32
+	lastSentAt time.Time
+}
+
+// unexpectedAcks counts ACKs for packet numbers without an open acknowledgment.
+type unexpectedAcks struct {
+	duplicate uint64 // The packet was already acknowledged
+	late      uint64 // The ACK arrived after we stopped waiting for it
+	spurious  uint64 // The packet number was never sent
+}
+
+// recordExpired remembers a packet whose open acknowledgment was removed without an ACK, so a late ACK can be recognized.
+// Must be called with p.mu held.
+func (p *peerState) recordExpired(pktNum32 uint32, openAck *OpenAck) {
+	if p.expired == nil {
+		p.expired = ringbuffer.New[expiredPacket](common.EXPIRED_PACKET_HISTORY_SIZE)
+	}
+	p.expired.Push(expiredPacket{pktNum: pktNum32, lastSentAt: openAck.sentAt})
+}
+
+// sampleRTT feeds the round-trip time of an acknowledged packet into the estimator of the peer.
+// Retransmitted packets are ignored, because it's unknown which transmission was acknowledged (Karn's algorithm).
+// Must be called with p.mu held.
+func (p *peerState) sampleRTT(openAck *OpenAck) {
+	if openAck.retransmitted {
+		return
+	}
+	p.rttEstimator().addSample(p.h.now().Sub(openAck.sentAt))
+}
+
+// rttEstimator returns the estimator of the peer, creating it if necessary.
+// Must be called with p.mu held.
+func (p *peerState) rttEstimator() *rttEstimator {
+	if p.rtt == nil {
+		p.rtt = &rttEstimator{}
+	}
+	return p.rtt
+}
+
+// handleUnexpectedAck classifies, counts and returns the kind of an ACK for a packet number without an open acknowledgment.
+// A late ACK still tells that the path works, just slower than we waited for.
+// The time since the last transmission is a lower bound of the round-trip time, so it is used to refine the estimate instead of being discarded.
+// Must be called with p.mu held.
+func (p *peerState) handleUnexpectedAck(pktNum32 uint32) AckKind {
+	if p.unexpectedAcks == nil {
+		p.unexpectedAcks = &unexpectedAcks{}
+	}
+	counts := p.unexpectedAcks
+	addr := p.addr
+
+	if p.expired != nil {
+		for _, packet := range p.expired.Items() {
+			if packet.pktNum != pktNum32 {
+				continue
+			}
+
+			counts.late++
+			rtt := p.h.now().Sub(packet.lastSentAt)
+			p.rttEstimator().addSample(rtt)
+			logUnexpectedAck("Late ACK from %s for packet %d, %v after its last transmission", addr, pktNum32, rtt)
+			return AckLate
+		}
+	}
+
+	if nextPktNum, exists := p.h.nextPktNum(addr); exists && pktNum32 < nextPktNum {
+		counts.duplicate++
+		logUnexpectedAck("Duplicate ACK from %s for packet %d", addr, pktNum32)
+		return AckDuplicate
+	}
+
+	counts.spurious++
+	logUnexpectedAck("Spurious ACK from %s for packet %d that was never sent", addr, pktNum32)
+	return AckSpurious
+}
+
+func logUnexpectedAck(format string, v ...any) {
+	if common.LOG_UNEXPECTED_ACKS {
+		logger.Infof(format, v...)
+	} else {
+		logger.Debugf(format, v...)
+	}
+}
@@ -0,0 +1,90 @@
+package sequencing
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	var e rttEstimator
+
+	e.addSample(100 * time.Millisecond)
+	if e.srtt != 100*time.Millisecond || e.rttvar != 50*time.Millisecond {
+		t.Errorf("Expected srtt 100ms and rttvar 50ms after the first sample, got %v and %v", e.srtt, e.rttvar)
+	}
+
+	e.addSample(180 * time.Millisecond)
+	if e.srtt != 110*time.Millisecond || e.rttvar != 57500*time.Microsecond {
+		t.Errorf("Expected srtt 110ms and rttvar 57.5ms after the second sample, got %v and %v", e.srtt, e.rttvar)
+	}
+}
+
+func TestRTTHistogram(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(10, false)
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	if _, exists := handler.GetRTTHistogram(addr); exists {
+		t.Fatalf("Expected no histogram before the first sample")
+	}
+
+	estimator := handler.peer(addr).rttEstimator()
+	for range 9 {
+		estimator.addSample(3 * time.Millisecond)
+	}
+	estimator.addSample(time.Minute)
+
+	histogram, exists := handler.GetRTTHistogram(addr)
+	if !exists {
+		t.Fatalf("Expected a histogram for %s", addr)
+	}
+	if histogram.Samples != 10 || histogram.Min != 3*time.Millisecond || histogram.Max != time.Minute {
+		t.Errorf("Expected 10 samples between 3ms and 1m, got %d between %v and %v", histogram.Samples, histogram.Min, histogram.Max)
+	}
+	if bucket := histogram.Buckets[4]; bucket.UpperBound != 4*time.Millisecond || bucket.Count != 9 {
+		t.Errorf("Expected 9 samples below 4ms, got %d below %v", bucket.Count, bucket.UpperBound)
+	}
+	if last := histogram.Buckets[len(histogram.Buckets)-1]; last.Count != 1 {
+		t.Errorf("Expected the 1m sample in the last bucket, got %d", last.Count)
+	}
+
+	if p50 := histogram.Percentile(50); p50 != 4*time.Millisecond {
+		t.Errorf("Expected p50 4ms, got %v", p50)
+	}
+	if p99 := histogram.Percentile(99); p99 != time.Minute {
+		t.Errorf("Expected p99 capped at the maximum 1m, got %v", p99)
+	}
+}
+
+func TestUnexpectedAcksAreClassified(t *testing.T) {
+	handler := NewOutgoingPktNumHandler(10, false)
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	handler.setNextPktNum(addr, 3)
+	for num := range uint32(3) {
+		if _, err := handler.AddOpenAck(context.Background(), makePkt(num, addr), func() {}); err != nil {
+			t.Fatalf("Failed to add open ack for packet %d: %v", num, err)
+		}
+	}
+
+	handler.RemoveOpenAck(addr, makePkt(0, addr).Header.PktNum) // Regular ACK
+	handler.RemoveOpenAck(addr, makePkt(0, addr).Header.PktNum) // Duplicate
+	handler.AbortSequence(addr, 1, 1)
+	handler.RemoveOpenAck(addr, makePkt(1, addr).Header.PktNum) // Late
+	handler.RemoveOpenAck(addr, makePkt(7, addr).Header.PktNum) // Never sent
+
+	stats, exists := handler.GetCongestionStats(addr)
+	if !exists {
+		t.Fatalf("Expected congestion stats for %s", addr)
+	}
+
+	if stats.DuplicateAcks != 1 || stats.LateAcks != 1 || stats.SpuriousAcks != 1 {
+		t.Errorf("Expected 1 duplicate, 1 late and 1 spurious ACK, got %d, %d and %d", stats.DuplicateAcks, stats.LateAcks, stats.SpuriousAcks)
+	}
+	if stats.RTTSamples != 2 {
+		t.Errorf("Expected the regular and the late ACK to be RTT samples, got %d samples", stats.RTTSamples)
+	}
+
+	handler.AbortSequence(addr, 2, 2)
+}
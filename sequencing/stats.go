@@ -0,0 +1,131 @@
+package sequencing
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const throughputBucketDuration = time.Second // Granularity used to determine the peak throughput
+
+// TransferStats collects statistics of a single transfer (a sequence of packets) to or from a peer.
+// TransferStats is thread-safe.
+type TransferStats struct {
+	mu              sync.Mutex
+	start           time.Time
+	last            time.Time
+	bytes           int64
+	packets         int64
+	retransmissions int64
+	lost            int64
+	bucketStart     time.Time
+	bucketBytes     int64
+	peakBytesPerSec float64
+}
+
+// TransferSummary is a snapshot of TransferStats.
+type TransferSummary struct {
+	Bytes           int64
+	Packets         int64
+	Retransmissions int64 // Resent packets on the sending side, duplicate packets on the receiving side
+	Lost            int64 // Packets whose retries were exhausted
+	Duration        time.Duration
+	AvgBytesPerSec  float64
+	PeakBytesPerSec float64
+}
+
+func NewTransferStats() *TransferStats {
+	now := time.Now()
+	return &TransferStats{
+		start:       now,
+		last:        now,
+		bucketStart: now,
+	}
+}
+
+// AddPacket records a packet with n payload bytes that was delivered (sending side) or received (receiving side).
+func (s *TransferStats) AddPacket(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	if elapsed := now.Sub(s.bucketStart); elapsed >= throughputBucketDuration {
+		s.peakBytesPerSec = max(s.peakBytesPerSec, float64(s.bucketBytes)/elapsed.Seconds())
+		s.bucketStart = now
+		s.bucketBytes = 0
+	}
+
+	s.bytes += int64(n)
+	s.packets++
+	s.bucketBytes += int64(n)
+	s.last = now
+}
+
+// AddRetransmission records a resent (sending side) or duplicate (receiving side) packet.
+func (s *TransferStats) AddRetransmission() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retransmissions++
+}
+
+// AddLoss records a packet that was given up on after all retries were exhausted.
+func (s *TransferStats) AddLoss() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lost++
+}
+
+// Snapshot returns the current statistics.
+// The duration spans from the creation of the stats until the last recorded packet.
+func (s *TransferStats) Snapshot() TransferSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := TransferSummary{
+		Bytes:           s.bytes,
+		Packets:         s.packets,
+		Retransmissions: s.retransmissions,
+		Lost:            s.lost,
+		Duration:        s.last.Sub(s.start),
+		PeakBytesPerSec: s.peakBytesPerSec,
+	}
+
+	if summary.Duration > 0 {
+		summary.AvgBytesPerSec = float64(s.bytes) / summary.Duration.Seconds()
+	}
+
+	// Transfers shorter than one bucket don't have a meaningful peak
+	summary.PeakBytesPerSec = max(summary.PeakBytesPerSec, summary.AvgBytesPerSec)
+
+	return summary
+}
+
+// LossRate returns the share of transmissions that had to be repeated.
+func (s TransferSummary) LossRate() float64 {
+	total := s.Packets + s.Retransmissions
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Retransmissions) / float64(total)
+}
+
+func (s TransferSummary) String() string {
+	return fmt.Sprintf("%d bytes in %v, avg %s, peak %s, %d packets, %d retransmissions, %d lost, loss rate %.2f%%",
+		s.Bytes, s.Duration.Round(time.Millisecond), FormatThroughput(s.AvgBytesPerSec), FormatThroughput(s.PeakBytesPerSec),
+		s.Packets, s.Retransmissions, s.Lost, s.LossRate()*100)
+}
+
+// FormatThroughput formats a throughput in bytes per second, e.g. "1.50 MiB/s".
+func FormatThroughput(bytesPerSec float64) string {
+	switch {
+	case bytesPerSec >= 1<<20:
+		return fmt.Sprintf("%.2f MiB/s", bytesPerSec/(1<<20))
+	case bytesPerSec >= 1<<10:
+		return fmt.Sprintf("%.2f KiB/s", bytesPerSec/(1<<10))
+	default:
+		return fmt.Sprintf("%.0f B/s", bytesPerSec)
+	}
+}
@@ -0,0 +1,45 @@
+package sequencing
+
+import (
+	"testing"
+)
+
+func TestTransferStatsSnapshot(t *testing.T) {
+	stats := NewTransferStats()
+
+	stats.AddPacket(100)
+	stats.AddPacket(50)
+	stats.AddRetransmission()
+	stats.AddLoss()
+
+	summary := stats.Snapshot()
+
+	if summary.Bytes != 150 {
+		t.Errorf("Expected 150 bytes, got %d", summary.Bytes)
+	}
+	if summary.Packets != 2 {
+		t.Errorf("Expected 2 packets, got %d", summary.Packets)
+	}
+	if summary.Retransmissions != 1 || summary.Lost != 1 {
+		t.Errorf("Expected 1 retransmission and 1 loss, got %d and %d", summary.Retransmissions, summary.Lost)
+	}
+	if summary.PeakBytesPerSec < summary.AvgBytesPerSec {
+		t.Errorf("Expected peak throughput %f to be at least the average %f", summary.PeakBytesPerSec, summary.AvgBytesPerSec)
+	}
+
+	const expectedLossRate = 1.0 / 3.0
+	if summary.LossRate() != expectedLossRate {
+		t.Errorf("Expected loss rate %f, got %f", expectedLossRate, summary.LossRate())
+	}
+}
+
+func TestTransferStatsEmpty(t *testing.T) {
+	summary := NewTransferStats().Snapshot()
+
+	if summary.LossRate() != 0 {
+		t.Errorf("Expected loss rate 0 for empty transfer, got %f", summary.LossRate())
+	}
+	if summary.AvgBytesPerSec != 0 {
+		t.Errorf("Expected average throughput 0 for empty transfer, got %f", summary.AvgBytesPerSec)
+	}
+}
@@ -0,0 +1,37 @@
+package sequencing
+
+import (
+	"net/netip"
+)
+
+// PeerTotals counts the reliable packets sent to a peer since the start, e.g. for a summary of the session.
+// Unlike the congestion state, the totals are kept when the packet numbers of the peer are cleared.
+type PeerTotals struct {
+	Packets         uint64 // Reliable packets sent, without retransmissions
+	Retransmissions uint64
+	MaxCwnd         int64 // Largest congestion window in packets
+}
+
+// recordTotals returns the totals of the peer after accounting the current congestion window cwnd.
+// Must be called with p.mu held.
+func (p *peerState) recordTotals(cwnd int64) *PeerTotals {
+	if p.totals == nil {
+		p.totals = &PeerTotals{}
+	}
+	p.totals.MaxCwnd = max(p.totals.MaxCwnd, cwnd)
+	return p.totals
+}
+
+// GetPeerTotals returns the totals of all peers reliable packets were sent to.
+// This is thread-safe.
+func (h *OutgoingPktNumHandler) GetPeerTotals() map[netip.Addr]PeerTotals {
+	totals := make(map[netip.Addr]PeerTotals)
+	for _, peer := range h.allPeers() {
+		peer.mu.Lock()
+		if peer.totals != nil {
+			totals[peer.addr] = *peer.totals
+		}
+		peer.mu.Unlock()
+	}
+	return totals
+}
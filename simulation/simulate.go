@@ -0,0 +1,286 @@
+// Package simulation runs protocol experiments with several nodes in one process.
+// Every simulated node is a complete node (see node.New) on a shared in-memory network (see sock.MemoryNetwork),
+// which drops and delays datagrams as configured. The simulator connects the nodes as described by a topology file,
+// waits for the routing to converge, sends the scripted traffic and reports convergence time, delivery rate and retransmissions.
+package simulation
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/events"
+	"bjoernblessin.de/chatprotogol/node"
+	"bjoernblessin.de/chatprotogol/pkt"
+	"bjoernblessin.de/chatprotogol/sequencing"
+	"bjoernblessin.de/chatprotogol/sock"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+const convergencePollInterval = time.Millisecond * 10 // Interval the routing tables are polled at, the resolution of the convergence time
+
+// Options configure a run of the simulation.
+type Options struct {
+	Timeout time.Duration // Maximum time to wait for a connection, the convergence or a message
+	Loss    float64       // Fraction of datagrams the network drops, see sock.MemoryNetwork.SetLoss
+	Latency time.Duration // Delay of every datagram, see sock.MemoryNetwork.SetLatency
+}
+
+// simNode is a started node of the simulation.
+type simNode struct {
+	*node.Node
+	spec     NodeSpec
+	addrPort netip.AddrPort
+}
+
+// Report is the outcome of a simulation.
+type Report struct {
+	ConvergenceTime time.Duration
+	MissingRoutes   map[string][]netip.Addr // Routes each node was missing when the routing didn't converge within the timeout
+	Traffic         []TrafficResult
+}
+
+// TrafficResult is the outcome of one TrafficSpec.
+type TrafficResult struct {
+	Spec            TrafficSpec
+	Delivered       int
+	Retransmissions int
+	TotalDelay      time.Duration // Sum of the delivery times of the delivered messages
+}
+
+// Run runs the simulate subcommand with its command line arguments.
+// Usage: simulate [-timeout duration] [-loss fraction] [-latency duration] <topology file>
+func Run(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", time.Second*10, "maximum time to wait for a connection, the convergence or a message")
+	loss := flags.Float64("loss", 0, "fraction of datagrams the simulated network drops, between 0 and 1")
+	latency := flags.Duration("latency", 0, "delay of every datagram in the simulated network")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: simulate [-timeout duration] [-loss fraction] [-latency duration] <topology file>")
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected exactly one topology file")
+	}
+	if *loss < 0 || *loss >= 1 {
+		return fmt.Errorf("loss %v is not between 0 and 1", *loss)
+	}
+
+	topology, err := LoadTopology(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	logger.SetEnable(false) // The log lines of all nodes would bury the report
+
+	options := Options{Timeout: *timeout, Loss: *loss, Latency: *latency}
+	report, err := Simulate(topology, options)
+	if err != nil {
+		return err
+	}
+
+	printReport(topology, options, report)
+	return nil
+}
+
+// Simulate starts the nodes of the topology on a new in-memory network, connects them, waits for the routing to converge and sends the traffic.
+// The nodes are closed when the simulation ends.
+func Simulate(topology *Topology, options Options) (*Report, error) {
+	network := sock.NewMemoryNetwork()
+	network.SetLoss(options.Loss)
+	network.SetLatency(options.Latency)
+
+	nodes := make(map[string]*simNode, len(topology.Nodes))
+	defer func() {
+		for _, node := range nodes {
+			_ = node.Socket.Close()
+		}
+	}()
+
+	for _, spec := range topology.Nodes {
+		node, err := startNode(network, spec)
+		if err != nil {
+			return nil, err
+		}
+		nodes[spec.Name] = node
+	}
+
+	report := &Report{}
+
+	var err error
+	report.ConvergenceTime, report.MissingRoutes, err = connectAndConverge(topology, nodes, options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, spec := range topology.Traffic {
+		report.Traffic = append(report.Traffic, sendTraffic(spec, nodes, options.Timeout))
+	}
+
+	return report, nil
+}
+
+// startNode starts a node listening on the spec's address of the network.
+func startNode(network *sock.MemoryNetwork, spec NodeSpec) (*simNode, error) {
+	n := node.New(network.NewSocket(), "")
+
+	localAddr, err := n.Socket.Open(net.IP(spec.Addr.AsSlice()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start node %s: %w", spec.Name, err)
+	}
+
+	return &simNode{Node: n, spec: spec, addrPort: localAddr.AddrPort()}, nil
+}
+
+// connectAndConverge connects the linked nodes and waits until every node has a route to every node it can reach.
+// Returns the time from the first CONNECT until the routing converged.
+// If the routing doesn't converge within the timeout, the routes each node is missing are returned instead.
+func connectAndConverge(topology *Topology, nodes map[string]*simNode, timeout time.Duration) (time.Duration, map[string][]netip.Addr, error) {
+	start := time.Now()
+
+	for _, link := range topology.Links {
+		from, to := nodes[link[0]], nodes[link[1]]
+
+		connected, err := from.Connections.ConnectTo(to.spec.Addr, to.addrPort, from.Connections.BuildConnectPayload())
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to connect %s to %s: %w", from.spec.Name, to.spec.Name, err)
+		}
+
+		select {
+		case success := <-connected:
+			if !success {
+				return 0, nil, fmt.Errorf("failed to connect %s to %s: CONNECT not acknowledged", from.spec.Name, to.spec.Name)
+			}
+		case <-time.After(timeout):
+			return 0, nil, fmt.Errorf("failed to connect %s to %s: timed out after %v", from.spec.Name, to.spec.Name, timeout)
+		}
+	}
+
+	missing := make(map[string][]netip.Addr) // Routes each unconverged node is missing
+	for name := range nodes {
+		for _, reachable := range topology.Reachable(name) {
+			missing[name] = append(missing[name], nodes[reachable].spec.Addr)
+		}
+	}
+
+	deadline := start.Add(timeout)
+	for len(missing) > 0 {
+		if time.Now().After(deadline) {
+			return 0, missing, nil
+		}
+
+		time.Sleep(convergencePollInterval)
+
+		for name, expected := range missing {
+			expected = slices.DeleteFunc(expected, func(addr netip.Addr) bool {
+				_, found := nodes[name].Router.GetNextHop(addr)
+				return found
+			})
+			if len(expected) == 0 {
+				delete(missing, name)
+			} else {
+				missing[name] = expected
+			}
+		}
+	}
+
+	return time.Since(start), nil, nil
+}
+
+// sendTraffic sends the messages of the spec one after the other and waits for each to arrive.
+// The messages are single-packet messages (see connection.Manager.BuildSinglePacketMessage), all simulated nodes support them.
+func sendTraffic(spec TrafficSpec, nodes map[string]*simNode, timeout time.Duration) TrafficResult {
+	sender, receiver := nodes[spec.From], nodes[spec.To]
+	result := TrafficResult{Spec: spec}
+
+	messages := events.MessageReceived.Subscribe()
+	defer events.MessageReceived.Unsubscribe(messages)
+
+	for i := 1; i <= spec.Count; i++ {
+		text := fmt.Sprintf("%s %d", spec.Text, i)
+		sent := time.Now()
+
+		stats := sequencing.NewTransferStats()
+		packet := sender.Connections.BuildSinglePacketMessage(pkt.Payload(text), receiver.spec.Addr, sent)
+		acked, err := sender.Connections.SendTrackedRoutedPacket(context.Background(), packet, stats)
+		if err != nil {
+			continue
+		}
+
+		if awaitMessage(messages, sender.spec.Addr, text, timeout) {
+			result.Delivered++
+			result.TotalDelay += time.Since(sent)
+		}
+
+		// The next message is only sent once the sender finished this one
+		<-acked
+		result.Retransmissions += int(stats.Snapshot().Retransmissions)
+	}
+
+	return result
+}
+
+// awaitMessage waits until the message with the text from sender is received, messages of other nodes are skipped.
+// Returns false if it isn't received within the timeout.
+func awaitMessage(messages chan events.MessageReceivedEvent, sender netip.Addr, text string, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case message := <-messages:
+			if message.From == sender && message.Text == text {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func printReport(topology *Topology, options Options, report *Report) {
+	fmt.Printf("Simulated %d nodes with %d links (loss %.1f%%, latency %v)\n", len(topology.Nodes), len(topology.Links), options.Loss*100, options.Latency)
+	if len(report.MissingRoutes) > 0 {
+		fmt.Printf("Routing didn't converge within %v:\n", options.Timeout)
+		for _, node := range topology.Nodes {
+			if missing, exists := report.MissingRoutes[node.Name]; exists {
+				fmt.Printf("  %s has no route to %v\n", node.Name, missing)
+			}
+		}
+	} else {
+		fmt.Printf("Convergence time: %v (polled every %v)\n", report.ConvergenceTime.Round(time.Millisecond), convergencePollInterval)
+	}
+
+	var sent, delivered, retransmissions int
+	for _, result := range report.Traffic {
+		fmt.Printf("  %s -> %s: %d/%d delivered, %d retransmissions%s\n", result.Spec.From, result.Spec.To,
+			result.Delivered, result.Spec.Count, result.Retransmissions, formatAverageDelay(result))
+
+		sent += result.Spec.Count
+		delivered += result.Delivered
+		retransmissions += result.Retransmissions
+	}
+
+	if sent == 0 {
+		fmt.Println("No traffic sent")
+		return
+	}
+	fmt.Printf("Delivery rate: %d/%d (%.1f%%)\n", delivered, sent, float64(delivered)/float64(sent)*100)
+	fmt.Printf("Retransmissions: %d\n", retransmissions)
+}
+
+func formatAverageDelay(result TrafficResult) string {
+	if result.Delivered == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", avg delivery time %v", (result.TotalDelay / time.Duration(result.Delivered)).Round(time.Microsecond))
+}
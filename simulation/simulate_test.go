@@ -0,0 +1,32 @@
+package simulation
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// TestSimulate verifies that the nodes of a line topology converge and deliver the traffic over the middle node.
+func TestSimulate(t *testing.T) {
+	topology := &Topology{
+		Nodes: []NodeSpec{
+			{Name: "A", Addr: netip.MustParseAddr("10.0.0.1")},
+			{Name: "B", Addr: netip.MustParseAddr("10.0.0.2")},
+			{Name: "C", Addr: netip.MustParseAddr("10.0.0.3")},
+		},
+		Links:   [][2]string{{"A", "B"}, {"B", "C"}},
+		Traffic: []TrafficSpec{{From: "A", To: "C", Text: "hello", Count: 3}},
+	}
+
+	report, err := Simulate(topology, Options{Timeout: time.Second * 5, Latency: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Simulation failed: %v", err)
+	}
+
+	if len(report.MissingRoutes) > 0 {
+		t.Fatalf("Routing didn't converge, missing routes: %v", report.MissingRoutes)
+	}
+	if len(report.Traffic) != 1 || report.Traffic[0].Delivered != 3 {
+		t.Errorf("Expected all 3 messages to be delivered, got %+v", report.Traffic)
+	}
+}
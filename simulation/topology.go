@@ -0,0 +1,145 @@
+package simulation
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+
+	"bjoernblessin.de/chatprotogol/util/strictjson"
+)
+
+// Topology describes the simulated network: the nodes, the links between them and the scripted traffic.
+//
+// Example:
+//
+//	{
+//	    "nodes": [
+//	        {"name": "A", "addr": "10.0.0.1"},
+//	        {"name": "B", "addr": "10.0.0.2"},
+//	        {"name": "C", "addr": "10.0.0.3"}
+//	    ],
+//	    "links": [["A", "B"], ["B", "C"]],
+//	    "traffic": [{"from": "A", "to": "C", "text": "hello", "count": 10}]
+//	}
+type Topology struct {
+	Nodes   []NodeSpec    `json:"nodes"`
+	Links   [][2]string   `json:"links"`   // Pairs of node names, the first node connects to the second
+	Traffic []TrafficSpec `json:"traffic"` // Sent in order after the routing converged
+}
+
+type NodeSpec struct {
+	Name string     `json:"name"`
+	Addr netip.Addr `json:"addr"` // IPv4 address of the node in the simulated network, unique per node
+}
+
+// TrafficSpec sends Count chat messages from one node to another, one after the other.
+// Each message is the text followed by its number and is sent as a single packet, see maxTrafficTextSize.
+type TrafficSpec struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Text  string `json:"text"`
+	Count int    `json:"count"`
+}
+
+const maxTrafficTextSize = 512 // Maximum size of a traffic text in bytes, a message must fit into one packet with its number
+
+// LoadTopology reads and validates the topology file.
+func LoadTopology(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var topology Topology
+	err = strictjson.Unmarshal(data, &topology)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topology file %s: %w", path, err)
+	}
+
+	err = topology.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid topology file %s: %w", path, err)
+	}
+
+	return &topology, nil
+}
+
+func (t *Topology) validate() error {
+	if len(t.Nodes) == 0 {
+		return errors.New("no nodes")
+	}
+
+	names := make(map[string]bool)
+	addrs := make(map[netip.Addr]bool)
+	for _, node := range t.Nodes {
+		if node.Name == "" {
+			return errors.New("node without name")
+		}
+		if names[node.Name] {
+			return fmt.Errorf("duplicate node name %q", node.Name)
+		}
+		if !node.Addr.Is4() || node.Addr.IsUnspecified() {
+			return fmt.Errorf("address %v of node %q is no IPv4 host address", node.Addr, node.Name)
+		}
+		if addrs[node.Addr] {
+			return fmt.Errorf("duplicate node address %v", node.Addr)
+		}
+		names[node.Name] = true
+		addrs[node.Addr] = true
+	}
+
+	for _, link := range t.Links {
+		if !names[link[0]] || !names[link[1]] {
+			return fmt.Errorf("link %v references an unknown node", link)
+		}
+		if link[0] == link[1] {
+			return fmt.Errorf("link %v connects a node to itself", link)
+		}
+	}
+
+	for _, traffic := range t.Traffic {
+		if !names[traffic.From] || !names[traffic.To] {
+			return fmt.Errorf("traffic from %q to %q references an unknown node", traffic.From, traffic.To)
+		}
+		if traffic.From == traffic.To {
+			return fmt.Errorf("traffic from %q to itself", traffic.From)
+		}
+		if traffic.Text == "" || traffic.Count <= 0 {
+			return fmt.Errorf("traffic from %q to %q needs a text and a positive count", traffic.From, traffic.To)
+		}
+		if len(traffic.Text) > maxTrafficTextSize {
+			return fmt.Errorf("text of the traffic from %q to %q exceeds %d bytes", traffic.From, traffic.To, maxTrafficTextSize)
+		}
+	}
+
+	return nil
+}
+
+// Reachable returns the names of all nodes the named node can reach over the links, excluding itself.
+// Once the routing converged, these are the entries of the node's routing table.
+func (t *Topology) Reachable(name string) []string {
+	adjacent := make(map[string][]string)
+	for _, link := range t.Links {
+		adjacent[link[0]] = append(adjacent[link[0]], link[1])
+		adjacent[link[1]] = append(adjacent[link[1]], link[0])
+	}
+
+	visited := map[string]bool{name: true}
+	queue := []string{name}
+	var reachable []string
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, neighbor := range adjacent[current] {
+			if !visited[neighbor] {
+				visited[neighbor] = true
+				reachable = append(reachable, neighbor)
+				queue = append(queue, neighbor)
+			}
+		}
+	}
+
+	return reachable
+}
@@ -0,0 +1,88 @@
+package simulation
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadTopology(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "topology.json")
+	err := os.WriteFile(path, []byte(`{
+		"nodes": [{"name": "A", "addr": "10.0.0.1"}, {"name": "B", "addr": "10.0.0.2"}],
+		"links": [["A", "B"]],
+		"traffic": [{"from": "A", "to": "B", "text": "hi", "count": 3}]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topology, err := LoadTopology(path)
+	if err != nil {
+		t.Fatalf("Expected valid topology, got error: %v", err)
+	}
+
+	if len(topology.Nodes) != 2 || topology.Nodes[1].Addr != netip.MustParseAddr("10.0.0.2") {
+		t.Errorf("Unexpected nodes %v", topology.Nodes)
+	}
+	if len(topology.Traffic) != 1 || topology.Traffic[0].Count != 3 {
+		t.Errorf("Unexpected traffic %v", topology.Traffic)
+	}
+}
+
+func TestTopologyValidate(t *testing.T) {
+	nodes := []NodeSpec{
+		{Name: "A", Addr: netip.MustParseAddr("10.0.0.1")},
+		{Name: "B", Addr: netip.MustParseAddr("10.0.0.2")},
+	}
+
+	tests := []struct {
+		name     string
+		topology Topology
+		wantErr  bool
+	}{
+		{"valid", Topology{Nodes: nodes, Links: [][2]string{{"A", "B"}}}, false},
+		{"no nodes", Topology{}, true},
+		{"duplicate name", Topology{Nodes: []NodeSpec{nodes[0], {Name: "A", Addr: netip.MustParseAddr("10.0.0.3")}}}, true},
+		{"duplicate address", Topology{Nodes: []NodeSpec{nodes[0], {Name: "C", Addr: nodes[0].Addr}}}, true},
+		{"no IPv4 address", Topology{Nodes: []NodeSpec{{Name: "A", Addr: netip.MustParseAddr("::1")}}}, true},
+		{"unspecified address", Topology{Nodes: []NodeSpec{{Name: "A", Addr: netip.IPv4Unspecified()}}}, true},
+		{"unknown link node", Topology{Nodes: nodes, Links: [][2]string{{"A", "C"}}}, true},
+		{"self link", Topology{Nodes: nodes, Links: [][2]string{{"A", "A"}}}, true},
+		{"unknown traffic node", Topology{Nodes: nodes, Traffic: []TrafficSpec{{From: "A", To: "C", Text: "hi", Count: 1}}}, true},
+		{"no count", Topology{Nodes: nodes, Traffic: []TrafficSpec{{From: "A", To: "B", Text: "hi"}}}, true},
+		{"text too long", Topology{Nodes: nodes, Traffic: []TrafficSpec{{From: "A", To: "B", Text: strings.Repeat("a", maxTrafficTextSize+1), Count: 1}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.topology.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTopologyReachable(t *testing.T) {
+	topology := Topology{
+		Links: [][2]string{{"A", "B"}, {"C", "B"}, {"D", "E"}},
+	}
+
+	reachable := topology.Reachable("A")
+	slices.Sort(reachable)
+	if !slices.Equal(reachable, []string{"B", "C"}) {
+		t.Errorf("Expected A to reach [B C], got %v", reachable)
+	}
+
+	if reachable := topology.Reachable("E"); !slices.Equal(reachable, []string{"D"}) {
+		t.Errorf("Expected E to reach [D], got %v", reachable)
+	}
+
+	if reachable := topology.Reachable("F"); len(reachable) != 0 {
+		t.Errorf("Expected isolated F to reach nothing, got %v", reachable)
+	}
+}
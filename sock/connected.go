@@ -0,0 +1,143 @@
+package sock
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/util/logger"
+)
+
+// The connected-UDP fast path sends the packets to the neighbor that receives most of the traffic, e.g. during a large file transfer,
+// through a second socket that is connected to it. The kernel then skips the route and destination lookup per packet.
+// The connected socket shares the local address and port of the socket (SO_REUSEPORT), so the neighbor sees the same source address,
+// and it receives the packets of the neighbor, which are read like the packets of the socket.
+// Every common.CONNECTED_UDP_WINDOW sent packets, the fast path is moved to the destination with at least common.CONNECTED_UDP_MIN_SHARE
+// of the packets or closed if there is none. Packets to other destinations are sent with WriteToUDP as usual.
+
+// connectedPath holds the fast path of a socket.
+type connectedPath struct {
+	mu      sync.Mutex
+	conn    *net.UDPConn // nil if not connected
+	peer    netip.AddrPort
+	counts  map[netip.AddrPort]int // Sent packets per destination in the current window
+	packets int                    // Sent packets in the current window
+}
+
+var errConnectedModeUnsupported = errors.New("connected UDP is not supported on this platform")
+
+func (s *udpSocket) SetConnectedMode(enabled bool) error {
+	if enabled && !connectedModeSupported {
+		return errConnectedModeUnsupported
+	}
+	s.connectedMode = enabled
+	return nil
+}
+
+func (s *udpSocket) ConnectedPeer() (netip.AddrPort, bool) {
+	s.fastPath.mu.Lock()
+	defer s.fastPath.mu.Unlock()
+
+	return s.fastPath.peer, s.fastPath.conn != nil
+}
+
+// fastPathTo counts a packet to the destination and returns the connected socket if the fast path leads to it.
+// Moves the fast path at the end of a window.
+func (s *udpSocket) fastPathTo(dest netip.AddrPort) *net.UDPConn {
+	path := &s.fastPath
+	path.mu.Lock()
+	defer path.mu.Unlock()
+
+	if path.counts == nil {
+		path.counts = make(map[netip.AddrPort]int)
+	}
+	path.counts[dest]++
+	path.packets++
+
+	if path.packets >= common.CONNECTED_UDP_WINDOW {
+		s.moveFastPathLocked()
+	}
+
+	if path.conn != nil && path.peer == dest {
+		return path.conn
+	}
+	return nil
+}
+
+// moveFastPathLocked connects the fast path to the destination with the largest share of the window, if the share is large enough, and starts a new window.
+// Must be called with s.fastPath.mu held.
+func (s *udpSocket) moveFastPathLocked() {
+	path := &s.fastPath
+
+	var top netip.AddrPort
+	for dest, count := range path.counts {
+		if !top.IsValid() || count > path.counts[top] {
+			top = dest
+		}
+	}
+	share := float64(path.counts[top]) / float64(path.packets)
+	clear(path.counts)
+	path.packets = 0
+
+	if share < common.CONNECTED_UDP_MIN_SHARE {
+		s.closeFastPathLocked()
+		return
+	}
+	if path.conn != nil && path.peer == top {
+		return
+	}
+
+	s.closeFastPathLocked()
+	conn, err := s.dialFastPath(top)
+	if err != nil {
+		logger.Debugf("Failed to connect the UDP fast path to %v: %v", top, err)
+		return
+	}
+	path.conn = conn
+	path.peer = top
+	go s.readLoop(conn)
+	logger.Debugf("Connected the UDP fast path to %v (%.0f%% of the sent packets)", top, share*100)
+}
+
+// dialFastPath opens a socket on the bound address of the socket that is connected to the peer.
+func (s *udpSocket) dialFastPath(peer netip.AddrPort) (*net.UDPConn, error) {
+	localAddr, err := s.GetBoundAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{
+		LocalAddr: net.UDPAddrFromAddrPort(localAddr),
+		Control:   reusePort,
+	}
+	conn, err := dialer.DialContext(context.Background(), "udp4", peer.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// closeFastPath closes the connected socket, e.g. because the socket is closed or rebound.
+func (s *udpSocket) closeFastPath() {
+	s.fastPath.mu.Lock()
+	defer s.fastPath.mu.Unlock()
+
+	s.closeFastPathLocked()
+	clear(s.fastPath.counts)
+	s.fastPath.packets = 0
+}
+
+// closeFastPathLocked closes the connected socket, packets to its peer are sent through the socket again.
+// Must be called with s.fastPath.mu held.
+func (s *udpSocket) closeFastPathLocked() {
+	if s.fastPath.conn == nil {
+		return
+	}
+
+	_ = s.fastPath.conn.Close() // Ends its read loop
+	s.fastPath.conn = nil
+	s.fastPath.peer = netip.AddrPort{}
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package sock
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const dontFragmentSupported = true
+
+// withDontFragment sets the Don't-Fragment bit on the socket (IP_PMTUDISC_DO) while send runs and restores the previous mode afterwards.
+// A datagram larger than the MTU of the interface is rejected with EMSGSIZE, on the path it's dropped instead of fragmented.
+func withDontFragment(c syscall.RawConn, send func() error) error {
+	var previous int
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		previous, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+		if sockErr == nil {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return err
+	}
+
+	defer c.Control(func(fd uintptr) {
+		_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, previous)
+	})
+	return send()
+}
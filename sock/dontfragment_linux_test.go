@@ -0,0 +1,54 @@
+package sock
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestSendDontFragmentToRestoresMode verifies that a datagram sent with the Don't-Fragment bit arrives
+// and that the socket keeps its previous path MTU discovery mode for the other datagrams.
+func TestSendDontFragmentToRestoresMode(t *testing.T) {
+	s := openLoopback(t, false)
+	peer := openLoopback(t, false)
+	received := peer.Subscribe()
+
+	mode := func() int {
+		rawConn, err := s.udpSocket.SyscallConn()
+		if err != nil {
+			t.Fatalf("SyscallConn failed: %v", err)
+		}
+		var mode int
+		var sockErr error
+		err = rawConn.Control(func(fd uintptr) {
+			mode, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+		})
+		if err != nil || sockErr != nil {
+			t.Fatalf("Failed to read IP_MTU_DISCOVER: %v %v", err, sockErr)
+		}
+		return mode
+	}
+
+	before := mode()
+	if before == unix.IP_PMTUDISC_DO {
+		t.Fatalf("Socket is opened with the Don't-Fragment bit")
+	}
+
+	if err := s.SendDontFragmentTo(net.UDPAddrFromAddrPort(peer.MustGetLocalAddress()), []byte("probe")); err != nil {
+		t.Fatalf("SendDontFragmentTo failed: %v", err)
+	}
+	select {
+	case packet := <-received:
+		if string(packet.Data) != "probe" {
+			t.Errorf("Received %q, want %q", packet.Data, "probe")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Datagram sent with the Don't-Fragment bit didn't arrive")
+	}
+
+	if after := mode(); after != before {
+		t.Errorf("IP_MTU_DISCOVER is %d after the send, want the previous mode %d", after, before)
+	}
+}
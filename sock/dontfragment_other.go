@@ -0,0 +1,12 @@
+//go:build !(linux || darwin)
+
+package sock
+
+import "syscall"
+
+const dontFragmentSupported = false
+
+// withDontFragment isn't supported on this platform, the datagrams may be fragmented.
+func withDontFragment(c syscall.RawConn, send func() error) error {
+	return ErrDontFragmentUnsupported
+}
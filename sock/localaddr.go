@@ -0,0 +1,98 @@
+package sock
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// InterfaceAddress is an IPv4 address of an up network interface.
+type InterfaceAddress struct {
+	Interface string
+	Addr      netip.Addr
+}
+
+// GetInterfaceAddresses returns the IPv4 addresses of all network interfaces that are up.
+// Interfaces whose addresses can't be read are skipped.
+func GetInterfaceAddresses() ([]InterfaceAddress, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]InterfaceAddress, 0)
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue // Skip down interfaces
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue // Skip non-IP addresses
+			}
+
+			ip, ok := netip.AddrFromSlice(ipNet.IP.To4())
+			if !ok {
+				continue // Skip non-IPv4 addresses
+			}
+
+			result = append(result, InterfaceAddress{Interface: iface.Name, Addr: ip})
+		}
+	}
+
+	return result, nil
+}
+
+// GetInterfaceAddress returns the first IPv4 address of the named interface.
+func GetInterfaceAddress(name string) (netip.Addr, error) {
+	addrs, err := GetInterfaceAddresses()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	for _, addr := range addrs {
+		if addr.Interface == name {
+			return addr.Addr, nil
+		}
+	}
+
+	return netip.Addr{}, errors.New("no up interface with an IPv4 address named " + name)
+}
+
+// SelectDefaultAddress returns the first non-loopback IPv4 address of an up interface.
+// Falls back to 127.0.0.1 if there is none, e.g. on machines without network.
+func SelectDefaultAddress() netip.Addr {
+	addrs, err := GetInterfaceAddresses()
+	if err == nil {
+		for _, addr := range addrs {
+			if !addr.Addr.IsLoopback() && !addr.Addr.IsLinkLocalUnicast() {
+				return addr.Addr
+			}
+		}
+	}
+
+	return netip.AddrFrom4([4]byte{127, 0, 0, 1})
+}
+
+// DetectOutgoingAddress returns the local IPv4 address the operating system uses to reach the target.
+// Connecting a UDP socket selects a route and source address without sending any packet.
+func DetectOutgoingAddress(target netip.Addr) (netip.Addr, error) {
+	if !target.Is4() {
+		return netip.Addr{}, errors.New("target is not an IPv4 address")
+	}
+
+	conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(target, PREFERRED_PORT)))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
@@ -0,0 +1,278 @@
+package sock
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/util/assert"
+	"bjoernblessin.de/chatprotogol/util/observer"
+)
+
+// MemoryNetwork connects in-memory sockets within one process, e.g. for tests and simulations without real UDP ports.
+// Datagrams sent to an address without an open socket are dropped, like UDP does.
+// Loss, latency and an MTU for datagrams sent with the Don't-Fragment bit can be configured for the whole network.
+// The MemoryNetwork is thread-safe and can be used concurrently.
+type MemoryNetwork struct {
+	mu       sync.Mutex
+	sockets  map[netip.AddrPort]*MemorySocket
+	lossRate float64       // Probability in [0, 1] that a datagram is dropped
+	latency  time.Duration // Delay before a datagram is delivered
+	mtu      int           // Largest datagram sent with the Don't-Fragment bit that is delivered, zero for no limit
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		sockets: make(map[netip.AddrPort]*MemorySocket),
+	}
+}
+
+// SetLoss sets the probability in [0, 1] that a datagram is dropped.
+func (n *MemoryNetwork) SetLoss(lossRate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.lossRate = lossRate
+}
+
+// SetLatency sets the delay before a datagram is delivered.
+func (n *MemoryNetwork) SetLatency(latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.latency = latency
+}
+
+// SetMTU sets the largest datagram that is delivered if it's sent with the Don't-Fragment bit (see MemorySocket.SendDontFragmentTo).
+// Larger datagrams sent with SendTo are still delivered, as if they were fragmented. Zero removes the limit.
+func (n *MemoryNetwork) SetMTU(mtu int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.mtu = mtu
+}
+
+// NewSocket creates an unopened socket in the network.
+func (n *MemoryNetwork) NewSocket() *MemorySocket {
+	return &MemorySocket{
+		network:          n,
+		packetObservable: observer.NewObservable[*Packet](common.SOCKET_RECEIVE_BUFFER_SIZE),
+	}
+}
+
+// bind registers the socket at the address and the first free port starting at PREFERRED_PORT.
+func (n *MemoryNetwork) bind(s *MemorySocket, addr netip.Addr) (netip.AddrPort, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for port := PREFERRED_PORT; port <= 0xFFFF; port++ {
+		addrPort := netip.AddrPortFrom(addr, uint16(port))
+		if _, taken := n.sockets[addrPort]; !taken {
+			n.sockets[addrPort] = s
+			return addrPort, nil
+		}
+	}
+
+	return netip.AddrPort{}, errors.New("no free port on the address")
+}
+
+func (n *MemoryNetwork) unbind(addrPort netip.AddrPort) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.sockets, addrPort)
+}
+
+// deliver hands the datagram to the socket at the destination, applying loss and latency.
+func (n *MemoryNetwork) deliver(from netip.AddrPort, to netip.AddrPort, data []byte) {
+	n.mu.Lock()
+	lossRate, latency := n.lossRate, n.latency
+	n.mu.Unlock()
+
+	if lossRate > 0 && rand.Float64() < lossRate {
+		return
+	}
+
+	send := func() {
+		n.mu.Lock()
+		target, exists := n.sockets[to]
+		n.mu.Unlock()
+
+		if exists {
+			target.packetObservable.NotifyObservers(&Packet{net.UDPAddrFromAddrPort(from), data})
+		}
+	}
+
+	if latency > 0 {
+		time.AfterFunc(latency, send)
+	} else {
+		send()
+	}
+}
+
+// MemorySocket is a Socket of a MemoryNetwork.
+type MemorySocket struct {
+	network          *MemoryNetwork
+	mu               sync.Mutex
+	localAddr        netip.AddrPort // Invalid while the socket is closed
+	boundAddr        netip.AddrPort // Differs from localAddr after Rebind or if a node ID is set
+	nodeID           netip.Addr     // Invalid if the socket identifies by its address
+	packetObservable *observer.Observable[*Packet]
+}
+
+func (s *MemorySocket) GetLocalAddress() (netip.AddrPort, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.localAddr.IsValid() {
+		return netip.AddrPort{}, errors.New("memory socket is not initialized")
+	}
+	return s.localAddr, nil
+}
+
+func (s *MemorySocket) GetBoundAddress() (netip.AddrPort, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.boundAddr.IsValid() {
+		return netip.AddrPort{}, errors.New("memory socket is not initialized")
+	}
+	return s.boundAddr, nil
+}
+
+func (s *MemorySocket) MustGetLocalAddress() netip.AddrPort {
+	addr, err := s.GetLocalAddress()
+	assert.IsNil(err)
+	return addr
+}
+
+// SendTo delivers a copy of the data to the socket at addr, the caller may reuse data after SendTo returns.
+func (s *MemorySocket) SendTo(addr *net.UDPAddr, data []byte) error {
+	boundAddr, err := s.GetBoundAddress()
+	if err != nil {
+		return net.ErrClosed
+	}
+
+	if len(data) > common.UDP_BUFFER_SIZE_BYTES {
+		return errors.New("datagram exceeds the receive buffer size")
+	}
+
+	dataCopy := make([]byte, len(data))
+	copy(dataCopy, data)
+
+	to := addr.AddrPort()
+	s.network.deliver(boundAddr, netip.AddrPortFrom(to.Addr().Unmap(), to.Port()), dataCopy)
+	return nil
+}
+
+// Open binds the socket to the IPv4 address in its network.
+// Like the UDP socket, PREFERRED_PORT is used if it is free, otherwise the next free port.
+func (s *MemorySocket) Open(ipv4addr net.IP) (*net.UDPAddr, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	assert.Assert(!s.localAddr.IsValid(), "Memory socket is already initialized. Call Close() before calling Open() again.")
+
+	addr, ok := netip.AddrFromSlice(ipv4addr.To4())
+	if !ok {
+		return nil, errors.New("memory sockets only support IPv4 addresses")
+	}
+
+	localAddr, err := s.network.bind(s, addr)
+	if err != nil {
+		return nil, err
+	}
+	s.localAddr = localAddr
+	s.boundAddr = localAddr
+	if s.nodeID.IsValid() {
+		s.localAddr = netip.AddrPortFrom(s.nodeID, localAddr.Port())
+	}
+
+	return net.UDPAddrFromAddrPort(localAddr), nil
+}
+
+// SetNodeID makes the socket identify as id from the next Open on.
+func (s *MemorySocket) SetNodeID(id netip.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodeID = id
+}
+
+// Rebind moves the socket to the IPv4 address in its network, the local address stays the same.
+func (s *MemorySocket) Rebind(ipv4addr net.IP) (*net.UDPAddr, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	assert.Assert(s.boundAddr.IsValid(), "Memory socket is not initialized.")
+
+	addr, ok := netip.AddrFromSlice(ipv4addr.To4())
+	if !ok {
+		return nil, errors.New("memory sockets only support IPv4 addresses")
+	}
+
+	boundAddr, err := s.network.bind(s, addr)
+	if err != nil {
+		return nil, err
+	}
+	s.network.unbind(s.boundAddr)
+	s.boundAddr = boundAddr
+
+	return net.UDPAddrFromAddrPort(boundAddr), nil
+}
+
+// SetConnectedMode does nothing, memory sockets have no per-packet route lookup to skip.
+func (s *MemorySocket) SetConnectedMode(enabled bool) error {
+	return nil
+}
+
+// DontFragment returns true, see SendDontFragmentTo.
+func (s *MemorySocket) DontFragment() bool {
+	return true
+}
+
+// SendDontFragmentTo sends like SendTo, but drops a datagram larger than the MTU of the network (see MemoryNetwork.SetMTU).
+func (s *MemorySocket) SendDontFragmentTo(addr *net.UDPAddr, data []byte) error {
+	s.network.mu.Lock()
+	mtu := s.network.mtu
+	s.network.mu.Unlock()
+
+	if mtu > 0 && len(data) > mtu {
+		if _, err := s.GetBoundAddress(); err != nil {
+			return net.ErrClosed
+		}
+		return nil // Dropped on the path, like a router drops a datagram it may not fragment
+	}
+	return s.SendTo(addr, data)
+}
+
+// ConnectedPeer always returns false, see SetConnectedMode.
+func (s *MemorySocket) ConnectedPeer() (netip.AddrPort, bool) {
+	return netip.AddrPort{}, false
+}
+
+func (s *MemorySocket) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.localAddr.IsValid() {
+		return nil
+	}
+
+	s.network.unbind(s.boundAddr)
+	s.localAddr = netip.AddrPort{}
+	s.boundAddr = netip.AddrPort{}
+	return nil
+}
+
+func (s *MemorySocket) Subscribe() chan *Packet {
+	return s.packetObservable.SubscribeWith(packetSubscribeOptions)
+}
+
+func (s *MemorySocket) DroppedPackets() uint64 {
+	return s.packetObservable.Dropped()
+}
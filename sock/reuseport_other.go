@@ -0,0 +1,15 @@
+//go:build !(linux || darwin)
+
+package sock
+
+import (
+	"errors"
+	"syscall"
+)
+
+const connectedModeSupported = false
+
+// reusePort isn't supported on this platform, the connected-UDP fast path can't be enabled.
+func reusePort(network string, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT not supported on this platform")
+}
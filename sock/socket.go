@@ -3,9 +3,11 @@
 package sock
 
 import (
+	"context"
 	"errors"
 	"net"
 	"net/netip"
+	"sync"
 
 	"bjoernblessin.de/chatprotogol/common"
 	"bjoernblessin.de/chatprotogol/util/assert"
@@ -15,17 +17,27 @@ import (
 
 const PREFERRED_PORT = 20000
 
+// ErrDontFragmentUnsupported is returned by SendDontFragmentTo if the platform can't set the Don't-Fragment bit.
+var ErrDontFragmentUnsupported = errors.New("the Don't-Fragment bit can't be set on this platform")
+
 type Socket interface {
 	// GetLocalAddress returns the local address of the UDP socket.
+	// The address identifies the node in the protocol (node ID), it's the address the socket was opened on and is kept on Rebind.
+	// If a node ID is set (see SetNodeID), the node ID is returned with the port the socket was opened on.
 	// It errors if the socket is not initialized.
 	GetLocalAddress() (netip.AddrPort, error)
 
+	// GetBoundAddress returns the address the UDP socket is currently bound to.
+	// It differs from GetLocalAddress after Rebind.
+	// It errors if the socket is not initialized.
+	GetBoundAddress() (netip.AddrPort, error)
+
 	// MustGetLocalAddress returns the local address of the UDP socket.
 	// It panics if the socket is not initialized.
 	MustGetLocalAddress() netip.AddrPort
 
 	// SendTo sends a byte array to the specified address.
-	// Open() must be called before using this function.
+	// Open() must be called before using this function, once the socket is closed it errors with net.ErrClosed.
 	SendTo(addr *net.UDPAddr, data []byte) error
 
 	// Open opens a UDP socket on all available IPv4 network interfaces.
@@ -33,18 +45,62 @@ type Socket interface {
 	// Returns the local address of the socket and an error if any occurs.
 	Open(ipv4addr net.IP) (*net.UDPAddr, error)
 
+	// SetNodeID makes the node identify as id instead of the address the socket is opened on.
+	// The node ID is a 32-bit value in IPv4 notation, it takes effect on the next Open.
+	// The invalid Addr restores the default, identifying by the socket address.
+	SetNodeID(id netip.Addr)
+
+	// Rebind moves the open socket to a new IPv4 address, e.g. after a network change.
+	// The local address (see GetLocalAddress) stays the same, packets are sent from and received on the new address.
+	// If the new address can't be bound, the socket stays bound to the old address.
+	// Returns the new bound address.
+	Rebind(ipv4addr net.IP) (*net.UDPAddr, error)
+
 	// Close closes the UDP socket if it's open.
 	// Packet observers are not cleared, they will receive packets from future sockets.
 	Close() error
 
 	// Subscribe registers an observer to receive packets from the UDP socket.
 	// The observer will receive all packets that are received by the socket.
+	// If the observer doesn't keep up, the oldest buffered packets are dropped.
 	Subscribe() chan *Packet
+
+	// DroppedPackets returns the number of received packets that were dropped because an observer didn't keep up.
+	DroppedPackets() uint64
+
+	// SendDontFragmentTo sends a byte array to the specified address with the Don't-Fragment bit,
+	// so the datagram is dropped instead of fragmented if it's larger than the path MTU. Path MTU probes are sent with it.
+	// SendTo keeps the default of the operating system, which fragments datagrams larger than the MTU of the interface.
+	// Errors with ErrDontFragmentUnsupported if the platform can't set the bit.
+	SendDontFragmentTo(addr *net.UDPAddr, data []byte) error
+
+	// DontFragment returns whether SendDontFragmentTo is supported.
+	DontFragment() bool
+
+	// SetConnectedMode enables or disables the connected-UDP fast path to the neighbor that receives most of the packets.
+	// It takes effect on the next Open. Errors if the platform doesn't support it.
+	SetConnectedMode(enabled bool) error
+
+	// ConnectedPeer returns the neighbor the connected-UDP fast path currently leads to.
+	// Returns false if the fast path isn't connected.
+	ConnectedPeer() (netip.AddrPort, bool)
+}
+
+// packetSubscribeOptions makes the receive buffer of a packet observer a ring buffer.
+// Under load the oldest packets are dropped, they are the most likely to have been retransmitted already.
+var packetSubscribeOptions = observer.SubscribeOptions{
+	BufferSize: common.SOCKET_RECEIVE_BUFFER_SIZE,
+	Overflow:   observer.DropOldest,
 }
 
 type udpSocket struct {
 	udpSocket        *net.UDPConn
+	localAddr        netip.AddrPort // Address the socket was opened on or the node ID, kept on Rebind
+	nodeID           netip.Addr     // Invalid if the node identifies by its socket address
 	packetObservable *observer.Observable[*Packet]
+	connectedMode    bool // Whether the socket is opened for the connected-UDP fast path
+	fastPath         connectedPath
+	sendMu           sync.RWMutex // Held exclusively while the Don't-Fragment bit is set, so SendTo never sends with it
 }
 
 type Packet struct {
@@ -59,6 +115,13 @@ func NewUDPSocket() *udpSocket {
 }
 
 func (s *udpSocket) GetLocalAddress() (netip.AddrPort, error) {
+	if s.udpSocket == nil {
+		return netip.AddrPort{}, errors.New("UDP socket is not initialized")
+	}
+	return s.localAddr, nil
+}
+
+func (s *udpSocket) GetBoundAddress() (netip.AddrPort, error) {
 	if s.udpSocket == nil {
 		return netip.AddrPort{}, errors.New("UDP socket is not initialized")
 	}
@@ -72,37 +135,120 @@ func (s *udpSocket) MustGetLocalAddress() netip.AddrPort {
 }
 
 func (s *udpSocket) Subscribe() chan *Packet {
-	return s.packetObservable.Subscribe()
+	return s.packetObservable.SubscribeWith(packetSubscribeOptions)
+}
+
+func (s *udpSocket) DroppedPackets() uint64 {
+	return s.packetObservable.Dropped()
+}
+
+func (s *udpSocket) DontFragment() bool {
+	return dontFragmentSupported
+}
+
+// SendDontFragmentTo sets the Don't-Fragment bit on the socket for the one datagram and restores the previous setting afterwards.
+func (s *udpSocket) SendDontFragmentTo(addr *net.UDPAddr, data []byte) error {
+	if !dontFragmentSupported {
+		return ErrDontFragmentUnsupported
+	}
+	if s.udpSocket == nil {
+		return net.ErrClosed
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	rawConn, err := s.udpSocket.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return withDontFragment(rawConn, func() error {
+		_, err := s.udpSocket.WriteToUDP(data, addr)
+		return err
+	})
 }
 
 func (s *udpSocket) Open(ipv4addr net.IP) (*net.UDPAddr, error) {
 	assert.Assert(s.udpSocket == nil, "UDP socket is already initialized. Call Close() before calling Open() again.")
 
+	socket, err := listen(ipv4addr, s.connectedMode)
+	if err != nil {
+		s.udpSocket = nil
+		return nil, err
+	}
+	s.udpSocket = socket
+	s.localAddr = socket.LocalAddr().(*net.UDPAddr).AddrPort()
+	if s.nodeID.IsValid() {
+		s.localAddr = netip.AddrPortFrom(s.nodeID, s.localAddr.Port())
+	}
+
+	go s.readLoop(socket)
+
+	return socket.LocalAddr().(*net.UDPAddr), nil
+}
+
+func (s *udpSocket) SetNodeID(id netip.Addr) {
+	s.nodeID = id
+}
+
+func (s *udpSocket) Rebind(ipv4addr net.IP) (*net.UDPAddr, error) {
+	assert.IsNotNil(s.udpSocket, "UDP socket is not initialized.")
+
+	socket, err := listen(ipv4addr, s.connectedMode)
+	if err != nil {
+		return nil, err
+	}
+
+	s.closeFastPath()
+	oldSocket := s.udpSocket
+	s.udpSocket = socket
+	_ = oldSocket.Close() // Ends the read loop of the old socket
+
+	go s.readLoop(socket)
+
+	return socket.LocalAddr().(*net.UDPAddr), nil
+}
+
+// listen opens a UDP socket on PREFERRED_PORT of the address or on a random port if PREFERRED_PORT is taken.
+// A socket for the connected-UDP fast path is reopened on the selected port with SO_REUSEPORT,
+// so a port shared with another socket in connected mode isn't mistaken for a free one.
+func listen(ipv4addr net.IP, connectedMode bool) (*net.UDPConn, error) {
+	socket, err := listenPreferred(ipv4addr)
+	if err != nil || !connectedMode {
+		return socket, err
+	}
+
+	addr := socket.LocalAddr().String()
+	_ = socket.Close()
+
+	config := net.ListenConfig{Control: reusePort}
+	conn, err := config.ListenPacket(context.Background(), "udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// listenPreferred opens a UDP socket on PREFERRED_PORT of the address or on a random port if PREFERRED_PORT is taken.
+func listenPreferred(ipv4addr net.IP) (*net.UDPConn, error) {
 	socket, err := net.ListenUDP("udp4", &net.UDPAddr{
 		IP:   ipv4addr,
 		Port: PREFERRED_PORT,
 	})
 	if err != nil {
-		socket, err = net.ListenUDP("udp4", &net.UDPAddr{
+		return net.ListenUDP("udp4", &net.UDPAddr{
 			IP:   ipv4addr,
 			Port: 0,
 		})
-		if err != nil {
-			s.udpSocket = nil
-			return nil, err
-		}
 	}
-	s.udpSocket = socket
-
-	go s.readLoop()
-
-	return socket.LocalAddr().(*net.UDPAddr), nil
+	return socket, nil
 }
 
-func (s *udpSocket) readLoop() {
+func (s *udpSocket) readLoop(socket *net.UDPConn) {
+	buffer := make([]byte, common.UDP_BUFFER_SIZE_BYTES)
+
 	for {
-		buffer := make([]byte, common.UDP_BUFFER_SIZE_BYTES)
-		n, addr, err := s.udpSocket.ReadFromUDP(buffer)
+		n, addr, err := socket.ReadFromUDP(buffer)
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				// Socket is closed, exit the loop
@@ -113,12 +259,27 @@ func (s *udpSocket) readLoop() {
 			continue
 		}
 
-		s.packetObservable.NotifyObservers(&Packet{addr, buffer[:n]})
+		data := make([]byte, n) // Copy so the large read buffer can be reused
+		copy(data, buffer[:n])
+
+		s.packetObservable.NotifyObservers(&Packet{addr, data})
 	}
 }
 
 func (s *udpSocket) SendTo(addr *net.UDPAddr, data []byte) error {
-	assert.IsNotNil(s.udpSocket, "UDP socket is not initialized.")
+	if s.udpSocket == nil {
+		return net.ErrClosed
+	}
+
+	s.sendMu.RLock()
+	defer s.sendMu.RUnlock()
+
+	if s.connectedMode {
+		if conn := s.fastPathTo(addr.AddrPort()); conn != nil {
+			_, err := conn.Write(data)
+			return err
+		}
+	}
 
 	_, err := s.udpSocket.WriteToUDP(data, addr)
 	if err != nil {
@@ -133,12 +294,14 @@ func (s *udpSocket) Close() error {
 		return nil
 	}
 
+	s.closeFastPath()
 	err := s.udpSocket.Close()
 	if err != nil {
 		return err
 	}
 
 	s.udpSocket = nil
+	s.localAddr = netip.AddrPort{}
 
 	return nil
 }
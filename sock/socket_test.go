@@ -0,0 +1,116 @@
+package sock
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/common"
+)
+
+// openLoopback opens a UDP socket on the loopback address, optionally in connected mode.
+func openLoopback(t testing.TB, connected bool) *udpSocket {
+	t.Helper()
+
+	s := NewUDPSocket()
+	if connected {
+		if err := s.SetConnectedMode(true); err != nil {
+			t.Skipf("Connected mode unavailable: %v", err)
+		}
+	}
+	if _, err := s.Open(net.IPv4(127, 0, 0, 1)); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestConnectedModeFollowsMainDestination(t *testing.T) {
+	s := openLoopback(t, true)
+	peer := openLoopback(t, false)
+	other := openLoopback(t, false)
+
+	peerAddr := net.UDPAddrFromAddrPort(peer.MustGetLocalAddress())
+	otherAddr := net.UDPAddrFromAddrPort(other.MustGetLocalAddress())
+
+	for i := range common.CONNECTED_UDP_WINDOW {
+		dest := peerAddr
+		if i%4 == 0 {
+			dest = otherAddr
+		}
+		if err := s.SendTo(dest, []byte{byte(i)}); err != nil {
+			t.Fatalf("SendTo failed: %v", err)
+		}
+	}
+
+	connectedPeer, ok := s.ConnectedPeer()
+	if !ok || connectedPeer != peer.MustGetLocalAddress() {
+		t.Fatalf("Expected the fast path to lead to %v, got %v (connected %v)", peer.MustGetLocalAddress(), connectedPeer, ok)
+	}
+
+	// Packets through the fast path come from the address of the socket and replies of the peer reach it
+	received := peer.Subscribe()
+	replies := s.Subscribe()
+	if err := s.SendTo(peerAddr, []byte("ping")); err != nil {
+		t.Fatalf("SendTo failed: %v", err)
+	}
+	select {
+	case packet := <-received:
+		if packet.Addr.AddrPort() != s.MustGetLocalAddress() {
+			t.Errorf("Expected the packet to come from %v, got %v", s.MustGetLocalAddress(), packet.Addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Peer didn't receive the packet sent through the fast path")
+	}
+
+	if err := peer.SendTo(net.UDPAddrFromAddrPort(s.MustGetLocalAddress()), []byte("pong")); err != nil {
+		t.Fatalf("SendTo failed: %v", err)
+	}
+	select {
+	case <-replies:
+	case <-time.After(time.Second):
+		t.Fatal("Reply of the connected peer wasn't received")
+	}
+
+	// A window without a main destination closes the fast path
+	for i := range common.CONNECTED_UDP_WINDOW {
+		dest := peerAddr
+		if i%2 == 0 {
+			dest = otherAddr
+		}
+		if i%3 == 0 {
+			dest = net.UDPAddrFromAddrPort(s.MustGetLocalAddress())
+		}
+		if err := s.SendTo(dest, []byte{byte(i)}); err != nil {
+			t.Fatalf("SendTo failed: %v", err)
+		}
+	}
+	if _, ok := s.ConnectedPeer(); ok {
+		t.Error("Expected the fast path to be closed without a main destination")
+	}
+}
+
+// BenchmarkSendTo sends file-transfer-sized packets to a single neighbor with and without the connected-UDP fast path.
+func BenchmarkSendTo(b *testing.B) {
+	payload := make([]byte, 1400)
+
+	for _, connected := range []bool{false, true} {
+		name := "unconnected"
+		if connected {
+			name = "connected"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			s := openLoopback(b, connected)
+			peer := openLoopback(b, false)
+			peerAddr := net.UDPAddrFromAddrPort(peer.MustGetLocalAddress())
+
+			b.SetBytes(int64(len(payload)))
+			for b.Loop() {
+				if err := s.SendTo(peerAddr, payload); err != nil {
+					b.Fatalf("SendTo failed: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package sock
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"bjoernblessin.de/chatprotogol/common"
+	"bjoernblessin.de/chatprotogol/util/assert"
+	"bjoernblessin.de/chatprotogol/util/observer"
+)
+
+// SocketSet lets a multi-homed node listen on several addresses, e.g. one per interface, and bridge the network segments behind them.
+// It is a Socket made of a primary socket, which is opened on the address passed to Open and identifies the node,
+// and additional sockets, which are opened on fixed addresses.
+// The packets of all sockets are received through the set. The neighbor table remembers which socket a neighbor was last heard on
+// and sends the packets to the neighbor through that socket. Packets to a neighbor that wasn't heard yet are sent through the socket
+// on the address the operating system would send them from, or the primary socket.
+// Only IPv4 addresses are supported, the protocol addresses nodes by IPv4 addresses.
+type SocketSet struct {
+	mu               sync.RWMutex
+	members          []setMember // members[0] is the primary socket
+	neighbors        map[netip.AddrPort]int
+	packetObservable *observer.Observable[*Packet]
+}
+
+type setMember struct {
+	socket Socket
+	addr   netip.Addr // Address the socket is opened on, invalid for the primary socket
+}
+
+// SocketSetMember is a socket of a SocketSet and the neighbors it reaches.
+type SocketSetMember struct {
+	BoundAddr netip.AddrPort // Invalid if the socket is closed
+	Primary   bool
+	Neighbors []netip.AddrPort // Sorted
+}
+
+// NewSocketSet creates a socket set with the primary socket.
+func NewSocketSet(primary Socket) *SocketSet {
+	s := &SocketSet{
+		neighbors:        make(map[netip.AddrPort]int),
+		packetObservable: observer.NewObservable[*Packet](common.SOCKET_RECEIVE_BUFFER_SIZE),
+	}
+	s.addMember(setMember{socket: primary})
+	return s
+}
+
+// AddSocket adds a socket that is opened on the IPv4 address with the next Open of the set.
+func (s *SocketSet) AddSocket(socket Socket, addr netip.Addr) error {
+	if !addr.Is4() {
+		return errors.New("socket sets only support IPv4 addresses")
+	}
+
+	s.addMember(setMember{socket: socket, addr: addr})
+	return nil
+}
+
+// addMember adds the socket and forwards its packets to the observers of the set, remembering the socket as the one reaching the sender.
+func (s *SocketSet) addMember(member setMember) {
+	s.mu.Lock()
+	index := len(s.members)
+	s.members = append(s.members, member)
+	s.mu.Unlock()
+
+	packets := member.socket.Subscribe()
+	go func() {
+		for packet := range packets {
+			sender := packet.Addr.AddrPort()
+			s.mu.Lock()
+			s.neighbors[netip.AddrPortFrom(sender.Addr().Unmap(), sender.Port())] = index
+			s.mu.Unlock()
+
+			s.packetObservable.NotifyObservers(packet)
+		}
+	}()
+}
+
+func (s *SocketSet) primary() Socket {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.members[0].socket
+}
+
+func (s *SocketSet) GetLocalAddress() (netip.AddrPort, error) {
+	return s.primary().GetLocalAddress()
+}
+
+// GetBoundAddress returns the address the primary socket is bound to.
+func (s *SocketSet) GetBoundAddress() (netip.AddrPort, error) {
+	return s.primary().GetBoundAddress()
+}
+
+func (s *SocketSet) MustGetLocalAddress() netip.AddrPort {
+	addr, err := s.GetLocalAddress()
+	assert.IsNil(err)
+	return addr
+}
+
+// SendTo sends the data through the socket that reaches the neighbor.
+func (s *SocketSet) SendTo(addr *net.UDPAddr, data []byte) error {
+	return s.socketFor(addr.AddrPort()).SendTo(addr, data)
+}
+
+// socketFor returns the socket the neighbor was last heard on.
+// A neighbor that wasn't heard yet is assigned the socket on the address the operating system would send from, or the primary socket.
+func (s *SocketSet) socketFor(neighbor netip.AddrPort) Socket {
+	neighbor = netip.AddrPortFrom(neighbor.Addr().Unmap(), neighbor.Port())
+
+	s.mu.RLock()
+	index, known := s.neighbors[neighbor]
+	socket := s.members[index].socket
+	s.mu.RUnlock()
+	if known {
+		return socket
+	}
+
+	index = 0
+	if outgoing, err := DetectOutgoingAddress(neighbor.Addr()); err == nil {
+		s.mu.RLock()
+		for i, member := range s.members {
+			if boundAddr, err := member.socket.GetBoundAddress(); err == nil && boundAddr.Addr() == outgoing {
+				index = i
+				break
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, known := s.neighbors[neighbor]; known {
+		index = current // Heard meanwhile
+	} else {
+		s.neighbors[neighbor] = index
+	}
+	return s.members[index].socket
+}
+
+// Open opens the primary socket on the address and the additional sockets on their addresses.
+// If a socket can't be opened, the sockets opened so far are closed again.
+// Returns the address of the primary socket.
+func (s *SocketSet) Open(ipv4addr net.IP) (*net.UDPAddr, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	localAddr, err := s.members[0].socket.Open(ipv4addr)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, member := range s.members[1:] {
+		if _, err := member.socket.Open(net.IP(member.addr.AsSlice())); err != nil {
+			for _, opened := range s.members[:i+1] {
+				_ = opened.socket.Close()
+			}
+			return nil, err
+		}
+	}
+
+	clear(s.neighbors)
+	return localAddr, nil
+}
+
+// SetNodeID sets the node ID of the primary socket.
+func (s *SocketSet) SetNodeID(id netip.Addr) {
+	s.primary().SetNodeID(id)
+}
+
+// Rebind moves the primary socket to a new IPv4 address, the additional sockets stay on their addresses.
+func (s *SocketSet) Rebind(ipv4addr net.IP) (*net.UDPAddr, error) {
+	return s.primary().Rebind(ipv4addr)
+}
+
+// Close closes all sockets of the set and forgets the neighbors, returns the first error.
+func (s *SocketSet) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for _, member := range s.members {
+		if err := member.socket.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	clear(s.neighbors)
+	return firstErr
+}
+
+func (s *SocketSet) Subscribe() chan *Packet {
+	return s.packetObservable.SubscribeWith(packetSubscribeOptions)
+}
+
+// DroppedPackets returns the number of received packets that were dropped by the sockets of the set or its observers.
+func (s *SocketSet) DroppedPackets() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	dropped := s.packetObservable.Dropped()
+	for _, member := range s.members {
+		dropped += member.socket.DroppedPackets()
+	}
+	return dropped
+}
+
+// SetConnectedMode enables or disables the connected-UDP fast path of every socket of the set.
+// Errors, without changing any socket, if the platform doesn't support it.
+func (s *SocketSet) SetConnectedMode(enabled bool) error {
+	if enabled && !connectedModeSupported {
+		return errConnectedModeUnsupported
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, member := range s.members {
+		if err := member.socket.SetConnectedMode(enabled); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendDontFragmentTo sends the data with the Don't-Fragment bit through the socket the neighbor was last heard on.
+func (s *SocketSet) SendDontFragmentTo(addr *net.UDPAddr, data []byte) error {
+	return s.socketFor(addr.AddrPort()).SendDontFragmentTo(addr, data)
+}
+
+// DontFragment returns whether every socket of the set supports SendDontFragmentTo.
+func (s *SocketSet) DontFragment() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, member := range s.members {
+		if !member.socket.DontFragment() {
+			return false
+		}
+	}
+	return true
+}
+
+// ConnectedPeer returns the neighbor the connected-UDP fast path of the primary socket leads to.
+func (s *SocketSet) ConnectedPeer() (netip.AddrPort, bool) {
+	return s.primary().ConnectedPeer()
+}
+
+// Members returns the sockets of the set, the primary socket first, with the neighbors they reach.
+func (s *SocketSet) Members() []SocketSetMember {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	members := make([]SocketSetMember, len(s.members))
+	for i, member := range s.members {
+		members[i].Primary = i == 0
+		if boundAddr, err := member.socket.GetBoundAddress(); err == nil {
+			members[i].BoundAddr = boundAddr
+		}
+	}
+	for neighbor, index := range s.neighbors {
+		members[index].Neighbors = append(members[index].Neighbors, neighbor)
+	}
+	for i := range members {
+		slices.SortFunc(members[i].Neighbors, func(a, b netip.AddrPort) int { return a.Compare(b) })
+	}
+	return members
+}
@@ -0,0 +1,95 @@
+package sock
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, packets chan *Packet) *Packet {
+	t.Helper()
+
+	select {
+	case packet := <-packets:
+		return packet
+	case <-time.After(time.Second):
+		t.Fatal("No packet received")
+		return nil
+	}
+}
+
+func openMemory(t *testing.T, socket Socket, addr string) {
+	t.Helper()
+
+	if _, err := socket.Open(net.ParseIP(addr)); err != nil {
+		t.Fatalf("Open on %s failed: %v", addr, err)
+	}
+	t.Cleanup(func() { _ = socket.Close() })
+}
+
+func TestSocketSetBridgesSegments(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	set := NewSocketSet(network.NewSocket())
+	if err := set.AddSocket(network.NewSocket(), netip.MustParseAddr("10.1.0.1")); err != nil {
+		t.Fatalf("AddSocket failed: %v", err)
+	}
+	openMemory(t, set, "10.0.0.1")
+	received := set.Subscribe()
+
+	if got := set.MustGetLocalAddress().Addr(); got != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("Expected the primary address as local address, got %v", got)
+	}
+
+	neighborA := network.NewSocket()
+	openMemory(t, neighborA, "10.0.0.2")
+	neighborB := network.NewSocket()
+	openMemory(t, neighborB, "10.1.0.2")
+	receivedA := neighborA.Subscribe()
+	receivedB := neighborB.Subscribe()
+
+	// Both segments are received through the set
+	primaryAddr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), PREFERRED_PORT))
+	additionalAddr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr("10.1.0.1"), PREFERRED_PORT))
+	if err := neighborA.SendTo(primaryAddr, []byte("a")); err != nil {
+		t.Fatalf("SendTo failed: %v", err)
+	}
+	receive(t, received)
+	if err := neighborB.SendTo(additionalAddr, []byte("b")); err != nil {
+		t.Fatalf("SendTo failed: %v", err)
+	}
+	receive(t, received)
+
+	// Replies leave through the socket the neighbor was heard on
+	if err := set.SendTo(net.UDPAddrFromAddrPort(neighborA.MustGetLocalAddress()), []byte("to a")); err != nil {
+		t.Fatalf("SendTo failed: %v", err)
+	}
+	if packet := receive(t, receivedA); packet.Addr.AddrPort() != primaryAddr.AddrPort() {
+		t.Errorf("Expected neighbor A to be reached from %v, got %v", primaryAddr, packet.Addr)
+	}
+	if err := set.SendTo(net.UDPAddrFromAddrPort(neighborB.MustGetLocalAddress()), []byte("to b")); err != nil {
+		t.Fatalf("SendTo failed: %v", err)
+	}
+	if packet := receive(t, receivedB); packet.Addr.AddrPort() != additionalAddr.AddrPort() {
+		t.Errorf("Expected neighbor B to be reached from %v, got %v", additionalAddr, packet.Addr)
+	}
+
+	members := set.Members()
+	if len(members) != 2 || !members[0].Primary {
+		t.Fatalf("Expected the primary and one additional socket, got %+v", members)
+	}
+	if len(members[0].Neighbors) != 1 || members[0].Neighbors[0] != neighborA.MustGetLocalAddress() {
+		t.Errorf("Expected neighbor A on the primary socket, got %v", members[0].Neighbors)
+	}
+	if len(members[1].Neighbors) != 1 || members[1].Neighbors[0] != neighborB.MustGetLocalAddress() {
+		t.Errorf("Expected neighbor B on the additional socket, got %v", members[1].Neighbors)
+	}
+}
+
+func TestSocketSetRejectsIPv6(t *testing.T) {
+	set := NewSocketSet(NewMemoryNetwork().NewSocket())
+	if err := set.AddSocket(NewMemoryNetwork().NewSocket(), netip.MustParseAddr("fd00::1")); err == nil {
+		t.Error("Expected an IPv6 address to be rejected")
+	}
+}
@@ -1,33 +1,45 @@
+// Package assert checks invariants of the program.
+//
+// Whether a failed assertion stops the program depends on the build:
+// built with -tags debug it panics, otherwise it is logged with its stack trace and counted, see [Failures].
 package assert
 
 import (
-	"log"
 	"reflect"
+	"sync/atomic"
 )
 
+var failures atomic.Int64
+
+// Failures returns the number of failed assertions since startup.
+func Failures() int64 {
+	return failures.Load()
+}
+
 // IsNil checks if the given error is nil.
 func IsNil(err error, v ...any) {
 	if err != nil {
-		log.Panicf("[ASSERT] %v was not nil. %v", err, v)
+		fail("[ASSERT] %v was not nil. %v", err, v)
 	}
 }
 
 // Never is a function that should never be called.
 func Never(v ...any) {
-	log.Panicf("[ASSERT] %v", v)
+	fail("[ASSERT] %v", v)
 }
 
 // Assert checks if the condition is true.
 func Assert(condition bool, v ...any) {
 	if !condition {
-		log.Panicf("[ASSERT] %v", v)
+		fail("[ASSERT] %v", v)
 	}
 }
 
 // IsNotNil checks if the given object is not nil.
 func IsNotNil(obj any, v ...any) {
 	if obj == nil {
-		log.Panicf("[ASSERT] %v was nil. %v", obj, v)
+		fail("[ASSERT] %v was nil. %v", obj, v)
+		return
 	}
 
 	// Handle interfaces whose value is nil.
@@ -35,7 +47,7 @@ func IsNotNil(obj any, v ...any) {
 	switch reflect.TypeOf(obj).Kind() {
 	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.UnsafePointer, reflect.Slice:
 		if reflect.ValueOf(obj).IsNil() {
-			log.Panicf("[ASSERT] value of %v was nil (wrapped in interface). %v", obj, v)
+			fail("[ASSERT] value of %v was nil (wrapped in interface). %v", obj, v)
 		}
 	}
 }
@@ -0,0 +1,11 @@
+//go:build debug
+
+package assert
+
+import "log"
+
+// fail panics, so inconsistencies are found during development.
+func fail(format string, v ...any) {
+	failures.Add(1)
+	log.Panicf(format, v...)
+}
@@ -0,0 +1,15 @@
+//go:build !debug
+
+package assert
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// fail logs the failed assertion with its stack trace and lets the caller continue.
+// A transient inconsistency shouldn't stop the whole node.
+func fail(format string, v ...any) {
+	failures.Add(1)
+	log.Printf(format+"\n%s", append(v, debug.Stack())...)
+}
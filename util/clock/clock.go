@@ -0,0 +1,153 @@
+// Package clock abstracts the time source of components with timeouts, so their tests can run in virtual time.
+// Real is the wall clock, Virtual only moves when it is advanced and runs the expired timers on the advancing goroutine,
+// which makes tests of timeouts instant and deterministic.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and schedules functions.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc schedules f to run after at least d.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a function scheduled on a Clock.
+type Timer interface {
+	// Stop prevents the timer from running.
+	// Returns false if the timer already expired or was stopped, like time.Timer.Stop.
+	Stop() bool
+	// Reset reschedules the timer to run after d.
+	// Returns whether the timer was scheduled before, like time.Timer.Reset.
+	Reset(d time.Duration) bool
+}
+
+// Real is the wall clock, its timers run on their own goroutines like time.AfterFunc.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Virtual is a clock that only moves when Advance is called.
+// Can be used concurrently.
+type Virtual struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*virtualTimer]struct{} // Scheduled timers
+	seq    uint64                     // Scheduling order, timers expiring at the same time run in the order they were scheduled
+}
+
+type virtualTimer struct {
+	clock *Virtual
+	f     func()
+	at    time.Time
+	seq   uint64
+}
+
+// NewVirtual creates a virtual clock that starts at start.
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{
+		now:    start,
+		timers: make(map[*virtualTimer]struct{}),
+	}
+}
+
+func (c *Virtual) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *Virtual) AfterFunc(d time.Duration, f func()) Timer {
+	t := &virtualTimer{clock: c, f: f}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.schedule(t, d)
+	return t
+}
+
+// Advance moves the clock forward by d and runs the timers that expire until then in the order of their expiry.
+// While a timer runs, the clock shows its expiry, so timers scheduled or reset by it run within the same Advance if they expire in time.
+func (c *Virtual) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		next := c.nextExpired(target)
+		if next == nil {
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+		delete(c.timers, next)
+		c.now = next.at
+		c.mu.Unlock()
+
+		next.f()
+	}
+}
+
+// Pending returns the number of scheduled timers.
+func (c *Virtual) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.timers)
+}
+
+// schedule adds the timer to expire after d.
+// Must be called with c.mu held.
+func (c *Virtual) schedule(t *virtualTimer, d time.Duration) {
+	c.seq++
+	t.at = c.now.Add(d)
+	t.seq = c.seq
+	c.timers[t] = struct{}{}
+}
+
+// nextExpired returns the timer that expires first, if it expires until target.
+// Must be called with c.mu held.
+func (c *Virtual) nextExpired(target time.Time) *virtualTimer {
+	var next *virtualTimer
+	for t := range c.timers {
+		if t.at.After(target) {
+			continue
+		}
+		if next == nil || t.at.Before(next.at) || (t.at.Equal(next.at) && t.seq < next.seq) {
+			next = t
+		}
+	}
+	return next
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	_, scheduled := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return scheduled
+}
+
+func (t *virtualTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	_, scheduled := t.clock.timers[t]
+	t.clock.schedule(t, d)
+	return scheduled
+}
@@ -0,0 +1,64 @@
+package clock
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestVirtualRunsTimersInOrder(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	c := NewVirtual(start)
+
+	var fired []string
+	var firedAt []time.Duration
+	record := func(name string) func() {
+		return func() {
+			fired = append(fired, name)
+			firedAt = append(firedAt, c.Now().Sub(start))
+		}
+	}
+
+	c.AfterFunc(3*time.Second, record("c"))
+	c.AfterFunc(time.Second, record("a"))
+	c.AfterFunc(time.Second, record("b"))
+	stopped := c.AfterFunc(2*time.Second, record("stopped"))
+	if !stopped.Stop() {
+		t.Errorf("Expected Stop to report the timer as scheduled")
+	}
+
+	c.Advance(2 * time.Second)
+	if !slices.Equal(fired, []string{"a", "b"}) {
+		t.Errorf("Expected a and b to fire after 2s, got %v", fired)
+	}
+	if c.Now().Sub(start) != 2*time.Second {
+		t.Errorf("Expected the clock at 2s, got %v", c.Now().Sub(start))
+	}
+
+	c.Advance(time.Hour)
+	if !slices.Equal(fired, []string{"a", "b", "c"}) || !slices.Equal(firedAt, []time.Duration{time.Second, time.Second, 3 * time.Second}) {
+		t.Errorf("Expected a and b at 1s and c at 3s, got %v at %v", fired, firedAt)
+	}
+	if c.Pending() != 0 {
+		t.Errorf("Expected no pending timers, got %d", c.Pending())
+	}
+}
+
+func TestVirtualTimerResetsItself(t *testing.T) {
+	c := NewVirtual(time.Unix(0, 0))
+
+	runs := 0
+	var timer Timer
+	timer = c.AfterFunc(time.Second, func() {
+		runs++
+		timer.Reset(time.Second)
+	})
+
+	c.Advance(5 * time.Second)
+	if runs != 5 {
+		t.Errorf("Expected the periodic timer to run 5 times in 5s, got %d", runs)
+	}
+	if !timer.Stop() {
+		t.Errorf("Expected the periodic timer to be scheduled")
+	}
+}
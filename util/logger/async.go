@@ -0,0 +1,107 @@
+package logger
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// asyncQueue passes the log lines to a goroutine that writes them, so logging doesn't wait for the console or the log file.
+// Debug and trace lines are dropped while the queue is full, the other lines wait for space.
+type asyncQueue struct {
+	lines   chan queuedLine
+	dropped atomic.Uint64
+}
+
+// queuedLine is a formatted log line waiting to be written, or a flush request if flushed is set.
+type queuedLine struct {
+	logger  *log.Logger
+	at      time.Time // Time the line was logged, not written
+	text    string
+	flushed chan struct{} // Closed once all lines queued before it are written
+}
+
+var async atomic.Pointer[asyncQueue] // nil while logging synchronously
+
+// StartAsync makes logging asynchronous with a queue of queueSize lines, see asyncQueue.
+// Call Flush before the program exits, queued lines are lost otherwise.
+// Calling it again has no effect.
+func StartAsync(queueSize int) {
+	queue := &asyncQueue{lines: make(chan queuedLine, queueSize)}
+	if async.CompareAndSwap(nil, queue) {
+		go queue.run()
+	}
+}
+
+// Flush blocks until all queued log lines are written.
+// It returns right away if logging is synchronous.
+func Flush() {
+	if queue := async.Load(); queue != nil {
+		queue.flush()
+	}
+}
+
+// DroppedLines returns the number of log lines dropped because the queue of the asynchronous logging was full.
+func DroppedLines() uint64 {
+	queue := async.Load()
+	if queue == nil {
+		return 0
+	}
+	return queue.dropped.Load()
+}
+
+// output writes a log line with the logger, through the queue if logging is asynchronous.
+// If wait is set, the line waits for space in a full queue instead of being dropped.
+func output(l *log.Logger, wait bool, format string, v ...any) {
+	queue := async.Load()
+	if queue == nil {
+		l.Printf(format, v...)
+		return
+	}
+
+	line := queuedLine{logger: l, at: time.Now(), text: fmt.Sprintf(format, v...)}
+	if wait {
+		queue.lines <- line
+		return
+	}
+
+	select {
+	case queue.lines <- line:
+	default:
+		queue.dropped.Add(1)
+	}
+}
+
+func (q *asyncQueue) flush() {
+	flushed := make(chan struct{})
+	q.lines <- queuedLine{flushed: flushed}
+	<-flushed
+}
+
+func (q *asyncQueue) run() {
+	for line := range q.lines {
+		if line.flushed != nil {
+			close(line.flushed)
+			continue
+		}
+
+		fmt.Fprintf(line.logger.Writer(), "%s%s\n", formatTime(line.at, line.logger.Flags()), line.text)
+	}
+}
+
+// formatTime formats the time like the log package does for the date and time flags.
+func formatTime(t time.Time, flags int) string {
+	var layout string
+	if flags&log.Ldate != 0 {
+		layout += "2006/01/02 "
+	}
+	if flags&(log.Ltime|log.Lmicroseconds) != 0 {
+		layout += "15:04:05"
+		if flags&log.Lmicroseconds != 0 {
+			layout += ".000000"
+		}
+		layout += " "
+	}
+	return t.Format(layout)
+}
@@ -0,0 +1,112 @@
+package logger
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useLoggers replaces the console and file loggers for the test and restores synchronous logging afterwards.
+func useLoggers(tb testing.TB, console io.Writer, file io.Writer) {
+	tb.Helper()
+
+	previousConsole, previousFile, previousLevel := consoleLogger, fileLogger, logLevel
+	consoleLogger = log.New(console, "", log.LstdFlags)
+	fileLogger = log.New(file, "", log.LstdFlags|log.Lmicroseconds)
+	tb.Cleanup(func() {
+		Flush()
+		async.Store(nil)
+		consoleLogger, fileLogger, logLevel = previousConsole, previousFile, previousLevel
+	})
+}
+
+// blockingWriter blocks every write until it is released.
+type blockingWriter struct {
+	release chan struct{}
+	mu      sync.Mutex
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func TestAsyncFlush(t *testing.T) {
+	var console bytes.Buffer
+	useLoggers(t, &console, io.Discard)
+	SetLogLevel(Debug)
+	StartAsync(64)
+
+	for range 10 {
+		Debugf("queued line")
+	}
+	Flush()
+
+	if lines := strings.Count(console.String(), "[DEBUG] queued line\n"); lines != 10 {
+		t.Errorf("Expected 10 lines after flushing, got %d:\n%s", lines, console.String())
+	}
+	if DroppedLines() != 0 {
+		t.Errorf("Expected no dropped lines, got %d", DroppedLines())
+	}
+}
+
+func TestAsyncDropsWhenFull(t *testing.T) {
+	writer := &blockingWriter{release: make(chan struct{})}
+	useLoggers(t, writer, io.Discard)
+	SetLogLevel(Trace)
+	StartAsync(4)
+
+	for range 20 {
+		Tracef("flooding line") // The writer blocks, so the queue fills up
+	}
+	if DroppedLines() == 0 {
+		t.Errorf("Expected trace lines to be dropped while the queue is full")
+	}
+
+	close(writer.release)
+	Warnf("warning") // Waits for space instead of being dropped
+	Flush()
+
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	if !strings.Contains(writer.buf.String(), "[WARN] warning") {
+		t.Errorf("Warning was dropped:\n%s", writer.buf.String())
+	}
+}
+
+// BenchmarkTraceLogging measures a datapath trace line at log level TRACE, written to a log file and the console.
+// The synchronous logger writes both lines on the calling goroutine, the asynchronous one only formats and queues them.
+func BenchmarkTraceLogging(b *testing.B) {
+	for _, mode := range []string{"sync", "async"} {
+		b.Run(mode, func(b *testing.B) {
+			console, err := os.CreateTemp(b.TempDir(), "console-*.log")
+			if err != nil {
+				b.Fatal(err)
+			}
+			file, err := os.CreateTemp(b.TempDir(), "file-*.log")
+			if err != nil {
+				b.Fatal(err)
+			}
+			useLoggers(b, console, file)
+			SetLogLevel(Trace)
+			if mode == "async" {
+				StartAsync(1 << 16)
+			}
+
+			b.ResetTimer()
+			for i := range b.N {
+				Tracef("SENT FILE %d to %v", i, "10.0.0.2")
+			}
+			b.StopTimer()
+
+			b.ReportMetric(float64(DroppedLines())/float64(b.N), "dropped/op")
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package logger
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/util/ringbuffer"
+)
+
+// HistoryLine is a recent warning or informational log line, see RecentLines.
+type HistoryLine struct {
+	Time  time.Time
+	Level LogLevel
+	Text  string // The formatted line without the level prefix
+}
+
+// history keeps the recent warning and informational lines in memory, independent of the log level and the log file.
+// Debug and trace lines aren't kept, formatting them would slow down the packet handling.
+var history struct {
+	mu    sync.Mutex
+	lines *ringbuffer.RingBuffer[HistoryLine] // nil while the history is disabled
+}
+
+// SetHistorySize keeps the last size warning and informational lines for RecentLines, 0 disables the history.
+// The lines kept so far are discarded.
+func SetHistorySize(size int) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	if size <= 0 {
+		history.lines = nil
+		return
+	}
+	history.lines = ringbuffer.New[HistoryLine](size)
+}
+
+// RecentLines returns the recent warning and informational lines, oldest first.
+// Can be called concurrently.
+func RecentLines() []HistoryLine {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	if history.lines == nil {
+		return nil
+	}
+	return history.lines.Items()
+}
+
+// remember adds a line to the history if it's enabled.
+// The format starts with the prefix of the level, e.g. "[WARN] ", it isn't kept.
+func remember(level LogLevel, format string, v ...any) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	if history.lines == nil {
+		return
+	}
+	history.lines.Push(HistoryLine{Time: time.Now(), Level: level, Text: strings.TrimPrefix(fmt.Sprintf(format, v...), "["+level.String()+"] ")})
+}
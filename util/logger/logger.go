@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"bjoernblessin.de/chatprotogol/util/assert"
 )
@@ -26,6 +29,7 @@ var consoleLogger *log.Logger
 var logFilePath string
 var enabled bool = true
 var fileEnabled bool = true
+var quiet atomic.Int32 // Number of active Quiet calls, the console only shows warnings and errors while it is positive
 
 func init() {
 	initLogger()
@@ -99,6 +103,7 @@ func (l LogLevel) String() string {
 // A newline is added to the end of the message.
 func Errorf(format string, v ...any) {
 	logFormat := fmt.Sprintf("[ERROR] %s", format)
+	Flush()
 	if fileEnabled {
 		fileLogger.Printf(logFormat, v...)
 	}
@@ -110,11 +115,12 @@ func Errorf(format string, v ...any) {
 // A newline is added to the end of the message.
 func Warnf(format string, v ...any) {
 	logFormat := fmt.Sprintf("[WARN] %s", format)
+	remember(Warn, logFormat, v...)
 	if fileEnabled {
-		fileLogger.Printf(logFormat, v...)
+		output(fileLogger, true, logFormat, v...)
 	}
 	if logLevel >= Warn {
-		consoleLogger.Printf(logFormat, v...)
+		output(consoleLogger, true, logFormat, v...)
 	}
 }
 
@@ -123,6 +129,7 @@ func Warnf(format string, v ...any) {
 // Technically you can recover from the panic, but that's not intended use.
 func Panicf(format string, v ...any) {
 	logFormat := fmt.Sprintf("[ERROR] %s", format)
+	Flush()
 	if fileEnabled {
 		fileLogger.Printf(logFormat, v...)
 	}
@@ -138,11 +145,12 @@ func Infof(format string, v ...any) {
 	}
 
 	logFormat := fmt.Sprintf("[INFO] %s", format)
+	remember(Info, logFormat, v...)
 	if fileEnabled {
-		fileLogger.Printf(logFormat, v...)
+		output(fileLogger, true, logFormat, v...)
 	}
-	if logLevel >= Info {
-		consoleLogger.Printf(logFormat, v...)
+	if consoleLevel() >= Info {
+		output(consoleLogger, true, logFormat, v...)
 	}
 }
 
@@ -155,10 +163,10 @@ func Debugf(format string, v ...any) {
 
 	logFormat := fmt.Sprintf("[DEBUG] %s", format)
 	if fileEnabled {
-		fileLogger.Printf(logFormat, v...)
+		output(fileLogger, false, logFormat, v...)
 	}
-	if logLevel >= Debug {
-		consoleLogger.Printf(logFormat, v...)
+	if consoleLevel() >= Debug {
+		output(consoleLogger, false, logFormat, v...)
 	}
 }
 
@@ -171,11 +179,127 @@ func Tracef(format string, v ...any) {
 
 	logFormat := fmt.Sprintf("[TRACE] %s", format)
 	if fileEnabled {
-		fileLogger.Printf(logFormat, v...)
+		output(fileLogger, false, logFormat, v...)
+	}
+	if consoleLevel() >= Trace {
+		output(consoleLogger, false, logFormat, v...)
+	}
+}
+
+// LimitedDebugf acts like [Debugf], but the console lines of the key are rate-limited, see SetRateLimit.
+// The key names a kind of line that can flood the console, e.g. "SENT FILE".
+func LimitedDebugf(key string, format string, v ...any) {
+	if !enabled {
+		return
+	}
+
+	logFormat := fmt.Sprintf("[DEBUG] %s", format)
+	if fileEnabled {
+		output(fileLogger, false, logFormat, v...)
+	}
+	if consoleLevel() >= Debug {
+		printLimited(key, logFormat, v...)
+	}
+}
+
+// LimitedTracef acts like [Tracef], but the console lines of the key are rate-limited, see SetRateLimit.
+// The key names a kind of line that can flood the console, e.g. "SENT FILE".
+func LimitedTracef(key string, format string, v ...any) {
+	if !enabled {
+		return
+	}
+
+	logFormat := fmt.Sprintf("[TRACE] %s", format)
+	if fileEnabled {
+		output(fileLogger, false, logFormat, v...)
+	}
+	if consoleLevel() >= Trace {
+		printLimited(key, logFormat, v...)
+	}
+}
+
+// rateLimits limits the console lines logged with a key, see SetRateLimit.
+var rateLimits = struct {
+	mu        sync.Mutex
+	perSecond int
+	keys      map[string]*keyRate
+}{keys: make(map[string]*keyRate)}
+
+// keyRate counts the console lines of a key in the current one second window.
+type keyRate struct {
+	windowStart time.Time
+	lines       int // Lines printed in the window
+	suppressed  int // Lines suppressed since the last printed line
+}
+
+// SetRateLimit limits the console lines of every key of [LimitedDebugf] and [LimitedTracef] to perSecond per second, 0 disables the limit.
+// The log file still receives all lines, the number of suppressed lines is appended to the next printed line of the key.
+func SetRateLimit(perSecond int) {
+	rateLimits.mu.Lock()
+	defer rateLimits.mu.Unlock()
+
+	rateLimits.perSecond = perSecond
+	clear(rateLimits.keys)
+}
+
+// printLimited prints the line to the console unless the rate limit of its key is exceeded.
+func printLimited(key string, logFormat string, v ...any) {
+	allowed, suppressed := allowLine(key, time.Now())
+	if !allowed {
+		return
+	}
+	if suppressed > 0 {
+		logFormat += fmt.Sprintf(" (%d similar lines suppressed)", suppressed)
+	}
+	output(consoleLogger, false, logFormat, v...)
+}
+
+// allowLine returns whether a console line of the key may be printed at now and how many lines of the key were suppressed before it.
+func allowLine(key string, now time.Time) (allowed bool, suppressed int) {
+	rateLimits.mu.Lock()
+	defer rateLimits.mu.Unlock()
+
+	if rateLimits.perSecond <= 0 {
+		return true, 0
+	}
+
+	rate, exists := rateLimits.keys[key]
+	if !exists {
+		rate = &keyRate{}
+		rateLimits.keys[key] = rate
+	}
+	if now.Sub(rate.windowStart) >= time.Second {
+		rate.windowStart = now
+		rate.lines = 0
 	}
-	if logLevel >= Trace {
-		consoleLogger.Printf(logFormat, v...)
+	if rate.lines >= rateLimits.perSecond {
+		rate.suppressed++
+		return false, 0
 	}
+
+	rate.lines++
+	suppressed = rate.suppressed
+	rate.suppressed = 0
+	return true, suppressed
+}
+
+// Quiet limits the console to warnings and errors until the returned function is called, e.g. during a bulk transfer.
+// The log file still receives all lines. Calls may overlap, the console stays quiet until all of them ended.
+func Quiet() (end func()) {
+	quiet.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { quiet.Add(-1) })
+	}
+}
+
+// consoleLevel returns the log level of the console, lowered to Warn while Quiet is active.
+func consoleLevel() LogLevel {
+	if quiet.Load() > 0 {
+		return min(logLevel, Warn)
+	}
+	return logLevel
 }
 
 // GetLogFilePath returns the path to the current log file
@@ -0,0 +1,74 @@
+package logger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	SetRateLimit(2)
+	defer SetRateLimit(0)
+
+	start := time.Unix(1700000000, 0)
+	for i := range 2 {
+		if allowed, _ := allowLine("SENT FILE", start); !allowed {
+			t.Fatalf("Line %d within the limit was suppressed", i)
+		}
+	}
+	for range 3 {
+		if allowed, _ := allowLine("SENT FILE", start.Add(500*time.Millisecond)); allowed {
+			t.Fatalf("Line exceeding the limit was printed")
+		}
+	}
+	if allowed, _ := allowLine("SENT MSG", start); !allowed {
+		t.Errorf("Line of another key was suppressed")
+	}
+
+	allowed, suppressed := allowLine("SENT FILE", start.Add(time.Second))
+	if !allowed || suppressed != 3 {
+		t.Errorf("Expected the first line of the next second to be printed with 3 suppressed lines, got %v and %d", allowed, suppressed)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	defer SetLogLevel(logLevel)
+	SetLogLevel(Debug)
+
+	endFirst := Quiet()
+	endSecond := Quiet()
+	if level := consoleLevel(); level != Warn {
+		t.Errorf("Expected console level WARN while quiet, got %v", level)
+	}
+
+	endFirst()
+	endFirst() // Ending twice must not end the other call
+	if level := consoleLevel(); level != Warn {
+		t.Errorf("Expected console level WARN until all quiet calls ended, got %v", level)
+	}
+
+	endSecond()
+	if level := consoleLevel(); level != Debug {
+		t.Errorf("Expected console level DEBUG after the quiet calls ended, got %v", level)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	SetHistorySize(2)
+	defer SetHistorySize(0)
+
+	Warnf("first %d", 1)
+	Debugf("not kept")
+	Infof("second")
+	Warnf("third")
+
+	lines := RecentLines()
+	if len(lines) != 2 || lines[0].Text != "second" || lines[0].Level != Info || lines[1].Text != "third" || lines[1].Level != Warn {
+		t.Errorf("Expected the last two warning and informational lines, got %+v", lines)
+	}
+
+	SetHistorySize(0)
+	Warnf("not kept")
+	if lines := RecentLines(); lines != nil {
+		t.Errorf("Expected no lines with the history disabled, got %+v", lines)
+	}
+}
@@ -2,24 +2,60 @@ package observer
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"bjoernblessin.de/chatprotogol/util/logger"
 )
 
+// OverflowPolicy decides what happens to a notification when a subscriber's channel buffer is full.
+type OverflowPolicy int
+
+const (
+	DropNewest OverflowPolicy = iota // The new notification is dropped
+	DropOldest                       // The oldest buffered notification is dropped to make room, the buffer acts like a ring buffer
+	Block                            // NotifyObservers waits until the subscriber has room, nothing is dropped
+)
+
+// SubscribeOptions configures a single subscription.
+type SubscribeOptions struct {
+	BufferSize int // Size of the channel buffer (0: unbuffered, 1+: size of buffer)
+	Overflow   OverflowPolicy
+}
+
+// SubscriberStats describes the state of a single subscription.
+type SubscriberStats struct {
+	BufferSize int
+	Buffered   int // Number of notifications waiting in the buffer
+	Overflow   OverflowPolicy
+	Dropped    uint64 // Number of notifications dropped for this subscriber
+}
+
+// subscription is a single subscriber channel.
+type subscription[T any] struct {
+	ch       chan T
+	options  SubscribeOptions
+	mu       sync.Mutex    // Held while sending, so the channel isn't closed during a send
+	closed   bool          // Whether ch is closed
+	done     chan struct{} // Closed on unsubscribe, releases a notification blocked on a full channel
+	dropped  atomic.Uint64
+	observed *atomic.Uint64 // Dropped notifications of the Observable, including past subscribers
+}
+
 // Observable manages a set of subscribers (channels) that receive notifications.
 type Observable[T any] struct {
-	observers  map[chan T]struct{}
+	observers  map[chan T]*subscription[T]
 	mu         sync.RWMutex
 	bufferSize int
+	dropped    atomic.Uint64
 }
 
 // NewObservable creates a new Observable instance.
-// bufferSize specifies the size of the channel buffer for each subscriber (0: unbuffered, 1+: size of buffer).
-// New messages will be discarded if the subscriber's channel is full.
+// bufferSize specifies the size of the channel buffer for each subscriber created by Subscribe (0: unbuffered, 1+: size of buffer).
+// New messages will be discarded if the subscriber's channel is full, see SubscribeWith for other behavior.
 // Example: stringObservable := NewObservable[string]() creates an observable for string events.
 func NewObservable[T any](bufferSize int) *Observable[T] {
 	return &Observable[T]{
-		observers:  make(map[chan T]struct{}),
+		observers:  make(map[chan T]*subscription[T]),
 		bufferSize: bufferSize,
 	}
 }
@@ -29,12 +65,24 @@ func NewObservable[T any](bufferSize int) *Observable[T] {
 // The channel will be closed when Unsubscribe is called or when the Observable is closed.
 // Example: msgChannel := myObservable.Subscribe() will return a new channel msgChannel that will receive notifications of type T.
 func (o *Observable[T]) Subscribe() chan T {
+	return o.SubscribeWith(SubscribeOptions{BufferSize: o.bufferSize, Overflow: DropNewest})
+}
+
+// SubscribeWith acts like Subscribe but uses the buffer size and overflow policy of options.
+// A subscriber with the Block policy must keep consuming until it unsubscribes, otherwise it stalls the notifying goroutines.
+// Example: packets := myObservable.SubscribeWith(SubscribeOptions{BufferSize: 4096, Overflow: DropOldest})
+func (o *Observable[T]) SubscribeWith(options SubscribeOptions) chan T {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 
-	ch := make(chan T, o.bufferSize)
-	o.observers[ch] = struct{}{}
-	return ch
+	sub := &subscription[T]{
+		ch:       make(chan T, options.BufferSize),
+		options:  options,
+		done:     make(chan struct{}),
+		observed: &o.dropped,
+	}
+	o.observers[sub.ch] = sub
+	return sub.ch
 }
 
 // SubscribeOnce adds a subscriber that will receive only one notification.
@@ -63,39 +111,33 @@ func (o *Observable[T]) SubscribeOnce() chan T {
 // Example: myObservable.Unsubscribe(msgChannel) will remove msgChannel from the subscribers and close it.
 func (o *Observable[T]) Unsubscribe(ch chan T) {
 	o.mu.Lock()
-	defer o.mu.Unlock()
+	sub, ok := o.observers[ch]
+	delete(o.observers, ch)
+	o.mu.Unlock()
 
-	if _, ok := o.observers[ch]; ok {
-		delete(o.observers, ch)
-		close(ch)
+	if ok {
+		sub.close()
 	}
 }
 
 // NotifyObservers sends data to all currently subscribed channels.
-// This operation is non-blocking for the Observable. If a subscriber's channel buffer is full,
-// the notification for that subscriber might be dropped to prevent blocking NotifyObservers.
+// If a subscriber's channel buffer is full, its overflow policy decides whether the new or the oldest notification is dropped
+// or whether NotifyObservers blocks until the subscriber has room.
+// Returns the number of subscribers for which a notification was dropped.
 // Example: myObservable.NotifyObservers("hello world") will send "hello world" to all subscribed channels.
-func (o *Observable[T]) NotifyObservers(data T) {
-	o.mu.RLock()
-	defer o.mu.RUnlock()
-
-	for ch := range o.observers {
-		select {
-		case ch <- data:
-		default:
-			// Subscriber channel is full or closed, skip sending to this one
-			logger.Debugf("Observable[%T](%p): Subscriber channel is full or closed, skipping notification", data, o)
+func (o *Observable[T]) NotifyObservers(data T) (dropped int) {
+	for _, sub := range o.subscriptions() {
+		if !sub.send(data, sub.options.Overflow) {
+			dropped++
 		}
 	}
+	return dropped
 }
 
-// NotifyObservers is similar to NotifyObservers but blocks until all subscribers have received the data.
+// NotifyObserversBlock is similar to NotifyObservers but blocks until all subscribers have received the data, regardless of their overflow policy.
 func (o *Observable[T]) NotifyObserversBlock(data T) {
-	o.mu.RLock()
-	defer o.mu.RUnlock()
-
-	for ch := range o.observers {
-		ch <- data
+	for _, sub := range o.subscriptions() {
+		sub.send(data, Block)
 	}
 }
 
@@ -103,10 +145,117 @@ func (o *Observable[T]) NotifyObserversBlock(data T) {
 // Example: myObservable.ClearAllSubscribers() will remove and close all subscriber channels.
 func (o *Observable[T]) ClearAllSubscribers() {
 	o.mu.Lock()
-	defer o.mu.Unlock()
-
-	for ch := range o.observers {
+	subs := make([]*subscription[T], 0, len(o.observers))
+	for ch, sub := range o.observers {
 		delete(o.observers, ch)
-		close(ch)
+		subs = append(subs, sub)
+	}
+	o.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.close()
+	}
+}
+
+// Dropped returns the number of notifications dropped for all subscribers since the Observable was created.
+func (o *Observable[T]) Dropped() uint64 {
+	return o.dropped.Load()
+}
+
+// Stats returns the state of all current subscriptions.
+func (o *Observable[T]) Stats() []SubscriberStats {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	stats := make([]SubscriberStats, 0, len(o.observers))
+	for ch, sub := range o.observers {
+		stats = append(stats, SubscriberStats{
+			BufferSize: sub.options.BufferSize,
+			Buffered:   len(ch),
+			Overflow:   sub.options.Overflow,
+			Dropped:    sub.dropped.Load(),
+		})
+	}
+	return stats
+}
+
+// subscriptions returns a snapshot of the current subscriptions.
+// Notifications are sent without holding the lock, so a blocked send doesn't block Subscribe and Unsubscribe.
+func (o *Observable[T]) subscriptions() []*subscription[T] {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	subs := make([]*subscription[T], 0, len(o.observers))
+	for _, sub := range o.observers {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// send sends data to the subscriber, handling a full buffer according to overflow.
+// Returns false if a notification was dropped.
+func (s *subscription[T]) send(data T, overflow OverflowPolicy) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return true // Unsubscribed after the snapshot was taken
+	}
+
+	switch overflow {
+	case Block:
+		select {
+		case s.ch <- data:
+		case <-s.done:
+		}
+		return true
+	case DropOldest:
+		delivered := true
+		for {
+			select {
+			case s.ch <- data:
+				return delivered
+			default:
+			}
+
+			if cap(s.ch) == 0 {
+				// Unbuffered, there is no oldest notification to make room
+				s.countDrop(data)
+				return false
+			}
+
+			select {
+			case <-s.ch:
+				s.countDrop(data)
+				delivered = false
+			default:
+				// The subscriber emptied the buffer in the meantime, try again
+			}
+		}
+	default:
+		select {
+		case s.ch <- data:
+			return true
+		default:
+			s.countDrop(data)
+			return false
+		}
 	}
 }
+
+func (s *subscription[T]) countDrop(data T) {
+	s.dropped.Add(1)
+	s.observed.Add(1)
+	logger.Debugf("Observable[%T]: Subscriber channel is full, dropped a notification (%d dropped)", data, s.dropped.Load())
+}
+
+// close closes the subscriber channel, releasing a send that is blocked on it first.
+func (s *subscription[T]) close() {
+	close(s.done)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	close(s.ch)
+}
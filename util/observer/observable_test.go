@@ -0,0 +1,92 @@
+package observer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDropNewest(t *testing.T) {
+	o := NewObservable[int](2)
+	ch := o.Subscribe()
+
+	dropped := 0
+	for i := range 3 {
+		dropped += o.NotifyObservers(i)
+	}
+
+	if dropped != 1 || o.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped notification, got %d (observable: %d)", dropped, o.Dropped())
+	}
+	if first, second := <-ch, <-ch; first != 0 || second != 1 {
+		t.Errorf("Expected the oldest notifications 0 and 1, got %d and %d", first, second)
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	o := NewObservable[int](0)
+	ch := o.SubscribeWith(SubscribeOptions{BufferSize: 2, Overflow: DropOldest})
+
+	for i := range 5 {
+		o.NotifyObservers(i)
+	}
+
+	if first, second := <-ch, <-ch; first != 3 || second != 4 {
+		t.Errorf("Expected the newest notifications 3 and 4, got %d and %d", first, second)
+	}
+
+	stats := o.Stats()
+	if len(stats) != 1 || stats[0].Dropped != 3 || stats[0].Buffered != 0 {
+		t.Errorf("Expected 3 dropped and nothing buffered, got %+v", stats)
+	}
+}
+
+func TestBlockWaitsForSubscriber(t *testing.T) {
+	o := NewObservable[int](0)
+	ch := o.SubscribeWith(SubscribeOptions{BufferSize: 1, Overflow: Block})
+
+	o.NotifyObservers(0)
+
+	notified := make(chan struct{})
+	go func() {
+		o.NotifyObservers(1)
+		close(notified)
+	}()
+
+	select {
+	case <-notified:
+		t.Fatal("Expected NotifyObservers to block while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if value := <-ch; value != 0 {
+		t.Errorf("Expected 0, got %d", value)
+	}
+	<-notified
+	if value := <-ch; value != 1 || o.Dropped() != 0 {
+		t.Errorf("Expected 1 without drops, got %d (%d dropped)", value, o.Dropped())
+	}
+}
+
+func TestUnsubscribeReleasesBlockedNotification(t *testing.T) {
+	o := NewObservable[int](0)
+	ch := o.SubscribeWith(SubscribeOptions{BufferSize: 0, Overflow: Block})
+
+	notified := make(chan struct{})
+	go func() {
+		o.NotifyObservers(0)
+		close(notified)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	o.Unsubscribe(ch)
+
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Unsubscribe to release the blocked notification")
+	}
+
+	if _, ok := <-ch; ok {
+		t.Error("Expected the channel to be closed")
+	}
+}
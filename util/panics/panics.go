@@ -0,0 +1,73 @@
+// Package panics isolates panics of goroutines that process packets or timers.
+// A panic caused by a single malformed packet or a failed assertion is recovered, logged and counted
+// instead of stopping the whole node.
+package panics
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/util/logger"
+	"bjoernblessin.de/chatprotogol/util/ringbuffer"
+)
+
+const recentReportsSize = 16 // Number of recovered panics kept for inspection
+
+// Report describes a recovered panic.
+type Report struct {
+	Time    time.Time
+	Context string // What the goroutine was doing, e.g. "processing packet from 10.0.0.2:20000"
+	Value   any    // The value passed to panic
+	Stack   string
+}
+
+var state = struct {
+	mu     sync.Mutex
+	count  int64
+	recent *ringbuffer.RingBuffer[Report]
+}{
+	recent: ringbuffer.New[Report](recentReportsSize),
+}
+
+// Recover recovers a panic of the calling goroutine, logs it with its stack trace and counts it.
+// It must be deferred directly, format and v describe what the goroutine is doing:
+//
+//	defer panics.Recover("processing packet from %v", addr)
+func Recover(format string, v ...any) {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	report := Report{
+		Time:    time.Now(),
+		Context: fmt.Sprintf(format, v...),
+		Value:   value,
+		Stack:   string(debug.Stack()),
+	}
+
+	state.mu.Lock()
+	state.count++
+	state.recent.Push(report)
+	state.mu.Unlock()
+
+	logger.Warnf("Recovered panic while %s: %v\n%s", report.Context, report.Value, report.Stack)
+}
+
+// Count returns the number of panics recovered since startup.
+func Count() int64 {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	return state.count
+}
+
+// Recent returns the most recently recovered panics, ordered from oldest to newest.
+func Recent() []Report {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	return state.recent.Items()
+}
@@ -0,0 +1,53 @@
+package panics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	before := Count()
+
+	func() {
+		defer Recover("testing %s", "recovery")
+		panic("boom")
+	}()
+
+	if Count() != before+1 {
+		t.Fatalf("Expected %d recovered panics, got %d", before+1, Count())
+	}
+
+	recent := Recent()
+	last := recent[len(recent)-1]
+	if last.Context != "testing recovery" || last.Value != "boom" {
+		t.Errorf("Unexpected report %q: %v", last.Context, last.Value)
+	}
+	if !strings.Contains(last.Stack, "TestRecover") {
+		t.Errorf("Expected the stack trace to contain the panicking function, got %s", last.Stack)
+	}
+}
+
+func TestRecoverWithoutPanic(t *testing.T) {
+	before := Count()
+
+	func() {
+		defer Recover("not panicking")
+	}()
+
+	if Count() != before {
+		t.Errorf("Expected no recovered panic, got %d", Count()-before)
+	}
+}
+
+func TestRecentIsBounded(t *testing.T) {
+	for range recentReportsSize + 5 {
+		func() {
+			defer Recover("panicking repeatedly")
+			panic("again")
+		}()
+	}
+
+	if len(Recent()) != recentReportsSize {
+		t.Errorf("Expected %d recent reports, got %d", recentReportsSize, len(Recent()))
+	}
+}
@@ -0,0 +1,52 @@
+// Package ringbuffer provides a fixed-size buffer that overwrites its oldest entries when full.
+package ringbuffer
+
+import "bjoernblessin.de/chatprotogol/util/assert"
+
+// RingBuffer stores the last N pushed values.
+// It is NOT thread-safe, callers must synchronize access themselves.
+type RingBuffer[T any] struct {
+	items []T
+	next  int // Index the next pushed value is written to
+	full  bool
+}
+
+// New creates a new RingBuffer that holds up to size values.
+func New[T any](size int) *RingBuffer[T] {
+	assert.Assert(size > 0, "ring buffer size must be positive")
+
+	return &RingBuffer[T]{
+		items: make([]T, size),
+	}
+}
+
+// Push appends a value, overwriting the oldest value if the buffer is full.
+func (b *RingBuffer[T]) Push(item T) {
+	b.items[b.next] = item
+	b.next = (b.next + 1) % len(b.items)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Len returns the number of values currently stored.
+func (b *RingBuffer[T]) Len() int {
+	if b.full {
+		return len(b.items)
+	}
+	return b.next
+}
+
+// Items returns a copy of the stored values, ordered from oldest to newest.
+func (b *RingBuffer[T]) Items() []T {
+	if !b.full {
+		result := make([]T, b.next)
+		copy(result, b.items[:b.next])
+		return result
+	}
+
+	result := make([]T, 0, len(b.items))
+	result = append(result, b.items[b.next:]...)
+	result = append(result, b.items[:b.next]...)
+	return result
+}
@@ -0,0 +1,56 @@
+package ringbuffer
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRingBuffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		pushes   []int
+		expected []int
+	}{
+		{
+			name:     "Empty",
+			size:     3,
+			pushes:   nil,
+			expected: []int{},
+		},
+		{
+			name:     "Partially filled",
+			size:     3,
+			pushes:   []int{1, 2},
+			expected: []int{1, 2},
+		},
+		{
+			name:     "Exactly full",
+			size:     3,
+			pushes:   []int{1, 2, 3},
+			expected: []int{1, 2, 3},
+		},
+		{
+			name:     "Overwrites oldest",
+			size:     3,
+			pushes:   []int{1, 2, 3, 4, 5},
+			expected: []int{3, 4, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New[int](tt.size)
+			for _, v := range tt.pushes {
+				b.Push(v)
+			}
+
+			if got := b.Items(); !slices.Equal(got, tt.expected) {
+				t.Errorf("Items() = %v, want %v", got, tt.expected)
+			}
+			if b.Len() != len(tt.expected) {
+				t.Errorf("Len() = %d, want %d", b.Len(), len(tt.expected))
+			}
+		})
+	}
+}
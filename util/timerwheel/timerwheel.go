@@ -0,0 +1,175 @@
+// Package timerwheel provides a hashed timer wheel for large numbers of timers with a coarse resolution.
+// All timers of a wheel share a single ticking goroutine instead of each allocating a runtime timer.
+package timerwheel
+
+import (
+	"sync"
+	"time"
+
+	"bjoernblessin.de/chatprotogol/util/assert"
+)
+
+// Wheel schedules functions to run after a duration, rounded up to the tick of the wheel.
+// The ticking goroutine only runs while timers are scheduled.
+// Can be used concurrently.
+type Wheel struct {
+	mu      sync.Mutex
+	tick    time.Duration
+	slots   []*Timer // Heads of the doubly linked timer lists
+	cursor  int      // Slot that was expired last
+	count   int      // Number of scheduled timers
+	running bool     // Whether the ticking goroutine runs
+}
+
+// Timer is a function scheduled on a Wheel.
+type Timer struct {
+	wheel     *Wheel
+	f         func()
+	slot      int
+	rounds    int // Number of full rotations of the wheel left before the timer expires
+	scheduled bool
+	prev      *Timer
+	next      *Timer
+}
+
+// New creates a wheel with the given tick and number of slots.
+// Durations up to tick*slots need a single rotation, longer durations are supported but expire less efficiently.
+func New(tick time.Duration, slots int) *Wheel {
+	assert.Assert(tick > 0 && slots > 0, "timer wheel tick and slots must be positive")
+
+	return &Wheel{
+		tick:  tick,
+		slots: make([]*Timer, slots),
+	}
+}
+
+// AfterFunc schedules f to run after at least d.
+// Unlike time.AfterFunc, the functions of a wheel run one after another on the ticking goroutine, so they must not block.
+func (w *Wheel) AfterFunc(d time.Duration, f func()) *Timer {
+	t := &Timer{wheel: w, f: f}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.schedule(t, d)
+	return t
+}
+
+// Len returns the number of scheduled timers.
+func (w *Wheel) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.count
+}
+
+// Stop prevents the timer from running.
+// Returns false if the timer already expired or was stopped, like time.Timer.Stop.
+func (t *Timer) Stop() bool {
+	t.wheel.mu.Lock()
+	defer t.wheel.mu.Unlock()
+
+	if !t.scheduled {
+		return false
+	}
+	t.wheel.remove(t)
+	return true
+}
+
+// Reset reschedules the timer to run after d.
+// Returns whether the timer was scheduled before, like time.Timer.Reset.
+func (t *Timer) Reset(d time.Duration) bool {
+	t.wheel.mu.Lock()
+	defer t.wheel.mu.Unlock()
+
+	wasScheduled := t.scheduled
+	if wasScheduled {
+		t.wheel.remove(t)
+	}
+	t.wheel.schedule(t, d)
+	return wasScheduled
+}
+
+// schedule adds the timer to the slot it expires in.
+// Must be called with w.mu held.
+func (w *Wheel) schedule(t *Timer, d time.Duration) {
+	ticks := max(int((d+w.tick-1)/w.tick), 1)
+
+	t.slot = (w.cursor + ticks) % len(w.slots)
+	t.rounds = (ticks - 1) / len(w.slots)
+	t.scheduled = true
+
+	t.prev = nil
+	t.next = w.slots[t.slot]
+	if t.next != nil {
+		t.next.prev = t
+	}
+	w.slots[t.slot] = t
+
+	w.count++
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+}
+
+// remove removes the timer from its slot.
+// Must be called with w.mu held.
+func (w *Wheel) remove(t *Timer) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		w.slots[t.slot] = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+
+	t.prev, t.next = nil, nil
+	t.scheduled = false
+	w.count--
+}
+
+// run advances the wheel every tick and runs the expired timers until no timers are left.
+func (w *Wheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, done := w.advance()
+
+		for _, t := range expired {
+			t.f()
+		}
+
+		if done {
+			return
+		}
+	}
+}
+
+// advance moves the cursor to the next slot and removes the timers that expire in it.
+// Returns done if no timers are left, the ticking goroutine then stops.
+func (w *Wheel) advance() (expired []*Timer, done bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.cursor = (w.cursor + 1) % len(w.slots)
+
+	for t := w.slots[w.cursor]; t != nil; {
+		next := t.next
+		if t.rounds > 0 {
+			t.rounds--
+		} else {
+			w.remove(t)
+			expired = append(expired, t)
+		}
+		t = next
+	}
+
+	if w.count == 0 {
+		w.running = false
+		return expired, true
+	}
+	return expired, false
+}
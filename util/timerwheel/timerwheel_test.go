@@ -0,0 +1,115 @@
+package timerwheel
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAfterFuncExpires(t *testing.T) {
+	w := New(time.Millisecond, 8)
+
+	fired := make(chan time.Time, 1)
+	start := time.Now()
+	w.AfterFunc(20*time.Millisecond, func() { fired <- time.Now() })
+
+	select {
+	case at := <-fired:
+		if elapsed := at.Sub(start); elapsed < 20*time.Millisecond {
+			t.Errorf("Timer expired after %v, expected at least 20ms", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timer didn't expire")
+	}
+
+	if w.Len() != 0 {
+		t.Errorf("Expected no scheduled timers, got %d", w.Len())
+	}
+}
+
+func TestStopAndReset(t *testing.T) {
+	w := New(time.Millisecond, 8)
+
+	var fired atomic.Int32
+	stopped := w.AfterFunc(5*time.Millisecond, func() { fired.Add(1) })
+	reset := w.AfterFunc(5*time.Millisecond, func() { fired.Add(10) })
+
+	if !stopped.Stop() {
+		t.Error("Expected Stop to report a scheduled timer")
+	}
+	if stopped.Stop() {
+		t.Error("Expected a second Stop to report an unscheduled timer")
+	}
+	if !reset.Reset(30 * time.Millisecond) {
+		t.Error("Expected Reset to report a scheduled timer")
+	}
+
+	time.Sleep(15 * time.Millisecond)
+	if fired.Load() != 0 {
+		t.Fatalf("Expected no timer to have expired, got %d", fired.Load())
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if fired.Load() != 10 {
+		t.Errorf("Expected only the reset timer to expire, got %d", fired.Load())
+	}
+	if reset.Reset(time.Millisecond) {
+		t.Error("Expected Reset of an expired timer to report an unscheduled timer")
+	}
+}
+
+func TestMultipleRotations(t *testing.T) {
+	w := New(time.Millisecond, 4) // One rotation takes 4ms
+
+	fired := make(chan struct{})
+	start := time.Now()
+	w.AfterFunc(25*time.Millisecond, func() { close(fired) })
+
+	select {
+	case <-fired:
+		if elapsed := time.Since(start); elapsed < 25*time.Millisecond {
+			t.Errorf("Timer expired after %v, expected at least 25ms", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timer didn't expire")
+	}
+}
+
+const outstandingTimers = 50_000
+
+// BenchmarkWheel50k schedules, resets and stops 50k timers, like open acknowledgments of a large window.
+func BenchmarkWheel50k(b *testing.B) {
+	w := New(10*time.Millisecond, 512)
+	timers := make([]*Timer, outstandingTimers)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		for i := range timers {
+			timers[i] = w.AfterFunc(2*time.Second, func() {})
+		}
+		for _, timer := range timers {
+			timer.Reset(2 * time.Second)
+		}
+		for _, timer := range timers {
+			timer.Stop()
+		}
+	}
+}
+
+// BenchmarkTimeAfterFunc50k is BenchmarkWheel50k with a runtime timer per open acknowledgment, as before the wheel.
+func BenchmarkTimeAfterFunc50k(b *testing.B) {
+	timers := make([]*time.Timer, outstandingTimers)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		for i := range timers {
+			timers[i] = time.AfterFunc(2*time.Second, func() {})
+		}
+		for _, timer := range timers {
+			timer.Reset(2 * time.Second)
+		}
+		for _, timer := range timers {
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Package utf8chunk splits text into chunks without splitting multi-byte UTF-8 sequences.
+package utf8chunk
+
+import "unicode/utf8"
+
+// Split splits data into chunks of at most maxSize bytes.
+// Chunks end at rune boundaries so that every chunk of valid UTF-8 is valid UTF-8 itself.
+// If no rune boundary is within reach (maxSize < utf8.UTFMax or invalid UTF-8), the chunk is cut at maxSize.
+// The chunks share the memory of data.
+func Split(data []byte, maxSize int) [][]byte {
+	if maxSize <= 0 {
+		panic("utf8chunk: maxSize must be positive")
+	}
+
+	chunks := make([][]byte, 0, len(data)/maxSize+1)
+
+	start := 0
+	for start < len(data) {
+		end := min(start+maxSize, len(data))
+
+		if end < len(data) {
+			boundary := end
+			for boundary > start && end-boundary < utf8.UTFMax && !utf8.RuneStart(data[boundary]) {
+				boundary--
+			}
+			if boundary > start && utf8.RuneStart(data[boundary]) {
+				end = boundary
+			}
+		}
+
+		chunks = append(chunks, data[start:end])
+		start = end
+	}
+
+	return chunks
+}
@@ -0,0 +1,83 @@
+package utf8chunk
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitKeepsRunesIntact(t *testing.T) {
+	message := []byte(strings.Repeat("Hi 👋🏽 ❤️ 家族 👨‍👩‍👧 ", 200))
+
+	for maxSize := utf8.UTFMax; maxSize <= 64; maxSize++ {
+		chunks := Split(message, maxSize)
+
+		if !bytes.Equal(bytes.Join(chunks, nil), message) {
+			t.Fatalf("maxSize %d: joined chunks differ from the message", maxSize)
+		}
+
+		for i, chunk := range chunks {
+			if len(chunk) > maxSize {
+				t.Fatalf("maxSize %d: chunk %d has %d bytes", maxSize, i, len(chunk))
+			}
+			if !utf8.Valid(chunk) {
+				t.Fatalf("maxSize %d: chunk %d is not valid UTF-8: %q", maxSize, i, chunk)
+			}
+		}
+	}
+}
+
+func TestSplitOnlyEmoji(t *testing.T) {
+	message := []byte(strings.Repeat("😀", 1000)) // 4 bytes each
+
+	chunks := Split(message, 1200)
+
+	if len(chunks) != 4 {
+		t.Fatalf("Expected 4 chunks, got %d", len(chunks))
+	}
+	for i, chunk := range chunks[:3] {
+		if len(chunk) != 1200 {
+			t.Errorf("Chunk %d: expected 1200 bytes, got %d", i, len(chunk))
+		}
+	}
+
+	chunks = Split(message, 1201)
+	if len(chunks[0]) != 1200 {
+		t.Errorf("Expected the first chunk to end at the rune boundary 1200, got %d", len(chunks[0]))
+	}
+}
+
+func TestSplitSmallMaxSize(t *testing.T) {
+	message := []byte("😀😀")
+
+	chunks := Split(message, 3) // No rune fits, fall back to byte chunks
+
+	if !bytes.Equal(bytes.Join(chunks, nil), message) {
+		t.Fatalf("Joined chunks differ from the message")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > 3 {
+			t.Errorf("Chunk %d has %d bytes", i, len(chunk))
+		}
+	}
+}
+
+func TestSplitInvalidUTF8(t *testing.T) {
+	message := bytes.Repeat([]byte{0x80}, 100) // Continuation bytes only
+
+	chunks := Split(message, 10)
+
+	if len(chunks) != 10 {
+		t.Errorf("Expected 10 chunks, got %d", len(chunks))
+	}
+	if !bytes.Equal(bytes.Join(chunks, nil), message) {
+		t.Errorf("Joined chunks differ from the message")
+	}
+}
+
+func TestSplitEmpty(t *testing.T) {
+	if chunks := Split(nil, 10); len(chunks) != 0 {
+		t.Errorf("Expected no chunks, got %d", len(chunks))
+	}
+}